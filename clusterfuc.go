@@ -2,12 +2,23 @@ package clusterfuc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
+	"github.com/calamity-m/clusterfuc/pkg/flow"
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
 	"github.com/calamity-m/clusterfuc/pkg/memoriser"
 	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/prompt"
+	"github.com/calamity-m/clusterfuc/pkg/serializer"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
 	"github.com/calamity-m/clusterfuc/pkg/tool"
 )
 
@@ -17,15 +28,66 @@ const (
 
 	Gemini2Flash     model.GeminiAiModel = "gemini-2.0-flash"
 	Gemini2FlashLite model.GeminiAiModel = "gemini-2.0-flash-lite"
+	Gemini25Flash    model.GeminiAiModel = "gemini-2.5-flash"
+	Gemini25Pro      model.GeminiAiModel = "gemini-2.5-pro"
+	// Generates images alongside text, see agent.GenerationOptions.ImageOutput
+	Gemini25FlashImage model.GeminiAiModel = "gemini-2.5-flash-image"
+
+	DeepSeekChat model.DeepSeekModel = "deepseek-chat"
+	// Returns its chain of thought as agent.AgentOutput.Thoughts
+	DeepSeekReasoner model.DeepSeekModel = "deepseek-reasoner"
+
+	MistralLarge model.MistralModel = "mistral-large-latest"
+	MistralSmall model.MistralModel = "mistral-small-latest"
+
+	CohereCommandA     model.CohereModel = "command-a-03-2025"
+	CohereCommandRPlus model.CohereModel = "command-r-plus-08-2024"
 )
 
+// A conversation passed between agents, see flow.Chain
+type Flow = flow.Flow
+
 type AgentConfig struct {
-	Client       *http.Client
-	Model        model.AIModel
-	SystemPrompt string
-	Verbose      bool
-	Auth         string
-	URL          string
+	Client              *http.Client
+	Model               model.AIModel
+	SystemPrompt        string
+	DeveloperMessages   []string
+	DynamicInstructions []agent.InstructionFunc
+	Generation          agent.GenerationOptions
+	Hooks               agent.Hooks
+	Serializer          serializer.Serializer
+	DebugSink           agent.DebugSink
+	Redact              agent.Redactor
+	Verbose             bool
+	OpenAIMiddleware    []openai.Middleware
+	GeminiMiddleware    []gemini.Middleware
+	OllamaMiddleware    []ollama.Middleware
+	CohereMiddleware    []cohere.Middleware
+	OllamaHost          string
+	HuggingFaceEndpoint string
+	Signer              signer.Signer
+	Auth                string
+	Keys                *keypool.Pool
+	Fallbacks           []agent.Fallback
+	Azure               *openai.Azure
+	OpenAIBaseURL       string
+	ChatCompletions     bool
+	Route               *openai.Route
+	Vertex              *gemini.Vertex
+	PromptCaching       bool
+	PromptCacheTTL      time.Duration
+	Prompts             prompt.Store
+	PromptName          string
+	PromptVersion       string
+	PostProcessors      []agent.PostProcessor
+	DumpFailedRequests  bool
+	ToolSelector        agent.ToolSelector
+	MaxTurnTools        int
+	Scratchpad          bool
+	HistoryRecovery     agent.HistoryRecovery
+	HistoryVersion      int
+	Migrations          map[int]agent.Migration
+	URL                 string
 }
 
 func NewAgent(cfg *AgentConfig) (*agent.Agent[model.AIModel], error) {
@@ -33,22 +95,138 @@ func NewAgent(cfg *AgentConfig) (*agent.Agent[model.AIModel], error) {
 		return nil, fmt.Errorf("nil agent config not allowed - %w", ErrAgentOptInvalid)
 	}
 
-	return &agent.Agent[model.AIModel]{
-		Client:       cfg.Client,
-		Model:        cfg.Model,
-		Memoriser:    &memoriser.NoOpMemoriser{},
-		SystemPrompt: cfg.SystemPrompt,
-		Verbose:      cfg.Verbose,
-		Auth:         cfg.Auth,
-	}, nil
+	a := &agent.Agent[model.AIModel]{
+		Client:              cfg.Client,
+		Model:               cfg.Model,
+		Memoriser:           &memoriser.NoOpMemoriser{},
+		SystemPrompt:        cfg.SystemPrompt,
+		DeveloperMessages:   cfg.DeveloperMessages,
+		DynamicInstructions: cfg.DynamicInstructions,
+		Generation:          cfg.Generation,
+		Hooks:               cfg.Hooks,
+		Serializer:          cfg.Serializer,
+		DebugSink:           cfg.DebugSink,
+		Redact:              cfg.Redact,
+		Verbose:             cfg.Verbose,
+		OpenAIMiddleware:    cfg.OpenAIMiddleware,
+		GeminiMiddleware:    cfg.GeminiMiddleware,
+		OllamaMiddleware:    cfg.OllamaMiddleware,
+		CohereMiddleware:    cfg.CohereMiddleware,
+		OllamaHost:          cfg.OllamaHost,
+		HuggingFaceEndpoint: cfg.HuggingFaceEndpoint,
+		Signer:              cfg.Signer,
+		Auth:                cfg.Auth,
+		Keys:                cfg.Keys,
+		Fallbacks:           cfg.Fallbacks,
+		Azure:               cfg.Azure,
+		OpenAIBaseURL:       cfg.OpenAIBaseURL,
+		ChatCompletions:     cfg.ChatCompletions,
+		Route:               cfg.Route,
+		Vertex:              cfg.Vertex,
+		PromptCaching:       cfg.PromptCaching,
+		PromptCacheTTL:      cfg.PromptCacheTTL,
+		Prompts:             cfg.Prompts,
+		PromptName:          cfg.PromptName,
+		PromptVersion:       cfg.PromptVersion,
+		PostProcessors:      cfg.PostProcessors,
+		DumpFailedRequests:  cfg.DumpFailedRequests,
+		ToolSelector:        cfg.ToolSelector,
+		MaxTurnTools:        cfg.MaxTurnTools,
+		HistoryRecovery:     cfg.HistoryRecovery,
+		HistoryVersion:      cfg.HistoryVersion,
+		Migrations:          cfg.Migrations,
+	}
+
+	if cfg.Scratchpad {
+		if err := a.EnableScratchpad(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Options of a one off completion, see Complete
+type CompleteOptions struct {
+	// Json schema the output must match, see agent.AgentInput.Schema
+	Schema        json.RawMessage
+	Instructions  []string
+	StopSequences []string
+	// Replaces the prompt with several entries, such as text alongside an
+	// image
+	Items []agent.InputItem
+	// Optional identifier of who the completion is for, sent to providers
+	// for abuse monitoring, see agent.AgentInput.EndUserID
+	EndUserID string
+}
+
+// Complete answers prompt with a one off call to the model cfg describes,
+// keeping no conversation. No id or Memoriser is needed, which suits quick
+// extraction with a Schema.
+func Complete(ctx context.Context, cfg *AgentConfig, prompt string, opts CompleteOptions) (agent.AgentOutput, error) {
+	a, err := NewAgent(cfg)
+	if err != nil {
+		return agent.AgentOutput{}, err
+	}
+
+	return a.Complete(ctx, agent.AgentInput{
+		UserInput:     prompt,
+		Schema:        opts.Schema,
+		Instructions:  opts.Instructions,
+		StopSequences: opts.StopSequences,
+		Items:         opts.Items,
+		EndUserID:     opts.EndUserID,
+	})
 }
 
 func RegisterTool[T any, S any](
 	a *agent.Agent[model.AIModel],
 	name string,
 	t func(ctx context.Context, in T) (S, error),
+	opts ...tool.Option,
+) error {
+
+	return a.AddTool(tool.CreateTool(name, t, opts...))
+}
+
+// RegisterService registers the exported methods of a service as tools, see
+// tool.FromMethods
+func RegisterService[I any](
+	a *agent.Agent[model.AIModel],
+	impl I,
+	descriptions map[string]string,
+	opts ...tool.Option,
 ) error {
+	tools, err := tool.FromMethods(impl, descriptions, opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tools {
+		if err := a.AddTool(t); err != nil {
+			return err
+		}
+	}
 
-	a.AddTool(tool.CreateTool(name, t))
 	return nil
 }
+
+// RegisterRemoteTool registers a tool served by another service, see
+// tool.RemoteTool
+func RegisterRemoteTool(
+	a *agent.Agent[model.AIModel],
+	remote *tool.RemoteTool,
+	opts ...tool.Option,
+) error {
+	return a.AddTool(remote.Tool(opts...))
+}
+
+// RegisterProcessTool registers a tool run as a subprocess, see
+// tool.ProcessTool
+func RegisterProcessTool(
+	a *agent.Agent[model.AIModel],
+	process *tool.ProcessTool,
+	opts ...tool.Option,
+) error {
+	return a.AddTool(process.Tool(opts...))
+}
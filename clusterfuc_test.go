@@ -3,13 +3,18 @@ package clusterfuc
 import (
 	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/calamity-m/clusterfuc/pkg/agent"
 	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
 )
 
 func TestAgentCreation(t *testing.T) {
@@ -38,6 +43,79 @@ func TestAgentCreation(t *testing.T) {
 	})
 }
 
+func TestRegisterTool(t *testing.T) {
+	type Arg struct {
+		Name string `json:"name"`
+	}
+
+	fn := func(ctx context.Context, in Arg) (Arg, error) { return in, nil }
+
+	t.Run("duplicate names fail", func(t *testing.T) {
+		a, _ := NewAgent(&AgentConfig{})
+
+		if err := RegisterTool(a, "test", fn); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if err := RegisterTool(a, "test", fn); !errors.Is(err, ErrDuplicateTool) {
+			t.Errorf("expected ErrDuplicateTool but got %v", err)
+		}
+	})
+
+	t.Run("invalid names fail", func(t *testing.T) {
+		a, _ := NewAgent(&AgentConfig{})
+
+		for _, name := range []string{"", "has space", "dotted.name", strings.Repeat("a", 65)} {
+			if err := RegisterTool(a, name, fn); !errors.Is(err, ErrInvalidTool) {
+				t.Errorf("expected ErrInvalidTool for %q but got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("tool count is limited", func(t *testing.T) {
+		a, _ := NewAgent(&AgentConfig{})
+
+		for i := range model.MAX_TOOLS_COUMT {
+			if err := RegisterTool(a, fmt.Sprintf("tool_%d", i), fn); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		if err := RegisterTool(a, "one_more", fn); !errors.Is(err, ErrExceededMaxToolCount) {
+			t.Errorf("expected ErrExceededMaxToolCount but got %v", err)
+		}
+	})
+}
+
+func TestComplete(t *testing.T) {
+	var sent *openai.CreateResponse
+	cfg := &AgentConfig{
+		Model: OpenAIChatGPT4oMini,
+		OpenAIMiddleware: []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = body
+				var resp openai.Response
+				err := json.Unmarshal([]byte(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"{\"city\":\"Perth\"}"}]}]}`), &resp)
+				return &resp, err
+			}
+		}},
+	}
+
+	output, err := Complete(context.Background(), cfg, "I live in Perth", CompleteOptions{
+		Schema: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+	})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if output.Output != `{"city":"Perth"}` {
+		t.Errorf("expected the extracted city but got %s", output.Output)
+	}
+	if sent == nil || sent.Text.Type != "json_schema" {
+		t.Errorf("expected the schema sent but got %+v", sent)
+	}
+}
+
 func TestExtendAgent(t *testing.T) {
 	// TODO adding functions to the agent via
 	// the extend function.
@@ -53,11 +131,55 @@ func TestAgentAsFunction(t *testing.T) {
 	// as a tool to another agent.
 }
 
+type recordingSink struct {
+	records []agent.DebugRecord
+}
+
+func (r *recordingSink) Debug(ctx context.Context, record agent.DebugRecord) {
+	r.records = append(r.records, record)
+}
+
 func TestAgentVerbosity(t *testing.T) {
-	// TODO test verbosity of agent. Explicit
-	// test due to the nature of this config
-	// option. Displaying user input when
-	// not wanted may be catastrophic.
+	// Explicit test due to the nature of this config
+	// option. Displaying user input when not wanted
+	// may be catastrophic.
+	secret := "my password is hunter2"
+
+	t.Run("debug records are redacted by default", func(t *testing.T) {
+		sink := &recordingSink{}
+		a, err := NewAgent(&AgentConfig{Model: OpenAIChatGPT4oMini, DebugSink: sink})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		a.Memoriser = nil
+
+		a.Call(context.Background(), agent.AgentInput{Id: "id", UserInput: secret})
+
+		if len(sink.records) == 0 {
+			t.Fatalf("expected debug records but got none")
+		}
+
+		for _, record := range sink.records {
+			if strings.Contains(record.Content, "hunter2") {
+				t.Errorf("expected user input to be redacted but got %q", record.Content)
+			}
+		}
+	})
+
+	t.Run("redaction can be disabled", func(t *testing.T) {
+		sink := &recordingSink{}
+		a, err := NewAgent(&AgentConfig{Model: OpenAIChatGPT4oMini, DebugSink: sink, Redact: agent.NoRedaction})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		a.Memoriser = nil
+
+		a.Call(context.Background(), agent.AgentInput{Id: "id", UserInput: secret})
+
+		if len(sink.records) == 0 || sink.records[0].Content != secret {
+			t.Errorf("expected unredacted input but got %#v", sink.records)
+		}
+	})
 }
 
 func TestCrazy(t *testing.T) {
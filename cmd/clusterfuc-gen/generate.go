@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const annotation = "//clusterfuc:tool"
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// An annotated function and what is needed to bind it
+type binding struct {
+	Name        string
+	Func        string
+	Description string
+	Properties  string
+	Required    []string
+}
+
+// Parses the package in dir and renders bindings for its annotated
+// functions, skipping tests and the file being generated
+func generate(dir string, fn string, out string) ([]byte, error) {
+	fset := token.NewFileSet()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") || filepath.Base(path) == out {
+			continue
+		}
+
+		file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no go files in %s", dir)
+	}
+
+	s := &schemer{types: map[string]ast.Expr{}}
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				s.types[ts.Name.Name] = ts.Type
+			}
+		}
+	}
+
+	var bindings []binding
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil || fd.Doc == nil {
+				continue
+			}
+
+			b, ok, err := s.bind(fd)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fset.Position(fd.Pos()), err)
+			}
+			if ok {
+				bindings = append(bindings, b)
+			}
+		}
+	}
+	if len(bindings) == 0 {
+		return nil, fmt.Errorf("no functions annotated with %s in %s", annotation, dir)
+	}
+
+	return render(files[0].Name.Name, fn, bindings)
+}
+
+// Reads a function's annotation, reporting whether it has one
+func (s *schemer) bind(fd *ast.FuncDecl) (binding, bool, error) {
+	var name string
+	var description []string
+	annotated := false
+
+	for _, c := range fd.Doc.List {
+		if rest, ok := strings.CutPrefix(c.Text, annotation); ok {
+			annotated = true
+			name = strings.TrimSpace(rest)
+			continue
+		}
+		description = append(description, strings.TrimSpace(strings.TrimPrefix(c.Text, "//")))
+	}
+	if !annotated {
+		return binding{}, false, nil
+	}
+
+	if name == "" {
+		name = snakeCase(fd.Name.Name)
+	}
+	if !validName.MatchString(name) {
+		return binding{}, false, fmt.Errorf("invalid tool name %q", name)
+	}
+
+	arg, err := toolArg(fd.Type)
+	if err != nil {
+		return binding{}, false, fmt.Errorf("%s: %w", fd.Name.Name, err)
+	}
+
+	schema, err := s.schema(arg, nil)
+	if err != nil {
+		return binding{}, false, fmt.Errorf("%s: %w", fd.Name.Name, err)
+	}
+
+	object, ok := schema.(*object)
+	if !ok || object.get("properties") == nil {
+		return binding{}, false, fmt.Errorf("%s: input must be a struct", fd.Name.Name)
+	}
+
+	properties, err := json.Marshal(object.get("properties"))
+	if err != nil {
+		return binding{}, false, err
+	}
+
+	required, _ := object.get("required").([]string)
+
+	return binding{
+		Name:        name,
+		Func:        fd.Name.Name,
+		Description: strings.TrimSpace(strings.Join(description, "\n")),
+		Properties:  string(properties),
+		Required:    required,
+	}, true, nil
+}
+
+// Checks a function is func(context.Context, T) (S, error), returning T
+func toolArg(ft *ast.FuncType) (ast.Expr, error) {
+	var params []ast.Expr
+	for _, field := range ft.Params.List {
+		for range max(len(field.Names), 1) {
+			params = append(params, field.Type)
+		}
+	}
+
+	var results []ast.Expr
+	if ft.Results != nil {
+		for _, field := range ft.Results.List {
+			for range max(len(field.Names), 1) {
+				results = append(results, field.Type)
+			}
+		}
+	}
+
+	if len(params) != 2 || exprString(params[0]) != "context.Context" ||
+		len(results) != 2 || exprString(results[1]) != "error" {
+		return nil, errors.New("must be func(ctx context.Context, in T) (S, error)")
+	}
+
+	return params[1], nil
+}
+
+// Works out json schemas from the syntax of types declared in the package
+type schemer struct {
+	types map[string]ast.Expr
+}
+
+// Builds the schema of a type, matching what CreateTool reflects at runtime.
+// Seen guards against recursive types, which have no finite schema.
+func (s *schemer) schema(expr ast.Expr, seen []string) (any, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return obj("type", "string"), nil
+		case "bool":
+			return obj("type", "boolean"), nil
+		case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "rune", "byte":
+			return obj("type", "integer"), nil
+		case "float32", "float64":
+			return obj("type", "number"), nil
+		case "any":
+			return true, nil
+		}
+
+		declared, ok := s.types[t.Name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %s", t.Name)
+		}
+		if slices.Contains(seen, t.Name) {
+			return nil, fmt.Errorf("recursive type %s", t.Name)
+		}
+		return s.schema(declared, append(seen, t.Name))
+
+	case *ast.StarExpr:
+		return s.schema(t.X, seen)
+
+	case *ast.ArrayType:
+		if ident, ok := t.Elt.(*ast.Ident); ok && ident.Name == "byte" {
+			return obj("type", "string", "contentEncoding", "base64"), nil
+		}
+		items, err := s.schema(t.Elt, seen)
+		if err != nil {
+			return nil, err
+		}
+		return obj("items", items, "type", "array"), nil
+
+	case *ast.MapType:
+		if ident, ok := t.Key.(*ast.Ident); !ok || ident.Name != "string" {
+			return nil, fmt.Errorf("map keys must be strings, not %s", exprString(t.Key))
+		}
+		values, err := s.schema(t.Value, seen)
+		if err != nil {
+			return nil, err
+		}
+		return obj("additionalProperties", values, "type", "object"), nil
+
+	case *ast.InterfaceType:
+		if t.Methods != nil && len(t.Methods.List) > 0 {
+			return nil, errors.New("interfaces with methods are unsupported")
+		}
+		return true, nil
+
+	case *ast.SelectorExpr:
+		switch exprString(t) {
+		case "time.Time":
+			return obj("type", "string", "format", "date-time"), nil
+		case "json.RawMessage":
+			return true, nil
+		}
+		return nil, fmt.Errorf("unsupported type %s, only types from this package can be used", exprString(t))
+
+	case *ast.StructType:
+		properties := obj()
+		var required []string
+		if err := s.fields(t, seen, properties, &required); err != nil {
+			return nil, err
+		}
+
+		schema := obj("properties", properties, "additionalProperties", false, "type", "object")
+		if len(required) > 0 {
+			schema.set("required", required)
+		}
+		return schema, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %s", exprString(expr))
+}
+
+// Adds a struct's fields to properties, flattening embedded structs as
+// encoding/json does
+func (s *schemer) fields(st *ast.StructType, seen []string, properties *object, required *[]string) error {
+	for _, field := range st.Fields.List {
+		tag := reflect.StructTag("")
+		if field.Tag != nil {
+			tag = reflect.StructTag(strings.Trim(field.Tag.Value, "`"))
+		}
+
+		name, opts, _ := strings.Cut(tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+
+		if len(field.Names) == 0 && name == "" {
+			embedded := field.Type
+			if star, ok := embedded.(*ast.StarExpr); ok {
+				embedded = star.X
+			}
+			ident, ok := embedded.(*ast.Ident)
+			if !ok {
+				return fmt.Errorf("unsupported embedded type %s", exprString(field.Type))
+			}
+			inner, ok := s.types[ident.Name].(*ast.StructType)
+			if !ok {
+				return fmt.Errorf("embedded type %s must be a struct", ident.Name)
+			}
+			if err := s.fields(inner, append(seen, ident.Name), properties, required); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, ident := range field.Names {
+			if !ident.IsExported() {
+				continue
+			}
+
+			key := name
+			if key == "" {
+				key = ident.Name
+			}
+
+			schema, err := s.schema(field.Type, seen)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", ident.Name, err)
+			}
+
+			settings := schemaTag(tag.Get("jsonschema"))
+			if description, ok := settings["description"]; ok {
+				if o, ok := schema.(*object); ok {
+					o.set("description", description)
+				}
+			}
+
+			_, forced := settings["required"]
+			if forced || !slices.Contains(strings.Split(opts, ","), "omitempty") {
+				*required = append(*required, key)
+			}
+
+			properties.set(key, schema)
+		}
+	}
+
+	return nil
+}
+
+// Parses a jsonschema tag of comma separated key=value settings
+func schemaTag(tag string) map[string]string {
+	settings := map[string]string{}
+	if tag == "" {
+		return settings
+	}
+
+	for _, setting := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(setting, "=")
+		settings[key] = value
+	}
+
+	return settings
+}
+
+func exprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// A json object that keeps its keys in order, so generated code is stable
+type object struct {
+	keys   []string
+	values map[string]any
+}
+
+func obj(pairs ...any) *object {
+	o := &object{values: map[string]any{}}
+	for i := 0; i < len(pairs); i += 2 {
+		o.set(pairs[i].(string), pairs[i+1])
+	}
+	return o
+}
+
+func (o *object) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *object) get(key string) any {
+	return o.values[key]
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func render(pkg string, fn string, bindings []binding) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "// Code generated by clusterfuc-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	fmt.Fprintf(&buf, "import (\n\t\"encoding/json\"\n\n\t\"github.com/calamity-m/clusterfuc/pkg/tool\"\n)\n\n")
+	fmt.Fprintf(&buf, "// %s returns the tools annotated with clusterfuc:tool in this package\n", fn)
+	fmt.Fprintf(&buf, "func %s(opts ...tool.Option) []tool.Tool[any, any] {\n", fn)
+	fmt.Fprintf(&buf, "\ttools := []tool.Tool[any, any]{\n")
+	for _, b := range bindings {
+		fmt.Fprintf(&buf, "\t\ttool.Bind(%q, %s, tool.JSONSchemaSubset{\n", b.Name, b.Func)
+		fmt.Fprintf(&buf, "\t\t\tProperties: json.RawMessage(%s),\n", quote(b.Properties))
+		if len(b.Required) > 0 {
+			fmt.Fprintf(&buf, "\t\t\tRequired: %#v,\n", b.Required)
+		}
+		fmt.Fprintf(&buf, "\t\t}, tool.WithDescription(%q)),\n", b.Description)
+	}
+	fmt.Fprintf(&buf, "\t}\n\n")
+	fmt.Fprintf(&buf, "\tfor i := range tools {\n\t\tfor _, opt := range opts {\n\t\t\topt(&tools[i])\n\t\t}\n\t}\n\n")
+	fmt.Fprintf(&buf, "\treturn tools\n}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code - %w", err)
+	}
+
+	return src, nil
+}
+
+// Quotes a string as a raw string literal where possible, keeping json
+// readable
+func quote(s string) string {
+	if strings.Contains(s, "`") {
+		return strconv.Quote(s)
+	}
+
+	return "`" + s + "`"
+}
+
+// GetUserByID becomes get_user_by_id, and HTTPStatus http_status
+func snakeCase(name string) string {
+	runes := []rune(name)
+
+	var sb strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Mirrors testdata/weather, so generated schemas can be checked against
+// what CreateTool reflects
+type Place struct {
+	City    string `json:"city" jsonschema:"description=the city"`
+	Country string `json:"country,omitempty"`
+}
+
+type Query struct {
+	Place
+	Days    int                `json:"days,omitempty"`
+	Tags    []string           `json:"tags"`
+	Weights map[string]float64 `json:"weights"`
+	From    *time.Time         `json:"from"`
+	Raw     []byte             `json:"raw"`
+	Extra   any                `json:"extra"`
+}
+
+func TestGenerate(t *testing.T) {
+	src, err := generate("testdata/weather", "Tools", "clusterfuc_tools.go")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	code := string(src)
+	for _, want := range []string{
+		"// Code generated by clusterfuc-gen. DO NOT EDIT.",
+		"package weather",
+		`tool.Bind("get_forecast", GetForecast,`,
+		`tool.WithDescription("Forecasts the weather for a place")`,
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("expected generated code to contain %s but got\n%s", want, code)
+		}
+	}
+
+	if strings.Contains(code, "Unbound") {
+		t.Errorf("expected unannotated functions to be skipped but got\n%s", code)
+	}
+
+	t.Run("schema matches reflection", func(t *testing.T) {
+
+		reflected := tool.CreateTool("get_forecast", func(ctx context.Context, in Query) (string, error) { return "", nil })
+		want, _ := json.Marshal(reflected.Definition.Properties)
+
+		start := strings.Index(code, "json.RawMessage(`") + len("json.RawMessage(`")
+		got := code[start : start+strings.Index(code[start:], "`")]
+
+		var gotSchema, wantSchema any
+		json.Unmarshal([]byte(got), &gotSchema)
+		json.Unmarshal(want, &wantSchema)
+		if !reflect.DeepEqual(gotSchema, wantSchema) {
+			t.Errorf("expected %s but got %s", want, got)
+		}
+
+		if !strings.Contains(code, `[]string{"city", "tags", "weights", "from", "raw", "extra"}`) {
+			t.Errorf("expected required to match reflection %v but got\n%s", reflected.Definition.Required, code)
+		}
+	})
+
+	t.Run("bad signatures fail", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "bad.go"), []byte("package bad\n\n//clusterfuc:tool\nfunc Bad(in string) string { return in }\n"), 0o644)
+
+		if _, err := generate(dir, "Tools", "clusterfuc_tools.go"); err == nil || !strings.Contains(err.Error(), "must be func") {
+			t.Errorf("expected a signature err but got %v", err)
+		}
+	})
+
+	t.Run("unsupported types fail", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "bad.go"), []byte("package bad\n\nimport (\"context\"; \"net/http\")\n\ntype In struct { R *http.Request `json:\"r\"` }\n\n//clusterfuc:tool\nfunc Bad(ctx context.Context, in In) (string, error) { return \"\", nil }\n"), 0o644)
+
+		if _, err := generate(dir, "Tools", "clusterfuc_tools.go"); err == nil || !strings.Contains(err.Error(), "http.Request") {
+			t.Errorf("expected an unsupported type err but got %v", err)
+		}
+	})
+}
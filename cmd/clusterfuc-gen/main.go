@@ -0,0 +1,42 @@
+// Command clusterfuc-gen generates tool bindings for functions annotated
+// with a clusterfuc:tool comment, working out their schemas at build time
+// rather than reflecting them at runtime. Run it from a package with
+//
+//	//go:generate go run github.com/calamity-m/clusterfuc/cmd/clusterfuc-gen
+//
+// and annotate functions shaped like func(ctx context.Context, in T) (S, error),
+// where T is a struct declared in the same package:
+//
+//	// Looks up the weather for a city
+//	//clusterfuc:tool get_weather
+//	func Weather(ctx context.Context, in WeatherInput) (Forecast, error)
+//
+// The name is optional, defaulting to the function's in snake case, and the
+// rest of the doc comment describes the tool. The generated Tools function
+// returns every annotated tool.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "package directory to scan")
+	out := flag.String("out", "clusterfuc_tools.go", "file to write, relative to dir")
+	fn := flag.String("func", "Tools", "name of the generated function")
+	flag.Parse()
+
+	src, err := generate(*dir, *fn, *out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "clusterfuc-gen: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(filepath.Join(*dir, *out), src, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "clusterfuc-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
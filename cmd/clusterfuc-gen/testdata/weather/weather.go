@@ -0,0 +1,38 @@
+package weather
+
+import (
+	"context"
+	"time"
+)
+
+type Place struct {
+	City    string `json:"city" jsonschema:"description=the city"`
+	Country string `json:"country,omitempty"`
+}
+
+type Query struct {
+	Place
+	Days    int                `json:"days,omitempty"`
+	Tags    []string           `json:"tags"`
+	Weights map[string]float64 `json:"weights"`
+	From    *time.Time         `json:"from"`
+	Raw     []byte             `json:"raw"`
+	Extra   any                `json:"extra"`
+	ignored string
+}
+
+type Forecast struct {
+	Summary string `json:"summary"`
+}
+
+// Forecasts the weather for a place
+//
+//clusterfuc:tool get_forecast
+func GetForecast(ctx context.Context, in Query) (Forecast, error) {
+	return Forecast{Summary: "sunny in " + in.City}, nil
+}
+
+// Not annotated, so left alone
+func Unbound(ctx context.Context, in Query) (Forecast, error) {
+	return Forecast{}, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/serializer"
+)
+
+// Longest tool arguments, outputs and thoughts printed without -full
+const maxSnippet = 200
+
+type inspectOptions struct {
+	// Only sessions whose id starts with this
+	Prefix string
+	// Only sessions of this end user
+	User string
+	// Only sessions updated within this range, zero for no bound
+	Since time.Time
+	Until time.Time
+	// Prices per million tokens, for estimating cost
+	InputPrice  float64
+	OutputPrice float64
+	// Print tool arguments, outputs and thoughts in full
+	Full bool
+}
+
+// A Memoriser whose sessions can be enumerated
+type store interface {
+	memoriser.Memoriser
+	memoriser.Lister
+}
+
+func inspectCommand(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	dir := flags.String("dir", "", "directory of sessions written by memoriser.FileMemoriser")
+	key := flags.String("key", "", "hex encoded key sessions were encrypted with, if any")
+	prefix := flags.String("id", "", "only sessions whose id starts with this")
+	user := flags.String("user", "", "only sessions of this end user")
+	since := flags.String("since", "", "only sessions updated on or after this date, as 2006-01-02")
+	until := flags.String("until", "", "only sessions updated on or before this date, as 2006-01-02")
+	inputPrice := flags.Float64("input-price", 0, "price per million input tokens, for estimating cost")
+	outputPrice := flags.Float64("output-price", 0, "price per million output tokens, for estimating cost")
+	full := flags.Bool("full", false, "print tool arguments, outputs and thoughts in full")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+	if info, err := os.Stat(*dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory of sessions", *dir)
+	}
+
+	opts := inspectOptions{
+		Prefix:      *prefix,
+		User:        *user,
+		InputPrice:  *inputPrice,
+		OutputPrice: *outputPrice,
+		Full:        *full,
+	}
+
+	var err error
+	if *since != "" {
+		if opts.Since, err = time.Parse(time.DateOnly, *since); err != nil {
+			return fmt.Errorf("invalid -since - %w", err)
+		}
+	}
+	if *until != "" {
+		if opts.Until, err = time.Parse(time.DateOnly, *until); err != nil {
+			return fmt.Errorf("invalid -until - %w", err)
+		}
+		// The whole of the day
+		opts.Until = opts.Until.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	var ser serializer.Serializer = serializer.JSONSerializer{}
+	if *key != "" {
+		decoded, err := hex.DecodeString(*key)
+		if err != nil {
+			return fmt.Errorf("invalid -key - %w", err)
+		}
+		if ser, err = serializer.NewEncryptedSerializer(decoded); err != nil {
+			return err
+		}
+	}
+
+	return inspect(w, &memoriser.FileMemoriser{Dir: *dir}, ser, opts)
+}
+
+// Prints every session matching opts. Sessions that can't be read are noted
+// and skipped rather than stopping the rest from being printed.
+func inspect(w io.Writer, mem store, ser serializer.Serializer, opts inspectOptions) error {
+	ids, err := mem.List(opts.Prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions - %w", err)
+	}
+	slices.Sort(ids)
+
+	shown := 0
+	for _, id := range ids {
+		session, err := readSession(mem, ser, id)
+		if err != nil {
+			fmt.Fprintf(w, "== %s\ncan't be read - %v\n\n", id, err)
+			continue
+		}
+
+		if !opts.matches(session) {
+			continue
+		}
+
+		printSession(w, id, session, opts)
+		shown++
+	}
+
+	fmt.Fprintf(w, "%d of %d sessions\n", shown, len(ids))
+
+	return nil
+}
+
+func readSession(mem memoriser.Memoriser, ser serializer.Serializer, id string) (agent.Session, error) {
+	stored, err := mem.Retrieve(id)
+	if err != nil {
+		return agent.Session{}, err
+	}
+
+	data, err := ser.Deserialize(stored)
+	if err != nil {
+		return agent.Session{}, fmt.Errorf("failed to deserialize - %w", err)
+	}
+
+	var session agent.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return agent.Session{}, fmt.Errorf("failed to decode - %w", err)
+	}
+
+	// Saved before the session format, as just the provider body
+	if session.Version == 0 {
+		session = agent.Session{History: data}
+	}
+
+	return session, nil
+}
+
+func (o inspectOptions) matches(session agent.Session) bool {
+	if o.User != "" && session.EndUserID != o.User {
+		return false
+	}
+	if !o.Since.IsZero() && (session.UpdatedAt.IsZero() || session.UpdatedAt.Before(o.Since)) {
+		return false
+	}
+	if !o.Until.IsZero() && (session.UpdatedAt.IsZero() || session.UpdatedAt.After(o.Until)) {
+		return false
+	}
+
+	return true
+}
+
+func printSession(w io.Writer, id string, session agent.Session, opts inspectOptions) {
+	fmt.Fprintf(w, "== %s\n", id)
+
+	details := []string{}
+	if session.EndUserID != "" {
+		details = append(details, "user "+session.EndUserID)
+	}
+	if session.Model != "" {
+		details = append(details, "model "+session.Model)
+	}
+	details = append(details, fmt.Sprintf("turns %d", session.Turns))
+	if !session.CreatedAt.IsZero() {
+		details = append(details, "created "+session.CreatedAt.Format(time.DateTime))
+	}
+	if !session.UpdatedAt.IsZero() {
+		details = append(details, "updated "+session.UpdatedAt.Format(time.DateTime))
+	}
+	fmt.Fprintln(w, strings.Join(details, "  "))
+
+	usage := session.Usage
+	line := fmt.Sprintf("usage %d input (%d cached, %.0f%%)  %d output (%d reasoning)  %d total", usage.InputTokens, usage.CachedTokens, usage.CacheRatio()*100, usage.OutputTokens, usage.ReasoningTokens, usage.TotalTokens)
+	if opts.InputPrice > 0 || opts.OutputPrice > 0 {
+		cost := (float64(usage.InputTokens)*opts.InputPrice + float64(usage.OutputTokens)*opts.OutputPrice) / 1_000_000
+		line += fmt.Sprintf("  cost $%.4f", cost)
+	}
+	fmt.Fprintln(w, line)
+
+	if len(session.Metadata) > 0 {
+		pairs := make([]string, 0, len(session.Metadata))
+		for _, k := range slices.Sorted(maps.Keys(session.Metadata)) {
+			pairs = append(pairs, k+"="+session.Metadata[k])
+		}
+		fmt.Fprintf(w, "metadata %s\n", strings.Join(pairs, " "))
+	}
+
+	if err := printTranscript(w, session.History, opts.Full); err != nil {
+		fmt.Fprintf(w, "history can't be read - %v\n", err)
+	}
+
+	fmt.Fprintln(w)
+}
+
+// Prints history turn by turn, whichever provider it came from
+func printTranscript(w io.Writer, history json.RawMessage, full bool) error {
+	if len(history) == 0 {
+		return nil
+	}
+
+	var body struct {
+		Input    []json.RawMessage `json:"input"`
+		Contents []gemini.Content  `json:"contents"`
+		// Ollama and cohere messages, whose tool call arguments are an
+		// object and a json string respectively
+		Messages []struct {
+			Role      string `json:"role"`
+			Content   string `json:"content"`
+			Thinking  string `json:"thinking"`
+			ToolCalls []struct {
+				Function struct {
+					Name      string `json:"name"`
+					Arguments any    `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(history, &body); err != nil {
+		return err
+	}
+
+	snippet := func(text string) string {
+		text = strings.TrimSpace(text)
+		if full || len(text) <= maxSnippet {
+			return text
+		}
+		return text[:maxSnippet] + "..."
+	}
+
+	turn := 0
+	userTurn := func(text string) {
+		turn++
+		fmt.Fprintf(w, "[%d] user: %s\n", turn, text)
+	}
+
+	for _, raw := range body.Input {
+		var item struct {
+			Type      string                    `json:"type"`
+			Role      string                    `json:"role"`
+			Name      string                    `json:"name"`
+			Arguments any                       `json:"arguments"`
+			Output    string                    `json:"output"`
+			Content   []openai.MessageContent   `json:"content"`
+			Summary   []openai.ReasoningSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return err
+		}
+
+		switch item.Type {
+		case "message":
+			var text, refusal string
+			for _, content := range item.Content {
+				text += content.Text
+				refusal += content.Refusal
+			}
+
+			switch {
+			case item.Role == "user":
+				userTurn(text)
+			case refusal != "":
+				fmt.Fprintf(w, "    assistant refused: %s\n", refusal)
+			default:
+				fmt.Fprintf(w, "    assistant: %s\n", text)
+			}
+		case "function_call":
+			args, _ := item.Arguments.(string)
+			fmt.Fprintf(w, "    tool %s %s\n", item.Name, snippet(args))
+		case "function_call_output":
+			fmt.Fprintf(w, "      -> %s\n", snippet(item.Output))
+		case "reasoning":
+			var thoughts string
+			for _, summary := range item.Summary {
+				thoughts += summary.Text
+			}
+			if thoughts != "" {
+				fmt.Fprintf(w, "    thought: %s\n", snippet(thoughts))
+			}
+		default:
+			fmt.Fprintf(w, "    %s item\n", item.Type)
+		}
+	}
+
+	for _, content := range body.Contents {
+		for _, part := range content.Parts {
+			switch {
+			case part.FunctionCall.Name != "":
+				args, _ := json.Marshal(part.FunctionCall.Args)
+				fmt.Fprintf(w, "    tool %s %s\n", part.FunctionCall.Name, snippet(string(args)))
+			case part.FunctionResponse.Name != "":
+				response, _ := json.Marshal(part.FunctionResponse.Response)
+				fmt.Fprintf(w, "      -> %s\n", snippet(string(response)))
+			case part.InlineData != nil:
+				fmt.Fprintf(w, "    %s: %s attachment\n", content.Role, part.InlineData.MimeType)
+			case part.Thought:
+				fmt.Fprintf(w, "    thought: %s\n", snippet(part.Text))
+			case content.Role == "model":
+				fmt.Fprintf(w, "    assistant: %s\n", part.Text)
+			default:
+				userTurn(part.Text)
+			}
+		}
+	}
+
+	for _, message := range body.Messages {
+		if message.Thinking != "" {
+			fmt.Fprintf(w, "    thought: %s\n", snippet(message.Thinking))
+		}
+
+		switch {
+		case message.Role == "user":
+			userTurn(message.Content)
+		case message.Role == "tool":
+			fmt.Fprintf(w, "      -> %s\n", snippet(message.Content))
+		case len(message.ToolCalls) > 0:
+			for _, call := range message.ToolCalls {
+				args, ok := call.Function.Arguments.(string)
+				if !ok {
+					encoded, _ := json.Marshal(call.Function.Arguments)
+					args = string(encoded)
+				}
+				fmt.Fprintf(w, "    tool %s %s\n", call.Function.Name, snippet(args))
+			}
+		default:
+			fmt.Fprintf(w, "    assistant: %s\n", message.Content)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/serializer"
+)
+
+func TestInspect(t *testing.T) {
+	mem, err := memoriser.NewFileMemoriser(t.TempDir())
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	mem.Save("support/1", json.RawMessage(`{"version":1,"model":"gpt-4o-mini","end_user_id":"alice","turns":1,
+		"updated_at":"2026-10-16T09:00:00Z","metadata":{"tenant":"a"},"usage":{"input_tokens":1000000,"output_tokens":500000,"total_tokens":1500000},
+		"history":{"input":[
+			{"type":"message","role":"user","content":[{"type":"input_text","text":"weather in Perth?"}]},
+			{"type":"function_call","call_id":"call_1","name":"weather","arguments":"{\"city\":\"Perth\"}"},
+			{"type":"function_call_output","call_id":"call_1","output":"\"sunny\""},
+			{"type":"message","role":"assistant","content":[{"type":"output_text","text":"It is sunny"}]}
+		]}}`))
+	mem.Save("support/2", json.RawMessage(`{"version":1,"model":"gemini-2.5-flash","end_user_id":"bob","turns":1,
+		"updated_at":"2026-09-01T09:00:00Z",
+		"history":{"contents":[
+			{"role":"user","parts":[{"text":"hello"}]},
+			{"role":"model","parts":[{"text":"hi there"}]}
+		]}}`))
+	mem.Save("support/3", json.RawMessage(`not json`))
+
+	run := func(opts inspectOptions) string {
+		var out bytes.Buffer
+		if err := inspect(&out, mem, serializer.JSONSerializer{}, opts); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		return out.String()
+	}
+
+	t.Run("prints every session", func(t *testing.T) {
+		out := run(inspectOptions{InputPrice: 0.15, OutputPrice: 0.6})
+
+		for _, want := range []string{
+			"== support/1\nuser alice  model gpt-4o-mini  turns 1  updated 2026-10-16 09:00:00",
+			"cost $0.4500",
+			"metadata tenant=a",
+			`[1] user: weather in Perth?`,
+			`    tool weather {"city":"Perth"}`,
+			`      -> "sunny"`,
+			"    assistant: It is sunny",
+			"== support/2",
+			"[1] user: hello\n    assistant: hi there",
+			"== support/3\ncan't be read",
+			"2 of 3 sessions",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("expected output to contain %q but got\n%s", want, out)
+			}
+		}
+	})
+
+	t.Run("filters by user and date", func(t *testing.T) {
+		out := run(inspectOptions{User: "alice"})
+		if strings.Contains(out, "== support/2") || !strings.Contains(out, "== support/1") {
+			t.Errorf("expected only alice's session but got\n%s", out)
+		}
+
+		if err := inspectCommand([]string{"-dir", mem.Dir, "-since", "2026-10-01", "-until", "2026-10-16"}, &bytes.Buffer{}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var cmd bytes.Buffer
+		inspectCommand([]string{"-dir", mem.Dir, "-id", "support/", "-until", "2026-09-30"}, &cmd)
+		if !strings.Contains(cmd.String(), "== support/2") || strings.Contains(cmd.String(), "== support/1") {
+			t.Errorf("expected only the september session but got\n%s", cmd.String())
+		}
+	})
+
+	t.Run("requires a directory", func(t *testing.T) {
+		if err := inspectCommand([]string{}, &bytes.Buffer{}); err == nil {
+			t.Errorf("expected err without -dir")
+		}
+	})
+}
@@ -0,0 +1,43 @@
+// Command clusterfuc holds tools for operating agents built with clusterfuc.
+//
+//	clusterfuc inspect -dir ./sessions -user alice -since 2026-10-01
+//
+// inspect pretty prints stored sessions, their turns, tool calls, usage and
+// cost, for triaging reports of an agent saying something odd. Sessions are
+// read from a directory written by memoriser.FileMemoriser.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: clusterfuc <command> [flags]
+
+commands:
+  inspect    pretty print stored sessions
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "inspect":
+		err = inspectCommand(os.Args[2:], os.Stdout)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "clusterfuc: unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "clusterfuc %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -5,11 +5,19 @@ import (
 
 	"github.com/calamity-m/clusterfuc/pkg/agent"
 	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/prompt"
 )
 
 var (
-	ErrExceededMaxToolCount = errors.New("exceeded max tool count")
-	ErrAgentOptInvalid      = errors.New("invalid agent option was passed")
-	ErrModelUnmatched       = agent.ErrModelUnmatched
-	ErrInvalidGeminiContent = gemini.ErrInvalidGeminiContent
+	ErrExceededMaxToolCount    = agent.ErrExceededMaxToolCount
+	ErrDuplicateTool           = agent.ErrDuplicateTool
+	ErrInvalidTool             = agent.ErrInvalidTool
+	ErrAgentOptInvalid         = errors.New("invalid agent option was passed")
+	ErrInvalidPreset           = errors.New("invalid preset")
+	ErrUnknownPreset           = errors.New("unknown preset")
+	ErrModelUnmatched          = agent.ErrModelUnmatched
+	ErrInvalidGeminiContent    = gemini.ErrInvalidGeminiContent
+	ErrPromptBlocked           = gemini.ErrPromptBlocked
+	ErrInvalidStructuredOutput = agent.ErrInvalidStructuredOutput
+	ErrPromptNotFound          = prompt.ErrPromptNotFound
 )
@@ -2,12 +2,16 @@ module github.com/calamity-m/clusterfuc
 
 go 1.24.0
 
-require github.com/invopop/jsonschema v0.13.0
+require (
+	github.com/coder/websocket v1.8.14
+	github.com/invopop/jsonschema v0.13.0
+	github.com/tetratelabs/wazero v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
 	github.com/buger/jsonparser v1.1.1 // indirect
 	github.com/mailru/easyjson v0.9.0 // indirect
 	github.com/wk8/go-ordered-map/v2 v2.1.8 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -2,24 +2,47 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
 	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
 	"github.com/calamity-m/clusterfuc/pkg/memoriser"
 	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
 	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/prompt"
+	"github.com/calamity-m/clusterfuc/pkg/quota"
+	"github.com/calamity-m/clusterfuc/pkg/serializer"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
 	"github.com/calamity-m/clusterfuc/pkg/tool"
 )
 
 var (
-	ErrModelUnmatched   = errors.New("model could not be matched")
-	ErrInvalidId        = errors.New("invalid id")
-	ErrInvalidUserInput = errors.New("invalid user input")
-	ErrNilMemoriser     = errors.New("nil memoriser")
+	ErrModelUnmatched       = errors.New("model could not be matched")
+	ErrInvalidId            = errors.New("invalid id")
+	ErrInvalidUserInput     = errors.New("invalid user input")
+	ErrNilMemoriser         = errors.New("nil memoriser")
+	ErrInvalidMetadata      = errors.New("invalid metadata")
+	ErrInvalidToolChoice    = errors.New("invalid tool choice")
+	ErrInvalidStopSequences = errors.New("invalid stop sequences")
+	ErrExceededMaxToolCount = errors.New("exceeded max tool count")
+	ErrDuplicateTool        = errors.New("duplicate tool")
+	ErrInvalidTool          = errors.New("invalid tool")
+	ErrInvalidLabels        = errors.New("invalid labels")
+	// The model's provider can't do what the call or agent asked of it
+	ErrUnsupportedOption = errors.New("unsupported option")
+	// The model's output did not match the schema, even after repairing it
+	// and asking again
+	ErrInvalidStructuredOutput = errors.New("invalid structured output")
 )
 
 // T model type, drives what agent this will be
@@ -30,17 +53,341 @@ type Agent[T model.AIModel] struct {
 	//
 	// The tool package provides a helper wrapper for turning any
 	// function into this style
-	tools        []tool.Tool[any, any]
-	Memoriser    memoriser.Memoriser
+	tools     []tool.Tool[any, any]
+	Memoriser memoriser.Memoriser
+	// Converts history to and from what the Memoriser stores. Defaults
+	// to storing the raw json of the provider request.
+	Serializer serializer.Serializer
+	// Client used to reach providers. Defaults to httpclient.Default.
 	Client       *http.Client
 	SystemPrompt string
-	Model        model.AIModel
-	Auth         string
+	// Optional messages sent every call with the developer role, apart
+	// from the system prompt openai receives as its instructions. They
+	// lead the conversation rather than being stored in history. Providers
+	// without a developer role, such as gemini, receive them as system
+	// instructions following the system prompt.
+	DeveloperMessages []string
+	// Instructions computed on every call and sent alongside the system
+	// prompt, such as the current date or a user profile. Gemini receives
+	// each as its own system instruction part, openai receives them joined
+	// onto the end of its instructions.
+	DynamicInstructions []InstructionFunc
+	// Optional tuning of how the model generates
+	Generation GenerationOptions
+	Model      model.AIModel
+	Auth       string
+	// Optional pool of api keys rotated between instead of Auth, for
+	// spreading load across keys. Ollama takes no keys, failing calls with
+	// ErrUnsupportedOption.
+	Keys *keypool.Pool
+	// Models tried in order when a call fails from the model's provider
+	// being rate limited, failing or timing out, see Fallback
+	Fallbacks []Fallback
+	// Optional destination for typed diagnostics about each call
+	DebugSink DebugSink
+	// Applied to debug record content before it reaches the DebugSink.
+	// Defaults to RedactContent.
+	Redact Redactor
 	// Verbose will print user input, which may
 	// be a cause for concern
+	//
+	// Deprecated: set DebugSink instead. Without a DebugSink, Verbose logs
+	// unredacted records through slog.
 	Verbose bool
+	// Optional callbacks into the lifecycle of a call
+	Hooks Hooks
+	// Optional policy shrinking tool outputs in stored history once the
+	// turn that produced them completes, keeping long sessions from
+	// growing quadratically. See TruncateToolOutputs.
+	CompactToolOutput CompactFunc
+	// Optional limit on the prompt tokens history may take up. The oldest
+	// turns are dropped before a call once history is estimated to exceed
+	// it, with estimates calibrated by the token counts providers report.
+	// Defaults to the model's context window when it's known, see
+	// Capabilities.
+	MaxHistoryTokens int
+	// Stores beyond the Memoriser holding end user data, included in
+	// ExportAllForUser and DeleteAllForUser
+	UserDataStores []UserDataStore
+	// Optional middleware wrapping each request to the provider, with access
+	// to the typed request and response bodies. Only the middleware for the
+	// agent's provider is used.
+	OpenAIMiddleware []openai.Middleware
+	GeminiMiddleware []gemini.Middleware
+	OllamaMiddleware []ollama.Middleware
+	CohereMiddleware []cohere.Middleware
+	// Structure requests so providers can reuse the prompt prefix they
+	// cached from earlier calls. Per call instructions are sent after
+	// history rather than with the system prompt, openai requests carry a
+	// cache key per conversation, and gemini keeps the system prompt and
+	// tools in cached content. Savings show up as Usage.CachedTokens.
+	PromptCaching bool
+	// How long gemini cached content lives, defaults to an hour
+	PromptCacheTTL time.Duration
+	// Optional Azure OpenAI resource openai models are called through
+	// instead of openai. The deployment defaults to the model's name.
+	Azure *openai.Azure
+	// Address of an openai compatible server openai models are called
+	// through instead of openai, e.g. http://localhost:8000/v1 for vLLM
+	OpenAIBaseURL string
+	// Call openai models through chat completions rather than the responses
+	// api, for compatible servers that only implement chat completions
+	ChatCompletions bool
+	// Fallback models and upstream provider preferences for
+	// model.OpenRouterModel
+	Route *openai.Route
+	// Optional Vertex AI project gemini models are called through instead
+	// of the developer api, authenticating with its token source rather
+	// than Auth
+	Vertex *gemini.Vertex
+	// Address of the ollama server used for model.OllamaModel, defaults to
+	// ollama.DefaultHost
+	OllamaHost string
+	// Address of the Inference Endpoint or text-generation-inference server
+	// used for model.HuggingFaceModel, e.g.
+	// https://xyz.us-east-1.aws.endpoints.huggingface.cloud
+	HuggingFaceEndpoint string
+	// Optionally signs every provider request, for gateways that require
+	// it. Gateways wanting mutual tls can instead be reached with a Client
+	// from signer.WithClientCertificate.
+	Signer signer.Signer
+	// Optional daily limits per end user, failing calls over them with
+	// quota.ErrQuotaExceeded
+	Quota *quota.UserQuota
+	// Gzip large provider requests. Gemini and cohere accept compressed
+	// requests, openai may need a gateway in front of it that does. Ollama
+	// doesn't, failing calls with ErrUnsupportedOption.
+	CompressRequests bool
+	// Provider responses larger than this fail, protecting memory from
+	// runaway outputs. Defaults to httpclient.DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+	// Provider requests larger than this fail with
+	// httpclient.ErrRequestTooLarge before being sent, such as once a tool
+	// dumps a huge output into history. 0 allows any size.
+	MaxRequestBytes int64
+	// How often Hooks.OnKeepAlive is called while a tool runs, defaults to
+	// 15s
+	KeepAliveInterval time.Duration
+	// Limits a whole call, including every round trip and tool it makes, 0
+	// for no limit beyond the context's
+	CallTimeout time.Duration
+	// Limits each http round trip to the provider, 0 for none. A single
+	// slow round trip is retried rather than using up the CallTimeout.
+	RequestTimeout time.Duration
+	// Attempts at a round trip that times out, defaults to 2 when
+	// RequestTimeout is set
+	RequestAttempts int
+	// Optional store the system prompt is read from on every call, so it
+	// can change without a redeploy. Takes the place of SystemPrompt.
+	Prompts prompt.Store
+	// Name of the prompt read from Prompts
+	PromptName string
+	// Version of the prompt read from Prompts, empty for the latest
+	PromptVersion string
+	// Applied in order to the model's output, including any re-asked for
+	// structured output, before it is validated and returned
+	PostProcessors []PostProcessor
+	// Attach a redacted copy of the request to provider errors as a
+	// RequestError, so failures can be debugged without Verbose. Credentials
+	// are removed and content is passed through Redact.
+	DumpFailedRequests bool
+	// Optional selector narrowing the tools sent with each turn to the most
+	// relevant, once more than MaxTurnTools are registered. With a selector,
+	// AddTool no longer limits how many tools can be registered. See
+	// KeywordSelector and EmbeddingSelector.
+	ToolSelector ToolSelector
+	// Most tools sent with a turn when there is a ToolSelector, defaults to
+	// model.MAX_TOOLS_COUMT
+	MaxTurnTools int
+	// Most a single call may spend on tools, going by the costs they
+	// declared with tool.WithCost. Tools that would go over are not run, and
+	// the model is told the budget is spent. 0 for no limit.
+	ToolBudget float64
+	// What happens to a session whose stored history is corrupt, defaults
+	// to RecoverRepair
+	HistoryRecovery HistoryRecovery
+	// Version of the history format this agent saves, stored with every
+	// session. Raise it alongside a migration when what history holds
+	// changes, such as switching provider, rather than orphaning sessions.
+	HistoryVersion int
+	// Upgrades sessions saved at a history version, the key, to the next.
+	// Sessions are migrated a version at a time when loaded, failing with
+	// ErrMissingMigration when a step is missing. See DropHistory.
+	Migrations map[int]Migration
+	// Optional lock shared between replicas, so calls for the same session
+	// on different replicas take turns. Calls within a process always take
+	// turns, waiting until the session is free or the call's context ends.
+	Locker memoriser.Locker
+	// How often Stream saves the reply streamed so far with the session, so
+	// a turn cut short, such as by a crash, doesn't lose what the user was
+	// shown. The next turn tells the model what they saw, see
+	// Session.Partial. Defaults to 2s, negative never saves.
+	StreamCheckpointInterval time.Duration
+
+	// Whether the scratchpad tools are registered, see EnableScratchpad
+	scratchpad bool
+	// Sessions being called within this process, shared by copies of the
+	// agent
+	locks *memoriser.LocalLocker
+	// Answers provider requests with recorded responses, see Replay
+	respond func() (json.RawMessage, error)
+}
+
+// Attempts at a timed out round trip, retrying once by default
+func (a *Agent[T]) requestAttempts() int {
+	if a.RequestAttempts > 0 {
+		return a.RequestAttempts
+	}
+
+	return 2
+}
+
+// Shrinks a tool output, given as json, once the model has seen it. On error
+// the original output is kept. Implementations should return outputs they
+// have already compacted unchanged.
+type CompactFunc func(ctx context.Context, output string) (string, error)
+
+// TruncateToolOutputs compacts tool outputs by keeping only their first
+// limit bytes
+func TruncateToolOutputs(limit int) CompactFunc {
+	const marker = "...[truncated]"
+
+	return func(ctx context.Context, output string) (string, error) {
+		if len(output) <= limit+len(marker) {
+			return output, nil
+		}
+
+		return strings.ToValidUTF8(output[:limit], "") + marker, nil
+	}
+}
+
+// Callbacks fired during a call. Any of them may be nil.
+type Hooks struct {
+	// Called when the provider returns safety feedback for a call
+	OnSafetyFeedback func(ctx context.Context, input AgentInput, feedback SafetyFeedback)
+	// Called when the model calls a tool that isn't registered. The model
+	// is told the tool is unknown and the call carries on.
+	OnUnknownTool func(ctx context.Context, input AgentInput, name string)
+	// Called once a tool the model called has run
+	OnToolCall func(ctx context.Context, input AgentInput, call ToolCall)
+	// Called with the redacted request when a provider request fails. Only
+	// called when DumpFailedRequests is set.
+	OnRequestFailure func(ctx context.Context, input AgentInput, err *RequestError)
+	// Called every KeepAliveInterval while a tool runs, so streams can send
+	// keepalive events and idle connections aren't dropped mid turn
+	OnKeepAlive func(ctx context.Context, input AgentInput, tool string, elapsed time.Duration)
+	// Called when history was out of order, such as a tool call left without
+	// its output, with a description of each repair made to it
+	OnHistoryRepair func(ctx context.Context, input AgentInput, repairs []string)
+}
+
+// A tool the model called during a call
+type ToolCall struct {
+	Name string
+	// Arguments the model gave, as json
+	Arguments json.RawMessage
+	// How long the tool ran for
+	Duration time.Duration
+	// Error the tool returned, which the model is told about
+	Err error
+}
+
+// Adapts the unknown tool hook for a provider client, nil when unset
+func (h Hooks) unknownTool(input AgentInput) func(ctx context.Context, name string) {
+	if h.OnUnknownTool == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, name string) {
+		h.OnUnknownTool(ctx, input, name)
+	}
+}
+
+// Adds a heartbeat calling the keep alive hook to ctx, if there is a hook
+func (a *Agent[T]) keepAlive(ctx context.Context, input AgentInput) context.Context {
+	if a.Hooks.OnKeepAlive == nil {
+		return ctx
+	}
+
+	interval := a.KeepAliveInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+
+	return tool.WithHeartbeat(ctx, interval, func(ctx context.Context, name string, elapsed time.Duration) {
+		a.Hooks.OnKeepAlive(ctx, input, name, elapsed)
+	})
 }
 
+// Adapts the tool call hook for a provider client, nil when unset
+func (h Hooks) toolCall(input AgentInput) func(ctx context.Context, name string, args any, elapsed time.Duration, err error) {
+	if h.OnToolCall == nil {
+		return nil
+	}
+
+	return func(ctx context.Context, name string, args any, elapsed time.Duration, err error) {
+		call := ToolCall{Name: name, Duration: elapsed, Err: err}
+		switch v := args.(type) {
+		case string:
+			call.Arguments = json.RawMessage(v)
+		case json.RawMessage:
+			call.Arguments = v
+		default:
+			call.Arguments, _ = json.Marshal(v)
+		}
+
+		h.OnToolCall(ctx, input, call)
+	}
+}
+
+// Provider agnostic generation settings. Not every provider supports every
+// option, unsupported options are ignored.
+type GenerationOptions struct {
+	// Number of tokens the model may spend thinking. 0 disables thinking
+	// where the model allows it, and -1 lets the model decide. Nil uses the
+	// model default. Gemini 2.5 and newer only.
+	ThinkingBudget *int
+	// Whether thought summaries are returned as AgentOutput.Thoughts.
+	// Gemini 2.5 and newer, and openai reasoning models. DeepSeek reasoning
+	// models always return their thinking.
+	IncludeThoughts bool
+	// Penalises tokens that have already appeared, between -2 and 2. Nil
+	// uses the model default. Ignored by openai outside chat completions
+	// mode, the responses api has no penalties.
+	PresencePenalty *float64
+	// Penalises tokens by how often they have appeared, between -2 and 2.
+	// Nil uses the model default. Ignored by openai outside chat
+	// completions mode.
+	FrequencyPenalty *float64
+	// Fixes sampling so repeated calls are reproducible on a best effort
+	// basis. Ignored by openai outside chat completions mode.
+	Seed *int
+	// Most tokens the model may generate per request, 0 uses the model
+	// default. Replies cut short set AgentOutput.Truncated.
+	MaxOutputTokens int
+	// Lets models able to generate images include them in replies, returned
+	// as AgentOutput.Artifacts. Gemini image models only.
+	ImageOutput bool
+	// Number of follow up requests asking the model to carry on from a
+	// reply cut short by MaxOutputTokens, stitched into a single output
+	Continuations int
+	// How AgentOutput.Confidence is worked out, empty to leave it unset
+	Confidence ConfidenceMode
+	// Processing tier trading cost against latency, one of the
+	// openai.ServiceTier constants, such as flex for batchy work. Empty
+	// uses the project default. Openai only.
+	ServiceTier string
+}
+
+// The end user one off calls are made for when they name none
+const completeUser = "complete"
+
+// Sent to ask the model to carry on from a truncated reply
+const continuePrompt = "Your previous response was cut off. Continue exactly where it stopped, without repeating anything."
+
+// Produces an instruction for a single call. An empty instruction is skipped.
+type InstructionFunc func(ctx context.Context, input AgentInput) (string, error)
+
 type AgentInput struct {
 	// An agent call should have some ID associated with it.
 	// This may be a session ID, a user ID, or some kind of ID
@@ -52,19 +399,283 @@ type AgentInput struct {
 	UserInput string `json:"user_input,omitempty" jsonschema:"description=Input of the user for agent to use,required"`
 	// Optional schema for agent to follow. The schema should follow some json encoded message, which is dependent on
 	// the model provider being used. For example, the schema accepted by gemini may be different that the one
-	// accepted by openai.
+	// accepted by openai. Output that doesn't match is repaired where possible, otherwise the model is asked once
+	// more before failing with ErrInvalidStructuredOutput.
 	Schema json.RawMessage `json:"-"`
+	// Optional identifier of the end user responsible for this call, sent to
+	// providers for abuse monitoring. Falls back to Id when empty. Consider
+	// hashing emails or usernames before setting this. Gemini receives it as
+	// a label, which only Vertex AI accepts, so the developer api never sees
+	// it.
+	EndUserID string `json:"-"`
+	// Optional key-value pairs attached to the provider request, useful for
+	// tagging requests with tenant or feature identifiers. Sent as metadata
+	// to openai and as labels to gemini on Vertex AI, as the gemini developer
+	// api drops labels. At most 16 pairs are allowed, with keys up to 64
+	// characters and values up to 512 characters. Gemini lowercases label
+	// keys and replaces characters it doesn't allow with underscores, so
+	// gemini calls fail with ErrInvalidMetadata when two keys become the same
+	// label, or when a key becomes end_user, the label reserved for
+	// EndUserID.
+	Metadata map[string]string `json:"-"`
+	// Optional namespace, such as a tenant, isolating this conversation's
+	// history from other namespaces. Requires the agent's Memoriser to be
+	// a memoriser.NamespacedMemoriser.
+	Namespace string `json:"-"`
+	// Optional control over which tools the model calls for this input.
+	// Only the first round of tool calls is constrained, letting the model
+	// reply normally once it has the results.
+	ToolChoice *ToolChoice `json:"-"`
+	// Optional sequences that end the generation, useful for bounding
+	// templated output. The sequence itself is not part of the output.
+	// Providers without native support, such as openai outside chat
+	// completions mode, have their output trimmed at the first sequence
+	// instead. At most 5 are allowed.
+	StopSequences []string `json:"-"`
+	// Optional system prompt replacing the agent's SystemPrompt for this
+	// call only.
+	SystemPrompt string `json:"-"`
+	// Optional instructions for this call only, such as per-request context
+	// documents. They follow the system prompt and any dynamic instructions.
+	Instructions []string `json:"-"`
+	// Optional entries making up the input in place of UserInput, such as
+	// several texts, text and images, or an earlier assistant draft to
+	// revise. They must end with the user's. UserInput is replaced with the
+	// text of the user's entries, which is what tool selectors and the
+	// like see. Images are sent to openai, gemini and ollama, other
+	// providers fail with ErrInvalidUserInput.
+	Items []InputItem `json:"-"`
+	// Optional sources for this call only, which the model grounds its
+	// reply on and cites in AgentOutput.Citations. Cohere only, other
+	// providers ignore them, so pass documents as Instructions for those.
+	Documents []Document `json:"-"`
+
+	// Called with each piece of output text as it's generated, set by
+	// Agent.Stream
+	onText func(text string)
+}
+
+// A source the model can ground its reply on
+type Document struct {
+	// Cited by the model, generated by the provider when empty
+	ID string
+	// Fields of the document, e.g. title and text
+	Data map[string]string
+}
+
+// A span of the output grounded on documents or tool outputs
+type Citation struct {
+	// Byte offsets of the span in the model's reply, before any post
+	// processing
+	Start int
+	End   int
+	Text  string
+	// Ids of the documents, or of the tool calls whose outputs, were cited
+	Sources []string
+}
+
+// The system prompt for a call, preferring the input's override, then the
+// prompt store. The stored prompt used, if any, is returned alongside it.
+func (a *Agent[T]) systemPrompt(ctx context.Context, input AgentInput) (string, prompt.Prompt, error) {
+	if input.SystemPrompt != "" {
+		return input.SystemPrompt, prompt.Prompt{}, nil
+	}
+
+	if a.Prompts != nil {
+		p, err := a.Prompts.Get(ctx, a.PromptName, a.PromptVersion)
+		if err != nil {
+			return "", prompt.Prompt{}, fmt.Errorf("failed to get system prompt - %w", err)
+		}
+
+		return p.Text, p, nil
+	}
+
+	return a.SystemPrompt, prompt.Prompt{}, nil
+}
+
+type ToolChoiceMode string
+
+const (
+	// The model decides whether to call tools, the default
+	ToolChoiceAuto ToolChoiceMode = "auto"
+	// The model may not call tools
+	ToolChoiceNone ToolChoiceMode = "none"
+	// The model must call at least one tool
+	ToolChoiceRequired ToolChoiceMode = "required"
+)
+
+type ToolChoice struct {
+	Mode ToolChoiceMode
+	// Optionally restricts the model to these tools
+	Tools []string
+}
+
+// ForceTool returns a copy of the input requiring the model to call the named tool
+func (i AgentInput) ForceTool(name string) AgentInput {
+	i.ToolChoice = &ToolChoice{Mode: ToolChoiceRequired, Tools: []string{name}}
+	return i
+}
+
+// Checks the tool choice only refers to tools the agent has
+func (a *Agent[T]) validToolChoice(choice *ToolChoice) error {
+	if choice == nil {
+		return nil
+	}
+
+	switch choice.Mode {
+	case ToolChoiceAuto, ToolChoiceRequired:
+	case ToolChoiceNone:
+		if len(choice.Tools) > 0 {
+			return fmt.Errorf("tools cannot be named with mode none - %w", ErrInvalidToolChoice)
+		}
+	default:
+		return fmt.Errorf("unknown mode %q - %w", choice.Mode, ErrInvalidToolChoice)
+	}
+
+	for _, name := range choice.Tools {
+		if !slices.ContainsFunc(a.tools, func(t tool.Tool[any, any]) bool { return t.Name == name }) {
+			return fmt.Errorf("tool %s is not registered - %w", name, ErrInvalidToolChoice)
+		}
+	}
+
+	return nil
+}
+
+// Identifier sent to providers for abuse monitoring
+func (i AgentInput) endUser() string {
+	if i.EndUserID != "" {
+		return i.EndUserID
+	}
+
+	return i.Id
 }
 
 type AgentOutput struct {
 	Output string `json:"output,omitempty"`
+	// Summaries of the model's thinking, when requested and supported, or
+	// the whole chain of thought from DeepSeek reasoning models. Never part
+	// of Output.
+	Thoughts string `json:"-"`
+	// Safety signals from providers that rate content, currently gemini
+	Safety SafetyFeedback `json:"-"`
+	// Tokens used by the call, including any tool call round trips
+	Usage Usage `json:"-"`
+	// The stored prompt that produced the output, empty when the system
+	// prompt didn't come from the agent's Prompts
+	PromptName    string `json:"-"`
+	PromptVersion string `json:"-"`
+	// Non-text results of the turn, such as images the model generated or
+	// files tools emitted with tool.Emit
+	Artifacts []tool.Artifact `json:"-"`
+	// The experiment variant that produced the output, if any
+	Variant string `json:"-"`
+	// Whether the output was cut short by GenerationOptions.MaxOutputTokens,
+	// even after any continuations
+	Truncated bool `json:"-"`
+	// How likely the output is to be right, between 0 and 1. Only set when
+	// GenerationOptions.Confidence is and the model could provide it.
+	Confidence *float64 `json:"-"`
+	// Estimated cost of the tools called, from what they declared with
+	// tool.WithCost
+	ToolCost float64 `json:"-"`
+	// Estimated cost of Usage in US dollars, from the list prices in
+	// model.Catalog. 0 for models missing from it.
+	Cost float64 `json:"-"`
+	// The tier the provider processed the call with, which may differ from
+	// GenerationOptions.ServiceTier. Openai only.
+	ServiceTier string `json:"-"`
+	// The model that served the call as the provider reported it, such as
+	// a dated snapshot, or the fallback an OpenRouter Route led to. Openai
+	// and OpenRouter only.
+	ServedModel string `json:"-"`
+	// The upstream provider OpenRouter routed the call to
+	ServedProvider string `json:"-"`
+	// Spans of the output grounded on AgentInput.Documents or tool outputs.
+	// Cohere only.
+	Citations []Citation `json:"-"`
+}
+
+// A provider's rating of how likely content is to be harmful in a category
+type SafetyRating struct {
+	Category    string
+	Probability string
+	Blocked     bool
+}
+
+type SafetyFeedback struct {
+	// Ratings of the prompt
+	Prompt []SafetyRating
+	// Ratings of the model's response
+	Response []SafetyRating
+}
+
+func (f SafetyFeedback) empty() bool {
+	return len(f.Prompt) == 0 && len(f.Response) == 0
+}
+
+// Stream makes a call like Call, handing onText each piece of the reply as
+// the model generates it. Only the reply and any continuations of it are
+// streamed, not structured output retries or confidence assessments. The
+// streamed text is as the model generated it, before postprocessing or
+// trimming at stop sequences, while the returned output is as Call's. The
+// reply streamed so far is saved with the session as it streams, see
+// StreamCheckpointInterval. Models that can't stream, see Capabilities,
+// fail with ErrUnsupportedOption before anything is sent.
+func (a *Agent[T]) Stream(ctx context.Context, input AgentInput, onText func(text string)) (AgentOutput, error) {
+	if onText == nil {
+		return AgentOutput{}, errors.New("nil onText")
+	}
+	input.onText = onText
+
+	return a.Call(ctx, input)
 }
 
 func (a *Agent[T]) Call(ctx context.Context, input AgentInput) (AgentOutput, error) {
+	if err := a.allow(ctx, input); err != nil {
+		return AgentOutput{}, err
+	}
+
+	return a.attempt(ctx, input)
+}
+
+// Charges a call to its end user's quota, if there is one. Calls without
+// an end user are left for call to reject.
+func (a *Agent[T]) allow(ctx context.Context, input AgentInput) error {
+	if a.Quota == nil || input.endUser() == "" {
+		return nil
+	}
+
+	return a.Quota.Allow(ctx, input.endUser())
+}
+
+// Makes a call already charged to the quota, failing over to the fallbacks
+// so one request is only ever charged once
+func (a *Agent[T]) attempt(ctx context.Context, input AgentInput) (AgentOutput, error) {
+	if a.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.CallTimeout)
+		defer cancel()
+	}
+
+	output, err := a.call(ctx, input)
+	for i := 0; i < len(a.Fallbacks) && failover(ctx, err); i++ {
+		fallback := a.fallback(a.Fallbacks[i])
+		slog.WarnContext(ctx, "failing over to fallback model", slog.String("model", fallback.Model.Model()), slog.Any("err", err))
+		output, err = fallback.call(ctx, input)
+	}
+
+	return output, err
+}
+
+func (a *Agent[T]) call(ctx context.Context, input AgentInput) (AgentOutput, error) {
 	slog.DebugContext(ctx, "received agent call request", slog.String("model", a.Model.Model()))
-	if a.Verbose {
-		slog.DebugContext(ctx, "request input", slog.Any("input", input))
+	if err := input.validItems(); err != nil {
+		return AgentOutput{}, err
+	}
+	if len(input.Items) > 0 {
+		input.UserInput = input.itemsText()
 	}
+	a.debug(ctx, DebugInput, input.Id, input.UserInput)
 
 	if a.Memoriser == nil {
 		return AgentOutput{}, fmt.Errorf("use NoOpMemoriser if no memory is wanted - %w", ErrNilMemoriser)
@@ -78,85 +689,444 @@ func (a *Agent[T]) Call(ctx context.Context, input AgentInput) (AgentOutput, err
 		return AgentOutput{}, fmt.Errorf("empty user input encountered - %w", ErrInvalidUserInput)
 	}
 
-	// Fetch our history
-	history, err := a.Memoriser.Retrieve(input.Id)
+	if err := validMetadata(input.Metadata); err != nil {
+		return AgentOutput{}, err
+	}
+
+	if err := a.validToolChoice(input.ToolChoice); err != nil {
+		return AgentOutput{}, err
+	}
+
+	if err := validStopSequences(input.StopSequences); err != nil {
+		return AgentOutput{}, err
+	}
+
+	p, err := a.provider(input)
 	if err != nil {
-		slog.InfoContext(ctx, "received request with no prior history")
+		return AgentOutput{}, err
+	}
+	caps := p.Capabilities()
+	if input.images() && !caps.Images {
+		return AgentOutput{}, fmt.Errorf("%s can't be sent images - %w", a.Model.Model(), ErrInvalidUserInput)
 	}
-	if a.Verbose {
-		slog.DebugContext(ctx, "found the following history", slog.Any("history", history))
+	if input.onText != nil && !caps.Streaming {
+		return AgentOutput{}, fmt.Errorf("%s can't stream - %w", a.Model.Model(), ErrUnsupportedOption)
 	}
 
-	output := AgentOutput{}
+	mem, err := a.memoriser(input.Namespace)
+	if err != nil {
+		return AgentOutput{}, err
+	}
 
-	if _, ok := a.Model.(model.GeminiAiModel); ok {
-		g, err := gemini.NewGeminiClient(a.Client, a.Auth, a.Model.Model())
-		if err != nil {
+	if admitter, ok := mem.(memoriser.Admitter); ok {
+		if err := admitter.Admit(input.Id); err != nil {
 			return AgentOutput{}, err
 		}
-		body, err := g.Body(input.UserInput, a.SystemPrompt, history, input.Schema)
-		if err != nil {
-			return AgentOutput{}, err
+	}
+
+	unlock, err := a.lock(ctx, input.Namespace, input.Id)
+	if err != nil {
+		return AgentOutput{}, err
+	}
+	defer unlock()
+
+	// Fetch our history
+	session, err := a.loadIntact(ctx, mem, input)
+	if err != nil {
+		return AgentOutput{}, err
+	}
+	if err := a.trimHistory(ctx, session, a.historyLimit(caps)); err != nil {
+		return AgentOutput{}, err
+	}
+
+	system, used, err := a.systemPrompt(ctx, input)
+	if err != nil {
+		return AgentOutput{}, err
+	}
+
+	instructions, err := a.instructions(ctx, input)
+	if err != nil {
+		return AgentOutput{}, err
+	}
+
+	output := AgentOutput{PromptName: used.Name, PromptVersion: used.Version}
+	artifacts := &tool.Artifacts{}
+	ctx = tool.WithArtifacts(ctx, artifacts)
+	budget := &tool.Budget{Limit: a.ToolBudget}
+	ctx = tool.WithBudget(ctx, budget)
+	ctx = a.keepAlive(ctx, input)
+	ctx, instructions = a.withScratchpad(ctx, session, instructions)
+	instructions = acknowledgePartial(session, instructions)
+	tools := a.turnTools(ctx, input)
+	if err := a.checkTools(caps, tools); err != nil {
+		return AgentOutput{}, err
+	}
+	// Set when the output never matched the schema, returned once history
+	// is saved
+	var structuredErr error
+
+	turn := Turn{Input: input, System: system, Developer: a.DeveloperMessages, History: session.History, Instructions: instructions, Tools: tools}
+	if len(input.Schema) > 0 && !caps.StructuredOutput {
+		// The schema is asked for instead, with the output checked against
+		// it all the same
+		turn.Input.Schema = nil
+		turn.Instructions = append(slices.Clone(instructions), schemaInstruction(input.Schema))
+	}
+
+	body, err := p.Body(ctx, turn)
+	if err != nil {
+		return AgentOutput{}, err
+	}
+	if err := a.repairHistory(ctx, input, body.Repair); err != nil {
+		return AgentOutput{}, err
+	}
+	if err := p.Prepare(ctx, body, turn); err != nil {
+		return AgentOutput{}, err
+	}
+
+	// The reply is streamed when asked for, anything generated after it
+	// isn't
+	generate := p.Generate
+	var streamed *checkpoint
+	if input.onText != nil {
+		streamed = a.checkpoint(ctx, mem, input, session)
+		// Whatever streamed is kept if the call fails before the turn is
+		// saved
+		defer streamed.flush()
+		generate = func(ctx context.Context, body Body, tools []tool.Tool[any, any]) (Body, Result, error) {
+			return p.Stream(ctx, body, tools, streamed.text)
 		}
+	}
 
-		body, res, err := g.Generate(ctx, body, a.tools)
-		if err != nil {
-			slog.ErrorContext(ctx, "failed calling gemini model", slog.Any("err", err))
+	req := body
+	body, res, err := generate(ctx, body, tools)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed calling model", slog.String("model", a.Model.Model()), slog.Any("err", err))
+		return AgentOutput{}, a.dumpRequest(ctx, input, req, err)
+	}
+	for i := 0; res.Truncated && i < a.Generation.Continuations; i++ {
+		if err := body.AppendUserInput(continuePrompt); err != nil {
 			return AgentOutput{}, err
 		}
-		output.Output = res
-
-		// Update state
-		history, err = json.Marshal(body)
+		next, more, err := generate(ctx, body, tools)
 		if err != nil {
-			slog.ErrorContext(ctx, "failed to parse gemini body into state", slog.Any("error", err), slog.Any("body", body))
-		} else {
-			if ok := a.Memoriser.Save(input.Id, history); !ok {
-				slog.ErrorContext(ctx, "failed to save updated gemini state", slog.Any("error", err))
+			slog.ErrorContext(ctx, "failed continuing model", slog.String("model", a.Model.Model()), slog.Any("err", err))
+			return AgentOutput{}, a.dumpRequest(ctx, input, body, err)
+		}
+		body, res = next, res.continued(more)
+	}
+	// Providers without stop sequences, such as the openai responses api,
+	// leave them in the output
+	res.Text, err = a.postProcess(ctx, trimAtStop(res.Text, input.StopSequences))
+	if err != nil {
+		return AgentOutput{}, err
+	}
+	if len(input.Schema) > 0 {
+		res.Text, structuredErr = a.structured(ctx, input.Schema, res.Text, func(prompt string) (string, error) {
+			if err := body.AppendUserInput(prompt); err != nil {
+				return "", err
+			}
+			retryBody, retry, err := p.Generate(ctx, body, tools)
+			if err != nil {
+				return "", a.dumpRequest(ctx, input, body, err)
+			}
+			retry.Usage = res.Usage.Add(retry.Usage)
+			retry.Artifacts = append(res.Artifacts, retry.Artifacts...)
+			retry.Text, err = a.postProcess(ctx, trimAtStop(retry.Text, input.StopSequences))
+			if err != nil {
+				return "", err
 			}
+			body, res = retryBody, retry
+			return res.Text, nil
+		})
+		if structuredErr != nil && !errors.Is(structuredErr, ErrInvalidStructuredOutput) {
+			slog.ErrorContext(ctx, "failed calling model", slog.String("model", a.Model.Model()), slog.Any("err", structuredErr))
+			return AgentOutput{}, structuredErr
 		}
 	}
+	output.Output = res.Text
+	output.Thoughts = res.Thoughts
+	output.Safety = res.Safety
+	output.Artifacts = append(res.Artifacts, artifacts.List()...)
+	output.ToolCost = budget.Spent()
+	output.Truncated = res.Truncated
+	output.Usage = res.Usage
+	output.ServiceTier = res.ServiceTier
+	output.ServedModel = res.ServedModel
+	output.ServedProvider = res.ServedProvider
+	output.Citations = res.Citations
 
-	if _, ok := a.Model.(model.OpenAiModel); ok {
-		oa, err := openai.NewOpenAIClient(a.Client, a.Auth)
+	confidence, spent := a.confidence(ctx, input, output.Output, res.Logprobs, func(ctx context.Context, prompt string) (string, Usage, error) {
+		assessBody, err := p.Body(ctx, Turn{Input: AgentInput{Id: input.Id, UserInput: prompt}})
 		if err != nil {
-			return AgentOutput{}, err
+			return "", Usage{}, err
 		}
+		_, assessed, err := p.Generate(ctx, assessBody, nil)
+		return assessed.Text, assessed.Usage, err
+	})
+	output.Confidence = confidence
+	output.Usage = output.Usage.Add(spent)
+	output.Cost = output.Usage.Cost(a.Model)
 
-		body, err := oa.Body(a.Model.Model(), input.UserInput, a.SystemPrompt, history, input.Schema)
-		if err != nil {
-			return AgentOutput{}, err
+	if !output.Safety.empty() && a.Hooks.OnSafetyFeedback != nil {
+		a.Hooks.OnSafetyFeedback(ctx, input, output.Safety)
+	}
+
+	// Update state
+	var compact func(string) string
+	if a.CompactToolOutput != nil {
+		compact = a.compact(ctx)
+	}
+	if err := body.Finish(compact); err != nil {
+		slog.ErrorContext(ctx, "failed to compact tool outputs", slog.Any("error", err))
+	}
+	if err := a.repairHistory(ctx, input, body.Repair); err != nil {
+		slog.ErrorContext(ctx, "failed to repair history", slog.Any("error", err))
+	}
+	session.PromptTokens = res.PromptTokens
+	session.Format = historyFormat(p)
+	a.save(ctx, mem, input, session, body, output.Usage)
+	streamed.finish()
+
+	if a.Quota != nil {
+		if err := a.Quota.Record(ctx, input.endUser(), int64(output.Usage.TotalTokens)); err != nil {
+			slog.ErrorContext(ctx, "failed to record quota usage", slog.Any("error", err))
+		}
+	}
+
+	a.debug(ctx, DebugOutput, input.Id, output.Output)
+
+	return output, structuredErr
+}
+
+// Complete answers input as a one off, such as to extract something from
+// it. Unlike Call it needs neither an id nor a Memoriser, as no history is
+// read or stored. One offs without an EndUserID or Id are all charged to the
+// Quota of the one end user, complete.
+func (a *Agent[T]) Complete(ctx context.Context, input AgentInput) (AgentOutput, error) {
+	oneOff, input := a.oneOff(input)
+	return oneOff.Call(ctx, input)
+}
+
+// The agent and input a one off call is made with, see Complete
+func (a *Agent[T]) oneOff(input AgentInput) (*Agent[T], AgentInput) {
+	oneOff := *a
+	oneOff.Memoriser = &memoriser.NoOpMemoriser{}
+	oneOff.Locker = nil
+
+	input.Namespace = ""
+	if input.Id == "" {
+		// The id is made up for the call, so it can't identify the end user
+		if input.EndUserID == "" {
+			input.EndUserID = completeUser
 		}
+		input.Id = "complete:" + rand.Text()
+	}
+
+	return &oneOff, input
+}
 
-		body, res, err := oa.Generate(ctx, body, a.tools)
+// Runs a provider's repair of its body, so history stays in an order the
+// provider accepts
+func (a *Agent[T]) repairHistory(ctx context.Context, input AgentInput, repair func() ([]string, error)) error {
+	repairs, err := repair()
+	if err != nil {
+		return fmt.Errorf("history can't be repaired - %w", err)
+	}
+
+	if len(repairs) > 0 {
+		slog.WarnContext(ctx, "repaired history", slog.String("id", input.Id), slog.Any("repairs", repairs))
+		if a.Hooks.OnHistoryRepair != nil {
+			a.Hooks.OnHistoryRepair(ctx, input, repairs)
+		}
+	}
+
+	return nil
+}
+
+// Adapts the compaction policy for provider bodies, keeping outputs as they
+// are when it fails
+func (a *Agent[T]) compact(ctx context.Context) func(string) string {
+	return func(output string) string {
+		compacted, err := a.CompactToolOutput(ctx, output)
 		if err != nil {
-			slog.ErrorContext(ctx, "failed calling openai model", slog.Any("err", err))
-			return output, err
+			slog.ErrorContext(ctx, "failed to compact tool output", slog.Any("error", err))
+			return output
 		}
-		output.Output = res
 
-		// Update state
-		history, err = json.Marshal(body)
+		return compacted
+	}
+}
+
+// Evaluates the dynamic instructions for a call, followed by the input's
+// own, dropping empty ones
+func (a *Agent[T]) instructions(ctx context.Context, input AgentInput) ([]string, error) {
+	instructions := make([]string, 0, len(a.DynamicInstructions)+len(input.Instructions))
+	for _, fn := range a.DynamicInstructions {
+		instruction, err := fn(ctx, input)
 		if err != nil {
-			slog.ErrorContext(ctx, "failed to parse openai body into state", slog.Any("error", err), slog.Any("body", body))
-		} else {
-			if ok := a.Memoriser.Save(input.Id, history); !ok {
-				slog.ErrorContext(ctx, "failed to save updated openai state", slog.Any("error", err))
-			}
+			return nil, fmt.Errorf("failed to build dynamic instruction - %w", err)
+		}
+
+		if instruction != "" {
+			instructions = append(instructions, instruction)
+		}
+	}
+
+	for _, instruction := range input.Instructions {
+		if instruction != "" {
+			instructions = append(instructions, instruction)
+		}
+	}
+
+	return instructions, nil
+}
+
+func validMetadata(metadata map[string]string) error {
+	if len(metadata) > 16 {
+		return fmt.Errorf("metadata has %d pairs, at most 16 allowed - %w", len(metadata), ErrInvalidMetadata)
+	}
+
+	for k, v := range metadata {
+		if k == "" || len(k) > 64 {
+			return fmt.Errorf("metadata key %q must be 1-64 characters - %w", k, ErrInvalidMetadata)
+		}
+
+		if len(v) > 512 {
+			return fmt.Errorf("metadata value for %q exceeds 512 characters - %w", k, ErrInvalidMetadata)
 		}
 	}
 
-	return output, nil
+	return nil
 }
 
-func (a *Agent[T]) AddTool(tool tool.Tool[any, any]) {
+func validStopSequences(stops []string) error {
+	if len(stops) > 5 {
+		return fmt.Errorf("%d stop sequences given, at most 5 allowed - %w", len(stops), ErrInvalidStopSequences)
+	}
+
+	for _, stop := range stops {
+		if stop == "" {
+			return fmt.Errorf("empty stop sequence - %w", ErrInvalidStopSequences)
+		}
+	}
+
+	return nil
+}
+
+// Cuts text at the earliest stop sequence, emulating them for providers
+// that lack support
+func trimAtStop(text string, stops []string) string {
+	cut := len(text)
+	for _, stop := range stops {
+		if i := strings.Index(text, stop); i >= 0 && i < cut {
+			cut = i
+		}
+	}
+
+	return text[:cut]
+}
+
+// Longest tool description openai accepts
+const maxToolDescription = 1024
+
+// Registers a tool for the agent to call. Tools must have unique names, which
+// have to satisfy every provider: at most 64 letters, digits, underscores or
+// dashes.
+func (a *Agent[T]) AddTool(tool tool.Tool[any, any]) error {
+	if !validToolName(tool.Name) {
+		return fmt.Errorf("name %q must be 1-64 letters, digits, underscores or dashes - %w", tool.Name, ErrInvalidTool)
+	}
+
+	if len(tool.Describe()) > maxToolDescription {
+		return fmt.Errorf("description of %s exceeds %d characters - %w", tool.Name, maxToolDescription, ErrInvalidTool)
+	}
+
+	if a.ToolSelector == nil && len(a.tools) >= model.MAX_TOOLS_COUMT {
+		return fmt.Errorf("cannot add %s to %d tools - %w", tool.Name, len(a.tools), ErrExceededMaxToolCount)
+	}
+
+	if err := checkTool(model.Limits(a.Model), tool); err != nil {
+		return err
+	}
+
+	for _, t := range a.tools {
+		if t.Name == tool.Name {
+			return fmt.Errorf("%s already registered - %w", tool.Name, ErrDuplicateTool)
+		}
+	}
+
 	a.tools = append(a.tools, tool)
+	return nil
+}
+
+// Checks a tool against what the provider accepts
+func checkTool(limits model.ToolLimits, t tool.Tool[any, any]) error {
+	if limits.MaxName > 0 && len(t.Name) > limits.MaxName {
+		return fmt.Errorf("name %s exceeds the %d characters %s accepts - %w", t.Name, limits.MaxName, limits.Provider, ErrInvalidTool)
+	}
+
+	if limits.MaxDescription > 0 && len(t.Describe()) > limits.MaxDescription {
+		return fmt.Errorf("description of %s exceeds the %d characters %s accepts - %w", t.Name, limits.MaxDescription, limits.Provider, ErrInvalidTool)
+	}
+
+	if limits.MaxSchemaBytes > 0 {
+		schema, err := json.Marshal(t.Definition)
+		if err != nil {
+			return fmt.Errorf("failed to encode parameters of %s - %w", t.Name, errors.Join(err, ErrInvalidTool))
+		}
+		if len(schema) > limits.MaxSchemaBytes {
+			return fmt.Errorf("parameters of %s are %d bytes, over the %d %s accepts - %w", t.Name, len(schema), limits.MaxSchemaBytes, limits.Provider, ErrInvalidTool)
+		}
+	}
+
+	return nil
+}
+
+// Checks the tools sent with a request against what the provider accepts,
+// which can differ from when they were registered, such as once the model
+// is changed or a selector sends more than the provider takes
+func (a *Agent[T]) checkTools(caps Capabilities, tools []tool.Tool[any, any]) error {
+	if len(tools) > 0 && !caps.Tools {
+		return fmt.Errorf("%s can't call tools - %w", a.Model.Model(), ErrInvalidTool)
+	}
+
+	limits := model.Limits(a.Model)
+
+	if limits.MaxTools > 0 && len(tools) > limits.MaxTools {
+		return fmt.Errorf("%d tools sent where %s accepts %d - %w", len(tools), limits.Provider, limits.MaxTools, ErrExceededMaxToolCount)
+	}
+
+	for _, t := range tools {
+		if err := checkTool(limits, t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validToolName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
 }
 
 func NewAgent(m model.AIModel) (*Agent[model.AIModel], error) {
 	agent := &Agent[model.AIModel]{
 		Model: m,
 		tools: make([]tool.Tool[any, any], 0),
+		locks: memoriser.NewLocalLocker(),
 	}
 	return agent, nil
 }
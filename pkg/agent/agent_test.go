@@ -0,0 +1,2133 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
+	"github.com/calamity-m/clusterfuc/pkg/credentials"
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser/memorisertest"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/prompt"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Answers every openai request in turn without touching the network
+func respond(responses ...string) openai.Middleware {
+	return func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			var resp openai.Response
+			err := json.Unmarshal([]byte(responses[0]), &resp)
+			responses = responses[1:]
+			return &resp, err
+		}
+	}
+}
+
+func TestContinuations(t *testing.T) {
+	cut := `{"status":"incomplete","incomplete_details":{"reason":"max_output_tokens"},"output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"once upon "}]}]}`
+	done := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"a time"}]}]}`
+
+	t.Run("truncated output is reported", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.Generation.MaxOutputTokens = 2
+		a.OpenAIMiddleware = []openai.Middleware{respond(cut)}
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "story"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !output.Truncated || output.Output != "once upon " {
+			t.Errorf("expected truncated output but got %#v", output)
+		}
+	})
+
+	t.Run("continuations stitch the output", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.Generation.MaxOutputTokens = 2
+		a.Generation.Continuations = 1
+		a.OpenAIMiddleware = []openai.Middleware{respond(cut, done)}
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "story"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if output.Truncated || output.Output != "once upon a time" {
+			t.Errorf("expected stitched output but got %#v", output)
+		}
+	})
+}
+
+func TestSystemPromptOverrides(t *testing.T) {
+	var sent string
+	capture := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			sent = body.Instructions
+			return next(ctx, body)
+		}
+	}
+
+	done := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"ok"}]}]}`
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.SystemPrompt = "be helpful"
+	a.OpenAIMiddleware = []openai.Middleware{capture, respond(done, done)}
+
+	t.Run("input replaces and extends the prompt", func(t *testing.T) {
+		_, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi", SystemPrompt: "be terse", Instructions: []string{"doc: a"}})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if sent != "be terse\n\ndoc: a" {
+			t.Errorf("expected overridden prompt but got %q", sent)
+		}
+	})
+
+	t.Run("agent is left untouched", func(t *testing.T) {
+		_, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if sent != "be helpful" || a.SystemPrompt != "be helpful" {
+			t.Errorf("expected agent prompt but got %q", sent)
+		}
+	})
+}
+
+func TestPromptStore(t *testing.T) {
+	var sent string
+	capture := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			sent = body.Instructions
+			return next(ctx, body)
+		}
+	}
+
+	done := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"ok"}]}]}`
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.Prompts = prompt.NewInMemoryStore(prompt.Prompt{Name: "greeter", Version: "1", Text: "say hi"}, prompt.Prompt{Name: "greeter", Version: "2", Text: "say hello"})
+	a.PromptName = "greeter"
+	a.OpenAIMiddleware = []openai.Middleware{capture, respond(done)}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if sent != "say hello" || output.PromptName != "greeter" || output.PromptVersion != "2" {
+		t.Errorf("expected latest greeter prompt but sent %q with %#v", sent, output)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{respond(
+		`{"status":"completed","output":[{"type":"function_call","call_id":"call_1","name":"chart","arguments":"{\"title\":\"sales\"}"}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"here is your chart"}]}]}`,
+	)}
+
+	type Chart struct {
+		Title string `json:"title"`
+	}
+	err := a.AddTool(tool.CreateTool("chart", func(ctx context.Context, in Chart) (string, error) {
+		tool.Emit(ctx, tool.Artifact{Name: in.Title + ".png", MimeType: "image/png", Data: []byte{0x89}})
+		return "rendered", nil
+	}))
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "chart sales"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if len(output.Artifacts) != 1 {
+		t.Fatalf("expected 1 artifact but got %d", len(output.Artifacts))
+	}
+
+	if artifact := output.Artifacts[0]; artifact.Name != "sales.png" || artifact.Source != "chart" || artifact.MimeType != "image/png" {
+		t.Errorf("unexpected artifact %#v", artifact)
+	}
+}
+
+func TestHistoryEvolution(t *testing.T) {
+	reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"reply"}]}]}`
+
+	recorder := memorisertest.NewRecorder()
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = recorder
+	a.OpenAIMiddleware = []openai.Middleware{respond(reply, reply)}
+
+	for _, in := range []string{"first", "second"} {
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: in}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+	}
+
+	recorder.AssertSaves(t, "id", 2)
+	recorder.AssertSave(t, "id", 0, memorisertest.Turns(1), memorisertest.Contains("first"))
+	recorder.AssertLatest(t, "id", memorisertest.Turns(2), memorisertest.Contains("first"), memorisertest.Contains("second"))
+}
+
+func TestTrimHistory(t *testing.T) {
+	ctx := context.Background()
+	history := json.RawMessage(`{"model":"gpt-4o-mini","input":[
+		{"role":"user","content":"first question"},
+		{"type":"function_call","call_id":"c","name":"lookup","arguments":"{}"},
+		{"type":"function_call_output","call_id":"c","output":"a long tool output"},
+		{"type":"message","role":"assistant","content":[{"type":"output_text","text":"first answer"}]},
+		{"role":"user","content":"second question"},
+		{"type":"message","role":"assistant","content":[{"type":"output_text","text":"second answer"}]}
+	]}`)
+
+	items := func(session *Session) []json.RawMessage {
+		items, err := splitHistory(session.History)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		return items
+	}
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+
+	t.Run("history under the limit is kept", func(t *testing.T) {
+		a.MaxHistoryTokens = 1000
+		session := &Session{History: history}
+		if err := a.trimHistory(ctx, session, a.MaxHistoryTokens); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(items(session)) != 6 {
+			t.Errorf("expected history to be kept but got %s", session.History)
+		}
+	})
+
+	t.Run("provider counts drive trimming", func(t *testing.T) {
+		// The same history counted as far more tokens than the byte
+		// estimate, as some tokenizers do for non-english text
+		a.MaxHistoryTokens = 1000
+		session := &Session{History: history, PromptTokens: 2000, PromptItems: 6}
+		if err := a.trimHistory(ctx, session, a.MaxHistoryTokens); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		kept := items(session)
+		if len(kept) != 2 || !a.turnStart(kept[0]) {
+			t.Errorf("expected only the last turn to be kept but got %s", session.History)
+		}
+
+		if !session.rewrite || session.PromptItems != 2 {
+			t.Errorf("expected session log to be rewritten but got %#v", session)
+		}
+
+		var body openai.CreateResponse
+		json.Unmarshal(session.History, &body)
+		if body.Model != "gpt-4o-mini" {
+			t.Errorf("expected the rest of the body to be kept but got %s", session.History)
+		}
+	})
+}
+
+func TestImageOutput(t *testing.T) {
+	var modalities []string
+	a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash-image"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.Generation.ImageOutput = true
+	a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+		return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+			modalities = body.GenerationConfig.ResponseModalities
+
+			var resp gemini.ResponseBody
+			err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"a cat"},{"inlineData":{"mimeType":"image/png","data":"iVBO"}}]}}]}`), &resp)
+			return &resp, err
+		}
+	}}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "draw a cat"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if !slices.Equal(modalities, []string{"TEXT", "IMAGE"}) {
+		t.Errorf("expected image modality to be requested but got %v", modalities)
+	}
+
+	if output.Output != "a cat" || len(output.Artifacts) != 1 || output.Artifacts[0].MimeType != "image/png" {
+		t.Errorf("expected text and an image but got %#v", output)
+	}
+}
+
+func TestDumpFailedRequests(t *testing.T) {
+	failing := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			return nil, &openai.APIError{StatusCode: 400, Type: openai.ErrorTypeInvalidRequest, Message: "bad"}
+		}
+	}
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{failing}
+	a.DumpFailedRequests = true
+
+	var hooked *RequestError
+	a.Hooks.OnRequestFailure = func(ctx context.Context, input AgentInput, err *RequestError) {
+		hooked = err
+	}
+
+	_, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "my secret address"})
+
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || hooked != reqErr {
+		t.Fatalf("expected RequestError passed to hook but got %v", err)
+	}
+
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		t.Errorf("expected the provider error to be wrapped but got %v", err)
+	}
+
+	if strings.Contains(reqErr.Request, "my secret address") {
+		t.Errorf("expected user input to be redacted but got %s", reqErr.Request)
+	}
+
+	if !strings.Contains(reqErr.Request, `"model":"gpt-4o-mini"`) || !strings.Contains(reqErr.Request, "[redacted len=17") {
+		t.Errorf("expected model kept and input redacted but got %s", reqErr.Request)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{respond(
+		`{"status":"completed","output":[{"type":"function_call","call_id":"call_1","name":"slow","arguments":"{\"query\":\"x\"}"}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`,
+	)}
+	a.KeepAliveInterval = 10 * time.Millisecond
+
+	var mux sync.Mutex
+	var beats []string
+	a.Hooks.OnKeepAlive = func(ctx context.Context, input AgentInput, tool string, elapsed time.Duration) {
+		mux.Lock()
+		beats = append(beats, tool)
+		mux.Unlock()
+	}
+
+	type Query struct {
+		Query string `json:"query"`
+	}
+	err := a.AddTool(tool.CreateTool("slow", func(ctx context.Context, in Query) (string, error) {
+		time.Sleep(55 * time.Millisecond)
+		return "ok", nil
+	}))
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "go"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(beats) < 2 || beats[0] != "slow" {
+		t.Errorf("expected keepalives for the slow tool but got %v", beats)
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	t.Run("logprobs", func(t *testing.T) {
+		var include []openai.Includable
+		capture := func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				include = body.Include
+				return next(ctx, body)
+			}
+		}
+
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.Generation.Confidence = ConfidenceLogprobs
+		a.OpenAIMiddleware = []openai.Middleware{capture, respond(
+			`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"paris","logprobs":[{"token":"par","logprob":-0.1},{"token":"is","logprob":-0.3}]}]}]}`,
+		)}
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "capital of france"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !slices.Contains(include, openai.IncludableOutputTextLogprobs) {
+			t.Errorf("expected logprobs to be requested but got %v", include)
+		}
+
+		if output.Confidence == nil || math.Abs(*output.Confidence-math.Exp(-0.2)) > 1e-9 {
+			t.Errorf("expected confidence from logprobs but got %v", output.Confidence)
+		}
+	})
+
+	t.Run("logprobs turned off", func(t *testing.T) {
+		var include []openai.Includable
+		reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"paris"}]}]}`
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		// Stores the whole request as history, not just its items
+		a.Memoriser = struct{ memoriser.Memoriser }{memoriser.NewInMemoryMemoriser()}
+		a.Generation.Confidence = ConfidenceLogprobs
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				include = body.Include
+				return next(ctx, body)
+			}
+		}, respond(reply, reply)}
+
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "capital of france"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		a.Generation.Confidence = ""
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "and spain"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if slices.Contains(include, openai.IncludableOutputTextLogprobs) {
+			t.Errorf("expected logprobs no longer requested but got %v", include)
+		}
+	})
+
+	t.Run("self assessment", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.Generation.Confidence = ConfidenceSelfAssessment
+		a.OpenAIMiddleware = []openai.Middleware{respond(
+			`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"paris"}]}],"usage":{"total_tokens":10}}`,
+			`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"0.85"}]}],"usage":{"total_tokens":5}}`,
+		)}
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "capital of france"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if output.Confidence == nil || *output.Confidence != 0.85 {
+			t.Errorf("expected self assessed confidence but got %v", output.Confidence)
+		}
+
+		if output.Output != "paris" || output.Usage.TotalTokens != 15 {
+			t.Errorf("expected the assessment to only add usage but got %#v", output)
+		}
+	})
+}
+
+func TestSummarizeSession(t *testing.T) {
+	var prompt string
+	capture := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			var message openai.Message
+			json.Unmarshal(body.Input[len(body.Input)-1], &message)
+			prompt = message.Content[0].Text
+			return next(ctx, body)
+		}
+	}
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memorisertest.NewRecorder()
+	a.OpenAIMiddleware = []openai.Middleware{capture, respond(
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"I'll book the flight to Lisbon for Friday."}]}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"{\"overview\":\"Booking a trip\",\"topics\":[\"travel\"],\"decisions\":[\"fly Friday\"],\"action_items\":[{\"task\":\"book flight\",\"owner\":\"assistant\"}]}"}]}],"usage":{"total_tokens":7}}`,
+	)}
+
+	if _, err := a.Call(context.Background(), AgentInput{Id: "trip", UserInput: "get me to lisbon on friday"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	summary, err := a.SummarizeSession(context.Background(), "trip", SummarizeOptions{})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if !strings.Contains(prompt, "user: get me to lisbon on friday\nassistant: I'll book the flight") {
+		t.Errorf("expected the transcript in the prompt but got %q", prompt)
+	}
+
+	if summary.Overview != "Booking a trip" || len(summary.ActionItems) != 1 || summary.ActionItems[0].Owner != "assistant" || summary.Usage.TotalTokens != 7 {
+		t.Errorf("unexpected summary %#v", summary)
+	}
+
+	t.Run("unknown session", func(t *testing.T) {
+		_, err := a.SummarizeSession(context.Background(), "nope", SummarizeOptions{})
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound but got %v", err)
+		}
+	})
+}
+
+func TestToolBudget(t *testing.T) {
+	type Ticker struct {
+		Symbol string `json:"symbol"`
+	}
+
+	runs := 0
+	quote := tool.CreateTool("quote", func(ctx context.Context, in Ticker) (string, error) {
+		runs++
+		return "42", nil
+	}, tool.WithDescription("Gets a stock quote"), tool.WithCost(0.5), tool.WithLatency(2*time.Second))
+
+	call := func(id string) string {
+		return `{"type":"function_call","call_id":"` + id + `","name":"quote","arguments":"{\"symbol\":\"ACME\"}"}`
+	}
+
+	var description string
+	var outputs []string
+	capture := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			description = body.Tools[0].Description
+			for _, raw := range body.Input {
+				var item struct {
+					Type   string `json:"type"`
+					Output string `json:"output"`
+				}
+				if json.Unmarshal(raw, &item) == nil && item.Type == "function_call_output" {
+					outputs = append(outputs, item.Output)
+				}
+			}
+			return next(ctx, body)
+		}
+	}
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.ToolBudget = 0.75
+	a.AddTool(quote)
+	a.OpenAIMiddleware = []openai.Middleware{capture, respond(
+		`{"status":"completed","output":[`+call("call_1")+`,`+call("call_2")+`]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"ACME is at 42"}]}]}`,
+	)}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "quote ACME twice"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if description != "Gets a stock quote Costs about 0.5 per call, avoid calling it unless needed. Takes about 2s." {
+		t.Errorf("expected cost and latency in the description but got %q", description)
+	}
+
+	if runs != 1 || output.ToolCost != 0.5 {
+		t.Errorf("expected one call within budget but got %d costing %g", runs, output.ToolCost)
+	}
+
+	if len(outputs) != 2 || !strings.Contains(outputs[1], "budget exceeded") {
+		t.Errorf("expected the model to be told the budget is spent but got %v", outputs)
+	}
+}
+
+func TestScratchpad(t *testing.T) {
+	var instructions string
+	var outputs []string
+	capture := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			instructions = body.Instructions
+			for _, raw := range body.Input {
+				var item struct {
+					Type   string `json:"type"`
+					Output string `json:"output"`
+				}
+				if json.Unmarshal(raw, &item) == nil && item.Type == "function_call_output" {
+					outputs = append(outputs, item.Output)
+				}
+			}
+			return next(ctx, body)
+		}
+	}
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	if err := a.EnableScratchpad(); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	a.OpenAIMiddleware = []openai.Middleware{capture, respond(
+		`{"status":"completed","output":[{"type":"function_call","call_id":"call_1","name":"write_note","arguments":"{\"note\":\"user is vegetarian\"}"}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"noted"}]}]}`,
+		`{"status":"completed","output":[{"type":"function_call","call_id":"call_2","name":"read_notes","arguments":"{}"}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"a salad"}]}]}`,
+	)}
+
+	if _, err := a.Call(t.Context(), AgentInput{Id: "id", UserInput: "I don't eat meat"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if strings.Contains(instructions, "scratchpad holds") {
+		t.Errorf("did not expect notes to be mentioned before any were written but got %q", instructions)
+	}
+
+	outputs = nil
+	if _, err := a.Call(t.Context(), AgentInput{Id: "id", UserInput: "what should I have for dinner?"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if !strings.Contains(instructions, "scratchpad holds 1 notes") {
+		t.Errorf("expected the model to be told about its notes but got %q", instructions)
+	}
+
+	if len(outputs) == 0 || outputs[len(outputs)-1] != `["user is vegetarian"]` {
+		t.Errorf("expected read_notes to return the note but got %v", outputs)
+	}
+
+	snapshot, err := a.Snapshot(t.Context(), "id")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if !strings.Contains(string(snapshot), "user is vegetarian") {
+		t.Errorf("expected the note to be kept in session metadata but got %s", snapshot)
+	}
+}
+
+func TestHistoryRepair(t *testing.T) {
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+
+	// A turn that stopped after the model called a tool
+	broken := json.RawMessage(`{"version":1,"model":"gpt-4o-mini","history":{"input":[
+		{"type":"message","role":"user","content":[{"type":"input_text","text":"weather?"}]},
+		{"type":"function_call","call_id":"call_1","name":"weather","arguments":"{}"}
+	]}}`)
+	if err := a.Restore(t.Context(), "id", broken); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	var repairs []string
+	a.Hooks.OnHistoryRepair = func(ctx context.Context, input AgentInput, made []string) {
+		repairs = append(repairs, made...)
+	}
+
+	var sent []string
+	a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			for _, raw := range body.Input {
+				var base openai.BaseItem
+				json.Unmarshal(raw, &base)
+				sent = append(sent, base.Type)
+			}
+			return next(ctx, body)
+		}
+	}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"sorry, try again"}]}]}`)}
+
+	if _, err := a.Call(t.Context(), AgentInput{Id: "id", UserInput: "hello?"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if len(repairs) != 1 {
+		t.Errorf("expected the hook to be told about one repair but got %v", repairs)
+	}
+
+	if !slices.Equal(sent, []string{"message", "function_call", "function_call_output", "message"}) {
+		t.Errorf("expected the call to be answered before the new input but got %v", sent)
+	}
+}
+
+func TestOllama(t *testing.T) {
+	ctx := context.Background()
+	mem := memoriser.NewInMemoryMemoriser()
+
+	responses := []string{
+		`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"weather","arguments":{"city":"Perth"}}}]},"done":true,"prompt_eval_count":20,"eval_count":5}`,
+		`{"message":{"role":"assistant","content":"It is sunny"},"done":true,"done_reason":"stop","prompt_eval_count":30,"eval_count":3}`,
+		`{"message":{"role":"assistant","content":"You're welcome"},"done":true,"done_reason":"stop","prompt_eval_count":40,"eval_count":2}`,
+	}
+	var sent []*ollama.ChatRequest
+	a, _ := NewAgent(model.OllamaModel("llama3.2"))
+	a.Memoriser = mem
+	a.SystemPrompt = "be nice"
+	a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+		return "sunny", nil
+	}))
+	a.OllamaMiddleware = []ollama.Middleware{func(next ollama.Handler) ollama.Handler {
+		return func(ctx context.Context, body *ollama.ChatRequest) (*ollama.ChatResponse, error) {
+			sent = append(sent, body)
+			var resp ollama.ChatResponse
+			err := json.Unmarshal([]byte(responses[0]), &resp)
+			responses = responses[1:]
+			return &resp, err
+		}
+	}}
+
+	output, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "weather in Perth?"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if output.Output != "It is sunny" || output.Usage.InputTokens != 50 || output.Usage.OutputTokens != 8 {
+		t.Errorf("expected the reply with usage summed but got %+v", output)
+	}
+
+	if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "thanks"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	last := sent[len(sent)-1]
+	if len(last.Messages) != 6 || last.Messages[0].Role != "user" || last.Messages[2].ToolName != "weather" {
+		t.Errorf("expected history to carry over but got %+v", last.Messages)
+	}
+	if len(last.System) != 1 || len(last.Tools) != 1 {
+		t.Errorf("expected the system prompt and tool once but got %v and %d tools", last.System, len(last.Tools))
+	}
+
+	report, err := a.Replay(ctx, "id", ReplayOptions{})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v with %+v", err, report.Mismatches)
+	}
+	if len(report.Outputs) != 2 || len(report.ToolCalls) != 1 {
+		t.Errorf("expected both turns replayed but got %+v", report)
+	}
+
+	t.Run("keys and compression refused", func(t *testing.T) {
+		keys, _ := keypool.NewPool("a", "b")
+		for name, configure := range map[string]func(a *Agent[model.AIModel]){
+			"keys":        func(a *Agent[model.AIModel]) { a.Keys = keys },
+			"compression": func(a *Agent[model.AIModel]) { a.CompressRequests = true },
+		} {
+			a, _ := NewAgent(model.OllamaModel("llama3.2"))
+			a.Memoriser = &memoriser.NoOpMemoriser{}
+			configure(a)
+
+			if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi"}); !errors.Is(err, ErrUnsupportedOption) {
+				t.Errorf("expected ErrUnsupportedOption with %s but got %v", name, err)
+			}
+		}
+	})
+}
+
+func TestMistral(t *testing.T) {
+	ctx := context.Background()
+	mem := memoriser.NewInMemoryMemoriser()
+
+	responses := []string{
+		`{"choices":[{"finish_reason":"tool_calls","message":{"role":"assistant","content":"","tool_calls":[{"id":"call00001","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Perth\"}"}}]}}],"usage":{"prompt_tokens":20,"completion_tokens":5,"total_tokens":25}}`,
+		`{"choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"It is sunny"}}],"usage":{"prompt_tokens":30,"completion_tokens":3,"total_tokens":33}}`,
+		`{"choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"You're welcome"}}],"usage":{"prompt_tokens":40,"completion_tokens":2,"total_tokens":42}}`,
+	}
+	var sent []map[string]json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("expected a chat completions request but got %s", r.URL.Path)
+		}
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = append(sent, body)
+
+		w.Write([]byte(responses[0]))
+		responses = responses[1:]
+	}))
+	t.Cleanup(srv.Close)
+
+	seed := 7
+	a, _ := NewAgent(model.MistralModel("mistral-small-latest"))
+	a.Memoriser = mem
+	a.SystemPrompt = "be nice"
+	a.Generation.Seed = &seed
+	a.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host != "api.mistral.ai" {
+			t.Errorf("expected a request to mistral but got %s", r.URL)
+		}
+		r.URL.Scheme, r.URL.Host = "http", strings.TrimPrefix(srv.URL, "http://")
+		return srv.Client().Transport.RoundTrip(r)
+	})}
+	a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+		return "sunny in " + in.City, nil
+	}))
+
+	input := AgentInput{Id: "id", UserInput: "weather in Perth?", EndUserID: "bob"}
+	input.ToolChoice = &ToolChoice{Mode: ToolChoiceRequired}
+	output, err := a.Call(ctx, input)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if output.Output != "It is sunny" || output.Usage.InputTokens != 50 || output.Usage.TotalTokens != 58 {
+		t.Errorf("expected the reply with usage summed but got %+v", output)
+	}
+	if string(sent[0]["tool_choice"]) != `"any"` || sent[1]["tool_choice"] != nil {
+		t.Errorf("expected the tool forced as any only until called but got %s and %s", sent[0]["tool_choice"], sent[1]["tool_choice"])
+	}
+	if string(sent[0]["random_seed"]) != "7" || sent[0]["seed"] != nil {
+		t.Errorf("expected the seed sent as random_seed but got %s and %s", sent[0]["random_seed"], sent[0]["seed"])
+	}
+	if sent[0]["user"] != nil {
+		t.Errorf("expected no user, which mistral rejects, but got %s", sent[0]["user"])
+	}
+
+	if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "thanks"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	var messages []openai.ChatMessage
+	json.Unmarshal(sent[len(sent)-1]["messages"], &messages)
+	if len(messages) != 6 || messages[0].Role != "system" || messages[0].Content != "be nice" || messages[3].ToolCallID != "call00001" {
+		t.Errorf("expected the system prompt once and history to carry over but got %+v", messages)
+	}
+
+	report, err := a.Replay(ctx, "id", ReplayOptions{})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v with %+v", err, report.Mismatches)
+	}
+	if len(report.Outputs) != 2 || len(report.ToolCalls) != 1 {
+		t.Errorf("expected both turns replayed but got %+v", report)
+	}
+}
+
+func TestCohere(t *testing.T) {
+	ctx := context.Background()
+	mem := memoriser.NewInMemoryMemoriser()
+
+	responses := []string{
+		`{"finish_reason":"TOOL_CALL","message":{"role":"assistant","tool_plan":"check the weather","tool_calls":[{"id":"weather_1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Perth\"}"}}]},"usage":{"tokens":{"input_tokens":20,"output_tokens":5}}}`,
+		`{"finish_reason":"COMPLETE","message":{"role":"assistant","content":[{"type":"text","text":"It is sunny, bring a hat"}],"citations":[{"start":0,"end":11,"text":"It is sunny","sources":[{"type":"tool","id":"weather_1"}]},{"start":13,"end":24,"text":"bring a hat","sources":[{"type":"document","id":"guide"}]}]},"usage":{"tokens":{"input_tokens":30,"output_tokens":3}}}`,
+		`{"finish_reason":"COMPLETE","message":{"role":"assistant","content":[{"type":"text","text":"You're welcome"}]},"usage":{"tokens":{"input_tokens":40,"output_tokens":2}}}`,
+	}
+	var sent []cohere.ChatRequest
+	a, _ := NewAgent(model.CohereModel("command-a-03-2025"))
+	a.Memoriser = mem
+	a.SystemPrompt = "be nice"
+	a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+		return "sunny in " + in.City, nil
+	}))
+	a.CohereMiddleware = []cohere.Middleware{func(next cohere.Handler) cohere.Handler {
+		return func(ctx context.Context, body *cohere.ChatRequest) (*cohere.ChatResponse, error) {
+			sent = append(sent, *body)
+			var resp cohere.ChatResponse
+			err := json.Unmarshal([]byte(responses[0]), &resp)
+			responses = responses[1:]
+			return &resp, err
+		}
+	}}
+
+	input := AgentInput{Id: "id", UserInput: "weather in Perth?", Documents: []Document{{ID: "guide", Data: map[string]string{"text": "Perth sun is harsh"}}}}
+	output, err := a.Call(ctx, input)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if output.Output != "It is sunny, bring a hat" || output.Usage.InputTokens != 50 || output.Usage.TotalTokens != 58 {
+		t.Errorf("expected the reply with usage summed but got %+v", output)
+	}
+	if len(output.Citations) != 2 || output.Citations[0].Sources[0] != "weather_1" || output.Citations[1].Sources[0] != "guide" {
+		t.Errorf("expected the tool output and document cited but got %+v", output.Citations)
+	}
+	if len(sent[0].Documents) != 1 || sent[0].Documents[0].Data["text"] != "Perth sun is harsh" {
+		t.Errorf("expected the documents sent but got %+v", sent[0].Documents)
+	}
+
+	if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "thanks"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	last := sent[len(sent)-1]
+	if len(last.Messages) != 5 || last.Messages[1].ToolPlan != "check the weather" || last.Messages[2].ToolCallID != "weather_1" {
+		t.Errorf("expected history to carry over but got %+v", last.Messages)
+	}
+	if len(last.System) != 1 || len(last.Tools) != 1 || len(last.Documents) != 0 {
+		t.Errorf("expected the system prompt and tool once without documents but got %v, %d tools and %v", last.System, len(last.Tools), last.Documents)
+	}
+
+	report, err := a.Replay(ctx, "id", ReplayOptions{})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v with %+v", err, report.Mismatches)
+	}
+	if len(report.Outputs) != 2 || len(report.ToolCalls) != 1 {
+		t.Errorf("expected both turns replayed but got %+v", report)
+	}
+}
+
+func TestHuggingFace(t *testing.T) {
+	ctx := context.Background()
+
+	responses := []string{
+		`{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","tool_calls":[{"id":"0","type":"function","function":{"name":"weather","arguments":{"city":"Perth"}}}]}}],"usage":{"prompt_tokens":20,"completion_tokens":5,"total_tokens":25}}`,
+		`{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"It is sunny"}}],"usage":{"prompt_tokens":30,"completion_tokens":3,"total_tokens":33}}`,
+		`{"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"You're welcome"}}],"usage":{"prompt_tokens":40,"completion_tokens":2,"total_tokens":42}}`,
+	}
+	var sent []openai.ChatCompletionRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("expected a chat completions request but got %s", r.URL.Path)
+		}
+		var body openai.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = append(sent, body)
+
+		w.Write([]byte(responses[0]))
+		responses = responses[1:]
+	}))
+	t.Cleanup(srv.Close)
+
+	a, _ := NewAgent(model.HuggingFaceModel("tgi"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.Client = srv.Client()
+	a.HuggingFaceEndpoint = srv.URL
+	a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+		return "sunny in " + in.City, nil
+	}))
+
+	output, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "weather in Perth?"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if output.Output != "It is sunny" || output.Usage.InputTokens != 50 || output.Usage.TotalTokens != 58 {
+		t.Errorf("expected the reply with usage summed but got %+v", output)
+	}
+
+	if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "thanks"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	last := sent[len(sent)-1]
+	if len(last.Messages) != 5 || last.Messages[1].ToolCalls[0].Function.Arguments != `{"city":"Perth"}` || last.Messages[2].ToolCallID != last.Messages[1].ToolCalls[0].ID {
+		t.Errorf("expected history to carry over but got %+v", last.Messages)
+	}
+
+	report, err := a.Replay(ctx, "id", ReplayOptions{})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v with %+v", err, report.Mismatches)
+	}
+	if len(report.Outputs) != 2 || len(report.ToolCalls) != 1 {
+		t.Errorf("expected both turns replayed but got %+v", report)
+	}
+
+	t.Run("without an endpoint", func(t *testing.T) {
+		a, _ := NewAgent(model.HuggingFaceModel("tgi"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi"}); err == nil {
+			t.Errorf("expected an endpoint to be required")
+		}
+	})
+}
+
+func TestOpenRouter(t *testing.T) {
+	a, _ := NewAgent(model.OpenRouterModel("anthropic/claude-sonnet-4"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{
+		respond(`{"status":"completed","model":"openai/gpt-4o-mini","provider":"OpenAI","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`),
+	}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if output.ServedModel != "openai/gpt-4o-mini" || output.ServedProvider != "OpenAI" {
+		t.Errorf("expected the serving model reported but got %q from %q", output.ServedModel, output.ServedProvider)
+	}
+}
+
+func TestDeepSeek(t *testing.T) {
+	a, _ := NewAgent(model.DeepSeekModel("deepseek-reasoner"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{
+		respond(`{"status":"completed","output":[{"type":"reasoning","summary":[{"type":"summary_text","text":"a greeting, greet back"}]},{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`),
+	}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if output.Output != "hi" || output.Thoughts != "a greeting, greet back" {
+		t.Errorf("expected the reasoning apart from the answer but got %q and %q", output.Output, output.Thoughts)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("catalog", func(t *testing.T) {
+		a, _ := NewAgent(model.MistralModel("mistral-large-latest"))
+		caps, err := a.Capabilities()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !caps.Tools || !caps.StructuredOutput || caps.Images || !caps.Streaming || caps.ContextWindow != 128_000 {
+			t.Errorf("expected mistral large's capabilities but got %+v", caps)
+		}
+	})
+
+	t.Run("schema without structured output", func(t *testing.T) {
+		var sent []byte
+		a, _ := NewAgent(model.DeepSeekModel("deepseek-chat"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent, _ = json.Marshal(body)
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"{\"city\":\"Perth\"}"}]}]}`)}
+
+		output, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "where?", Schema: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`)})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if strings.Contains(string(sent), "json_schema") || !strings.Contains(string(sent), "Respond with only JSON matching this schema") {
+			t.Errorf("expected the schema asked for rather than enforced but got %s", sent)
+		}
+		if output.Output != `{"city":"Perth"}` {
+			t.Errorf("expected the structured output but got %s", output.Output)
+		}
+	})
+
+	t.Run("tools to a model without them", func(t *testing.T) {
+		RegisterProvider[echoModel](func(cfg ProviderConfig) (Provider, error) {
+			return echoProvider{}, nil
+		})
+		defer func() {
+			providers.mux.Lock()
+			delete(providers.factories, reflect.TypeFor[echoModel]())
+			providers.mux.Unlock()
+		}()
+
+		a, _ := NewAgent(echoModel("echo"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+			return "sunny", nil
+		}))
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "weather?"}); !errors.Is(err, ErrInvalidTool) {
+			t.Errorf("expected ErrInvalidTool but got %v", err)
+		}
+	})
+}
+
+func TestCost(t *testing.T) {
+	t.Run("call", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OpenAIMiddleware = []openai.Middleware{
+			respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}],
+				"usage":{"input_tokens":1000000,"input_tokens_details":{"cached_tokens":500000},"output_tokens":1000000,"total_tokens":2000000}}`),
+		}
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		// Half the input at the cached price
+		if math.Abs(output.Cost-0.7125) > 1e-9 {
+			t.Errorf("expected 0.7125 but got %v", output.Cost)
+		}
+	})
+
+	t.Run("thinking billed as output", func(t *testing.T) {
+		usage := Usage{InputTokens: 1_000_000, OutputTokens: 1_000_000, ReasoningTokens: 1_000_000, TotalTokens: 3_000_000}
+		if cost := usage.Cost(model.GeminiAiModel("gemini-2.5-flash")); math.Abs(cost-5.3) > 1e-9 {
+			t.Errorf("expected 5.3 but got %v", cost)
+		}
+	})
+
+	t.Run("unknown model", func(t *testing.T) {
+		if cost := (Usage{InputTokens: 100, TotalTokens: 100}).Cost(model.OllamaModel("llama3.2")); cost != 0 {
+			t.Errorf("expected no cost but got %v", cost)
+		}
+	})
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"dump","arguments":{"city":"Perth"}}}]},"done":true}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	a, _ := NewAgent(model.OllamaModel("llama3.2"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.Client = srv.Client()
+	a.OllamaHost = srv.URL
+	a.MaxRequestBytes = 4096
+	a.AddTool(tool.CreateTool("dump", func(ctx context.Context, in City) (string, error) {
+		return strings.Repeat("x", 8192), nil
+	}))
+
+	_, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "dump it"})
+	if !errors.Is(err, httpclient.ErrRequestTooLarge) {
+		t.Errorf("expected ErrRequestTooLarge but got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the oversized request not to be sent but got %d calls", calls)
+	}
+}
+
+func TestChatCompletionsSampling(t *testing.T) {
+	var sent map[string]json.RawMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Write([]byte(`{"id":"chatcmpl_1","choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hi"}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	seed, presence, frequency := 7, 0.5, -0.25
+	a, _ := NewAgent(model.OpenAiModel("llama-3.1-8b"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.Client = srv.Client()
+	a.OpenAIBaseURL = srv.URL
+	a.ChatCompletions = true
+	a.Generation.Seed = &seed
+	a.Generation.PresencePenalty = &presence
+	a.Generation.FrequencyPenalty = &frequency
+
+	if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello", StopSequences: []string{"END", "STOP"}}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	for field, want := range map[string]string{
+		"stop":              `["END","STOP"]`,
+		"seed":              `7`,
+		"presence_penalty":  `0.5`,
+		"frequency_penalty": `-0.25`,
+	} {
+		if string(sent[field]) != want {
+			t.Errorf("expected %s of %s but got %s", field, want, sent[field])
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("openai", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, `data: {"type":"response.output_text.delta","delta":"hel"}`+"\n\n")
+			fmt.Fprint(w, `data: {"type":"response.output_text.delta","delta":"lo"}`+"\n\n")
+			fmt.Fprint(w, `data: {"type":"response.completed","response":{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hello"}]}]}}`+"\n\n")
+		}))
+		t.Cleanup(srv.Close)
+
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+		a.Client = srv.Client()
+		a.OpenAIBaseURL = srv.URL
+
+		var streamed []string
+		output, err := a.Stream(ctx, AgentInput{Id: "id", UserInput: "hi"}, func(text string) {
+			streamed = append(streamed, text)
+		})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if strings.Join(streamed, "|") != "hel|lo" || output.Output != "hello" {
+			t.Errorf("expected hello streamed in two pieces but got %q and %q", streamed, output.Output)
+		}
+
+		session, _ := a.load(ctx, a.Memoriser, "id")
+		if strings.Contains(string(session.History), "stream") {
+			t.Errorf("expected streaming left out of history but got %s", session.History)
+		}
+	})
+
+	t.Run("ollama can't", func(t *testing.T) {
+		a, _ := NewAgent(model.OllamaModel("llama3.2"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OllamaMiddleware = []ollama.Middleware{func(next ollama.Handler) ollama.Handler {
+			return func(ctx context.Context, body *ollama.ChatRequest) (*ollama.ChatResponse, error) {
+				t.Error("did not expect a request to be sent")
+				return next(ctx, body)
+			}
+		}}
+
+		if caps, _ := a.Capabilities(); caps.Streaming {
+			t.Errorf("expected ollama's capabilities to say it can't stream")
+		}
+		if _, err := a.Stream(ctx, AgentInput{Id: "id", UserInput: "hi"}, func(string) {}); !errors.Is(err, ErrUnsupportedOption) {
+			t.Errorf("expected ErrUnsupportedOption but got %v", err)
+		}
+	})
+}
+
+func TestSamplingOptions(t *testing.T) {
+	seed, presence, frequency := 7, 0.5, -0.25
+	tests := []struct {
+		name  string
+		agent func(a *Agent[model.AIModel], url string)
+		model model.AIModel
+		reply string
+		// Where each option lands in the request, in the order seed,
+		// presence then frequency. Empty when the provider can't take it.
+		paths [3]string
+	}{
+		{
+			name:  "gemini",
+			model: model.GeminiAiModel("gemini-2.5-flash"),
+			reply: `{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`,
+			paths: [3]string{"generationConfig.seed", "generationConfig.presencePenalty", "generationConfig.frequencyPenalty"},
+		},
+		{
+			name:  "ollama",
+			agent: func(a *Agent[model.AIModel], url string) { a.OllamaHost = url },
+			model: model.OllamaModel("llama3.2"),
+			reply: `{"message":{"role":"assistant","content":"hi"},"done":true}`,
+			paths: [3]string{"options.seed", "options.presence_penalty", "options.frequency_penalty"},
+		},
+		{
+			name:  "cohere",
+			model: model.CohereModel("command-a-03-2025"),
+			reply: `{"finish_reason":"COMPLETE","message":{"role":"assistant","content":[{"type":"text","text":"hi"}]}}`,
+			paths: [3]string{"seed", "presence_penalty", "frequency_penalty"},
+		},
+		{
+			name:  "mistral",
+			model: model.MistralModel("mistral-small-latest"),
+			reply: `{"choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hi"}}]}`,
+			paths: [3]string{"random_seed", "presence_penalty", "frequency_penalty"},
+		},
+		{
+			name:  "huggingface",
+			agent: func(a *Agent[model.AIModel], url string) { a.HuggingFaceEndpoint = url },
+			model: model.HuggingFaceModel("tgi"),
+			reply: `{"choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hi"}}]}`,
+			paths: [3]string{"seed", "presence_penalty", "frequency_penalty"},
+		},
+		{
+			name:  "openai chat completions",
+			agent: func(a *Agent[model.AIModel], url string) { a.OpenAIBaseURL, a.ChatCompletions = url, true },
+			model: model.OpenAiModel("llama-3.1-8b"),
+			reply: `{"choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hi"}}]}`,
+			paths: [3]string{"seed", "presence_penalty", "frequency_penalty"},
+		},
+		{
+			name:  "openai responses",
+			model: model.OpenAiModel("gpt-4o-mini"),
+			reply: `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent map[string]any
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				w.Write([]byte(tt.reply))
+			}))
+			t.Cleanup(srv.Close)
+
+			a, _ := NewAgent(tt.model)
+			a.Memoriser = &memoriser.NoOpMemoriser{}
+			a.Auth = "key"
+			a.Generation.Seed = &seed
+			a.Generation.PresencePenalty = &presence
+			a.Generation.FrequencyPenalty = &frequency
+			// Every provider is sent to the test server, whatever its host
+			a.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				r.URL.Scheme, r.URL.Host = "http", strings.TrimPrefix(srv.URL, "http://")
+				return srv.Client().Transport.RoundTrip(r)
+			})}
+			if tt.agent != nil {
+				tt.agent(a, srv.URL)
+			}
+
+			if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"}); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			lookup := func(path string) any {
+				var v any = sent
+				for key := range strings.SplitSeq(path, ".") {
+					object, _ := v.(map[string]any)
+					v = object[key]
+				}
+				return v
+			}
+			for i, want := range []any{float64(seed), presence, frequency} {
+				if tt.paths[i] == "" {
+					continue
+				}
+				if got := lookup(tt.paths[i]); got != want {
+					t.Errorf("expected %v at %s but got %v", want, tt.paths[i], got)
+				}
+			}
+
+			if tt.paths == [3]string{} {
+				for _, field := range []string{"seed", "presence_penalty", "frequency_penalty"} {
+					if v, ok := sent[field]; ok {
+						t.Errorf("expected no %s but got %v", field, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestServiceTier(t *testing.T) {
+	var requested string
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.Generation.ServiceTier = openai.ServiceTierFlex
+	a.OpenAIMiddleware = []openai.Middleware{
+		func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				requested = body.ServiceTier
+				return next(ctx, body)
+			}
+		},
+		respond(`{"status":"completed","service_tier":"default","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`),
+	}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if requested != openai.ServiceTierFlex {
+		t.Errorf("expected flex to be requested but got %q", requested)
+	}
+
+	if output.ServiceTier != openai.ServiceTierDefault {
+		t.Errorf("expected the tier used to be reported but got %q", output.ServiceTier)
+	}
+}
+
+func TestPromptCaching(t *testing.T) {
+	reply := `{"status":"completed","usage":{"input_tokens":100,"input_tokens_details":{"cached_tokens":80}},"output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`
+
+	var sent []openai.CreateResponse
+	mem := memoriser.NewInMemoryMemoriser()
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = mem
+	a.SystemPrompt = "be nice"
+	a.PromptCaching = true
+	a.DynamicInstructions = []InstructionFunc{func(ctx context.Context, input AgentInput) (string, error) {
+		return "the time is " + input.UserInput, nil
+	}}
+	a.OpenAIMiddleware = []openai.Middleware{
+		func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				copied := *body
+				copied.Input = slices.Clone(body.Input)
+				sent = append(sent, copied)
+				return next(ctx, body)
+			}
+		},
+		respond(reply, reply),
+	}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "noon"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "one"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if output.Usage.CacheRatio() != 0.8 {
+		t.Errorf("expected the cache ratio to be reported but got %v", output.Usage.CacheRatio())
+	}
+
+	for _, body := range sent {
+		if body.Instructions != "be nice" || body.PromptCacheKey == "" {
+			t.Errorf("expected a stable prefix with a cache key but got %q and %q", body.Instructions, body.PromptCacheKey)
+		}
+	}
+
+	// The earlier turn is sent as it was, with only the latest instructions
+	// ahead of the latest input
+	last := sent[1].Input
+	if len(last) != 4 || !strings.Contains(string(last[2]), "the time is one") || !strings.Contains(string(last[2]), `"developer"`) {
+		t.Fatalf("expected instructions just before the input but got %s", last)
+	}
+	if strings.Contains(string(last[0])+string(last[1]), "the time is") {
+		t.Errorf("expected instructions to be left out of history but got %s", last)
+	}
+}
+
+func TestDeveloperMessages(t *testing.T) {
+	t.Run("openai", func(t *testing.T) {
+		reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`
+
+		var sent []openai.CreateResponse
+		a, _ := NewAgent(model.OpenAiModel("gpt-4.1"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+		a.SystemPrompt = "be nice"
+		a.DeveloperMessages = []string{"never mention pricing"}
+		a.OpenAIMiddleware = []openai.Middleware{
+			func(next openai.Handler) openai.Handler {
+				return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+					copied := *body
+					copied.Input = slices.Clone(body.Input)
+					sent = append(sent, copied)
+					return next(ctx, body)
+				}
+			},
+			respond(reply, reply),
+		}
+
+		for _, in := range []string{"hello", "again"} {
+			if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: in}); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		last := sent[1]
+		if last.Instructions != "be nice" {
+			t.Errorf("expected the system prompt kept as instructions but got %q", last.Instructions)
+		}
+		if len(last.Input) != 4 || !strings.Contains(string(last.Input[0]), `"developer"`) || !strings.Contains(string(last.Input[0]), "never mention pricing") {
+			t.Fatalf("expected the developer message to lead the input once but got %s", last.Input)
+		}
+		if strings.Contains(string(last.Input[1])+string(last.Input[2])+string(last.Input[3]), "pricing") {
+			t.Errorf("expected the developer message left out of history but got %s", last.Input)
+		}
+	})
+
+	t.Run("gemini", func(t *testing.T) {
+		var sent *gemini.RequestBody
+		a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.SystemPrompt = "be nice"
+		a.DeveloperMessages = []string{"never mention pricing"}
+		a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+			return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+				sent = body
+				var resp gemini.ResponseBody
+				err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`), &resp)
+				return &resp, err
+			}
+		}}
+
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(sent.SystemInstruction.Parts) != 1 || sent.SystemInstruction.Parts[0].Text != "be nice\n\nnever mention pricing" {
+			t.Errorf("expected the developer message after the system prompt but got %+v", sent.SystemInstruction)
+		}
+	})
+}
+
+func TestToolsAddedMidSession(t *testing.T) {
+	reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`
+
+	var offered [][]string
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) { return "sunny", nil }))
+	a.OpenAIMiddleware = []openai.Middleware{
+		func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				var names []string
+				for _, t := range body.Tools {
+					names = append(names, t.Name)
+				}
+				offered = append(offered, names)
+				return next(ctx, body)
+			}
+		},
+		respond(reply, reply),
+	}
+
+	if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hello"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	a.AddTool(tool.CreateTool("time", func(ctx context.Context, in City) (string, error) { return "noon", nil }))
+	if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "and now?"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if !slices.Equal(offered[1], []string{"weather", "time"}) {
+		t.Errorf("expected the new tool to reach the model but got %v", offered)
+	}
+}
+
+func TestToolLimits(t *testing.T) {
+	noop := func(ctx context.Context, in City) (string, error) { return "", nil }
+	oversized := tool.CreateTool("oversized", noop)
+	oversized.Definition.Properties = map[string]any{"city": map[string]any{"type": "string", "enum": []string{strings.Repeat("a", 120_000)}}}
+
+	t.Run("oversized schema fails registration", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+
+		if err := a.AddTool(oversized); !errors.Is(err, ErrInvalidTool) {
+			t.Errorf("expected ErrInvalidTool but got %v", err)
+		}
+	})
+
+	t.Run("tools are checked again before each request", func(t *testing.T) {
+		a, _ := NewAgent(model.OllamaModel("llama3.2"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		if err := a.AddTool(oversized); err != nil {
+			t.Fatalf("expected ollama to take the schema but got %v", err)
+		}
+
+		sent := false
+		a.Model = model.OpenAiModel("gpt-4o-mini")
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = true
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[]}`)}
+
+		if _, err := a.Call(t.Context(), AgentInput{Id: "id", UserInput: "hi"}); !errors.Is(err, ErrInvalidTool) {
+			t.Errorf("expected ErrInvalidTool but got %v", err)
+		}
+		if sent {
+			t.Errorf("expected nothing sent to openai")
+		}
+	})
+
+	t.Run("too many tools for the provider", func(t *testing.T) {
+		a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.ToolSelector = KeywordSelector{}
+		a.MaxTurnTools = 200
+
+		for i := range 130 {
+			if err := a.AddTool(tool.CreateTool(fmt.Sprintf("tool_%d", i), noop)); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		if _, err := a.Call(t.Context(), AgentInput{Id: "id", UserInput: "hi"}); !errors.Is(err, ErrExceededMaxToolCount) {
+			t.Errorf("expected ErrExceededMaxToolCount but got %v", err)
+		}
+	})
+}
+
+// A model answered by echoProvider
+type echoModel string
+
+func (m echoModel) Model() string {
+	return string(m)
+}
+
+// Answers with the last user message, shouting
+type echoProvider struct{}
+
+type echoBody struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
+func (b *echoBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Messages []json.RawMessage `json:"messages"`
+	}{b.Messages})
+}
+
+func (b *echoBody) AppendUserInput(text string) error {
+	item, err := json.Marshal(map[string]string{"role": "user", "content": text})
+	b.Messages = append(b.Messages, item)
+	return err
+}
+
+func (b *echoBody) Repair() ([]string, error) {
+	return nil, nil
+}
+
+func (b *echoBody) Finish(compact func(string) string) error {
+	return nil
+}
+
+func (b *echoBody) Items(from int) ([]json.RawMessage, int, error) {
+	return messageItems(b.Messages, from)
+}
+
+func (p echoProvider) Body(ctx context.Context, turn Turn) (Body, error) {
+	body := &echoBody{}
+	if turn.History != nil {
+		if err := json.Unmarshal(turn.History, body); err != nil {
+			return nil, err
+		}
+	}
+	return body, body.AppendUserInput(turn.Input.UserInput)
+}
+
+func (p echoProvider) Prepare(ctx context.Context, body Body, turn Turn) error {
+	return nil
+}
+
+func (p echoProvider) Generate(ctx context.Context, b Body, tools []tool.Tool[any, any]) (Body, Result, error) {
+	body := b.(*echoBody)
+	var last struct {
+		Content string `json:"content"`
+	}
+	json.Unmarshal(body.Messages[len(body.Messages)-1], &last)
+
+	text := strings.ToUpper(last.Content)
+	item, _ := json.Marshal(map[string]string{"role": "assistant", "content": text})
+	next := &echoBody{Messages: append(slices.Clone(body.Messages), item)}
+	return next, Result{Text: text, Usage: Usage{TotalTokens: 1}}, nil
+}
+
+// Streams the reply a word at a time
+func (p echoProvider) Stream(ctx context.Context, b Body, tools []tool.Tool[any, any], onText func(text string)) (Body, Result, error) {
+	next, res, err := p.Generate(ctx, b, tools)
+	for _, word := range strings.SplitAfter(res.Text, " ") {
+		onText(word)
+	}
+	return next, res, err
+}
+
+func (p echoProvider) History(items []json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(map[string][]json.RawMessage{"messages": items})
+}
+
+func (p echoProvider) CheckHistory(history json.RawMessage) error {
+	return json.Unmarshal(history, &echoBody{})
+}
+
+func (p echoProvider) TurnStart(item json.RawMessage) bool {
+	return userMessage(item)
+}
+
+func (p echoProvider) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func TestRegisterProvider(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("unregistered model", func(t *testing.T) {
+		a, _ := NewAgent(echoModel("unregistered"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi"}); !errors.Is(err, ErrModelUnmatched) {
+			t.Errorf("expected ErrModelUnmatched but got %v", err)
+		}
+	})
+
+	RegisterProvider[echoModel](func(cfg ProviderConfig) (Provider, error) {
+		if cfg.Model.Model() != "echo" {
+			return nil, fmt.Errorf("expected the agent's model but got %v", cfg.Model)
+		}
+		return echoProvider{}, nil
+	})
+	defer func() {
+		providers.mux.Lock()
+		delete(providers.factories, reflect.TypeFor[echoModel]())
+		providers.mux.Unlock()
+	}()
+
+	a, _ := NewAgent(echoModel("echo"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+
+	output, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if output.Output != "HI" {
+		t.Errorf("expected HI but got %q", output.Output)
+	}
+
+	if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "again"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	session, err := a.load(ctx, a.Memoriser, "id")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	var body echoBody
+	json.Unmarshal(session.History, &body)
+	if len(body.Messages) != 4 {
+		t.Errorf("expected both turns in history but got %s", session.History)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	t.Run("validation", func(t *testing.T) {
+		tooMany := map[string]string{}
+		for i := range 17 {
+			tooMany[fmt.Sprint("key", i)] = "v"
+		}
+
+		tests := []struct {
+			name     string
+			metadata map[string]string
+			valid    bool
+		}{
+			{"none", nil, true},
+			{"pairs", map[string]string{"tenant": "acme", "Feature Flag": "on"}, true},
+			{"too many pairs", tooMany, false},
+			{"empty key", map[string]string{"": "v"}, false},
+			{"long key", map[string]string{strings.Repeat("k", 65): "v"}, false},
+			{"long value", map[string]string{"k": strings.Repeat("v", 513)}, false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := validMetadata(tt.metadata)
+				if tt.valid && err != nil {
+					t.Errorf("did not expect err but got %v", err)
+				}
+				if !tt.valid && !errors.Is(err, ErrInvalidMetadata) {
+					t.Errorf("expected ErrInvalidMetadata but got %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("sent as openai metadata and gemini labels", func(t *testing.T) {
+		metadata := map[string]string{"Tenant": "Acme Corp", "1st-party": "yes"}
+
+		var openaiSent map[string]string
+		oa, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		oa.Memoriser = &memoriser.NoOpMemoriser{}
+		oa.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				openaiSent = body.Metadata
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`)}
+
+		if _, err := oa.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi", Metadata: metadata}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if !maps.Equal(openaiSent, metadata) {
+			t.Errorf("expected the metadata sent as is but got %v", openaiSent)
+		}
+
+		var labels map[string]string
+		g, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+		g.Memoriser = &memoriser.NoOpMemoriser{}
+		g.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+			return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+				labels = body.Labels
+				var resp gemini.ResponseBody
+				err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`), &resp)
+				return &resp, err
+			}
+		}}
+
+		if _, err := g.Call(context.Background(), AgentInput{Id: "User-7", UserInput: "hi", Metadata: metadata}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		want := map[string]string{"tenant": "acme_corp", "k1st-party": "yes", gemini.LabelEndUser: "user-7"}
+		if !maps.Equal(labels, want) {
+			t.Errorf("expected labels %v but got %v", want, labels)
+		}
+	})
+
+	t.Run("gemini labels can't collide", func(t *testing.T) {
+		g, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+		g.Memoriser = &memoriser.NoOpMemoriser{}
+		g.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+			return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+				t.Error("did not expect a request to be sent")
+				return next(ctx, body)
+			}
+		}}
+
+		for _, metadata := range []map[string]string{
+			{"Tenant": "acme", "tenant": "globex"},
+			{"a.b": "1", "a_b": "2"},
+			{"End User": "bob"},
+		} {
+			if _, err := g.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi", Metadata: metadata}); !errors.Is(err, ErrInvalidMetadata) {
+				t.Errorf("expected ErrInvalidMetadata for %v but got %v", metadata, err)
+			}
+		}
+	})
+}
+
+func TestStopSequences(t *testing.T) {
+	t.Run("validation", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			stops []string
+			valid bool
+		}{
+			{"none", nil, true},
+			{"five", []string{"a", "b", "c", "d", "e"}, true},
+			{"six", []string{"a", "b", "c", "d", "e", "f"}, false},
+			{"empty", []string{"END", ""}, false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := validStopSequences(tt.stops)
+				if tt.valid && err != nil {
+					t.Errorf("did not expect err but got %v", err)
+				}
+				if !tt.valid && !errors.Is(err, ErrInvalidStopSequences) {
+					t.Errorf("expected ErrInvalidStopSequences but got %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("trimming", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			text  string
+			stops []string
+			want  string
+		}{
+			{"no stops", "a\nb", nil, "a\nb"},
+			{"absent", "a\nb", []string{"END"}, "a\nb"},
+			{"cut at the stop", "name: bob\nEND\nmore", []string{"END"}, "name: bob\n"},
+			{"earliest of several", "one;two\nthree", []string{"\n", ";"}, "one"},
+			{"at the start", "ENDrest", []string{"END"}, ""},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if got := trimAtStop(tt.text, tt.stops); got != tt.want {
+					t.Errorf("expected %q but got %q", tt.want, got)
+				}
+			})
+		}
+	})
+
+	t.Run("emulated for openai", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OpenAIMiddleware = []openai.Middleware{respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"1. apples\n2. pears\n3. plums"}]}]}`)}
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "list fruit", StopSequences: []string{"\n3."}})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if output.Output != "1. apples\n2. pears" {
+			t.Errorf("expected the output cut at the stop but got %q", output.Output)
+		}
+	})
+
+	t.Run("rejected before calling", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				t.Errorf("did not expect a request")
+				return nil, errors.New("unexpected request")
+			}
+		}}
+
+		_, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi", StopSequences: []string{""}})
+		if !errors.Is(err, ErrInvalidStopSequences) {
+			t.Errorf("expected ErrInvalidStopSequences but got %v", err)
+		}
+	})
+}
+
+func TestSafetyFeedback(t *testing.T) {
+	rated := `{"candidates":[{"content":{"role":"model","parts":[{"text":"here you go"}]},"finishReason":"STOP","safetyRatings":[
+		{"category":"HARM_CATEGORY_HARASSMENT","probability":"LOW"},
+		{"category":"HARM_CATEGORY_DANGEROUS_CONTENT","probability":"NEGLIGIBLE"}
+	]}],"promptFeedback":{"safetyRatings":[{"category":"HARM_CATEGORY_HARASSMENT","probability":"MEDIUM"}]}}`
+
+	a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+		return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+			var resp gemini.ResponseBody
+			err := json.Unmarshal([]byte(rated), &resp)
+			return &resp, err
+		}
+	}}
+
+	var hooked []SafetyFeedback
+	var hookedInput AgentInput
+	a.Hooks.OnSafetyFeedback = func(ctx context.Context, input AgentInput, feedback SafetyFeedback) {
+		hooked = append(hooked, feedback)
+		hookedInput = input
+	}
+
+	output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "be rude"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	expected := SafetyFeedback{
+		Prompt: []SafetyRating{{Category: "HARM_CATEGORY_HARASSMENT", Probability: "MEDIUM"}},
+		Response: []SafetyRating{
+			{Category: "HARM_CATEGORY_HARASSMENT", Probability: "LOW"},
+			{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "NEGLIGIBLE"},
+		},
+	}
+	if !reflect.DeepEqual(output.Safety, expected) {
+		t.Errorf("expected %+v but got %+v", expected, output.Safety)
+	}
+
+	if len(hooked) != 1 || !reflect.DeepEqual(hooked[0], expected) || hookedInput.UserInput != "be rude" {
+		t.Errorf("expected the hook called once with the feedback but got %+v for %q", hooked, hookedInput.UserInput)
+	}
+
+	t.Run("not called without feedback", func(t *testing.T) {
+		hooked = nil
+		rated = `{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`
+
+		output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(hooked) != 0 || len(output.Safety.Prompt)+len(output.Safety.Response) != 0 {
+			t.Errorf("expected no feedback but got %+v and %+v", output.Safety, hooked)
+		}
+	})
+}
+
+func TestGeminiSystemInstruction(t *testing.T) {
+	var sent []json.RawMessage
+	a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.SystemPrompt = "be nice"
+	a.DynamicInstructions = []InstructionFunc{func(ctx context.Context, input AgentInput) (string, error) {
+		return "today is monday", nil
+	}}
+	a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+		return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+			raw, _ := json.Marshal(body.SystemInstruction)
+			sent = append(sent, raw)
+			var resp gemini.ResponseBody
+			err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`), &resp)
+			return &resp, err
+		}
+	}}
+
+	for range 2 {
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi", Instructions: []string{"the user is bob"}}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+	}
+
+	want := `{"parts":[{"text":"be nice"},{"text":"today is monday"},{"text":"the user is bob"}]}`
+	for i, got := range sent {
+		if string(got) != want {
+			t.Errorf("expected each instruction as a part of call %d, %s, but got %s", i, want, got)
+		}
+	}
+}
+
+func TestThinking(t *testing.T) {
+	budget := func(n int) *int { return &n }
+
+	tests := []struct {
+		name       string
+		generation GenerationOptions
+		want       string
+	}{
+		{"model default", GenerationOptions{}, ""},
+		{"disabled", GenerationOptions{ThinkingBudget: budget(0)}, `{"thinkingBudget":0}`},
+		{"dynamic", GenerationOptions{ThinkingBudget: budget(-1)}, `{"thinkingBudget":-1}`},
+		{"budget with thoughts", GenerationOptions{ThinkingBudget: budget(1024), IncludeThoughts: true}, `{"thinkingBudget":1024,"includeThoughts":true}`},
+		{"thoughts only", GenerationOptions{IncludeThoughts: true}, `{"includeThoughts":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent map[string]json.RawMessage
+			a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+			a.Memoriser = &memoriser.NoOpMemoriser{}
+			a.Generation = tt.generation
+			a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+				return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+					raw, _ := json.Marshal(body.GenerationConfig)
+					json.Unmarshal(raw, &sent)
+					var resp gemini.ResponseBody
+					err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"weighing it up","thought":true},{"text":"42"}]},"finishReason":"STOP"}]}`), &resp)
+					return &resp, err
+				}
+			}}
+
+			output, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "meaning of life?"})
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			if got := string(sent["thinkingConfig"]); got != tt.want {
+				t.Errorf("expected thinking config %q but got %q", tt.want, got)
+			}
+			if output.Output != "42" || output.Thoughts != "weighing it up" {
+				t.Errorf("expected thoughts kept apart from the output but got %q and %q", output.Output, output.Thoughts)
+			}
+		})
+	}
+
+	t.Run("openai reasoning summaries", func(t *testing.T) {
+		for _, m := range []string{"o4-mini", "gpt-4o-mini"} {
+			var sent openai.Reasoning
+			a, _ := NewAgent(model.OpenAiModel(m))
+			a.Memoriser = &memoriser.NoOpMemoriser{}
+			a.Generation.IncludeThoughts = true
+			a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+				return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+					sent = body.Reasoning
+					return next(ctx, body)
+				}
+			}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"42"}]}]}`)}
+
+			if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "meaning of life?"}); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			if reasoning := openai.ReasoningModel(m); (sent.Summary == "auto") != reasoning {
+				t.Errorf("expected summaries asked of %s only if it reasons but got %+v", m, sent)
+			}
+		}
+	})
+
+	t.Run("openai reasoning summaries turned off", func(t *testing.T) {
+		var sent openai.Reasoning
+		reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"42"}]}]}`
+		a, _ := NewAgent(model.OpenAiModel("o4-mini"))
+		// Stores the whole request as history, not just its items
+		a.Memoriser = struct{ memoriser.Memoriser }{memoriser.NewInMemoryMemoriser()}
+		a.Generation.IncludeThoughts = true
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = body.Reasoning
+				return next(ctx, body)
+			}
+		}, respond(reply, reply)}
+
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "meaning of life?"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		a.Generation.IncludeThoughts = false
+		if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "and again?"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if sent.Summary != "" {
+			t.Errorf("expected summaries no longer asked for but got %+v", sent)
+		}
+	})
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestGeminiPromptCache(t *testing.T) {
+	reply := func(status int, body string) *http.Response {
+		return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	var mu sync.Mutex
+	created := 0
+	failing := false
+	a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.Auth = "key"
+	a.SystemPrompt = "be nice " + rand.Text()
+	a.PromptCaching = true
+	a.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(r.URL.Path, "/cachedContents") {
+			return reply(http.StatusOK, `{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`), nil
+		}
+
+		mu.Lock()
+		created++
+		fail := failing
+		mu.Unlock()
+		// Slow enough for every call to want the cache while it's created
+		time.Sleep(20 * time.Millisecond)
+		if fail {
+			return reply(http.StatusServiceUnavailable, `{"error":{"code":503,"message":"overloaded","status":"UNAVAILABLE"}}`), nil
+		}
+		return reply(http.StatusOK, `{"name":"cachedContents/abc"}`), nil
+	})}
+
+	call := func() {
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := a.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi"}); err != nil {
+					t.Errorf("did not expect err but got %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	t.Run("created once for concurrent calls", func(t *testing.T) {
+		call()
+		if created != 1 {
+			t.Errorf("expected the cache created once but it was %d times", created)
+		}
+	})
+
+	t.Run("failures retried shortly", func(t *testing.T) {
+		a.SystemPrompt = "be nice " + rand.Text()
+		created, failing = 0, true
+
+		call()
+		call()
+		if created != 1 {
+			t.Errorf("expected a failure remembered for a while but creation was tried %d times", created)
+		}
+
+		// Past the failure's short expiry
+		processCaches.mux.Lock()
+		for _, entry := range processCaches.entries {
+			if entry.name == "" {
+				entry.expires = time.Now()
+			}
+		}
+		processCaches.mux.Unlock()
+		failing = false
+
+		call()
+		if created != 2 {
+			t.Errorf("expected creation tried again once the failure expired but it was tried %d times", created)
+		}
+	})
+
+	t.Run("kept apart per vertex project", func(t *testing.T) {
+		created = 0
+		for _, project := range []string{"one", "two"} {
+			vertex, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+			vertex.Memoriser = &memoriser.NoOpMemoriser{}
+			vertex.Vertex = &gemini.Vertex{Project: project, Region: "us-central1", Tokens: staticTokens{}}
+			vertex.SystemPrompt = a.SystemPrompt
+			vertex.PromptCaching = true
+			vertex.Client = a.Client
+
+			if _, err := vertex.Call(context.Background(), AgentInput{Id: "id", UserInput: "hi"}); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		if created != 2 {
+			t.Errorf("expected a cache created in each project but it was %d times", created)
+		}
+	})
+}
+
+// Hands out the one token, which never expires
+type staticTokens struct{}
+
+func (staticTokens) Token(ctx context.Context) (credentials.Token, error) {
+	return credentials.Token{Value: "token"}, nil
+}
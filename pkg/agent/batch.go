@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/model"
+)
+
+type BatchOptions struct {
+	// Calls in flight at once, defaults to 4
+	Concurrency int
+	// Attempts at an input before giving up on it, defaults to 3. Only
+	// failures another attempt may get past are retried, such as being
+	// rate limited or the provider failing.
+	Attempts int
+	// Wait before retrying an input, doubling each attempt. Defaults to a
+	// second.
+	Backoff time.Duration
+	// Optionally called as each input finishes, with how many have finished
+	// so far. Calls come from the workers, one at a time.
+	OnProgress func(done, total int, result BatchItem)
+	// Optionally written each result as it finishes, one at a time. The
+	// batch stops should writing fail.
+	Sink Sink
+}
+
+// The result of one input of a batch
+type BatchItem struct {
+	// Position of the input in the batch
+	Index  int
+	Output AgentOutput
+	// Why the input failed, leaving Output empty
+	Err      error
+	Attempts int
+}
+
+type BatchResult struct {
+	// One per input, in the order of the inputs
+	Items []BatchItem
+	// Summed across every input that succeeded
+	Usage Usage
+	Cost  float64
+	// Inputs that failed
+	Failed int
+}
+
+// RunBatch calls the agent once for each of the inputs, several at a time,
+// for jobs such as enriching thousands of rows. Inputs without an Id are one
+// off completions, see Agent.Complete, and those with one continue their
+// conversation as usual.
+//
+// Failed inputs don't stop the batch, their errors are kept in the result's
+// items. An error is only returned when ctx ends before every input ran, or
+// the sink fails, alongside the results of those that did.
+func RunBatch[M model.AIModel](ctx context.Context, a *Agent[M], inputs []AgentInput, opts BatchOptions) (BatchResult, error) {
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = 4
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := BatchResult{Items: make([]BatchItem, len(inputs))}
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed error
+	done := 0
+
+	for range min(workers, len(inputs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				item := batchCall(ctx, a, inputs[i], opts)
+				item.Index = i
+
+				mu.Lock()
+				result.Items[i] = item
+				if item.Err != nil {
+					result.Failed++
+				} else {
+					result.Usage = result.Usage.Add(item.Output.Usage)
+					result.Cost += item.Output.Cost
+				}
+				done++
+				if opts.OnProgress != nil {
+					opts.OnProgress(done, len(inputs), item)
+				}
+				if opts.Sink != nil && failed == nil {
+					if err := opts.Sink.Write(ctx, newSinkRecord(inputs[i], item)); err != nil {
+						failed = fmt.Errorf("failed to write input %d to the sink - %w", i, err)
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	sent := 0
+send:
+	for ; sent < len(inputs); sent++ {
+		select {
+		case indexes <- sent:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if failed == nil && sent < len(inputs) {
+		failed = fmt.Errorf("batch stopped after %d of %d inputs - %w", sent, len(inputs), ctx.Err())
+	}
+	for i := sent; i < len(inputs); i++ {
+		result.Items[i] = BatchItem{Index: i, Err: ctx.Err()}
+		result.Failed++
+	}
+
+	return result, failed
+}
+
+// Calls the agent with one input of a batch, retrying while another attempt
+// may succeed
+func batchCall[M model.AIModel](ctx context.Context, a *Agent[M], input AgentInput, opts BatchOptions) BatchItem {
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	if input.Id == "" {
+		a, input = a.oneOff(input)
+	}
+
+	// Charged to the quota once, however many attempts it takes
+	if err := a.allow(ctx, input); err != nil {
+		return BatchItem{Err: err, Attempts: 1}
+	}
+
+	for attempt := 1; ; attempt++ {
+		output, err := a.attempt(ctx, input)
+
+		if err == nil || attempt >= attempts || !failover(ctx, err) {
+			return BatchItem{Output: output, Err: err, Attempts: attempt}
+		}
+
+		select {
+		case <-time.After(backoff << (attempt - 1)):
+		case <-ctx.Done():
+			return BatchItem{Err: ctx.Err(), Attempts: attempt}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/quota"
+)
+
+func TestRunBatch(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			var message openai.Message
+			json.Unmarshal(body.Input[len(body.Input)-1], &message)
+			text := message.Content[0].Text
+
+			mu.Lock()
+			calls[text]++
+			n := calls[text]
+			mu.Unlock()
+
+			switch {
+			case text == "flaky" && n == 1:
+				return nil, &openai.APIError{StatusCode: http.StatusTooManyRequests, Message: "slow down"}
+			case text == "broken":
+				return nil, &openai.APIError{StatusCode: http.StatusBadRequest, Message: "bad input"}
+			}
+
+			var resp openai.Response
+			err := json.Unmarshal(fmt.Appendf(nil, `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"enriched %s"}]}],
+				"usage":{"input_tokens":1000,"output_tokens":100,"total_tokens":1100}}`, text), &resp)
+			return &resp, err
+		}
+	}}
+
+	inputs := []AgentInput{{UserInput: "a"}, {UserInput: "flaky"}, {UserInput: "broken"}, {Id: "row-4", UserInput: "b"}}
+
+	var progress []int
+	result, err := RunBatch(ctx, a, inputs, BatchOptions{Concurrency: 2, Backoff: 1, OnProgress: func(done, total int, item BatchItem) {
+		if total != len(inputs) {
+			t.Errorf("expected %d inputs but got %d", len(inputs), total)
+		}
+		progress = append(progress, done)
+	}})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if len(progress) != 4 || progress[3] != 4 {
+		t.Errorf("expected progress after every input but got %v", progress)
+	}
+
+	for i, text := range []string{"enriched a", "enriched flaky", "", "enriched b"} {
+		if item := result.Items[i]; item.Index != i || item.Output.Output != text {
+			t.Errorf("expected %q for input %d but got %+v", text, i, item)
+		}
+	}
+
+	if result.Items[1].Attempts != 2 {
+		t.Errorf("expected the rate limited input retried but got %d attempts", result.Items[1].Attempts)
+	}
+	if result.Items[2].Err == nil || result.Items[2].Attempts != 1 || calls["broken"] != 1 {
+		t.Errorf("expected the bad input to fail without retrying but got %+v", result.Items[2])
+	}
+	if result.Failed != 1 {
+		t.Errorf("expected 1 failed input but got %d", result.Failed)
+	}
+
+	if result.Usage.TotalTokens != 3300 {
+		t.Errorf("expected usage of the 3 successes but got %+v", result.Usage)
+	}
+	if want := 3 * result.Items[0].Output.Cost; result.Cost == 0 || result.Cost != want {
+		t.Errorf("expected cost %v but got %v", want, result.Cost)
+	}
+
+	if session, err := a.Snapshot(ctx, "row-4"); err != nil || len(session) == 0 {
+		t.Errorf("expected inputs with an id to keep their conversation but got %v", err)
+	}
+
+	t.Run("retries charged to the quota once", func(t *testing.T) {
+		mu.Lock()
+		calls["flaky"] = 0
+		mu.Unlock()
+		limited := *a
+		limited.Quota = quota.NewUserQuota(quota.Limits{RequestsPerDay: 1}, nil)
+
+		result, err := RunBatch(ctx, &limited, []AgentInput{{Id: "row-5", UserInput: "flaky"}}, BatchOptions{Backoff: 1})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if item := result.Items[0]; item.Err != nil || item.Attempts != 2 {
+			t.Errorf("expected the retry to be let through but got %+v", item)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		result, err := RunBatch(cancelled, a, inputs, BatchOptions{})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled but got %v", err)
+		}
+		if len(result.Items) != len(inputs) || result.Failed != len(inputs) {
+			t.Errorf("expected every input failed but got %+v", result)
+		}
+	})
+}
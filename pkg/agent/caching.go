@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// How long gemini cached content lives unless PromptCacheTTL says otherwise
+const defaultPromptCacheTTL = time.Hour
+
+// How long gemini failing to cache is remembered before trying again, short
+// so a passing error doesn't turn caching off for long
+const failedPromptCacheTTL = time.Minute
+
+// Gemini cached content created within this process, keyed by what it holds
+var processCaches = &promptCaches{}
+
+type promptCaches struct {
+	mux     sync.Mutex
+	entries map[string]*promptCache
+}
+
+type promptCache struct {
+	// Empty when gemini refused to cache, such as for prompts too small to
+	// be cached, so creating it isn't retried every call
+	name    string
+	expires time.Time
+	// Closed once the cache has been created or refused, before which name
+	// and expires are unset
+	ready chan struct{}
+}
+
+// Whether the cache needs creating again, false while it is being created
+func (c *promptCache) stale() bool {
+	select {
+	case <-c.ready:
+	default:
+		return false
+	}
+
+	// Leave a margin, so a cache doesn't expire between here and gemini
+	if c.name == "" {
+		return !time.Now().Before(c.expires)
+	}
+	return time.Until(c.expires) <= time.Minute
+}
+
+// Identifies a conversation to openai, so its requests are routed to where
+// its prefix is cached. Hashed so ids aren't sent.
+func promptCacheKey(input AgentInput) string {
+	sum := sha256.Sum256([]byte(input.Namespace + "/" + input.Id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// The name of gemini cached content holding the system prompt and tools,
+// creating it when there is none still live. Empty when there is nothing
+// to cache or gemini won't cache it.
+func (p *geminiProvider) cache(ctx context.Context, system string, tools []tool.Tool[any, any]) string {
+	// Cached content belongs to the project of the key that created it
+	if p.cfg.Keys != nil || (system == "" && len(tools) == 0) {
+		return ""
+	}
+
+	declared := make([]any, len(tools))
+	for i, t := range tools {
+		declared[i] = []any{t.Name, t.Describe(), t.Definition}
+	}
+	// Vertex clients have no key, their project and region say where the
+	// cache lives
+	var location []string
+	if v := p.cfg.Vertex; v != nil {
+		location = []string{v.Project, v.Region}
+	}
+	fingerprint, _ := json.Marshal([]any{p.cfg.Model.Model(), p.cfg.Auth, location, system, declared})
+	sum := sha256.Sum256(fingerprint)
+	key := hex.EncodeToString(sum[:])
+
+	caches := processCaches
+	caches.mux.Lock()
+	entry, ok := caches.entries[key]
+	if ok && !entry.stale() {
+		caches.mux.Unlock()
+
+		// Calls wanting a cache already being created wait on it, rather
+		// than creating their own
+		select {
+		case <-entry.ready:
+			return entry.name
+		case <-ctx.Done():
+			return ""
+		}
+	}
+
+	entry = &promptCache{ready: make(chan struct{})}
+	if caches.entries == nil {
+		caches.entries = make(map[string]*promptCache)
+	}
+	caches.entries[key] = entry
+	caches.mux.Unlock()
+	defer close(entry.ready)
+
+	ttl := p.cfg.PromptCacheTTL
+	if ttl <= 0 {
+		ttl = defaultPromptCacheTTL
+	}
+
+	cached, err := p.client.CacheContext(ctx, system, tools, ttl)
+	if err != nil {
+		slog.DebugContext(ctx, "gemini did not cache prompt", slog.Any("error", err))
+		entry.expires = time.Now().Add(failedPromptCacheTTL)
+		return ""
+	}
+
+	entry.name = cached.Name
+	entry.expires = time.Now().Add(ttl)
+	if !cached.ExpireTime.IsZero() {
+		entry.expires = cached.ExpireTime
+	}
+
+	return entry.name
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+)
+
+// A reply streamed to the user in a turn that never finished
+type PartialTurn struct {
+	// The user input of the turn
+	Input string `json:"input"`
+	// The reply as far as it had streamed
+	Output string `json:"output"`
+	// When the reply was last saved
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Passes a streamed reply on, saving it with the session every interval
+// so a turn cut short doesn't lose what the user was shown
+type checkpoint struct {
+	ctx      context.Context
+	onText   func(text string)
+	interval time.Duration
+	input    string
+	save     func(partial *PartialTurn) error
+
+	output strings.Builder
+	saved  time.Time
+	// Length of the output when last saved
+	savedLength int
+	// Set once the turn is saved, which the partial reply mustn't follow
+	finished bool
+}
+
+// Checkpoints the reply a call streams into its session, see
+// Agent.StreamCheckpointInterval
+func (a *Agent[T]) checkpoint(ctx context.Context, mem memoriser.Memoriser, input AgentInput, session *Session) *checkpoint {
+	interval := a.StreamCheckpointInterval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+
+	return &checkpoint{
+		ctx:      ctx,
+		onText:   input.onText,
+		interval: interval,
+		input:    input.UserInput,
+		save: func(partial *PartialTurn) error {
+			return a.savePartial(mem, input.Id, session, partial)
+		},
+		saved: time.Now(),
+	}
+}
+
+// Hands on a piece of the reply, saving the reply so far once the interval
+// has passed
+func (c *checkpoint) text(text string) {
+	c.onText(text)
+
+	c.output.WriteString(text)
+	if time.Since(c.saved) >= c.interval {
+		c.flush()
+	}
+}
+
+// Saves whatever has streamed since the last save, such as once the call
+// fails. Nil checkpoints, of calls that don't stream, do nothing.
+func (c *checkpoint) flush() {
+	if c == nil || c.finished || c.interval < 0 || c.output.Len() == c.savedLength {
+		return
+	}
+
+	partial := &PartialTurn{Input: c.input, Output: c.output.String(), UpdatedAt: time.Now().UTC()}
+	if err := c.save(partial); err != nil {
+		slog.ErrorContext(c.ctx, "failed to checkpoint streamed reply", slog.Any("error", err))
+	}
+	c.saved = time.Now()
+	c.savedLength = c.output.Len()
+}
+
+// Stops any further saves, once the turn the reply belongs to is saved
+func (c *checkpoint) finish() {
+	if c != nil {
+		c.finished = true
+	}
+}
+
+// Tells the model about a reply the previous turn streamed but never
+// finished, as the user saw it while the model never will
+func acknowledgePartial(session *Session, instructions []string) []string {
+	if session.Partial == nil {
+		return instructions
+	}
+
+	return append(instructions, fmt.Sprintf(
+		"Your reply to the user's previous message was cut off before it finished, and isn't in the conversation. They said: %q. They were shown this much of your reply: %q. Carry on knowing they saw it, rather than repeating it.",
+		session.Partial.Input, session.Partial.Output,
+	))
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+)
+
+func TestStreamCheckpoints(t *testing.T) {
+	ctx := context.Background()
+
+	// The first request streams part of a reply before failing, the rest
+	// answer whole
+	var sent []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = append(sent, body)
+
+		if body["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, `data: {"type":"response.output_text.delta","delta":"Once upon"}`+"\n\n")
+			fmt.Fprint(w, `data: {"type":"response.output_text.delta","delta":" a time"}`+"\n\n")
+			fmt.Fprint(w, `data: {"type":"error","code":"server_error","message":"overloaded"}`+"\n\n")
+			return
+		}
+		w.Write([]byte(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"the end"}]}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name     string
+		mem      memoriser.Memoriser
+		interval time.Duration
+		// Partial reply saved by the time the second piece streams
+		midway string
+	}{
+		{name: "saved as it streams", mem: memoriser.NewInMemoryMemoriser(), interval: time.Nanosecond, midway: "Once upon"},
+		{name: "saved once it fails", mem: memoriser.NewInMemoryMemoriser(), interval: time.Hour},
+		{name: "saved whole without a log", mem: struct{ memoriser.Memoriser }{memoriser.NewInMemoryMemoriser()}, interval: time.Nanosecond, midway: "Once upon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			a, _ := NewAgent(model.OpenAiModel("gpt-4o"))
+			a.Memoriser = tt.mem
+			a.Client = srv.Client()
+			a.OpenAIBaseURL = srv.URL
+			a.StreamCheckpointInterval = tt.interval
+
+			if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "tell me a story"}); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			pieces := 0
+			_, err := a.Stream(ctx, AgentInput{Id: "id", UserInput: "another"}, func(text string) {
+				pieces++
+				if pieces != 2 {
+					return
+				}
+
+				session, _ := a.load(ctx, a.Memoriser, "id")
+				midway := ""
+				if session.Partial != nil {
+					midway = session.Partial.Output
+				}
+				if midway != tt.midway {
+					t.Errorf("expected %q saved midway but got %q", tt.midway, midway)
+				}
+			})
+			if err == nil {
+				t.Fatal("expected the stream to fail")
+			}
+
+			session, err := a.load(ctx, a.Memoriser, "id")
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+			if session.Partial == nil || session.Partial.Input != "another" || session.Partial.Output != "Once upon a time" {
+				t.Fatalf("expected the streamed reply saved but got %+v", session.Partial)
+			}
+			if session.Turns != 1 || !strings.Contains(string(session.History), "the end") {
+				t.Errorf("expected the first turn kept but got %+v", session)
+			}
+
+			if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "go on"}); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			instructions, _ := sent[len(sent)-1]["instructions"].(string)
+			if !strings.Contains(instructions, `"another"`) || !strings.Contains(instructions, `"Once upon a time"`) {
+				t.Errorf("expected the cut off reply acknowledged but got %q", instructions)
+			}
+
+			session, _ = a.load(ctx, a.Memoriser, "id")
+			if session.Partial != nil || session.Turns != 2 {
+				t.Errorf("expected the partial reply cleared once a turn finished but got %+v", session)
+			}
+		})
+	}
+}
+
+func TestStreamCheckpointsAfterGenerating(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"type":"response.output_text.delta","delta":"the end"}`+"\n\n")
+		fmt.Fprint(w, `data: {"type":"response.completed","response":{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"the end"}]}]}}`+"\n\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.Client = srv.Client()
+	a.OpenAIBaseURL = srv.URL
+	a.StreamCheckpointInterval = time.Hour
+	a.PostProcessors = []PostProcessor{func(ctx context.Context, output string) (string, error) {
+		return "", errors.New("rejected")
+	}}
+
+	if _, err := a.Stream(ctx, AgentInput{Id: "id", UserInput: "tell me a story"}, func(string) {}); err == nil {
+		t.Fatal("expected postprocessing to fail the call")
+	}
+
+	session, _ := a.load(ctx, a.Memoriser, "id")
+	if session.Partial == nil || session.Partial.Output != "the end" {
+		t.Errorf("expected the streamed reply saved but got %+v", session.Partial)
+	}
+
+	a.PostProcessors = nil
+	if _, err := a.Stream(ctx, AgentInput{Id: "id", UserInput: "again"}, func(string) {}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	session, _ = a.load(ctx, a.Memoriser, "id")
+	if session.Partial != nil || session.Turns != 1 {
+		t.Errorf("expected no partial reply once the turn was saved but got %+v", session)
+	}
+}
@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Calls model.CohereModel
+type cohereProvider struct {
+	cfg    ProviderConfig
+	client *cohere.Cohere
+}
+
+type cohereBody struct {
+	*cohere.ChatRequest
+}
+
+func (b *cohereBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.ChatRequest)
+}
+
+func (b *cohereBody) AppendUserInput(text string) error {
+	b.ChatRequest.AppendUserInput(text)
+	return nil
+}
+
+func (b *cohereBody) Repair() ([]string, error) {
+	return b.RepairMessages()
+}
+
+func (b *cohereBody) Finish(compact func(string) string) error {
+	if compact != nil {
+		b.CompactToolOutputs(compact)
+	}
+
+	return nil
+}
+
+func (b *cohereBody) Items(from int) ([]json.RawMessage, int, error) {
+	return messageItems(b.Messages, from)
+}
+
+func newCohereProvider(cfg ProviderConfig) (Provider, error) {
+	c, err := cohere.NewCohereClient(cfg.Client, cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	c.Middleware = cfg.CohereMiddleware
+	if cfg.respond != nil {
+		c.Middleware = append(slices.Clone(c.Middleware), func(cohere.Handler) cohere.Handler {
+			return func(ctx context.Context, body *cohere.ChatRequest) (*cohere.ChatResponse, error) {
+				raw, err := cfg.respond()
+				if err != nil {
+					return nil, err
+				}
+				var resp cohere.ChatResponse
+				return &resp, json.Unmarshal(raw, &resp)
+			}
+		})
+	}
+	c.Signer = cfg.Signer
+	c.Keys = cfg.Keys
+	c.Compress = cfg.Compress
+	c.MaxResponseBytes = cfg.MaxResponseBytes
+	c.MaxRequestBytes = cfg.MaxRequestBytes
+	c.RequestTimeout = cfg.RequestTimeout
+	c.RequestAttempts = cfg.RequestAttempts
+	c.OnUnknownTool = cfg.OnUnknownTool
+	c.OnToolCall = cfg.OnToolCall
+
+	return &cohereProvider{cfg: cfg, client: c}, nil
+}
+
+func (p *cohereProvider) Body(ctx context.Context, turn Turn) (Body, error) {
+	body, err := p.client.Body(p.cfg.Model.Model(), turn.Input.UserInput, turn.system(), turn.History, turn.Input.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(turn.Input.Items) > 0 {
+		// Body adds the input as text, which its items replace
+		body.Messages = body.Messages[:len(body.Messages)-1]
+		for _, message := range turn.Input.messages() {
+			if message.images() {
+				return nil, fmt.Errorf("cohere can't be sent images - %w", ErrInvalidUserInput)
+			}
+			body.Messages = append(body.Messages, cohere.Message{Role: message.Role, Content: message.text()})
+		}
+	}
+
+	return &cohereBody{ChatRequest: body}, nil
+}
+
+func (p *cohereProvider) Prepare(ctx context.Context, b Body, turn Turn) error {
+	body := b.(*cohereBody)
+	input := turn.Input
+	generation := p.cfg.Generation
+
+	// Cohere has no prompt caching to keep the prefix stable for, so
+	// instructions always follow the system prompt
+	for _, instruction := range turn.Instructions {
+		body.AppendSystemInstruction(instruction)
+	}
+
+	body.Documents = nil
+	for _, document := range input.Documents {
+		data := make(map[string]any, len(document.Data))
+		for k, v := range document.Data {
+			data[k] = v
+		}
+		body.Documents = append(body.Documents, cohere.Document{ID: document.ID, Data: data})
+	}
+
+	body.MaxTokens = generation.MaxOutputTokens
+	body.Seed = generation.Seed
+	body.StopSequences = input.StopSequences
+	body.PresencePenalty = generation.PresencePenalty
+	body.FrequencyPenalty = generation.FrequencyPenalty
+
+	body.ToolChoice = ""
+	if input.ToolChoice != nil {
+		var err error
+		body.ToolChoice, err = cohere.ToolChoice(string(input.ToolChoice.Mode), input.ToolChoice.Tools...)
+		if err != nil {
+			return fmt.Errorf("failed to encode tool choice - %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *cohereProvider) Generate(ctx context.Context, b Body, tools []tool.Tool[any, any]) (Body, Result, error) {
+	next, res, err := p.client.Generate(ctx, b.(*cohereBody).ChatRequest, tools)
+	if err != nil {
+		return nil, Result{}, err
+	}
+
+	return &cohereBody{ChatRequest: next}, Result{
+		Text:         res.Text,
+		Truncated:    res.Truncated(),
+		Usage:        cohereUsage(res.Usage),
+		PromptTokens: res.PromptTokens,
+		Citations:    cohereCitations(res.Citations),
+	}, nil
+}
+
+func (p *cohereProvider) Stream(ctx context.Context, b Body, tools []tool.Tool[any, any], onText func(text string)) (Body, Result, error) {
+	return nil, Result{}, fmt.Errorf("cohere can't stream - %w", ErrUnsupportedOption)
+}
+
+func (p *cohereProvider) History(items []json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(map[string][]json.RawMessage{"messages": items})
+}
+
+func (p *cohereProvider) CheckHistory(history json.RawMessage) error {
+	var body cohere.ChatRequest
+	if err := json.Unmarshal(history, &body); err != nil {
+		return err
+	}
+	_, err := body.RepairMessages()
+	return err
+}
+
+func (p *cohereProvider) TurnStart(item json.RawMessage) bool {
+	return userMessage(item)
+}
+
+func (p *cohereProvider) Capabilities() Capabilities {
+	return catalogCapabilities(p.cfg.Model, Capabilities{Tools: true, StructuredOutput: true})
+}
+
+func (p *cohereProvider) replayTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	return cohereTurns(items)
+}
+
+func cohereUsage(usage cohere.Usage) Usage {
+	return Usage{
+		InputTokens:  usage.Tokens.InputTokens,
+		OutputTokens: usage.Tokens.OutputTokens,
+		TotalTokens:  usage.Tokens.InputTokens + usage.Tokens.OutputTokens,
+	}
+}
+
+func cohereCitations(citations []cohere.Citation) []Citation {
+	if len(citations) == 0 {
+		return nil
+	}
+
+	converted := make([]Citation, len(citations))
+	for i, c := range citations {
+		converted[i] = Citation{Start: c.Start, End: c.End, Text: c.Text}
+		for _, source := range c.Sources {
+			converted[i].Sources = append(converted[i].Sources, source.ID)
+		}
+	}
+
+	return converted
+}
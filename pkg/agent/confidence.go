@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// How AgentOutput.Confidence is worked out
+type ConfidenceMode string
+
+const (
+	// From the log probabilities of the reply's tokens. Models that don't
+	// return them, such as openai reasoning models, leave confidence unset.
+	ConfidenceLogprobs ConfidenceMode = "logprobs"
+	// From a follow up request asking the model to rate its own reply,
+	// costing an extra request that isn't kept in history
+	ConfidenceSelfAssessment ConfidenceMode = "self_assessment"
+)
+
+const assessPrompt = `Rate how confident you are that the answer below is correct and complete, from 0 (certainly wrong) to 1 (certainly right). Reply with only the number.
+
+Question:
+%s
+
+Answer:
+%s`
+
+var assessmentNumber = regexp.MustCompile(`\d*\.?\d+`)
+
+// Sends a single prompt to the agent's model without tools or history,
+// returning the reply and what it cost
+type assessFunc func(ctx context.Context, prompt string) (string, Usage, error)
+
+// Works out the confidence of a reply with the agent's ConfidenceMode,
+// returning any usage spent doing so
+func (a *Agent[T]) confidence(ctx context.Context, input AgentInput, output string, logprobs []float64, assess assessFunc) (*float64, Usage) {
+	switch a.Generation.Confidence {
+	case ConfidenceLogprobs:
+		return logprobConfidence(logprobs), Usage{}
+	case ConfidenceSelfAssessment:
+		reply, usage, err := assess(ctx, fmt.Sprintf(assessPrompt, input.UserInput, output))
+		if err != nil {
+			slog.WarnContext(ctx, "failed to self assess confidence", slog.Any("error", err))
+			return nil, usage
+		}
+
+		return parseAssessment(reply), usage
+	}
+
+	return nil, Usage{}
+}
+
+// The geometric mean of the token probabilities, nil without any
+func logprobConfidence(logprobs []float64) *float64 {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	sum := 0.0
+	for _, logprob := range logprobs {
+		sum += logprob
+	}
+
+	confidence := math.Exp(sum / float64(len(logprobs)))
+	return &confidence
+}
+
+// Reads the first number in a self assessment, nil without one
+func parseAssessment(reply string) *float64 {
+	confidence, err := strconv.ParseFloat(assessmentNumber.FindString(reply), 64)
+	if err != nil {
+		return nil
+	}
+
+	confidence = min(max(confidence, 0), 1)
+	return &confidence
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+)
+
+type DebugKind string
+
+const (
+	// The input of a call
+	DebugInput DebugKind = "input"
+	// History loaded for a call
+	DebugHistory DebugKind = "history"
+	// The reply produced by a call
+	DebugOutput DebugKind = "output"
+	// Strings within a request dumped after it failed, see
+	// Agent.DumpFailedRequests
+	DebugRequest DebugKind = "request"
+)
+
+// A single diagnostic about a call. Content has already been through the
+// agent's Redactor.
+type DebugRecord struct {
+	Kind    DebugKind
+	Model   string
+	ID      string
+	Content string
+}
+
+// Receives diagnostics about calls, letting operators decide where they are
+// routed
+type DebugSink interface {
+	Debug(ctx context.Context, record DebugRecord)
+}
+
+// Transforms the content of a debug record before it reaches a sink
+type Redactor func(kind DebugKind, content string) string
+
+// RedactContent replaces content with its length and a short hash, enough to
+// correlate records without revealing what users said. This is the default.
+func RedactContent(kind DebugKind, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("[redacted len=%d sha256=%s]", len(content), hex.EncodeToString(sum[:6]))
+}
+
+// NoRedaction passes content through untouched. User input will reach the
+// sink, which may be a cause for concern.
+func NoRedaction(kind DebugKind, content string) string {
+	return content
+}
+
+// Writes debug records to a slog logger at debug level
+type SlogSink struct {
+	// Defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+func (s SlogSink) Debug(ctx context.Context, record DebugRecord) {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.DebugContext(
+		ctx,
+		"agent debug record",
+		slog.String("kind", string(record.Kind)),
+		slog.String("model", record.Model),
+		slog.String("id", record.ID),
+		slog.String("content", record.Content),
+	)
+}
+
+// Sends a redacted record to the debug sink, if there is one
+func (a *Agent[T]) debug(ctx context.Context, kind DebugKind, id string, content string) {
+	sink := a.DebugSink
+	redact := a.Redact
+
+	// Verbose predates sinks, and always logged everything as is
+	if sink == nil && a.Verbose {
+		sink = SlogSink{}
+		if redact == nil {
+			redact = NoRedaction
+		}
+	}
+
+	if sink == nil {
+		return
+	}
+
+	if redact == nil {
+		redact = RedactContent
+	}
+
+	sink.Debug(ctx, DebugRecord{
+		Kind:    kind,
+		Model:   a.Model.Model(),
+		ID:      id,
+		Content: redact(kind, content),
+	})
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+)
+
+// Returned in place of a provider error when DumpFailedRequests is set,
+// carrying a redacted copy of the request that failed
+type RequestError struct {
+	Err error
+	// The request as json, with credentials removed and content passed
+	// through the agent's Redactor
+	Request string
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Fields dropped from dumps entirely
+var credentialFields = map[string]bool{
+	"key":           true,
+	"api_key":       true,
+	"apikey":        true,
+	"authorization": true,
+	"token":         true,
+	"access_token":  true,
+}
+
+// Fields describing the shape of a request rather than what users said, kept
+// as is so dumps are still useful
+var structuralFields = map[string]bool{
+	"type":             true,
+	"role":             true,
+	"model":            true,
+	"name":             true,
+	"status":           true,
+	"id":               true,
+	"call_id":          true,
+	"mimeType":         true,
+	"mime_type":        true,
+	"format":           true,
+	"mode":             true,
+	"strict":           true,
+	"service_tier":     true,
+	"truncation":       true,
+	"tool_choice":      true,
+	"responseMimeType": true,
+}
+
+// Wraps a provider error with a redacted dump of the request that failed,
+// when DumpFailedRequests is set
+func (a *Agent[T]) dumpRequest(ctx context.Context, input AgentInput, request any, err error) error {
+	if !a.DumpFailedRequests || err == nil {
+		return err
+	}
+
+	redact := a.Redact
+	if redact == nil {
+		redact = RedactContent
+	}
+
+	dumped, encodeErr := redactRequest(request, redact)
+	if encodeErr != nil {
+		slog.ErrorContext(ctx, "failed to dump failed request", slog.Any("error", encodeErr))
+		return err
+	}
+
+	reqErr := &RequestError{Err: err, Request: dumped}
+	if a.Hooks.OnRequestFailure != nil {
+		a.Hooks.OnRequestFailure(ctx, input, reqErr)
+	}
+
+	return reqErr
+}
+
+// Encodes a request with credentials removed and every string that isn't
+// structural passed through redact
+func redactRequest(request any, redact Redactor) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return "", err
+	}
+
+	data, err = json.Marshal(redactValue(tree, "", redact))
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+func redactValue(value any, field string, redact Redactor) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if credentialFields[strings.ToLower(k)] {
+				delete(v, k)
+				continue
+			}
+			v[k] = redactValue(child, k, redact)
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = redactValue(child, field, redact)
+		}
+		return v
+	case string:
+		if structuralFields[field] {
+			return v
+		}
+		return redact(DebugRequest, v)
+	default:
+		return v
+	}
+}
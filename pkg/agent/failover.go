@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+// A model a call fails over to, sharing the rest of the agent's
+// configuration. When its provider stores history differently to the one
+// before it, history is translated to its format, keeping the user and
+// assistant messages but not tool calls.
+//
+// Tools the failed attempt ran are run again by the fallback.
+type Fallback struct {
+	Model model.AIModel
+	// Used instead of the agent's Auth and Keys, empty for none
+	Auth string
+}
+
+// The agent as it calls through a fallback
+func (a *Agent[T]) fallback(f Fallback) *Agent[T] {
+	fallback := *a
+	fallback.Model = f.Model
+	fallback.Auth = f.Auth
+	fallback.Keys = nil
+
+	return &fallback
+}
+
+// Whether a call failed in a way another provider may not, from being rate
+// limited, the provider failing or a request timing out. Failed calls store
+// nothing, so they can be made again elsewhere.
+func failover(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var (
+		openaiErr *openai.APIError
+		geminiErr *gemini.APIError
+		ollamaErr *ollama.APIError
+		cohereErr *cohere.APIError
+		status    int
+	)
+	switch {
+	case errors.As(err, &openaiErr):
+		status = openaiErr.StatusCode
+	case errors.As(err, &geminiErr):
+		status = geminiErr.StatusCode
+	case errors.As(err, &ollamaErr):
+		status = ollamaErr.StatusCode
+	case errors.As(err, &cohereErr):
+		status = cohereErr.StatusCode
+	}
+
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Identifies the format a provider stores history in
+func historyFormat(p Provider) string {
+	return reflect.TypeOf(p).String()
+}
+
+// Rewrites history stored in another provider's format, such as by a
+// fallback, into the format of the agent's provider
+func (a *Agent[T]) translateHistory(ctx context.Context, id string, session *Session) error {
+	if session.Format == "" || len(session.History) == 0 {
+		return nil
+	}
+
+	p, err := a.provider(AgentInput{})
+	if err != nil {
+		return err
+	}
+	format := historyFormat(p)
+	if session.Format == format {
+		return nil
+	}
+
+	items, err := splitHistory(session.History)
+	if err != nil {
+		return err
+	}
+
+	var history json.RawMessage
+	if messages := conversation(items); len(messages) > 0 {
+		// Bodies start from a user input, which the messages replace
+		body, err := p.Body(ctx, Turn{Input: AgentInput{Id: id, UserInput: messages[0].Text, Items: messages}})
+		if err != nil {
+			return fmt.Errorf("failed to translate history - %w", err)
+		}
+		translated, _, err := body.Items(0)
+		if err != nil {
+			return fmt.Errorf("failed to translate history - %w", err)
+		}
+		if history, err = p.History(translated); err != nil {
+			return fmt.Errorf("failed to translate history - %w", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "translated history", slog.String("id", id), slog.String("from", session.Format), slog.String("to", format))
+
+	session.History = history
+	session.Format = format
+	// Neither the log nor the token counts match the new format
+	session.rewrite = true
+	session.PromptTokens = 0
+	session.PromptItems = 0
+
+	return nil
+}
+
+// The user and assistant messages of history in any provider's format, as
+// input items
+func conversation(items []json.RawMessage) []InputItem {
+	var messages []InputItem
+
+	for _, raw := range items {
+		var item struct {
+			Type    string          `json:"type"`
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+			// gemini
+			Parts []struct {
+				Text    string `json:"text"`
+				Thought bool   `json:"thought"`
+			} `json:"parts"`
+		}
+		if json.Unmarshal(raw, &item) != nil || (item.Type != "" && item.Type != "message") {
+			continue
+		}
+
+		text := messageText(item.Content)
+		for _, part := range item.Parts {
+			if !part.Thought {
+				text += part.Text
+			}
+		}
+		if text == "" {
+			continue
+		}
+
+		switch item.Role {
+		case "user":
+			messages = append(messages, TextItem(text))
+		case "assistant", "model":
+			// Replies split by tool calls become one
+			if n := len(messages); n > 0 && messages[n-1].Type == InputAssistant {
+				messages[n-1].Text += "\n\n" + text
+				continue
+			}
+			messages = append(messages, AssistantItem(text))
+		}
+	}
+
+	return messages
+}
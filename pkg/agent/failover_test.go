@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/quota"
+)
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+
+	reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"from openai"}]}]}`
+	var openaiErr error
+	var openaiSent []json.RawMessage
+	var geminiSent []gemini.Content
+	geminiCalls := 0
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			openaiSent = body.Input
+			if openaiErr != nil {
+				return nil, openaiErr
+			}
+			return next(ctx, body)
+		}
+	}, respond(reply, reply)}
+	a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+		return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+			geminiCalls++
+			geminiSent = body.Contents
+			var resp gemini.ResponseBody
+			err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"from gemini"}]},"finishReason":"STOP"}]}`), &resp)
+			return &resp, err
+		}
+	}}
+	a.Fallbacks = []Fallback{{Model: model.GeminiAiModel("gemini-2.5-flash"), Auth: "gemini-key"}}
+
+	if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "first"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		openaiErr = &openai.APIError{StatusCode: http.StatusTooManyRequests, Message: "slow down"}
+		output, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "second"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if output.Output != "from gemini" {
+			t.Errorf("expected the fallback to answer but got %q", output.Output)
+		}
+		if len(geminiSent) != 3 || geminiSent[0].Parts[0].Text != "first" || geminiSent[1].Role != "model" || geminiSent[1].Parts[0].Text != "from openai" {
+			t.Errorf("expected openai's history translated for gemini but got %+v", geminiSent)
+		}
+	})
+
+	t.Run("back on the primary", func(t *testing.T) {
+		openaiErr = nil
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "third"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var roles []string
+		for _, item := range openaiSent {
+			var message openai.Message
+			json.Unmarshal(item, &message)
+			roles = append(roles, message.Role)
+		}
+		if len(roles) != 5 || roles[3] != "assistant" || roles[4] != "user" {
+			t.Errorf("expected gemini's history translated back but got %v", roles)
+		}
+	})
+
+	t.Run("errors another provider would share", func(t *testing.T) {
+		geminiCalls = 0
+		openaiErr = &openai.APIError{StatusCode: http.StatusBadRequest, Message: "bad request"}
+
+		var apiErr *openai.APIError
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "fourth"}); !errors.As(err, &apiErr) {
+			t.Errorf("expected the primary's error but got %v", err)
+		}
+		if geminiCalls != 0 {
+			t.Errorf("expected no failover but gemini was called %d times", geminiCalls)
+		}
+	})
+	t.Run("charged to the quota once", func(t *testing.T) {
+		a.Quota = quota.NewUserQuota(quota.Limits{RequestsPerDay: 1}, nil)
+		defer func() { a.Quota = nil }()
+		openaiErr = &openai.APIError{StatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "charged", UserInput: "hi"}); err != nil {
+			t.Fatalf("expected the fallback to answer within the quota but got %v", err)
+		}
+		if _, err := a.Call(ctx, AgentInput{Id: "charged", UserInput: "again"}); !errors.Is(err, quota.ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded but got %v", err)
+		}
+	})
+}
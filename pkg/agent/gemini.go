@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Calls model.GeminiAiModel through the developer api, or Vertex AI
+type geminiProvider struct {
+	cfg    ProviderConfig
+	client *gemini.Gemini
+}
+
+// A gemini request, along with the instructions sent only for this turn
+type geminiBody struct {
+	*gemini.RequestBody
+	// Index of the content holding deferred instructions, -1 for none
+	deferred int
+}
+
+func (b *geminiBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.RequestBody)
+}
+
+func (b *geminiBody) AppendUserInput(text string) error {
+	b.RequestBody.AppendUserInput(text)
+	return nil
+}
+
+func (b *geminiBody) Repair() ([]string, error) {
+	return b.RepairContents()
+}
+
+func (b *geminiBody) Finish(compact func(string) string) error {
+	if b.deferred >= 0 {
+		b.Contents = slices.Delete(b.Contents, b.deferred, b.deferred+1)
+		b.deferred = -1
+	}
+	if compact != nil {
+		return b.CompactToolOutputs(compact)
+	}
+
+	return nil
+}
+
+func (b *geminiBody) Items(from int) ([]json.RawMessage, int, error) {
+	if from > len(b.Contents) {
+		return nil, len(b.Contents), nil
+	}
+
+	items := make([]json.RawMessage, 0, len(b.Contents)-from)
+	for _, content := range b.Contents[from:] {
+		item, err := json.Marshal(content)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode history item - %w", err)
+		}
+		items = append(items, item)
+	}
+
+	return items, len(b.Contents), nil
+}
+
+func newGeminiProvider(cfg ProviderConfig) (Provider, error) {
+	g, err := gemini.NewGeminiClient(cfg.Client, cfg.Auth, cfg.Model.Model())
+	if cfg.Vertex != nil {
+		g, err = gemini.NewVertexClient(cfg.Client, *cfg.Vertex, cfg.Model.Model())
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.Middleware = cfg.GeminiMiddleware
+	if cfg.respond != nil {
+		g.Middleware = append(slices.Clone(g.Middleware), func(gemini.Handler) gemini.Handler {
+			return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+				raw, err := cfg.respond()
+				if err != nil {
+					return nil, err
+				}
+				var resp gemini.ResponseBody
+				return &resp, json.Unmarshal(raw, &resp)
+			}
+		})
+	}
+	g.Signer = cfg.Signer
+	g.Keys = cfg.Keys
+	g.Compress = cfg.Compress
+	g.MaxResponseBytes = cfg.MaxResponseBytes
+	g.MaxRequestBytes = cfg.MaxRequestBytes
+	g.RequestTimeout = cfg.RequestTimeout
+	g.RequestAttempts = cfg.RequestAttempts
+	g.OnUnknownTool = cfg.OnUnknownTool
+	g.OnToolCall = cfg.OnToolCall
+
+	return &geminiProvider{cfg: cfg, client: g}, nil
+}
+
+func (p *geminiProvider) Body(ctx context.Context, turn Turn) (Body, error) {
+	body, err := p.client.Body(turn.Input.UserInput, turn.system(), turn.History, turn.Input.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(turn.Input.Items) > 0 {
+		// Body adds the input as text, which its items replace
+		body.Contents = body.Contents[:len(body.Contents)-1]
+		for _, message := range turn.Input.messages() {
+			content := gemini.Content{Role: "user"}
+			if message.Role == "assistant" {
+				content.Role = "model"
+			}
+			for _, item := range message.Items {
+				if item.Type == InputImage {
+					content.Parts = append(content.Parts, gemini.Part{InlineData: &gemini.Blob{MimeType: item.MimeType, Data: item.Data}})
+					continue
+				}
+				content.Parts = append(content.Parts, gemini.Part{Text: item.Text})
+			}
+			body.Contents = append(body.Contents, content)
+		}
+	}
+
+	return &geminiBody{RequestBody: body, deferred: -1}, nil
+}
+
+func (p *geminiProvider) Prepare(ctx context.Context, b Body, turn Turn) error {
+	body := b.(*geminiBody)
+	input := turn.Input
+	generation := p.cfg.Generation
+
+	if err := labelCollisions(input.Metadata); err != nil {
+		return err
+	}
+	for k, v := range input.Metadata {
+		body.SetLabel(k, v)
+	}
+	body.SetLabel(gemini.LabelEndUser, input.endUser())
+	if p.cfg.PromptCaching && len(turn.Instructions) > 0 {
+		body.deferred = len(body.Contents) - 1
+		body.Contents = slices.Insert(body.Contents, body.deferred, gemini.Content{
+			Role:  "user",
+			Parts: []gemini.Part{{Text: strings.Join(turn.Instructions, "\n\n")}},
+		})
+	} else {
+		for _, instruction := range turn.Instructions {
+			body.AppendSystemInstruction(instruction)
+		}
+	}
+
+	body.ToolConfig = geminiToolConfig(input.ToolChoice)
+	body.GenerationConfig.StopSequences = input.StopSequences
+	body.GenerationConfig.PresencePenalty = generation.PresencePenalty
+	body.GenerationConfig.FrequencyPenalty = generation.FrequencyPenalty
+	body.GenerationConfig.Seed = generation.Seed
+	body.GenerationConfig.MaxOutputTokens = generation.MaxOutputTokens
+	body.GenerationConfig.ResponseLogprobs = generation.Confidence == ConfidenceLogprobs
+	body.GenerationConfig.ResponseModalities = nil
+	if generation.ImageOutput {
+		body.GenerationConfig.ResponseModalities = []string{"TEXT", "IMAGE"}
+	}
+
+	body.GenerationConfig.ThinkingConfig = nil
+	if generation.ThinkingBudget != nil || generation.IncludeThoughts {
+		body.GenerationConfig.ThinkingConfig = &gemini.ThinkingConfig{
+			ThinkingBudget:  generation.ThinkingBudget,
+			IncludeThoughts: generation.IncludeThoughts,
+		}
+	}
+
+	// Cached content can't be paired with a tool config
+	if p.cfg.PromptCaching && body.ToolConfig == nil {
+		if name := p.cache(ctx, turn.system(), turn.Tools); name != "" {
+			body.UseCachedContent(name)
+		}
+	}
+
+	return nil
+}
+
+// Fails metadata whose keys would be sent as the same label, as only one of
+// them would be kept. The end user label is set from EndUserID, so metadata
+// can't have it.
+func labelCollisions(metadata map[string]string) error {
+	labels := map[string]string{gemini.LabelEndUser: "EndUserID"}
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		label := gemini.LabelKey(k)
+		if other, ok := labels[label]; ok {
+			return fmt.Errorf("metadata key %q is sent to gemini as label %s, as is %s - %w", k, label, other, ErrInvalidMetadata)
+		}
+		labels[label] = fmt.Sprintf("%q", k)
+	}
+
+	return nil
+}
+
+func (p *geminiProvider) Generate(ctx context.Context, b Body, tools []tool.Tool[any, any]) (Body, Result, error) {
+	body := b.(*geminiBody)
+	return body.generated(p.client.Generate(ctx, body.RequestBody, tools))
+}
+
+func (p *geminiProvider) Stream(ctx context.Context, b Body, tools []tool.Tool[any, any], onText func(text string)) (Body, Result, error) {
+	body := b.(*geminiBody)
+	return body.generated(p.client.Stream(ctx, body.RequestBody, tools, onText))
+}
+
+// Wraps what the client generated from a body, keeping what the body
+// deferred
+func (body *geminiBody) generated(next *gemini.RequestBody, res gemini.Result, err error) (Body, Result, error) {
+	if err != nil {
+		return nil, Result{}, err
+	}
+
+	return &geminiBody{RequestBody: next, deferred: body.deferred}, Result{
+		Text:         res.Text,
+		Thoughts:     res.Thoughts,
+		Truncated:    res.Truncated(),
+		Usage:        geminiUsage(res.Usage),
+		PromptTokens: res.PromptTokens,
+		Logprobs:     res.Logprobs,
+		Artifacts:    res.Artifacts,
+		Safety:       geminiSafety(res),
+	}, nil
+}
+
+func (p *geminiProvider) History(items []json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(map[string][]json.RawMessage{"contents": items})
+}
+
+func (p *geminiProvider) CheckHistory(history json.RawMessage) error {
+	var body gemini.RequestBody
+	if err := json.Unmarshal(history, &body); err != nil {
+		return err
+	}
+	_, err := body.RepairContents()
+	return err
+}
+
+func (p *geminiProvider) TurnStart(item json.RawMessage) bool {
+	var content struct {
+		Role  string `json:"role"`
+		Parts []struct {
+			FunctionResponse json.RawMessage `json:"functionResponse"`
+		} `json:"parts"`
+	}
+	if json.Unmarshal(item, &content) != nil || content.Role != "user" {
+		return false
+	}
+
+	for _, part := range content.Parts {
+		if len(part.FunctionResponse) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *geminiProvider) Capabilities() Capabilities {
+	return catalogCapabilities(p.cfg.Model, Capabilities{Tools: true, StructuredOutput: true, Images: true, Streaming: true})
+}
+
+func (p *geminiProvider) replayTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	return geminiTurns(items)
+}
+
+func geminiToolConfig(choice *ToolChoice) *gemini.ToolConfig {
+	if choice == nil {
+		return nil
+	}
+
+	config := &gemini.ToolConfig{}
+	switch choice.Mode {
+	case ToolChoiceNone:
+		config.FunctionCallingConfig.Mode = "NONE"
+	case ToolChoiceRequired:
+		config.FunctionCallingConfig.Mode = "ANY"
+		config.FunctionCallingConfig.AllowedFunctionNames = choice.Tools
+	default:
+		// Gemini can only restrict functions when calling is required, so
+		// an auto choice over a subset stays fully auto
+		config.FunctionCallingConfig.Mode = "AUTO"
+	}
+
+	return config
+}
+
+func geminiUsage(usage gemini.UsageMetadata) Usage {
+	return Usage{
+		InputTokens:     usage.PromptTokenCount + usage.ToolUsePromptTokenCount,
+		OutputTokens:    usage.CandidatesTokenCount,
+		CachedTokens:    usage.CachedContentTokenCount,
+		ReasoningTokens: usage.ThoughtsTokenCount,
+		TotalTokens:     usage.TotalTokenCount,
+	}
+}
+
+func geminiSafety(res gemini.Result) SafetyFeedback {
+	convert := func(ratings []gemini.SafetyRating) []SafetyRating {
+		if len(ratings) == 0 {
+			return nil
+		}
+
+		converted := make([]SafetyRating, len(ratings))
+		for i, r := range ratings {
+			converted[i] = SafetyRating{Category: r.Category, Probability: r.Probability, Blocked: r.Blocked}
+		}
+		return converted
+	}
+
+	return SafetyFeedback{
+		Prompt:   convert(res.PromptFeedback.SafetyRatings),
+		Response: convert(res.SafetyRatings),
+	}
+}
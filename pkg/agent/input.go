@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type InputItemType string
+
+const (
+	InputText  InputItemType = "text"
+	InputImage InputItemType = "image"
+	// A reply of the assistant, such as an earlier draft for the model to
+	// revise
+	InputAssistant InputItemType = "assistant"
+)
+
+// One entry of a turn's input, see AgentInput.Items
+type InputItem struct {
+	Type InputItemType
+	// Text of text and assistant entries
+	Text string
+	// Bytes of an image entry, along with their mime type, e.g. image/png
+	Data     []byte
+	MimeType string
+}
+
+func TextItem(text string) InputItem {
+	return InputItem{Type: InputText, Text: text}
+}
+
+func ImageItem(mimeType string, data []byte) InputItem {
+	return InputItem{Type: InputImage, Data: data, MimeType: mimeType}
+}
+
+func AssistantItem(text string) InputItem {
+	return InputItem{Type: InputAssistant, Text: text}
+}
+
+// The entries of a turn's input grouped into messages, with consecutive
+// user entries sharing one
+type inputMessage struct {
+	// Either user or assistant
+	Role  string
+	Items []InputItem
+}
+
+func (i AgentInput) messages() []inputMessage {
+	var messages []inputMessage
+	for _, item := range i.Items {
+		role := "user"
+		if item.Type == InputAssistant {
+			role = "assistant"
+		}
+
+		if n := len(messages); n > 0 && role == "user" && messages[n-1].Role == "user" {
+			messages[n-1].Items = append(messages[n-1].Items, item)
+			continue
+		}
+		messages = append(messages, inputMessage{Role: role, Items: []InputItem{item}})
+	}
+
+	return messages
+}
+
+// Text of the message's entries, leaving out images
+func (m inputMessage) text() string {
+	var texts []string
+	for _, item := range m.Items {
+		if item.Text != "" {
+			texts = append(texts, item.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n\n")
+}
+
+// Whether the message holds any images
+func (m inputMessage) images() bool {
+	for _, item := range m.Items {
+		if item.Type == InputImage {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether any of the input's items are images
+func (i AgentInput) images() bool {
+	return slices.ContainsFunc(i.Items, func(item InputItem) bool {
+		return item.Type == InputImage
+	})
+}
+
+// Checks the input's items, which must end with the user's entries
+func (i AgentInput) validItems() error {
+	for n, item := range i.Items {
+		switch item.Type {
+		case InputText, InputAssistant:
+			if item.Text == "" {
+				return fmt.Errorf("input item %d has no text - %w", n, ErrInvalidUserInput)
+			}
+		case InputImage:
+			if len(item.Data) == 0 || item.MimeType == "" {
+				return fmt.Errorf("input item %d needs image data and its mime type - %w", n, ErrInvalidUserInput)
+			}
+		default:
+			return fmt.Errorf("input item %d has unknown type %q - %w", n, item.Type, ErrInvalidUserInput)
+		}
+	}
+
+	if len(i.Items) > 0 && i.Items[len(i.Items)-1].Type == InputAssistant {
+		return fmt.Errorf("input items must end with the user's - %w", ErrInvalidUserInput)
+	}
+	if len(i.Items) > 0 && i.itemsText() == "" {
+		return fmt.Errorf("input items need some text of the user's - %w", ErrInvalidUserInput)
+	}
+
+	return nil
+}
+
+// The text of the user's entries, standing in for UserInput wherever the
+// input is read as text
+func (i AgentInput) itemsText() string {
+	var texts []string
+	for _, message := range i.messages() {
+		if message.Role == "user" && message.text() != "" {
+			texts = append(texts, message.text())
+		}
+	}
+
+	return strings.Join(texts, "\n\n")
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+func TestInputItems(t *testing.T) {
+	ctx := context.Background()
+	png := []byte{0x89, 'P', 'N', 'G'}
+	items := []InputItem{
+		TextItem("make this friendlier"),
+		AssistantItem("Your order shipped."),
+		TextItem("and mention the photo"),
+		ImageItem("image/png", png),
+	}
+
+	t.Run("openai", func(t *testing.T) {
+		var sent []json.RawMessage
+		var seen string
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.DynamicInstructions = []InstructionFunc{func(ctx context.Context, input AgentInput) (string, error) {
+			seen = input.UserInput
+			return "", nil
+		}}
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = body.Input
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`)}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", Items: items}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if seen != "make this friendlier\n\nand mention the photo" {
+			t.Errorf("expected the user's text as the input but got %q", seen)
+		}
+
+		var messages []openai.Message
+		for _, item := range sent {
+			var message openai.Message
+			json.Unmarshal(item, &message)
+			messages = append(messages, message)
+		}
+		if len(messages) != 3 || messages[0].Role != "user" || messages[1].Role != "assistant" || messages[2].Role != "user" {
+			t.Fatalf("expected user, assistant and user messages but got %+v", messages)
+		}
+		if messages[1].Content[0].Type != "output_text" || messages[1].Content[0].Text != "Your order shipped." {
+			t.Errorf("expected the draft as assistant output but got %+v", messages[1].Content)
+		}
+		last := messages[2].Content
+		if len(last) != 2 || last[1].Type != "input_image" || !strings.HasPrefix(last[1].ImageURL, "data:image/png;base64,") {
+			t.Errorf("expected the text and image together but got %+v", last)
+		}
+	})
+
+	t.Run("gemini", func(t *testing.T) {
+		var sent []gemini.Content
+		a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+			return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+				sent = body.Contents
+				var resp gemini.ResponseBody
+				err := json.Unmarshal([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`), &resp)
+				return &resp, err
+			}
+		}}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", Items: items}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(sent) != 3 || sent[1].Role != "model" || len(sent[2].Parts) != 2 || sent[2].Parts[1].InlineData == nil {
+			t.Errorf("expected the draft from the model and the image inline but got %+v", sent)
+		}
+	})
+
+	t.Run("images to a provider without them", func(t *testing.T) {
+		a, _ := NewAgent(model.MistralModel("mistral-large-latest"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				t.Errorf("expected nothing sent")
+				return nil, errors.New("sent")
+			}
+		}}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", Items: items}); !errors.Is(err, ErrInvalidUserInput) {
+			t.Errorf("expected ErrInvalidUserInput but got %v", err)
+		}
+	})
+
+	t.Run("invalid items", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+
+		for name, invalid := range map[string][]InputItem{
+			"ending with the assistant": {TextItem("hi"), AssistantItem("hello")},
+			"image without a type":      {TextItem("hi"), {Type: InputImage, Data: png}},
+			"only an image":             {ImageItem("image/png", png)},
+		} {
+			if _, err := a.Call(ctx, AgentInput{Id: "id", Items: invalid}); !errors.Is(err, ErrInvalidUserInput) {
+				t.Errorf("expected ErrInvalidUserInput for %s but got %v", name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+)
+
+var ErrCorruptHistory = errors.New("corrupt history")
+
+// What happens to a session whose stored history is corrupt, such as one
+// the Memoriser mangled or a provider body that no longer decodes
+type HistoryRecovery string
+
+const (
+	// Keeps whatever history items still decode, dropping the rest and
+	// repairing the order of what's left. Sessions that can't be decoded at
+	// all are reset. The default.
+	RecoverRepair HistoryRecovery = "repair"
+	// Starts the session's history afresh, keeping its metadata and usage
+	RecoverReset HistoryRecovery = "reset"
+	// Fails every call for the session with ErrCorruptHistory
+	RecoverFail HistoryRecovery = "fail"
+)
+
+// Loads a session, checking its history decodes into the provider's body and
+// recovering it as HistoryRecovery says when it doesn't
+func (a *Agent[T]) loadIntact(ctx context.Context, mem memoriser.Memoriser, input AgentInput) (*Session, error) {
+	session, err := a.load(ctx, mem, input.Id)
+	if errors.Is(err, ErrUnsupportedVersion) || errors.Is(err, ErrMigrationFailed) {
+		// Written by something newer or waiting on a migration, rather
+		// than corrupt
+		return nil, err
+	}
+	if err == nil {
+		err = a.translateHistory(ctx, input.Id, session)
+	}
+	if err == nil {
+		if err = a.checkHistory(session.History); err == nil {
+			return session, nil
+		}
+	}
+
+	corrupt := fmt.Errorf("%s - %w", input.Id, errors.Join(ErrCorruptHistory, err))
+	slog.WarnContext(ctx, "loaded corrupt history", slog.String("id", input.Id), slog.String("recovery", string(a.HistoryRecovery)), slog.Any("error", err))
+
+	if a.HistoryRecovery == RecoverFail {
+		return nil, corrupt
+	}
+
+	if session == nil {
+		session = &Session{Version: SessionVersion}
+	}
+	// However it's recovered, what was stored can't be appended to
+	session.rewrite = true
+	session.logged = 0
+	session.PromptTokens = 0
+	session.PromptItems = 0
+
+	repairs := []string{"reset corrupt history"}
+	if a.HistoryRecovery == RecoverReset || len(session.History) == 0 {
+		session.History = nil
+	} else if salvaged, dropped, err := a.salvageHistory(session.History); err != nil {
+		slog.WarnContext(ctx, "failed to salvage history, resetting it", slog.Any("error", err))
+		session.History = nil
+	} else {
+		session.History = salvaged
+		repairs = []string{fmt.Sprintf("dropped %d corrupt history items", dropped)}
+	}
+
+	if a.Hooks.OnHistoryRepair != nil {
+		a.Hooks.OnHistoryRepair(ctx, input, repairs)
+	}
+
+	return session, nil
+}
+
+// Checks history decodes into the provider's body, with every item being
+// one the provider could be sent
+func (a *Agent[T]) checkHistory(history json.RawMessage) error {
+	if len(history) == 0 {
+		return nil
+	}
+
+	p, err := a.provider(AgentInput{})
+	if err != nil {
+		return err
+	}
+
+	return p.CheckHistory(history)
+}
+
+// Rebuilds history from the items that still decode on their own, returning
+// how many were dropped
+func (a *Agent[T]) salvageHistory(history json.RawMessage) (json.RawMessage, int, error) {
+	items, err := splitHistory(history)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kept := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		body, err := a.historyBody([]json.RawMessage{item})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if a.checkHistory(body) == nil {
+			kept = append(kept, item)
+		}
+	}
+
+	body, err := a.historyBody(kept)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, len(items) - len(kept), nil
+}
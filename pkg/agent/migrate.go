@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	ErrMissingMigration = errors.New("missing migration")
+	ErrMigrationFailed  = errors.New("history migration failed")
+)
+
+// Upgrades a session saved at one history version to the next, such as
+// rewriting history after switching provider. The session's HistoryVersion
+// is bumped once the migration returns.
+type Migration func(ctx context.Context, session *Session) error
+
+// DropHistory is a Migration discarding history the agent can no longer use,
+// keeping the session's metadata and usage
+func DropHistory(ctx context.Context, session *Session) error {
+	session.History = nil
+	session.PromptTokens = 0
+	session.PromptItems = 0
+
+	return nil
+}
+
+// Brings a session's history up to the agent's HistoryVersion, one version
+// at a time
+func (a *Agent[T]) migrate(ctx context.Context, id string, session *Session) error {
+	if session.HistoryVersion > a.HistoryVersion {
+		return fmt.Errorf("history version %d is newer than %d - %w", session.HistoryVersion, a.HistoryVersion, ErrUnsupportedVersion)
+	}
+
+	// Nothing stored yet, so nothing to migrate
+	if len(session.History) == 0 && session.Turns == 0 {
+		session.HistoryVersion = a.HistoryVersion
+		return nil
+	}
+
+	for session.HistoryVersion < a.HistoryVersion {
+		migration, ok := a.Migrations[session.HistoryVersion]
+		if !ok {
+			return fmt.Errorf("history version %d to %d - %w", session.HistoryVersion, session.HistoryVersion+1, errors.Join(ErrMissingMigration, ErrUnsupportedVersion))
+		}
+
+		if err := migration(ctx, session); err != nil {
+			return fmt.Errorf("history version %d - %w", session.HistoryVersion, errors.Join(ErrMigrationFailed, err))
+		}
+
+		slog.InfoContext(ctx, "migrated history", slog.String("id", id), slog.Int("from", session.HistoryVersion), slog.Int("to", session.HistoryVersion+1))
+		session.HistoryVersion++
+		// The log holds the history as it was
+		session.rewrite = true
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Calls model.OllamaModel on an ollama server
+type ollamaProvider struct {
+	cfg    ProviderConfig
+	client *ollama.Ollama
+	// Set when the turn's tool choice is none, as ollama can't require
+	// tools, only leave them out
+	withoutTools bool
+}
+
+// An ollama request, along with the instructions sent only for this turn
+type ollamaBody struct {
+	*ollama.ChatRequest
+	// Index of the message holding deferred instructions, -1 for none
+	deferred int
+}
+
+func (b *ollamaBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.ChatRequest)
+}
+
+func (b *ollamaBody) AppendUserInput(text string) error {
+	b.ChatRequest.AppendUserInput(text)
+	return nil
+}
+
+func (b *ollamaBody) Repair() ([]string, error) {
+	return b.RepairMessages()
+}
+
+func (b *ollamaBody) Finish(compact func(string) string) error {
+	if b.deferred >= 0 {
+		b.Messages = slices.Delete(b.Messages, b.deferred, b.deferred+1)
+		b.deferred = -1
+	}
+	if compact != nil {
+		b.CompactToolOutputs(compact)
+	}
+
+	return nil
+}
+
+func (b *ollamaBody) Items(from int) ([]json.RawMessage, int, error) {
+	return messageItems(b.Messages, from)
+}
+
+// History items of chat style messages
+func messageItems[M any](messages []M, from int) ([]json.RawMessage, int, error) {
+	if from > len(messages) {
+		return nil, len(messages), nil
+	}
+
+	items := make([]json.RawMessage, 0, len(messages)-from)
+	for _, message := range messages[from:] {
+		item, err := json.Marshal(message)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode history item - %w", err)
+		}
+		items = append(items, item)
+	}
+
+	return items, len(messages), nil
+}
+
+func newOllamaProvider(cfg ProviderConfig) (Provider, error) {
+	// Ollama has no auth, and decodes no compressed requests
+	if cfg.Keys != nil || cfg.Compress {
+		return nil, fmt.Errorf("ollama takes neither keys nor compressed requests - %w", ErrUnsupportedOption)
+	}
+
+	o, err := ollama.NewOllamaClient(cfg.Client, cfg.OllamaHost)
+	if err != nil {
+		return nil, err
+	}
+	o.Middleware = cfg.OllamaMiddleware
+	if cfg.respond != nil {
+		o.Middleware = append(slices.Clone(o.Middleware), func(ollama.Handler) ollama.Handler {
+			return func(ctx context.Context, body *ollama.ChatRequest) (*ollama.ChatResponse, error) {
+				raw, err := cfg.respond()
+				if err != nil {
+					return nil, err
+				}
+				var resp ollama.ChatResponse
+				return &resp, json.Unmarshal(raw, &resp)
+			}
+		})
+	}
+	o.Signer = cfg.Signer
+	o.MaxResponseBytes = cfg.MaxResponseBytes
+	o.MaxRequestBytes = cfg.MaxRequestBytes
+	o.RequestTimeout = cfg.RequestTimeout
+	o.RequestAttempts = cfg.RequestAttempts
+	o.OnUnknownTool = cfg.OnUnknownTool
+	o.OnToolCall = cfg.OnToolCall
+
+	return &ollamaProvider{cfg: cfg, client: o}, nil
+}
+
+func (p *ollamaProvider) Body(ctx context.Context, turn Turn) (Body, error) {
+	body, err := p.client.Body(p.cfg.Model.Model(), turn.Input.UserInput, turn.system(), turn.History, turn.Input.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(turn.Input.Items) > 0 {
+		// Body adds the input as text, which its items replace
+		body.Messages = body.Messages[:len(body.Messages)-1]
+		for _, message := range turn.Input.messages() {
+			m := ollama.Message{Role: message.Role, Content: message.text()}
+			for _, item := range message.Items {
+				if item.Type == InputImage {
+					m.Images = append(m.Images, item.Data)
+				}
+			}
+			body.Messages = append(body.Messages, m)
+		}
+	}
+
+	return &ollamaBody{ChatRequest: body, deferred: -1}, nil
+}
+
+func (p *ollamaProvider) Prepare(ctx context.Context, b Body, turn Turn) error {
+	body := b.(*ollamaBody)
+	input := turn.Input
+	generation := p.cfg.Generation
+
+	if p.cfg.PromptCaching && len(turn.Instructions) > 0 {
+		body.deferred = len(body.Messages) - 1
+		body.Messages = slices.Insert(body.Messages, body.deferred, ollama.Message{Role: "system", Content: strings.Join(turn.Instructions, "\n\n")})
+	} else {
+		for _, instruction := range turn.Instructions {
+			body.AppendSystemInstruction(instruction)
+		}
+	}
+
+	body.Options = ollama.Options{
+		NumPredict:       generation.MaxOutputTokens,
+		Seed:             generation.Seed,
+		Stop:             input.StopSequences,
+		PresencePenalty:  generation.PresencePenalty,
+		FrequencyPenalty: generation.FrequencyPenalty,
+	}
+
+	body.Think = nil
+	if generation.IncludeThoughts {
+		think := true
+		body.Think = &think
+	} else if generation.ThinkingBudget != nil && *generation.ThinkingBudget == 0 {
+		think := false
+		body.Think = &think
+	}
+
+	p.withoutTools = input.ToolChoice != nil && input.ToolChoice.Mode == ToolChoiceNone
+
+	return nil
+}
+
+func (p *ollamaProvider) Generate(ctx context.Context, b Body, tools []tool.Tool[any, any]) (Body, Result, error) {
+	body := b.(*ollamaBody)
+	if p.withoutTools {
+		tools = nil
+	}
+
+	next, res, err := p.client.Generate(ctx, body.ChatRequest, tools)
+	if err != nil {
+		return nil, Result{}, err
+	}
+
+	return &ollamaBody{ChatRequest: next, deferred: body.deferred}, Result{
+		Text:         res.Text,
+		Thoughts:     res.Thoughts,
+		Truncated:    res.Truncated(),
+		Usage:        ollamaUsage(res.Usage),
+		PromptTokens: res.PromptTokens,
+	}, nil
+}
+
+func (p *ollamaProvider) Stream(ctx context.Context, b Body, tools []tool.Tool[any, any], onText func(text string)) (Body, Result, error) {
+	return nil, Result{}, fmt.Errorf("ollama can't stream - %w", ErrUnsupportedOption)
+}
+
+func (p *ollamaProvider) History(items []json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(map[string][]json.RawMessage{"messages": items})
+}
+
+func (p *ollamaProvider) CheckHistory(history json.RawMessage) error {
+	var body ollama.ChatRequest
+	if err := json.Unmarshal(history, &body); err != nil {
+		return err
+	}
+	_, err := body.RepairMessages()
+	return err
+}
+
+func (p *ollamaProvider) TurnStart(item json.RawMessage) bool {
+	return userMessage(item)
+}
+
+// Whether a local model can call tools or see images depends on the model
+// pulled, so ollama is left to reject what the model can't do
+func (p *ollamaProvider) Capabilities() Capabilities {
+	return catalogCapabilities(p.cfg.Model, Capabilities{Tools: true, StructuredOutput: true, Images: true})
+}
+
+func (p *ollamaProvider) replayTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	return ollamaTurns(items)
+}
+
+// Whether a chat style message is from the user
+func userMessage(item json.RawMessage) bool {
+	var message struct {
+		Role string `json:"role"`
+	}
+	return json.Unmarshal(item, &message) == nil && message.Role == "user"
+}
+
+func ollamaUsage(usage ollama.Usage) Usage {
+	return Usage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.OutputTokens,
+		TotalTokens:  usage.PromptTokens + usage.OutputTokens,
+	}
+}
@@ -0,0 +1,303 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/huggingface"
+	"github.com/calamity-m/clusterfuc/pkg/mistral"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Calls model.OpenAiModel through openai, Azure or a compatible server,
+// model.OpenRouterModel through OpenRouter, model.DeepSeekModel through
+// DeepSeek, model.MistralModel through mistral and model.HuggingFaceModel
+// through a TGI server
+type openaiProvider struct {
+	cfg    ProviderConfig
+	client *openai.OpenAI
+}
+
+// An openai request, along with the instructions sent only for this turn
+type openaiBody struct {
+	*openai.CreateResponse
+	// Index of the item holding deferred instructions, -1 for none
+	deferred int
+	// Number of developer messages leading the input
+	developer int
+}
+
+func (b *openaiBody) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.CreateResponse)
+}
+
+func (b *openaiBody) Repair() ([]string, error) {
+	return b.RepairInput()
+}
+
+func (b *openaiBody) Finish(compact func(string) string) error {
+	if b.deferred >= 0 {
+		b.Input = slices.Delete(b.Input, b.deferred, b.deferred+1)
+		b.deferred = -1
+	}
+	b.Input = slices.Delete(b.Input, 0, b.developer)
+	b.developer = 0
+	if compact != nil {
+		return b.CompactToolOutputs(compact)
+	}
+
+	return nil
+}
+
+func (b *openaiBody) Items(from int) ([]json.RawMessage, int, error) {
+	if from > len(b.Input) {
+		return nil, len(b.Input), nil
+	}
+
+	return b.Input[from:], len(b.Input), nil
+}
+
+func newOpenAIProvider(cfg ProviderConfig) (Provider, error) {
+	oa, err := openai.NewOpenAIClient(cfg.Client, cfg.Auth)
+	switch cfg.Model.(type) {
+	case model.OpenRouterModel:
+		oa, err = openai.NewOpenRouterClient(cfg.Client, cfg.Auth)
+	case model.DeepSeekModel:
+		oa, err = openai.NewDeepSeekClient(cfg.Client, cfg.Auth)
+	case model.MistralModel:
+		oa, err = mistral.NewMistralClient(cfg.Client, cfg.Auth)
+	case model.HuggingFaceModel:
+		oa, err = huggingface.NewHuggingFaceClient(cfg.Client, cfg.HuggingFaceEndpoint, cfg.Auth)
+	default:
+		if cfg.OpenAIBaseURL != "" {
+			oa, err = openai.NewCompatibleClient(cfg.Client, cfg.Auth, cfg.OpenAIBaseURL)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	oa.ChatCompletions = oa.ChatCompletions || cfg.ChatCompletions
+	oa.Route = cfg.Route
+	oa.Middleware = cfg.OpenAIMiddleware
+	if cfg.respond != nil {
+		oa.Middleware = append(slices.Clone(oa.Middleware), func(openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				raw, err := cfg.respond()
+				if err != nil {
+					return nil, err
+				}
+				var resp openai.Response
+				return &resp, json.Unmarshal(raw, &resp)
+			}
+		})
+	}
+	oa.Signer = cfg.Signer
+	oa.Keys = cfg.Keys
+	if cfg.Azure != nil {
+		azure := *cfg.Azure
+		if azure.Deployment == "" {
+			azure.Deployment = cfg.Model.Model()
+		}
+		oa.Azure = &azure
+	}
+	oa.Compress = cfg.Compress
+	oa.MaxResponseBytes = cfg.MaxResponseBytes
+	oa.MaxRequestBytes = cfg.MaxRequestBytes
+	oa.RequestTimeout = cfg.RequestTimeout
+	oa.RequestAttempts = cfg.RequestAttempts
+	oa.OnUnknownTool = cfg.OnUnknownTool
+	oa.OnToolCall = cfg.OnToolCall
+
+	return &openaiProvider{cfg: cfg, client: oa}, nil
+}
+
+func (p *openaiProvider) Body(ctx context.Context, turn Turn) (Body, error) {
+	body, err := p.client.Body(p.cfg.Model.Model(), turn.Input.UserInput, turn.System, turn.History, turn.Input.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(turn.Input.Items) > 0 {
+		// Body adds the input as text, which its items replace
+		body.Input = body.Input[:len(body.Input)-1]
+		for _, message := range turn.Input.messages() {
+			var content []openai.MessageContent
+			for _, item := range message.Items {
+				switch {
+				case item.Type == InputImage:
+					content = append(content, openai.ImageContent(item.MimeType, item.Data))
+				case message.Role == "assistant":
+					content = append(content, openai.MessageContent{Type: "output_text", Text: item.Text})
+				default:
+					content = append(content, openai.MessageContent{Type: "input_text", Text: item.Text})
+				}
+			}
+
+			item, err := openai.InputMessage(message.Role, content...)
+			if err != nil {
+				return nil, err
+			}
+			body.Input = append(body.Input, item)
+		}
+	}
+
+	return &openaiBody{CreateResponse: body, deferred: -1}, nil
+}
+
+func (p *openaiProvider) Prepare(ctx context.Context, b Body, turn Turn) error {
+	body := b.(*openaiBody)
+	input := turn.Input
+	generation := p.cfg.Generation
+
+	body.User = input.endUser()
+	for _, message := range turn.Developer {
+		if message == "" {
+			continue
+		}
+		item, err := openai.DeveloperMessage(message)
+		if err != nil {
+			return err
+		}
+		body.Input = slices.Insert(body.Input, body.developer, item)
+		body.developer++
+	}
+	if p.cfg.PromptCaching && len(turn.Instructions) > 0 {
+		item, err := openai.DeveloperMessage(strings.Join(turn.Instructions, "\n\n"))
+		if err != nil {
+			return err
+		}
+		body.deferred = len(body.Input) - 1
+		body.Input = slices.Insert(body.Input, body.deferred, item)
+	} else if len(turn.Instructions) > 0 {
+		body.Instructions = strings.Join(append([]string{body.Instructions}, turn.Instructions...), "\n\n")
+		body.Instructions = strings.TrimPrefix(body.Instructions, "\n\n")
+	}
+	body.PromptCacheKey = ""
+	if p.cfg.PromptCaching {
+		body.PromptCacheKey = promptCacheKey(input)
+	}
+	body.Metadata = input.Metadata
+	body.MaxOutputTokens = generation.MaxOutputTokens
+	body.ServiceTier = generation.ServiceTier
+	// Sent in chat completions mode only, the responses api has no place
+	// for them
+	body.Stop = input.StopSequences
+	body.Seed = generation.Seed
+	body.PresencePenalty = generation.PresencePenalty
+	body.FrequencyPenalty = generation.FrequencyPenalty
+
+	// History holds the previous turn's choice, which may not be this one's
+	body.Reasoning.Summary = ""
+	if generation.IncludeThoughts && openai.ReasoningModel(body.Model) {
+		body.Reasoning.Summary = "auto"
+	}
+
+	logprobs := generation.Confidence == ConfidenceLogprobs && !openai.ReasoningModel(body.Model)
+	body.Include = slices.DeleteFunc(body.Include, func(include openai.Includable) bool {
+		return include == openai.IncludableOutputTextLogprobs
+	})
+	if logprobs {
+		body.Include = append(body.Include, openai.IncludableOutputTextLogprobs)
+	}
+
+	body.ToolChoice = nil
+	if input.ToolChoice != nil {
+		var err error
+		body.ToolChoice, err = openai.ToolChoice(string(input.ToolChoice.Mode), input.ToolChoice.Tools...)
+		if err != nil {
+			return fmt.Errorf("failed to encode tool choice - %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *openaiProvider) Generate(ctx context.Context, b Body, tools []tool.Tool[any, any]) (Body, Result, error) {
+	body := b.(*openaiBody)
+	return body.generated(p.client.Generate(ctx, body.CreateResponse, tools))
+}
+
+func (p *openaiProvider) Stream(ctx context.Context, b Body, tools []tool.Tool[any, any], onText func(text string)) (Body, Result, error) {
+	body := b.(*openaiBody)
+	return body.generated(p.client.Stream(ctx, body.CreateResponse, tools, onText))
+}
+
+// Wraps what the client generated from a body, keeping what the body
+// deferred
+func (body *openaiBody) generated(next *openai.CreateResponse, res openai.Result, err error) (Body, Result, error) {
+	if err != nil {
+		return nil, Result{}, err
+	}
+
+	return &openaiBody{CreateResponse: next, deferred: body.deferred, developer: body.developer}, Result{
+		Text:           res.Text,
+		Thoughts:       res.Thoughts,
+		Truncated:      res.Truncated(),
+		Usage:          openaiUsage(res.Usage),
+		PromptTokens:   res.PromptTokens,
+		Logprobs:       res.Logprobs,
+		ServiceTier:    res.ServiceTier,
+		ServedModel:    res.Model,
+		ServedProvider: res.Provider,
+	}, nil
+}
+
+func (p *openaiProvider) History(items []json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(map[string][]json.RawMessage{"input": items})
+}
+
+func (p *openaiProvider) CheckHistory(history json.RawMessage) error {
+	var body openai.CreateResponse
+	if err := json.Unmarshal(history, &body); err != nil {
+		return err
+	}
+	_, err := body.RepairInput()
+	return err
+}
+
+func (p *openaiProvider) TurnStart(item json.RawMessage) bool {
+	var message struct {
+		Type string `json:"type"`
+		Role string `json:"role"`
+	}
+	if json.Unmarshal(item, &message) != nil {
+		return false
+	}
+
+	return message.Role == "user" && (message.Type == "" || message.Type == "message")
+}
+
+func (p *openaiProvider) Capabilities() Capabilities {
+	caps := Capabilities{Tools: true, StructuredOutput: true, Images: true, Streaming: true}
+	switch p.cfg.Model.(type) {
+	case model.DeepSeekModel:
+		// DeepSeek only constrains output to json, rather than to a
+		// schema, and its models can't see
+		caps.StructuredOutput = false
+		caps.Images = false
+	case model.HuggingFaceModel:
+		// Most models TGI serves can't see
+		caps.Images = false
+	}
+
+	return catalogCapabilities(p.cfg.Model, caps)
+}
+
+func (p *openaiProvider) replayTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	return openaiTurns(items)
+}
+
+func openaiUsage(usage openai.ResponseUsage) Usage {
+	return Usage{
+		InputTokens:     usage.InputTokens,
+		OutputTokens:    usage.OutputTokens,
+		CachedTokens:    usage.InputTokensDetails.CachedTokens,
+		ReasoningTokens: usage.OutputTokensDetails.ReasoningTokens,
+		TotalTokens:     usage.TotalTokens,
+	}
+}
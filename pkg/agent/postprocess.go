@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Transforms the model's output before it is validated against a schema and
+// returned. An error fails the call.
+type PostProcessor func(ctx context.Context, output string) (string, error)
+
+// StripCodeFences unwraps output the model has put in a markdown code fence
+func StripCodeFences() PostProcessor {
+	return func(ctx context.Context, output string) (string, error) {
+		return stripFences(output), nil
+	}
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// NormalizeWhitespace trims the output and its lines of trailing spaces,
+// collapsing runs of blank lines into one
+func NormalizeWhitespace() PostProcessor {
+	return func(ctx context.Context, output string) (string, error) {
+		lines := strings.Split(strings.ReplaceAll(output, "\r\n", "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(line, " \t")
+		}
+
+		return blankLines.ReplaceAllString(strings.TrimSpace(strings.Join(lines, "\n")), "\n\n"), nil
+	}
+}
+
+// ExtractJSON keeps only the first json object in the output, dropping any
+// prose around it. Output without one is left as is.
+func ExtractJSON() PostProcessor {
+	return func(ctx context.Context, output string) (string, error) {
+		for start := strings.IndexByte(output, '{'); start >= 0; {
+			if end := objectEnd(output[start:]); end > 0 && json.Valid([]byte(output[start:start+end])) {
+				return output[start : start+end], nil
+			}
+
+			next := strings.IndexByte(output[start+1:], '{')
+			if next < 0 {
+				break
+			}
+			start += next + 1
+		}
+
+		return output, nil
+	}
+}
+
+// Finds the length of the object opening text, or 0 when it never closes
+func objectEnd(text string) int {
+	depth := 0
+	inString, escaped := false, false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return 0
+}
+
+// Runs output through the agent's post processors in order
+func (a *Agent[T]) postProcess(ctx context.Context, output string) (string, error) {
+	for _, p := range a.PostProcessors {
+		var err error
+		output, err = p(ctx, output)
+		if err != nil {
+			return "", fmt.Errorf("failed to post process output - %w", err)
+		}
+	}
+
+	return output, nil
+}
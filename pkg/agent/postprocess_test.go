@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+func TestPostProcessors(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name      string
+		processor PostProcessor
+		in, want  string
+	}{
+		{"fences", StripCodeFences(), "```json\n{\"a\":1}\n```", `{"a":1}`},
+		{"whitespace", NormalizeWhitespace(), "  a  \r\n\n\n\nb\t\n", "a\n\nb"},
+		{"json", ExtractJSON(), `Sure! {"a":{"b":"}"}} hope that helps {"c":2}`, `{"a":{"b":"}"}}`},
+		{"json skips invalid", ExtractJSON(), `{oops} then {"a":1}`, `{"a":1}`},
+		{"json missing", ExtractJSON(), "no json here", "no json here"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.processor(ctx, c.in)
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			if got != c.want {
+				t.Errorf("expected %q but got %q", c.want, got)
+			}
+		})
+	}
+
+	t.Run("applied before structured output", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.PostProcessors = []PostProcessor{ExtractJSON(), func(ctx context.Context, output string) (string, error) {
+			return strings.ToUpper(output), nil
+		}}
+		a.OpenAIMiddleware = []openai.Middleware{respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Here you go: {\"name\":\"bob\"}"}]}]}`)}
+
+		output, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi", Schema: []byte(`{"type":"object","properties":{"NAME":{"type":"string"}},"required":["NAME"]}`)})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if output.Output != `{"NAME":"BOB"}` {
+			t.Errorf("expected processed output but got %s", output.Output)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+)
+
+// Somewhere other than the Memoriser holding data about end users, such as
+// long-term memory or audit logs, that must take part in privacy requests
+type UserDataStore interface {
+	// Name identifying the store within an export
+	Name() string
+	// ExportUser returns everything held about an end user
+	ExportUser(ctx context.Context, endUserID string) (json.RawMessage, error)
+	// DeleteUser removes everything held about an end user
+	DeleteUser(ctx context.Context, endUserID string) error
+}
+
+// Everything held about an end user
+type UserExport struct {
+	EndUserID string `json:"end_user_id"`
+	// Sessions keyed by namespace and then session id, with the default
+	// namespace being an empty string
+	Sessions map[string]map[string]Session `json:"sessions"`
+	// Exports of each UserDataStore keyed by name
+	Stores map[string]json.RawMessage `json:"stores,omitempty"`
+}
+
+// ExportAllForUser gathers every session belonging to an end user, along
+// with whatever the agent's UserDataStores hold about them. Sessions are
+// searched within the default namespace and any namespaces given, and
+// require the Memoriser to be a memoriser.Lister.
+func (a *Agent[T]) ExportAllForUser(ctx context.Context, endUserID string, namespaces ...string) (UserExport, error) {
+	export := UserExport{
+		EndUserID: endUserID,
+		Sessions:  make(map[string]map[string]Session),
+		Stores:    make(map[string]json.RawMessage),
+	}
+
+	err := a.userSessions(ctx, endUserID, namespaces, func(ns string, mem memoriser.Memoriser, id string, session *Session) error {
+		if export.Sessions[ns] == nil {
+			export.Sessions[ns] = make(map[string]Session)
+		}
+		export.Sessions[ns][id] = *session
+		return nil
+	})
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	for _, store := range a.UserDataStores {
+		data, err := store.ExportUser(ctx, endUserID)
+		if err != nil {
+			return UserExport{}, fmt.Errorf("failed to export from %s - %w", store.Name(), err)
+		}
+		export.Stores[store.Name()] = data
+	}
+
+	return export, nil
+}
+
+// DeleteAllForUser removes every session belonging to an end user, and asks
+// the agent's UserDataStores to do the same. Sessions are searched within the
+// default namespace and any namespaces given, and require the Memoriser to be
+// both a memoriser.Lister and memoriser.Deleter. Deletion carries on past
+// failures, which are returned together.
+func (a *Agent[T]) DeleteAllForUser(ctx context.Context, endUserID string, namespaces ...string) error {
+	var errs []error
+
+	err := a.userSessions(ctx, endUserID, namespaces, func(ns string, mem memoriser.Memoriser, id string, session *Session) error {
+		deleter, ok := mem.(memoriser.Deleter)
+		if !ok {
+			return memoriser.ErrDeleteUnsupported
+		}
+
+		if err := deleter.Delete(id); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete session %s - %w", id, err))
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, store := range a.UserDataStores {
+		if err := store.DeleteUser(ctx, endUserID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete from %s - %w", store.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Walks every session belonging to an end user within the given namespaces
+// and the default one
+func (a *Agent[T]) userSessions(
+	ctx context.Context,
+	endUserID string,
+	namespaces []string,
+	fn func(ns string, mem memoriser.Memoriser, id string, session *Session) error,
+) error {
+	if a.Memoriser == nil {
+		return fmt.Errorf("use NoOpMemoriser if no memory is wanted - %w", ErrNilMemoriser)
+	}
+
+	if endUserID == "" {
+		return fmt.Errorf("empty end user id - %w", ErrInvalidId)
+	}
+
+	for _, ns := range append([]string{""}, namespaces...) {
+		mem, err := a.memoriser(ns)
+		if err != nil {
+			return err
+		}
+
+		lister, ok := mem.(memoriser.Lister)
+		if !ok {
+			return memoriser.ErrListUnsupported
+		}
+
+		ids, err := lister.List("")
+		if err != nil {
+			return fmt.Errorf("failed to list sessions - %w", err)
+		}
+
+		for _, id := range ids {
+			session, err := a.load(ctx, mem, id)
+			if err != nil {
+				return fmt.Errorf("failed to load session %s - %w", id, err)
+			}
+
+			// Sessions saved before end users were recorded fell back
+			// to their id
+			owner := session.EndUserID
+			if owner == "" {
+				owner = id
+			}
+
+			if owner != endUserID {
+				continue
+			}
+
+			if err := fn(ns, mem, id, session); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// A model provider the agent calls, such as openai or gemini. A provider is
+// made for every call by the factory registered for the type of the
+// agent's model, see RegisterProvider.
+type Provider interface {
+	// Body starts a turn, adding its input to its history. Nothing else of
+	// the turn is applied until Prepare, so a body with just an input asks
+	// a one off question.
+	Body(ctx context.Context, turn Turn) (Body, error)
+	// Prepare applies the rest of the turn to a body once its history is
+	// repaired, such as its instructions, tool choice and generation options
+	Prepare(ctx context.Context, body Body, turn Turn) error
+	// Generate sends a body, running the tools the model calls until it
+	// answers, and returns the body with the exchange added
+	Generate(ctx context.Context, body Body, tools []tool.Tool[any, any]) (Body, Result, error)
+	// Stream generates like Generate, calling onText with each piece of
+	// output text as it arrives. Providers that can't stream fail with
+	// ErrUnsupportedOption.
+	Stream(ctx context.Context, body Body, tools []tool.Tool[any, any], onText func(text string)) (Body, Result, error)
+	// History builds stored history holding just items. Items are kept
+	// under an input, contents or messages key, which is where the agent
+	// splits them back out from.
+	History(items []json.RawMessage) (json.RawMessage, error)
+	// CheckHistory fails when stored history doesn't decode, or holds items
+	// the provider can't be sent
+	CheckHistory(history json.RawMessage) error
+	// TurnStart reports whether a history item is a user message starting
+	// a turn, rather than part of one such as a tool output
+	TurnStart(item json.RawMessage) bool
+	// Capabilities reports what the provider's model supports, so calls
+	// needing something it lacks fail before anything is sent
+	Capabilities() Capabilities
+}
+
+// What a provider's model supports
+type Capabilities struct {
+	// Whether the model can call tools
+	Tools bool
+	// Whether output can be constrained to AgentInput.Schema. Without it
+	// the schema is only asked for, and the output still checked.
+	StructuredOutput bool
+	// Whether image input items can be sent
+	Images bool
+	// Whether output can be streamed as it's generated, see Agent.Stream
+	Streaming bool
+	// Most tokens the model accepts in a request, 0 when unknown
+	ContextWindow int
+	// Most tokens the model generates in a reply, 0 when unknown
+	MaxOutputTokens int
+}
+
+// Narrows what a provider supports to what model.Catalog knows of its
+// model, filling in its token limits
+func catalogCapabilities(m model.AIModel, caps Capabilities) Capabilities {
+	info, ok := model.Lookup(m)
+	if !ok {
+		return caps
+	}
+
+	caps.Tools = caps.Tools && info.Tools
+	caps.Images = caps.Images && info.Vision
+	caps.ContextWindow = info.ContextWindow
+	caps.MaxOutputTokens = info.MaxOutputTokens
+	return caps
+}
+
+// A request to a provider. Bodies encode as what is sent, which is also
+// what is stored as the session's history.
+type Body interface {
+	json.Marshaler
+	// AppendUserInput adds a user message, such as one asking the model to
+	// continue
+	AppendUserInput(text string) error
+	// Repair fixes the order of history so the provider accepts it,
+	// describing each repair made
+	Repair() ([]string, error)
+	// Finish readies the body to be stored once the turn is over, removing
+	// anything only sent for the turn. Tool outputs are compacted with
+	// compact unless it is nil.
+	Finish(compact func(string) string) error
+	// Items returns the history items from index from onwards, along with
+	// how many there are in total
+	Items(from int) ([]json.RawMessage, int, error)
+}
+
+// What a provider is told about a turn
+type Turn struct {
+	Input AgentInput
+	// Empty for none
+	System string
+	// Sent with the developer role, or as system instructions by providers
+	// without one, see Agent.DeveloperMessages
+	Developer []string
+	// Stored history of the session, nil for a new one
+	History json.RawMessage
+	// Sent alongside the system prompt, see DynamicInstructions
+	Instructions []string
+	// Sent with the turn, after any ToolSelector
+	Tools []tool.Tool[any, any]
+}
+
+// The system prompt followed by the developer messages, for providers
+// without a developer role
+func (t Turn) system() string {
+	parts := slices.DeleteFunc(append([]string{t.System}, t.Developer...), func(part string) bool {
+		return part == ""
+	})
+
+	return strings.Join(parts, "\n\n")
+}
+
+// What a provider generated for a turn
+type Result struct {
+	Text     string
+	Thoughts string
+	// Whether the output was cut short, such as by the output token limit
+	Truncated bool
+	// Tokens used across every request made for the generation
+	Usage Usage
+	// Prompt tokens of the final request, calibrating history trimming
+	PromptTokens int
+	// Log probability of each output token, for ConfidenceLogprobs
+	Logprobs  []float64
+	Artifacts []tool.Artifact
+	Safety    SafetyFeedback
+	// See AgentOutput
+	ServiceTier    string
+	ServedModel    string
+	ServedProvider string
+	Citations      []Citation
+}
+
+// Carries on from r with a continuation of its output
+func (r Result) continued(more Result) Result {
+	more.Text = r.Text + more.Text
+	more.Thoughts = r.Thoughts + more.Thoughts
+	more.Usage = r.Usage.Add(more.Usage)
+	more.Artifacts = append(r.Artifacts, more.Artifacts...)
+	more.Logprobs = append(r.Logprobs, more.Logprobs...)
+	// Citations of the continuation are offset by what it carries on from
+	for i := range more.Citations {
+		more.Citations[i].Start += len(r.Text)
+		more.Citations[i].End += len(r.Text)
+	}
+	more.Citations = append(r.Citations, more.Citations...)
+	return more
+}
+
+// What a provider is made with for a call, taken from the agent
+type ProviderConfig struct {
+	Model            model.AIModel
+	Client           *http.Client
+	Auth             string
+	Keys             *keypool.Pool
+	Signer           signer.Signer
+	Compress         bool
+	MaxResponseBytes int64
+	MaxRequestBytes  int64
+	RequestTimeout   time.Duration
+	RequestAttempts  int
+	Generation       GenerationOptions
+	PromptCaching    bool
+	PromptCacheTTL   time.Duration
+	// Called when the model calls a tool that isn't registered
+	OnUnknownTool func(ctx context.Context, name string)
+	// Called once a registered tool the model called has run
+	OnToolCall func(ctx context.Context, name string, args any, elapsed time.Duration, err error)
+
+	// Settings of the built in providers
+	OpenAIMiddleware    []openai.Middleware
+	GeminiMiddleware    []gemini.Middleware
+	OllamaMiddleware    []ollama.Middleware
+	CohereMiddleware    []cohere.Middleware
+	Azure               *openai.Azure
+	OpenAIBaseURL       string
+	ChatCompletions     bool
+	Route               *openai.Route
+	Vertex              *gemini.Vertex
+	OllamaHost          string
+	HuggingFaceEndpoint string
+
+	// Answers every request with a recorded response instead of the
+	// provider, see Replay
+	respond func() (json.RawMessage, error)
+}
+
+// Makes the provider for a call
+type ProviderFactory func(cfg ProviderConfig) (Provider, error)
+
+var providers = struct {
+	mux       sync.RWMutex
+	factories map[reflect.Type]ProviderFactory
+}{factories: map[reflect.Type]ProviderFactory{}}
+
+// RegisterProvider has agents whose model is an M call through providers
+// from factory, replacing any factory registered for M before. Models of
+// the built in providers are registered already.
+func RegisterProvider[M model.AIModel](factory ProviderFactory) {
+	providers.mux.Lock()
+	defer providers.mux.Unlock()
+
+	providers.factories[reflect.TypeFor[M]()] = factory
+}
+
+func init() {
+	RegisterProvider[model.OpenAiModel](newOpenAIProvider)
+	RegisterProvider[model.OpenRouterModel](newOpenAIProvider)
+	RegisterProvider[model.DeepSeekModel](newOpenAIProvider)
+	RegisterProvider[model.GeminiAiModel](newGeminiProvider)
+	RegisterProvider[model.OllamaModel](newOllamaProvider)
+	RegisterProvider[model.MistralModel](newOpenAIProvider)
+	RegisterProvider[model.CohereModel](newCohereProvider)
+	RegisterProvider[model.HuggingFaceModel](newOpenAIProvider)
+}
+
+// Makes the provider registered for the agent's model, configured for a
+// call with input
+func (a *Agent[T]) provider(input AgentInput) (Provider, error) {
+	providers.mux.RLock()
+	factory, ok := providers.factories[reflect.TypeOf(a.Model)]
+	providers.mux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no provider registered for %T - %w", a.Model, ErrModelUnmatched)
+	}
+
+	return factory(ProviderConfig{
+		Model:               a.Model,
+		Client:              a.Client,
+		Auth:                a.Auth,
+		Keys:                a.Keys,
+		Signer:              a.Signer,
+		Compress:            a.CompressRequests,
+		MaxResponseBytes:    a.MaxResponseBytes,
+		MaxRequestBytes:     a.MaxRequestBytes,
+		RequestTimeout:      a.RequestTimeout,
+		RequestAttempts:     a.requestAttempts(),
+		Generation:          a.Generation,
+		PromptCaching:       a.PromptCaching,
+		PromptCacheTTL:      a.PromptCacheTTL,
+		OnUnknownTool:       a.Hooks.unknownTool(input),
+		OnToolCall:          a.Hooks.toolCall(input),
+		OpenAIMiddleware:    a.OpenAIMiddleware,
+		GeminiMiddleware:    a.GeminiMiddleware,
+		OllamaMiddleware:    a.OllamaMiddleware,
+		CohereMiddleware:    a.CohereMiddleware,
+		Azure:               a.Azure,
+		OpenAIBaseURL:       a.OpenAIBaseURL,
+		ChatCompletions:     a.ChatCompletions,
+		Route:               a.Route,
+		Vertex:              a.Vertex,
+		OllamaHost:          a.OllamaHost,
+		HuggingFaceEndpoint: a.HuggingFaceEndpoint,
+		respond:             a.respond,
+	})
+}
+
+// Capabilities reports what the agent's model supports, see Provider
+func (a *Agent[T]) Capabilities() (Capabilities, error) {
+	p, err := a.provider(AgentInput{})
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	return p.Capabilities(), nil
+}
+
+// Splits recorded history into turns, for providers whose sessions can be
+// replayed
+type replayable interface {
+	replayTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error)
+}
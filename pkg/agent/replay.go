@@ -0,0 +1,434 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/calamity-m/clusterfuc/pkg/cohere"
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/ollama"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+var ErrReplayDiverged = errors.New("replay diverged from recording")
+
+type ReplayOptions struct {
+	// Run the agent's tools rather than answering each call with the
+	// output that was recorded. Tools with side effects will have them
+	// again, but changes in what tools return are caught.
+	LiveTools bool
+}
+
+// A history item the replay produced differently to the recording
+type ReplayMismatch struct {
+	// Index of the item in history
+	Item int
+	// Nil when the replay produced more items than were recorded
+	Recorded json.RawMessage
+	// Nil when the replay produced fewer items than were recorded
+	Replayed json.RawMessage
+}
+
+type ReplayReport struct {
+	// Output of each replayed turn
+	Outputs []AgentOutput
+	// Tools called while replaying, in order
+	ToolCalls  []ToolCall
+	Mismatches []ReplayMismatch
+}
+
+// A recorded user turn, with the provider responses that answered it
+type replayTurn struct {
+	input     string
+	responses []json.RawMessage
+}
+
+// Replay reproduces a stored session from its history alone, for debugging
+// what happened in production. Every user turn is called again against a
+// mock provider answering with the model's recorded responses, then the
+// history the replay produced is compared with the recording.
+//
+// Replays are read only. The session is never written to, and the agent's
+// hooks, quota and middleware are left out. Unless LiveTools is set, tools
+// answer with their recorded outputs rather than running, so what's checked
+// is that the agent still offers the tools the model called and builds the
+// same history from them.
+//
+// Turns the agent continued or re-asked on its own are replayed as separate
+// calls, so show up as mismatches. Replays that diverge fail with
+// ErrReplayDiverged alongside the report.
+func (a *Agent[T]) Replay(ctx context.Context, id string, opts ReplayOptions) (ReplayReport, error) {
+	if a.Memoriser == nil {
+		return ReplayReport{}, fmt.Errorf("use NoOpMemoriser if no memory is wanted - %w", ErrNilMemoriser)
+	}
+
+	session, err := a.load(ctx, a.Memoriser, id)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+
+	recorded, err := splitHistory(session.History)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+	if len(recorded) == 0 {
+		return ReplayReport{}, fmt.Errorf("%s - %w", id, ErrSessionNotFound)
+	}
+
+	var turns []replayTurn
+	var outputs map[string][]json.RawMessage
+	replayer := &Agent[T]{
+		Model:               a.Model,
+		SystemPrompt:        a.SystemPrompt,
+		Prompts:             a.Prompts,
+		PromptName:          a.PromptName,
+		PromptVersion:       a.PromptVersion,
+		Generation:          a.Generation,
+		CompactToolOutput:   a.CompactToolOutput,
+		PostProcessors:      a.PostProcessors,
+		HuggingFaceEndpoint: a.HuggingFaceEndpoint,
+		ToolSelector:        a.ToolSelector,
+		MaxTurnTools:        a.MaxTurnTools,
+		HistoryVersion:      a.HistoryVersion,
+		Memoriser:           memoriser.NewInMemoryMemoriser(),
+		scratchpad:          a.scratchpad,
+	}
+	// Self assessment would ask the model something it was never recorded
+	// answering
+	replayer.Generation.Confidence = ""
+
+	p, err := a.provider(AgentInput{})
+	if err != nil {
+		return ReplayReport{}, err
+	}
+	r, ok := p.(replayable)
+	if !ok {
+		return ReplayReport{}, fmt.Errorf("%T sessions can't be replayed - %w", a.Model, ErrModelUnmatched)
+	}
+	turns, outputs, err = r.replayTurns(recorded)
+	replayer.respond = replayResponses(turns)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+
+	replayer.tools = a.tools
+	if !opts.LiveTools {
+		replayer.tools = recordedTools(a.tools, outputs)
+	}
+
+	var report ReplayReport
+	var mux sync.Mutex
+	replayer.Hooks.OnToolCall = func(ctx context.Context, input AgentInput, call ToolCall) {
+		mux.Lock()
+		defer mux.Unlock()
+		report.ToolCalls = append(report.ToolCalls, call)
+	}
+
+	for i, turn := range turns {
+		output, err := replayer.Call(ctx, AgentInput{Id: id, UserInput: turn.input})
+		if err != nil {
+			return report, fmt.Errorf("failed replaying turn %d - %w", i+1, err)
+		}
+		report.Outputs = append(report.Outputs, output)
+	}
+
+	replayed, err := replayer.load(ctx, replayer.Memoriser, id)
+	if err != nil {
+		return report, err
+	}
+	items, err := splitHistory(replayed.History)
+	if err != nil {
+		return report, err
+	}
+
+	for i := range max(len(recorded), len(items)) {
+		var want, got json.RawMessage
+		if i < len(recorded) {
+			want = recorded[i]
+		}
+		if i < len(items) {
+			got = items[i]
+		}
+
+		if !sameJSON(want, got) {
+			report.Mismatches = append(report.Mismatches, ReplayMismatch{Item: i, Recorded: want, Replayed: got})
+		}
+	}
+
+	if len(report.Mismatches) > 0 {
+		return report, fmt.Errorf("%d of %d items differ - %w", len(report.Mismatches), len(recorded), ErrReplayDiverged)
+	}
+
+	return report, nil
+}
+
+// Hands out recorded responses in order, across every turn
+func replayResponses(turns []replayTurn) func() (json.RawMessage, error) {
+	var responses []json.RawMessage
+	for _, turn := range turns {
+		responses = append(responses, turn.responses...)
+	}
+
+	var mux sync.Mutex
+	return func() (json.RawMessage, error) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		if len(responses) == 0 {
+			return nil, fmt.Errorf("the agent made more requests than were recorded - %w", ErrReplayDiverged)
+		}
+
+		next := responses[0]
+		responses = responses[1:]
+		return next, nil
+	}
+}
+
+// Splits openai history into turns, along with the recorded outputs of
+// every tool called
+func openaiTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	var turns []replayTurn
+	outputs := map[string][]json.RawMessage{}
+	names := map[string]string{}
+	// Model items waiting to be sent as one response
+	var pending []json.RawMessage
+
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if len(turns) == 0 {
+			return fmt.Errorf("model output before any user input - %w", ErrReplayDiverged)
+		}
+
+		response, err := json.Marshal(openai.Response{Status: "completed", Output: pending})
+		if err != nil {
+			return fmt.Errorf("failed encoding recorded response - %w", err)
+		}
+		turns[len(turns)-1].responses = append(turns[len(turns)-1].responses, response)
+		pending = nil
+
+		return nil
+	}
+
+	for _, raw := range items {
+		var item struct {
+			Type    string                  `json:"type"`
+			Role    string                  `json:"role"`
+			CallID  string                  `json:"call_id"`
+			Name    string                  `json:"name"`
+			Output  string                  `json:"output"`
+			Content []openai.MessageContent `json:"content"`
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode recorded item - %w", err)
+		}
+
+		switch {
+		case item.Type == "message" && item.Role == "user":
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+
+			var input string
+			for _, content := range item.Content {
+				input += content.Text
+			}
+			turns = append(turns, replayTurn{input: input})
+
+		case item.Type == "function_call_output":
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+			name := names[item.CallID]
+			outputs[name] = append(outputs[name], json.RawMessage(item.Output))
+
+		default:
+			if item.Type == "function_call" {
+				names[item.CallID] = item.Name
+			}
+			pending = append(pending, raw)
+		}
+	}
+
+	return turns, outputs, flush()
+}
+
+// Splits gemini history into turns, along with the recorded responses of
+// every tool called
+func geminiTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	var turns []replayTurn
+	outputs := map[string][]json.RawMessage{}
+
+	for _, raw := range items {
+		var content gemini.Content
+		if err := json.Unmarshal(raw, &content); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode recorded content - %w", err)
+		}
+
+		if content.Role == "model" {
+			if len(turns) == 0 {
+				return nil, nil, fmt.Errorf("model output before any user input - %w", ErrReplayDiverged)
+			}
+
+			response, err := json.Marshal(gemini.ResponseBody{Candidates: []gemini.Candidate{{Content: content, FinishReason: "STOP"}}})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed encoding recorded response - %w", err)
+			}
+			turns[len(turns)-1].responses = append(turns[len(turns)-1].responses, response)
+			continue
+		}
+
+		var input string
+		for _, part := range content.Parts {
+			if part.FunctionResponse.Name == "" {
+				input += part.Text
+				continue
+			}
+
+			output, err := json.Marshal(part.FunctionResponse.Response)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed encoding recorded tool output - %w", err)
+			}
+			outputs[part.FunctionResponse.Name] = append(outputs[part.FunctionResponse.Name], output)
+		}
+
+		if input != "" {
+			turns = append(turns, replayTurn{input: input})
+		}
+	}
+
+	return turns, outputs, nil
+}
+
+// Splits ollama history into turns, along with the recorded outputs of every
+// tool called
+func ollamaTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	var turns []replayTurn
+	outputs := map[string][]json.RawMessage{}
+
+	for _, raw := range items {
+		var message ollama.Message
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode recorded message - %w", err)
+		}
+
+		switch message.Role {
+		case "user":
+			turns = append(turns, replayTurn{input: message.Content})
+		case "tool":
+			outputs[message.ToolName] = append(outputs[message.ToolName], json.RawMessage(message.Content))
+		case "assistant":
+			if len(turns) == 0 {
+				return nil, nil, fmt.Errorf("model output before any user input - %w", ErrReplayDiverged)
+			}
+
+			response, err := json.Marshal(ollama.ChatResponse{Message: message, Done: true, DoneReason: "stop"})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed encoding recorded response - %w", err)
+			}
+			turns[len(turns)-1].responses = append(turns[len(turns)-1].responses, response)
+		}
+	}
+
+	return turns, outputs, nil
+}
+
+func cohereTurns(items []json.RawMessage) ([]replayTurn, map[string][]json.RawMessage, error) {
+	var turns []replayTurn
+	outputs := map[string][]json.RawMessage{}
+	// Tool messages only carry their call's id, so the tool is found from
+	// the call
+	names := map[string]string{}
+
+	for _, raw := range items {
+		var message cohere.Message
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode recorded message - %w", err)
+		}
+
+		switch message.Role {
+		case "user":
+			turns = append(turns, replayTurn{input: message.Content})
+		case "tool":
+			name := names[message.ToolCallID]
+			outputs[name] = append(outputs[name], json.RawMessage(message.Content))
+		case "assistant":
+			if len(turns) == 0 {
+				return nil, nil, fmt.Errorf("model output before any user input - %w", ErrReplayDiverged)
+			}
+			for _, call := range message.ToolCalls {
+				names[call.ID] = call.Function.Name
+			}
+
+			reply := cohere.ResponseMessage{Role: "assistant", ToolCalls: message.ToolCalls, ToolPlan: message.ToolPlan}
+			if message.Content != "" {
+				reply.Content = []cohere.Content{{Type: "text", Text: message.Content}}
+			}
+			response, err := json.Marshal(cohere.ChatResponse{Message: reply, FinishReason: "COMPLETE"})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed encoding recorded response - %w", err)
+			}
+			turns[len(turns)-1].responses = append(turns[len(turns)-1].responses, response)
+		}
+	}
+
+	return turns, outputs, nil
+}
+
+// Stands in for the agent's tools, answering each call with the next output
+// recorded for it
+func recordedTools(tools []tool.Tool[any, any], outputs map[string][]json.RawMessage) []tool.Tool[any, any] {
+	var mux sync.Mutex
+
+	stubs := make([]tool.Tool[any, any], 0, len(tools))
+	for _, t := range tools {
+		if t.Name == "write_note" || t.Name == "read_notes" {
+			// The scratchpad only touches the replayed session
+			stubs = append(stubs, t)
+			continue
+		}
+
+		name := t.Name
+		stub := t
+		stub.Executable = tool.Bind(name, func(ctx context.Context, in json.RawMessage) (any, error) {
+			mux.Lock()
+			defer mux.Unlock()
+
+			if len(outputs[name]) == 0 {
+				return nil, fmt.Errorf("no recorded output left for %s - %w", name, ErrReplayDiverged)
+			}
+
+			output := outputs[name][0]
+			outputs[name] = outputs[name][1:]
+
+			if !json.Valid(output) {
+				return string(output), nil
+			}
+			return output, nil
+		}, t.Definition).Executable
+		stubs = append(stubs, stub)
+	}
+
+	return stubs
+}
+
+// Whether two json values are equal, regardless of formatting
+func sameJSON(a, b json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	var x, y any
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return string(a) == string(b)
+	}
+
+	return reflect.DeepEqual(x, y)
+}
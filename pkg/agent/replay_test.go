@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/gemini"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+type City struct {
+	City string `json:"city"`
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	mem := memoriser.NewInMemoryMemoriser()
+
+	runs := 0
+	weather := func(forecast string) tool.Tool[any, any] {
+		return tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+			runs++
+			return forecast, nil
+		})
+	}
+
+	// Record a session as production would have
+	recorder, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	recorder.Memoriser = mem
+	recorder.AddTool(weather("sunny"))
+	recorder.OpenAIMiddleware = []openai.Middleware{respond(
+		`{"status":"completed","output":[{"type":"function_call","call_id":"call_1","name":"weather","arguments":"{\"city\":\"Perth\"}"}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"It is sunny"}]}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"You're welcome"}]}]}`,
+	)}
+	for _, input := range []string{"weather in Perth?", "thanks"} {
+		if _, err := recorder.Call(ctx, AgentInput{Id: "id", UserInput: input}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+	}
+	recorded, _ := recorder.Snapshot(ctx, "id")
+
+	t.Run("replays with recorded tool outputs", func(t *testing.T) {
+		runs = 0
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = mem
+		a.AddTool(weather("snowing"))
+
+		report, err := a.Replay(ctx, "id", ReplayOptions{})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v with %+v", err, report.Mismatches)
+		}
+
+		if len(report.Outputs) != 2 || report.Outputs[0].Output != "It is sunny" {
+			t.Errorf("expected both turns to be replayed but got %+v", report.Outputs)
+		}
+		if len(report.ToolCalls) != 1 || string(report.ToolCalls[0].Arguments) != `{"city":"Perth"}` || runs != 0 {
+			t.Errorf("expected weather to be answered from the recording but got %+v after %d runs", report.ToolCalls, runs)
+		}
+
+		if after, _ := a.Snapshot(ctx, "id"); string(after) != string(recorded) {
+			t.Errorf("expected the stored session to be left alone but got %s", after)
+		}
+	})
+
+	t.Run("live tools are compared", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = mem
+		a.AddTool(weather("snowing"))
+
+		report, err := a.Replay(ctx, "id", ReplayOptions{LiveTools: true})
+		if !errors.Is(err, ErrReplayDiverged) {
+			t.Fatalf("expected ErrReplayDiverged but got %v", err)
+		}
+
+		if len(report.Mismatches) != 1 || report.Mismatches[0].Item != 2 {
+			t.Errorf("expected the tool output to differ but got %+v", report.Mismatches)
+		}
+	})
+
+	t.Run("missing tools diverge", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = mem
+
+		if _, err := a.Replay(ctx, "id", ReplayOptions{}); !errors.Is(err, ErrReplayDiverged) {
+			t.Errorf("expected ErrReplayDiverged but got %v", err)
+		}
+	})
+
+	t.Run("missing session", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = mem
+
+		if _, err := a.Replay(ctx, "missing", ReplayOptions{}); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound but got %v", err)
+		}
+	})
+
+	t.Run("gemini", func(t *testing.T) {
+		replies := []string{
+			`{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"weather","args":{"city":"Perth"}}}]}}]}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"It is sunny"}]}}]}`,
+		}
+
+		a, _ := NewAgent(model.GeminiAiModel("gemini-2.5-flash"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+		a.AddTool(weather("sunny"))
+		a.GeminiMiddleware = []gemini.Middleware{func(next gemini.Handler) gemini.Handler {
+			return func(ctx context.Context, body *gemini.RequestBody) (*gemini.ResponseBody, error) {
+				var resp gemini.ResponseBody
+				err := json.Unmarshal([]byte(replies[0]), &resp)
+				replies = replies[1:]
+				return &resp, err
+			}
+		}}
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "weather in Perth?"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		runs = 0
+		report, err := a.Replay(ctx, "id", ReplayOptions{})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v with %+v", err, report.Mismatches)
+		}
+		if len(report.Outputs) != 1 || report.Outputs[0].Output != "It is sunny" || runs != 0 {
+			t.Errorf("expected the turn to be replayed from the recording but got %+v", report.Outputs)
+		}
+	})
+}
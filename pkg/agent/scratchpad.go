@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Session metadata key the scratchpad's notes are kept under, as a json
+// array
+const ScratchpadMetadataKey = "scratchpad"
+
+const (
+	// Notes kept per session, the oldest are dropped past this
+	maxNotes = 50
+	// Longest note the model may write
+	maxNoteLength = 1000
+)
+
+// Notes returns what the model wrote to the session's scratchpad, oldest
+// first
+func (s *Session) Notes() []string {
+	var notes []string
+	if raw := s.Metadata[ScratchpadMetadataKey]; raw != "" {
+		json.Unmarshal([]byte(raw), &notes)
+	}
+
+	return notes
+}
+
+func (s *Session) setNotes(notes []string) {
+	data, _ := json.Marshal(notes)
+
+	if s.Metadata == nil {
+		s.Metadata = make(map[string]string)
+	}
+	s.Metadata[ScratchpadMetadataKey] = string(data)
+}
+
+// The session of the call tools are running in, guarded as tools may run at
+// the same time
+type scratchpad struct {
+	mux     sync.Mutex
+	session *Session
+}
+
+type scratchpadKey struct{}
+
+type writeNote struct {
+	Note string `json:"note" jsonschema:"description=What to remember such as a fact the user gave or a plan for later turns"`
+}
+
+type readNotes struct{}
+
+// EnableScratchpad gives the model write_note and read_notes tools, a
+// scratchpad kept in session metadata that lasts across turns. Notes don't
+// show up in replies and survive history being trimmed.
+func (a *Agent[T]) EnableScratchpad() error {
+	write := tool.CreateTool("write_note", func(ctx context.Context, in writeNote) (string, error) {
+		pad, ok := ctx.Value(scratchpadKey{}).(*scratchpad)
+		if !ok {
+			return "", errors.New("no scratchpad for this call")
+		}
+
+		note := strings.TrimSpace(in.Note)
+		if note == "" {
+			return "", errors.New("note is empty")
+		}
+		if len(note) > maxNoteLength {
+			return "", fmt.Errorf("note is %d characters, at most %d allowed", len(note), maxNoteLength)
+		}
+
+		pad.mux.Lock()
+		defer pad.mux.Unlock()
+
+		notes := append(pad.session.Notes(), note)
+		if len(notes) > maxNotes {
+			notes = notes[len(notes)-maxNotes:]
+		}
+		pad.session.setNotes(notes)
+
+		return fmt.Sprintf("saved, %d notes in the scratchpad", len(notes)), nil
+	}, tool.WithDescription("Writes a note to a private scratchpad kept for the whole conversation. Use it for anything worth remembering in later turns. The user does not see notes."))
+
+	read := tool.CreateTool("read_notes", func(ctx context.Context, in readNotes) ([]string, error) {
+		pad, ok := ctx.Value(scratchpadKey{}).(*scratchpad)
+		if !ok {
+			return nil, errors.New("no scratchpad for this call")
+		}
+
+		pad.mux.Lock()
+		defer pad.mux.Unlock()
+
+		return pad.session.Notes(), nil
+	}, tool.WithDescription("Reads every note written to the scratchpad so far, oldest first."))
+
+	for _, t := range []tool.Tool[any, any]{write, read} {
+		if err := a.AddTool(t); err != nil {
+			return err
+		}
+	}
+
+	a.scratchpad = true
+	return nil
+}
+
+// Lets the scratchpad tools reach the session, telling the model about any
+// notes it wrote earlier
+func (a *Agent[T]) withScratchpad(ctx context.Context, session *Session, instructions []string) (context.Context, []string) {
+	if !a.scratchpad {
+		return ctx, instructions
+	}
+
+	if notes := len(session.Notes()); notes > 0 {
+		instructions = append(instructions, fmt.Sprintf("Your scratchpad holds %d notes from earlier in the conversation, call read_notes to see them.", notes))
+	}
+
+	return context.WithValue(ctx, scratchpadKey{}, &scratchpad{session: session}), instructions
+}
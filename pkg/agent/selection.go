@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/calamity-m/clusterfuc/pkg/embed"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Picks the k tools most relevant to what the user said, so agents can have
+// more tools registered than are worth sending, or than providers accept, on
+// every turn
+type ToolSelector interface {
+	Select(ctx context.Context, input string, tools []tool.Tool[any, any], k int) ([]tool.Tool[any, any], error)
+}
+
+// Tools sent with a turn. Once more tools are registered than MaxTurnTools
+// and there is a ToolSelector, only the most relevant are sent, along with
+// any the tool choice names, in the order they were registered.
+func (a *Agent[T]) turnTools(ctx context.Context, input AgentInput) []tool.Tool[any, any] {
+	limit := a.MaxTurnTools
+	if limit <= 0 {
+		limit = model.MAX_TOOLS_COUMT
+	}
+
+	if a.ToolSelector == nil || len(a.tools) <= limit {
+		return a.tools
+	}
+
+	var named []string
+	if input.ToolChoice != nil {
+		named = input.ToolChoice.Tools
+	}
+
+	candidates := make([]tool.Tool[any, any], 0, len(a.tools))
+	for _, t := range a.tools {
+		if !slices.Contains(named, t.Name) {
+			candidates = append(candidates, t)
+		}
+	}
+
+	k := max(limit-len(named), 0)
+	selected, err := a.ToolSelector.Select(ctx, input.UserInput, candidates, k)
+	if err != nil {
+		slog.WarnContext(ctx, "tool selection failed, falling back to keywords", slog.Any("error", err))
+		selected, _ = KeywordSelector{}.Select(ctx, input.UserInput, candidates, k)
+	}
+
+	keep := make(map[string]bool, len(selected)+len(named))
+	for _, t := range selected {
+		keep[t.Name] = true
+	}
+	for _, name := range named {
+		keep[name] = true
+	}
+
+	tools := make([]tool.Tool[any, any], 0, len(keep))
+	for _, t := range a.tools {
+		if keep[t.Name] {
+			tools = append(tools, t)
+		}
+	}
+
+	slog.DebugContext(ctx, "selected tools for turn", slog.Int("registered", len(a.tools)), slog.Int("selected", len(tools)))
+
+	return tools
+}
+
+// Selects tools sharing the most words with the input, weighing rarer words
+// higher as BM25 does. Names, descriptions and parameters of tools are all
+// searched. Tools nothing matches are only picked to fill remaining room.
+type KeywordSelector struct{}
+
+func (KeywordSelector) Select(ctx context.Context, input string, tools []tool.Tool[any, any], k int) ([]tool.Tool[any, any], error) {
+	if len(tools) <= k {
+		return tools, nil
+	}
+
+	docs := make([]map[string]int, len(tools))
+	frequency := map[string]int{}
+	for i, t := range tools {
+		docs[i] = map[string]int{}
+		for _, word := range words(toolText(t)) {
+			if docs[i][word] == 0 {
+				frequency[word]++
+			}
+			docs[i][word]++
+		}
+	}
+
+	query := words(input)
+	scores := make([]float64, len(tools))
+	for i, doc := range docs {
+		for _, word := range query {
+			tf := float64(doc[word])
+			if tf == 0 {
+				continue
+			}
+
+			df := float64(frequency[word])
+			idf := math.Log(1 + (float64(len(tools))-df+0.5)/(df+0.5))
+			scores[i] += idf * tf / (tf + 1)
+		}
+	}
+
+	return top(tools, scores, k), nil
+}
+
+// Selects tools whose embedded names and descriptions are closest to the
+// embedded input. Tool embeddings are cached, so only the input is embedded
+// on most turns.
+type EmbeddingSelector struct {
+	Embedder embed.Embedder
+
+	mux     sync.Mutex
+	vectors map[string][]float32
+}
+
+func (s *EmbeddingSelector) Select(ctx context.Context, input string, tools []tool.Tool[any, any], k int) ([]tool.Tool[any, any], error) {
+	if len(tools) <= k {
+		return tools, nil
+	}
+
+	texts := make([]string, len(tools))
+	for i, t := range tools {
+		texts[i] = toolText(t)
+	}
+
+	vectors, err := s.embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := s.Embedder.Embed(ctx, []string{input})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed input - %w", err)
+	}
+	if len(query) != 1 {
+		return nil, fmt.Errorf("expected 1 input embedding but got %d", len(query))
+	}
+
+	scores := make([]float64, len(tools))
+	for i, vector := range vectors {
+		scores[i] = cosine(query[0], vector)
+	}
+
+	return top(tools, scores, k), nil
+}
+
+// Embeds tool texts, reusing those embedded before
+func (s *EmbeddingSelector) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	s.mux.Lock()
+	if s.vectors == nil {
+		s.vectors = make(map[string][]float32)
+	}
+
+	var missing []string
+	for _, text := range texts {
+		if _, ok := s.vectors[text]; !ok && !slices.Contains(missing, text) {
+			missing = append(missing, text)
+		}
+	}
+	s.mux.Unlock()
+
+	if len(missing) > 0 {
+		embedded, err := s.Embedder.Embed(ctx, missing)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed tools - %w", err)
+		}
+		if len(embedded) != len(missing) {
+			return nil, fmt.Errorf("expected %d tool embeddings but got %d", len(missing), len(embedded))
+		}
+
+		s.mux.Lock()
+		for i, text := range missing {
+			s.vectors[text] = embedded[i]
+		}
+		s.mux.Unlock()
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = s.vectors[text]
+	}
+
+	return vectors, nil
+}
+
+func NewEmbeddingSelector(embedder embed.Embedder) *EmbeddingSelector {
+	return &EmbeddingSelector{Embedder: embedder, vectors: make(map[string][]float32)}
+}
+
+// The k highest scoring tools, ties going to those registered first
+func top(tools []tool.Tool[any, any], scores []float64, k int) []tool.Tool[any, any] {
+	order := make([]int, len(tools))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+
+	selected := make([]tool.Tool[any, any], 0, k)
+	for _, i := range order[:min(k, len(order))] {
+		selected = append(selected, tools[i])
+	}
+
+	return selected
+}
+
+// What a tool is searched by, its name, description and parameters
+func toolText(t tool.Tool[any, any]) string {
+	params, _ := json.Marshal(t.Definition.Properties)
+
+	return strings.Join([]string{t.Name, t.Description, string(params)}, " ")
+}
+
+// Words of json schemas rather than of what a tool does
+var schemaWords = map[string]bool{
+	"type": true, "string": true, "object": true, "array": true, "integer": true,
+	"number": true, "boolean": true, "description": true, "properties": true,
+	"required": true, "items": true, "enum": true, "null": true,
+}
+
+// Lowercased words of text, splitting snake, kebab and camel case apart
+func words(text string) []string {
+	var out []string
+	var word []rune
+
+	flush := func() {
+		if len(word) > 1 && !schemaWords[string(word)] {
+			out = append(out, string(word))
+		}
+		word = word[:0]
+	}
+
+	var prev rune
+	for _, r := range text {
+		switch {
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			flush()
+			word = append(word, unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, unicode.ToLower(r))
+		default:
+			flush()
+		}
+		prev = r
+	}
+	flush()
+
+	return out
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
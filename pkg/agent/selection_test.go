@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+type Query struct {
+	Query string `json:"query"`
+}
+
+func describedTools(descriptions map[string]string) []tool.Tool[any, any] {
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var out []tool.Tool[any, any]
+	for _, name := range names {
+		out = append(out, tool.CreateTool(name, func(ctx context.Context, in Query) (string, error) { return name, nil }, tool.WithDescription(descriptions[name])))
+	}
+
+	return out
+}
+
+func toolNames(tools []tool.Tool[any, any]) []string {
+	var out []string
+	for _, t := range tools {
+		out = append(out, t.Name)
+	}
+
+	return out
+}
+
+// Embeds text as how often it mentions each of a few topics
+type topicEmbedder struct {
+	calls int
+}
+
+func (e *topicEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.calls++
+
+	topics := []string{"weather", "calendar", "email"}
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = make([]float32, len(topics))
+		for j, topic := range topics {
+			vectors[i][j] = float32(strings.Count(strings.ToLower(text), topic))
+		}
+	}
+
+	return vectors, nil
+}
+
+func TestToolSelection(t *testing.T) {
+	registered := describedTools(map[string]string{
+		"get_forecast":   "Gets the weather forecast for a city",
+		"send_email":     "Sends an email to a recipient",
+		"list_events":    "Lists calendar events for a day",
+		"create_event":   "Creates a calendar event",
+		"search_inbox":   "Searches email in the inbox",
+		"convert_units":  "Converts between units of measurement",
+		"translate_text": "Translates text between languages",
+	})
+
+	t.Run("keywords", func(t *testing.T) {
+		selected, err := KeywordSelector{}.Select(t.Context(), "what's the weather forecast in Perth?", registered, 2)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if got := toolNames(selected); len(got) != 2 || got[0] != "get_forecast" {
+			t.Errorf("expected get_forecast to be selected first but got %v", got)
+		}
+	})
+
+	t.Run("embeddings", func(t *testing.T) {
+		embedder := &topicEmbedder{}
+		selector := NewEmbeddingSelector(embedder)
+
+		for range 2 {
+			selected, err := selector.Select(t.Context(), "anything on my calendar tomorrow?", registered, 2)
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			got := toolNames(selected)
+			slices.Sort(got)
+			if !slices.Equal(got, []string{"create_event", "list_events"}) {
+				t.Errorf("expected calendar tools but got %v", got)
+			}
+		}
+
+		// Tools once, then the input of each turn
+		if embedder.calls != 3 {
+			t.Errorf("expected tool embeddings to be cached but embedded %d times", embedder.calls)
+		}
+	})
+
+	t.Run("agent sends selected tools", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.ToolSelector = KeywordSelector{}
+		a.MaxTurnTools = 3
+
+		for _, tl := range registered {
+			if err := a.AddTool(tl); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+		for i := range model.MAX_TOOLS_COUMT {
+			if err := a.AddTool(tool.CreateTool(fmt.Sprintf("extra_%d", i), func(ctx context.Context, in Query) (string, error) { return "", nil })); err != nil {
+				t.Fatalf("expected no tool limit with a selector but got %v", err)
+			}
+		}
+
+		var sent []string
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = nil
+				for _, t := range body.Tools {
+					sent = append(sent, t.Name)
+				}
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`)}
+
+		_, err := a.Call(t.Context(), AgentInput{
+			Id:         "id",
+			UserInput:  "email my calendar events to Sam",
+			ToolChoice: &ToolChoice{Mode: ToolChoiceAuto, Tools: []string{"translate_text"}},
+		})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !slices.Equal(sent, []string{"list_events", "send_email", "translate_text"}) {
+			t.Errorf("expected the 2 best tools plus the chosen one but got %v", sent)
+		}
+	})
+
+	t.Run("failed selection falls back to keywords", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.ToolSelector = failingSelector{}
+		a.MaxTurnTools = 1
+		for _, tl := range registered {
+			a.AddTool(tl)
+		}
+
+		got := toolNames(a.turnTools(t.Context(), AgentInput{UserInput: "translate this text"}))
+		if !slices.Equal(got, []string{"translate_text"}) {
+			t.Errorf("expected keyword fallback to pick translate_text but got %v", got)
+		}
+	})
+}
+
+type failingSelector struct{}
+
+func (failingSelector) Select(ctx context.Context, input string, tools []tool.Tool[any, any], k int) ([]tool.Tool[any, any], error) {
+	return nil, errors.New("embedder down")
+}
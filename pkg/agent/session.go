@@ -0,0 +1,526 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/serializer"
+)
+
+// Version of the session format written by this package
+const SessionVersion = 1
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrInvalidSnapshot    = errors.New("invalid snapshot")
+	ErrUnsupportedVersion = errors.New("unsupported session version")
+	ErrSessionLocked      = errors.New("session locked")
+)
+
+// Token usage reported by a provider
+type Usage struct {
+	InputTokens     int `json:"input_tokens,omitempty"`
+	OutputTokens    int `json:"output_tokens,omitempty"`
+	CachedTokens    int `json:"cached_tokens,omitempty"`
+	ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+	TotalTokens     int `json:"total_tokens,omitempty"`
+}
+
+// Add sums two usages together
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		InputTokens:     u.InputTokens + other.InputTokens,
+		OutputTokens:    u.OutputTokens + other.OutputTokens,
+		CachedTokens:    u.CachedTokens + other.CachedTokens,
+		ReasoningTokens: u.ReasoningTokens + other.ReasoningTokens,
+		TotalTokens:     u.TotalTokens + other.TotalTokens,
+	}
+}
+
+// Share of input tokens the provider read from its prompt cache, between 0
+// and 1
+func (u Usage) CacheRatio() float64 {
+	if u.InputTokens == 0 {
+		return 0
+	}
+
+	return float64(u.CachedTokens) / float64(u.InputTokens)
+}
+
+// Estimated cost of the usage in US dollars at m's list price in
+// model.Catalog, 0 for models missing from it
+func (u Usage) Cost(m model.AIModel) float64 {
+	info, ok := model.Lookup(m)
+	if !ok {
+		return 0
+	}
+
+	// Thinking is billed as output, which not every provider counts in
+	// OutputTokens, though all do in TotalTokens
+	output := max(u.OutputTokens, u.TotalTokens-u.InputTokens)
+	return info.Cost(u.InputTokens, output) - info.CacheSavings(u.CachedTokens)
+}
+
+// Everything stored about a conversation. This is what gets serialized and
+// handed to the Memoriser, and doubles as the snapshot format.
+type Session struct {
+	Version int `json:"version"`
+	// Model whose provider produced the history
+	Model string `json:"model,omitempty"`
+	// End user the session belongs to, used to honour privacy requests
+	EndUserID string `json:"end_user_id,omitempty"`
+	// Provider specific request body holding the conversation so far
+	History json.RawMessage `json:"history,omitempty"`
+	// Which provider's format History is in, so history left by a
+	// fallback is translated for the agent's own provider. Empty for
+	// sessions saved before formats were recorded.
+	Format string `json:"format,omitempty"`
+	// Version of the history format, the Agent.HistoryVersion it was saved
+	// by. Older history is migrated when loaded, see Agent.Migrations.
+	HistoryVersion int `json:"history_version,omitempty"`
+	// Metadata accumulated from every call in the session
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Number of completed calls in the session
+	Turns int `json:"turns,omitempty"`
+	// When the session's first and latest calls were saved
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+	// Tokens used across the whole session
+	Usage Usage `json:"usage,omitzero"`
+	// Prompt tokens the provider counted for the session's last request,
+	// and how many history items they covered, calibrating history trimming
+	PromptTokens int `json:"prompt_tokens,omitempty"`
+	PromptItems  int `json:"prompt_items,omitempty"`
+	// Reply streamed by a turn that never finished, such as one cut short
+	// by a crash, which the next turn tells the model about. Nil once a
+	// turn completes.
+	Partial *PartialTurn `json:"partial,omitempty"`
+
+	// Number of history items already in the Memoriser's log
+	logged int
+	// Whether the next save must replace the log, as the session was loaded
+	// from somewhere other than it
+	rewrite bool
+}
+
+// A change to a session, appended to the log of Memorisers that are
+// memoriser.Appenders. The latest entry's session fields win, while items
+// are added to the history.
+type sessionEntry struct {
+	Session
+	// Provider history items added since the previous entry
+	Items []json.RawMessage `json:"items,omitempty"`
+	// Replaces every item before this entry rather than adding to them
+	Replace bool `json:"replace,omitempty"`
+}
+
+// Snapshot returns a portable copy of a session, suitable for backups or
+// moving sessions between Memorisers. The snapshot is plain json regardless
+// of the agent's Serializer.
+func (a *Agent[T]) Snapshot(ctx context.Context, id string) (json.RawMessage, error) {
+	if a.Memoriser == nil {
+		return nil, fmt.Errorf("use NoOpMemoriser if no memory is wanted - %w", ErrNilMemoriser)
+	}
+
+	session, err := a.load(ctx, a.Memoriser, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Turns == 0 && len(session.History) == 0 {
+		return nil, fmt.Errorf("%s - %w", id, ErrSessionNotFound)
+	}
+
+	return json.Marshal(session)
+}
+
+// Restore replaces a session with one previously taken by Snapshot
+func (a *Agent[T]) Restore(ctx context.Context, id string, snapshot json.RawMessage) error {
+	if a.Memoriser == nil {
+		return fmt.Errorf("use NoOpMemoriser if no memory is wanted - %w", ErrNilMemoriser)
+	}
+
+	var session Session
+	if err := json.Unmarshal(snapshot, &session); err != nil {
+		return fmt.Errorf("%w - %w", ErrInvalidSnapshot, err)
+	}
+
+	if session.Version < 1 || session.Version > SessionVersion {
+		return fmt.Errorf("snapshot version %d - %w", session.Version, ErrUnsupportedVersion)
+	}
+
+	unlock, err := a.lock(ctx, "", id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return a.store(a.Memoriser, id, &session)
+}
+
+// Used by agents not made through NewAgent
+var processLocks memoriser.LocalLocker
+
+// Holds a session until the returned func is called, so calls for it take
+// turns rather than clobbering each other's saves. Waiting that outlasts ctx
+// fails with ErrSessionLocked.
+func (a *Agent[T]) lock(ctx context.Context, namespace string, id string) (func(), error) {
+	key := namespace + "/" + id
+
+	locks := a.locks
+	if locks == nil {
+		locks = &processLocks
+	}
+
+	unlock, err := locks.Lock(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("waiting on %s - %w", id, errors.Join(ErrSessionLocked, err))
+	}
+
+	if a.Locker == nil {
+		return unlock, nil
+	}
+
+	shared, err := a.Locker.Lock(ctx, key)
+	if err != nil {
+		unlock()
+		return nil, fmt.Errorf("waiting on %s - %w", id, errors.Join(ErrSessionLocked, err))
+	}
+
+	return func() {
+		shared()
+		unlock()
+	}, nil
+}
+
+// Picks the Memoriser holding a namespace's sessions, with an empty namespace
+// being the agent's Memoriser itself
+func (a *Agent[T]) memoriser(namespace string) (memoriser.Memoriser, error) {
+	if namespace == "" {
+		return a.Memoriser, nil
+	}
+
+	namespaced, ok := a.Memoriser.(memoriser.NamespacedMemoriser)
+	if !ok {
+		return nil, fmt.Errorf("cannot use namespace %s - %w", namespace, memoriser.ErrNamespacesUnsupported)
+	}
+
+	return namespaced.Namespace(namespace)
+}
+
+func (a *Agent[T]) serializer() serializer.Serializer {
+	if a.Serializer == nil {
+		return serializer.JSONSerializer{}
+	}
+
+	return a.Serializer
+}
+
+// Retrieves and deserializes the session of a conversation, starting a new
+// one if nothing is stored
+func (a *Agent[T]) load(ctx context.Context, mem memoriser.Memoriser, id string) (*Session, error) {
+	session, err := a.loadStored(ctx, mem, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.migrate(ctx, id, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Retrieves a session however the Memoriser stored it
+func (a *Agent[T]) loadStored(ctx context.Context, mem memoriser.Memoriser, id string) (*Session, error) {
+	log, ok := mem.(memoriser.Appender)
+	if !ok {
+		return a.loadSaved(ctx, mem, id)
+	}
+
+	session, err := a.loadLog(ctx, log, id)
+	if err != nil || session != nil {
+		return session, err
+	}
+
+	// Without a log the session may have been saved whole before the
+	// Memoriser supported logs, in which case the log has to start afresh
+	session, err = a.loadSaved(ctx, mem, id)
+	if err != nil {
+		return nil, err
+	}
+	session.rewrite = len(session.History) > 0
+
+	return session, nil
+}
+
+// Folds a session's log back into a session, returning nil when there is no log
+func (a *Agent[T]) loadLog(ctx context.Context, log memoriser.Appender, id string) (*Session, error) {
+	entries, err := log.Entries(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve session log - %w", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	var session Session
+	var items []json.RawMessage
+	for _, stored := range entries {
+		data, err := a.serializer().Deserialize(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize session entry - %w", err)
+		}
+
+		var entry sessionEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode session entry - %w", err)
+		}
+
+		if entry.Version > SessionVersion {
+			return nil, fmt.Errorf("session version %d - %w", entry.Version, ErrUnsupportedVersion)
+		}
+
+		if entry.Replace {
+			items = nil
+		}
+		items = append(items, entry.Items...)
+		session = entry.Session
+	}
+
+	session.History, err = a.historyBody(items)
+	if err != nil {
+		return nil, err
+	}
+	session.logged = len(items)
+
+	a.debug(ctx, DebugHistory, id, string(session.History))
+
+	return &session, nil
+}
+
+// Retrieves a session saved whole
+func (a *Agent[T]) loadSaved(ctx context.Context, mem memoriser.Memoriser, id string) (*Session, error) {
+	stored, err := mem.Retrieve(id)
+	if err != nil || len(stored) == 0 {
+		slog.InfoContext(ctx, "received request with no prior history")
+		return &Session{Version: SessionVersion}, nil
+	}
+
+	data, err := a.serializer().Deserialize(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deserialize history - %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode session - %w", err)
+	}
+
+	// Sessions saved before the session format existed were just the
+	// provider body
+	if session.Version == 0 {
+		session = Session{Version: SessionVersion, History: data}
+	}
+
+	if session.Version > SessionVersion {
+		return nil, fmt.Errorf("session version %d - %w", session.Version, ErrUnsupportedVersion)
+	}
+
+	a.debug(ctx, DebugHistory, id, string(session.History))
+
+	return &session, nil
+}
+
+// Records the outcome of a call in the session and saves it. Failures are
+// logged rather than failing the call, as the model has already replied.
+func (a *Agent[T]) save(ctx context.Context, mem memoriser.Memoriser, input AgentInput, session *Session, body Body, usage Usage) {
+	session.Model = a.Model.Model()
+	session.HistoryVersion = a.HistoryVersion
+	session.EndUserID = input.endUser()
+	session.Turns++
+	session.UpdatedAt = time.Now().UTC()
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = session.UpdatedAt
+	}
+	session.Usage = session.Usage.Add(usage)
+	session.Partial = nil
+	_, session.PromptItems, _ = body.Items(math.MaxInt)
+	if len(input.Metadata) > 0 {
+		if session.Metadata == nil {
+			session.Metadata = make(map[string]string, len(input.Metadata))
+		}
+		maps.Copy(session.Metadata, input.Metadata)
+	}
+
+	if log, ok := mem.(memoriser.Appender); ok {
+		if err := a.append(log, input.Id, session, body); err != nil {
+			slog.ErrorContext(ctx, "failed to append to session log", slog.Any("error", err), slog.String("model", a.Model.Model()))
+		}
+		return
+	}
+
+	history, err := json.Marshal(body)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to parse body into state", slog.Any("error", err), slog.String("model", a.Model.Model()))
+		return
+	}
+	session.History = history
+
+	if err := a.store(mem, input.Id, session); err != nil {
+		slog.ErrorContext(ctx, "failed to save updated state", slog.Any("error", err), slog.String("model", a.Model.Model()))
+	}
+}
+
+// Saves a session as it stood before the turn, along with the reply the
+// turn has streamed so far, see Session.Partial
+func (a *Agent[T]) savePartial(mem memoriser.Memoriser, id string, session *Session, partial *PartialTurn) error {
+	saved := *session
+	saved.Partial = partial
+
+	// Sessions whose log no longer matches their history, or that have no
+	// log yet, are saved whole, as an entry of nothing but the partial
+	// reply would leave the history out
+	log, ok := mem.(memoriser.Appender)
+	if !ok || session.rewrite {
+		if err := a.store(mem, id, &saved); err != nil {
+			return err
+		}
+		if ok {
+			items, _ := splitHistory(session.History)
+			session.logged, session.rewrite = len(items), false
+		}
+		return nil
+	}
+
+	entry := sessionEntry{Session: saved}
+	entry.History = nil
+	return a.appendEntry(log, id, entry)
+}
+
+// Appends the history items a call added to the session log, encoding only
+// those rather than the whole history
+func (a *Agent[T]) append(log memoriser.Appender, id string, session *Session, body Body) error {
+	replace := session.rewrite
+	from := session.logged
+	if replace {
+		from = 0
+	}
+
+	added, total, err := body.Items(from)
+	if err != nil {
+		return err
+	}
+
+	// Anything that removed earlier history, rather than adding to it,
+	// means the log has to start over
+	if total < from {
+		replace = true
+		added, total, err = body.Items(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	entry := sessionEntry{Session: *session, Items: added, Replace: replace}
+	entry.History = nil
+	if err := a.appendEntry(log, id, entry); err != nil {
+		return err
+	}
+
+	session.logged = total
+	session.rewrite = false
+
+	return nil
+}
+
+func (a *Agent[T]) appendEntry(log memoriser.Appender, id string, entry sessionEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode session entry - %w", err)
+	}
+
+	stored, err := a.serializer().Serialize(data)
+	if err != nil {
+		return fmt.Errorf("failed to serialize session entry - %w", err)
+	}
+
+	return log.Append(id, stored)
+}
+
+// Splits stored provider history into its items
+func splitHistory(history json.RawMessage) ([]json.RawMessage, error) {
+	if len(history) == 0 {
+		return nil, nil
+	}
+
+	var body struct {
+		Input    []json.RawMessage `json:"input"`
+		Contents []json.RawMessage `json:"contents"`
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(history, &body); err != nil {
+		return nil, fmt.Errorf("failed to decode history - %w", err)
+	}
+
+	if len(body.Contents) > 0 {
+		return body.Contents, nil
+	}
+	if len(body.Messages) > 0 {
+		return body.Messages, nil
+	}
+
+	return body.Input, nil
+}
+
+// Builds a provider body holding just the history items, which is all a
+// body needs to continue the conversation
+func (a *Agent[T]) historyBody(items []json.RawMessage) (json.RawMessage, error) {
+	p, err := a.provider(AgentInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	return p.History(items)
+}
+
+// Serializes a session and hands it to the Memoriser. Logs are replaced
+// with a single entry holding the whole session.
+func (a *Agent[T]) store(mem memoriser.Memoriser, id string, session *Session) error {
+	if log, ok := mem.(memoriser.Appender); ok {
+		items, err := splitHistory(session.History)
+		if err != nil {
+			return err
+		}
+
+		entry := sessionEntry{Session: *session, Items: items, Replace: true}
+		entry.History = nil
+
+		return a.appendEntry(log, id, entry)
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode session - %w", err)
+	}
+
+	stored, err := a.serializer().Serialize(data)
+	if err != nil {
+		return fmt.Errorf("failed to serialize session - %w", err)
+	}
+
+	if ok := mem.Save(id, stored); !ok {
+		return fmt.Errorf("memoriser failed to save session %s", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,415 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("restore then snapshot round trips", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+
+		snapshot := json.RawMessage(`{"version":1,"model":"gpt-4o-mini","history":{"input":[]},"metadata":{"tenant":"a"},"turns":2,"usage":{"total_tokens":10}}`)
+		if err := a.Restore(ctx, "id", snapshot); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		taken, err := a.Snapshot(ctx, "id")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var session Session
+		json.Unmarshal(taken, &session)
+		if session.Turns != 2 || session.Usage.TotalTokens != 10 || session.Metadata["tenant"] != "a" {
+			t.Errorf("unexpected session %#v", session)
+		}
+	})
+
+	t.Run("legacy history becomes a session", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		m := memoriser.NewInMemoryMemoriser()
+		m.Save("id", json.RawMessage(`{"input":[],"model":"gpt-4o-mini"}`))
+		a.Memoriser = m
+
+		taken, err := a.Snapshot(ctx, "id")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var session Session
+		json.Unmarshal(taken, &session)
+		if session.Version != SessionVersion || string(session.History) != `{"input":[],"model":"gpt-4o-mini"}` {
+			t.Errorf("expected legacy body to be kept as history but got %s", taken)
+		}
+	})
+
+	t.Run("missing session", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+
+		if _, err := a.Snapshot(ctx, "missing"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound but got %v", err)
+		}
+	})
+
+	t.Run("future versions are rejected", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+
+		if err := a.Restore(ctx, "id", json.RawMessage(`{"version":99}`)); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("expected ErrUnsupportedVersion but got %v", err)
+		}
+	})
+}
+
+func TestUserPrivacy(t *testing.T) {
+	ctx := context.Background()
+
+	ns := memoriser.NewPrefixNamespacer(memoriser.NewInMemoryMemoriser(), nil)
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = ns
+
+	tenant, _ := ns.Namespace("tenant")
+	tenant.Save("first", json.RawMessage(`{"version":1,"end_user_id":"user"}`))
+	tenant.Save("other", json.RawMessage(`{"version":1,"end_user_id":"someone"}`))
+	ns.Save("user", json.RawMessage(`{"input":[]}`))
+
+	export, err := a.ExportAllForUser(ctx, "user", "tenant")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if len(export.Sessions["tenant"]) != 1 || len(export.Sessions[""]) != 1 {
+		t.Errorf("expected a session in each namespace but got %#v", export.Sessions)
+	}
+
+	if err := a.DeleteAllForUser(ctx, "user", "tenant"); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if _, err := tenant.Retrieve("first"); err == nil {
+		t.Errorf("expected user session to be deleted")
+	}
+
+	if _, err := ns.Retrieve("user"); err == nil {
+		t.Errorf("expected legacy user session to be deleted")
+	}
+
+	if _, err := tenant.Retrieve("other"); err != nil {
+		t.Errorf("expected other user's session to survive but got %v", err)
+	}
+}
+
+func TestSessionLog(t *testing.T) {
+	ctx := context.Background()
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	m := memoriser.NewInMemoryMemoriser()
+	a.Memoriser = m
+
+	message := func(text string) json.RawMessage {
+		item, _ := json.Marshal(openai.Message{BaseItem: openai.BaseItem{Type: "message"}, Role: "user", Content: []openai.MessageContent{{Type: "input_text", Text: text}}})
+		return item
+	}
+
+	input := AgentInput{Id: "id", UserInput: "hi"}
+	for turn := 1; turn <= 2; turn++ {
+		session, err := a.load(ctx, m, "id")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		body := openai.CreateResponse{}
+		json.Unmarshal(session.History, &body)
+		body.Input = append(body.Input, message("question"), message("answer"))
+
+		a.save(ctx, m, input, session, &openaiBody{CreateResponse: &body, deferred: -1}, Usage{TotalTokens: 1})
+	}
+
+	entries, _ := m.Entries("id")
+	if len(entries) != 2 {
+		t.Fatalf("expected an entry per turn but got %d", len(entries))
+	}
+
+	var second sessionEntry
+	json.Unmarshal(entries[1], &second)
+	if len(second.Items) != 2 || second.Replace {
+		t.Errorf("expected only the new items to be appended but got %#v", second)
+	}
+
+	session, err := a.load(ctx, m, "id")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	var body openai.CreateResponse
+	json.Unmarshal(session.History, &body)
+	if len(body.Input) != 4 || session.Turns != 2 || session.Usage.TotalTokens != 2 {
+		t.Errorf("unexpected session %#v", session)
+	}
+}
+
+func TestHistoryIntegrity(t *testing.T) {
+	ctx := context.Background()
+
+	// The second item has been mangled into something that isn't an item
+	corrupt := []byte(`{"version":1,"model":"gpt-4o-mini","metadata":{"tenant":"a"},"turns":1,"history":{"input":[
+		{"type":"message","role":"user","content":[{"type":"input_text","text":"hi"}]},
+		"garbage",
+		{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hello"}]}
+	]}}`)
+
+	call := func(t *testing.T, recovery HistoryRecovery, stored []byte) ([]json.RawMessage, error) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		m := memoriser.NewInMemoryMemoriser()
+		m.Save("id", stored)
+		a.Memoriser = m
+		a.HistoryRecovery = recovery
+
+		var sent []json.RawMessage
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = body.Input
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"again"}]}]}`)}
+
+		_, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "still there?"})
+		return sent, err
+	}
+
+	t.Run("repair drops corrupt items", func(t *testing.T) {
+		sent, err := call(t, RecoverRepair, corrupt)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(sent) != 3 {
+			t.Errorf("expected both good items and the new input but got %d items", len(sent))
+		}
+	})
+
+	t.Run("reset starts afresh", func(t *testing.T) {
+		sent, err := call(t, RecoverReset, corrupt)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(sent) != 1 {
+			t.Errorf("expected just the new input but got %d items", len(sent))
+		}
+	})
+
+	t.Run("fail keeps failing", func(t *testing.T) {
+		if _, err := call(t, RecoverFail, corrupt); !errors.Is(err, ErrCorruptHistory) {
+			t.Errorf("expected ErrCorruptHistory but got %v", err)
+		}
+	})
+
+	t.Run("undecodable sessions are reset", func(t *testing.T) {
+		sent, err := call(t, RecoverRepair, []byte(`{"version":1,"history":`))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(sent) != 1 {
+			t.Errorf("expected just the new input but got %d items", len(sent))
+		}
+	})
+
+	t.Run("recovered history is saved", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		m := memoriser.NewInMemoryMemoriser()
+		m.Save("id", corrupt)
+		a.Memoriser = m
+		a.OpenAIMiddleware = []openai.Middleware{respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"again"}]}]}`)}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "still there?"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		taken, err := a.Snapshot(ctx, "id")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var session Session
+		json.Unmarshal(taken, &session)
+		if session.Turns != 2 || session.Metadata["tenant"] != "a" || strings.Contains(string(session.History), "garbage") {
+			t.Errorf("expected repaired session to be saved but got %s", taken)
+		}
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	stored := json.RawMessage(`{"version":1,"model":"gpt-4o-mini","turns":1,"history":{"input":[
+		{"type":"message","role":"user","content":[{"type":"input_text","text":"hi"}]}
+	]}}`)
+
+	agent := func(t *testing.T, version int, migrations map[int]Migration) *Agent[model.AIModel] {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = memoriser.NewInMemoryMemoriser()
+		a.HistoryVersion = version
+		a.Migrations = migrations
+		if err := a.Restore(ctx, "id", stored); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		return a
+	}
+
+	t.Run("migrates a version at a time", func(t *testing.T) {
+		var ran []int
+		a := agent(t, 2, map[int]Migration{
+			0: func(ctx context.Context, session *Session) error {
+				ran = append(ran, session.HistoryVersion)
+				session.Metadata = map[string]string{"migrated": "yes"}
+				return nil
+			},
+			1: func(ctx context.Context, session *Session) error {
+				ran = append(ran, session.HistoryVersion)
+				return DropHistory(ctx, session)
+			},
+		})
+
+		var sent int
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = len(body.Input)
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hello"}]}]}`)}
+
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi again"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !slices.Equal(ran, []int{0, 1}) || sent != 1 {
+			t.Errorf("expected both migrations to run and history to be dropped but ran %v and sent %d items", ran, sent)
+		}
+
+		taken, err := a.Snapshot(ctx, "id")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var session Session
+		json.Unmarshal(taken, &session)
+		if session.HistoryVersion != 2 || session.Metadata["migrated"] != "yes" || session.Turns != 2 {
+			t.Errorf("expected the migrated session to be saved but got %s", taken)
+		}
+		if len(ran) != 2 {
+			t.Errorf("expected saved session to need no further migration but ran %v", ran)
+		}
+	})
+
+	t.Run("missing migration", func(t *testing.T) {
+		a := agent(t, 1, nil)
+		if _, err := a.Snapshot(ctx, "id"); !errors.Is(err, ErrMissingMigration) {
+			t.Errorf("expected ErrMissingMigration but got %v", err)
+		}
+	})
+
+	t.Run("failed migration", func(t *testing.T) {
+		a := agent(t, 1, map[int]Migration{
+			0: func(ctx context.Context, session *Session) error { return errors.New("boom") },
+		})
+		if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hi again"}); !errors.Is(err, ErrMigrationFailed) {
+			t.Errorf("expected ErrMigrationFailed but got %v", err)
+		}
+	})
+
+	t.Run("newer history is rejected", func(t *testing.T) {
+		a := agent(t, 0, nil)
+		a.Restore(ctx, "id", json.RawMessage(`{"version":1,"history_version":3,"turns":1}`))
+		if _, err := a.Snapshot(ctx, "id"); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("expected ErrUnsupportedVersion but got %v", err)
+		}
+	})
+}
+
+type recordingLocker struct {
+	mux  sync.Mutex
+	keys []string
+}
+
+func (l *recordingLocker) Lock(ctx context.Context, id string) (func(), error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.keys = append(l.keys, id)
+	return func() {}, nil
+}
+
+func TestSessionLocking(t *testing.T) {
+	ctx := context.Background()
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	locker := &recordingLocker{}
+	a.Locker = locker
+	a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			time.Sleep(10 * time.Millisecond)
+
+			var resp openai.Response
+			err := json.Unmarshal([]byte(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hi"}]}]}`), &resp)
+			return &resp, err
+		}
+	}}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.Call(ctx, AgentInput{Id: "id", UserInput: "hello"}); err != nil {
+				t.Errorf("did not expect err but got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	taken, err := a.Snapshot(ctx, "id")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	var session Session
+	json.Unmarshal(taken, &session)
+	items, _ := splitHistory(session.History)
+	if session.Turns != 3 || len(items) != 6 {
+		t.Errorf("expected every turn to be kept but got %d turns with %d items", session.Turns, len(items))
+	}
+
+	if !slices.Equal(locker.keys, []string{"/id", "/id", "/id"}) {
+		t.Errorf("expected the shared locker to be used for every call but got %v", locker.keys)
+	}
+
+	t.Run("waiting ends with ctx", func(t *testing.T) {
+		unlock, err := a.lock(ctx, "", "busy")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		defer unlock()
+
+		waiting, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		if _, err := a.Call(waiting, AgentInput{Id: "busy", UserInput: "hello"}); !errors.Is(err, ErrSessionLocked) {
+			t.Errorf("expected ErrSessionLocked but got %v", err)
+		}
+	})
+}
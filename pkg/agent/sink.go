@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Where a runner such as RunBatch writes each result as it finishes, so
+// pipelines can stream results out rather than collecting them afterwards
+type Sink interface {
+	Write(ctx context.Context, record SinkRecord) error
+}
+
+// Adapts a function to a Sink
+type SinkFunc func(ctx context.Context, record SinkRecord) error
+
+func (f SinkFunc) Write(ctx context.Context, record SinkRecord) error {
+	return f(ctx, record)
+}
+
+// One input's result, as written to a Sink
+type SinkRecord struct {
+	// Position of the input in the batch
+	Index int    `json:"index"`
+	Id    string `json:"id,omitempty"`
+	// Text of the input
+	Input  string `json:"input"`
+	Output string `json:"output,omitempty"`
+	// Why the input failed, empty when it didn't
+	Error    string  `json:"error,omitempty"`
+	Attempts int     `json:"attempts"`
+	Usage    Usage   `json:"usage,omitzero"`
+	Cost     float64 `json:"cost,omitempty"`
+}
+
+func newSinkRecord(input AgentInput, item BatchItem) SinkRecord {
+	text := input.UserInput
+	if len(input.Items) > 0 {
+		text = input.itemsText()
+	}
+
+	record := SinkRecord{
+		Index:    item.Index,
+		Id:       input.Id,
+		Input:    text,
+		Output:   item.Output.Output,
+		Attempts: item.Attempts,
+		Usage:    item.Output.Usage,
+		Cost:     item.Output.Cost,
+	}
+	if item.Err != nil {
+		record.Error = item.Err.Error()
+	}
+
+	return record
+}
+
+// Columns of a record in csv and sql sinks, in the order they're written
+var SinkColumns = []string{"index", "id", "input", "output", "error", "attempts", "input_tokens", "output_tokens", "total_tokens", "cost"}
+
+func (r SinkRecord) values() []any {
+	return []any{r.Index, r.Id, r.Input, r.Output, r.Error, r.Attempts, r.Usage.InputTokens, r.Usage.OutputTokens, r.Usage.TotalTokens, r.Cost}
+}
+
+type jsonlSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONLSink writes each record as a line of json to w
+func NewJSONLSink(w io.Writer) Sink {
+	return &jsonlSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *jsonlSink) Write(ctx context.Context, record SinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.encoder.Encode(record)
+}
+
+type csvSink struct {
+	mu     sync.Mutex
+	writer *csv.Writer
+	header bool
+}
+
+// NewCSVSink writes each record as a row of csv to w, under a header of
+// SinkColumns. Rows are flushed as they're written.
+func NewCSVSink(w io.Writer) Sink {
+	return &csvSink{writer: csv.NewWriter(w)}
+}
+
+func (s *csvSink) Write(ctx context.Context, record SinkRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.header {
+		if err := s.writer.Write(SinkColumns); err != nil {
+			return err
+		}
+		s.header = true
+	}
+
+	row := make([]string, 0, len(SinkColumns))
+	for _, value := range record.values() {
+		switch v := value.(type) {
+		case string:
+			row = append(row, v)
+		case int:
+			row = append(row, strconv.Itoa(v))
+		case float64:
+			row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	if err := s.writer.Write(row); err != nil {
+		return err
+	}
+
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+type sqlSink struct {
+	db    *sql.DB
+	query string
+}
+
+// NewSQLSink inserts each record into a database with query, which takes
+// the record's SinkColumns as arguments in order. Placeholders differ
+// between drivers, e.g. for postgres:
+//
+//	INSERT INTO enriched (idx, id, input, output, error, attempts, input_tokens, output_tokens, total_tokens, cost)
+//	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+func NewSQLSink(db *sql.DB, query string) Sink {
+	return &sqlSink{db: db, query: query}
+}
+
+func (s *sqlSink) Write(ctx context.Context, record SinkRecord) error {
+	_, err := s.db.ExecContext(ctx, s.query, record.values()...)
+	return err
+}
+
+type channelSink chan<- SinkRecord
+
+// NewChannelSink sends each record on ch, waiting for it to be received or
+// the run to end
+func NewChannelSink(ch chan<- SinkRecord) Sink {
+	return channelSink(ch)
+}
+
+func (s channelSink) Write(ctx context.Context, record SinkRecord) error {
+	select {
+	case s <- record:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+// Records the arguments of every statement executed
+type recordingDriver struct {
+	mu    sync.Mutex
+	query string
+	args  [][]driver.Value
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{d: c.d, query: query}, nil
+}
+func (c recordingConn) Close() error              { return nil }
+func (c recordingConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.query = s.query
+	s.d.args = append(s.d.args, args)
+	return driver.RowsAffected(1), nil
+}
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("no queries")
+}
+
+var recorded = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", recorded)
+}
+
+func TestSinks(t *testing.T) {
+	ctx := context.Background()
+	records := []SinkRecord{
+		{Index: 0, Input: "a", Output: "enriched, \"a\"", Attempts: 1, Usage: Usage{InputTokens: 10, OutputTokens: 2, TotalTokens: 12}, Cost: 0.000015},
+		{Index: 1, Id: "row-2", Input: "b", Error: "bad input", Attempts: 3},
+	}
+
+	t.Run("jsonl", func(t *testing.T) {
+		var out bytes.Buffer
+		sink := NewJSONLSink(&out)
+		for _, record := range records {
+			if err := sink.Write(ctx, record); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected a line per record but got %q", out.String())
+		}
+		var decoded SinkRecord
+		if err := json.Unmarshal([]byte(lines[1]), &decoded); err != nil || decoded.Id != "row-2" || decoded.Error != "bad input" {
+			t.Errorf("expected the second record but got %+v, %v", decoded, err)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		var out bytes.Buffer
+		sink := NewCSVSink(&out)
+		for _, record := range records {
+			if err := sink.Write(ctx, record); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		expected := "index,id,input,output,error,attempts,input_tokens,output_tokens,total_tokens,cost\n" +
+			"0,,a,\"enriched, \"\"a\"\"\",,1,10,2,12,0.000015\n" +
+			"1,row-2,b,,bad input,3,0,0,0,0\n"
+		if out.String() != expected {
+			t.Errorf("expected %q but got %q", expected, out.String())
+		}
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		recorded.args = nil
+		db, err := sql.Open("recording", "")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		defer db.Close()
+
+		query := "INSERT INTO enriched VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		sink := NewSQLSink(db, query)
+		if err := sink.Write(ctx, records[0]); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if recorded.query != query || len(recorded.args) != 1 || len(recorded.args[0]) != len(SinkColumns) {
+			t.Fatalf("expected the record inserted but got %q with %v", recorded.query, recorded.args)
+		}
+		if args := recorded.args[0]; args[2] != "a" || args[8] != int64(12) || args[9] != 0.000015 {
+			t.Errorf("expected the record's columns in order but got %v", args)
+		}
+	})
+
+	t.Run("channel", func(t *testing.T) {
+		ch := make(chan SinkRecord, 1)
+		sink := NewChannelSink(ch)
+		if err := sink.Write(ctx, records[0]); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if got := <-ch; got.Output != records[0].Output {
+			t.Errorf("expected the record sent but got %+v", got)
+		}
+
+		// Nothing receives the second record
+		cancelled, cancel := context.WithCancel(ctx)
+		ch <- records[0]
+		cancel()
+		if err := sink.Write(cancelled, records[1]); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled but got %v", err)
+		}
+	})
+}
+
+func TestRunBatchSink(t *testing.T) {
+	ctx := context.Background()
+	reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`
+
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			var resp openai.Response
+			err := json.Unmarshal([]byte(reply), &resp)
+			return &resp, err
+		}
+	}}
+
+	inputs := []AgentInput{{UserInput: "a"}, {Items: []InputItem{TextItem("b")}}, {UserInput: "c"}}
+
+	t.Run("every result written", func(t *testing.T) {
+		var written []SinkRecord
+		sink := SinkFunc(func(ctx context.Context, record SinkRecord) error {
+			written = append(written, record)
+			return nil
+		})
+
+		if _, err := RunBatch(ctx, a, inputs, BatchOptions{Concurrency: 2, Sink: sink}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(written) != 3 {
+			t.Fatalf("expected 3 records but got %+v", written)
+		}
+		for _, record := range written {
+			if record.Output != "done" || record.Input != inputs[record.Index].UserInput+inputs[record.Index].itemsText() {
+				t.Errorf("expected the input and its output but got %+v", record)
+			}
+		}
+	})
+
+	t.Run("failing sink", func(t *testing.T) {
+		full := errors.New("disk full")
+		writes := 0
+		sink := SinkFunc(func(ctx context.Context, record SinkRecord) error {
+			writes++
+			return full
+		})
+
+		_, err := RunBatch(ctx, a, inputs, BatchOptions{Concurrency: 1, Sink: sink})
+		if !errors.Is(err, full) {
+			t.Errorf("expected the sink's error but got %v", err)
+		}
+		if writes != 1 {
+			t.Errorf("expected writing to stop after failing but got %d writes", writes)
+		}
+	})
+}
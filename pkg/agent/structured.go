@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// A subset of json schema, enough to check what providers are able to
+// constrain output with. Unknown keywords are ignored.
+type outputSchema struct {
+	Type       any                     `json:"type"`
+	Properties map[string]outputSchema `json:"properties"`
+	Required   []string                `json:"required"`
+	Items      *outputSchema           `json:"items"`
+	Enum       []any                   `json:"enum"`
+	AnyOf      []outputSchema          `json:"anyOf"`
+}
+
+// Ensures output matches the schema, returning the output with any repairs
+// applied. When the output can't be repaired the model is re-asked once,
+// with the validation error, through reask.
+func (a *Agent[T]) structured(ctx context.Context, schema json.RawMessage, output string, reask func(prompt string) (string, error)) (string, error) {
+	var s outputSchema
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return output, fmt.Errorf("failed to decode schema - %w", err)
+	}
+
+	// Top level schemas for gemini only carry properties
+	if s.Type == nil && s.Properties != nil {
+		s.Type = "object"
+	}
+
+	repaired, err := s.repair(output)
+	if err == nil {
+		return repaired, nil
+	}
+
+	slog.WarnContext(ctx, "model output did not match schema, re-asking", slog.Any("error", err))
+
+	output, rerr := reask(fmt.Sprintf("Your previous response was invalid: %v. Respond again with only JSON matching the requested schema.", err))
+	if rerr != nil {
+		return "", rerr
+	}
+
+	repaired, err = s.repair(output)
+	if err != nil {
+		return output, fmt.Errorf("%v - %w", err, ErrInvalidStructuredOutput)
+	}
+
+	return repaired, nil
+}
+
+// Asks for output matching schema, for providers unable to constrain it
+func schemaInstruction(schema json.RawMessage) string {
+	return "Respond with only JSON matching this schema:\n" + string(schema)
+}
+
+// ExtractAs pulls a T out of text with a one off call, see Agent.Complete.
+// The schema the model answers with is inferred from T like a tool's input,
+// so T must be a struct.
+func ExtractAs[T any, M model.AIModel](ctx context.Context, a *Agent[M], text string) (T, error) {
+	var extracted T
+	if t := reflect.TypeFor[T](); t.Kind() != reflect.Struct {
+		return extracted, fmt.Errorf("can't extract %s, only structs - %w", t, ErrInvalidStructuredOutput)
+	}
+
+	definition := tool.Reflect[T]()
+	schema, err := json.Marshal(map[string]any{
+		"type":                 "object",
+		"properties":           definition.Properties,
+		"required":             definition.Required,
+		"additionalProperties": false,
+	})
+	if err != nil {
+		return extracted, fmt.Errorf("failed to encode schema - %w", err)
+	}
+
+	output, err := a.Complete(ctx, AgentInput{
+		UserInput:    text,
+		Schema:       schema,
+		Instructions: []string{extractInstruction},
+	})
+	if err != nil {
+		return extracted, err
+	}
+
+	if err := json.Unmarshal([]byte(output.Output), &extracted); err != nil {
+		return extracted, fmt.Errorf("failed to decode extraction - %w", err)
+	}
+
+	return extracted, nil
+}
+
+const extractInstruction = "Extract the fields of the requested schema from the user's message. Use empty values for anything it doesn't state, rather than guessing."
+
+// The label Classify chose for some text
+type Classification struct {
+	Label string
+	// How sure the model is of the label, between 0 and 1. Measured as
+	// GenerationOptions.Confidence asks when it's set, otherwise as the
+	// model rated itself.
+	Confidence float64
+}
+
+// Classify labels text with one of labels using a one off call, see
+// Agent.Complete, such as to route or moderate it. The label is held to
+// labels by the schema's enum, or for providers unable to constrain output
+// by checking the output and asking again.
+func Classify[M model.AIModel](ctx context.Context, a *Agent[M], text string, labels []string) (Classification, error) {
+	if len(labels) == 0 {
+		return Classification{}, fmt.Errorf("nothing to classify with - %w", ErrInvalidLabels)
+	}
+	for i, label := range labels {
+		if label == "" || slices.Contains(labels[:i], label) {
+			return Classification{}, fmt.Errorf("label %q is empty or repeated - %w", label, ErrInvalidLabels)
+		}
+	}
+
+	schema, err := json.Marshal(map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"label":      map[string]any{"type": "string", "enum": labels},
+			"confidence": map[string]any{"type": "number"},
+		},
+		"required":             []string{"label", "confidence"},
+		"additionalProperties": false,
+	})
+	if err != nil {
+		return Classification{}, fmt.Errorf("failed to encode schema - %w", err)
+	}
+
+	// Listed in the instructions as well, for the providers only asked for
+	// the schema
+	listed, err := json.Marshal(labels)
+	if err != nil {
+		return Classification{}, fmt.Errorf("failed to encode labels - %w", err)
+	}
+
+	output, err := a.Complete(ctx, AgentInput{
+		UserInput:    text,
+		Schema:       schema,
+		Instructions: []string{fmt.Sprintf(classifyInstruction, listed)},
+	})
+	if err != nil {
+		return Classification{}, err
+	}
+
+	var classified struct {
+		Label      string  `json:"label"`
+		Confidence float64 `json:"confidence"`
+	}
+	if err := json.Unmarshal([]byte(output.Output), &classified); err != nil {
+		return Classification{}, fmt.Errorf("failed to decode classification - %w", err)
+	}
+
+	confidence := classified.Confidence
+	if output.Confidence != nil {
+		confidence = *output.Confidence
+	}
+
+	return Classification{Label: classified.Label, Confidence: min(max(confidence, 0), 1)}, nil
+}
+
+const classifyInstruction = "Classify the user's message with exactly one of these labels: %s. Rate your confidence in the label from 0 (a guess) to 1 (certain)."
+
+// Validates output, falling back to validating a repaired copy of it
+func (s outputSchema) repair(output string) (string, error) {
+	err := s.validate(output)
+	if err == nil {
+		return output, nil
+	}
+
+	repaired := repairJSON(output)
+	if s.validate(repaired) != nil {
+		return "", err
+	}
+
+	return repaired, nil
+}
+
+func (s outputSchema) validate(output string) error {
+	var value any
+	if err := json.Unmarshal([]byte(output), &value); err != nil {
+		return fmt.Errorf("not valid json: %v", err)
+	}
+
+	return s.check("$", value)
+}
+
+func (s outputSchema) check(path string, value any) error {
+	if len(s.AnyOf) > 0 {
+		for _, variant := range s.AnyOf {
+			if variant.check(path, value) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s matches none of the allowed schemas", path)
+	}
+
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+		return fmt.Errorf("%s must be one of %v", path, s.Enum)
+	}
+
+	var types []string
+	switch t := s.Type.(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, v := range t {
+			if str, ok := v.(string); ok {
+				types = append(types, str)
+			}
+		}
+	}
+
+	if len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return isType(strings.ToLower(t), value) }) {
+		return fmt.Errorf("%s must be of type %s", path, strings.Join(types, " or "))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				return fmt.Errorf("%s is missing required property %s", path, key)
+			}
+		}
+
+		for key, prop := range s.Properties {
+			if field, ok := v[key]; ok {
+				if err := prop.check(path+"."+key, field); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.check(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func isType(typ string, value any) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		return typ == "object"
+	case []any:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case float64:
+		return typ == "number" || (typ == "integer" && v == float64(int64(v)))
+	case nil:
+		return typ == "null"
+	}
+
+	return false
+}
+
+// Unwraps output from a markdown code fence, trimming surrounding space
+func stripFences(output string) string {
+	output = strings.TrimSpace(output)
+
+	if strings.HasPrefix(output, "```") {
+		output = strings.TrimPrefix(output, "```")
+		// Drop the language tag, e.g. ```json
+		if i := strings.IndexByte(output, '\n'); i >= 0 {
+			output = output[i+1:]
+		}
+		output = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(output), "```"))
+	}
+
+	return output
+}
+
+// Fixes the usual ways models mangle json, wrapping it in markdown code
+// fences and leaving trailing commas
+func repairJSON(output string) string {
+	output = stripFences(output)
+
+	var b strings.Builder
+	inString, escaped := false, false
+	for i := 0; i < len(output); i++ {
+		c := output[i]
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			b.WriteByte(c)
+			continue
+		}
+
+		if c == '"' {
+			inString = true
+		}
+
+		if c == ',' {
+			// Skip the comma when the next significant character closes
+			// an object or array
+			rest := strings.TrimLeft(output[i+1:], " \t\r\n")
+			if strings.HasPrefix(rest, "}") || strings.HasPrefix(rest, "]") {
+				continue
+			}
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/quota"
+)
+
+func TestStructuredOutput(t *testing.T) {
+	ctx := context.Background()
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	schema := json.RawMessage(`{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer"}},"required":["name"]}`)
+
+	noReask := func(prompt string) (string, error) {
+		t.Errorf("did not expect a re-ask but got %q", prompt)
+		return "", nil
+	}
+
+	t.Run("repairs fences and trailing commas", func(t *testing.T) {
+		out, err := a.structured(ctx, schema, "```json\n{\"name\": \"bob\", \"tags\": [\"a,\",],}\n```", noReask)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if out != `{"name": "bob", "tags": ["a,"]}` {
+			t.Errorf("unexpected repaired output %s", out)
+		}
+	})
+
+	t.Run("re-asks with the validation error", func(t *testing.T) {
+		asked := ""
+		out, err := a.structured(ctx, schema, `{"age": 3}`, func(prompt string) (string, error) {
+			asked = prompt
+			return `{"name":"bob","age":3}`, nil
+		})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if out != `{"name":"bob","age":3}` {
+			t.Errorf("expected re-asked output but got %s", out)
+		}
+
+		if asked == "" {
+			t.Errorf("expected a re-ask")
+		}
+	})
+
+	t.Run("fails after one re-ask", func(t *testing.T) {
+		asks := 0
+		_, err := a.structured(ctx, schema, `{"name": 1}`, func(prompt string) (string, error) {
+			asks++
+			return `{"name": 1.5}`, nil
+		})
+		if !errors.Is(err, ErrInvalidStructuredOutput) {
+			t.Errorf("expected ErrInvalidStructuredOutput but got %v", err)
+		}
+
+		if asks != 1 {
+			t.Errorf("expected a single re-ask but got %d", asks)
+		}
+	})
+}
+
+// Counts the keys a quota has charged
+type keyStore struct {
+	quota.Store
+	keys map[string]bool
+}
+
+func (s *keyStore) Add(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Time, error) {
+	s.keys[key] = true
+	return s.Store.Add(ctx, key, n, window)
+}
+
+func TestCompleteQuota(t *testing.T) {
+	ctx := context.Background()
+	reply := `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`
+
+	store := &keyStore{Store: quota.NewInMemoryStore(), keys: map[string]bool{}}
+	a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.OpenAIMiddleware = []openai.Middleware{respond(reply, reply, reply)}
+	a.Quota = quota.NewUserQuota(quota.Limits{RequestsPerDay: 1}, store)
+
+	if _, err := a.Complete(ctx, AgentInput{UserInput: "first"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if _, err := a.Complete(ctx, AgentInput{UserInput: "second"}); !errors.Is(err, quota.ErrQuotaExceeded) {
+		t.Errorf("expected anonymous one offs to share a quota but got %v", err)
+	}
+	if _, err := a.Complete(ctx, AgentInput{UserInput: "third", EndUserID: "bob"}); err != nil {
+		t.Errorf("expected bob to have a quota of their own but got %v", err)
+	}
+
+	if len(store.keys) != 2 {
+		t.Errorf("expected a key for the anonymous one offs and for bob but got %v", store.keys)
+	}
+}
+
+func TestExtractAs(t *testing.T) {
+	type invoice struct {
+		Number string  `json:"number"`
+		Total  float64 `json:"total"`
+	}
+
+	t.Run("extracts", func(t *testing.T) {
+		var sent *openai.CreateResponse
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = body
+				return next(ctx, body)
+			}
+		}, respond(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"{\"number\":\"INV-7\",\"total\":12.5}"}]}]}`)}
+
+		got, err := ExtractAs[invoice](context.Background(), a, "Invoice INV-7 comes to $12.50")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if got != (invoice{Number: "INV-7", Total: 12.5}) {
+			t.Errorf("expected the invoice but got %+v", got)
+		}
+
+		var schema struct {
+			Properties map[string]any `json:"properties"`
+			Required   []string       `json:"required"`
+		}
+		json.Unmarshal(sent.Text.Schema, &schema)
+		if len(schema.Properties) != 2 || len(schema.Required) != 2 {
+			t.Errorf("expected the schema inferred from the struct but got %s", sent.Text.Schema)
+		}
+	})
+
+	t.Run("only structs", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+
+		if _, err := ExtractAs[[]string](context.Background(), a, "a, b"); !errors.Is(err, ErrInvalidStructuredOutput) {
+			t.Errorf("expected ErrInvalidStructuredOutput but got %v", err)
+		}
+	})
+}
+
+func TestClassify(t *testing.T) {
+	ctx := context.Background()
+	labels := []string{"spam", "ham"}
+	reply := func(text string) string {
+		encoded, _ := json.Marshal(text)
+		return `{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":` + string(encoded) + `}]}]}`
+	}
+
+	t.Run("enum schema", func(t *testing.T) {
+		var sent *openai.CreateResponse
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				sent = body
+				return next(ctx, body)
+			}
+		}, respond(reply(`{"label":"spam","confidence":0.9}`))}
+
+		got, err := Classify(ctx, a, "WIN A FREE CRUISE", labels)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if got != (Classification{Label: "spam", Confidence: 0.9}) {
+			t.Errorf("expected spam but got %+v", got)
+		}
+		if !strings.Contains(string(sent.Text.Schema), `"enum":["spam","ham"]`) {
+			t.Errorf("expected the labels as an enum but got %s", sent.Text.Schema)
+		}
+	})
+
+	t.Run("provider without schemas", func(t *testing.T) {
+		var prompts []string
+		a, _ := NewAgent(model.DeepSeekModel("deepseek-chat"))
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				prompts = append(prompts, body.Instructions)
+				return next(ctx, body)
+			}
+		}, respond(reply(`{"label":"eggs","confidence":2}`), reply(`{"label":"ham","confidence":2}`))}
+
+		got, err := Classify(ctx, a, "lunch at noon?", labels)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if got != (Classification{Label: "ham", Confidence: 1}) {
+			t.Errorf("expected ham once re-asked, with confidence capped, but got %+v", got)
+		}
+		if !strings.Contains(prompts[0], `["spam","ham"]`) {
+			t.Errorf("expected the labels listed in the instructions but got %q", prompts[0])
+		}
+	})
+
+	t.Run("invalid labels", func(t *testing.T) {
+		a, _ := NewAgent(model.OpenAiModel("gpt-4o-mini"))
+
+		for _, invalid := range [][]string{nil, {"spam", ""}, {"spam", "spam"}} {
+			if _, err := Classify(ctx, a, "hi", invalid); !errors.Is(err, ErrInvalidLabels) {
+				t.Errorf("expected ErrInvalidLabels for %q but got %v", invalid, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+)
+
+const summaryPrompt = `You summarise conversations between a user and an AI assistant for whoever picks them up next, which may be a person or another agent. Be brief and factual, and only include what the conversation actually contains.`
+
+const summarySchema = `{
+	"type": "object",
+	"properties": {
+		"overview": {"type": "string", "description": "A few sentences on what the conversation was about and where it ended up"},
+		"topics": {"type": "array", "items": {"type": "string"}},
+		"decisions": {"type": "array", "items": {"type": "string"}},
+		"action_items": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"properties": {
+					"task": {"type": "string"},
+					"owner": {"type": "string", "description": "Who is to do it, user or assistant, empty when unclear"}
+				},
+				"required": ["task", "owner"],
+				"additionalProperties": false
+			}
+		}
+	},
+	"required": ["overview", "topics", "decisions", "action_items"],
+	"additionalProperties": false
+}`
+
+// A structured summary of a session, for handing it to a person or another
+// agent
+type Summary struct {
+	Overview    string       `json:"overview"`
+	Topics      []string     `json:"topics"`
+	Decisions   []string     `json:"decisions"`
+	ActionItems []ActionItem `json:"action_items"`
+	// Tokens spent summarising
+	Usage Usage `json:"-"`
+}
+
+type ActionItem struct {
+	Task string `json:"task"`
+	// Who is to do it, empty when unclear
+	Owner string `json:"owner"`
+}
+
+type SummarizeOptions struct {
+	// Model producing the summary, defaults to the agent's. It must be
+	// served by the same provider, as it shares the agent's credentials.
+	Model model.AIModel
+	// Namespace the session is stored in
+	Namespace string
+	// Optional extra guidance, such as what the reader cares about
+	Instructions string
+}
+
+// SummarizeSession summarises a stored session without changing it. The
+// summary is produced by a separate call that has no tools and keeps no
+// history.
+func (a *Agent[T]) SummarizeSession(ctx context.Context, id string, opts SummarizeOptions) (Summary, error) {
+	mem, err := a.memoriser(opts.Namespace)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	session, err := a.load(ctx, mem, id)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	items, err := splitHistory(session.History)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	text := transcript(items)
+	if text == "" {
+		return Summary{}, fmt.Errorf("%s - %w", id, ErrSessionNotFound)
+	}
+
+	// The summariser shares the agent's configuration, but none of what
+	// ties it to the session or its tools
+	summarizer := Agent[model.AIModel]{
+		Memoriser:        &memoriser.NoOpMemoriser{},
+		Client:           a.Client,
+		SystemPrompt:     summaryPrompt,
+		Model:            a.Model,
+		Auth:             a.Auth,
+		Keys:             a.Keys,
+		Signer:           a.Signer,
+		OpenAIMiddleware: a.OpenAIMiddleware,
+		GeminiMiddleware: a.GeminiMiddleware,
+		CompressRequests: a.CompressRequests,
+		MaxResponseBytes: a.MaxResponseBytes,
+		MaxRequestBytes:  a.MaxRequestBytes,
+		RequestTimeout:   a.RequestTimeout,
+		RequestAttempts:  a.RequestAttempts,
+	}
+	if opts.Model != nil {
+		summarizer.Model = opts.Model
+	}
+
+	input := AgentInput{
+		Id:        "summary:" + id,
+		UserInput: "Summarise this conversation.\n\n" + text,
+		Schema:    json.RawMessage(summarySchema),
+		EndUserID: session.EndUserID,
+	}
+	if opts.Instructions != "" {
+		input.Instructions = []string{opts.Instructions}
+	}
+
+	output, err := summarizer.Call(ctx, input)
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to summarise session %s - %w", id, err)
+	}
+
+	var summary Summary
+	if err := json.Unmarshal([]byte(output.Output), &summary); err != nil {
+		return Summary{}, fmt.Errorf("failed to decode summary - %w", err)
+	}
+	summary.Usage = output.Usage
+
+	return summary, nil
+}
+
+// Renders provider history items as plain text, one line per message, tool
+// call or tool result
+func transcript(items []json.RawMessage) string {
+	var lines []string
+
+	for _, raw := range items {
+		var item struct {
+			// openai
+			Type      string          `json:"type"`
+			Role      string          `json:"role"`
+			Content   json.RawMessage `json:"content"`
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+			Output    json.RawMessage `json:"output"`
+			// gemini
+			Parts []struct {
+				Text         string `json:"text"`
+				Thought      bool   `json:"thought"`
+				FunctionCall *struct {
+					Name string          `json:"name"`
+					Args json.RawMessage `json:"args"`
+				} `json:"functionCall"`
+				FunctionResponse *struct {
+					Name     string          `json:"name"`
+					Response json.RawMessage `json:"response"`
+				} `json:"functionResponse"`
+			} `json:"parts"`
+		}
+		if json.Unmarshal(raw, &item) != nil {
+			continue
+		}
+
+		role := item.Role
+		if role == "model" {
+			role = "assistant"
+		}
+
+		switch {
+		case item.Type == "function_call":
+			lines = append(lines, fmt.Sprintf("tool call: %s(%s)", item.Name, plain(item.Arguments)))
+		case item.Type == "function_call_output":
+			lines = append(lines, "tool result: "+plain(item.Output))
+		case len(item.Parts) > 0:
+			for _, part := range item.Parts {
+				switch {
+				case part.FunctionCall != nil:
+					lines = append(lines, fmt.Sprintf("tool call: %s(%s)", part.FunctionCall.Name, part.FunctionCall.Args))
+				case part.FunctionResponse != nil:
+					lines = append(lines, fmt.Sprintf("tool result: %s", part.FunctionResponse.Response))
+				case part.Text != "" && !part.Thought:
+					lines = append(lines, role+": "+part.Text)
+				}
+			}
+		case role != "":
+			if text := messageText(item.Content); text != "" {
+				lines = append(lines, role+": "+text)
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Text of an openai message's content, which is either a string or a list
+// of content parts
+func messageText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(content, &parts) != nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, part := range parts {
+		sb.WriteString(part.Text)
+	}
+
+	return sb.String()
+}
+
+// Unwraps json that is itself a string, as openai encodes arguments and
+// outputs
+func plain(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+
+	return string(raw)
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// Bytes per token assumed until a provider has counted a session's tokens
+const bytesPerToken = 4
+
+// Tokens history is trimmed to, MaxHistoryTokens or otherwise what fits in
+// the model's context window alongside the longest output it may reply with
+func (a *Agent[T]) historyLimit(caps Capabilities) int {
+	if a.MaxHistoryTokens > 0 || caps.ContextWindow == 0 {
+		return a.MaxHistoryTokens
+	}
+
+	output := a.Generation.MaxOutputTokens
+	if output == 0 {
+		output = caps.MaxOutputTokens
+	}
+
+	return caps.ContextWindow - output
+}
+
+// Drops the oldest turns of a session's history until it is estimated to fit
+// within limit tokens. Estimates are scaled by the tokens the provider
+// counted for the session's last request, so they track the real tokenizer
+// rather than drifting over long conversations. The latest turn is always
+// kept.
+func (a *Agent[T]) trimHistory(ctx context.Context, session *Session, limit int) error {
+	if limit <= 0 || len(session.History) == 0 {
+		return nil
+	}
+
+	items, err := splitHistory(session.History)
+	if err != nil {
+		return err
+	}
+
+	sizes := make([]int, len(items))
+	total := 0
+	for i, item := range items {
+		sizes[i] = len(item)
+		total += len(item)
+	}
+
+	rate := 1.0 / bytesPerToken
+	if counted := min(session.PromptItems, len(items)); session.PromptTokens > 0 && counted > 0 {
+		bytes := 0
+		for _, size := range sizes[:counted] {
+			bytes += size
+		}
+		rate = float64(session.PromptTokens) / float64(bytes)
+	}
+
+	estimate := func(bytes int) int { return int(float64(bytes) * rate) }
+	if estimate(total) <= limit {
+		return nil
+	}
+
+	// Drop whole turns, as a turn cut part way through can leave tool
+	// outputs without their calls
+	cut := 0
+	for i := 1; i < len(items); i++ {
+		total -= sizes[i-1]
+		if !a.turnStart(items[i]) {
+			continue
+		}
+
+		cut = i
+		if estimate(total) <= limit {
+			break
+		}
+	}
+	if cut == 0 {
+		return nil
+	}
+
+	slog.InfoContext(ctx, "trimming history to fit token limit", slog.Int("dropped", cut), slog.Int("kept", len(items)-cut))
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(session.History, &body); err != nil {
+		return fmt.Errorf("failed to decode history - %w", err)
+	}
+
+	key := "input"
+	for _, k := range []string{"contents", "messages"} {
+		if _, ok := body[k]; ok {
+			key = k
+		}
+	}
+
+	body[key], err = json.Marshal(items[cut:])
+	if err != nil {
+		return fmt.Errorf("failed to encode trimmed history - %w", err)
+	}
+
+	session.History, err = json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode trimmed history - %w", err)
+	}
+
+	// The log no longer matches, so it has to start over
+	session.rewrite = true
+	session.PromptItems = max(session.PromptItems-cut, 0)
+
+	return nil
+}
+
+// Whether a history item is a user message starting a turn, rather than part
+// of a turn such as a tool output
+func (a *Agent[T]) turnStart(item json.RawMessage) bool {
+	p, err := a.provider(AgentInput{})
+	if err != nil {
+		return false
+	}
+
+	return p.TurnStart(item)
+}
@@ -0,0 +1,588 @@
+package cohere
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+const baseURL = "https://api.cohere.com/v2"
+
+type FunctionCall struct {
+	Name string `json:"name"`
+	// A JSON string of the arguments
+	Arguments string `json:"arguments"`
+}
+
+type ToolCall struct {
+	ID string `json:"id"`
+	// Always function
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+type Message struct {
+	// One of system, user, assistant or tool
+	Role string `json:"role"`
+	// Text of the message. Replies come back as content items, but are
+	// kept and sent back as plain text.
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// What the model said it would do with the tool calls it made
+	ToolPlan string `json:"tool_plan,omitempty"`
+	// The call a tool message holds the output of
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+type FunctionDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters"`
+}
+
+type Tool struct {
+	// Always function
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// A source the model grounds its reply on, citing it by id
+type Document struct {
+	// Generated by cohere when empty
+	ID string `json:"id,omitempty"`
+	// Fields of the document, e.g. title and text
+	Data map[string]any `json:"data"`
+}
+
+type ResponseFormat struct {
+	// Always json_object
+	Type       string          `json:"type"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+}
+
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Tools    []Tool    `json:"tools,omitempty"`
+	// See ToolChoice
+	ToolChoice     string          `json:"tool_choice,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	P              *float64        `json:"p,omitempty"`
+	// Most tokens to generate, 0 for the model default
+	MaxTokens        int      `json:"max_tokens,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	StopSequences    []string `json:"stop_sequences,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	// Streaming is not supported, so this is always sent as false
+	Stream bool `json:"stream"`
+	// Instructions sent as a leading system message. Kept out of messages
+	// so they are rebuilt every call rather than stored in history.
+	System []string `json:"-"`
+	// Sources the model grounds its reply on and cites. Like System, they
+	// are sent with every request but not stored in history.
+	Documents []Document `json:"-"`
+}
+
+// ToolChoice builds a tool_choice value. Mode is one of `auto`, `none` or
+// `required`. Cohere can't force or restrict the model to particular tools,
+// so names are ignored, and auto leaves the choice unset.
+func ToolChoice(mode string, names ...string) (string, error) {
+	switch mode {
+	case "auto":
+		return "", nil
+	case "none":
+		return "NONE", nil
+	case "required":
+		return "REQUIRED", nil
+	}
+
+	return "", fmt.Errorf("unknown tool choice mode %q", mode)
+}
+
+// AppendSystemInstruction adds another instruction after the system prompt.
+// Empty text is ignored.
+func (b *ChatRequest) AppendSystemInstruction(text string) {
+	if text == "" {
+		return
+	}
+
+	b.System = append(b.System, text)
+}
+
+// AppendUserInput adds a user message to the end of the conversation
+func (b *ChatRequest) AppendUserInput(text string) {
+	b.Messages = append(b.Messages, Message{Role: "user", Content: text})
+}
+
+// CompactToolOutputs replaces the content of every tool message with the
+// result of fn, letting bulky tool results be shrunk once the model has seen
+// them
+func (b *ChatRequest) CompactToolOutputs(fn func(output string) string) {
+	for i, message := range b.Messages {
+		if message.Role == "tool" {
+			b.Messages[i].Content = fn(message.Content)
+		}
+	}
+}
+
+// SetTools offers tools to the model, replacing those the body held, and
+// reports how they changed
+func (b *ChatRequest) SetTools(tools []tool.Tool[any, any]) tool.Changes {
+	offered := definitions(tools)
+	changes := tool.Diff(b.Tools, offered, func(t Tool) string { return t.Function.Name })
+	b.Tools = offered
+
+	return changes
+}
+
+// The request as sent, with the system instructions leading the messages
+// and the documents alongside them
+func (b ChatRequest) wire() ([]byte, error) {
+	if len(b.System) > 0 {
+		system := Message{Role: "system", Content: strings.Join(b.System, "\n\n")}
+		b.Messages = append([]Message{system}, b.Messages...)
+	}
+	// Cohere rejects a tool choice when no tools are offered
+	if len(b.Tools) == 0 {
+		b.ToolChoice = ""
+	}
+	b.Stream = false
+
+	type request ChatRequest
+	return json.Marshal(struct {
+		request
+		Documents []Document `json:"documents,omitempty"`
+	}{request(b), b.Documents})
+}
+
+type Content struct {
+	// Always text
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Where a citation's text came from
+type Source struct {
+	// Either document or tool
+	Type string `json:"type"`
+	// Id of the document, or of the tool call whose output was cited
+	ID string `json:"id,omitempty"`
+}
+
+// A span of the reply grounded on documents or tool outputs
+type Citation struct {
+	// Offsets of the cited span in the reply's text
+	Start   int      `json:"start"`
+	End     int      `json:"end"`
+	Text    string   `json:"text"`
+	Sources []Source `json:"sources,omitempty"`
+}
+
+type ResponseMessage struct {
+	Role      string     `json:"role"`
+	Content   []Content  `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	ToolPlan  string     `json:"tool_plan,omitempty"`
+	Citations []Citation `json:"citations,omitempty"`
+}
+
+// The reply as a message to keep in history
+func (m ResponseMessage) message() Message {
+	var text strings.Builder
+	for _, content := range m.Content {
+		text.WriteString(content.Text)
+	}
+
+	return Message{Role: "assistant", Content: text.String(), ToolCalls: m.ToolCalls, ToolPlan: m.ToolPlan}
+}
+
+type Tokens struct {
+	InputTokens  int `json:"input_tokens,omitempty"`
+	OutputTokens int `json:"output_tokens,omitempty"`
+}
+
+type Usage struct {
+	// Tokens billed for, which leave out those of cohere's own prompting
+	BilledUnits Tokens `json:"billed_units,omitzero"`
+	// Tokens the model actually saw and generated
+	Tokens Tokens `json:"tokens,omitzero"`
+}
+
+// Add sums two usages together
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		BilledUnits: Tokens{
+			InputTokens:  u.BilledUnits.InputTokens + other.BilledUnits.InputTokens,
+			OutputTokens: u.BilledUnits.OutputTokens + other.BilledUnits.OutputTokens,
+		},
+		Tokens: Tokens{
+			InputTokens:  u.Tokens.InputTokens + other.Tokens.InputTokens,
+			OutputTokens: u.Tokens.OutputTokens + other.Tokens.OutputTokens,
+		},
+	}
+}
+
+type ChatResponse struct {
+	ID      string          `json:"id,omitempty"`
+	Message ResponseMessage `json:"message"`
+	// Why generation stopped, one of COMPLETE, STOP_SEQUENCE, MAX_TOKENS,
+	// TOOL_CALL or ERROR
+	FinishReason string `json:"finish_reason,omitempty"`
+	Usage        Usage  `json:"usage,omitzero"`
+}
+
+// The outcome of a generation
+type Result struct {
+	// Text the model replied with
+	Text string
+	// Spans of the final reply grounded on documents or tool outputs
+	Citations []Citation
+	// Tokens used across every request made for the generation
+	Usage Usage
+	// Why the final reply stopped, e.g. COMPLETE or MAX_TOKENS
+	FinishReason string
+	// Prompt tokens of the final request, the size of the whole conversation
+	// as the model last saw it
+	PromptTokens int
+}
+
+// Whether the reply was cut short by ChatRequest.MaxTokens
+func (r Result) Truncated() bool {
+	return r.FinishReason == "MAX_TOKENS"
+}
+
+// Returned when cohere replies with anything but 200
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("cohere error %d: %s", e.StatusCode, e.Message)
+}
+
+// Parses the error cohere describes in a failed response body, keeping the
+// raw body when it isn't one
+func newAPIError(status int, body []byte) *APIError {
+	var payload struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Message != "" {
+		return &APIError{StatusCode: status, Message: payload.Message}
+	}
+
+	return &APIError{StatusCode: status, Message: string(body)}
+}
+
+type Cohere struct {
+	client  *http.Client
+	auth    string
+	baseURL string
+	// Wraps every chat request, see Middleware
+	Middleware []Middleware
+	// Optionally signs every request, for gateways that require it
+	Signer signer.Signer
+	// Optional pool of keys used instead of auth, see keypool.Pool
+	Keys *keypool.Pool
+	// Gzip large request bodies, such as those carrying many tool schemas
+	Compress bool
+	// Requests larger than this, before any compression, fail with
+	// httpclient.ErrRequestTooLarge rather than being sent. 0 allows any
+	// size.
+	MaxRequestBytes int64
+	// Responses larger than this fail with httpclient.ErrResponseTooLarge.
+	// Defaults to httpclient.DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+	// Limits each http round trip to cohere, 0 for none. Unlike a deadline
+	// on the call's context, a round trip that times out is retried.
+	RequestTimeout time.Duration
+	// Attempts at a round trip that times out, defaults to 1
+	RequestAttempts int
+	// Called when the model calls a tool that isn't registered. The model
+	// is told the tool is unknown either way.
+	OnUnknownTool func(ctx context.Context, name string)
+	// Called once a registered tool the model called has run, with the
+	// arguments the model gave, how long it ran and any error it returned
+	OnToolCall func(ctx context.Context, name string, args any, elapsed time.Duration, err error)
+}
+
+func (c *Cohere) Body(model string, userInput string, prompt string, history json.RawMessage, schema json.RawMessage) (*ChatRequest, error) {
+	if userInput == "" {
+		return nil, errors.New("empty user input is weird")
+	}
+
+	var body ChatRequest
+	if len(history) > 0 {
+		if err := json.Unmarshal(history, &body); err != nil {
+			return nil, err
+		}
+	}
+
+	body.Model = model
+	body.AppendSystemInstruction(prompt)
+	body.AppendUserInput(userInput)
+
+	body.ResponseFormat = nil
+	if len(schema) > 0 {
+		if !json.Valid(schema) {
+			return nil, errors.New("invalid schema supplied, could not decode it")
+		}
+		body.ResponseFormat = &ResponseFormat{Type: "json_object", JSONSchema: schema}
+	}
+
+	return &body, nil
+}
+
+func (c *Cohere) Generate(ctx context.Context, body *ChatRequest, tools []tool.Tool[any, any]) (*ChatRequest, Result, error) {
+	slog.DebugContext(ctx, "cohere agent called", slog.String("model", body.Model))
+
+	// Tools are offered afresh every request, as those stored with history
+	// may have changed since
+	offered := len(body.Tools) > 0
+	if changes := body.SetTools(tools); offered && !changes.Empty() {
+		slog.DebugContext(ctx, "tools changed since the last request", slog.Any("changes", changes))
+	}
+
+	reply := Result{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, Result{}, err
+		}
+
+		resp, err := c.handler()(ctx, body)
+		if err != nil {
+			return nil, Result{}, err
+		}
+
+		reply.Usage = reply.Usage.Add(resp.Usage)
+		reply.PromptTokens = resp.Usage.Tokens.InputTokens
+		reply.FinishReason = resp.FinishReason
+
+		message := resp.Message.message()
+		body.Messages = append(body.Messages, message)
+
+		if len(message.ToolCalls) == 0 {
+			reply.Text = message.Content
+			reply.Citations = resp.Message.Citations
+			return body, reply, nil
+		}
+
+		for _, call := range message.ToolCalls {
+			body.Messages = append(body.Messages, Message{
+				Role:       "tool",
+				Content:    c.execute(ctx, call.Function, tools),
+				ToolCallID: call.ID,
+			})
+		}
+
+		// A required tool choice has been honoured, requiring it again would
+		// loop forever
+		body.ToolChoice = ""
+	}
+}
+
+// Runs the tool a call names, describing any failure, including the model
+// calling a tool that doesn't exist, in the output so the model can carry on
+func (c *Cohere) execute(ctx context.Context, call FunctionCall, tools []tool.Tool[any, any]) string {
+	for _, t := range tools {
+		if t.Name != call.Name {
+			continue
+		}
+
+		start := time.Now()
+		out, err := tool.Execute(ctx, t, any(call.Arguments))
+		if c.OnToolCall != nil {
+			c.OnToolCall(ctx, call.Name, call.Arguments, time.Since(start), err)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to execute tool", slog.String("tool", call.Name), slog.Any("error", err))
+			return errorResponse(err.Error())
+		}
+
+		encoded, err := json.Marshal(out)
+		if err != nil {
+			return errorResponse("failed to encode tool output")
+		}
+
+		return string(encoded)
+	}
+
+	slog.WarnContext(ctx, "model called unknown tool", slog.String("tool", call.Name))
+	if c.OnUnknownTool != nil {
+		c.OnUnknownTool(ctx, call.Name)
+	}
+
+	return errorResponse("unknown tool " + call.Name)
+}
+
+func errorResponse(message string) string {
+	r, _ := json.Marshal(struct {
+		Success bool   `json:"success"`
+		Reason  string `json:"reason"`
+	}{
+		Success: false,
+		Reason:  message,
+	})
+
+	return string(r)
+}
+
+func definitions(tools []tool.Tool[any, any]) []Tool {
+	defs := make([]Tool, len(tools))
+	for i, t := range tools {
+		description := t.Describe()
+		if description == "" {
+			description = t.Name
+		}
+
+		defs[i] = Tool{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        t.Name,
+				Description: description,
+				Parameters: map[string]any{
+					"type":       "object",
+					"properties": t.Definition.Properties,
+					"required":   t.Definition.Required,
+				},
+			},
+		}
+	}
+
+	return defs
+}
+
+// send posts a chat request to cohere
+func (c *Cohere) send(ctx context.Context, body *ChatRequest) (*ChatResponse, error) {
+	data, err := body.wire()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body - %w", err)
+	}
+
+	resp, err := c.request(ctx, "/chat", data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	limit := c.MaxResponseBytes
+	if limit <= 0 {
+		limit = httpclient.DefaultMaxResponseBytes
+	}
+	reader := httpclient.LimitReader(resp.Body, limit)
+
+	if resp.StatusCode != http.StatusOK {
+		failed, _ := io.ReadAll(io.LimitReader(reader, 64<<10))
+		apiErr := newAPIError(resp.StatusCode, failed)
+		slog.ErrorContext(ctx, "non 200 response from cohere", slog.Int("code", apiErr.StatusCode), slog.String("message", apiErr.Message))
+		return nil, apiErr
+	}
+
+	var chat ChatResponse
+	if err := json.NewDecoder(reader).Decode(&chat); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response - %w", err)
+	}
+
+	return &chat, nil
+}
+
+// request posts data to a path of the api. With a key pool, requests
+// rejected as unauthorized or rate limited are retried with another key.
+func (c *Cohere) request(ctx context.Context, path string, data []byte) (*http.Response, error) {
+	if err := httpclient.CheckRequest(data, c.MaxRequestBytes); err != nil {
+		return nil, err
+	}
+
+	compressed := false
+	if c.Compress {
+		var err error
+		if data, compressed, err = httpclient.Compress(data); err != nil {
+			return nil, fmt.Errorf("failed to compress request - %w", err)
+		}
+	}
+
+	attempts := 1
+	if c.Keys != nil {
+		attempts = c.Keys.Len()
+	}
+
+	for attempt := 1; ; attempt++ {
+		auth := c.auth
+		if c.Keys != nil {
+			var err error
+			if auth, err = c.Keys.Pick(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := httpclient.RoundTrip(ctx, c.RequestTimeout, c.RequestAttempts, func(ctx context.Context) (*http.Response, error) {
+			return c.post(ctx, path, data, compressed, auth)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if c.Keys != nil {
+			c.Keys.Report(auth, resp.StatusCode, keypool.RetryAfter(resp.Header))
+			if keypool.Rotate(resp.StatusCode) && attempt < attempts {
+				resp.Body.Close()
+				continue
+			}
+		}
+
+		return resp, nil
+	}
+}
+
+func (c *Cohere) post(ctx context.Context, path string, data []byte, compressed bool, auth string) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request - %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+auth)
+	if compressed {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if c.Signer != nil {
+		if err := c.Signer.Sign(r, data); err != nil {
+			return nil, fmt.Errorf("failed to sign request - %w", err)
+		}
+	}
+
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed - %w", err)
+	}
+
+	return resp, nil
+}
+
+// NewCohereClient creates a client, using httpclient.Default when client is
+// nil
+func NewCohereClient(client *http.Client, auth string) (*Cohere, error) {
+	if client == nil {
+		client = httpclient.Default()
+	}
+
+	return &Cohere{
+		client:  client,
+		auth:    auth,
+		baseURL: baseURL,
+	}, nil
+}
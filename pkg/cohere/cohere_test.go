@@ -0,0 +1,236 @@
+package cohere
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func testClient(t testing.TB, handler http.HandlerFunc) *Cohere {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := NewCohereClient(srv.Client(), "test-key")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	c.baseURL = srv.URL
+
+	return c
+}
+
+type weather struct {
+	City string `json:"city"`
+}
+
+func TestGenerate(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat" {
+			t.Errorf("expected /chat but got %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("expected bearer auth but got %s", r.Header.Get("Authorization"))
+		}
+
+		var sent map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&sent)
+		requests = append(requests, sent)
+
+		if len(requests) == 1 {
+			w.Write([]byte(`{"id":"1","finish_reason":"TOOL_CALL","message":{"role":"assistant","tool_plan":"look up the weather","tool_calls":[
+				{"id":"weather_1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Perth\"}"}}
+			]},"usage":{"billed_units":{"input_tokens":20,"output_tokens":5},"tokens":{"input_tokens":200,"output_tokens":5}}}`))
+			return
+		}
+
+		w.Write([]byte(`{"id":"2","finish_reason":"COMPLETE","message":{"role":"assistant","content":[{"type":"text","text":"sunny in Perth"}],
+			"citations":[{"start":0,"end":5,"text":"sunny","sources":[{"type":"tool","id":"weather_1"}]}]},
+			"usage":{"billed_units":{"input_tokens":40,"output_tokens":4},"tokens":{"input_tokens":240,"output_tokens":4}}}`))
+	})
+
+	var called string
+	c.OnToolCall = func(ctx context.Context, name string, args any, elapsed time.Duration, err error) { called = name }
+
+	tools := []tool.Tool[any, any]{tool.CreateTool("weather", func(ctx context.Context, in weather) (string, error) {
+		return "sunny in " + in.City, nil
+	})}
+
+	body, err := c.Body("command-a-03-2025", "weather in perth?", "be nice", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	body.ToolChoice, _ = ToolChoice("required", "weather")
+	body.Documents = []Document{{ID: "guide", Data: map[string]any{"title": "Perth", "text": "Perth is sunny"}}}
+
+	body, res, err := c.Generate(context.Background(), body, tools)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "sunny in Perth" {
+		t.Errorf("expected sunny in Perth but got %s", res.Text)
+	}
+	if len(res.Citations) != 1 || res.Citations[0].Sources[0].ID != "weather_1" {
+		t.Errorf("expected the tool output cited but got %+v", res.Citations)
+	}
+
+	if res.Usage.Tokens.InputTokens != 440 || res.Usage.BilledUnits.OutputTokens != 9 || res.PromptTokens != 240 {
+		t.Errorf("expected usage summed across requests but got %+v, prompt %d", res.Usage, res.PromptTokens)
+	}
+
+	if called != "weather" {
+		t.Errorf("expected hook to see weather but got %q", called)
+	}
+
+	if string(requests[0]["tool_choice"]) != `"REQUIRED"` {
+		t.Errorf("expected a tool call to be required but got %s", requests[0]["tool_choice"])
+	}
+	if _, ok := requests[1]["tool_choice"]; ok {
+		t.Errorf("expected the required choice dropped once honoured but got %s", requests[1]["tool_choice"])
+	}
+	if string(requests[1]["documents"]) != `[{"id":"guide","data":{"text":"Perth is sunny","title":"Perth"}}]` {
+		t.Errorf("expected the documents with every request but got %s", requests[1]["documents"])
+	}
+
+	var sent []Message
+	json.Unmarshal(requests[1]["messages"], &sent)
+	if len(sent) != 4 || sent[0].Role != "system" || sent[0].Content != "be nice" {
+		t.Fatalf("expected the system prompt to lead the messages but got %+v", sent)
+	}
+	if sent[2].ToolPlan != "look up the weather" || len(sent[2].ToolCalls) != 1 {
+		t.Errorf("expected the tool plan and call sent back but got %+v", sent[2])
+	}
+	if sent[3].Role != "tool" || sent[3].ToolCallID != "weather_1" || sent[3].Content != `"sunny in Perth"` {
+		t.Errorf("expected the tool output but got %+v", sent[3])
+	}
+
+	// The system prompt and documents are sent every call rather than stored
+	history, _ := json.Marshal(body)
+	if strings.Contains(string(history), "be nice") || strings.Contains(string(history), "Perth is sunny") {
+		t.Errorf("expected history without the system prompt or documents but got %s", history)
+	}
+	if len(body.Messages) != 4 {
+		t.Errorf("expected 4 messages in history but got %d", len(body.Messages))
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"id":"abc","message":"invalid api token"}`))
+	})
+
+	body, err := c.Body("command-r-plus", "hello", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	_, _, err = c.Generate(context.Background(), body, nil)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError but got %v", err)
+	}
+
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "invalid api token" {
+		t.Errorf("expected the unauthorized error but got %+v", apiErr)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer limited" {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"finish_reason":"COMPLETE","message":{"role":"assistant","content":[{"type":"text","text":"hi"}]}}`))
+	})
+
+	keys, err := keypool.NewPool("limited", "fine")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	c.Keys = keys
+
+	for range 2 {
+		body, _ := c.Body("command-r-plus", "hello", "", nil, nil)
+		if _, _, err := c.Generate(context.Background(), body, nil); err != nil {
+			t.Errorf("did not expect err but got %v", err)
+		}
+	}
+}
+
+func TestCompressedRequests(t *testing.T) {
+	c := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected gzipped request but got %q", r.Header.Get("Content-Encoding"))
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var sent ChatRequest
+		if err := json.NewDecoder(zr).Decode(&sent); err != nil || len(sent.Messages) != 2 {
+			t.Errorf("expected decodable body but got %v", err)
+		}
+		w.Write([]byte(`{"finish_reason":"COMPLETE","message":{"role":"assistant","content":[{"type":"text","text":"hi"}]}}`))
+	})
+	c.Compress = true
+
+	body, _ := c.Body("command-r-plus", "hello", strings.Repeat("be helpful. ", 200), nil, nil)
+	if _, _, err := c.Generate(context.Background(), body, nil); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+}
+
+func TestRepairMessages(t *testing.T) {
+	t.Run("interrupted and orphaned calls", func(t *testing.T) {
+		body := ChatRequest{Messages: []Message{
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", ToolCalls: []ToolCall{{ID: "1", Function: FunctionCall{Name: "a"}}, {ID: "2", Function: FunctionCall{Name: "b"}}}},
+			{Role: "tool", ToolCallID: "1", Content: "{}"},
+			{Role: "tool", ToolCallID: "3", Content: "{}"},
+			{Role: "user", Content: "hello?"},
+		}}
+
+		repairs, err := body.RepairMessages()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(repairs) != 2 {
+			t.Errorf("expected 2 repairs but got %v", repairs)
+		}
+
+		roles := []string{}
+		for _, message := range body.Messages {
+			roles = append(roles, message.Role+":"+message.ToolCallID)
+		}
+		if strings.Join(roles, " ") != "user: assistant: tool:1 tool:2 user:" {
+			t.Errorf("expected the missing output added and the orphan dropped but got %v", roles)
+		}
+	})
+
+	t.Run("unknown role", func(t *testing.T) {
+		body := ChatRequest{Messages: []Message{{Role: "chatbot", Content: "hi"}}}
+
+		if _, err := body.RepairMessages(); !errors.Is(err, ErrInvalidSequence) {
+			t.Errorf("expected ErrInvalidSequence but got %v", err)
+		}
+	})
+}
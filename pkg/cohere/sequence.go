@@ -0,0 +1,69 @@
+package cohere
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrInvalidSequence = errors.New("messages are out of order")
+
+// RepairMessages checks the messages are in an order cohere accepts,
+// fixing what it can so a malformed response doesn't poison every later
+// turn:
+//
+//   - tool calls without an output are given one saying the call was
+//     interrupted
+//   - tool outputs without a call before them are dropped
+//
+// It returns a description of each repair made. Messages with an unknown
+// role fail with ErrInvalidSequence, leaving the messages as they were.
+func (b *ChatRequest) RepairMessages() ([]string, error) {
+	for i, message := range b.Messages {
+		switch message.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return nil, fmt.Errorf("message %d has unknown role %q - %w", i, message.Role, ErrInvalidSequence)
+		}
+	}
+
+	var repairs []string
+	messages := make([]Message, 0, len(b.Messages))
+	// Calls still waiting on an output, in the order they were made
+	var pending []ToolCall
+
+	// Answers every call still pending, before anything but their outputs
+	interrupt := func() {
+		for _, call := range pending {
+			messages = append(messages, Message{
+				Role:       "tool",
+				Content:    errorResponse("the call was interrupted before it returned"),
+				ToolCallID: call.ID,
+			})
+			repairs = append(repairs, fmt.Sprintf("added missing output for tool call %s", call.ID))
+		}
+		pending = nil
+	}
+
+	for _, message := range b.Messages {
+		if message.Role != "tool" {
+			interrupt()
+			pending = append(pending, message.ToolCalls...)
+			messages = append(messages, message)
+			continue
+		}
+
+		at := slices.IndexFunc(pending, func(call ToolCall) bool { return call.ID == message.ToolCallID })
+		if at < 0 {
+			repairs = append(repairs, fmt.Sprintf("dropped output for unknown tool call %s", message.ToolCallID))
+			continue
+		}
+		pending = slices.Delete(pending, at, at+1)
+		messages = append(messages, message)
+	}
+	interrupt()
+
+	b.Messages = messages
+
+	return repairs, nil
+}
@@ -0,0 +1,140 @@
+package credentials
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Temporary AWS credentials
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiry          time.Time
+}
+
+// Exchanges the projected service account token of an EKS pod (IRSA) for
+// temporary credentials of the role it is annotated with, using the
+// AWS_WEB_IDENTITY_TOKEN_FILE, AWS_ROLE_ARN, AWS_ROLE_SESSION_NAME and
+// AWS_REGION variables EKS injects. Credentials are cached until shortly
+// before they expire.
+//
+// The credentials are meant for Bedrock, which needs requests signed with
+// SigV4. No Bedrock backend exists yet, so signing is left to the caller.
+type AWSWebIdentity struct {
+	client      *http.Client
+	endpoint    string
+	roleARN     string
+	sessionName string
+	tokenFile   string
+
+	mux    sync.Mutex
+	cached AWSCredentials
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		}
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+func (w *AWSWebIdentity) Credentials(ctx context.Context) (AWSCredentials, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.cached.AccessKeyID != "" && time.Until(w.cached.Expiry) > refreshWindow {
+		return w.cached, nil
+	}
+
+	// The token is rotated on disk by kubernetes, so read it every time
+	token, err := os.ReadFile(w.tokenFile)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to read web identity token - %w", err)
+	}
+
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {w.roleARN},
+		"RoleSessionName":  {w.sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, strings.NewReader(query.Encode()))
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to reach sts - %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return AWSCredentials{}, fmt.Errorf("sts returned %d: %s - %w", resp.StatusCode, body, ErrNoCredentials)
+	}
+
+	var assumed assumeRoleWithWebIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&assumed); err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to decode sts response - %w", err)
+	}
+
+	creds := assumed.Result.Credentials
+	w.cached = AWSCredentials{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Expiry:          creds.Expiration,
+	}
+
+	return w.cached, nil
+}
+
+// NewAWSWebIdentity configures itself from the environment EKS provides,
+// failing with ErrNoCredentials when it isn't there
+func NewAWSWebIdentity(client *http.Client) (*AWSWebIdentity, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return nil, fmt.Errorf("AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN must be set - %w", ErrNoCredentials)
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "clusterfuc-" + strconv.FormatInt(time.Now().Unix(), 10)
+	}
+
+	endpoint := "https://sts.amazonaws.com/"
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		endpoint = "https://sts." + region + ".amazonaws.com/"
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &AWSWebIdentity{
+		client:      client,
+		endpoint:    endpoint,
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		tokenFile:   tokenFile,
+	}, nil
+}
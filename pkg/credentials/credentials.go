@@ -0,0 +1,118 @@
+package credentials
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long before expiry cached credentials are refreshed
+const refreshWindow = 5 * time.Minute
+
+const gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+var ErrNoCredentials = errors.New("no credentials available")
+
+// A short lived bearer token
+type Token struct {
+	Value  string
+	Expiry time.Time
+}
+
+// Fetches tokens, such as from a workload identity metadata server
+type TokenSource interface {
+	Token(ctx context.Context) (Token, error)
+}
+
+// Obtains access tokens for the workload's google service account from the
+// metadata server, as provided by GKE workload identity and GCE. Tokens are
+// cached until shortly before they expire.
+//
+// The tokens are meant for Vertex AI, see gemini.Vertex, and can be sent to
+// gateways fronting it with BearerSigner.
+type GCPMetadataSource struct {
+	client *http.Client
+	url    string
+
+	mux    sync.Mutex
+	cached Token
+}
+
+func (s *GCPMetadataSource) Token(ctx context.Context) (Token, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.cached.Value != "" && time.Until(s.cached.Expiry) > refreshWindow {
+		return s.cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to reach metadata server - %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Token{}, fmt.Errorf("metadata server returned %d: %s - %w", resp.StatusCode, body, ErrNoCredentials)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return Token{}, fmt.Errorf("failed to decode metadata token - %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return Token{}, fmt.Errorf("metadata server returned an empty token - %w", ErrNoCredentials)
+	}
+
+	s.cached = Token{
+		Value:  token.AccessToken,
+		Expiry: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}
+
+	return s.cached, nil
+}
+
+func NewGCPMetadataSource(client *http.Client) *GCPMetadataSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &GCPMetadataSource{
+		client: client,
+		url:    gcpMetadataURL,
+	}
+}
+
+// Signs requests by setting a bearer token from source as their
+// Authorization header, replacing any api key based one. Satisfies
+// signer.Signer.
+type BearerSigner struct {
+	Source TokenSource
+}
+
+func (b BearerSigner) Sign(req *http.Request, body []byte) error {
+	token, err := b.Source.Token(req.Context())
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.Value)
+
+	return nil
+}
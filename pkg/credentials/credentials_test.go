@@ -0,0 +1,180 @@
+package credentials
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGCPMetadataSource(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("expected metadata flavor header")
+		}
+		w.Write([]byte(`{"access_token":"tok","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	s := NewGCPMetadataSource(srv.Client())
+	s.url = srv.URL
+
+	for range 2 {
+		token, err := s.Token(context.Background())
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if token.Value != "tok" {
+			t.Errorf("expected tok but got %s", token.Value)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("expected token to be cached but metadata server was called %d times", calls)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://example.com", nil)
+	if err := (BearerSigner{Source: s}).Sign(req, nil); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if req.Header.Get("Authorization") != "Bearer tok" {
+		t.Errorf("expected bearer token but got %s", req.Header.Get("Authorization"))
+	}
+}
+
+func TestAWSWebIdentity(t *testing.T) {
+	t.Run("missing environment", func(t *testing.T) {
+		t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+		t.Setenv("AWS_ROLE_ARN", "")
+
+		if _, err := NewAWSWebIdentity(nil); !errors.Is(err, ErrNoCredentials) {
+			t.Errorf("expected ErrNoCredentials but got %v", err)
+		}
+	})
+
+	t.Run("assumes role", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		os.WriteFile(tokenFile, []byte("jwt\n"), 0o600)
+		t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+		t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123:role/agent")
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			if r.Form.Get("WebIdentityToken") != "jwt" || r.Form.Get("RoleArn") != "arn:aws:iam::123:role/agent" {
+				t.Errorf("unexpected form %v", r.Form)
+			}
+			w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKID</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+		}))
+		defer srv.Close()
+
+		w, err := NewAWSWebIdentity(srv.Client())
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		w.endpoint = srv.URL
+
+		creds, err := w.Credentials(context.Background())
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if creds.AccessKeyID != "AKID" || creds.SecretAccessKey != "secret" || creds.SessionToken != "session" {
+			t.Errorf("unexpected credentials %#v", creds)
+		}
+	})
+}
+
+func TestServiceAccountSource(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("expected a jwt bearer grant but got %s", r.Form.Get("grant_type"))
+		}
+
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("expected a jwt but got %s", r.Form.Get("assertion"))
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&private.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("expected the assertion signed by the key but got %v", err)
+		}
+
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var decoded map[string]any
+		json.Unmarshal(claims, &decoded)
+		if decoded["iss"] != "agent@proj.iam.gserviceaccount.com" || decoded["aud"] != "http://"+r.Host+"/token" {
+			t.Errorf("unexpected claims %v", decoded)
+		}
+
+		w.Write([]byte(`{"access_token":"sa-tok","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	key, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "agent@proj.iam.gserviceaccount.com",
+		"private_key_id": "kid",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      srv.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "key.json")
+	os.WriteFile(path, key, 0o600)
+
+	s, err := LoadServiceAccountSource(srv.Client(), path)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	for range 2 {
+		token, err := s.Token(context.Background())
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if token.Value != "sa-tok" {
+			t.Errorf("expected sa-tok but got %s", token.Value)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("expected token to be cached but token endpoint was called %d times", calls)
+	}
+
+	if _, err := NewServiceAccountSource(nil, []byte(`{"type":"authorized_user"}`)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected ErrNoCredentials but got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package credentials
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Obtains access tokens for a google service account from its json key,
+// for workloads outside GCP. A JWT signed with the key is exchanged for a
+// token at the key's token uri. Tokens are cached until shortly before they
+// expire.
+type ServiceAccountSource struct {
+	client   *http.Client
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURI string
+
+	mux    sync.Mutex
+	cached Token
+}
+
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+func (s *ServiceAccountSource) Token(ctx context.Context) (Token, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.cached.Value != "" && time.Until(s.cached.Expiry) > refreshWindow {
+		return s.cached, nil
+	}
+
+	assertion, err := s.assertion(time.Now())
+	if err != nil {
+		return Token{}, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to reach token endpoint - %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Token{}, fmt.Errorf("token endpoint returned %d: %s - %w", resp.StatusCode, body, ErrNoCredentials)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return Token{}, fmt.Errorf("failed to decode service account token - %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return Token{}, fmt.Errorf("token endpoint returned an empty token - %w", ErrNoCredentials)
+	}
+
+	s.cached = Token{
+		Value:  token.AccessToken,
+		Expiry: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}
+
+	return s.cached, nil
+}
+
+// A JWT asking for a cloud platform token, signed with the key
+func (s *ServiceAccountSource) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   s.email,
+		"scope": gcpScope,
+		"aud":   s.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign assertion - %w", err)
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// NewServiceAccountSource creates a source from the contents of a service
+// account json key
+func NewServiceAccountSource(client *http.Client, key []byte) (*ServiceAccountSource, error) {
+	var parsed serviceAccountKey
+	if err := json.Unmarshal(key, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to decode service account key - %w", err)
+	}
+	if parsed.Type != "service_account" || parsed.ClientEmail == "" {
+		return nil, fmt.Errorf("not a service account key - %w", ErrNoCredentials)
+	}
+
+	block, _ := pem.Decode([]byte(parsed.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account key has no pem private key")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse service account private key - %w", err)
+	}
+	rsaKey, ok := private.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key is not rsa")
+	}
+
+	if parsed.TokenURI == "" {
+		parsed.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &ServiceAccountSource{
+		client:   client,
+		email:    parsed.ClientEmail,
+		keyID:    parsed.PrivateKeyID,
+		key:      rsaKey,
+		tokenURI: parsed.TokenURI,
+	}, nil
+}
+
+// LoadServiceAccountSource reads a service account json key from path, such
+// as the one GOOGLE_APPLICATION_CREDENTIALS names
+func LoadServiceAccountSource(client *http.Client, path string) (*ServiceAccountSource, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServiceAccountSource(client, key)
+}
@@ -0,0 +1,10 @@
+// Package embed defines what provider clients implement to turn text into
+// vectors, so callers such as ingestion pipelines can swap providers.
+package embed
+
+import "context"
+
+// Turns text into vectors, one per text in the order given
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
@@ -0,0 +1,168 @@
+package experiment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+)
+
+var ErrNoVariants = errors.New("experiment has no variants")
+
+// Anything that answers agent inputs, such as an agent.Agent
+type Caller interface {
+	Call(ctx context.Context, input agent.AgentInput) (agent.AgentOutput, error)
+}
+
+// One arm of an experiment, usually an agent differing from the others by
+// its model or prompt version
+type Variant struct {
+	Name string
+	// Share of traffic relative to the other variants, values below 1 count
+	// as 1
+	Weight int
+	Agent  Caller
+}
+
+// Aggregated results of a variant
+type Metrics struct {
+	Variant string
+	Calls   int64
+	Errors  int64
+	Usage   agent.Usage
+	// Total time spent in calls
+	Latency time.Duration
+}
+
+func (m Metrics) ErrorRate() float64 {
+	if m.Calls == 0 {
+		return 0
+	}
+
+	return float64(m.Errors) / float64(m.Calls)
+}
+
+func (m Metrics) AverageLatency() time.Duration {
+	if m.Calls == 0 {
+		return 0
+	}
+
+	return m.Latency / time.Duration(m.Calls)
+}
+
+func (m Metrics) AverageTokens() float64 {
+	if m.Calls == 0 {
+		return 0
+	}
+
+	return float64(m.Usage.TotalTokens) / float64(m.Calls)
+}
+
+// Splits traffic between variants by a hash of the input id, so a
+// conversation always lands on the same variant and keeps a history its
+// model understands.
+type Experiment struct {
+	// Salts the hash, so experiments sharing ids split them independently
+	Name     string
+	Variants []Variant
+
+	mux     sync.Mutex
+	metrics map[string]*Metrics
+}
+
+// Pick returns the variant that serves id
+func (e *Experiment) Pick(id string) (Variant, error) {
+	if len(e.Variants) == 0 {
+		return Variant{}, ErrNoVariants
+	}
+
+	total := 0
+	for _, v := range e.Variants {
+		total += max(v.Weight, 1)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + id))
+	point := int(h.Sum32() % uint32(total))
+
+	for _, v := range e.Variants {
+		point -= max(v.Weight, 1)
+		if point < 0 {
+			return v, nil
+		}
+	}
+
+	return e.Variants[len(e.Variants)-1], nil
+}
+
+// Call answers input with its variant, tagging the output with the variant's
+// name and counting the call towards its metrics
+func (e *Experiment) Call(ctx context.Context, input agent.AgentInput) (agent.AgentOutput, error) {
+	v, err := e.Pick(input.Id)
+	if err != nil {
+		return agent.AgentOutput{}, err
+	}
+
+	start := time.Now()
+	output, err := v.Agent.Call(ctx, input)
+	e.record(v.Name, output.Usage, time.Since(start), err)
+
+	output.Variant = v.Name
+	if err != nil {
+		return output, fmt.Errorf("variant %s - %w", v.Name, err)
+	}
+
+	return output, nil
+}
+
+func (e *Experiment) record(variant string, usage agent.Usage, latency time.Duration, err error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.metrics == nil {
+		e.metrics = make(map[string]*Metrics)
+	}
+
+	m, ok := e.metrics[variant]
+	if !ok {
+		m = &Metrics{Variant: variant}
+		e.metrics[variant] = m
+	}
+
+	m.Calls++
+	if err != nil {
+		m.Errors++
+	}
+	m.Usage = m.Usage.Add(usage)
+	m.Latency += latency
+}
+
+// Metrics returns the results so far of every variant, in the order the
+// variants are listed
+func (e *Experiment) Metrics() []Metrics {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	metrics := make([]Metrics, 0, len(e.Variants))
+	for _, v := range e.Variants {
+		if m, ok := e.metrics[v.Name]; ok {
+			metrics = append(metrics, *m)
+		} else {
+			metrics = append(metrics, Metrics{Variant: v.Name})
+		}
+	}
+
+	return metrics
+}
+
+func NewExperiment(name string, variants ...Variant) *Experiment {
+	return &Experiment{
+		Name:     name,
+		Variants: variants,
+		metrics:  make(map[string]*Metrics),
+	}
+}
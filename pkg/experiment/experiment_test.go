@@ -0,0 +1,76 @@
+package experiment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+)
+
+type fixed struct {
+	tokens int
+	err    error
+}
+
+func (f fixed) Call(ctx context.Context, input agent.AgentInput) (agent.AgentOutput, error) {
+	return agent.AgentOutput{Output: "ok", Usage: agent.Usage{TotalTokens: f.tokens}}, f.err
+}
+
+func TestExperiment(t *testing.T) {
+	broken := errors.New("broken")
+	e := NewExperiment("prompt-v2",
+		Variant{Name: "control", Weight: 1, Agent: fixed{tokens: 10}},
+		Variant{Name: "candidate", Weight: 1, Agent: fixed{tokens: 20, err: broken}},
+	)
+
+	t.Run("sessions stick to a variant", func(t *testing.T) {
+		first, _ := e.Pick("session")
+		for range 10 {
+			again, _ := e.Pick("session")
+			if again.Name != first.Name {
+				t.Fatalf("expected %s but got %s", first.Name, again.Name)
+			}
+		}
+	})
+
+	t.Run("traffic is split", func(t *testing.T) {
+		seen := map[string]int{}
+		for i := range 1000 {
+			v, _ := e.Pick(fmt.Sprintf("session-%d", i))
+			seen[v.Name]++
+		}
+
+		if seen["control"] < 400 || seen["candidate"] < 400 {
+			t.Errorf("expected an even split but got %v", seen)
+		}
+	})
+
+	t.Run("outputs are tagged and counted", func(t *testing.T) {
+		for i := range 20 {
+			output, err := e.Call(context.Background(), agent.AgentInput{Id: fmt.Sprintf("call-%d", i)})
+			if output.Variant == "candidate" && !errors.Is(err, broken) {
+				t.Errorf("expected candidate err but got %v", err)
+			}
+			if output.Variant == "" {
+				t.Errorf("expected output to be tagged with a variant")
+			}
+		}
+
+		metrics := e.Metrics()
+		if metrics[0].Calls+metrics[1].Calls != 20 {
+			t.Errorf("expected 20 calls but got %#v", metrics)
+		}
+
+		if metrics[1].Calls > 0 && (metrics[1].ErrorRate() != 1 || metrics[1].AverageTokens() != 20) {
+			t.Errorf("unexpected candidate metrics %#v", metrics[1])
+		}
+	})
+
+	t.Run("no variants", func(t *testing.T) {
+		if _, err := NewExperiment("empty").Call(context.Background(), agent.AgentInput{Id: "id"}); !errors.Is(err, ErrNoVariants) {
+			t.Errorf("expected ErrNoVariants but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+)
+
+// Author of a debate's verdict
+const ModeratorAuthor = "moderator"
+
+const moderatorPrompt = `Below is a debate over a question. Weigh the arguments made and give the best final answer to the question, briefly noting where the debaters disagreed.`
+
+// Debaters argue over a question for a number of rounds before a moderator
+// decides on the answer
+type Debate struct {
+	// Prefixes every session id, keeping separate debates apart
+	Id       string
+	Debaters []Participant
+	// Times every debater speaks, defaults to 1
+	Rounds int
+	// Produces the final answer from the transcript, such as a judge model
+	Moderator Caller
+	// Optional guidance replacing the moderator's default instructions
+	ModeratorPrompt string
+}
+
+// The outcome of a debate
+type Verdict struct {
+	Answer string
+	// Every message of the debate, ending with the moderator's
+	Transcript *Flow
+}
+
+// Usage sums what the whole debate cost
+func (v Verdict) Usage() agent.Usage {
+	return v.Transcript.Usage()
+}
+
+// Run debates a question and has the moderator answer it. On failure the
+// transcript so far is still returned.
+func (d *Debate) Run(ctx context.Context, question string) (Verdict, error) {
+	if d.Moderator == nil {
+		return Verdict{}, errors.New("debate has no moderator")
+	}
+
+	chain := &Chain{Id: d.Id, Participants: d.Debaters, Rounds: d.Rounds}
+	flow, err := chain.Run(ctx, question)
+	if err != nil {
+		return Verdict{Transcript: flow}, err
+	}
+
+	prompt := d.ModeratorPrompt
+	if prompt == "" {
+		prompt = moderatorPrompt
+	}
+
+	output, err := d.Moderator.Call(ctx, agent.AgentInput{
+		Id:        d.Id + ":" + ModeratorAuthor,
+		UserInput: prompt + "\n\n" + flow.Transcript(),
+	})
+	if err != nil {
+		return Verdict{Transcript: flow}, fmt.Errorf("moderator failed to decide - %w", err)
+	}
+
+	flow.Append(Message{Author: ModeratorAuthor, Text: output.Output, At: chain.clock()(), Usage: output.Usage})
+
+	return Verdict{Answer: output.Output, Transcript: flow}, nil
+}
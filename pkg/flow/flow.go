@@ -0,0 +1,151 @@
+// Package flow chains agents together, passing a growing conversation
+// between them in turn, e.g. for round-robin debates.
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+)
+
+var ErrNoParticipants = errors.New("chain has no participants")
+
+// Author of the message that starts a flow
+const UserAuthor = "user"
+
+// Anything that answers agent inputs, such as an agent.Agent
+type Caller interface {
+	Call(ctx context.Context, input agent.AgentInput) (agent.AgentOutput, error)
+}
+
+// A single contribution to a flow
+type Message struct {
+	// Name of the participant that wrote it, or UserAuthor
+	Author string
+	Text   string
+	At     time.Time
+	// Tokens the participant spent writing it
+	Usage agent.Usage
+}
+
+// A conversation between agents, in the order it happened
+type Flow struct {
+	Messages []Message
+}
+
+// Append adds a message to the end of the flow
+func (f *Flow) Append(message Message) {
+	f.Messages = append(f.Messages, message)
+}
+
+// Last returns the latest message, or an empty one if there are none
+func (f *Flow) Last() Message {
+	if len(f.Messages) == 0 {
+		return Message{}
+	}
+
+	return f.Messages[len(f.Messages)-1]
+}
+
+// Transcript renders the flow as one "author: text" block per message
+func (f *Flow) Transcript() string {
+	return render(f.Messages)
+}
+
+// Usage sums what every message cost
+func (f *Flow) Usage() agent.Usage {
+	var usage agent.Usage
+	for _, message := range f.Messages {
+		usage = usage.Add(message.Usage)
+	}
+
+	return usage
+}
+
+// A named agent taking part in a chain
+type Participant struct {
+	Name  string
+	Agent Caller
+	// Optional instructions sent with each of its turns, such as the stance
+	// to take, letting one agent play several parts
+	Role string
+}
+
+// Runs participants in turn, each seeing what was said since it last spoke.
+// Every participant keeps its own session, so agents with memory remember
+// their earlier turns.
+type Chain struct {
+	// Prefixes each participant's session id, keeping separate runs apart
+	Id           string
+	Participants []Participant
+	// Times every participant speaks, defaults to 1
+	Rounds int
+	// Optionally ends the chain early, checked after every message
+	Done func(f *Flow) bool
+
+	now func() time.Time
+}
+
+// Run starts a flow with the user's prompt and lets every participant speak
+// in turn until the rounds are up or Done says so. The flow so far is
+// returned alongside any error.
+func (c *Chain) Run(ctx context.Context, prompt string) (*Flow, error) {
+	if len(c.Participants) == 0 {
+		return nil, ErrNoParticipants
+	}
+
+	now := c.clock()
+	rounds := max(c.Rounds, 1)
+	flow := &Flow{}
+	flow.Append(Message{Author: UserAuthor, Text: prompt, At: now()})
+
+	// Index of the first message each participant hasn't seen
+	seen := make([]int, len(c.Participants))
+
+	for range rounds {
+		for i, p := range c.Participants {
+			input := agent.AgentInput{
+				Id:        c.Id + ":" + p.Name,
+				UserInput: render(flow.Messages[seen[i]:]),
+			}
+			if p.Role != "" {
+				input.Instructions = []string{p.Role}
+			}
+
+			output, err := p.Agent.Call(ctx, input)
+			if err != nil {
+				return flow, fmt.Errorf("%s failed to take its turn - %w", p.Name, err)
+			}
+
+			flow.Append(Message{Author: p.Name, Text: output.Output, At: now(), Usage: output.Usage})
+			seen[i] = len(flow.Messages)
+
+			if c.Done != nil && c.Done(flow) {
+				return flow, nil
+			}
+		}
+	}
+
+	return flow, nil
+}
+
+func (c *Chain) clock() func() time.Time {
+	if c.now == nil {
+		return time.Now
+	}
+
+	return c.now
+}
+
+func render(messages []Message) string {
+	blocks := make([]string, 0, len(messages))
+	for _, message := range messages {
+		blocks = append(blocks, message.Author+": "+message.Text)
+	}
+
+	return strings.Join(blocks, "\n\n")
+}
@@ -0,0 +1,115 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+)
+
+// Replies with its name and records what it was sent
+type echo struct {
+	name   string
+	inputs []agent.AgentInput
+}
+
+func (e *echo) Call(ctx context.Context, input agent.AgentInput) (agent.AgentOutput, error) {
+	e.inputs = append(e.inputs, input)
+	return agent.AgentOutput{Output: e.name + " argues", Usage: agent.Usage{TotalTokens: 1}}, nil
+}
+
+func TestChain(t *testing.T) {
+	pro, con := &echo{name: "pro"}, &echo{name: "con"}
+	at := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	chain := &Chain{
+		Id:           "debate",
+		Participants: []Participant{{Name: "pro", Agent: pro}, {Name: "con", Agent: con}},
+		Rounds:       2,
+		now:          func() time.Time { return at },
+	}
+
+	flow, err := chain.Run(context.Background(), "tabs or spaces")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	authors := []string{UserAuthor, "pro", "con", "pro", "con"}
+	if len(flow.Messages) != len(authors) {
+		t.Fatalf("expected %d messages but got %d", len(authors), len(flow.Messages))
+	}
+	for i, message := range flow.Messages {
+		if message.Author != authors[i] || !message.At.Equal(at) {
+			t.Errorf("expected message %d from %s but got %#v", i, authors[i], message)
+		}
+	}
+
+	if got := pro.inputs[1].UserInput; got != "con: con argues" {
+		t.Errorf("expected pro to only see what was said since its turn but got %q", got)
+	}
+
+	if got := con.inputs[0].UserInput; got != "user: tabs or spaces\n\npro: pro argues" {
+		t.Errorf("expected con to see the prompt and pro's turn but got %q", got)
+	}
+
+	if pro.inputs[0].Id != "debate:pro" || flow.Usage().TotalTokens != 4 {
+		t.Errorf("unexpected session id %s or usage %d", pro.inputs[0].Id, flow.Usage().TotalTokens)
+	}
+
+	t.Run("done ends early", func(t *testing.T) {
+		chain.Done = func(f *Flow) bool { return f.Last().Author == "pro" }
+
+		flow, err := chain.Run(context.Background(), "tabs or spaces")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(flow.Messages) != 2 {
+			t.Errorf("expected to stop after pro but got %d messages", len(flow.Messages))
+		}
+	})
+
+	t.Run("no participants", func(t *testing.T) {
+		if _, err := (&Chain{}).Run(context.Background(), "hi"); !errors.Is(err, ErrNoParticipants) {
+			t.Errorf("expected ErrNoParticipants but got %v", err)
+		}
+	})
+}
+
+func TestDebate(t *testing.T) {
+	debater, judge := &echo{name: "debater"}, &echo{name: "judge"}
+
+	debate := &Debate{
+		Id: "d",
+		Debaters: []Participant{
+			{Name: "optimist", Agent: debater, Role: "Argue for."},
+			{Name: "skeptic", Agent: debater, Role: "Argue against."},
+		},
+		Rounds:    2,
+		Moderator: judge,
+	}
+
+	verdict, err := debate.Run(context.Background(), "should we rewrite it in rust")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if verdict.Answer != "judge argues" || verdict.Transcript.Last().Author != ModeratorAuthor || len(verdict.Transcript.Messages) != 6 {
+		t.Errorf("unexpected verdict %#v", verdict)
+	}
+
+	if debater.inputs[1].Instructions[0] != "Argue against." || debater.inputs[1].Id != "d:skeptic" {
+		t.Errorf("expected the skeptic's role in its turn but got %#v", debater.inputs[1])
+	}
+
+	if len(judge.inputs) != 1 || !strings.Contains(judge.inputs[0].UserInput, "skeptic: debater argues") {
+		t.Errorf("expected the moderator to see the transcript but got %#v", judge.inputs)
+	}
+
+	if verdict.Usage().TotalTokens != 5 {
+		t.Errorf("expected 5 tokens but got %d", verdict.Usage().TotalTokens)
+	}
+}
@@ -0,0 +1,96 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/speech"
+)
+
+const transcribePrompt = "Transcribe this audio verbatim. Reply with only the transcript."
+
+// Speak reads text aloud with the client's model, which must be a speech
+// model such as gemini-2.5-flash-preview-tts. Audio comes back as raw pcm,
+// e.g. audio/L16;codec=pcm;rate=24000.
+func (oa *Gemini) Speak(ctx context.Context, text string, voice string) (Blob, error) {
+	body := RequestBody{Contents: []Content{{Role: "user", Parts: []Part{{Text: text}}}}}
+	body.GenerationConfig.ResponseModalities = []string{"AUDIO"}
+	if voice != "" {
+		body.GenerationConfig.SpeechConfig = &SpeechConfig{}
+		body.GenerationConfig.SpeechConfig.VoiceConfig.PrebuiltVoiceConfig.VoiceName = voice
+	}
+
+	resp, err := oa.generateContent(ctx, body)
+	if err != nil {
+		return Blob{}, err
+	}
+
+	for _, candidate := range resp.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if part.InlineData != nil {
+				return *part.InlineData, nil
+			}
+		}
+	}
+
+	return Blob{}, errors.New("no audio in response")
+}
+
+// Transcribe turns spoken audio into text with the client's model, which must
+// accept audio such as gemini-2.5-flash
+func (oa *Gemini) Transcribe(ctx context.Context, audio Blob) (string, error) {
+	body := RequestBody{Contents: []Content{{Role: "user", Parts: []Part{
+		{Text: transcribePrompt},
+		{InlineData: &audio},
+	}}}}
+
+	resp, err := oa.generateContent(ctx, body)
+	if err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	for _, candidate := range resp.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if !part.Thought {
+				text.WriteString(part.Text)
+			}
+		}
+	}
+
+	return strings.TrimSpace(text.String()), nil
+}
+
+// Speaks text with a gemini speech model, implementing speech.Synthesizer
+type Speaker struct {
+	Client *Gemini
+	// Optional prebuilt voice, e.g. Kore
+	Voice string
+}
+
+func (s *Speaker) Synthesize(ctx context.Context, text string) (speech.Audio, error) {
+	audio, err := s.Client.Speak(ctx, text, s.Voice)
+	if err != nil {
+		return speech.Audio{}, err
+	}
+
+	return speech.Audio{Data: audio.Data, MimeType: audio.MimeType}, nil
+}
+
+func NewSpeaker(client *Gemini) *Speaker {
+	return &Speaker{Client: client}
+}
+
+// Transcribes audio with a gemini model, implementing speech.Transcriber
+type Transcriber struct {
+	Client *Gemini
+}
+
+func (t *Transcriber) Transcribe(ctx context.Context, audio speech.Audio) (string, error) {
+	return t.Client.Transcribe(ctx, Blob{MimeType: audio.MimeType, Data: audio.Data})
+}
+
+func NewTranscriber(client *Gemini) *Transcriber {
+	return &Transcriber{Client: client}
+}
@@ -0,0 +1,74 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Content stored by gemini ahead of requests, which requests reference by
+// name rather than sending it again. Tokens read from the cache are billed
+// at a reduced rate.
+type CachedContent struct {
+	// Set by gemini, e.g. cachedContents/abc123, or under the project and
+	// region on vertex
+	Name string `json:"name,omitempty"`
+	// e.g. models/gemini-2.5-flash
+	Model             string    `json:"model,omitempty"`
+	SystemInstruction Content   `json:"systemInstruction,omitzero"`
+	Tools             []Tool    `json:"tools,omitempty"`
+	Contents          []Content `json:"contents,omitempty"`
+	// How long the cache lives for, e.g. 3600s
+	TTL string `json:"ttl,omitempty"`
+	// Set by gemini
+	ExpireTime    time.Time `json:"expireTime,omitzero"`
+	UsageMetadata struct {
+		TotalTokenCount int `json:"totalTokenCount,omitempty"`
+	} `json:"usageMetadata,omitzero"`
+}
+
+// CacheContext stores a system prompt and tools as cached content for the
+// client's model, living for ttl. Gemini refuses to cache content under a
+// minimum size, 1024 tokens for flash models and more for others.
+func (oa *Gemini) CacheContext(ctx context.Context, system string, tools []tool.Tool[any, any], ttl time.Duration) (*CachedContent, error) {
+	cached := CachedContent{
+		Model: oa.modelName(),
+		TTL:   fmt.Sprintf("%ds", int(ttl.Seconds())),
+	}
+	if system != "" {
+		cached.SystemInstruction.Parts = []Part{{Text: system}}
+	}
+	if len(tools) > 0 {
+		cached.Tools = []Tool{{FunctionDeclarations: functionDeclarations(tools)}}
+	}
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cached content - %w", err)
+	}
+
+	resp, err := oa.request(ctx, oa.collection("cachedContents"), data)
+	if err != nil {
+		return nil, err
+	}
+
+	var created CachedContent
+	if err := oa.decode(ctx, resp, &created); err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// UseCachedContent points the body at cached content holding its system
+// instruction and tools, which gemini refuses to have sent again alongside
+// it
+func (b *RequestBody) UseCachedContent(name string) {
+	b.CachedContent = name
+	b.SystemInstruction = Content{}
+	b.Tools = nil
+	b.ToolConfig = nil
+}
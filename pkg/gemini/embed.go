@@ -0,0 +1,148 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// What embeddings will be used for, letting the model optimise for it
+const (
+	TaskRetrievalQuery     = "RETRIEVAL_QUERY"
+	TaskRetrievalDocument  = "RETRIEVAL_DOCUMENT"
+	TaskSemanticSimilarity = "SEMANTIC_SIMILARITY"
+	TaskClassification     = "CLASSIFICATION"
+	TaskClustering         = "CLUSTERING"
+	TaskQuestionAnswering  = "QUESTION_ANSWERING"
+	TaskFactVerification   = "FACT_VERIFICATION"
+)
+
+// Most requests batchEmbedContents accepts at once
+const MaxEmbedBatch = 100
+
+type EmbedContentRequest struct {
+	// Required by batches, as models/{model}. Filled in with the client's
+	// model when empty.
+	Model   string  `json:"model,omitempty"`
+	Content Content `json:"content"`
+	// Optional task the embedding is for, e.g. TaskRetrievalDocument
+	TaskType string `json:"taskType,omitempty"`
+	// Optional title of the content, only for TaskRetrievalDocument
+	Title string `json:"title,omitempty"`
+	// Optionally truncates the embedding to fewer dimensions
+	OutputDimensionality int `json:"outputDimensionality,omitempty"`
+}
+
+type ContentEmbedding struct {
+	Values []float32 `json:"values"`
+}
+
+type embedContentResponse struct {
+	Embedding ContentEmbedding `json:"embedding"`
+}
+
+type batchEmbedContentsRequest struct {
+	Requests []EmbedContentRequest `json:"requests"`
+}
+
+type batchEmbedContentsResponse struct {
+	Embeddings []ContentEmbedding `json:"embeddings"`
+}
+
+// EmbedContent embeds a single piece of content with the client's model,
+// which must be an embedding model such as gemini-embedding-001
+func (oa *Gemini) EmbedContent(ctx context.Context, req EmbedContentRequest) (ContentEmbedding, error) {
+	var out embedContentResponse
+	if err := oa.embed(ctx, "embedContent", req, &out); err != nil {
+		return ContentEmbedding{}, err
+	}
+
+	return out.Embedding, nil
+}
+
+// BatchEmbedContents embeds up to MaxEmbedBatch pieces of content in one
+// request, returning embeddings in the order of the requests
+func (oa *Gemini) BatchEmbedContents(ctx context.Context, reqs []EmbedContentRequest) ([]ContentEmbedding, error) {
+	if len(reqs) > MaxEmbedBatch {
+		return nil, fmt.Errorf("batch of %d exceeds %d requests", len(reqs), MaxEmbedBatch)
+	}
+
+	batch := batchEmbedContentsRequest{Requests: make([]EmbedContentRequest, len(reqs))}
+	for i, req := range reqs {
+		if req.Model == "" {
+			req.Model = oa.modelName()
+		}
+		batch.Requests[i] = req
+	}
+
+	var out batchEmbedContentsResponse
+	if err := oa.embed(ctx, "batchEmbedContents", batch, &out); err != nil {
+		return nil, err
+	}
+
+	if len(out.Embeddings) != len(reqs) {
+		return nil, fmt.Errorf("expected %d embeddings but got %d", len(reqs), len(out.Embeddings))
+	}
+
+	return out.Embeddings, nil
+}
+
+func (oa *Gemini) embed(ctx context.Context, method string, body any, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s request - %w", method, err)
+	}
+
+	resp, err := oa.request(ctx, oa.method(method), data)
+	if err != nil {
+		return err
+	}
+
+	if err := oa.decode(ctx, resp, out); err != nil {
+		return fmt.Errorf("%s failed - %w", method, err)
+	}
+
+	return nil
+}
+
+// Embeds text with a gemini embedding model, implementing embed.Embedder.
+// Large inputs are split across as many batches as needed.
+type Embedder struct {
+	Client *Gemini
+	// Optional task the embeddings are for, e.g. TaskRetrievalDocument
+	TaskType string
+	// Optionally truncates embeddings to fewer dimensions
+	OutputDimensionality int
+}
+
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+
+	for start := 0; start < len(texts); start += MaxEmbedBatch {
+		chunk := texts[start:min(start+MaxEmbedBatch, len(texts))]
+
+		reqs := make([]EmbedContentRequest, len(chunk))
+		for i, text := range chunk {
+			reqs[i] = EmbedContentRequest{
+				Content:              Content{Parts: []Part{{Text: text}}},
+				TaskType:             e.TaskType,
+				OutputDimensionality: e.OutputDimensionality,
+			}
+		}
+
+		embeddings, err := e.Client.BatchEmbedContents(ctx, reqs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, embedding := range embeddings {
+			vectors = append(vectors, embedding.Values)
+		}
+	}
+
+	return vectors, nil
+}
+
+func NewEmbedder(client *Gemini) *Embedder {
+	return &Embedder{Client: client}
+}
@@ -0,0 +1,106 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Canonical statuses google reports errors with
+const (
+	StatusInvalidArgument    = "INVALID_ARGUMENT"
+	StatusFailedPrecondition = "FAILED_PRECONDITION"
+	StatusPermissionDenied   = "PERMISSION_DENIED"
+	StatusNotFound           = "NOT_FOUND"
+	StatusResourceExhausted  = "RESOURCE_EXHAUSTED"
+	StatusInternal           = "INTERNAL"
+	StatusUnavailable        = "UNAVAILABLE"
+	StatusDeadlineExceeded   = "DEADLINE_EXCEEDED"
+)
+
+// Returned when gemini replies with anything but 200, holding the error
+// google described in the body
+type APIError struct {
+	StatusCode int
+	// Canonical status, e.g. StatusResourceExhausted
+	Status  string
+	Message string
+	// Machine readable cause from the error's ErrorInfo, e.g. API_KEY_INVALID
+	Reason string
+	// How long google asked to wait before retrying, from the error's
+	// RetryInfo or the Retry-After header. 0 when it didn't say.
+	RetryDelay time.Duration
+	// Every detail attached to the error, each with an @type
+	Details []json.RawMessage
+	// Raw response body, kept for bodies that aren't a google error
+	Body string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("invalid status code: %d, body: %s", e.StatusCode, e.Body)
+	}
+
+	msg := fmt.Sprintf("gemini error %d (%s): %s", e.StatusCode, e.Status, e.Message)
+	if e.RetryDelay > 0 {
+		msg += fmt.Sprintf(", retry in %s", e.RetryDelay)
+	}
+
+	return msg
+}
+
+// Whether the request may succeed if retried later, e.g. when rate limited or
+// gemini is overloaded
+func (e *APIError) Temporary() bool {
+	switch e.Status {
+	case StatusResourceExhausted, StatusUnavailable, StatusInternal, StatusDeadlineExceeded:
+		return true
+	}
+
+	return e.StatusCode == 429 || e.StatusCode >= 500
+}
+
+// Parses the error google describes in a failed response body. Bodies that
+// aren't json only keep the raw body.
+func newAPIError(status int, body []byte) *APIError {
+	var payload struct {
+		Error struct {
+			Code    int               `json:"code"`
+			Message string            `json:"message"`
+			Status  string            `json:"status"`
+			Details []json.RawMessage `json:"details"`
+		} `json:"error"`
+	}
+
+	apiErr := &APIError{StatusCode: status, Body: string(body)}
+	if json.Unmarshal(body, &payload) != nil {
+		return apiErr
+	}
+
+	apiErr.Status = payload.Error.Status
+	apiErr.Message = payload.Error.Message
+	apiErr.Details = payload.Error.Details
+
+	for _, raw := range payload.Error.Details {
+		var detail struct {
+			Type       string `json:"@type"`
+			Reason     string `json:"reason"`
+			RetryDelay string `json:"retryDelay"`
+		}
+		if json.Unmarshal(raw, &detail) != nil {
+			continue
+		}
+
+		switch detail.Type {
+		case "type.googleapis.com/google.rpc.ErrorInfo":
+			apiErr.Reason = detail.Reason
+		case "type.googleapis.com/google.rpc.RetryInfo":
+			// Durations are encoded as seconds, e.g. "34s" or "1.5s"
+			if delay, err := time.ParseDuration(detail.RetryDelay); err == nil {
+				apiErr.RetryDelay = delay
+			}
+		}
+	}
+
+	return apiErr
+}
@@ -9,26 +9,49 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
 	"github.com/calamity-m/clusterfuc/pkg/tool"
 )
 
 var (
 	ErrInvalidGeminiContent = errors.New("input contains non gemini content")
+	ErrPromptBlocked        = errors.New("prompt blocked by gemini")
 )
 
+// Label key used to attribute a request to the end user responsible for it
+const LabelEndUser = "end_user"
+
 type FunctionCall struct {
+	// Only set by the live api, to pair responses with calls
+	ID   string `json:"id,omitempty"`
 	Name string `json:"name,omitempty"`
 	Args any    `json:"args,omitempty"`
 }
 
 type FunctionResponse struct {
+	// Only required by the live api, echoing the id of the call
+	ID       string `json:"id,omitempty"`
 	Name     string `json:"name,omitempty"`
 	Response any    `json:"response,omitempty"`
 }
 
+// Raw media bytes, such as audio or images
+type Blob struct {
+	MimeType string `json:"mimeType,omitempty"`
+	// Base64 encoded when marshaled to json
+	Data []byte `json:"data,omitempty"`
+}
+
 type Part struct {
 	Text             string           `json:"text,omitempty"`
+	InlineData       *Blob            `json:"inlineData,omitempty"`
 	FunctionCall     FunctionCall     `json:"functionCall,omitzero,omitempty"`
 	FunctionResponse FunctionResponse `json:"functionResponse,omitzero,omitempty"`
 	Thought          bool             `json:"thought,omitzero,omitempty"`
@@ -81,12 +104,94 @@ func VerifyContents(in []any) ([]Content, error) {
 }
 
 type GenerationConfig struct {
-	ResponseSchema struct {
+	// Must be application/json when a response schema is set
+	ResponseMimeType string `json:"responseMimeType,omitempty"`
+	ResponseSchema   struct {
+		Type        string   `json:"type,omitempty"`
 		Properties  any      `json:"properties,omitzero,omitempty"`
 		Required    []string `json:"required,omitempty"`
 		Title       string   `json:"title,omitempty"`
 		Description string   `json:"description,omitempty"`
 	} `json:"responseSchema,omitzero"`
+	// What the response may contain, TEXT and IMAGE for image output
+	// models. Empty uses the model default of text only.
+	ResponseModalities []string `json:"responseModalities,omitempty"`
+	// Most tokens a candidate may contain, 0 uses the model default
+	MaxOutputTokens int `json:"maxOutputTokens,omitempty"`
+	// Up to 5 sequences that stop generation when produced. They are not
+	// included in the response.
+	StopSequences []string `json:"stopSequences,omitempty"`
+	// Penalises tokens that have already appeared at all, between -2 and 2
+	PresencePenalty *float64 `json:"presencePenalty,omitempty"`
+	// Penalises tokens by how often they have appeared, between -2 and 2
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	// Makes sampling deterministic, as far as the model allows
+	Seed *int `json:"seed,omitempty"`
+	// Thinking features, only supported by 2.5 and newer models
+	ThinkingConfig *ThinkingConfig `json:"thinkingConfig,omitempty"`
+	// Return the log probability of every generated token
+	ResponseLogprobs bool `json:"responseLogprobs,omitempty"`
+	// Voice used by speech models replying with AUDIO
+	SpeechConfig *SpeechConfig `json:"speechConfig,omitempty"`
+}
+
+type SpeechConfig struct {
+	VoiceConfig struct {
+		PrebuiltVoiceConfig struct {
+			// e.g. Kore, Puck or Charon
+			VoiceName string `json:"voiceName"`
+		} `json:"prebuiltVoiceConfig"`
+	} `json:"voiceConfig"`
+}
+
+type ThinkingConfig struct {
+	// Number of thought tokens the model may generate. 0 disables thinking
+	// where the model allows it, and -1 lets the model decide. Nil uses the
+	// model default.
+	ThinkingBudget *int `json:"thinkingBudget,omitempty"`
+	// Whether thought summaries are returned in the response
+	IncludeThoughts bool `json:"includeThoughts,omitempty"`
+}
+
+// The outcome of a generation
+type Result struct {
+	// Text the model replied with
+	Text string
+	// Thought summaries, only present when thoughts are included
+	Thoughts string
+	// Safety feedback on the prompt from the final request
+	PromptFeedback PromptFeedback
+	// Safety ratings of the candidates from the final request
+	SafetyRatings []SafetyRating
+	// Tokens used across every request made for the generation
+	Usage UsageMetadata
+	// Why the final candidate stopped, e.g. STOP or MAX_TOKENS
+	FinishReason string
+	// Media the model generated inline, such as images
+	Artifacts []tool.Artifact
+	// Prompt tokens of the final request, the size of the whole conversation
+	// as the model last saw it
+	PromptTokens int
+	// Log probability of each token of the reply, when
+	// GenerationConfig.ResponseLogprobs is set
+	Logprobs []float64
+}
+
+// Whether the reply was cut short by GenerationConfig.MaxOutputTokens
+func (r Result) Truncated() bool {
+	return r.FinishReason == "MAX_TOKENS"
+}
+
+// Add sums two usages together
+func (u UsageMetadata) Add(other UsageMetadata) UsageMetadata {
+	return UsageMetadata{
+		PromptTokenCount:        u.PromptTokenCount + other.PromptTokenCount,
+		CachedContentTokenCount: u.CachedContentTokenCount + other.CachedContentTokenCount,
+		CandidatesTokenCount:    u.CandidatesTokenCount + other.CandidatesTokenCount,
+		ToolUsePromptTokenCount: u.ToolUsePromptTokenCount + other.ToolUsePromptTokenCount,
+		ThoughtsTokenCount:      u.ThoughtsTokenCount + other.ThoughtsTokenCount,
+		TotalTokenCount:         u.TotalTokenCount + other.TotalTokenCount,
+	}
 }
 
 type FunctionDeclaration struct {
@@ -101,29 +206,164 @@ type Tool struct {
 	GoogleSearch         struct{}              `json:"google_search,omitzero,omitempty"`
 }
 
+// Controls how the model may call functions
+type ToolConfig struct {
+	FunctionCallingConfig FunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type FunctionCallingConfig struct {
+	// One of AUTO, ANY or NONE
+	Mode string `json:"mode,omitempty"`
+	// Restricts which functions may be called, only valid with ANY
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
 type RequestBody struct {
 	Contents          []Content        `json:"contents,omitempty,omitzero"`
 	CachedContent     string           `json:"cachedContent,omitempty,omitzero"`
 	Tools             []Tool           `json:"tools,omitempty,omitzero"`
+	ToolConfig        *ToolConfig      `json:"toolConfig,omitempty"`
 	GenerationConfig  GenerationConfig `json:"generationConfig,omitzero,omitempty"`
-	SystemInstruction Part             `json:"system_instruction,omitzero,omitempty"`
+	SystemInstruction Content          `json:"system_instruction,omitzero,omitempty"`
+	// User defined metadata attached to the request, such as the end user
+	// identifier. Only Vertex AI accepts labels, the developer API rejects
+	// them, so they are stripped before sending there.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Extra top level fields sent with the request, such as those required
+	// by a gateway sitting in front of gemini. Never stored in history.
+	Extra map[string]any `json:"-"`
+	// Called with each piece of reply text as it streams in, which streams
+	// the request. Set for the generation by Gemini.Stream rather than
+	// directly, and never stored in history.
+	OnText func(text string) `json:"-"`
+}
+
+// AppendSystemInstruction adds another part to the system instruction, allowing
+// dynamic instructions to sit alongside the system prompt. Empty text is ignored.
+func (b *RequestBody) AppendSystemInstruction(text string) {
+	if text == "" {
+		return
+	}
+
+	b.SystemInstruction.Parts = append(b.SystemInstruction.Parts, Part{Text: text})
+}
+
+// AppendUserInput adds a user turn to the end of the contents
+func (b *RequestBody) AppendUserInput(text string) {
+	b.Contents = append(b.Contents, Content{
+		Role:  "user",
+		Parts: []Part{{Text: text}},
+	})
+}
+
+// CompactToolOutputs replaces the response of every function call in the body
+// with the result of fn, letting bulky tool results be shrunk once the model
+// has seen them. Compacted responses are stored as {"output": compacted}.
+func (b *RequestBody) CompactToolOutputs(fn func(output string) string) error {
+	for _, content := range b.Contents {
+		for i, part := range content.Parts {
+			if part.FunctionResponse.Name == "" {
+				continue
+			}
+
+			var output string
+			if wrapped, ok := part.FunctionResponse.Response.(map[string]any); ok && len(wrapped) == 1 {
+				output, _ = wrapped["output"].(string)
+			}
+
+			if output == "" {
+				encoded, err := json.Marshal(part.FunctionResponse.Response)
+				if err != nil {
+					return fmt.Errorf("failed encoding tool output - %w", err)
+				}
+				output = string(encoded)
+			}
+
+			compacted := fn(output)
+			if compacted == output {
+				continue
+			}
+
+			content.Parts[i].FunctionResponse.Response = map[string]any{"output": compacted}
+		}
+	}
+
+	return nil
+}
+
+// SetLabel sets a label on the body, coercing the key and value into the
+// charset allowed for labels (lowercase letters, digits, underscores and
+// dashes, at most 63 characters). Keys not starting with a letter are given
+// a leading k, as vertex rejects them. Empty values remove the label.
+func (b *RequestBody) SetLabel(key string, value string) {
+	key = LabelKey(key)
+
+	if value == "" {
+		delete(b.Labels, key)
+		return
+	}
+
+	if b.Labels == nil {
+		b.Labels = make(map[string]string)
+	}
+
+	b.Labels[key] = labelValue(value)
+}
+
+// LabelKey is the key SetLabel sets a label under, which distinct keys can
+// share, e.g. Tenant and tenant
+func LabelKey(key string) string {
+	key = labelValue(key)
+	if r, _ := utf8.DecodeRuneInString(key); !unicode.IsLetter(r) {
+		key = labelValue("k" + key)
+	}
+
+	return key
+}
+
+func labelValue(value string) string {
+	label := []rune(strings.ToLower(value))
+	for i, r := range label {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			label[i] = '_'
+		}
+	}
+
+	if len(label) > 63 {
+		label = label[:63]
+	}
+
+	return string(label)
 }
 
 type Candidate struct {
-	Content      Content `json:"content,omitzero,omitempty"`
-	FinishReason string  `json:"finish_reason,omitempty,omitzero"`
-	SafetyRating []struct {
-		Category    string `json:"category,omitempty,omitzero"`
-		Probability string `json:"probability,omitempty,omitzero"`
-	} `json:"safety_rating,omitzero,omitempty"`
+	Content       Content        `json:"content,omitzero,omitempty"`
+	FinishReason  string         `json:"finishReason,omitempty,omitzero"`
+	SafetyRatings []SafetyRating `json:"safetyRatings,omitzero,omitempty"`
+	// Only present when GenerationConfig.ResponseLogprobs is set
+	LogprobsResult LogprobsResult `json:"logprobsResult,omitzero"`
+}
+
+type LogprobsResult struct {
+	// The token chosen at each step, with its log probability
+	ChosenCandidates []struct {
+		Token          string  `json:"token"`
+		LogProbability float64 `json:"logProbability"`
+	} `json:"chosenCandidates,omitempty"`
+}
+
+// Feedback on the prompt itself, set when the prompt was blocked or rated
+type PromptFeedback struct {
+	// Why the prompt was blocked, empty if it wasn't
+	BlockReason   string         `json:"blockReason,omitempty"`
+	SafetyRatings []SafetyRating `json:"safetyRatings,omitzero,omitempty"`
 }
 
 // Updated ResponseBody to replace map[string]any with specific fields
 type ResponseBody struct {
 	Candidates     []Candidate    `json:"candidates,omitzero,omitempty"`
-	PromptFeedback string         `json:"promptFeedback,omitzero,omitempty"`
+	PromptFeedback PromptFeedback `json:"promptFeedback,omitzero,omitempty"`
 	UsageMetadata  UsageMetadata  `json:"usageMetadata,omitzero,omitempty"`
-	SafetyRatings  []SafetyRating `json:"safetyRatings,omitzero,omitempty"`
 }
 
 // UsageMetadata represents metadata on token usage
@@ -138,15 +378,47 @@ type UsageMetadata struct {
 
 // SafetyRating represents safety ratings for the generated content
 type SafetyRating struct {
-	Category    string  `json:"category,omitzero,omitempty"`
-	Probability float64 `json:"probability,omitzero,omitempty"`
-	Blocked     bool    `json:"blocked,omitzero,omitempty"`
+	// Harm category, e.g. HARM_CATEGORY_HARASSMENT
+	Category string `json:"category,omitzero,omitempty"`
+	// Likelihood of harm, e.g. NEGLIGIBLE, LOW, MEDIUM or HIGH
+	Probability string `json:"probability,omitzero,omitempty"`
+	// Whether the content was blocked because of this rating
+	Blocked bool `json:"blocked,omitzero,omitempty"`
 }
 
 type Gemini struct {
-	client *http.Client
-	auth   string
-	model  string
+	client  *http.Client
+	auth    string
+	model   string
+	baseURL string
+	// Set by NewVertexClient
+	vertex *Vertex
+	// Wraps every generate content request, see Middleware
+	Middleware []Middleware
+	// Optionally signs every request, for gateways that require it
+	Signer signer.Signer
+	// Optional pool of keys used instead of auth, see keypool.Pool
+	Keys *keypool.Pool
+	// Gzip large request bodies, such as those carrying many tool schemas
+	Compress bool
+	// Requests larger than this, before any compression, fail with
+	// httpclient.ErrRequestTooLarge rather than being sent. 0 allows any
+	// size.
+	MaxRequestBytes int64
+	// Responses larger than this fail with httpclient.ErrResponseTooLarge.
+	// Defaults to httpclient.DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+	// Limits each http round trip to gemini, 0 for none. Unlike a deadline
+	// on the call's context, a round trip that times out is retried.
+	RequestTimeout time.Duration
+	// Attempts at a round trip that times out, defaults to 1
+	RequestAttempts int
+	// Called when the model calls a tool that isn't registered. The model
+	// is told the tool is unknown either way.
+	OnUnknownTool func(ctx context.Context, name string)
+	// Called once a registered tool the model called has run, with the
+	// arguments the model gave, how long it ran and any error it returned
+	OnToolCall func(ctx context.Context, name string, args any, elapsed time.Duration, err error)
 }
 
 func (oa *Gemini) Body(userInput string, prompt string, history json.RawMessage, schema json.RawMessage) (*RequestBody, error) {
@@ -164,16 +436,17 @@ func (oa *Gemini) Body(userInput string, prompt string, history json.RawMessage,
 		}
 	}
 
-	// System prompt
-	body.SystemInstruction.Text = prompt
+	// System prompt, rebuilt every call rather than carried over
+	body.SystemInstruction = Content{}
+	body.AppendSystemInstruction(prompt)
+
+	// Labels and caches are per request, so drop whatever the history
+	// carried
+	body.Labels = nil
+	body.CachedContent = ""
 
 	// User input
-	body.Contents = append(body.Contents, Content{
-		Role: "user",
-		Parts: []Part{{
-			Text: userInput,
-		}},
-	})
+	body.AppendUserInput(userInput)
 
 	// Schema
 	if len(schema) > 0 {
@@ -183,6 +456,8 @@ func (oa *Gemini) Body(userInput string, prompt string, history json.RawMessage,
 			return nil, fmt.Errorf("invalid schema supplied, could not decode it - %w", err)
 		}
 
+		body.GenerationConfig.ResponseMimeType = "application/json"
+		body.GenerationConfig.ResponseSchema.Type = "OBJECT"
 		body.GenerationConfig.ResponseSchema.Properties = jsonSchema.Properties
 		body.GenerationConfig.ResponseSchema.Required = jsonSchema.Required
 	}
@@ -190,33 +465,39 @@ func (oa *Gemini) Body(userInput string, prompt string, history json.RawMessage,
 	return &body, nil
 }
 
-func (oa *Gemini) Generate(ctx context.Context, body *RequestBody, tools []tool.Tool[any, any]) (*RequestBody, string, error) {
+// SetTools offers tools as the body's function declarations, replacing
+// those it held, and reports how they changed
+func (b *RequestBody) SetTools(tools []tool.Tool[any, any]) tool.Changes {
+	var before []FunctionDeclaration
+	for _, t := range b.Tools {
+		before = append(before, t.FunctionDeclarations...)
+	}
+
+	offered := functionDeclarations(tools)
+	b.Tools = []Tool{{FunctionDeclarations: offered}}
+
+	return tool.Diff(before, offered, func(d FunctionDeclaration) string { return d.Name })
+}
+
+func (oa *Gemini) Generate(ctx context.Context, body *RequestBody, tools []tool.Tool[any, any]) (*RequestBody, Result, error) {
 	slog.DebugContext(ctx, "gemini agent called", slog.String("model", oa.model))
 
 	if body == nil {
-		return nil, "", errors.New("nil body")
-	}
-
-	// Set our tools on our body
-	if len(body.Tools) == 0 {
-		functionDecs := make([]FunctionDeclaration, len(tools))
-		for i, tool := range tools {
-			functionDecs[i] = FunctionDeclaration{
-				Name:        tool.Name,
-				Description: tool.Name,
-				Parameters: map[string]any{
-					"type":       "object",
-					"properties": tool.Definition.Properties,
-					"required":   tool.Definition.Required,
-				},
-			}
+		return nil, Result{}, errors.New("nil body")
+	}
+
+	// Tools are offered afresh every request, as those stored with history
+	// may have changed since, unless they are held in cached content
+	if body.CachedContent == "" {
+		offered := len(body.Tools) > 0
+		if changes := body.SetTools(tools); offered && !changes.Empty() {
+			slog.DebugContext(ctx, "tools changed since the last request", slog.Any("changes", changes))
 		}
-		body.Tools = []Tool{{FunctionDeclarations: functionDecs}}
 	}
 
 	// In case we are returning, we need to record
 	// our potential replies
-	reply := ""
+	reply := Result{}
 
 	// We might have function calls that require a resend
 	calls := false
@@ -226,73 +507,76 @@ func (oa *Gemini) Generate(ctx context.Context, body *RequestBody, tools []tool.
 	// exit
 	select {
 	case <-ctx.Done():
-		return nil, "", ctx.Err()
+		return nil, Result{}, ctx.Err()
 	default:
 
 		// Send body and get resp
 		resp, err := oa.generateContent(ctx, *body)
 		if err != nil {
-			return nil, "", err
+			return nil, Result{}, err
+		}
+
+		if resp.PromptFeedback.BlockReason != "" {
+			slog.WarnContext(ctx, "gemini blocked prompt", slog.Any("feedback", resp.PromptFeedback))
+			return nil, Result{}, fmt.Errorf("blocked for %s - %w", resp.PromptFeedback.BlockReason, ErrPromptBlocked)
 		}
 
 		if resp.Candidates == nil {
-			return nil, "", errors.New("invalid output")
+			return nil, Result{}, errors.New("invalid output")
 		}
 
+		reply.PromptFeedback = resp.PromptFeedback
+		reply.Usage = resp.UsageMetadata
+		reply.PromptTokens = resp.UsageMetadata.PromptTokenCount
+
 		for _, candidate := range resp.Candidates {
+			reply.SafetyRatings = append(reply.SafetyRatings, candidate.SafetyRatings...)
+			reply.FinishReason = candidate.FinishReason
+			for _, chosen := range candidate.LogprobsResult.ChosenCandidates {
+				reply.Logprobs = append(reply.Logprobs, chosen.LogProbability)
+			}
+
 			// Ensure our body retains this candidate for our history
 			body.Contents = append(body.Contents, candidate.Content)
 
 			for _, part := range candidate.Content.Parts {
-				if part.FunctionCall.Name == "" {
+				if part.Thought {
+					// Thought summaries are kept in history but
+					// never form part of the reply
+					reply.Thoughts += part.Text
+				} else if part.InlineData != nil {
+					reply.Artifacts = append(reply.Artifacts, tool.Artifact{
+						MimeType: part.InlineData.MimeType,
+						Data:     part.InlineData.Data,
+						Source:   "model",
+					})
+				} else if part.FunctionCall.Name == "" {
 					// We are on a message, rather than a function
 					// call
-					reply += part.Text
+					reply.Text += part.Text
 				} else {
 					// Flip our tool call switch
 					calls = true
 
-					for _, tool := range tools {
-						if tool.Name == part.FunctionCall.Name {
-							out, err := tool.Executable.Execute(ctx, part.FunctionCall.Args)
-							if err != nil {
-								slog.ErrorContext(ctx, "failed to execute tool", slog.Any("tool", part.FunctionCall))
-
-								// Add failed execution to the history
-								body.Contents = append(body.Contents, Content{
-									Role: "user",
-									Parts: []Part{{
-										FunctionResponse: FunctionResponse{
-											Name: part.FunctionCall.Name,
-											Response: map[string]any{
-												"success":       false,
-												"failureReason": err.Error(),
-											},
-										},
-									}},
-								})
-							}
-
-							// Add execution to the history
-							body.Contents = append(body.Contents, Content{
-								Role: "user",
-								Parts: []Part{{
-									FunctionResponse: FunctionResponse{
-										Name:     part.FunctionCall.Name,
-										Response: out,
-									},
-								}},
-							})
-
-						}
-					}
+					body.Contents = append(body.Contents, Content{
+						Role:  "user",
+						Parts: []Part{{FunctionResponse: oa.execute(ctx, part.FunctionCall, tools)}},
+					})
 				}
 
 			}
 		}
 
 		if calls {
-			return oa.Generate(ctx, body, tools)
+			// A forced function call has been honoured, forcing it
+			// again would loop forever
+			body.ToolConfig = nil
+
+			body, next, err := oa.Generate(ctx, body, tools)
+			next.Usage = next.Usage.Add(reply.Usage)
+			next.Thoughts = reply.Thoughts + next.Thoughts
+			next.Artifacts = append(reply.Artifacts, next.Artifacts...)
+			return body, next, err
 		}
 
 	}
@@ -301,52 +585,271 @@ func (oa *Gemini) Generate(ctx context.Context, body *RequestBody, tools []tool.
 	return body, reply, nil
 }
 
-// createResponse sends a POST request to the OpenAI /v1/responses endpoint and parses the response
+// Runs the tool a function call names, describing any failure, including the
+// model calling a tool that doesn't exist, in the response so the model can
+// carry on
+func (oa *Gemini) execute(ctx context.Context, call FunctionCall, tools []tool.Tool[any, any]) FunctionResponse {
+	for _, t := range tools {
+		if t.Name != call.Name {
+			continue
+		}
+
+		start := time.Now()
+		out, err := tool.Execute(ctx, t, any(call.Args))
+		if oa.OnToolCall != nil {
+			oa.OnToolCall(ctx, call.Name, call.Args, time.Since(start), err)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to execute tool", slog.Any("tool", call))
+			return FunctionResponse{
+				Name: call.Name,
+				Response: map[string]any{
+					"success":       false,
+					"failureReason": err.Error(),
+				},
+			}
+		}
+
+		return FunctionResponse{Name: call.Name, Response: out}
+	}
+
+	slog.WarnContext(ctx, "model called unknown tool", slog.String("tool", call.Name))
+	if oa.OnUnknownTool != nil {
+		oa.OnUnknownTool(ctx, call.Name)
+	}
+
+	return FunctionResponse{
+		Name: call.Name,
+		Response: map[string]any{
+			"success":       false,
+			"failureReason": "unknown tool",
+		},
+	}
+}
+
+func functionDeclarations(tools []tool.Tool[any, any]) []FunctionDeclaration {
+	functionDecs := make([]FunctionDeclaration, len(tools))
+	for i, tool := range tools {
+		description := tool.Describe()
+		if description == "" {
+			description = tool.Name
+		}
+
+		functionDecs[i] = FunctionDeclaration{
+			Name:        tool.Name,
+			Description: description,
+			Parameters: map[string]any{
+				"type":       "object",
+				"properties": tool.Definition.Properties,
+				"required":   tool.Definition.Required,
+			},
+		}
+	}
+
+	return functionDecs
+}
+
+// generateContent sends a request through any middleware
 func (oa *Gemini) generateContent(ctx context.Context, body RequestBody) (*ResponseBody, error) {
-	data, err := json.Marshal(body)
+	return oa.handler()(ctx, &body)
+}
+
+// send posts a generate content request to the developer api or vertex
+func (oa *Gemini) send(ctx context.Context, body RequestBody) (*ResponseBody, error) {
+	// The developer API has no concept of labels
+	if oa.vertex == nil {
+		if user := body.Labels[LabelEndUser]; user != "" {
+			slog.DebugContext(ctx, "gemini developer api drops labels, including the end user", slog.String("end_user", user))
+		}
+		body.Labels = nil
+	}
+
+	data, err := withExtra(body, body.Extra)
 	if err != nil {
 		return &ResponseBody{}, err
 	}
 
-	url := fmt.Sprintf("%s/%s:generateContent?key=%s", "https://generativelanguage.googleapis.com/v1beta/models", oa.model, oa.auth)
-	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if body.OnText != nil {
+		return oa.stream(ctx, data, body.OnText)
+	}
+
+	resp, err := oa.request(ctx, oa.method("generateContent"), data)
 	if err != nil {
 		return &ResponseBody{}, err
 	}
-	r.Header.Set("Content-Type", "application/json")
 
-	resp, err := oa.client.Do(r)
-	if err != nil {
+	var generated ResponseBody
+	if err := oa.decode(ctx, resp, &generated); err != nil {
 		return &ResponseBody{}, err
 	}
 
+	return &generated, nil
+}
+
+// Path of a method of the client's model
+func (oa *Gemini) method(name string) string {
+	return oa.modelName() + ":" + name
+}
+
+// Resource name of the client's model, e.g. models/gemini-2.5-flash
+func (oa *Gemini) modelName() string {
+	if oa.vertex != nil {
+		return oa.vertex.location() + "/publishers/google/models/" + oa.model
+	}
+
+	return "models/" + oa.model
+}
+
+// Path of a collection, such as cachedContents, which vertex scopes to the
+// project and region
+func (oa *Gemini) collection(name string) string {
+	if oa.vertex != nil {
+		return oa.vertex.location() + "/" + name
+	}
+
+	return name
+}
+
+// request posts data to a path of the api, such as a method of the client's
+// model. With a key pool, requests rejected as unauthorized or rate limited
+// are retried with another key.
+func (oa *Gemini) request(ctx context.Context, path string, data []byte) (*http.Response, error) {
+	if err := httpclient.CheckRequest(data, oa.MaxRequestBytes); err != nil {
+		return nil, err
+	}
+
+	compressed := false
+	if oa.Compress {
+		var err error
+		if data, compressed, err = httpclient.Compress(data); err != nil {
+			return nil, fmt.Errorf("failed to compress request - %w", err)
+		}
+	}
+
+	// Vertex authenticates with tokens rather than keys
+	keys := oa.Keys
+	if oa.vertex != nil {
+		keys = nil
+	}
+
+	attempts := 1
+	if keys != nil {
+		attempts = keys.Len()
+	}
+
+	for attempt := 1; ; attempt++ {
+		auth := oa.auth
+		if keys != nil {
+			var err error
+			if auth, err = keys.Pick(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := httpclient.RoundTrip(ctx, oa.RequestTimeout, oa.RequestAttempts, func(ctx context.Context) (*http.Response, error) {
+			return oa.post(ctx, path, data, compressed, auth)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if keys != nil {
+			keys.Report(auth, resp.StatusCode, keypool.RetryAfter(resp.Header))
+			if keypool.Rotate(resp.StatusCode) && attempt < attempts {
+				resp.Body.Close()
+				continue
+			}
+		}
+
+		return resp, nil
+	}
+}
+
+// decode streams a response body into out, refusing bodies over the size
+// limit
+func (oa *Gemini) decode(ctx context.Context, resp *http.Response, out any) error {
+	defer resp.Body.Close()
+
+	body, err := oa.body(ctx, resp)
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(body).Decode(out)
+}
+
+// body limits a response body to the client's maximum size, failing with an
+// APIError for anything but 200
+func (oa *Gemini) body(ctx context.Context, resp *http.Response) (io.Reader, error) {
+	limit := oa.MaxResponseBytes
+	if limit <= 0 {
+		limit = httpclient.DefaultMaxResponseBytes
+	}
+	body := httpclient.LimitReader(resp.Body, limit)
+
 	if resp.StatusCode != 200 {
-		failed, err := io.ReadAll(resp.Body)
+		failed, err := io.ReadAll(io.LimitReader(body, 64<<10))
 		if err != nil {
 			slog.ErrorContext(ctx, "non 200 response parsing failed", slog.Any("error", err))
 		}
-		slog.ErrorContext(ctx, "non 200 response from gemini", slog.Any("body", failed))
-		return &ResponseBody{}, fmt.Errorf("invalid status code: %d", resp.StatusCode)
+
+		apiErr := newAPIError(resp.StatusCode, failed)
+		if apiErr.RetryDelay == 0 {
+			apiErr.RetryDelay = keypool.RetryAfter(resp.Header)
+		}
+		slog.ErrorContext(ctx, "non 200 response from gemini", slog.Int("code", apiErr.StatusCode), slog.String("status", apiErr.Status), slog.String("message", apiErr.Message))
+
+		return nil, apiErr
 	}
 
-	respData, err := io.ReadAll(resp.Body)
+	return body, nil
+}
+
+func (oa *Gemini) post(ctx context.Context, path string, data []byte, compressed bool, auth string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/%s", oa.baseURL, path)
+	if oa.vertex == nil {
+		// Paths may carry a query of their own, such as alt=sse
+		if strings.Contains(path, "?") {
+			url += "&key=" + auth
+		} else {
+			url += "?key=" + auth
+		}
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
 	if err != nil {
-		return &ResponseBody{}, err
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if oa.vertex != nil {
+		token, err := oa.vertex.Tokens.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get vertex token - %w", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token.Value)
+	}
+	if compressed {
+		r.Header.Set("Content-Encoding", "gzip")
 	}
 
-	var generated ResponseBody
-	err = json.Unmarshal(respData, &generated)
-	if err != nil {
-		return &ResponseBody{}, err
+	if oa.Signer != nil {
+		if err := oa.Signer.Sign(r, data); err != nil {
+			return nil, fmt.Errorf("failed to sign request - %w", err)
+		}
 	}
 
-	return &generated, nil
+	return oa.client.Do(r)
 }
 
+// NewGeminiClient creates a client, using httpclient.Default when client is nil
 func NewGeminiClient(client *http.Client, auth string, model string) (*Gemini, error) {
+	if client == nil {
+		client = httpclient.Default()
+	}
+
 	return &Gemini{
-		client: client,
-		auth:   auth,
-		model:  model,
+		client:  client,
+		auth:    auth,
+		model:   model,
+		baseURL: "https://generativelanguage.googleapis.com/v1beta",
 	}, nil
 }
@@ -0,0 +1,565 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/credentials"
+	"github.com/calamity-m/clusterfuc/pkg/embed"
+	"github.com/calamity-m/clusterfuc/pkg/speech"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func testClient(t testing.TB, handler http.HandlerFunc) *Gemini {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	g, err := NewGeminiClient(srv.Client(), "test-key", "gemini-2.0-flash")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	g.baseURL = srv.URL
+
+	return g
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	for _, turns := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("%d turns", turns), func(b *testing.B) {
+			g := testClient(b, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"a reply"}]}}]}`))
+			})
+
+			var history RequestBody
+			for i := range turns {
+				history.AppendUserInput(fmt.Sprintf("message number %d with a bit of padding to it", i))
+				history.Contents = append(history.Contents, Content{Role: "model", Parts: []Part{{Text: "a reply"}}})
+			}
+			raw, _ := json.Marshal(history)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for b.Loop() {
+				body, err := g.Body("hello", "be nice", raw, nil)
+				if err != nil {
+					b.Fatalf("did not expect err but got %v", err)
+				}
+
+				if _, _, err := g.Generate(context.Background(), body, nil); err != nil {
+					b.Fatalf("did not expect err but got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestInlineArtifacts(t *testing.T) {
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"a cat"},{"inlineData":{"mimeType":"image/png","data":"iVBO"}}]},"finishReason":"STOP"}]}`))
+	})
+
+	body, err := g.Body("draw a cat", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	_, res, err := g.Generate(context.Background(), body, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "a cat" {
+		t.Errorf("expected a cat but got %s", res.Text)
+	}
+
+	if len(res.Artifacts) != 1 || res.Artifacts[0].MimeType != "image/png" || len(res.Artifacts[0].Data) == 0 {
+		t.Errorf("expected an image artifact but got %#v", res.Artifacts)
+	}
+}
+
+func TestEmbeddings(t *testing.T) {
+	var batches []int
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":embedContent"):
+			var req EmbedContentRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.TaskType != TaskRetrievalQuery || req.OutputDimensionality != 3 {
+				t.Errorf("expected options to be sent but got %#v", req)
+			}
+			w.Write([]byte(`{"embedding":{"values":[0.1,0.2,0.3]}}`))
+
+		case strings.HasSuffix(r.URL.Path, ":batchEmbedContents"):
+			var batch batchEmbedContentsRequest
+			json.NewDecoder(r.Body).Decode(&batch)
+			batches = append(batches, len(batch.Requests))
+
+			var out batchEmbedContentsResponse
+			for _, req := range batch.Requests {
+				if req.Model != "models/gemini-2.0-flash" {
+					t.Errorf("expected model to be filled in but got %s", req.Model)
+				}
+				out.Embeddings = append(out.Embeddings, ContentEmbedding{Values: []float32{float32(len(req.Content.Parts[0].Text))}})
+			}
+			json.NewEncoder(w).Encode(out)
+
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	t.Run("single", func(t *testing.T) {
+		embedding, err := g.EmbedContent(context.Background(), EmbedContentRequest{
+			Content:              Content{Parts: []Part{{Text: "hello"}}},
+			TaskType:             TaskRetrievalQuery,
+			OutputDimensionality: 3,
+		})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(embedding.Values) != 3 {
+			t.Errorf("expected 3 values but got %v", embedding.Values)
+		}
+	})
+
+	t.Run("embedder batches large inputs", func(t *testing.T) {
+		var embedder embed.Embedder = NewEmbedder(g)
+
+		texts := make([]string, 250)
+		for i := range texts {
+			texts[i] = strings.Repeat("a", i)
+		}
+
+		vectors, err := embedder.Embed(context.Background(), texts)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !slices.Equal(batches, []int{100, 100, 50}) {
+			t.Errorf("expected batches of 100, 100 and 50 but got %v", batches)
+		}
+
+		if len(vectors) != 250 || vectors[249][0] != 249 {
+			t.Errorf("expected vectors in input order")
+		}
+	})
+}
+
+func TestGenerateImages(t *testing.T) {
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req imagenRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !strings.HasSuffix(r.URL.Path, ":predict") || req.Instances[0].Prompt != "a cat" || req.Parameters.SampleCount != 2 {
+			t.Errorf("unexpected request to %s with %#v", r.URL.Path, req)
+		}
+
+		w.Write([]byte(`{"predictions":[{"bytesBase64Encoded":"iVBORw==","mimeType":"image/png"},{"bytesBase64Encoded":"iVBORw==","mimeType":"image/png"}]}`))
+	})
+
+	images, err := g.GenerateImages(context.Background(), "a cat", &ImagenParameters{SampleCount: 2, AspectRatio: "1:1"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if len(images) != 2 || images[0].MimeType != "image/png" || string(images[0].Data) != "\x89PNG" {
+		t.Errorf("expected two decoded images but got %#v", images)
+	}
+}
+
+func TestSpeech(t *testing.T) {
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req RequestBody
+		json.NewDecoder(r.Body).Decode(&req)
+
+		if slices.Equal(req.GenerationConfig.ResponseModalities, []string{"AUDIO"}) {
+			if req.GenerationConfig.SpeechConfig == nil || req.GenerationConfig.SpeechConfig.VoiceConfig.PrebuiltVoiceConfig.VoiceName != "Kore" {
+				t.Errorf("expected voice Kore but got %#v", req.GenerationConfig.SpeechConfig)
+			}
+			w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=24000","data":"AAAA"}}]}}]}`))
+			return
+		}
+
+		parts := req.Contents[0].Parts
+		if len(parts) != 2 || parts[1].InlineData == nil || parts[1].InlineData.MimeType != "audio/wav" {
+			t.Errorf("expected prompt and audio parts but got %#v", parts)
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":" hello there\n"}]}}]}`))
+	})
+
+	speaker := NewSpeaker(g)
+	speaker.Voice = "Kore"
+	audio, err := speaker.Synthesize(context.Background(), "hello there")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if audio.MimeType != "audio/L16;codec=pcm;rate=24000" || len(audio.Data) != 3 {
+		t.Errorf("expected pcm audio but got %#v", audio)
+	}
+
+	text, err := NewTranscriber(g).Transcribe(context.Background(), speech.Audio{Data: []byte("RIFF"), MimeType: "audio/wav"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if text != "hello there" {
+		t.Errorf("expected hello there but got %q", text)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		gStatus   string
+		reason    string
+		delay     time.Duration
+		temporary bool
+	}{
+		{
+			name:    "invalid key",
+			status:  http.StatusBadRequest,
+			body:    `{"error":{"code":400,"message":"API key not valid.","status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"API_KEY_INVALID","domain":"googleapis.com"}]}}`,
+			gStatus: StatusInvalidArgument,
+			reason:  "API_KEY_INVALID",
+		},
+		{
+			name:      "rate limited",
+			status:    http.StatusTooManyRequests,
+			body:      `{"error":{"code":429,"message":"Quota exceeded.","status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.rpc.QuotaFailure","violations":[]},{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"34s"}]}}`,
+			gStatus:   StatusResourceExhausted,
+			delay:     34 * time.Second,
+			temporary: true,
+		},
+		{
+			name:      "not json",
+			status:    http.StatusServiceUnavailable,
+			body:      "overloaded",
+			temporary: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			body, err := g.Body("hi", "", nil, nil)
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			_, _, err = g.Generate(context.Background(), body, nil)
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected APIError but got %v", err)
+			}
+
+			if apiErr.StatusCode != tt.status || apiErr.Status != tt.gStatus || apiErr.Reason != tt.reason || apiErr.RetryDelay != tt.delay {
+				t.Errorf("unexpected error fields %#v", apiErr)
+			}
+
+			if apiErr.Temporary() != tt.temporary {
+				t.Errorf("expected temporary %v but got %v", tt.temporary, apiErr.Temporary())
+			}
+		})
+	}
+}
+
+func TestRepairContents(t *testing.T) {
+	user := Content{Role: "user", Parts: []Part{{Text: "weather?"}}}
+	call := Content{Role: "model", Parts: []Part{{FunctionCall: FunctionCall{Name: "weather"}}}}
+	response := Content{Role: "user", Parts: []Part{{FunctionResponse: FunctionResponse{Name: "weather", Response: "sunny"}}}}
+	reply := Content{Role: "model", Parts: []Part{{Text: "sunny"}}}
+
+	t.Run("well formed contents are untouched", func(t *testing.T) {
+		body := RequestBody{Contents: []Content{user, call, response, reply}}
+		repairs, err := body.RepairContents()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(repairs) != 0 || len(body.Contents) != 4 {
+			t.Errorf("expected no repairs but got %v", repairs)
+		}
+	})
+
+	t.Run("calls without response are answered", func(t *testing.T) {
+		body := RequestBody{Contents: []Content{user, call, user}}
+		repairs, err := body.RepairContents()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(repairs) != 1 || len(body.Contents) != 4 || body.Contents[2].Parts[0].FunctionResponse.Name != "weather" {
+			t.Errorf("expected a response after the call but got %+v", body.Contents)
+		}
+	})
+
+	t.Run("orphans and empty contents are dropped", func(t *testing.T) {
+		body := RequestBody{Contents: []Content{user, response, {Role: "model"}, reply}}
+		repairs, err := body.RepairContents()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(repairs) != 3 || len(body.Contents) != 2 {
+			t.Errorf("expected the orphan and empty content to be dropped but got %v", repairs)
+		}
+	})
+
+	t.Run("mixed parts fail", func(t *testing.T) {
+		body := RequestBody{Contents: []Content{{Role: "model", Parts: []Part{{Text: "hi", FunctionCall: FunctionCall{Name: "weather"}}}}}}
+		if _, err := body.RepairContents(); !errors.Is(err, ErrInvalidSequence) {
+			t.Errorf("expected ErrInvalidSequence but got %v", err)
+		}
+	})
+}
+
+func TestCacheContext(t *testing.T) {
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/models/gemini-2.0-flash:generateContent" {
+			var sent map[string]json.RawMessage
+			json.NewDecoder(r.Body).Decode(&sent)
+			if string(sent["cachedContent"]) != `"cachedContents/abc"` || sent["system_instruction"] != nil || sent["tools"] != nil {
+				t.Errorf("expected only the cache to be referenced but got %v", sent)
+			}
+
+			w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]}}]}`))
+			return
+		}
+
+		var sent CachedContent
+		json.NewDecoder(r.Body).Decode(&sent)
+		if r.URL.Path != "/cachedContents" || sent.Model != "models/gemini-2.0-flash" || sent.TTL != "600s" {
+			t.Errorf("unexpected request to %s with %#v", r.URL.Path, sent)
+		}
+		if sent.SystemInstruction.Parts[0].Text != "be nice" || len(sent.Tools) != 0 {
+			t.Errorf("expected the system prompt alone to be cached but got %#v", sent)
+		}
+
+		w.Write([]byte(`{"name":"cachedContents/abc","expireTime":"2030-01-01T00:00:00Z"}`))
+	})
+
+	cached, err := g.CacheContext(context.Background(), "be nice", nil, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if cached.Name != "cachedContents/abc" || cached.ExpireTime.Year() != 2030 {
+		t.Errorf("expected the created cache but got %#v", cached)
+	}
+
+	body, _ := g.Body("hello", "be nice", nil, nil)
+	body.UseCachedContent(cached.Name)
+	if _, _, err := g.Generate(context.Background(), body, nil); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+}
+
+type staticTokens string
+
+func (s staticTokens) Token(ctx context.Context) (credentials.Token, error) {
+	return credentials.Token{Value: string(s), Expiry: time.Now().Add(time.Hour)}, nil
+}
+
+func TestVertex(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer vertex-token" || r.URL.RawQuery != "" {
+			t.Errorf("expected bearer auth without a key but got %q and %q", r.Header.Get("Authorization"), r.URL.RawQuery)
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/cachedContents") {
+			var sent CachedContent
+			json.NewDecoder(r.Body).Decode(&sent)
+			if sent.Model != "projects/proj/locations/us-central1/publishers/google/models/gemini-2.5-flash" {
+				t.Errorf("expected the vertex model name but got %s", sent.Model)
+			}
+			w.Write([]byte(`{"name":"projects/proj/locations/us-central1/cachedContents/abc"}`))
+			return
+		}
+
+		var sent map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&sent)
+		if string(sent["labels"]) != `{"team":"support"}` {
+			t.Errorf("expected labels kept for vertex but got %s", sent["labels"])
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	if _, err := NewVertexClient(nil, Vertex{Project: "proj", Region: "us-central1"}, "gemini-2.5-flash"); err == nil {
+		t.Errorf("expected an error without a token source")
+	}
+
+	g, err := NewVertexClient(srv.Client(), Vertex{Project: "proj", Region: "us-central1", Tokens: staticTokens("vertex-token")}, "gemini-2.5-flash")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if g.baseURL != "https://us-central1-aiplatform.googleapis.com/v1" {
+		t.Errorf("expected the regional endpoint but got %s", g.baseURL)
+	}
+	g.baseURL = srv.URL
+
+	body, _ := g.Body("hello", "be nice", nil, nil)
+	body.SetLabel("team", "support")
+	if _, _, err := g.Generate(context.Background(), body, nil); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if _, err := g.CacheContext(context.Background(), "be nice", nil, time.Minute); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	expected := []string{
+		"/projects/proj/locations/us-central1/publishers/google/models/gemini-2.5-flash:generateContent",
+		"/projects/proj/locations/us-central1/cachedContents",
+	}
+	if !slices.Equal(paths, expected) {
+		t.Errorf("expected %v but got %v", expected, paths)
+	}
+}
+
+func TestSetLabel(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       map[string]string
+	}{
+		{"team", "support", map[string]string{"team": "support"}},
+		{"Tenant ID", "Acme Corp", map[string]string{"tenant_id": "acme_corp"}},
+		{"2fa", "on", map[string]string{"k2fa": "on"}},
+		{"_internal", "yes", map[string]string{"k_internal": "yes"}},
+		{"équipe", "Zürich", map[string]string{"équipe": "zürich"}},
+		{strings.Repeat("a", 80), "x", map[string]string{strings.Repeat("a", 63): "x"}},
+		{"team", "", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			body := RequestBody{Labels: map[string]string{}}
+			body.SetLabel(tt.key, tt.value)
+
+			if !maps.Equal(body.Labels, tt.want) {
+				t.Errorf("expected %v but got %v", tt.want, body.Labels)
+			}
+		})
+	}
+}
+
+// Serves a reply to every request, keeping the raw json of each one sent
+func recordRequests(t *testing.T) (*Gemini, *[]map[string]json.RawMessage) {
+	var sent []map[string]json.RawMessage
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&request)
+		sent = append(sent, request)
+		w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`))
+	})
+
+	return g, &sent
+}
+
+func TestSystemInstruction(t *testing.T) {
+	tests := []struct {
+		name         string
+		history      string
+		prompt       string
+		instructions []string
+		want         string
+	}{
+		{"prompt", "", "be nice", nil, `{"parts":[{"text":"be nice"}]}`},
+		{"parts after the prompt", "", "be nice", []string{"today is monday", "", "the user is bob"},
+			`{"parts":[{"text":"be nice"},{"text":"today is monday"},{"text":"the user is bob"}]}`},
+		{"instructions without a prompt", "", "", []string{"today is monday"}, `{"parts":[{"text":"today is monday"}]}`},
+		{"rebuilt rather than carried over", `{"system_instruction":{"parts":[{"text":"old"},{"text":"older"}]}}`, "be nice", nil,
+			`{"parts":[{"text":"be nice"}]}`},
+		{"omitted when empty", "", "", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, sent := recordRequests(t)
+
+			body, err := g.Body("hello", tt.prompt, json.RawMessage(tt.history), nil)
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+			for _, instruction := range tt.instructions {
+				body.AppendSystemInstruction(instruction)
+			}
+
+			if _, _, err := g.Generate(context.Background(), body, nil); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			if got := string((*sent)[0]["system_instruction"]); got != tt.want {
+				t.Errorf("expected %s but got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	type Query struct {
+		Term string `json:"term"`
+	}
+	lookup := tool.CreateTool("lookup", func(ctx context.Context, in Query) (string, error) { return "found " + in.Term, nil })
+
+	calls := 0
+	g := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/models/gemini-2.0-flash:streamGenerateContent" || r.URL.Query().Get("alt") != "sse" || r.URL.Query().Get("key") != "test-key" {
+			t.Errorf("expected a streamed request but got %s", r.URL)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if calls == 1 {
+			fmt.Fprint(w, `data: {"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"lookup","args":{"term":"it"}}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"totalTokenCount":15}}`+"\n\n")
+			return
+		}
+		fmt.Fprint(w, `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"thinking","thought":true}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"hel"}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"lo"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":20,"totalTokenCount":22}}`+"\n\n")
+	})
+
+	body, err := g.Body("find it", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	var streamed []string
+	body, res, err := g.Stream(context.Background(), body, []tool.Tool[any, any]{lookup}, func(text string) {
+		streamed = append(streamed, text)
+	})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if strings.Join(streamed, "|") != "hel|lo" || res.Text != "hello" || res.Thoughts != "thinking" || res.Usage.TotalTokenCount != 37 {
+		t.Errorf("expected hello streamed in two pieces but got %q and %#v", streamed, res)
+	}
+
+	reply := body.Contents[len(body.Contents)-1]
+	if len(reply.Parts) != 2 || reply.Parts[1].Text != "hello" {
+		t.Errorf("expected the streamed text joined into one part but got %#v", reply.Parts)
+	}
+	if body.OnText != nil {
+		t.Errorf("expected streaming left out of the body once done")
+	}
+}
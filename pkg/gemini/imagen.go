@@ -0,0 +1,65 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Options for generating images with an imagen model
+type ImagenParameters struct {
+	// Number of images, 1 to 4
+	SampleCount int `json:"sampleCount,omitempty"`
+	// e.g. 1:1, 3:4, 4:3, 9:16 or 16:9
+	AspectRatio string `json:"aspectRatio,omitempty"`
+	// 1K or 2K, standard and ultra models only
+	ImageSize string `json:"imageSize,omitempty"`
+	// dont_allow, allow_adult or allow_all
+	PersonGeneration string `json:"personGeneration,omitempty"`
+}
+
+type imagenInstance struct {
+	Prompt string `json:"prompt"`
+}
+
+type imagenRequest struct {
+	Instances  []imagenInstance  `json:"instances"`
+	Parameters *ImagenParameters `json:"parameters,omitempty"`
+}
+
+type imagenResponse struct {
+	Predictions []struct {
+		// Base64 encoded, decoded by json
+		Data     []byte `json:"bytesBase64Encoded"`
+		MimeType string `json:"mimeType"`
+	} `json:"predictions"`
+}
+
+// GenerateImages creates images from a prompt with the client's model, which
+// must be an imagen model such as imagen-4.0-generate-001
+func (oa *Gemini) GenerateImages(ctx context.Context, prompt string, params *ImagenParameters) ([]Blob, error) {
+	data, err := json.Marshal(imagenRequest{
+		Instances:  []imagenInstance{{Prompt: prompt}},
+		Parameters: params,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image request - %w", err)
+	}
+
+	resp, err := oa.request(ctx, oa.method("predict"), data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out imagenResponse
+	if err := oa.decode(ctx, resp, &out); err != nil {
+		return nil, fmt.Errorf("image generation failed - %w", err)
+	}
+
+	images := make([]Blob, 0, len(out.Predictions))
+	for _, prediction := range out.Predictions {
+		images = append(images, Blob{MimeType: prediction.MimeType, Data: prediction.Data})
+	}
+
+	return images, nil
+}
@@ -0,0 +1,343 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+	"github.com/coder/websocket"
+)
+
+const liveURL = "wss://generativelanguage.googleapis.com/ws/google.ai.generativelanguage.v1beta.GenerativeService.BidiGenerateContent"
+
+// Live messages can carry a fair chunk of audio, well past the websocket
+// library's default read limit
+const liveReadLimit = 16 << 20
+
+var ErrLiveClosed = errors.New("live session closed by server")
+
+// Configuration for a live session. Modalities are fixed for the lifetime
+// of a session.
+type LiveConfig struct {
+	// Live capable model, e.g. gemini-2.0-flash-live-001
+	Model string
+	// Optional system instruction for the session
+	SystemPrompt string
+	// Either TEXT or AUDIO, defaults to TEXT
+	ResponseModality string
+	// Optional prebuilt voice used when responding with audio, e.g. Puck
+	Voice string
+	// Tools the model can call, executed automatically while receiving
+	Tools []tool.Tool[any, any]
+}
+
+type liveSetup struct {
+	Model             string               `json:"model"`
+	GenerationConfig  liveGenerationConfig `json:"generationConfig,omitzero"`
+	SystemInstruction Content              `json:"systemInstruction,omitzero"`
+	Tools             []Tool               `json:"tools,omitempty"`
+}
+
+type liveGenerationConfig struct {
+	ResponseModalities []string          `json:"responseModalities,omitempty"`
+	SpeechConfig       *liveSpeechConfig `json:"speechConfig,omitempty"`
+}
+
+type liveSpeechConfig struct {
+	VoiceConfig struct {
+		PrebuiltVoiceConfig struct {
+			VoiceName string `json:"voiceName"`
+		} `json:"prebuiltVoiceConfig"`
+	} `json:"voiceConfig"`
+}
+
+type liveClientContent struct {
+	Turns        []Content `json:"turns"`
+	TurnComplete bool      `json:"turnComplete"`
+}
+
+type liveRealtimeInput struct {
+	Audio          *Blob `json:"audio,omitempty"`
+	AudioStreamEnd bool  `json:"audioStreamEnd,omitempty"`
+}
+
+type liveToolResponse struct {
+	FunctionResponses []FunctionResponse `json:"functionResponses"`
+}
+
+type liveClientMessage struct {
+	Setup         *liveSetup         `json:"setup,omitempty"`
+	ClientContent *liveClientContent `json:"clientContent,omitempty"`
+	RealtimeInput *liveRealtimeInput `json:"realtimeInput,omitempty"`
+	ToolResponse  *liveToolResponse  `json:"toolResponse,omitempty"`
+}
+
+type liveServerMessage struct {
+	SetupComplete *struct{} `json:"setupComplete,omitempty"`
+	ServerContent *struct {
+		ModelTurn    Content `json:"modelTurn,omitzero"`
+		TurnComplete bool    `json:"turnComplete,omitempty"`
+		Interrupted  bool    `json:"interrupted,omitempty"`
+	} `json:"serverContent,omitempty"`
+	ToolCall *struct {
+		FunctionCalls []FunctionCall `json:"functionCalls,omitempty"`
+	} `json:"toolCall,omitempty"`
+	ToolCallCancellation *struct {
+		IDs []string `json:"ids,omitempty"`
+	} `json:"toolCallCancellation,omitempty"`
+	GoAway *struct {
+		TimeLeft string `json:"timeLeft,omitempty"`
+	} `json:"goAway,omitempty"`
+}
+
+// Something the model produced during a live session
+type LiveEvent struct {
+	// Text produced by the model, when responding with text
+	Text string
+	// Audio produced by the model, when responding with audio. Typically
+	// 24kHz 16-bit little endian PCM, see AudioMimeType.
+	Audio         []byte
+	AudioMimeType string
+	// Tool calls the model made, which have already been executed and
+	// responded to
+	ToolCalls []FunctionCall
+	// The model has finished its turn
+	TurnComplete bool
+	// The model was interrupted by new user input
+	Interrupted bool
+	// The server will soon close the connection, with roughly this long left
+	GoAway string
+}
+
+type Live struct {
+	client *http.Client
+	auth   string
+	url    string
+}
+
+// Connect opens a live session and waits for the server to complete setup
+func (l *Live) Connect(ctx context.Context, cfg LiveConfig) (*LiveSession, error) {
+	if cfg.Model == "" {
+		return nil, errors.New("empty live model")
+	}
+
+	conn, _, err := websocket.Dial(ctx, l.url+"?key="+url.QueryEscape(l.auth), &websocket.DialOptions{
+		HTTPClient: l.client,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to gemini live - %w", err)
+	}
+	conn.SetReadLimit(liveReadLimit)
+
+	session := &LiveSession{
+		conn:  conn,
+		tools: cfg.Tools,
+	}
+
+	modality := cfg.ResponseModality
+	if modality == "" {
+		modality = "TEXT"
+	}
+
+	setup := &liveSetup{
+		Model: "models/" + cfg.Model,
+		GenerationConfig: liveGenerationConfig{
+			ResponseModalities: []string{modality},
+		},
+	}
+	if cfg.SystemPrompt != "" {
+		setup.SystemInstruction = Content{Parts: []Part{{Text: cfg.SystemPrompt}}}
+	}
+	if cfg.Voice != "" {
+		setup.GenerationConfig.SpeechConfig = &liveSpeechConfig{}
+		setup.GenerationConfig.SpeechConfig.VoiceConfig.PrebuiltVoiceConfig.VoiceName = cfg.Voice
+	}
+	if len(cfg.Tools) > 0 {
+		setup.Tools = []Tool{{FunctionDeclarations: functionDeclarations(cfg.Tools)}}
+	}
+
+	if err := session.send(ctx, liveClientMessage{Setup: setup}); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	msg, err := session.read(ctx)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if msg.SetupComplete == nil {
+		session.Close()
+		return nil, errors.New("gemini live did not complete setup")
+	}
+
+	return session, nil
+}
+
+// A bidirectional session with the live api. Sends may happen concurrently
+// with Receive, but Receive itself must only be called from one goroutine.
+type LiveSession struct {
+	conn  *websocket.Conn
+	tools []tool.Tool[any, any]
+}
+
+// SendText sends a complete user turn
+func (s *LiveSession) SendText(ctx context.Context, text string) error {
+	return s.send(ctx, liveClientMessage{
+		ClientContent: &liveClientContent{
+			Turns:        []Content{{Role: "user", Parts: []Part{{Text: text}}}},
+			TurnComplete: true,
+		},
+	})
+}
+
+// SendAudio streams a chunk of realtime audio, e.g. 16kHz 16-bit PCM with
+// a mime type of audio/pcm;rate=16000. The server detects when the user has
+// stopped speaking.
+func (s *LiveSession) SendAudio(ctx context.Context, audio []byte, mimeType string) error {
+	return s.send(ctx, liveClientMessage{
+		RealtimeInput: &liveRealtimeInput{
+			Audio: &Blob{MimeType: mimeType, Data: audio},
+		},
+	})
+}
+
+// EndAudio signals the audio stream has paused, such as a muted microphone
+func (s *LiveSession) EndAudio(ctx context.Context) error {
+	return s.send(ctx, liveClientMessage{
+		RealtimeInput: &liveRealtimeInput{AudioStreamEnd: true},
+	})
+}
+
+// Receive blocks until the model produces something. Any tool calls are
+// executed and their results sent back before the event is returned.
+func (s *LiveSession) Receive(ctx context.Context) (LiveEvent, error) {
+	for {
+		msg, err := s.read(ctx)
+		if err != nil {
+			return LiveEvent{}, err
+		}
+
+		switch {
+		case msg.ServerContent != nil:
+			event := LiveEvent{
+				TurnComplete: msg.ServerContent.TurnComplete,
+				Interrupted:  msg.ServerContent.Interrupted,
+			}
+
+			for _, part := range msg.ServerContent.ModelTurn.Parts {
+				if part.InlineData != nil {
+					event.Audio = append(event.Audio, part.InlineData.Data...)
+					event.AudioMimeType = part.InlineData.MimeType
+				} else if !part.Thought {
+					event.Text += part.Text
+				}
+			}
+
+			return event, nil
+
+		case msg.ToolCall != nil:
+			responses := make([]FunctionResponse, 0, len(msg.ToolCall.FunctionCalls))
+			for _, call := range msg.ToolCall.FunctionCalls {
+				responses = append(responses, s.execute(ctx, call))
+			}
+
+			if err := s.send(ctx, liveClientMessage{
+				ToolResponse: &liveToolResponse{FunctionResponses: responses},
+			}); err != nil {
+				return LiveEvent{}, err
+			}
+
+			return LiveEvent{ToolCalls: msg.ToolCall.FunctionCalls}, nil
+
+		case msg.GoAway != nil:
+			return LiveEvent{GoAway: msg.GoAway.TimeLeft}, nil
+
+		case msg.ToolCallCancellation != nil:
+			// Tools are executed synchronously, so by the time a
+			// cancellation arrives there is nothing left to cancel
+			slog.DebugContext(ctx, "gemini live cancelled tool calls", slog.Any("ids", msg.ToolCallCancellation.IDs))
+		}
+	}
+}
+
+// Close ends the session
+func (s *LiveSession) Close() error {
+	return s.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (s *LiveSession) execute(ctx context.Context, call FunctionCall) FunctionResponse {
+	for _, tool := range s.tools {
+		if tool.Name != call.Name {
+			continue
+		}
+
+		out, err := tool.Executable.Execute(ctx, call.Args)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to execute tool", slog.Any("tool", call))
+			return FunctionResponse{
+				ID:   call.ID,
+				Name: call.Name,
+				Response: map[string]any{
+					"success":       false,
+					"failureReason": err.Error(),
+				},
+			}
+		}
+
+		return FunctionResponse{ID: call.ID, Name: call.Name, Response: out}
+	}
+
+	return FunctionResponse{
+		ID:   call.ID,
+		Name: call.Name,
+		Response: map[string]any{
+			"success":       false,
+			"failureReason": "unknown tool",
+		},
+	}
+}
+
+func (s *LiveSession) send(ctx context.Context, msg liveClientMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if err := s.conn.Write(ctx, websocket.MessageText, data); err != nil {
+		return fmt.Errorf("failed to send to gemini live - %w", err)
+	}
+
+	return nil
+}
+
+func (s *LiveSession) read(ctx context.Context) (liveServerMessage, error) {
+	_, data, err := s.conn.Read(ctx)
+	if err != nil {
+		if websocket.CloseStatus(err) != -1 {
+			return liveServerMessage{}, fmt.Errorf("%w - %w", ErrLiveClosed, err)
+		}
+		return liveServerMessage{}, fmt.Errorf("failed to read from gemini live - %w", err)
+	}
+
+	var msg liveServerMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return liveServerMessage{}, fmt.Errorf("failed to decode gemini live message - %w", err)
+	}
+
+	return msg, nil
+}
+
+func NewLiveClient(client *http.Client, auth string) (*Live, error) {
+	return &Live{
+		client: client,
+		auth:   auth,
+		url:    liveURL,
+	}, nil
+}
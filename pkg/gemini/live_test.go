@@ -0,0 +1,96 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+	"github.com/coder/websocket"
+)
+
+func TestLiveSession(t *testing.T) {
+	type Arg struct {
+		Name string `json:"name"`
+	}
+
+	called := ""
+	echo := tool.CreateTool("echo", func(ctx context.Context, in Arg) (Arg, error) {
+		called = in.Name
+		return in, nil
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "test-key" {
+			t.Errorf("expected api key in query but got %q", r.URL.RawQuery)
+		}
+
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to accept websocket - %v", err)
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+
+		var setup liveClientMessage
+		_, data, _ := conn.Read(ctx)
+		json.Unmarshal(data, &setup)
+		if setup.Setup == nil || setup.Setup.Model != "models/live-model" {
+			t.Errorf("expected setup message but got %s", data)
+		}
+		conn.Write(ctx, websocket.MessageText, []byte(`{"setupComplete":{}}`))
+
+		// User turn, reply with a tool call
+		conn.Read(ctx)
+		conn.Write(ctx, websocket.MessageText, []byte(`{"toolCall":{"functionCalls":[{"id":"call-1","name":"echo","args":{"name":"live"}}]}}`))
+
+		var response liveClientMessage
+		_, data, _ = conn.Read(ctx)
+		json.Unmarshal(data, &response)
+		if response.ToolResponse == nil || response.ToolResponse.FunctionResponses[0].ID != "call-1" {
+			t.Errorf("expected tool response for call-1 but got %s", data)
+		}
+
+		conn.Write(ctx, websocket.MessageText, []byte(`{"serverContent":{"modelTurn":{"parts":[{"text":"done"}]},"turnComplete":true}}`))
+		conn.Read(ctx)
+	}))
+	defer srv.Close()
+
+	live, err := NewLiveClient(srv.Client(), "test-key")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	live.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx := context.Background()
+	session, err := live.Connect(ctx, LiveConfig{Model: "live-model", Tools: []tool.Tool[any, any]{echo}})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	defer session.Close()
+
+	if err := session.SendText(ctx, "hello"); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	event, err := session.Receive(ctx)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if len(event.ToolCalls) != 1 || called != "live" {
+		t.Errorf("expected echo tool to be executed but got %#v", event)
+	}
+
+	event, err = session.Receive(ctx)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if event.Text != "done" || !event.TurnComplete {
+		t.Errorf("expected completed text turn but got %#v", event)
+	}
+}
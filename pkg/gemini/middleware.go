@@ -0,0 +1,51 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Sends a generate content request, returning the decoded response
+type Handler func(ctx context.Context, body *RequestBody) (*ResponseBody, error)
+
+// Wraps the sending of generate content requests. Middleware may mutate the
+// body before calling next, and inspect or mutate the response after.
+type Middleware func(next Handler) Handler
+
+// Builds the handler chain, with the first middleware being the outermost
+func (oa *Gemini) handler() Handler {
+	h := Handler(func(ctx context.Context, body *RequestBody) (*ResponseBody, error) {
+		return oa.send(ctx, *body)
+	})
+
+	for i := len(oa.Middleware) - 1; i >= 0; i-- {
+		h = oa.Middleware[i](h)
+	}
+
+	return h
+}
+
+// Encodes v with extra top level fields merged in, overriding any it
+// already has
+func withExtra(v any, extra map[string]any) (json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	for k, v := range extra {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode extra field %s - %w", k, err)
+		}
+		fields[k] = encoded
+	}
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,94 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrInvalidSequence = errors.New("contents are out of order")
+
+// RepairContents checks the contents are in an order gemini accepts, fixing
+// what it can so a malformed response doesn't poison every later turn:
+//
+//   - function calls without a response are given one saying the call was
+//     interrupted
+//   - function responses without a call before them are dropped
+//   - contents left without any parts are dropped
+//
+// It returns a description of each repair made. Parts mixing text with
+// function calls or responses fail with ErrInvalidSequence, leaving the
+// contents as they were.
+func (b *RequestBody) RepairContents() ([]string, error) {
+	for i, content := range b.Contents {
+		for _, part := range content.Parts {
+			if !part.Valid() {
+				return nil, fmt.Errorf("content %d has a part mixing kinds - %w", i, ErrInvalidSequence)
+			}
+		}
+	}
+
+	var repairs []string
+	contents := make([]Content, 0, len(b.Contents))
+	// Names of calls still waiting on a response, in the order they were
+	// made
+	var pending []string
+
+	// Answers every call still pending, before anything but their responses
+	interrupt := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		parts := make([]Part, 0, len(pending))
+		for _, name := range pending {
+			parts = append(parts, Part{FunctionResponse: FunctionResponse{
+				Name: name,
+				Response: map[string]any{
+					"success":       false,
+					"failureReason": "the call was interrupted before it returned",
+				},
+			}})
+			repairs = append(repairs, fmt.Sprintf("added missing response for function call %s", name))
+		}
+		pending = nil
+
+		contents = append(contents, Content{Role: "user", Parts: parts})
+	}
+
+	for i, content := range b.Contents {
+		if !slices.ContainsFunc(content.Parts, func(p Part) bool { return p.FunctionResponse.Name != "" }) {
+			interrupt()
+		}
+
+		parts := make([]Part, 0, len(content.Parts))
+		for _, part := range content.Parts {
+			switch {
+			case part.FunctionCall.Name != "":
+				pending = append(pending, part.FunctionCall.Name)
+			case part.FunctionResponse.Name != "":
+				at := slices.Index(pending, part.FunctionResponse.Name)
+				if at < 0 {
+					repairs = append(repairs, fmt.Sprintf("dropped response for unknown function call %s", part.FunctionResponse.Name))
+					continue
+				}
+				pending = slices.Delete(pending, at, at+1)
+			}
+
+			parts = append(parts, part)
+		}
+
+		if len(parts) == 0 {
+			repairs = append(repairs, fmt.Sprintf("dropped content %d without parts", i))
+			continue
+		}
+
+		content.Parts = parts
+		contents = append(contents, content)
+	}
+	interrupt()
+
+	b.Contents = contents
+
+	return repairs, nil
+}
@@ -0,0 +1,114 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Stream generates like Generate, calling onText with each piece of reply
+// text as it arrives. Text of every request in the tool call loop is
+// streamed, and the result is the same as Generate's once the stream ends.
+// Responses Middleware serves without calling next aren't streamed.
+func (oa *Gemini) Stream(ctx context.Context, body *RequestBody, tools []tool.Tool[any, any], onText func(text string)) (*RequestBody, Result, error) {
+	if body == nil {
+		return nil, Result{}, errors.New("nil body")
+	}
+
+	// Only this generation streams
+	body.OnText = onText
+	defer func() {
+		body.OnText = nil
+	}()
+
+	return oa.Generate(ctx, body, tools)
+}
+
+// Posts a generate content request that streams, merging its chunks into
+// the response it would have been
+func (oa *Gemini) stream(ctx context.Context, data []byte, onText func(string)) (*ResponseBody, error) {
+	resp, err := oa.request(ctx, oa.method("streamGenerateContent")+"?alt=sse", data)
+	if err != nil {
+		return &ResponseBody{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := oa.body(ctx, resp)
+	if err != nil {
+		return &ResponseBody{}, err
+	}
+
+	var merged ResponseBody
+	received := false
+	err = httpclient.Events(body, func(data []byte) error {
+		var chunk ResponseBody
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to decode stream chunk - %w", err)
+		}
+		received = true
+
+		merged.merge(chunk, onText)
+		return nil
+	})
+	if err != nil {
+		return &ResponseBody{}, err
+	}
+
+	if !received {
+		return &ResponseBody{}, errors.New("gemini stream ended without a response")
+	}
+
+	return &merged, nil
+}
+
+// Adds a streamed chunk to the response assembled so far. Consecutive text
+// is joined into one part, as a whole response would hold it.
+func (r *ResponseBody) merge(chunk ResponseBody, onText func(string)) {
+	if chunk.PromptFeedback.BlockReason != "" || len(chunk.PromptFeedback.SafetyRatings) > 0 {
+		r.PromptFeedback = chunk.PromptFeedback
+	}
+	// Each chunk's usage covers the whole response so far
+	if chunk.UsageMetadata != (UsageMetadata{}) {
+		r.UsageMetadata = chunk.UsageMetadata
+	}
+
+	for i, candidate := range chunk.Candidates {
+		if i >= len(r.Candidates) {
+			r.Candidates = append(r.Candidates, Candidate{})
+		}
+		merged := &r.Candidates[i]
+
+		if candidate.Content.Role != "" {
+			merged.Content.Role = candidate.Content.Role
+		}
+		if candidate.FinishReason != "" {
+			merged.FinishReason = candidate.FinishReason
+		}
+		if len(candidate.SafetyRatings) > 0 {
+			merged.SafetyRatings = candidate.SafetyRatings
+		}
+		merged.LogprobsResult.ChosenCandidates = append(merged.LogprobsResult.ChosenCandidates, candidate.LogprobsResult.ChosenCandidates...)
+
+		for _, part := range candidate.Content.Parts {
+			if text(part) && i == 0 && !part.Thought && onText != nil {
+				onText(part.Text)
+			}
+
+			parts := merged.Content.Parts
+			if last := len(parts) - 1; last >= 0 && text(part) && text(parts[last]) && parts[last].Thought == part.Thought {
+				parts[last].Text += part.Text
+				continue
+			}
+			merged.Content.Parts = append(parts, part)
+		}
+	}
+}
+
+// Whether a part holds only text, or thoughts
+func text(part Part) bool {
+	return part.Text != "" && part.InlineData == nil && part.FunctionCall.Name == "" && part.FunctionResponse.Name == ""
+}
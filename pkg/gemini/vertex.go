@@ -0,0 +1,57 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/calamity-m/clusterfuc/pkg/credentials"
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+)
+
+// Where a client reaches gemini through Vertex AI rather than the developer
+// api, authenticating with oauth tokens instead of an api key
+type Vertex struct {
+	Project string
+	// e.g. us-central1, or global
+	Region string
+	// Such as credentials.GCPMetadataSource on GKE, or a
+	// credentials.ServiceAccountSource from a key file
+	Tokens credentials.TokenSource
+}
+
+func (v *Vertex) baseURL() string {
+	if v.Region == "global" {
+		return "https://aiplatform.googleapis.com/v1"
+	}
+
+	return fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1", v.Region)
+}
+
+// Resource name of the project and region
+func (v *Vertex) location() string {
+	return fmt.Sprintf("projects/%s/locations/%s", v.Project, v.Region)
+}
+
+// NewVertexClient creates a client calling model through Vertex AI, using
+// httpclient.Default when client is nil. Keys are ignored, every request
+// carries a bearer token from vertex.Tokens.
+func NewVertexClient(client *http.Client, vertex Vertex, model string) (*Gemini, error) {
+	if vertex.Project == "" || vertex.Region == "" {
+		return nil, errors.New("vertex needs a project and region")
+	}
+	if vertex.Tokens == nil {
+		return nil, errors.New("vertex needs a token source")
+	}
+
+	if client == nil {
+		client = httpclient.Default()
+	}
+
+	return &Gemini{
+		client:  client,
+		model:   model,
+		baseURL: vertex.baseURL(),
+		vertex:  &vertex,
+	}, nil
+}
@@ -0,0 +1,260 @@
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Bodies smaller than this aren't worth compressing
+const compressThreshold = 1024
+
+type Options struct {
+	// Overall timeout of a request, 0 for none. Generations can take a
+	// while, so prefer context deadlines for anything tighter.
+	Timeout time.Duration
+	// Connections kept idle per provider host, defaults to 32. Go's default
+	// of 2 forces agents making concurrent calls to redial constantly.
+	MaxIdleConnsPerHost int
+	// Limits connections per provider host, 0 for no limit
+	MaxConnsPerHost int
+	// How long idle connections are kept, defaults to 90s
+	IdleConnTimeout time.Duration
+}
+
+// New returns a client tuned for talking to model providers, keeping
+// connections alive between calls and preferring http/2. Gzipped responses
+// are requested and transparently decoded.
+func New(opts *Options) *http.Client {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.MaxIdleConnsPerHost <= 0 {
+		o.MaxIdleConnsPerHost = 32
+	}
+	if o.IdleConnTimeout <= 0 {
+		o.IdleConnTimeout = 90 * time.Second
+	}
+
+	return &http.Client{
+		Timeout: o.Timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          o.MaxIdleConnsPerHost * 4,
+			MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       o.MaxConnsPerHost,
+			IdleConnTimeout:       o.IdleConnTimeout,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultClient *http.Client
+)
+
+// Default returns a shared client made by New, used by provider clients
+// that aren't given one
+func Default() *http.Client {
+	defaultOnce.Do(func() {
+		defaultClient = New(nil)
+	})
+
+	return defaultClient
+}
+
+// Compress gzips a request body worth compressing, reporting whether it did.
+// Callers should set Content-Encoding: gzip when it has.
+func Compress(data []byte) ([]byte, bool, error) {
+	if len(data) < compressThreshold {
+		return data, false, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+// Responses larger than this are rejected unless configured otherwise
+const DefaultMaxResponseBytes = 32 << 20
+
+var (
+	ErrResponseTooLarge = errors.New("response exceeded size limit")
+	ErrRequestTooLarge  = errors.New("request exceeded size limit")
+)
+
+// A request or response over its size limit, matching ErrRequestTooLarge
+// or ErrResponseTooLarge with errors.Is
+type SizeError struct {
+	Err   error
+	Limit int64
+	// Size of the request. Responses are only read one byte past the limit,
+	// so their size is unknown and left 0.
+	Size int64
+}
+
+func (e *SizeError) Error() string {
+	if e.Size > 0 {
+		return fmt.Sprintf("%v - %d bytes over a limit of %d", e.Err, e.Size, e.Limit)
+	}
+
+	return fmt.Sprintf("%v - over a limit of %d bytes", e.Err, e.Limit)
+}
+
+func (e *SizeError) Unwrap() error {
+	return e.Err
+}
+
+// CheckRequest fails with a SizeError when a request body is over limit
+// bytes, so it can be refused before it is sent. A limit of 0 allows any
+// size.
+func CheckRequest(data []byte, limit int64) error {
+	if limit > 0 && int64(len(data)) > limit {
+		return &SizeError{Err: ErrRequestTooLarge, Limit: limit, Size: int64(len(data))}
+	}
+
+	return nil
+}
+
+// LimitReader reads from r, failing with a SizeError matching
+// ErrResponseTooLarge once more than n bytes have been read, rather than
+// quietly stopping like io.LimitReader
+func LimitReader(r io.Reader, n int64) io.Reader {
+	return &limitedReader{r: r, limit: n, remaining: n}
+}
+
+type limitedReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, &SizeError{Err: ErrResponseTooLarge, Limit: l.limit}
+	}
+
+	// Read one byte past the limit to tell a response of exactly the limit
+	// apart from one going over it
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), &SizeError{Err: ErrResponseTooLarge, Limit: l.limit}
+	}
+
+	return n, err
+}
+
+// RoundTrip sends a request with send, limiting each attempt to timeout. The
+// limit covers reading the response body too, so it is released once the
+// body is closed. Attempts that time out are retried up to attempts times,
+// unless ctx itself is done. A timeout of 0 sends once without a limit.
+func RoundTrip(ctx context.Context, timeout time.Duration, attempts int, send func(ctx context.Context) (*http.Response, error)) (*http.Response, error) {
+	if timeout <= 0 {
+		return send(ctx)
+	}
+
+	attempts = max(attempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+
+		resp, err := send(attemptCtx)
+		if err == nil {
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		cancel()
+
+		if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil || attempt >= attempts {
+			return nil, err
+		}
+
+		slog.WarnContext(ctx, "provider round trip timed out, retrying", slog.Duration("timeout", timeout), slog.Int("attempt", attempt))
+	}
+}
+
+// Releases a round trip's timeout once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Events reads a server-sent event stream, calling fn with the data of each
+// event in turn until the stream ends or fn fails. Events without data, such
+// as keep alive comments, are skipped.
+func Events(r io.Reader, fn func(data []byte) error) error {
+	reader := bufio.NewReader(r)
+	var data []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		// A blank line ends an event, as does the end of the stream
+		if len(line) == 0 || err == io.EOF {
+			if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+				data = appendData(data, value)
+			}
+			if len(data) > 0 {
+				if err := fn(data); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			data = nil
+			continue
+		}
+
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = appendData(data, value)
+		}
+	}
+}
+
+// Adds a data field to an event's data, which joins them with newlines
+func appendData(data []byte, value []byte) []byte {
+	value = bytes.TrimPrefix(value, []byte(" "))
+	if data != nil {
+		data = append(data, '\n')
+	}
+
+	return append(data, value...)
+}
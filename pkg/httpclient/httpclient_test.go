@@ -0,0 +1,164 @@
+package httpclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompress(t *testing.T) {
+	t.Run("small bodies are left alone", func(t *testing.T) {
+		out, compressed, err := Compress([]byte(`{"a":1}`))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if compressed || string(out) != `{"a":1}` {
+			t.Errorf("expected body to be untouched but got %s", out)
+		}
+	})
+
+	t.Run("large bodies round trip", func(t *testing.T) {
+		body := bytes.Repeat([]byte(`{"type":"function","name":"lookup"},`), 100)
+
+		out, compressed, err := Compress(body)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !compressed || len(out) >= len(body) {
+			t.Fatalf("expected body to shrink but went from %d to %d", len(body), len(out))
+		}
+
+		r, err := gzip.NewReader(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		decoded, _ := io.ReadAll(r)
+		if !bytes.Equal(decoded, body) {
+			t.Errorf("expected decoded body to match")
+		}
+	})
+}
+
+func TestLimitReader(t *testing.T) {
+	t.Run("at the limit", func(t *testing.T) {
+		out, err := io.ReadAll(LimitReader(strings.NewReader("12345"), 5))
+		if err != nil || string(out) != "12345" {
+			t.Errorf("expected full read but got %q and %v", out, err)
+		}
+	})
+
+	t.Run("over the limit", func(t *testing.T) {
+		_, err := io.ReadAll(LimitReader(strings.NewReader("123456"), 5))
+		if !errors.Is(err, ErrResponseTooLarge) {
+			t.Errorf("expected ErrResponseTooLarge but got %v", err)
+		}
+
+		var size *SizeError
+		if !errors.As(err, &size) || size.Limit != 5 {
+			t.Errorf("expected a SizeError with the limit but got %v", err)
+		}
+	})
+}
+
+func TestCheckRequest(t *testing.T) {
+	if err := CheckRequest([]byte("12345"), 5); err != nil {
+		t.Errorf("did not expect err but got %v", err)
+	}
+	if err := CheckRequest([]byte("123456"), 0); err != nil {
+		t.Errorf("did not expect err without a limit but got %v", err)
+	}
+
+	err := CheckRequest([]byte("123456"), 5)
+	var size *SizeError
+	if !errors.Is(err, ErrRequestTooLarge) || !errors.As(err, &size) || size.Size != 6 {
+		t.Errorf("expected a SizeError for 6 bytes but got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	send := func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return srv.Client().Do(req)
+	}
+
+	t.Run("slow round trips are retried", func(t *testing.T) {
+		resp, err := RoundTrip(context.Background(), 50*time.Millisecond, 2, send)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "ok" || calls.Load() != 2 {
+			t.Errorf("expected ok on the second attempt but got %q after %d", body, calls.Load())
+		}
+	})
+
+	t.Run("gives up after its attempts", func(t *testing.T) {
+		calls.Store(0)
+		_, err := RoundTrip(context.Background(), 50*time.Millisecond, 1, send)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded but got %v", err)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	stream := ": keep alive\n\n" +
+		"event: delta\ndata: {\"a\":1}\n\n" +
+		"data: first\r\ndata: second\r\n\r\n" +
+		"data: [DONE]"
+
+	var events []string
+	err := Events(strings.NewReader(stream), func(data []byte) error {
+		events = append(events, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	want := []string{`{"a":1}`, "first\nsecond", "[DONE]"}
+	if strings.Join(events, "|") != strings.Join(want, "|") {
+		t.Errorf("expected events %q but got %q", want, events)
+	}
+
+	t.Run("stops at the first failure", func(t *testing.T) {
+		failed := errors.New("failed")
+		calls := 0
+		err := Events(strings.NewReader("data: 1\n\ndata: 2\n\n"), func([]byte) error {
+			calls++
+			return failed
+		})
+		if !errors.Is(err, failed) || calls != 1 {
+			t.Errorf("expected one call failing with %v but got %d calls and %v", failed, calls, err)
+		}
+	})
+}
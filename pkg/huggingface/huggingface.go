@@ -0,0 +1,186 @@
+// Package huggingface calls models served by Hugging Face Inference
+// Endpoints, or any text-generation-inference (TGI) server, through the
+// openai client's chat completions mode.
+package huggingface
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+// TGI serves a single model and ignores the name it is sent, which is only
+// reported back. This is the name it reports when given none.
+const DefaultModel = "tgi"
+
+// Functions TGI offers the model alongside the tools it was sent, letting
+// it reply without calling any. Older releases call the second notify_error.
+const (
+	noTool      = "no_tool"
+	notifyError = "notify_error"
+)
+
+// How TGI departs from openai's chat completions, mostly in constraining
+// the model with a grammar built from the tools or schema it is sent
+type TGI struct {
+	// Optionally replaces the prompt TGI puts before the tools it describes
+	// to the model
+	ToolPrompt string
+}
+
+// Dialect adapts an openai client's chat completions to TGI
+func (t TGI) Dialect() openai.Dialect {
+	return openai.Dialect{Request: t.request, Completion: completion}
+}
+
+func (t TGI) request(request *openai.ChatCompletionRequest, extra map[string]any) {
+	if request.Model == "" {
+		request.Model = DefaultModel
+	}
+
+	// TGI constrains tool calls with a grammar of its own, and refuses a
+	// second one for the reply. The schema is asked for instead, and the
+	// reply checked against it by the caller.
+	if format := request.ResponseFormat; format != nil {
+		request.ResponseFormat = nil
+		if len(request.Tools) > 0 {
+			instruction := "Once you have finished calling tools, reply only with JSON matching this schema:\n" + string(format.JSONSchema.Schema)
+			if len(request.Messages) > 0 && request.Messages[0].Role == "system" {
+				request.Messages[0].Content += "\n\n" + instruction
+			} else {
+				request.Messages = append([]openai.ChatMessage{{Role: "system", Content: instruction}}, request.Messages...)
+			}
+		} else {
+			extra["response_format"] = map[string]any{"type": "json", "value": format.JSONSchema.Schema}
+		}
+	}
+
+	// TGI rejects a tool choice when no tools are offered
+	if len(request.Tools) == 0 {
+		request.ToolChoice = nil
+		return
+	}
+
+	extra["tools"] = definitions(request.Tools)
+	if t.ToolPrompt != "" {
+		extra["tool_prompt"] = t.ToolPrompt
+	}
+}
+
+// TGI compiles the parameters of every tool into the grammar constraining
+// the model's tool calls, a choice between objects each naming their
+// function in a _name property alongside its parameters. The grammar fails
+// to build from a missing properties or required, so both are always sent,
+// and the name and description are left out of the parameters as TGI adds
+// its own.
+func definitions(tools []openai.ChatTool) []map[string]any {
+	defs := make([]map[string]any, len(tools))
+	for i, t := range tools {
+		description := t.Function.Description
+		if description == "" {
+			description = t.Function.Name
+		}
+
+		properties := t.Function.Parameters.Properties
+		if len(properties) == 0 || string(properties) == "null" {
+			properties = json.RawMessage(`{}`)
+		}
+		required := t.Function.Parameters.Required
+		if required == nil {
+			required = []string{}
+		}
+
+		defs[i] = map[string]any{
+			"type": "function",
+			"function": map[string]any{
+				"name":        t.Function.Name,
+				"description": description,
+				"parameters": map[string]any{
+					"type":       "object",
+					"properties": properties,
+					"required":   required,
+				},
+			},
+		}
+	}
+
+	return defs
+}
+
+// Tidies the tool calls of a reply. A call of TGI's own no_tool function is
+// the model answering without tools, so becomes the reply's text. TGI
+// numbers calls from 0 in every reply, so ids are made unique across the
+// conversation for outputs to find their call.
+func completion(request openai.ChatCompletionRequest, completion *openai.ChatCompletion) {
+	if len(completion.Choices) == 0 {
+		return
+	}
+	message := &completion.Choices[0].Message
+
+	if len(message.ToolCalls) == 1 {
+		if name := message.ToolCalls[0].Function.Name; name == noTool || name == notifyError {
+			var args struct {
+				Content string `json:"content"`
+				Error   string `json:"error"`
+			}
+			json.Unmarshal([]byte(message.ToolCalls[0].Function.Arguments), &args)
+
+			message.ToolCalls = nil
+			if message.Content == "" {
+				message.Content = args.Content + args.Error
+			}
+			return
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, m := range request.Messages {
+		for _, call := range m.ToolCalls {
+			seen[call.ID] = true
+		}
+	}
+	for i, call := range message.ToolCalls {
+		if call.ID == "" || seen[call.ID] {
+			message.ToolCalls[i].ID = fmt.Sprintf("call_%d_%d", len(request.Messages), i)
+		}
+		message.ToolCalls[i].Type = "function"
+		seen[message.ToolCalls[i].ID] = true
+
+		// The grammar names the function being called with _name, which
+		// some releases leave in the arguments
+		var args map[string]json.RawMessage
+		if json.Unmarshal([]byte(call.Function.Arguments), &args) == nil {
+			if _, ok := args["_name"]; ok {
+				delete(args, "_name")
+				encoded, _ := json.Marshal(args)
+				message.ToolCalls[i].Function.Arguments = string(encoded)
+			}
+		}
+	}
+}
+
+// NewHuggingFaceClient creates an openai client for the Inference Endpoint
+// or TGI server at endpoint, e.g.
+// https://xyz.us-east-1.aws.endpoints.huggingface.cloud. A server of one's
+// own may need no auth. It uses httpclient.Default when client is nil.
+func NewHuggingFaceClient(client *http.Client, endpoint string, auth string) (*openai.OpenAI, error) {
+	if endpoint == "" {
+		return nil, errors.New("huggingface needs the address of an endpoint")
+	}
+
+	// The messages api lives under /v1, which the address may already hold
+	endpoint = strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), "/v1")
+
+	oa, err := openai.NewCompatibleClient(client, auth, endpoint+"/v1")
+	if err != nil {
+		return nil, err
+	}
+	oa.ChatCompletions = true
+	oa.Dialect = TGI{}.Dialect()
+
+	return oa, nil
+}
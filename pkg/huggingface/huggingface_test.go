@@ -0,0 +1,185 @@
+package huggingface
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func testClient(t testing.TB, handler http.HandlerFunc) *openai.OpenAI {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	oa, err := NewHuggingFaceClient(srv.Client(), srv.URL+"/v1/", "test-key")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	return oa
+}
+
+type weather struct {
+	City string `json:"city"`
+}
+
+func TestGenerate(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("expected /v1/chat/completions but got %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("expected bearer auth but got %s", r.Header.Get("Authorization"))
+		}
+
+		var sent map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&sent)
+		requests = append(requests, sent)
+
+		// TGI replies with the arguments as an object and numbers calls
+		// from 0 every reply
+		switch len(requests) {
+		case 1, 2:
+			w.Write([]byte(`{"id":"","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","tool_calls":[
+				{"id":"0","type":"function","function":{"description":null,"name":"weather","arguments":{"_name":"weather","city":"Perth"}}}
+			]}}],"usage":{"prompt_tokens":20,"completion_tokens":5,"total_tokens":25}}`))
+		default:
+			w.Write([]byte(`{"id":"","choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","tool_calls":[
+				{"id":"0","type":"function","function":{"name":"no_tool","arguments":{"content":"sunny in Perth"}}}
+			]}}],"usage":{"prompt_tokens":40,"completion_tokens":4,"total_tokens":44}}`))
+		}
+	})
+
+	oa.Dialect = TGI{ToolPrompt: "use these"}.Dialect()
+	var args []any
+	oa.OnToolCall = func(ctx context.Context, name string, in any, elapsed time.Duration, err error) {
+		args = append(args, in)
+	}
+
+	tools := []tool.Tool[any, any]{tool.CreateTool("weather", func(ctx context.Context, in weather) (string, error) {
+		return "sunny in " + in.City, nil
+	})}
+
+	body, err := oa.Body("", "weather in perth?", "be nice", nil, json.RawMessage(`{"type":"object"}`))
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	body.ToolChoice, _ = openai.ToolChoice("required", "weather")
+
+	body, res, err := oa.Generate(context.Background(), body, tools)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "sunny in Perth" {
+		t.Errorf("expected the no_tool content as the reply but got %q", res.Text)
+	}
+	if res.Usage.TotalTokens != 94 || res.PromptTokens != 40 {
+		t.Errorf("expected usage summed across requests but got %+v, prompt %d", res.Usage, res.PromptTokens)
+	}
+
+	if len(args) != 2 || args[0] != `{"city":"Perth"}` {
+		t.Errorf("expected the arguments as a string without _name but got %v", args)
+	}
+
+	if string(requests[0]["model"]) != `"tgi"` {
+		t.Errorf("expected the default model but got %s", requests[0]["model"])
+	}
+	if string(requests[0]["tool_prompt"]) != `"use these"` {
+		t.Errorf("expected the tool prompt but got %s", requests[0]["tool_prompt"])
+	}
+	if _, ok := requests[0]["response_format"]; ok {
+		t.Errorf("expected no grammar alongside tools but got %s", requests[0]["response_format"])
+	}
+	if _, ok := requests[1]["tool_choice"]; ok {
+		t.Errorf("expected the required choice dropped once honoured but got %s", requests[1]["tool_choice"])
+	}
+
+	var offered []struct {
+		Function struct {
+			Parameters map[string]json.RawMessage `json:"parameters"`
+		} `json:"function"`
+	}
+	json.Unmarshal(requests[0]["tools"], &offered)
+	if params := offered[0].Function.Parameters; params["required"] == nil || params["properties"] == nil {
+		t.Errorf("expected properties and required for the grammar but got %s", requests[0]["tools"])
+	}
+
+	var sent []openai.ChatMessage
+	json.Unmarshal(requests[0]["messages"], &sent)
+	if sent[0].Role != "system" || sent[0].Content == "be nice" {
+		t.Errorf("expected the schema asked for with the system prompt but got %+v", sent[0])
+	}
+
+	json.Unmarshal(requests[2]["messages"], &sent)
+	calls := map[string]bool{}
+	for _, message := range sent {
+		for _, call := range message.ToolCalls {
+			calls[call.ID] = true
+		}
+	}
+	if len(calls) != 2 {
+		t.Errorf("expected each call a unique id but got %v", calls)
+	}
+	// input, two calls with their outputs and the reply
+	if len(body.Input) != 6 {
+		t.Errorf("expected 6 history items but got %d", len(body.Input))
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	var sent map[string]json.RawMessage
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Write([]byte(`{"choices":[{"index":0,"finish_reason":"length","message":{"role":"assistant","content":"{\"a\""}}]}`))
+	})
+	oa.Dialect = TGI{ToolPrompt: "use these"}.Dialect()
+
+	body, _ := oa.Body("meta-llama/Llama-3.1-8B-Instruct", "hello", "", nil, json.RawMessage(`{"type":"object"}`))
+	_, res, err := oa.Generate(context.Background(), body, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if string(sent["response_format"]) != `{"type":"json","value":{"type":"object"}}` {
+		t.Errorf("expected the schema as a json grammar but got %s", sent["response_format"])
+	}
+	if _, ok := sent["tool_prompt"]; ok {
+		t.Errorf("expected no tool prompt without tools but got %s", sent["tool_prompt"])
+	}
+	if !res.Truncated() {
+		t.Errorf("expected the reply truncated")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"Model is loading","error_type":"overloaded"}`))
+	})
+
+	body, _ := oa.Body("tgi", "hello", "", nil, nil)
+	_, _, err := oa.Generate(context.Background(), body, nil)
+
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError but got %v", err)
+	}
+
+	if apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "Model is loading" {
+		t.Errorf("expected the loading error but got %+v", apiErr)
+	}
+
+	if _, err := NewHuggingFaceClient(nil, "", ""); err == nil {
+		t.Errorf("expected an endpoint to be required")
+	}
+}
@@ -0,0 +1,129 @@
+package keypool
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrNoKeys = errors.New("no usable api keys")
+
+// How long a rate limited key rests when the provider doesn't say
+const defaultCooldown = 30 * time.Second
+
+type entry struct {
+	key     string
+	uses    int64
+	resting time.Time
+	revoked bool
+}
+
+// A set of api keys for one provider, spreading requests across them. Keys
+// rejected as unauthorized are dropped from rotation, and rate limited keys
+// rest until the provider says they can be used again.
+type Pool struct {
+	mux  sync.Mutex
+	keys []*entry
+	now  func() time.Time
+}
+
+// Pick returns the least used key that isn't resting. When every key is
+// resting, the one available soonest is returned rather than failing.
+func (p *Pool) Pick() (string, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	now := p.now()
+
+	var best, soonest *entry
+	for _, e := range p.keys {
+		if e.revoked {
+			continue
+		}
+
+		if now.Before(e.resting) {
+			if soonest == nil || e.resting.Before(soonest.resting) {
+				soonest = e
+			}
+			continue
+		}
+
+		if best == nil || e.uses < best.uses {
+			best = e
+		}
+	}
+
+	if best == nil {
+		best = soonest
+	}
+
+	if best == nil {
+		return "", ErrNoKeys
+	}
+
+	best.uses++
+	return best.key, nil
+}
+
+// Report records the status of a request made with key. A retryAfter of 0
+// uses a default cooldown for rate limited keys.
+func (p *Pool) Report(key string, status int, retryAfter time.Duration) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, e := range p.keys {
+		if e.key != key {
+			continue
+		}
+
+		switch status {
+		case http.StatusUnauthorized:
+			e.revoked = true
+		case http.StatusTooManyRequests:
+			if retryAfter <= 0 {
+				retryAfter = defaultCooldown
+			}
+			e.resting = p.now().Add(retryAfter)
+		}
+	}
+}
+
+// Len is the number of keys in the pool, including revoked ones
+func (p *Pool) Len() int {
+	return len(p.keys)
+}
+
+// Rotate reports whether a request that failed with status should be
+// retried with another key
+func Rotate(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusTooManyRequests
+}
+
+// RetryAfter reads the Retry-After header as seconds, returning 0 when it
+// is missing or a date
+func RetryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func NewPool(keys ...string) (*Pool, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	p := &Pool{now: time.Now}
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("empty api key in pool")
+		}
+		p.keys = append(p.keys, &entry{key: key})
+	}
+
+	return p, nil
+}
@@ -0,0 +1,47 @@
+package keypool
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	t.Run("spreads use", func(t *testing.T) {
+		p, _ := NewPool("a", "b")
+
+		first, _ := p.Pick()
+		second, _ := p.Pick()
+		if first == second {
+			t.Errorf("expected different keys but got %s twice", first)
+		}
+	})
+
+	t.Run("rate limited keys rest", func(t *testing.T) {
+		p, _ := NewPool("a", "b")
+		now := time.Now()
+		p.now = func() time.Time { return now }
+
+		p.Report("a", http.StatusTooManyRequests, time.Minute)
+		for range 3 {
+			if key, _ := p.Pick(); key != "b" {
+				t.Errorf("expected b while a rests but got %s", key)
+			}
+		}
+
+		now = now.Add(2 * time.Minute)
+		if key, _ := p.Pick(); key != "a" {
+			t.Errorf("expected rested a to be picked but got %s", key)
+		}
+	})
+
+	t.Run("unauthorized keys are dropped", func(t *testing.T) {
+		p, _ := NewPool("a")
+		p.Report("a", http.StatusUnauthorized, 0)
+
+		if _, err := p.Pick(); !errors.Is(err, ErrNoKeys) {
+			t.Errorf("expected ErrNoKeys but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package memoriser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Stores each session as a file in a directory, for single host deployments
+// and for tools such as the session inspector to read
+type FileMemoriser struct {
+	Dir string
+}
+
+// Ids may hold slashes, such as namespaced ones, so are escaped into a single
+// file name
+func (f *FileMemoriser) path(id string) string {
+	return filepath.Join(f.Dir, url.PathEscape(id)+".json")
+}
+
+func (f *FileMemoriser) Save(id string, latest json.RawMessage) bool {
+	// Written aside then renamed, so readers never see half a session
+	tmp, err := os.CreateTemp(f.Dir, ".session-*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(latest); err != nil {
+		tmp.Close()
+		return false
+	}
+	if err := tmp.Close(); err != nil {
+		return false
+	}
+
+	return os.Rename(tmp.Name(), f.path(id)) == nil
+}
+
+func (f *FileMemoriser) Retrieve(id string) (json.RawMessage, error) {
+	data, err := os.ReadFile(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
+
+func (f *FileMemoriser) Delete(id string) error {
+	err := os.Remove(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (f *FileMemoriser) List(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		id, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func NewFileMemoriser(dir string) (*FileMemoriser, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session directory - %w", err)
+	}
+
+	return &FileMemoriser{Dir: dir}, nil
+}
@@ -0,0 +1,46 @@
+package memoriser
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestFileMemoriser(t *testing.T) {
+	f, err := NewFileMemoriser(t.TempDir())
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if _, err := f.Retrieve("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound but got %v", err)
+	}
+
+	for _, id := range []string{"tenant/a/1", "tenant/a/2", "other"} {
+		if !f.Save(id, json.RawMessage(`"`+id+`"`)) {
+			t.Fatalf("expected %s to be saved", id)
+		}
+	}
+	f.Save("other", json.RawMessage(`"replaced"`))
+
+	if hist, err := f.Retrieve("tenant/a/1"); err != nil || string(hist) != `"tenant/a/1"` {
+		t.Errorf("expected saved session but got %s, %v", hist, err)
+	}
+	if hist, _ := f.Retrieve("other"); string(hist) != `"replaced"` {
+		t.Errorf("expected latest save to win but got %s", hist)
+	}
+
+	ids, err := f.List("tenant/")
+	slices.Sort(ids)
+	if err != nil || !slices.Equal(ids, []string{"tenant/a/1", "tenant/a/2"}) {
+		t.Errorf("expected tenant sessions but got %v, %v", ids, err)
+	}
+
+	if err := f.Delete("tenant/a/1"); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if _, err := f.Retrieve("tenant/a/1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected deleted session to be gone but got %v", err)
+	}
+}
@@ -3,12 +3,17 @@ package memoriser
 import (
 	"encoding/json"
 	"errors"
+	"slices"
+	"strings"
 	"sync"
 )
 
+var ErrNotFound = errors.New("not found")
+
 type InMemoryMemoriser struct {
 	mux     sync.RWMutex
 	history map[string]json.RawMessage
+	logs    map[string][]json.RawMessage
 }
 
 func (in *InMemoryMemoriser) Save(id string, latest json.RawMessage) bool {
@@ -26,15 +31,61 @@ func (in *InMemoryMemoriser) Retrieve(id string) (json.RawMessage, error) {
 
 	hist, ok := in.history[id]
 	if !ok {
-		return nil, errors.New("not found")
+		return nil, ErrNotFound
 	}
 
 	return hist, nil
 }
 
+func (in *InMemoryMemoriser) Append(id string, entries ...json.RawMessage) error {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	in.logs[id] = append(in.logs[id], entries...)
+
+	return nil
+}
+
+func (in *InMemoryMemoriser) Entries(id string) ([]json.RawMessage, error) {
+	in.mux.RLock()
+	defer in.mux.RUnlock()
+
+	return slices.Clone(in.logs[id]), nil
+}
+
+func (in *InMemoryMemoriser) Delete(id string) error {
+	in.mux.Lock()
+	defer in.mux.Unlock()
+
+	delete(in.history, id)
+	delete(in.logs, id)
+
+	return nil
+}
+
+func (in *InMemoryMemoriser) List(prefix string) ([]string, error) {
+	in.mux.RLock()
+	defer in.mux.RUnlock()
+
+	ids := make([]string, 0)
+	for id := range in.history {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	for id := range in.logs {
+		if _, saved := in.history[id]; !saved && strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
 func NewInMemoryMemoriser() *InMemoryMemoriser {
 	m := &InMemoryMemoriser{
 		history: make(map[string]json.RawMessage, 0),
+		logs:    make(map[string][]json.RawMessage),
 	}
 
 	return m
@@ -0,0 +1,267 @@
+package memoriser
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LayeredOptions struct {
+	// Number of sessions that may be waiting on a durable write before
+	// saves fall back to writing synchronously. Defaults to 1024.
+	QueueSize int
+	// Number of times a failed durable write is retried. Defaults to 3.
+	Retries int
+	// Delay between durable write retries, doubling each attempt. Defaults
+	// to 100ms.
+	Backoff time.Duration
+	// Called when a durable write has exhausted its retries. The history is
+	// still held by the cache, but will be lost if the cache drops it.
+	OnWriteFailure func(id string, history json.RawMessage)
+}
+
+type pendingWrite struct {
+	history json.RawMessage
+	seq     uint64
+}
+
+// Layers a fast cache over a durable Memoriser. Reads are served from the
+// cache, falling back to the durable store and warming the cache on a miss.
+// Saves land in the cache immediately and are written behind to the durable
+// store in the background, with writes for the same session coalesced.
+//
+// Close must be called to flush outstanding durable writes.
+//
+// Sessions can be deleted when both layers are Deleters, and listed when the
+// durable store is a Lister.
+type LayeredMemoriser struct {
+	cache   Memoriser
+	durable Memoriser
+	opts    LayeredOptions
+
+	// Held while writing to the durable store, so a deleted session can't
+	// be written back by a write already under way
+	writing sync.Mutex
+	mux     sync.Mutex
+	pending map[string]pendingWrite
+	seq     uint64
+	closed  bool
+	queue   chan string
+	done    chan struct{}
+}
+
+func (l *LayeredMemoriser) Save(id string, latest json.RawMessage) bool {
+	ok := l.cache.Save(id, latest)
+
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return l.durable.Save(id, latest) && ok
+	}
+
+	_, queued := l.pending[id]
+	l.seq++
+	l.pending[id] = pendingWrite{history: latest, seq: l.seq}
+
+	if queued {
+		// The queued write will pick up the latest history
+		l.mux.Unlock()
+		return ok
+	}
+
+	select {
+	case l.queue <- id:
+		l.mux.Unlock()
+	default:
+		// Queue is full, apply back pressure rather than dropping the write
+		l.mux.Unlock()
+		slog.Warn("layered memoriser queue full, writing synchronously", slog.String("id", id))
+		l.write(id)
+	}
+
+	return ok
+}
+
+func (l *LayeredMemoriser) Retrieve(id string) (json.RawMessage, error) {
+	// A pending write is always newer than what the durable store has
+	l.mux.Lock()
+	latest, ok := l.pending[id]
+	l.mux.Unlock()
+	if ok {
+		return latest.history, nil
+	}
+
+	if hist, err := l.cache.Retrieve(id); err == nil {
+		return hist, nil
+	}
+
+	hist, err := l.durable.Retrieve(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.cache.Save(id, hist) {
+		slog.Warn("failed to warm layered memoriser cache", slog.String("id", id))
+	}
+
+	return hist, nil
+}
+
+// Delete removes a session from both layers, along with any write of it
+// still waiting to reach the durable store
+func (l *LayeredMemoriser) Delete(id string) error {
+	cache, ok := l.cache.(Deleter)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+	durable, ok := l.durable.(Deleter)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+
+	l.writing.Lock()
+	defer l.writing.Unlock()
+
+	l.mux.Lock()
+	delete(l.pending, id)
+	l.mux.Unlock()
+
+	if err := cache.Delete(id); err != nil {
+		return err
+	}
+
+	return durable.Delete(id)
+}
+
+// List returns the ids of the durable store starting with prefix, along with
+// those still waiting to be written to it
+func (l *LayeredMemoriser) List(prefix string) ([]string, error) {
+	lister, ok := l.durable.(Lister)
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+
+	ids, err := lister.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for id := range l.pending {
+		if strings.HasPrefix(id, prefix) && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// Close stops accepting background writes and blocks until the outstanding
+// ones have been written to the durable store
+func (l *LayeredMemoriser) Close() {
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.queue)
+	l.mux.Unlock()
+
+	<-l.done
+}
+
+func (l *LayeredMemoriser) run() {
+	defer close(l.done)
+
+	for id := range l.queue {
+		l.write(id)
+	}
+}
+
+// Writes the latest pending history of a session to the durable store,
+// repeating until nothing newer has arrived for it
+func (l *LayeredMemoriser) write(id string) {
+	l.writing.Lock()
+	defer l.writing.Unlock()
+
+	for {
+		l.mux.Lock()
+		latest, ok := l.pending[id]
+		l.mux.Unlock()
+		if !ok {
+			return
+		}
+
+		saved := l.save(id, latest.history)
+
+		l.mux.Lock()
+		current := l.pending[id]
+		done := current.seq == latest.seq
+		if done {
+			delete(l.pending, id)
+		}
+		l.mux.Unlock()
+
+		if !saved {
+			slog.Error("layered memoriser failed durable write", slog.String("id", id))
+			if l.opts.OnWriteFailure != nil {
+				l.opts.OnWriteFailure(id, latest.history)
+			}
+		}
+
+		if done {
+			return
+		}
+	}
+}
+
+// Saves to the durable store, retrying with backoff
+func (l *LayeredMemoriser) save(id string, history json.RawMessage) bool {
+	backoff := l.opts.Backoff
+	for attempt := 0; attempt <= l.opts.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if l.durable.Save(id, history) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewLayeredMemoriser(cache Memoriser, durable Memoriser, opts *LayeredOptions) *LayeredMemoriser {
+	o := LayeredOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1024
+	}
+	if o.Retries <= 0 {
+		o.Retries = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 100 * time.Millisecond
+	}
+
+	l := &LayeredMemoriser{
+		cache:   cache,
+		durable: durable,
+		opts:    o,
+		pending: make(map[string]pendingWrite),
+		queue:   make(chan string, o.QueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go l.run()
+
+	return l
+}
@@ -0,0 +1,145 @@
+package memoriser
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type failingMemoriser struct {
+	attempts atomic.Int32
+}
+
+func (f *failingMemoriser) Save(string, json.RawMessage) bool {
+	f.attempts.Add(1)
+	return false
+}
+
+func (f *failingMemoriser) Retrieve(string) (json.RawMessage, error) {
+	return nil, ErrNotFound
+}
+
+func TestLayeredMemoriser(t *testing.T) {
+	t.Run("writes behind to durable store", func(t *testing.T) {
+		cache, durable := NewInMemoryMemoriser(), NewInMemoryMemoriser()
+		l := NewLayeredMemoriser(cache, durable, nil)
+
+		for _, h := range []string{`1`, `2`, `3`} {
+			if !l.Save("id", json.RawMessage(h)) {
+				t.Fatalf("expected save to succeed")
+			}
+		}
+
+		hist, err := l.Retrieve("id")
+		if err != nil || string(hist) != `3` {
+			t.Errorf("expected latest history but got %s, %v", hist, err)
+		}
+
+		l.Close()
+
+		hist, err = durable.Retrieve("id")
+		if err != nil || string(hist) != `3` {
+			t.Errorf("expected durable store to hold latest history but got %s, %v", hist, err)
+		}
+	})
+
+	t.Run("reads fall through and warm the cache", func(t *testing.T) {
+		cache, durable := NewInMemoryMemoriser(), NewInMemoryMemoriser()
+		durable.Save("id", json.RawMessage(`"durable"`))
+
+		l := NewLayeredMemoriser(cache, durable, nil)
+		defer l.Close()
+
+		hist, err := l.Retrieve("id")
+		if err != nil || string(hist) != `"durable"` {
+			t.Errorf("expected durable history but got %s, %v", hist, err)
+		}
+
+		if hist, err := cache.Retrieve("id"); err != nil || string(hist) != `"durable"` {
+			t.Errorf("expected cache to be warmed but got %s, %v", hist, err)
+		}
+	})
+
+	t.Run("failed durable writes are reported", func(t *testing.T) {
+		durable := &failingMemoriser{}
+		failed := make(chan string, 1)
+
+		l := NewLayeredMemoriser(NewInMemoryMemoriser(), durable, &LayeredOptions{
+			Retries: 2,
+			Backoff: time.Millisecond,
+			OnWriteFailure: func(id string, history json.RawMessage) {
+				failed <- id
+			},
+		})
+
+		l.Save("id", json.RawMessage(`1`))
+		l.Close()
+
+		select {
+		case id := <-failed:
+			if id != "id" {
+				t.Errorf("expected failure for id but got %s", id)
+			}
+		default:
+			t.Errorf("expected write failure to be reported")
+		}
+
+		if durable.attempts.Load() != 3 {
+			t.Errorf("expected 3 attempts but got %d", durable.attempts.Load())
+		}
+	})
+	t.Run("deletes from both layers", func(t *testing.T) {
+		cache, durable := NewInMemoryMemoriser(), NewInMemoryMemoriser()
+		l := NewLayeredMemoriser(cache, durable, nil)
+		defer l.Close()
+
+		l.Save("a", json.RawMessage(`1`))
+		l.Save("b", json.RawMessage(`2`))
+		if err := l.Delete("a"); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		l.Close()
+
+		for name, m := range map[string]Memoriser{"layered": l, "cache": cache, "durable": durable} {
+			if _, err := m.Retrieve("a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected a deleted from %s but got %v", name, err)
+			}
+		}
+		if hist, err := durable.Retrieve("b"); err != nil || string(hist) != `2` {
+			t.Errorf("expected b kept but got %s, %v", hist, err)
+		}
+
+		if err := NewLayeredMemoriser(cache, &failingMemoriser{}, nil).Delete("b"); !errors.Is(err, ErrDeleteUnsupported) {
+			t.Errorf("expected ErrDeleteUnsupported but got %v", err)
+		}
+	})
+
+	t.Run("lists durable and pending sessions", func(t *testing.T) {
+		durable := NewInMemoryMemoriser()
+		durable.Save("user-1/old", json.RawMessage(`1`))
+		l := NewLayeredMemoriser(NewInMemoryMemoriser(), durable, nil)
+		defer l.Close()
+
+		// Held back from the durable store until it is checked
+		l.writing.Lock()
+		l.Save("user-1/new", json.RawMessage(`2`))
+		l.Save("user-2/other", json.RawMessage(`3`))
+		ids, err := l.List("user-1/")
+		l.writing.Unlock()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		slices.Sort(ids)
+		if !slices.Equal(ids, []string{"user-1/new", "user-1/old"}) {
+			t.Errorf("expected both of user-1's sessions but got %v", ids)
+		}
+
+		if _, err := NewLayeredMemoriser(durable, &failingMemoriser{}, nil).List(""); !errors.Is(err, ErrListUnsupported) {
+			t.Errorf("expected ErrListUnsupported but got %v", err)
+		}
+	})
+}
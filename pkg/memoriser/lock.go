@@ -0,0 +1,72 @@
+package memoriser
+
+import (
+	"context"
+	"sync"
+)
+
+// Locks sessions so only one call at a time loads and saves each, keeping
+// concurrent calls from clobbering each other's history. Implementations
+// backed by a shared store, such as redis with SET NX PX and a lease that
+// is renewed while held, let locks hold across replicas.
+type Locker interface {
+	// Lock blocks until id is held or ctx is done, returning a func that
+	// releases it
+	Lock(ctx context.Context, id string) (unlock func(), err error)
+}
+
+// Locks sessions within a single process. The zero value is ready to use.
+type LocalLocker struct {
+	mux   sync.Mutex
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	held chan struct{}
+	// Callers holding or waiting on the lock, which is forgotten once none
+	// are left
+	refs int
+}
+
+func (l *LocalLocker) Lock(ctx context.Context, id string) (func(), error) {
+	l.mux.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*localLock)
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &localLock{held: make(chan struct{}, 1)}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	l.mux.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+	case <-ctx.Done():
+		l.release(id, lock)
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-lock.held
+			l.release(id, lock)
+		})
+	}, nil
+}
+
+func (l *LocalLocker) release(id string, lock *localLock) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, id)
+	}
+}
+
+func NewLocalLocker() *LocalLocker {
+	return &LocalLocker{locks: make(map[string]*localLock)}
+}
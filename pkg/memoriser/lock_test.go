@@ -0,0 +1,67 @@
+package memoriser
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocalLocker(t *testing.T) {
+	t.Run("one holder at a time", func(t *testing.T) {
+		var l LocalLocker
+
+		unlock, err := l.Lock(t.Context(), "id")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		acquired := make(chan struct{})
+		go func() {
+			second, err := l.Lock(context.Background(), "id")
+			if err == nil {
+				second()
+			}
+			close(acquired)
+		}()
+
+		other, err := l.Lock(t.Context(), "other")
+		if err != nil {
+			t.Fatalf("expected other ids to be free but got %v", err)
+		}
+		other()
+
+		select {
+		case <-acquired:
+			t.Fatalf("expected second lock to wait")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		unlock()
+		unlock()
+
+		select {
+		case <-acquired:
+		case <-time.After(time.Second):
+			t.Fatalf("expected second lock once the first was released")
+		}
+
+		if len(l.locks) != 0 {
+			t.Errorf("expected released locks to be forgotten but got %d", len(l.locks))
+		}
+	})
+
+	t.Run("waiting ends with ctx", func(t *testing.T) {
+		l := NewLocalLocker()
+
+		unlock, _ := l.Lock(t.Context(), "id")
+		defer unlock()
+
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		defer cancel()
+
+		if _, err := l.Lock(ctx, "id"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded but got %v", err)
+		}
+	})
+}
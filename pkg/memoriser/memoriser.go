@@ -10,6 +10,34 @@ type Memoriser interface {
 	Retrieve(string) (json.RawMessage, error)
 }
 
+// Memorisers able to remove stored history
+type Deleter interface {
+	Delete(id string) error
+}
+
+// Memorisers able to enumerate the ids they hold
+type Lister interface {
+	// List returns every stored id starting with prefix
+	List(prefix string) ([]string, error)
+}
+
+// Memorisers able to store a session as a log of entries, so each call only
+// has to write what changed rather than the whole history. The agent prefers
+// this over Save and Retrieve when a Memoriser supports it.
+type Appender interface {
+	// Append adds entries to the end of a session's log
+	Append(id string, entries ...json.RawMessage) error
+	// Entries returns a session's log in the order it was appended, and
+	// nothing when the session has no log
+	Entries(id string) ([]json.RawMessage, error)
+}
+
+// Memorisers able to reject a session before any work is done for it, such
+// as when a quota has been reached
+type Admitter interface {
+	Admit(id string) error
+}
+
 type NoOpMemoriser struct {
 }
 
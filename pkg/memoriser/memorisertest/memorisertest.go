@@ -0,0 +1,135 @@
+// Package memorisertest provides a Memoriser for unit tests that records
+// every save, so tests can assert how a conversation's history evolves.
+package memorisertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+)
+
+// Checks a saved session, returning why it doesn't match
+type Matcher func(saved json.RawMessage) error
+
+// Turns matches sessions that have completed the given number of calls
+func Turns(n int) Matcher {
+	return func(saved json.RawMessage) error {
+		var session struct {
+			Turns int `json:"turns"`
+		}
+		if err := json.Unmarshal(saved, &session); err != nil {
+			return fmt.Errorf("session is not json: %v", err)
+		}
+
+		if session.Turns != n {
+			return fmt.Errorf("expected %d turns but got %d", n, session.Turns)
+		}
+
+		return nil
+	}
+}
+
+// Contains matches sessions whose history includes text anywhere, such as a
+// user input or model reply
+func Contains(text string) Matcher {
+	return func(saved json.RawMessage) error {
+		var session struct {
+			History json.RawMessage `json:"history"`
+		}
+		if err := json.Unmarshal(saved, &session); err != nil {
+			return fmt.Errorf("session is not json: %v", err)
+		}
+
+		// Compare against the encoded form, so quotes and newlines in text
+		// are escaped the same way as in the history
+		encoded, _ := json.Marshal(text)
+		if !bytes.Contains(session.History, bytes.Trim(encoded, `"`)) {
+			return fmt.Errorf("expected history to contain %q", text)
+		}
+
+		return nil
+	}
+}
+
+// A Memoriser keeping every version of every session it is given. Sessions
+// must be saved as plain json, so avoid encrypting serializers with it.
+type Recorder struct {
+	mux   sync.Mutex
+	saves map[string][]json.RawMessage
+}
+
+func (r *Recorder) Save(id string, latest json.RawMessage) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.saves[id] = append(r.saves[id], bytes.Clone(latest))
+
+	return true
+}
+
+func (r *Recorder) Retrieve(id string) (json.RawMessage, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	saves := r.saves[id]
+	if len(saves) == 0 {
+		return nil, memoriser.ErrNotFound
+	}
+
+	return saves[len(saves)-1], nil
+}
+
+// Saves returns every version of a session in the order they were saved
+func (r *Recorder) Saves(id string) []json.RawMessage {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return append([]json.RawMessage(nil), r.saves[id]...)
+}
+
+// AssertSaves fails the test unless a session was saved exactly n times
+func (r *Recorder) AssertSaves(t testing.TB, id string, n int) {
+	t.Helper()
+
+	if saves := len(r.Saves(id)); saves != n {
+		t.Errorf("expected %s to be saved %d times but got %d", id, n, saves)
+	}
+}
+
+// AssertSave fails the test unless the nth save of a session, counting from
+// 0, satisfies every matcher. Negative n counts back from the latest save.
+func (r *Recorder) AssertSave(t testing.TB, id string, n int, matchers ...Matcher) {
+	t.Helper()
+
+	saves := r.Saves(id)
+	if n < 0 {
+		n += len(saves)
+	}
+
+	if n < 0 || n >= len(saves) {
+		t.Errorf("expected save %d of %s but it was saved %d times", n, id, len(saves))
+		return
+	}
+
+	for _, match := range matchers {
+		if err := match(saves[n]); err != nil {
+			t.Errorf("save %d of %s: %v", n, id, err)
+		}
+	}
+}
+
+// AssertLatest fails the test unless the latest save of a session satisfies
+// every matcher
+func (r *Recorder) AssertLatest(t testing.TB, id string, matchers ...Matcher) {
+	t.Helper()
+
+	r.AssertSave(t, id, -1, matchers...)
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{saves: make(map[string][]json.RawMessage)}
+}
@@ -0,0 +1,37 @@
+package memorisertest
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+
+	if _, err := r.Retrieve("id"); !errors.Is(err, memoriser.ErrNotFound) {
+		t.Errorf("expected ErrNotFound but got %v", err)
+	}
+
+	r.Save("id", json.RawMessage(`{"turns":1,"history":{"input":[{"role":"user","content":"say \"hi\""}]}}`))
+	r.Save("id", json.RawMessage(`{"turns":2,"history":{"input":[{"role":"user","content":"say \"hi\""},{"role":"user","content":"again"}]}}`))
+
+	r.AssertSaves(t, "id", 2)
+	r.AssertSave(t, "id", 0, Turns(1), Contains(`say "hi"`))
+	r.AssertLatest(t, "id", Turns(2), Contains("again"))
+
+	latest, err := r.Retrieve("id")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if Turns(2)(latest) != nil {
+		t.Errorf("expected latest save to be retrieved but got %s", latest)
+	}
+
+	if Contains("missing")(latest) == nil {
+		t.Errorf("expected missing text not to match")
+	}
+}
@@ -0,0 +1,268 @@
+package memoriser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrQuotaExceeded         = errors.New("namespace quota exceeded")
+	ErrDeleteUnsupported     = errors.New("memoriser does not support deletion")
+	ErrInvalidNamespace      = errors.New("invalid namespace")
+	ErrNamespacesUnsupported = errors.New("memoriser does not support namespaces")
+	ErrListUnsupported       = errors.New("memoriser does not support listing")
+)
+
+// A Memoriser partitioned into isolated namespaces, such as one per tenant
+type NamespacedMemoriser interface {
+	// Namespace returns a Memoriser that can only see the sessions of ns
+	Namespace(ns string) (Memoriser, error)
+	// DeleteNamespace removes every session within ns
+	DeleteNamespace(ns string) error
+}
+
+// Limits applied to each namespace. Zero values are unlimited.
+type NamespaceQuota struct {
+	// Maximum number of sessions within a namespace
+	MaxSessions int
+	// Maximum total bytes of history within a namespace
+	MaxBytes int
+}
+
+// Partitions any Memoriser into namespaces by prefixing ids with their
+// escaped namespace. Deleting a namespace requires the underlying Memoriser
+// to be both a Lister and a Deleter.
+//
+// Used directly as a Memoriser it acts as a default namespace, isolated from
+// every named one.
+//
+// Quotas are tracked in process. Namespaces already holding sessions are
+// measured on first use when the underlying Memoriser is a Lister.
+type PrefixNamespacer struct {
+	base  Memoriser
+	quota NamespaceQuota
+
+	mux   sync.Mutex
+	sizes map[string]map[string]int
+}
+
+func (p *PrefixNamespacer) Namespace(ns string) (Memoriser, error) {
+	if ns == "" {
+		return nil, fmt.Errorf("empty namespace - %w", ErrInvalidNamespace)
+	}
+
+	return p.view(ns), nil
+}
+
+// Named namespaces never escape to an empty string, so a bare separator
+// prefix keeps the default namespace apart from them
+func (p *PrefixNamespacer) view(ns string) *namespace {
+	return &namespace{parent: p, ns: ns, prefix: url.PathEscape(ns) + "/"}
+}
+
+func (p *PrefixNamespacer) Save(id string, latest json.RawMessage) bool {
+	return p.view("").Save(id, latest)
+}
+
+func (p *PrefixNamespacer) Retrieve(id string) (json.RawMessage, error) {
+	return p.view("").Retrieve(id)
+}
+
+func (p *PrefixNamespacer) Admit(id string) error {
+	return p.view("").Admit(id)
+}
+
+func (p *PrefixNamespacer) Delete(id string) error {
+	return p.view("").Delete(id)
+}
+
+func (p *PrefixNamespacer) List(prefix string) ([]string, error) {
+	return p.view("").List(prefix)
+}
+
+func (p *PrefixNamespacer) DeleteNamespace(ns string) error {
+	lister, ok := p.base.(Lister)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+	deleter, ok := p.base.(Deleter)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+
+	ids, err := lister.List(url.PathEscape(ns) + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list namespace %s - %w", ns, err)
+	}
+
+	for _, id := range ids {
+		if err := deleter.Delete(id); err != nil {
+			return fmt.Errorf("failed to delete %s - %w", id, err)
+		}
+	}
+
+	p.mux.Lock()
+	delete(p.sizes, ns)
+	p.mux.Unlock()
+
+	return nil
+}
+
+// Usage reports how many sessions and bytes of history a namespace holds,
+// as far as this process knows
+func (p *PrefixNamespacer) Usage(ns string) (sessions int, bytes int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, size := range p.measure(ns) {
+		sessions++
+		bytes += size
+	}
+
+	return sessions, bytes
+}
+
+// Returns the known session sizes of a namespace, measuring it through the
+// underlying Memoriser the first time. Must be called with the lock held.
+func (p *PrefixNamespacer) measure(ns string) map[string]int {
+	if sizes, ok := p.sizes[ns]; ok {
+		return sizes
+	}
+
+	sizes := make(map[string]int)
+	p.sizes[ns] = sizes
+
+	lister, ok := p.base.(Lister)
+	if !ok {
+		return sizes
+	}
+
+	prefix := url.PathEscape(ns) + "/"
+	ids, err := lister.List(prefix)
+	if err != nil {
+		slog.Error("failed to measure namespace", slog.String("namespace", ns), slog.Any("error", err))
+		return sizes
+	}
+
+	for _, id := range ids {
+		if hist, err := p.base.Retrieve(id); err == nil {
+			sizes[strings.TrimPrefix(id, prefix)] = len(hist)
+		}
+	}
+
+	return sizes
+}
+
+// Checks whether saving size bytes for id would break the quota. Must be
+// called with the lock held.
+func (p *PrefixNamespacer) allowed(ns string, id string, size int) error {
+	sizes := p.measure(ns)
+	current, exists := sizes[id]
+
+	if !exists && p.quota.MaxSessions > 0 && len(sizes) >= p.quota.MaxSessions {
+		return fmt.Errorf("namespace %s has %d sessions - %w", ns, len(sizes), ErrQuotaExceeded)
+	}
+
+	if p.quota.MaxBytes > 0 {
+		total := size - current
+		for _, s := range sizes {
+			total += s
+		}
+
+		if total > p.quota.MaxBytes {
+			return fmt.Errorf("namespace %s would hold %d bytes - %w", ns, total, ErrQuotaExceeded)
+		}
+	}
+
+	return nil
+}
+
+type namespace struct {
+	parent *PrefixNamespacer
+	ns     string
+	prefix string
+}
+
+func (n *namespace) Save(id string, latest json.RawMessage) bool {
+	n.parent.mux.Lock()
+	defer n.parent.mux.Unlock()
+
+	if err := n.parent.allowed(n.ns, id, len(latest)); err != nil {
+		slog.Warn("refusing to save session", slog.String("id", id), slog.Any("error", err))
+		return false
+	}
+
+	if !n.parent.base.Save(n.prefix+id, latest) {
+		return false
+	}
+
+	n.parent.measure(n.ns)[id] = len(latest)
+
+	return true
+}
+
+func (n *namespace) Retrieve(id string) (json.RawMessage, error) {
+	return n.parent.base.Retrieve(n.prefix + id)
+}
+
+// Admit rejects new sessions once the namespace is at its session quota, and
+// any session once it is at its byte quota
+func (n *namespace) Admit(id string) error {
+	n.parent.mux.Lock()
+	defer n.parent.mux.Unlock()
+
+	return n.parent.allowed(n.ns, id, 0)
+}
+
+func (n *namespace) Delete(id string) error {
+	deleter, ok := n.parent.base.(Deleter)
+	if !ok {
+		return ErrDeleteUnsupported
+	}
+
+	if err := deleter.Delete(n.prefix + id); err != nil {
+		return err
+	}
+
+	n.parent.mux.Lock()
+	delete(n.parent.measure(n.ns), id)
+	n.parent.mux.Unlock()
+
+	return nil
+}
+
+func (n *namespace) List(prefix string) ([]string, error) {
+	lister, ok := n.parent.base.(Lister)
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+
+	ids, err := lister.List(n.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		ids[i] = strings.TrimPrefix(id, n.prefix)
+	}
+
+	return ids, nil
+}
+
+// Creates a namespaced view over base. Quota may be nil for no limits.
+func NewPrefixNamespacer(base Memoriser, quota *NamespaceQuota) *PrefixNamespacer {
+	p := &PrefixNamespacer{
+		base:  base,
+		sizes: make(map[string]map[string]int),
+	}
+	if quota != nil {
+		p.quota = *quota
+	}
+
+	return p
+}
@@ -0,0 +1,74 @@
+package memoriser
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestPrefixNamespacer(t *testing.T) {
+	t.Run("namespaces are isolated", func(t *testing.T) {
+		p := NewPrefixNamespacer(NewInMemoryMemoriser(), nil)
+
+		a, _ := p.Namespace("tenant/a")
+		b, _ := p.Namespace("tenant")
+
+		a.Save("id", json.RawMessage(`"a"`))
+
+		if _, err := b.Retrieve("a/id"); err == nil {
+			t.Errorf("expected namespace b to not see namespace a")
+		}
+
+		if hist, err := a.Retrieve("id"); err != nil || string(hist) != `"a"` {
+			t.Errorf("expected a to retrieve its own history but got %s, %v", hist, err)
+		}
+	})
+
+	t.Run("delete namespace", func(t *testing.T) {
+		base := NewInMemoryMemoriser()
+		p := NewPrefixNamespacer(base, nil)
+
+		a, _ := p.Namespace("a")
+		b, _ := p.Namespace("b")
+		a.Save("1", json.RawMessage(`1`))
+		a.Save("2", json.RawMessage(`2`))
+		b.Save("1", json.RawMessage(`1`))
+
+		if err := p.DeleteNamespace("a"); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if _, err := a.Retrieve("1"); err == nil {
+			t.Errorf("expected namespace a to be deleted")
+		}
+
+		if _, err := b.Retrieve("1"); err != nil {
+			t.Errorf("expected namespace b to survive but got %v", err)
+		}
+	})
+
+	t.Run("quotas", func(t *testing.T) {
+		p := NewPrefixNamespacer(NewInMemoryMemoriser(), &NamespaceQuota{MaxSessions: 1, MaxBytes: 4})
+		a, _ := p.Namespace("a")
+
+		if !a.Save("1", json.RawMessage(`123`)) {
+			t.Fatalf("expected first save to succeed")
+		}
+
+		if a.Save("2", json.RawMessage(`1`)) {
+			t.Errorf("expected second session to exceed quota")
+		}
+
+		if a.Save("1", json.RawMessage(`12345`)) {
+			t.Errorf("expected oversized history to exceed quota")
+		}
+
+		if err := a.(Admitter).Admit("2"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded but got %v", err)
+		}
+
+		if sessions, bytes := p.Usage("a"); sessions != 1 || bytes != 3 {
+			t.Errorf("expected 1 session of 3 bytes but got %d, %d", sessions, bytes)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+// Package mistral calls models served by mistral, through the openai
+// client's chat completions mode.
+package mistral
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+// Where mistral serves its chat completions api
+const BaseURL = "https://api.mistral.ai/v1"
+
+// NewMistralClient creates an openai client for mistral, which only speaks
+// chat completions and departs from openai's in a few places, see request
+func NewMistralClient(client *http.Client, auth string) (*openai.OpenAI, error) {
+	oa, err := openai.NewCompatibleClient(client, auth, BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	oa.ChatCompletions = true
+	oa.Dialect = openai.Dialect{Request: request}
+
+	return oa, nil
+}
+
+// Mistral names the seed random_seed, calls a required tool choice any,
+// and rejects fields it doesn't know as well as a tool choice without
+// tools. Streams end with their usage without it being asked for.
+func request(request *openai.ChatCompletionRequest, extra map[string]any) {
+	if request.Seed != nil {
+		extra["random_seed"] = *request.Seed
+		request.Seed = nil
+	}
+
+	if string(request.ToolChoice) == `"required"` {
+		request.ToolChoice = json.RawMessage(`"any"`)
+	}
+	if len(request.Tools) == 0 {
+		request.ToolChoice = nil
+	}
+
+	request.User = ""
+	request.ReasoningEffort = ""
+	request.ServiceTier = ""
+	request.PromptCacheKey = ""
+	request.StreamOptions = nil
+}
@@ -0,0 +1,49 @@
+package mistral
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+func TestRequest(t *testing.T) {
+	seed := 7
+	tools := []openai.ChatTool{{Type: "function"}}
+
+	tests := []struct {
+		name   string
+		tools  []openai.ChatTool
+		choice string
+		want   string
+	}{
+		{"required becomes any", tools, `"required"`, `"any"`},
+		{"named function kept", tools, `{"function":{"name":"weather"},"type":"function"}`, `{"function":{"name":"weather"},"type":"function"}`},
+		{"dropped without tools", nil, `"auto"`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := openai.ChatCompletionRequest{
+				Tools:          tt.tools,
+				ToolChoice:     json.RawMessage(tt.choice),
+				Seed:           &seed,
+				User:           "bob",
+				PromptCacheKey: "key",
+				StreamOptions:  &openai.ChatStreamOptions{IncludeUsage: true},
+			}
+			extra := map[string]any{}
+			request(&sent, extra)
+
+			if string(sent.ToolChoice) != tt.want {
+				t.Errorf("expected a tool choice of %s but got %s", tt.want, sent.ToolChoice)
+			}
+			if sent.Seed != nil || extra["random_seed"] != 7 {
+				t.Errorf("expected the seed moved to random_seed but got %v and %v", sent.Seed, extra)
+			}
+			if sent.User != "" || sent.PromptCacheKey != "" || sent.StreamOptions != nil {
+				t.Errorf("expected fields mistral rejects cleared but got %+v", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package model
+
+// What a model can do and what it costs, used to pick between models
+type Info struct {
+	Model AIModel
+	// Whether the model can call tools
+	Tools bool
+	// Whether the model accepts images
+	Vision bool
+	// Most tokens the model accepts in a request
+	ContextWindow int
+	// Most tokens the model generates in a reply, 0 when unpublished
+	MaxOutputTokens int
+	// US dollars per million tokens
+	InputPrice  float64
+	OutputPrice float64
+	// US dollars per million input tokens read from the prompt cache
+	CachedInputPrice float64
+}
+
+// What a call needs from a model
+type Requirements struct {
+	Tools  bool
+	Vision bool
+	// Smallest context window that will do, 0 for any
+	MinContext int
+}
+
+// Satisfies reports whether the model can serve a call with the requirements
+func (i Info) Satisfies(r Requirements) bool {
+	if r.Tools && !i.Tools {
+		return false
+	}
+
+	if r.Vision && !i.Vision {
+		return false
+	}
+
+	return i.ContextWindow >= r.MinContext
+}
+
+// Cost of a call in US dollars
+func (i Info) Cost(inputTokens int, outputTokens int) float64 {
+	return (float64(inputTokens)*i.InputPrice + float64(outputTokens)*i.OutputPrice) / 1_000_000
+}
+
+// Dollars saved by input tokens having been read from the prompt cache
+// rather than billed at the full input price
+func (i Info) CacheSavings(cachedTokens int) float64 {
+	if i.CachedInputPrice == 0 {
+		return 0
+	}
+
+	return float64(cachedTokens) * (i.InputPrice - i.CachedInputPrice) / 1_000_000
+}
+
+// Known models at list price. Prices change, so callers caring about
+// accuracy should keep their own.
+var Catalog = []Info{
+	{Model: OpenAiModel("gpt-4o"), Tools: true, Vision: true, ContextWindow: 128_000, MaxOutputTokens: 16_384, InputPrice: 2.5, OutputPrice: 10, CachedInputPrice: 1.25},
+	{Model: OpenAiModel("gpt-4o-mini"), Tools: true, Vision: true, ContextWindow: 128_000, MaxOutputTokens: 16_384, InputPrice: 0.15, OutputPrice: 0.6, CachedInputPrice: 0.075},
+	{Model: OpenAiModel("gpt-4.1"), Tools: true, Vision: true, ContextWindow: 1_047_576, MaxOutputTokens: 32_768, InputPrice: 2, OutputPrice: 8, CachedInputPrice: 0.5},
+	{Model: OpenAiModel("gpt-4.1-mini"), Tools: true, Vision: true, ContextWindow: 1_047_576, MaxOutputTokens: 32_768, InputPrice: 0.4, OutputPrice: 1.6, CachedInputPrice: 0.1},
+	{Model: OpenAiModel("gpt-4.1-nano"), Tools: true, Vision: true, ContextWindow: 1_047_576, MaxOutputTokens: 32_768, InputPrice: 0.1, OutputPrice: 0.4, CachedInputPrice: 0.025},
+	{Model: GeminiAiModel("gemini-2.0-flash"), Tools: true, Vision: true, ContextWindow: 1_048_576, MaxOutputTokens: 8_192, InputPrice: 0.1, OutputPrice: 0.4, CachedInputPrice: 0.025},
+	{Model: GeminiAiModel("gemini-2.0-flash-lite"), Tools: true, Vision: true, ContextWindow: 1_048_576, MaxOutputTokens: 8_192, InputPrice: 0.075, OutputPrice: 0.3, CachedInputPrice: 0.01875},
+	{Model: GeminiAiModel("gemini-2.5-flash"), Tools: true, Vision: true, ContextWindow: 1_048_576, MaxOutputTokens: 65_536, InputPrice: 0.3, OutputPrice: 2.5, CachedInputPrice: 0.075},
+	{Model: GeminiAiModel("gemini-2.5-pro"), Tools: true, Vision: true, ContextWindow: 1_048_576, MaxOutputTokens: 65_536, InputPrice: 1.25, OutputPrice: 10, CachedInputPrice: 0.31},
+	{Model: MistralModel("mistral-large-latest"), Tools: true, ContextWindow: 128_000, InputPrice: 2, OutputPrice: 6},
+	{Model: MistralModel("mistral-small-latest"), Tools: true, Vision: true, ContextWindow: 128_000, InputPrice: 0.1, OutputPrice: 0.3},
+}
+
+// Lookup finds m in the Catalog
+func Lookup(m AIModel) (Info, bool) {
+	for _, info := range Catalog {
+		if info.Model == m {
+			return info, true
+		}
+	}
+
+	return Info{}, false
+}
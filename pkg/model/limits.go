@@ -0,0 +1,39 @@
+package model
+
+// What a provider accepts of the tools sent with a request, so bad tools
+// fail fast rather than as an opaque 400. Zero fields are unchecked.
+type ToolLimits struct {
+	// Provider the limits belong to, for error messages
+	Provider string
+	// Most tools sent with a request
+	MaxTools int
+	// Longest tool name
+	MaxName int
+	// Longest tool description
+	MaxDescription int
+	// Largest json encoding of a tool's parameters
+	MaxSchemaBytes int
+}
+
+// Limits of the provider serving m. Providers don't publish every limit, so
+// these err on the side of what is known to be accepted.
+func Limits(m AIModel) ToolLimits {
+	switch m.(type) {
+	case OpenAiModel:
+		// Strict schemas may hold 120,000 characters of names and enum
+		// values, checked here against the whole encoding
+		return ToolLimits{Provider: "openai", MaxTools: 128, MaxName: 64, MaxDescription: 1024, MaxSchemaBytes: 120_000}
+	case GeminiAiModel:
+		return ToolLimits{Provider: "gemini", MaxTools: 128, MaxName: 64}
+	case OpenRouterModel:
+		return ToolLimits{Provider: "openrouter", MaxTools: 128, MaxName: 64}
+	case DeepSeekModel:
+		return ToolLimits{Provider: "deepseek", MaxTools: 128, MaxName: 64}
+	case MistralModel:
+		return ToolLimits{Provider: "mistral", MaxTools: 128, MaxName: 64}
+	}
+
+	// Ollama and text-generation-inference only limit tools by the model's
+	// context
+	return ToolLimits{}
+}
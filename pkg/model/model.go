@@ -5,6 +5,28 @@ const MAX_TOOLS_COUMT = 10
 type OpenAiModel string
 type GeminiAiModel string
 
+// Any model pulled into a local ollama server, e.g. llama3.2
+type OllamaModel string
+
+// A model served through OpenRouter, named with its provider, e.g.
+// anthropic/claude-sonnet-4
+type OpenRouterModel string
+
+// A model served by DeepSeek, e.g. deepseek-chat, or deepseek-reasoner
+// which returns its chain of thought
+type DeepSeekModel string
+
+// A Command model served by cohere, e.g. command-a-03-2025
+type CohereModel string
+
+// A model served by mistral, e.g. mistral-large-latest
+type MistralModel string
+
+// A model served by a Hugging Face Inference Endpoint or any
+// text-generation-inference server, found at Agent.HuggingFaceEndpoint.
+// These serve a single model, so its name is only reported back, e.g. tgi.
+type HuggingFaceModel string
+
 // Type masturbation and overengineering in
 // a very silly way
 type AIModel interface {
@@ -18,3 +40,27 @@ func (m OpenAiModel) Model() string {
 func (m GeminiAiModel) Model() string {
 	return string(m)
 }
+
+func (m OllamaModel) Model() string {
+	return string(m)
+}
+
+func (m MistralModel) Model() string {
+	return string(m)
+}
+
+func (m OpenRouterModel) Model() string {
+	return string(m)
+}
+
+func (m DeepSeekModel) Model() string {
+	return string(m)
+}
+
+func (m CohereModel) Model() string {
+	return string(m)
+}
+
+func (m HuggingFaceModel) Model() string {
+	return string(m)
+}
@@ -0,0 +1,23 @@
+package ollama
+
+import (
+	"context"
+)
+
+// Sends a chat request, returning the decoded response
+type Handler func(ctx context.Context, body *ChatRequest) (*ChatResponse, error)
+
+// Wraps the sending of chat requests. Middleware may mutate the body before
+// calling next, and inspect or mutate the response after.
+type Middleware func(next Handler) Handler
+
+// Builds the handler chain, with the first middleware being the outermost
+func (o *Ollama) handler() Handler {
+	h := Handler(o.send)
+
+	for i := len(o.Middleware) - 1; i >= 0; i-- {
+		h = o.Middleware[i](h)
+	}
+
+	return h
+}
@@ -0,0 +1,451 @@
+package ollama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Where ollama listens unless told otherwise
+const DefaultHost = "http://localhost:11434"
+
+type FunctionCall struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+}
+
+type ToolCall struct {
+	Function FunctionCall `json:"function"`
+}
+
+type Message struct {
+	// One of system, user, assistant or tool
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// What the model thought before replying, only set by thinking models
+	// when asked to think
+	Thinking string `json:"thinking,omitempty"`
+	// Images for vision models, base64 encoded when marshaled to json
+	Images    [][]byte   `json:"images,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// Tool a tool message holds the output of
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+type FunctionDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	// Always function
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// Model parameters, any left unset use what the model was created with
+type Options struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Most tokens to generate, 0 uses the model default
+	NumPredict int `json:"num_predict,omitempty"`
+	// Size of the context window, 0 uses the model default. Ollama
+	// silently drops the start of conversations that don't fit.
+	NumCtx           int      `json:"num_ctx,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+}
+
+type ChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Tools    []Tool    `json:"tools,omitempty"`
+	// Either "json" or a json schema the reply must follow
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options Options         `json:"options,omitzero"`
+	// Streaming is not supported, so this is always sent as false
+	Stream bool `json:"stream"`
+	// Whether thinking models think before replying, nil for the model
+	// default
+	Think *bool `json:"think,omitempty"`
+	// How long the model stays loaded after the request, e.g. 10m
+	KeepAlive string `json:"keep_alive,omitempty"`
+	// Instructions sent as a leading system message. Kept out of messages
+	// so they are rebuilt every call rather than stored in history.
+	System []string `json:"-"`
+}
+
+// AppendSystemInstruction adds another instruction after the system prompt.
+// Empty text is ignored.
+func (b *ChatRequest) AppendSystemInstruction(text string) {
+	if text == "" {
+		return
+	}
+
+	b.System = append(b.System, text)
+}
+
+// AppendUserInput adds a user message to the end of the conversation
+func (b *ChatRequest) AppendUserInput(text string) {
+	b.Messages = append(b.Messages, Message{Role: "user", Content: text})
+}
+
+// CompactToolOutputs replaces the content of every tool message with the
+// result of fn, letting bulky tool results be shrunk once the model has seen
+// them
+func (b *ChatRequest) CompactToolOutputs(fn func(output string) string) {
+	for i, message := range b.Messages {
+		if message.Role == "tool" {
+			b.Messages[i].Content = fn(message.Content)
+		}
+	}
+}
+
+// The request as sent, with the system instructions leading the messages
+func (b ChatRequest) wire() ([]byte, error) {
+	if len(b.System) > 0 {
+		system := Message{Role: "system", Content: strings.Join(b.System, "\n\n")}
+		b.Messages = append([]Message{system}, b.Messages...)
+	}
+	b.Stream = false
+
+	return json.Marshal(b)
+}
+
+type ChatResponse struct {
+	Model   string  `json:"model"`
+	Message Message `json:"message"`
+	Done    bool    `json:"done"`
+	// Why generation stopped, e.g. stop or length
+	DoneReason string `json:"done_reason,omitempty"`
+	// Tokens of the prompt and of the reply
+	PromptEvalCount int `json:"prompt_eval_count,omitempty"`
+	EvalCount       int `json:"eval_count,omitempty"`
+	// Nanoseconds spent on the whole request
+	TotalDuration int64 `json:"total_duration,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens int
+	OutputTokens int
+}
+
+// Add sums two usages together
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		PromptTokens: u.PromptTokens + other.PromptTokens,
+		OutputTokens: u.OutputTokens + other.OutputTokens,
+	}
+}
+
+// The outcome of a generation
+type Result struct {
+	// Text the model replied with
+	Text string
+	// What the model thought, only present when thinking
+	Thoughts string
+	// Tokens used across every request made for the generation
+	Usage Usage
+	// Why the final reply stopped, e.g. stop or length
+	DoneReason string
+	// Prompt tokens of the final request, the size of the whole conversation
+	// as the model last saw it
+	PromptTokens int
+}
+
+// Whether the reply was cut short by Options.NumPredict
+func (r Result) Truncated() bool {
+	return r.DoneReason == "length"
+}
+
+// Returned when ollama replies with anything but 200
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("ollama error %d: %s", e.StatusCode, e.Message)
+}
+
+// Parses the error ollama describes in a failed response body, keeping the
+// raw body when it isn't one
+func newAPIError(status int, body []byte) *APIError {
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		return &APIError{StatusCode: status, Message: payload.Error}
+	}
+
+	return &APIError{StatusCode: status, Message: string(body)}
+}
+
+type Ollama struct {
+	client *http.Client
+	host   string
+	// Wraps every chat request, see Middleware
+	Middleware []Middleware
+	// Optionally signs every request, for gateways that require it
+	Signer signer.Signer
+	// Requests larger than this, before any compression, fail with
+	// httpclient.ErrRequestTooLarge rather than being sent. 0 allows any
+	// size.
+	MaxRequestBytes int64
+	// Responses larger than this fail with httpclient.ErrResponseTooLarge.
+	// Defaults to httpclient.DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+	// Limits each http round trip to ollama, 0 for none. Unlike a deadline
+	// on the call's context, a round trip that times out is retried.
+	RequestTimeout time.Duration
+	// Attempts at a round trip that times out, defaults to 1
+	RequestAttempts int
+	// Called when the model calls a tool that isn't registered. The model
+	// is told the tool is unknown either way.
+	OnUnknownTool func(ctx context.Context, name string)
+	// Called once a registered tool the model called has run, with the
+	// arguments the model gave, how long it ran and any error it returned
+	OnToolCall func(ctx context.Context, name string, args any, elapsed time.Duration, err error)
+}
+
+func (o *Ollama) Body(model string, userInput string, prompt string, history json.RawMessage, schema json.RawMessage) (*ChatRequest, error) {
+	if userInput == "" {
+		return nil, errors.New("empty user input is weird")
+	}
+
+	var body ChatRequest
+	if len(history) > 0 {
+		if err := json.Unmarshal(history, &body); err != nil {
+			return nil, err
+		}
+	}
+
+	body.Model = model
+	body.AppendSystemInstruction(prompt)
+	body.AppendUserInput(userInput)
+
+	body.Format = nil
+	if len(schema) > 0 {
+		if !json.Valid(schema) {
+			return nil, errors.New("invalid schema supplied, could not decode it")
+		}
+		body.Format = schema
+	}
+
+	return &body, nil
+}
+
+// SetTools offers tools to the model, replacing those the body held, and
+// reports how they changed
+func (b *ChatRequest) SetTools(tools []tool.Tool[any, any]) tool.Changes {
+	offered := definitions(tools)
+	changes := tool.Diff(b.Tools, offered, func(t Tool) string { return t.Function.Name })
+	b.Tools = offered
+
+	return changes
+}
+
+func (o *Ollama) Generate(ctx context.Context, body *ChatRequest, tools []tool.Tool[any, any]) (*ChatRequest, Result, error) {
+	slog.DebugContext(ctx, "ollama agent called", slog.String("model", body.Model))
+
+	// Tools are offered afresh every request, as those stored with history
+	// may have changed since
+	offered := len(body.Tools) > 0
+	if changes := body.SetTools(tools); offered && !changes.Empty() {
+		slog.DebugContext(ctx, "tools changed since the last request", slog.Any("changes", changes))
+	}
+
+	reply := Result{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, Result{}, err
+		}
+
+		resp, err := o.handler()(ctx, body)
+		if err != nil {
+			return nil, Result{}, err
+		}
+
+		reply.Usage = reply.Usage.Add(Usage{PromptTokens: resp.PromptEvalCount, OutputTokens: resp.EvalCount})
+		reply.PromptTokens = resp.PromptEvalCount
+		reply.DoneReason = resp.DoneReason
+		reply.Thoughts += resp.Message.Thinking
+
+		resp.Message.Role = "assistant"
+		body.Messages = append(body.Messages, resp.Message)
+
+		if len(resp.Message.ToolCalls) == 0 {
+			reply.Text = resp.Message.Content
+			return body, reply, nil
+		}
+
+		for _, call := range resp.Message.ToolCalls {
+			body.Messages = append(body.Messages, Message{
+				Role:     "tool",
+				Content:  o.execute(ctx, call.Function, tools),
+				ToolName: call.Function.Name,
+			})
+		}
+	}
+}
+
+// Runs the tool a call names, describing any failure, including the model
+// calling a tool that doesn't exist, in the output so the model can carry on
+func (o *Ollama) execute(ctx context.Context, call FunctionCall, tools []tool.Tool[any, any]) string {
+	for _, t := range tools {
+		if t.Name != call.Name {
+			continue
+		}
+
+		start := time.Now()
+		out, err := tool.Execute(ctx, t, any(call.Arguments))
+		if o.OnToolCall != nil {
+			o.OnToolCall(ctx, call.Name, call.Arguments, time.Since(start), err)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to execute tool", slog.String("tool", call.Name), slog.Any("error", err))
+			return errorResponse(err.Error())
+		}
+
+		encoded, err := json.Marshal(out)
+		if err != nil {
+			return errorResponse("failed to encode tool output")
+		}
+
+		return string(encoded)
+	}
+
+	slog.WarnContext(ctx, "model called unknown tool", slog.String("tool", call.Name))
+	if o.OnUnknownTool != nil {
+		o.OnUnknownTool(ctx, call.Name)
+	}
+
+	return errorResponse("unknown tool " + call.Name)
+}
+
+func errorResponse(message string) string {
+	r, _ := json.Marshal(struct {
+		Success bool   `json:"success"`
+		Reason  string `json:"reason"`
+	}{
+		Success: false,
+		Reason:  message,
+	})
+
+	return string(r)
+}
+
+func definitions(tools []tool.Tool[any, any]) []Tool {
+	defs := make([]Tool, len(tools))
+	for i, t := range tools {
+		description := t.Describe()
+		if description == "" {
+			description = t.Name
+		}
+
+		defs[i] = Tool{
+			Type: "function",
+			Function: FunctionDefinition{
+				Name:        t.Name,
+				Description: description,
+				Parameters: map[string]any{
+					"type":       "object",
+					"properties": t.Definition.Properties,
+					"required":   t.Definition.Required,
+				},
+			},
+		}
+	}
+
+	return defs
+}
+
+// send posts a chat request to ollama
+func (o *Ollama) send(ctx context.Context, body *ChatRequest) (*ChatResponse, error) {
+	data, err := body.wire()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body - %w", err)
+	}
+	if err := httpclient.CheckRequest(data, o.MaxRequestBytes); err != nil {
+		return nil, err
+	}
+
+	resp, err := httpclient.RoundTrip(ctx, o.RequestTimeout, o.RequestAttempts, func(ctx context.Context) (*http.Response, error) {
+		return o.post(ctx, "/api/chat", data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	limit := o.MaxResponseBytes
+	if limit <= 0 {
+		limit = httpclient.DefaultMaxResponseBytes
+	}
+	reader := httpclient.LimitReader(resp.Body, limit)
+
+	if resp.StatusCode != http.StatusOK {
+		failed, _ := io.ReadAll(io.LimitReader(reader, 64<<10))
+		apiErr := newAPIError(resp.StatusCode, failed)
+		slog.ErrorContext(ctx, "non 200 response from ollama", slog.Int("code", apiErr.StatusCode), slog.String("message", apiErr.Message))
+		return nil, apiErr
+	}
+
+	var chat ChatResponse
+	if err := json.NewDecoder(reader).Decode(&chat); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response - %w", err)
+	}
+
+	return &chat, nil
+}
+
+func (o *Ollama) post(ctx context.Context, path string, data []byte) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, o.host+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request - %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	if o.Signer != nil {
+		if err := o.Signer.Sign(r, data); err != nil {
+			return nil, fmt.Errorf("failed to sign request - %w", err)
+		}
+	}
+
+	resp, err := o.client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed - %w", err)
+	}
+
+	return resp, nil
+}
+
+// NewOllamaClient creates a client for the ollama server at host, using
+// DefaultHost when host is empty and httpclient.Default when client is nil
+func NewOllamaClient(client *http.Client, host string) (*Ollama, error) {
+	if client == nil {
+		client = httpclient.Default()
+	}
+
+	if host == "" {
+		host = DefaultHost
+	}
+
+	return &Ollama{
+		client: client,
+		host:   strings.TrimSuffix(host, "/"),
+	}, nil
+}
@@ -0,0 +1,163 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func testClient(t testing.TB, handler http.HandlerFunc) *Ollama {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	o, err := NewOllamaClient(srv.Client(), srv.URL+"/")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	return o
+}
+
+type weather struct {
+	City string `json:"city"`
+}
+
+func TestGenerate(t *testing.T) {
+	var requests []map[string]json.RawMessage
+	o := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			t.Errorf("expected /api/chat but got %s", r.URL.Path)
+		}
+
+		var sent map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&sent)
+		requests = append(requests, sent)
+
+		if len(requests) == 1 {
+			w.Write([]byte(`{"model":"llama3.2","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"weather","arguments":{"city":"Perth"}}}]},"done":true,"prompt_eval_count":20,"eval_count":5}`))
+			return
+		}
+
+		w.Write([]byte(`{"model":"llama3.2","message":{"role":"assistant","content":"sunny in Perth"},"done":true,"done_reason":"stop","prompt_eval_count":40,"eval_count":4}`))
+	})
+
+	var called string
+	o.OnToolCall = func(ctx context.Context, name string, args any, elapsed time.Duration, err error) { called = name }
+
+	tools := []tool.Tool[any, any]{tool.CreateTool("weather", func(ctx context.Context, in weather) (string, error) {
+		return "sunny in " + in.City, nil
+	})}
+
+	body, err := o.Body("llama3.2", "weather in perth?", "be nice", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	body, res, err := o.Generate(context.Background(), body, tools)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "sunny in Perth" {
+		t.Errorf("expected sunny in Perth but got %s", res.Text)
+	}
+
+	if res.Usage.PromptTokens != 60 || res.Usage.OutputTokens != 9 || res.PromptTokens != 40 {
+		t.Errorf("expected usage summed across requests but got %+v, prompt %d", res.Usage, res.PromptTokens)
+	}
+
+	if called != "weather" {
+		t.Errorf("expected hook to see weather but got %q", called)
+	}
+
+	if string(requests[0]["stream"]) != "false" {
+		t.Errorf("expected stream false but got %s", requests[0]["stream"])
+	}
+
+	var sent []Message
+	json.Unmarshal(requests[1]["messages"], &sent)
+	if len(sent) != 4 || sent[0].Role != "system" || sent[0].Content != "be nice" {
+		t.Fatalf("expected the system prompt to lead the messages but got %+v", sent)
+	}
+	if sent[3].Role != "tool" || sent[3].ToolName != "weather" || sent[3].Content != `"sunny in Perth"` {
+		t.Errorf("expected the tool output but got %+v", sent[3])
+	}
+
+	// The system prompt is rebuilt every call rather than stored
+	history, _ := json.Marshal(body)
+	if strings.Contains(string(history), "be nice") {
+		t.Errorf("expected history without the system prompt but got %s", history)
+	}
+	if len(body.Messages) != 4 {
+		t.Errorf("expected 4 messages in history but got %d", len(body.Messages))
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	o := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"model \"llama9\" not found, try pulling it first"}`))
+	})
+
+	body, err := o.Body("llama9", "hello", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	_, _, err = o.Generate(context.Background(), body, nil)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError but got %v", err)
+	}
+
+	if apiErr.StatusCode != http.StatusNotFound || !strings.Contains(apiErr.Message, "try pulling it first") {
+		t.Errorf("expected the not found error but got %+v", apiErr)
+	}
+}
+
+func TestRepairMessages(t *testing.T) {
+	t.Run("interrupted and orphaned calls", func(t *testing.T) {
+		body := ChatRequest{Messages: []Message{
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", ToolCalls: []ToolCall{{Function: FunctionCall{Name: "a"}}, {Function: FunctionCall{Name: "b"}}}},
+			{Role: "tool", ToolName: "a", Content: "{}"},
+			{Role: "tool", ToolName: "c", Content: "{}"},
+			{Role: "user", Content: "hello?"},
+		}}
+
+		repairs, err := body.RepairMessages()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(repairs) != 2 {
+			t.Errorf("expected 2 repairs but got %v", repairs)
+		}
+
+		roles := []string{}
+		for _, message := range body.Messages {
+			roles = append(roles, message.Role+":"+message.ToolName)
+		}
+		if strings.Join(roles, " ") != "user: assistant: tool:a tool:b user:" {
+			t.Errorf("expected the missing output added and the orphan dropped but got %v", roles)
+		}
+	})
+
+	t.Run("unknown role", func(t *testing.T) {
+		body := ChatRequest{Messages: []Message{{Role: "model", Content: "hi"}}}
+
+		if _, err := body.RepairMessages(); !errors.Is(err, ErrInvalidSequence) {
+			t.Errorf("expected ErrInvalidSequence but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/calamity-m/clusterfuc/pkg/speech"
+)
+
+type SpeechRequest struct {
+	// Speech model, e.g. gpt-4o-mini-tts or tts-1
+	Model string `json:"model"`
+	// Text to speak, up to 4096 characters
+	Input string `json:"input"`
+	// e.g. alloy, ash, coral or nova
+	Voice string `json:"voice"`
+	// How to speak, e.g. cheerfully. gpt-4o-mini-tts only.
+	Instructions string `json:"instructions,omitempty"`
+	// mp3, opus, aac, flac, wav or pcm. Defaults to mp3.
+	ResponseFormat string `json:"response_format,omitempty"`
+	// 0.25 to 4, defaults to 1
+	Speed float64 `json:"speed,omitempty"`
+}
+
+// CreateSpeech speaks text, returning audio in the requested format
+func (oa *OpenAI) CreateSpeech(ctx context.Context, req SpeechRequest) ([]byte, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	resp, err := oa.exchange(ctx, http.MethodPost, "/audio/speech", "application/json", data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := oa.body(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(body)
+}
+
+type TranscriptionRequest struct {
+	// Transcription model, e.g. gpt-4o-mini-transcribe or whisper-1
+	Model string
+	Audio []byte
+	// Name of the audio file, its extension tells openai the format,
+	// e.g. speech.mp3
+	Filename string
+	// Optional ISO-639-1 language of the audio, improving accuracy
+	Language string
+	// Optional text guiding the style or continuing a previous segment
+	Prompt string
+}
+
+// CreateTranscription turns spoken audio into text
+func (oa *OpenAI) CreateTranscription(ctx context.Context, req TranscriptionRequest) (string, error) {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+
+	file, err := form.CreateFormFile("file", req.Filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to create transcription form: %w", err)
+	}
+	file.Write(req.Audio)
+
+	fields := [][2]string{
+		{"model", req.Model},
+		{"language", req.Language},
+		{"prompt", req.Prompt},
+		{"response_format", "json"},
+	}
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return "", fmt.Errorf("failed to create transcription form: %w", err)
+		}
+	}
+
+	if err := form.Close(); err != nil {
+		return "", fmt.Errorf("failed to create transcription form: %w", err)
+	}
+
+	resp, err := oa.exchange(ctx, http.MethodPost, "/audio/transcriptions", form.FormDataContentType(), buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	var out struct {
+		Text string `json:"text"`
+	}
+	if err := oa.decode(resp, &out); err != nil {
+		return "", err
+	}
+
+	return out.Text, nil
+}
+
+// Speaks text with an openai speech model, implementing speech.Synthesizer
+type Speaker struct {
+	Client *OpenAI
+	// Defaults to gpt-4o-mini-tts
+	Model string
+	// Defaults to alloy
+	Voice string
+	// Optional guidance on how to speak
+	Instructions string
+	// Defaults to mp3
+	Format string
+}
+
+// Mime types of the formats speech is returned in
+var speechMimeTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"pcm":  "audio/pcm",
+}
+
+func (s *Speaker) Synthesize(ctx context.Context, text string) (speech.Audio, error) {
+	req := SpeechRequest{
+		Model:          s.Model,
+		Input:          text,
+		Voice:          s.Voice,
+		Instructions:   s.Instructions,
+		ResponseFormat: s.Format,
+	}
+	if req.Model == "" {
+		req.Model = "gpt-4o-mini-tts"
+	}
+	if req.Voice == "" {
+		req.Voice = "alloy"
+	}
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = "mp3"
+	}
+
+	data, err := s.Client.CreateSpeech(ctx, req)
+	if err != nil {
+		return speech.Audio{}, err
+	}
+
+	return speech.Audio{Data: data, MimeType: speechMimeTypes[req.ResponseFormat]}, nil
+}
+
+func NewSpeaker(client *OpenAI) *Speaker {
+	return &Speaker{Client: client}
+}
+
+// Transcribes audio with an openai model, implementing speech.Transcriber
+type Transcriber struct {
+	Client *OpenAI
+	// Defaults to gpt-4o-mini-transcribe
+	Model string
+	// Optional ISO-639-1 language of the audio
+	Language string
+}
+
+// File extensions openai recognises, by mime type
+var audioExtensions = map[string]string{
+	"audio/mpeg":  "mp3",
+	"audio/mp3":   "mp3",
+	"audio/mp4":   "mp4",
+	"audio/m4a":   "m4a",
+	"audio/x-m4a": "m4a",
+	"audio/wav":   "wav",
+	"audio/x-wav": "wav",
+	"audio/webm":  "webm",
+	"audio/ogg":   "ogg",
+	"audio/flac":  "flac",
+}
+
+func (t *Transcriber) Transcribe(ctx context.Context, audio speech.Audio) (string, error) {
+	ext, ok := audioExtensions[audio.MimeType]
+	if !ok {
+		return "", fmt.Errorf("unsupported audio type %q", audio.MimeType)
+	}
+
+	model := t.Model
+	if model == "" {
+		model = "gpt-4o-mini-transcribe"
+	}
+
+	return t.Client.CreateTranscription(ctx, TranscriptionRequest{
+		Model:    model,
+		Audio:    audio.Data,
+		Filename: "audio." + ext,
+		Language: t.Language,
+	})
+}
+
+func NewTranscriber(client *OpenAI) *Transcriber {
+	return &Transcriber{Client: client}
+}
@@ -0,0 +1,36 @@
+package openai
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Api version sent to Azure OpenAI unless another is given
+const DefaultAzureAPIVersion = "2025-04-01-preview"
+
+// An Azure OpenAI resource requests are sent to instead of openai. Requests
+// are routed to a deployment, authenticated with an api-key header holding
+// the client's key rather than a bearer token.
+type Azure struct {
+	// Address of the resource, e.g. https://my-resource.openai.azure.com
+	Endpoint string
+	// Deployment requests are routed to, which decides the model used
+	Deployment string
+	// Defaults to DefaultAzureAPIVersion
+	APIVersion string
+}
+
+// The deployment url of an openai api path, carrying over any query the
+// path has
+func (az *Azure) url(path string) string {
+	path, query, _ := strings.Cut(path, "?")
+	values, _ := url.ParseQuery(query)
+
+	version := az.APIVersion
+	if version == "" {
+		version = DefaultAzureAPIVersion
+	}
+	values.Set("api-version", version)
+
+	return strings.TrimSuffix(az.Endpoint, "/") + "/openai/deployments/" + url.PathEscape(az.Deployment) + path + "?" + values.Encode()
+}
@@ -0,0 +1,476 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// A chat completions request, the api most openai compatible servers such
+// as vLLM, llama.cpp and LM Studio speak. Only built from a CreateResponse
+// when OpenAI.ChatCompletions is set, history stays in the responses shape.
+type ChatCompletionRequest struct {
+	Model          string              `json:"model"`
+	Messages       []ChatMessage       `json:"messages"`
+	Tools          []ChatTool          `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage     `json:"tool_choice,omitzero"`
+	ResponseFormat *ChatResponseFormat `json:"response_format,omitempty"`
+	Temperature    float32             `json:"temperature,omitempty"`
+	TopP           float32             `json:"top_p,omitempty"`
+	MaxTokens      int                 `json:"max_tokens,omitempty"`
+	User           string              `json:"user,omitempty"`
+	Logprobs       bool                `json:"logprobs,omitempty"`
+	// Sequences that end the generation, left out of the output
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	// Sent only when set, as compatible servers may not know them
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	ServiceTier     string `json:"service_tier,omitempty"`
+	PromptCacheKey  string `json:"prompt_cache_key,omitempty"`
+	Stream          bool   `json:"stream"`
+	// Asks for usage in the final chunk of a stream
+	StreamOptions *ChatStreamOptions `json:"stream_options,omitempty"`
+}
+
+type ChatStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type ChatMessage struct {
+	// One of system, user, assistant or tool
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Sent as the content in place of Content when set, for messages
+	// holding images
+	Parts []ChatContentPart `json:"-"`
+	// Calls made by an assistant message
+	ToolCalls []ChatToolCall `json:"tool_calls,omitempty"`
+	// The call a tool message is the output of
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	Refusal    string `json:"refusal,omitempty"`
+	// Thinking returned by reasoning models served by vLLM, DeepSeek and
+	// others
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+}
+
+func (m ChatMessage) MarshalJSON() ([]byte, error) {
+	type message ChatMessage
+	if len(m.Parts) == 0 {
+		return json.Marshal(message(m))
+	}
+
+	return json.Marshal(struct {
+		message
+		Content []ChatContentPart `json:"content"`
+	}{message(m), m.Parts})
+}
+
+type ChatContentPart struct {
+	// Either text or image_url
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *ChatImageURL `json:"image_url,omitempty"`
+}
+
+type ChatImageURL struct {
+	// A link to the image, or its base64 encoded data url
+	URL string `json:"url"`
+}
+
+type ChatToolCall struct {
+	ID string `json:"id"`
+	// Always `function`
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+		// A JSON string of the arguments
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// Some compatible servers, such as TGI, reply with the arguments as an
+// object, which is decoded into its JSON
+func (c *ChatToolCall) UnmarshalJSON(data []byte) error {
+	type call ChatToolCall
+	var decoded struct {
+		call
+		Function struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*c = ChatToolCall(decoded.call)
+	c.Function.Name = decoded.Function.Name
+	args := decoded.Function.Arguments
+	switch {
+	case len(args) == 0 || string(args) == "null":
+		return nil
+	case args[0] == '"':
+		return json.Unmarshal(args, &c.Function.Arguments)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, args); err != nil {
+		return err
+	}
+	c.Function.Arguments = compact.String()
+
+	return nil
+}
+
+type ChatTool struct {
+	// Always `function`
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description,omitempty"`
+		Parameters  FunctionToolParameters `json:"parameters"`
+		Strict      bool                   `json:"strict,omitempty"`
+	} `json:"function"`
+}
+
+type ChatResponseFormat struct {
+	// Always `json_schema`
+	Type       string `json:"type"`
+	JSONSchema struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Schema      json.RawMessage `json:"schema"`
+		Strict      bool            `json:"strict,omitempty"`
+	} `json:"json_schema"`
+}
+
+type ChatCompletion struct {
+	ID      string `json:"id,omitempty"`
+	Created int    `json:"created,omitempty"`
+	Model   string `json:"model,omitempty"`
+	// The tier openai processed the completion with
+	ServiceTier string `json:"service_tier,omitempty"`
+	// The upstream provider that served the completion, OpenRouter only
+	Provider string       `json:"provider,omitempty"`
+	Choices  []ChatChoice `json:"choices"`
+	Usage    struct {
+		PromptTokens     int `json:"prompt_tokens,omitempty"`
+		CompletionTokens int `json:"completion_tokens,omitempty"`
+		TotalTokens      int `json:"total_tokens,omitempty"`
+		// Prompt tokens read from DeepSeek's context cache, which it
+		// reports in place of prompt_tokens_details
+		PromptCacheHitTokens int `json:"prompt_cache_hit_tokens,omitempty"`
+		PromptTokensDetails  struct {
+			CachedTokens int `json:"cached_tokens,omitempty"`
+		} `json:"prompt_tokens_details,omitzero"`
+		CompletionTokensDetails struct {
+			ReasoningTokens int `json:"reasoning_tokens,omitempty"`
+		} `json:"completion_tokens_details,omitzero"`
+	} `json:"usage,omitzero"`
+}
+
+type ChatChoice struct {
+	Message ChatMessage `json:"message"`
+	// One of stop, length, tool_calls or content_filter
+	FinishReason string `json:"finish_reason,omitempty"`
+	Logprobs     struct {
+		Content []Logprob `json:"content,omitempty"`
+	} `json:"logprobs,omitzero"`
+}
+
+// How a chat completions server departs from openai's api. Either function
+// may be nil.
+type Dialect struct {
+	// Rewrites every request before it is sent. Extra holds the top level
+	// fields sent alongside it, for fields openai has no place for.
+	Request func(request *ChatCompletionRequest, extra map[string]any)
+	// Rewrites every completion before it is translated into a response,
+	// given the request it answers
+	Completion func(request ChatCompletionRequest, completion *ChatCompletion)
+}
+
+// Sends a create response request as a chat completion, translating the
+// completion back into a response
+func (oa *OpenAI) chatCompletion(ctx context.Context, body *CreateResponse) (*Response, error) {
+	request, err := chatRequest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Stream {
+		request.Stream = true
+		request.StreamOptions = &ChatStreamOptions{IncludeUsage: true}
+	}
+
+	extra := oa.Route.fields()
+	for k, v := range body.Extra {
+		extra[k] = v
+	}
+	if oa.Dialect.Request != nil {
+		oa.Dialect.Request(&request, extra)
+	}
+
+	in, err := withExtra(request, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	var completion ChatCompletion
+	if request.Stream {
+		completion, err = oa.streamCompletion(ctx, in, body.OnText)
+	} else {
+		err = oa.do(ctx, http.MethodPost, "/chat/completions", in, &completion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if oa.Dialect.Completion != nil {
+		oa.Dialect.Completion(request, &completion)
+	}
+
+	return completion.response()
+}
+
+// Translates a create response request into a chat completions request.
+// Items chat completions has no place for, such as reasoning, are dropped.
+func chatRequest(body *CreateResponse) (ChatCompletionRequest, error) {
+	request := ChatCompletionRequest{
+		Model:            body.Model,
+		Temperature:      body.Temperature,
+		TopP:             body.TopP,
+		MaxTokens:        body.MaxOutputTokens,
+		User:             body.User,
+		Logprobs:         slices.Contains(body.Include, IncludableOutputTextLogprobs),
+		Stop:             body.Stop,
+		Seed:             body.Seed,
+		PresencePenalty:  body.PresencePenalty,
+		FrequencyPenalty: body.FrequencyPenalty,
+		// Chat completions has no reasoning summaries to ask for
+		ReasoningEffort: body.Reasoning.Effort,
+		ServiceTier:     body.ServiceTier,
+		PromptCacheKey:  body.PromptCacheKey,
+	}
+
+	if body.Instructions != "" {
+		request.Messages = append(request.Messages, ChatMessage{Role: "system", Content: body.Instructions})
+	}
+
+	for _, item := range body.Input {
+		var base BaseItem
+		if err := json.Unmarshal(item, &base); err != nil {
+			return ChatCompletionRequest{}, fmt.Errorf("failed decoding input type - %w", err)
+		}
+
+		switch base.Type {
+		case "message":
+			var message Message
+			if err := json.Unmarshal(item, &message); err != nil {
+				return ChatCompletionRequest{}, fmt.Errorf("failed to decode message - %w", err)
+			}
+
+			var text strings.Builder
+			var parts []ChatContentPart
+			images := false
+			for _, content := range message.Content {
+				if content.Type == "input_image" {
+					parts = append(parts, ChatContentPart{Type: "image_url", ImageURL: &ChatImageURL{URL: content.ImageURL}})
+					images = true
+					continue
+				}
+				text.WriteString(content.Text)
+				parts = append(parts, ChatContentPart{Type: "text", Text: content.Text})
+			}
+
+			role := message.Role
+			// Compatible servers rarely know the developer role
+			if role == "developer" {
+				role = "system"
+			}
+			chat := ChatMessage{Role: role, Content: text.String()}
+			// Plain text content is kept for the many servers that only
+			// take a string
+			if images {
+				chat.Parts = parts
+			}
+			request.Messages = append(request.Messages, chat)
+
+		case "function_call":
+			var call FunctionToolCall
+			if err := json.Unmarshal(item, &call); err != nil {
+				return ChatCompletionRequest{}, fmt.Errorf("failed to decode function_call - %w", err)
+			}
+
+			var chatCall ChatToolCall
+			chatCall.ID = call.CallID
+			chatCall.Type = "function"
+			chatCall.Function.Name = call.Name
+			if args, ok := call.Arguments.(string); ok {
+				chatCall.Function.Arguments = args
+			} else {
+				data, err := json.Marshal(call.Arguments)
+				if err != nil {
+					return ChatCompletionRequest{}, fmt.Errorf("failed to encode function_call arguments - %w", err)
+				}
+				chatCall.Function.Arguments = string(data)
+			}
+
+			// Calls made together belong to the one assistant message
+			if n := len(request.Messages); n > 0 && request.Messages[n-1].Role == "assistant" {
+				request.Messages[n-1].ToolCalls = append(request.Messages[n-1].ToolCalls, chatCall)
+			} else {
+				request.Messages = append(request.Messages, ChatMessage{Role: "assistant", ToolCalls: []ChatToolCall{chatCall}})
+			}
+
+		case "function_call_output":
+			var output FunctionToolCallOutput
+			if err := json.Unmarshal(item, &output); err != nil {
+				return ChatCompletionRequest{}, fmt.Errorf("failed to decode function_call_output - %w", err)
+			}
+
+			request.Messages = append(request.Messages, ChatMessage{Role: "tool", Content: output.Output, ToolCallID: output.CallID})
+		}
+	}
+
+	for _, t := range body.Tools {
+		var chatTool ChatTool
+		chatTool.Type = "function"
+		chatTool.Function.Name = t.Name
+		chatTool.Function.Description = t.Description
+		chatTool.Function.Parameters = t.Parameters
+		chatTool.Function.Strict = t.Strict
+		request.Tools = append(request.Tools, chatTool)
+	}
+
+	if len(body.ToolChoice) > 0 {
+		choice, err := chatToolChoice(body.ToolChoice)
+		if err != nil {
+			return ChatCompletionRequest{}, err
+		}
+		request.ToolChoice = choice
+	}
+
+	if body.Text.Type == "json_schema" {
+		format := &ChatResponseFormat{Type: "json_schema"}
+		format.JSONSchema.Name = body.Text.Name
+		format.JSONSchema.Description = body.Text.Description
+		format.JSONSchema.Schema = body.Text.Schema
+		format.JSONSchema.Strict = body.Text.Strict
+		request.ResponseFormat = format
+	}
+
+	return request, nil
+}
+
+// Translates a tool_choice built by ToolChoice. Chat completions can only
+// force a single function, so a restriction to several falls back to its
+// mode.
+func chatToolChoice(choice json.RawMessage) (json.RawMessage, error) {
+	var object struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(choice, &object); err != nil {
+		// A plain mode, e.g. auto
+		return choice, nil
+	}
+
+	switch object.Type {
+	case "function":
+		return json.Marshal(map[string]any{"type": "function", "function": map[string]string{"name": object.Name}})
+	case "allowed_tools":
+		return json.Marshal(object.Mode)
+	default:
+		return nil, fmt.Errorf("unsupported tool_choice type %s for chat completions", object.Type)
+	}
+}
+
+// Translates a chat completion into the response it would have been
+func (c ChatCompletion) response() (*Response, error) {
+	response := Response{
+		ID:          c.ID,
+		Status:      "completed",
+		ServiceTier: c.ServiceTier,
+		CreatedAt:   c.Created,
+		Model:       c.Model,
+		Provider:    c.Provider,
+		Usage: ResponseUsage{
+			InputTokens:         c.Usage.PromptTokens,
+			InputTokensDetails:  InputTokenDetails{CachedTokens: max(c.Usage.PromptTokensDetails.CachedTokens, c.Usage.PromptCacheHitTokens)},
+			OutputTokens:        c.Usage.CompletionTokens,
+			OutputTokensDetails: OutputTokenDetails{ReasoningTokens: c.Usage.CompletionTokensDetails.ReasoningTokens},
+			TotalTokens:         c.Usage.TotalTokens,
+		},
+	}
+
+	if len(c.Choices) == 0 {
+		return nil, fmt.Errorf("chat completion %s has no choices", c.ID)
+	}
+	choice := c.Choices[0]
+
+	switch choice.FinishReason {
+	case "length":
+		response.Status = "incomplete"
+		response.IncompleteDetails.Reason = "max_output_tokens"
+	case "content_filter":
+		response.Status = "incomplete"
+		response.IncompleteDetails.Reason = "content_filter"
+	}
+
+	add := func(v any) error {
+		item, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode chat completion output - %w", err)
+		}
+		response.Output = append(response.Output, item)
+		return nil
+	}
+
+	if choice.Message.ReasoningContent != "" {
+		err := add(ReasoningItem{
+			BaseItem: BaseItem{Type: "reasoning"},
+			Summary:  []ReasoningSummary{{Type: "summary_text", Text: choice.Message.ReasoningContent}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if choice.Message.Content != "" || choice.Message.Refusal != "" {
+		err := add(Message{
+			BaseItem: BaseItem{Type: "message"},
+			Role:     "assistant",
+			Status:   "completed",
+			Content: []MessageContent{{
+				Type:     "output_text",
+				Text:     choice.Message.Content,
+				Refusal:  choice.Message.Refusal,
+				Logprobs: choice.Logprobs.Content,
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, call := range choice.Message.ToolCalls {
+		err := add(FunctionToolCall{
+			BaseItem:  BaseItem{Type: "function_call"},
+			CallID:    call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+			Status:    "completed",
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &response, nil
+}
@@ -0,0 +1,23 @@
+package openai
+
+import (
+	"net/http"
+)
+
+// Where DeepSeek serves its openai compatible api
+const DeepSeekBaseURL = "https://api.deepseek.com"
+
+// NewDeepSeekClient creates a client for DeepSeek, which only speaks chat
+// completions. The chain of thought reasoning models such as
+// deepseek-reasoner return as reasoning_content comes back as
+// Result.Thoughts, and is left out of later requests as DeepSeek rejects
+// it being sent back.
+func NewDeepSeekClient(client *http.Client, auth string) (*OpenAI, error) {
+	oa, err := NewCompatibleClient(client, auth, DeepSeekBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	oa.ChatCompletions = true
+
+	return oa, nil
+}
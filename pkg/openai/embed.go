@@ -0,0 +1,229 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Most inputs /v1/embeddings accepts in one request
+const MaxEmbedBatch = 2048
+
+type EmbeddingRequest struct {
+	// Texts to embed
+	Input []string `json:"input"`
+	// Embedding model, e.g. text-embedding-3-small
+	Model string `json:"model"`
+	// Optionally truncates embeddings to fewer dimensions, text-embedding-3
+	// and newer only
+	Dimensions int `json:"dimensions,omitempty"`
+	// A unique identifier representing your end-user, which can help OpenAI to monitor and detect abuse
+	User string `json:"user,omitempty"`
+}
+
+type Embedding struct {
+	// Position of the input this embedding is for
+	Index     int       `json:"index"`
+	Embedding []float32 `json:"embedding"`
+}
+
+type EmbeddingResponse struct {
+	Data  []Embedding `json:"data"`
+	Model string      `json:"model"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// CreateEmbeddings embeds up to MaxEmbedBatch inputs in a single request
+func (oa *OpenAI) CreateEmbeddings(ctx context.Context, req EmbeddingRequest) (*EmbeddingResponse, error) {
+	if len(req.Input) > MaxEmbedBatch {
+		return nil, fmt.Errorf("batch of %d exceeds %d inputs", len(req.Input), MaxEmbedBatch)
+	}
+
+	var out EmbeddingResponse
+	if err := oa.do(ctx, http.MethodPost, "/embeddings", req, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// Embeds text with an openai embedding model, implementing embed.Embedder.
+// Inputs are split into batches embedded concurrently, with rate limited
+// batches retried after a backoff.
+type Embedder struct {
+	Client *OpenAI
+	Model  string
+	// Optionally truncates embeddings to fewer dimensions
+	Dimensions int
+	// Inputs per request, defaults to 512
+	BatchSize int
+	// Requests in flight at once, defaults to 4
+	Workers int
+	// Requests started per minute across every worker, 0 for no limit
+	RequestsPerMinute int
+	// Attempts at a rate limited batch before giving up, defaults to 5
+	MaxAttempts int
+	// Wait before retrying a rate limited batch when openai doesn't say how
+	// long to wait, doubling each attempt. Defaults to a second.
+	Backoff time.Duration
+}
+
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	size := e.BatchSize
+	if size <= 0 {
+		size = 512
+	}
+	size = min(size, MaxEmbedBatch)
+
+	workers := e.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	limit := newLimiter(e.RequestsPerMinute)
+	vectors := make([][]float32, len(texts))
+	starts := make(chan int)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failed error
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for start := range starts {
+				end := min(start+size, len(texts))
+				if err := e.batch(ctx, limit, texts[start:end], vectors[start:end]); err != nil {
+					once.Do(func() {
+						failed = fmt.Errorf("failed to embed inputs %d to %d - %w", start, end, err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for start := 0; start < len(texts); start += size {
+		select {
+		case starts <- start:
+		case <-ctx.Done():
+		}
+	}
+	close(starts)
+	wg.Wait()
+
+	if failed != nil {
+		return nil, failed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return vectors, nil
+}
+
+// Embeds a single batch into out, retrying while rate limited
+func (e *Embedder) batch(ctx context.Context, limit *limiter, texts []string, out [][]float32) error {
+	attempts := e.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+
+	backoff := e.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := limit.wait(ctx); err != nil {
+			return err
+		}
+
+		resp, err := e.Client.CreateEmbeddings(ctx, EmbeddingRequest{Input: texts, Model: e.Model, Dimensions: e.Dimensions})
+
+		var status *APIError
+		if errors.As(err, &status) && status.StatusCode == http.StatusTooManyRequests && attempt < attempts {
+			wait := status.RetryAfter
+			if wait <= 0 {
+				wait = backoff << (attempt - 1)
+			}
+
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Data) != len(texts) {
+			return fmt.Errorf("expected %d embeddings but got %d", len(texts), len(resp.Data))
+		}
+
+		for _, embedding := range resp.Data {
+			if embedding.Index < 0 || embedding.Index >= len(out) {
+				return fmt.Errorf("embedding index %d out of range", embedding.Index)
+			}
+			out[embedding.Index] = embedding.Embedding
+		}
+
+		return nil
+	}
+}
+
+func NewEmbedder(client *OpenAI, model string) *Embedder {
+	return &Embedder{Client: client, Model: model}
+}
+
+// Spaces out requests evenly to stay under a per minute rate
+type limiter struct {
+	mux      sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(perMinute int) *limiter {
+	if perMinute <= 0 {
+		return &limiter{}
+	}
+
+	return &limiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// Blocks until the next request may start
+func (l *limiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	l.mux.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mux.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package openai
+
+import (
+	"context"
+	"net/http"
+)
+
+type ImageRequest struct {
+	// Image model, e.g. gpt-image-1 or dall-e-3
+	Model  string `json:"model,omitempty"`
+	Prompt string `json:"prompt"`
+	// Number of images, dall-e-3 only supports 1
+	N int `json:"n,omitempty"`
+	// e.g. 1024x1024, 1536x1024 or auto
+	Size string `json:"size,omitempty"`
+	// e.g. low, medium, high or auto for gpt-image-1, standard or hd for
+	// dall-e-3
+	Quality string `json:"quality,omitempty"`
+	// url or b64_json, dall-e only as gpt-image-1 always returns b64_json
+	ResponseFormat string `json:"response_format,omitempty"`
+	// png, jpeg or webp, gpt-image-1 only
+	OutputFormat string `json:"output_format,omitempty"`
+	// transparent, opaque or auto, gpt-image-1 only
+	Background string `json:"background,omitempty"`
+	// A unique identifier representing your end-user, which can help OpenAI to monitor and detect abuse
+	User string `json:"user,omitempty"`
+}
+
+type Image struct {
+	// Image bytes, when returned as b64_json
+	Data []byte `json:"b64_json,omitempty"`
+	// Temporary link to the image, when returned as a url
+	URL string `json:"url,omitempty"`
+	// The prompt the model actually used, dall-e-3 only
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+type ImageResponse struct {
+	Created int     `json:"created"`
+	Data    []Image `json:"data"`
+	// Token usage, gpt-image-1 only
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// GenerateImages creates images from a prompt
+func (oa *OpenAI) GenerateImages(ctx context.Context, req ImageRequest) (*ImageResponse, error) {
+	var out ImageResponse
+	if err := oa.do(ctx, http.MethodPost, "/images/generations", req, &out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -3,13 +3,23 @@ package openai
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
 	"github.com/calamity-m/clusterfuc/pkg/tool"
 )
 
@@ -28,8 +38,12 @@ type CreateResponse struct {
 	TopP float32 `json:"top_p,omitempty"`
 	// A unique identifier representing your end-user, which can help OpenAI to monitor and detect abuse
 	User string `json:"user,omitempty"`
-	// Specifies the latency tier to use for processing the request. This parameter is relevant for customers subscribed to the scale tier service
+	// Specifies the latency tier to use for processing the request, one of the ServiceTier constants.
+	// Empty uses the project default.
 	ServiceTier string `json:"service_tier,omitempty"`
+	// Groups requests sharing a prompt prefix, such as those of one conversation, so they are routed to
+	// where the prefix is cached
+	PromptCacheKey string `json:"prompt_cache_key,omitempty"`
 	// Model to use, e.g. gpt-4o
 	Model string `json:"model"`
 	// o-series models only - reasoning configuration
@@ -52,10 +66,35 @@ type CreateResponse struct {
 	Include []Includable `json:"include,omitzero"`
 	// Whether to store the generated model response for later retrieval via API
 	Store bool `json:"store,omitempty"`
-	// If set to true, the model response data will be streamed to the client as it is generated using server-sent events
+	// If set to true, the model response data will be streamed to the client as it is generated using server-sent events.
+	// Set for the generation by OpenAI.Stream rather than directly.
 	Stream bool `json:"stream,omitempty"`
+	// Called with each piece of output text as it streams in. Never stored in history.
+	OnText func(text string) `json:"-"`
+	// Extra top level fields sent with the request, such as those required
+	// by a gateway sitting in front of openai. Never stored in history.
+	Extra map[string]any `json:"-"`
+	// Sampling options the responses api has no place for, sent only in
+	// chat completions mode. Never stored in history.
+	Stop             []string `json:"-"`
+	Seed             *int     `json:"-"`
+	PresencePenalty  *float64 `json:"-"`
+	FrequencyPenalty *float64 `json:"-"`
 }
 
+// Tiers requests can be processed with, trading cost against latency
+const (
+	// Uses the project's default tier, which may be scale tier
+	ServiceTierAuto = "auto"
+	// Standard pricing and performance
+	ServiceTierDefault = "default"
+	// Cheaper but slower, and may fail with a 429 when capacity is short.
+	// Suits batchy workloads that can wait.
+	ServiceTierFlex = "flex"
+	// Faster but pricier
+	ServiceTierPriority = "priority"
+)
+
 type Includable string
 
 const (
@@ -65,13 +104,46 @@ const (
 	IncludableInputImageImageUrl Includable = "message.input_image.image_url"
 	// Include image urls from the computer call output
 	IncludableComputerCallOutputImageUrl Includable = "computer_call_output.output.image_url"
+	// Include an encrypted copy of reasoning, letting it be replayed without
+	// storing responses
+	IncludableReasoningEncryptedContent Includable = "reasoning.encrypted_content"
+	// Include the log probability of each token of output text
+	IncludableOutputTextLogprobs Includable = "message.output_text.logprobs"
 )
 
 type Reasoning struct {
-	Effort  string `json:"effort"`
+	Effort  string `json:"effort,omitempty"`
 	Summary string `json:"summary,omitempty"`
 }
 
+// Reasoning produced by reasoning models, such as the o-series. It has to be
+// passed back in later requests for the model to keep its reasoning across
+// tool calls.
+type ReasoningItem struct {
+	BaseItem
+	ID      string             `json:"id,omitempty"`
+	Summary []ReasoningSummary `json:"summary"`
+	// Only returned when requested through Include
+	EncryptedContent string `json:"encrypted_content,omitempty"`
+}
+
+type ReasoningSummary struct {
+	// Always `summary_text`
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// ReasoningModel reports whether a model produces reasoning items
+func ReasoningModel(model string) bool {
+	for _, prefix := range []string{"o1", "o3", "o4", "gpt-5"} {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
 type TextResponseFormatConfiguration struct {
 	// response format. Used to generate responses. Either `text` or `json_schema`
 	Type string `json:"type"`
@@ -95,15 +167,15 @@ type FunctionTool struct {
 	Description string `json:"description,omitempty"`
 	// A JSON schema object describing the parameters of the function
 	Parameters FunctionToolParameters `json:"parameters,omitempty"`
-	// Whether to enforce strict parameter validation. Default `true`
-	Strict bool `json:"strict,omitempty"`
+	// Whether to enforce strict parameter validation. Default `true`, so always send it
+	Strict bool `json:"strict"`
 }
 
 type FunctionToolParameters struct {
 	Type                 string          `json:"type,omitempty"`
 	Properties           json.RawMessage `json:"properties,omitzero"`
 	Required             []string        `json:"required,omitempty"`
-	AdditionalProperties bool            `json:"additionalProperties,omitempty"`
+	AdditionalProperties bool            `json:"additionalProperties"`
 }
 
 type Message struct {
@@ -120,14 +192,25 @@ type Message struct {
 
 // Currently MessageContent only supports text, not file or image
 type MessageContent struct {
-	// The type of the output text. Always either output_text or input_text.
+	// One of output_text, input_text or input_image
 	Type string `json:"type,omitempty"`
 	// The text output from the model
 	Text string `json:"text,omitempty"`
+	// Url of an input_image, which may be a base64 data url, see
+	// ImageContent
+	ImageURL string `json:"image_url,omitempty"`
 	// The annotations of the text output
 	Annotations []json.RawMessage `json:"annotations,omitzero"`
 	// The refusal explanation from the model.
 	Refusal string `json:"refusal,omitempty"`
+	// Log probability of each token of the text, when
+	// IncludableOutputTextLogprobs is included
+	Logprobs []Logprob `json:"logprobs,omitzero"`
+}
+
+type Logprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
 }
 
 type FunctionToolCall struct {
@@ -177,6 +260,14 @@ type Response struct {
 	Output []json.RawMessage `json:"output,omitempty"`
 	// Represents token usage details including input tokens, output tokens, a breakdown of output tokens, and the total tokens used
 	Usage ResponseUsage `json:"usage,omitempty"`
+	// The tier the response was actually processed with, which may differ
+	// from the one requested
+	ServiceTier string `json:"service_tier,omitempty"`
+	// The model that produced the response, such as a dated snapshot of
+	// the one requested
+	Model string `json:"model,omitempty"`
+	// The upstream provider that served the response, OpenRouter only
+	Provider string `json:"provider,omitempty"`
 }
 
 type ResponseUsage struct {
@@ -210,7 +301,8 @@ type ResponseError struct {
 }
 
 type IncompleteDetails struct {
-	Reason string
+	// Why the response is incomplete, max_output_tokens or content_filter
+	Reason string `json:"reason,omitempty"`
 }
 
 // Potential input items that create and response can trade back and forth with
@@ -218,9 +310,215 @@ type BaseItem struct {
 	Type string `json:"type"`
 }
 
+// A single page of input items used to generate a stored response
+type InputItemList struct {
+	// Always `list`
+	Object string `json:"object,omitempty"`
+	// The input items, in the same shape they were sent in
+	Data []json.RawMessage `json:"data,omitempty"`
+	// The ID of the first item in the list
+	FirstID string `json:"first_id,omitempty"`
+	// The ID of the last item in the list
+	LastID string `json:"last_id,omitempty"`
+	// Whether there are more items available
+	HasMore bool `json:"has_more,omitempty"`
+}
+
+// Optional pagination parameters for listing input items
+type ListInputItemsParams struct {
+	// An item ID to list items after, used in pagination
+	After string
+	// An item ID to list items before, used in pagination
+	Before string
+	// Number of items to return, between 1 and 100
+	Limit int
+	// The order to return the input items in. Either `asc` or `desc`
+	Order string
+}
+
+func (p *ListInputItemsParams) query() string {
+	if p == nil {
+		return ""
+	}
+
+	q := url.Values{}
+	if p.After != "" {
+		q.Set("after", p.After)
+	}
+	if p.Before != "" {
+		q.Set("before", p.Before)
+	}
+	if p.Limit > 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Order != "" {
+		q.Set("order", p.Order)
+	}
+
+	if len(q) == 0 {
+		return ""
+	}
+
+	return "?" + q.Encode()
+}
+
+// CompactToolOutputs replaces the output of every function call in the body
+// with the result of fn, letting bulky tool results be shrunk once the model
+// has seen them
+func (b *CreateResponse) CompactToolOutputs(fn func(output string) string) error {
+	for i, item := range b.Input {
+		var base BaseItem
+		if err := json.Unmarshal(item, &base); err != nil {
+			return fmt.Errorf("failed decoding input type - %w", err)
+		}
+
+		if base.Type != "function_call_output" {
+			continue
+		}
+
+		var output FunctionToolCallOutput
+		if err := json.Unmarshal(item, &output); err != nil {
+			return fmt.Errorf("failed to decode function_call_output - %w", err)
+		}
+
+		compacted := fn(output.Output)
+		if compacted == output.Output {
+			continue
+		}
+		output.Output = compacted
+
+		encoded, err := json.Marshal(output)
+		if err != nil {
+			return fmt.Errorf("failed encoding compacted tool output - %w", err)
+		}
+		b.Input[i] = encoded
+	}
+
+	return nil
+}
+
+// AppendUserInput adds a user message to the end of the input
+func (b *CreateResponse) AppendUserInput(text string) error {
+	i, err := json.Marshal(Message{
+		BaseItem: BaseItem{
+			Type: "message",
+		},
+		Role: "user",
+		Content: []MessageContent{
+			{
+				Type: "input_text",
+				Text: text,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode user input - %w", err)
+	}
+	b.Input = append(b.Input, i)
+
+	return nil
+}
+
+// ImageContent builds the content of an image sent with a message
+func ImageContent(mimeType string, data []byte) MessageContent {
+	return MessageContent{
+		Type:     "input_image",
+		ImageURL: "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+// InputMessage builds an input item of a message with any content, such as
+// text alongside images, or an earlier reply of the assistant's
+func InputMessage(role string, content ...MessageContent) (json.RawMessage, error) {
+	i, err := json.Marshal(Message{BaseItem: BaseItem{Type: "message"}, Role: role, Content: content})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s message - %w", role, err)
+	}
+
+	return i, nil
+}
+
+// DeveloperMessage builds an input item of instructions, which unlike
+// CreateResponse.Instructions can sit anywhere in the conversation
+func DeveloperMessage(text string) (json.RawMessage, error) {
+	i, err := json.Marshal(Message{
+		BaseItem: BaseItem{
+			Type: "message",
+		},
+		Role: "developer",
+		Content: []MessageContent{
+			{
+				Type: "input_text",
+				Text: text,
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode developer message - %w", err)
+	}
+
+	return i, nil
+}
+
+// Request bodies are encoded into pooled buffers, as a long tool call loop
+// would otherwise allocate a fresh one per round trip
+var buffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// Returns a buffer to the pool, unless an unusually large request has grown
+// it to a size not worth holding on to
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > 4<<20 {
+		return
+	}
+
+	buffers.Put(buf)
+}
+
 type OpenAI struct {
-	client *http.Client
-	auth   string
+	client  *http.Client
+	auth    string
+	baseURL string
+	// Wraps every create response request, see Middleware
+	Middleware []Middleware
+	// Optionally signs every request, for gateways that require it
+	Signer signer.Signer
+	// Optional pool of keys used instead of auth, see keypool.Pool
+	Keys *keypool.Pool
+	// Optional Azure OpenAI deployment to send requests to instead of openai
+	Azure *Azure
+	// Send requests to /chat/completions rather than /responses, for openai
+	// compatible servers that only implement chat completions. Requests and
+	// history keep the responses shape, being translated on the way out and
+	// back.
+	ChatCompletions bool
+	// Adapts chat completions to servers departing from openai's, such as
+	// mistral, see mistral.NewMistralClient. Chat completions mode only.
+	Dialect Dialect
+	// Routing preferences sent with every request, OpenRouter only
+	Route *Route
+	// Gzip large request bodies, such as those carrying many tool schemas.
+	// Only enable when whatever receives requests accepts compressed ones.
+	Compress bool
+	// Requests larger than this, before any compression, fail with
+	// httpclient.ErrRequestTooLarge rather than being sent. 0 allows any
+	// size.
+	MaxRequestBytes int64
+	// Responses larger than this fail with httpclient.ErrResponseTooLarge.
+	// Defaults to httpclient.DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+	// Limits each http round trip to openai, 0 for none. Unlike a deadline
+	// on the call's context, a round trip that times out is retried.
+	RequestTimeout time.Duration
+	// Attempts at a round trip that times out, defaults to 1
+	RequestAttempts int
+	// Called when the model calls a tool that isn't registered. The model
+	// is told the tool is unknown either way.
+	OnUnknownTool func(ctx context.Context, name string)
+	// Called once a registered tool the model called has run, with the
+	// arguments the model gave, how long it ran and any error it returned
+	OnToolCall func(ctx context.Context, name string, args any, elapsed time.Duration, err error)
 }
 
 func (oa *OpenAI) Body(model string, userInput string, prompt string, history json.RawMessage, schema json.RawMessage) (*CreateResponse, error) {
@@ -251,63 +549,142 @@ func (oa *OpenAI) Body(model string, userInput string, prompt string, history js
 	}
 
 	// Set user input
-	i, err := json.Marshal(Message{
-		BaseItem: BaseItem{
-			Type: "message",
-		},
-		Role: "user",
-		Content: []MessageContent{
-			{
-				Type: "input_text",
-				Text: userInput,
-			},
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode user input - %w", err)
+	if err := body.AppendUserInput(userInput); err != nil {
+		return nil, err
 	}
-	body.Input = append(body.Input, i)
 
 	// Set model
 	body.Model = model
 
+	// Reasoning can only be replayed from its encrypted form when responses
+	// aren't stored for openai to look it up by id
+	if ReasoningModel(model) && !body.Store && !slices.Contains(body.Include, IncludableReasoningEncryptedContent) {
+		body.Include = append(body.Include, IncludableReasoningEncryptedContent)
+	}
+
 	return &body, nil
 }
 
-func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []tool.Tool[any, any]) (*CreateResponse, string, error) {
-	if body == nil {
-		return nil, "", errors.New("nil body")
+// ToolChoice builds a tool_choice value. Mode is one of `auto`, `none` or
+// `required`. Naming tools restricts the model to them, and with a mode of
+// `required` forces it to call one of them.
+func ToolChoice(mode string, names ...string) (json.RawMessage, error) {
+	switch {
+	case len(names) == 0:
+		return json.Marshal(mode)
+	case len(names) == 1 && mode == "required":
+		return json.Marshal(map[string]string{"type": "function", "name": names[0]})
+	default:
+		allowed := make([]map[string]string, len(names))
+		for i, name := range names {
+			allowed[i] = map[string]string{"type": "function", "name": name}
+		}
+		return json.Marshal(map[string]any{"type": "allowed_tools", "mode": mode, "tools": allowed})
 	}
+}
 
-	slog.DebugContext(ctx, "openai agent called", slog.String("model", body.Model))
+// The outcome of a generation
+type Result struct {
+	// Text the model replied with
+	Text string
+	// Summaries of the model's reasoning, when requested through
+	// Reasoning.Summary
+	Thoughts string
+	// Tokens used across every request made for the generation
+	Usage ResponseUsage
+	// Why the final response stopped early, empty when it completed
+	Incomplete string
+	// Input tokens of the final request, the size of the whole conversation
+	// as the model last saw it
+	PromptTokens int
+	// Log probability of each token of the reply, when
+	// IncludableOutputTextLogprobs is included
+	Logprobs []float64
+	// Tier the final request was processed with
+	ServiceTier string
+	// Model and upstream provider that served the final request, see
+	// Response.Model and Response.Provider
+	Model    string
+	Provider string
+}
+
+// Whether the reply was cut short by CreateResponse.MaxOutputTokens
+func (r Result) Truncated() bool {
+	return r.Incomplete == "max_output_tokens"
+}
+
+// Add sums two usages together
+func (u ResponseUsage) Add(other ResponseUsage) ResponseUsage {
+	return ResponseUsage{
+		InputTokens:         u.InputTokens + other.InputTokens,
+		InputTokensDetails:  InputTokenDetails{CachedTokens: u.InputTokensDetails.CachedTokens + other.InputTokensDetails.CachedTokens},
+		OutputTokens:        u.OutputTokens + other.OutputTokens,
+		OutputTokensDetails: OutputTokenDetails{ReasoningTokens: u.OutputTokensDetails.ReasoningTokens + other.OutputTokensDetails.ReasoningTokens},
+		TotalTokens:         u.TotalTokens + other.TotalTokens,
+	}
+}
 
-	// Set our tools on our body
-	if len(body.Tools) == 0 {
-		for _, tool := range tools {
-			params, err := json.Marshal(tool.Definition.Properties)
+// SetTools offers tools as the body's function tools, replacing those it
+// held, and reports how they changed
+func (b *CreateResponse) SetTools(tools []tool.Tool[any, any]) (tool.Changes, error) {
+	offered := make([]FunctionTool, 0, len(tools))
+	for _, t := range tools {
+		params, err := json.Marshal(t.Definition.Properties)
+		if err != nil {
+			return tool.Changes{}, fmt.Errorf("failed to encode tool for request - %w", err)
+		}
+
+		required := t.Definition.Required
+		if t.Strict {
+			params, required, err = strictProperties(params, required)
 			if err != nil {
-				return nil, "", fmt.Errorf("failed to encode tool for request - %w", err)
+				return tool.Changes{}, fmt.Errorf("tool %s cannot be strict - %w", t.Name, err)
 			}
-			body.Tools = append(body.Tools, FunctionTool{
-				Type:        "function",
-				Name:        tool.Name,
-				Description: tool.Description,
-				Strict:      false,
-				Parameters: FunctionToolParameters{
-					Type:                 "object",
-					Properties:           params,
-					Required:             tool.Definition.Required,
-					AdditionalProperties: false,
-				},
-			})
 		}
+
+		offered = append(offered, FunctionTool{
+			Type:        "function",
+			Name:        t.Name,
+			Description: t.Describe(),
+			Strict:      t.Strict,
+			Parameters: FunctionToolParameters{
+				Type:                 "object",
+				Properties:           params,
+				Required:             required,
+				AdditionalProperties: false,
+			},
+		})
+	}
+
+	changes := tool.Diff(b.Tools, offered, func(t FunctionTool) string { return t.Name })
+	b.Tools = offered
+
+	return changes, nil
+}
+
+func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []tool.Tool[any, any]) (*CreateResponse, Result, error) {
+	if body == nil {
+		return nil, Result{}, errors.New("nil body")
+	}
+
+	slog.DebugContext(ctx, "openai agent called", slog.String("model", body.Model))
+
+	// Tools are offered afresh every request, as those stored with history
+	// may have changed since
+	offered := len(body.Tools) > 0
+	changes, err := body.SetTools(tools)
+	if err != nil {
+		return nil, Result{}, err
+	}
+	if offered && !changes.Empty() {
+		slog.DebugContext(ctx, "tools changed since the last request", slog.Any("changes", changes))
 	}
 
 	slog.DebugContext(ctx, "openai agent tools registered", slog.Any("tools", body.Tools))
 
 	// In case we are returning, we need to record
 	// our potential replies
-	reply := ""
+	reply := Result{}
 
 	// We might have function calls that require a resend
 	calls := false
@@ -317,18 +694,27 @@ func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []to
 	// exit
 	select {
 	case <-ctx.Done():
-		return nil, "", ctx.Err()
+		return nil, Result{}, ctx.Err()
 	default:
 		// Send body and get resp
 		resp, err := oa.createResponse(ctx, *body)
 		if err != nil {
-			return nil, "", err
+			return nil, Result{}, err
 		}
 
-		slog.DebugContext(ctx, "received response from openai", slog.Any("resp", resp))
+		slog.DebugContext(ctx, "received response from openai", slog.String("id", resp.ID), slog.String("status", resp.Status))
 
 		if resp.Output == nil {
-			return nil, "", errors.New("invalid output")
+			return nil, Result{}, errors.New("invalid output")
+		}
+
+		reply.Usage = resp.Usage
+		reply.PromptTokens = resp.Usage.InputTokens
+		reply.ServiceTier = resp.ServiceTier
+		reply.Model = resp.Model
+		reply.Provider = resp.Provider
+		if resp.Status == "incomplete" {
+			reply.Incomplete = resp.IncompleteDetails.Reason
 		}
 
 		// loop through response output
@@ -336,7 +722,7 @@ func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []to
 			var base BaseItem
 			err := json.Unmarshal(output, &base)
 			if err != nil {
-				return nil, "", fmt.Errorf("failed decoding input type - %w", err)
+				return nil, Result{}, fmt.Errorf("failed decoding input type - %w", err)
 			}
 
 			switch base.Type {
@@ -347,20 +733,24 @@ func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []to
 				var message Message
 				err := json.Unmarshal(output, &message)
 				if err != nil {
-					return nil, "", fmt.Errorf("failed to decode output_text - %w", err)
+					return nil, Result{}, fmt.Errorf("failed to decode output_text - %w", err)
 				}
 
 				for _, content := range message.Content {
 					if content.Type != "output_text" {
 						slog.ErrorContext(ctx, "received non output_text message from model", slog.Any("type", content.Type))
-						return nil, "", fmt.Errorf("received non output_text message from model")
+						return nil, Result{}, fmt.Errorf("received non output_text message from model")
 					}
 
 					if content.Refusal != "" {
-						slog.ErrorContext(ctx, "encountered refusal", slog.Any("reply", reply), slog.Any("refusal", content.Refusal))
-						return nil, "", fmt.Errorf("refusal encountered: %s", content.Refusal)
+						slog.ErrorContext(ctx, "encountered refusal", slog.Any("reply", reply.Text), slog.Any("refusal", content.Refusal))
+						return nil, Result{}, fmt.Errorf("refusal encountered: %s", content.Refusal)
 					} else {
-						reply += content.Text
+						reply.Text += content.Text
+					}
+
+					for _, logprob := range content.Logprobs {
+						reply.Logprobs = append(reply.Logprobs, logprob.Logprob)
 					}
 				}
 
@@ -372,55 +762,60 @@ func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []to
 				err := json.Unmarshal(output, &call)
 				if err != nil {
 					slog.ErrorContext(ctx, "encountered err while parsing tool call", slog.Any("error", err))
-					return nil, "", fmt.Errorf("failed to decode function_call - %w", err)
+					return nil, Result{}, fmt.Errorf("failed to decode function_call - %w", err)
 				}
 
-				for _, tool := range tools {
-					if tool.Name == call.Name {
-						result, err := tool.Executable.Execute(ctx, call.Arguments)
-						if err != nil {
-							// Tool failures might be expected, so we'll append it to input and move on
-							// rather than failing outright
-							slog.ErrorContext(ctx, "encountered err while executing tool", slog.Any("error", err))
-							output, err := json.Marshal(FunctionToolCallOutput{
-								BaseItem: BaseItem{Type: "function_call_output"},
-								CallID:   call.CallID,
-								Output:   errorResponse(err.Error()),
-							})
-							if err != nil {
-								return nil, reply, fmt.Errorf("failed encoding tool call failure - %w", err)
-							}
-							body.Input = append(body.Input, output)
-							continue
-						}
-
-						str, err := json.Marshal(result)
-						if err != nil {
-							return nil, reply, fmt.Errorf("failed to encode results into json - %w", err)
-						}
-						output, err := json.Marshal(FunctionToolCallOutput{
-							BaseItem: BaseItem{Type: "function_call_output"},
-							CallID:   call.CallID,
-							Output:   string(str),
-						})
-						if err != nil {
-							return nil, reply, fmt.Errorf("failed encoding tool call result - %w", err)
-						}
-
-						body.Input = append(body.Input, output)
-					}
+				result, err := oa.execute(ctx, call, tools)
+				if err != nil {
+					return nil, Result{}, err
 				}
 
+				output, err = json.Marshal(FunctionToolCallOutput{
+					BaseItem: BaseItem{Type: "function_call_output"},
+					CallID:   call.CallID,
+					Output:   result,
+				})
+				if err != nil {
+					return nil, Result{}, fmt.Errorf("failed encoding tool call result - %w", err)
+				}
+
+				body.Input = append(body.Input, output)
+
 				calls = true
+			case "reasoning":
+				// Reasoning must be replayed alongside the function calls
+				// it led to, so it stays in our history
+				body.Input = append(body.Input, output)
+
+				var reasoning ReasoningItem
+				if err := json.Unmarshal(output, &reasoning); err != nil {
+					return nil, Result{}, fmt.Errorf("failed to decode reasoning - %w", err)
+				}
+
+				for _, summary := range reasoning.Summary {
+					reply.Thoughts += summary.Text
+				}
+
 			default:
 				slog.ErrorContext(ctx, "failed to match output type", slog.Any("type", base.Type), slog.Any("raw", output))
-				return nil, "", errors.New("unmatched idk")
+				return nil, Result{}, errors.New("unmatched idk")
 			}
 		}
 
-		// Send response through again if we are not marked as completed
-		if calls || resp.Status != "completed" {
-			return oa.Generate(ctx, body, tools)
+		// Send response through again if we are not marked as completed.
+		// Incomplete responses are final, resending them would only repeat
+		// the same cut off.
+		if calls || (resp.Status != "completed" && resp.Status != "incomplete") {
+			// A forced tool choice has been honoured, forcing it again
+			// would loop forever
+			if calls {
+				body.ToolChoice = nil
+			}
+
+			body, next, err := oa.Generate(ctx, body, tools)
+			next.Usage = next.Usage.Add(reply.Usage)
+			next.Thoughts = reply.Thoughts + next.Thoughts
+			return body, next, err
 		}
 
 	}
@@ -431,54 +826,365 @@ func (oa *OpenAI) Generate(ctx context.Context, body *CreateResponse, tools []to
 
 // createResponse sends a POST request to the OpenAI /v1/responses endpoint and parses the response
 func (oa *OpenAI) createResponse(ctx context.Context, body CreateResponse) (*Response, error) {
-	// Marshal the request body into JSON
-	bodyBytes, err := json.Marshal(body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	return oa.handler()(ctx, &body)
+}
+
+// GetResponse retrieves a response previously created with Store enabled
+func (oa *OpenAI) GetResponse(ctx context.Context, id string) (*Response, error) {
+	if id == "" {
+		return nil, errors.New("empty response id")
 	}
 
-	// Create the HTTP request
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.openai.com/v1/responses", bytes.NewReader(bodyBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	var response Response
+	if err := oa.do(ctx, http.MethodGet, "/responses/"+url.PathEscape(id), nil, &response); err != nil {
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+oa.auth)
 
-	// Send the HTTP request
-	resp, err := oa.client.Do(req)
+	return &response, nil
+}
+
+// DeleteResponse deletes a stored response
+func (oa *OpenAI) DeleteResponse(ctx context.Context, id string) error {
+	if id == "" {
+		return errors.New("empty response id")
+	}
+
+	var deleted struct {
+		Deleted bool `json:"deleted"`
+	}
+	if err := oa.do(ctx, http.MethodDelete, "/responses/"+url.PathEscape(id), nil, &deleted); err != nil {
+		return err
+	}
+
+	if !deleted.Deleted {
+		return fmt.Errorf("response %s was not deleted", id)
+	}
+
+	return nil
+}
+
+// ListInputItems lists the input items used to generate a stored response. Params
+// may be nil to fetch the first page with the API defaults.
+func (oa *OpenAI) ListInputItems(ctx context.Context, id string, params *ListInputItemsParams) (*InputItemList, error) {
+	if id == "" {
+		return nil, errors.New("empty response id")
+	}
+
+	var list InputItemList
+	if err := oa.do(ctx, http.MethodGet, "/responses/"+url.PathEscape(id)+"/input_items"+params.query(), nil, &list); err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+// do sends a request to the given OpenAI API path, encoding in as the request
+// body when it is non nil and decoding the response body into out
+func (oa *OpenAI) do(ctx context.Context, method string, path string, in any, out any) error {
+	var bodyBytes []byte
+	if in != nil {
+		// Encode the request body into JSON. The buffer is only released
+		// once the response is decoded, as until its body is closed the
+		// transport may still be reading the request.
+		buf := buffers.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer releaseBuffer(buf)
+		if err := json.NewEncoder(buf).Encode(in); err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		bodyBytes = buf.Bytes()
+	}
+
+	resp, err := oa.exchange(ctx, method, path, "application/json", bodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return err
+	}
+
+	return oa.decode(resp, out)
+}
+
+// exchange sends a request body of any content type, returning the response
+// for the caller to close. With a key pool, requests rejected as unauthorized
+// or rate limited are retried with another key.
+func (oa *OpenAI) exchange(ctx context.Context, method string, path string, contentType string, bodyBytes []byte) (*http.Response, error) {
+	if err := httpclient.CheckRequest(bodyBytes, oa.MaxRequestBytes); err != nil {
+		return nil, err
+	}
+
+	compressed := false
+	if oa.Compress && bodyBytes != nil {
+		var err error
+		bodyBytes, compressed, err = httpclient.Compress(bodyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress request body: %w", err)
+		}
 	}
+
+	attempts := 1
+	if oa.Keys != nil {
+		attempts = oa.Keys.Len()
+	}
+
+	for attempt := 1; ; attempt++ {
+		auth := oa.auth
+		if oa.Keys != nil {
+			var err error
+			if auth, err = oa.Keys.Pick(); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := httpclient.RoundTrip(ctx, oa.RequestTimeout, oa.RequestAttempts, func(ctx context.Context) (*http.Response, error) {
+			return oa.send(ctx, method, path, contentType, bodyBytes, compressed, auth)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if oa.Keys != nil {
+			oa.Keys.Report(auth, resp.StatusCode, keypool.RetryAfter(resp.Header))
+			if keypool.Rotate(resp.StatusCode) && attempt < attempts {
+				resp.Body.Close()
+				continue
+			}
+		}
+
+		return resp, nil
+	}
+}
+
+// Types and codes openai reports errors with
+const (
+	ErrorTypeInvalidRequest        = "invalid_request_error"
+	ErrorTypeAuthentication        = "authentication_error"
+	ErrorTypeRateLimit             = "rate_limit_error"
+	ErrorTypeServer                = "server_error"
+	ErrorTypeInsufficientQuota     = "insufficient_quota"
+	ErrorCodeInsufficientQuota     = "insufficient_quota"
+	ErrorCodeRateLimitExceeded     = "rate_limit_exceeded"
+	ErrorCodeInvalidAPIKey         = "invalid_api_key"
+	ErrorCodeContextLengthExceeded = "context_length_exceeded"
+)
+
+// Returned when openai replies with anything but 200, holding the error
+// openai described in the body
+type APIError struct {
+	StatusCode int
+	// e.g. ErrorTypeInvalidRequest
+	Type string `json:"type"`
+	// e.g. ErrorCodeInsufficientQuota, empty for many errors
+	Code string `json:"code"`
+	// Request parameter the error relates to, if any
+	Param   string `json:"param"`
+	Message string `json:"message"`
+	// Raw response body, kept for bodies that aren't an openai error
+	Body string `json:"-"`
+	// How long openai asked to wait before retrying, 0 when it didn't say
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("non-200 status code: %d, body: %s", e.StatusCode, e.Body)
+	}
+
+	kind := e.Type
+	if e.Code != "" && e.Code != e.Type {
+		kind += "/" + e.Code
+	}
+
+	return fmt.Sprintf("openai error %d (%s): %s", e.StatusCode, kind, e.Message)
+}
+
+// Parses the error openai describes in a failed response body. Bodies that
+// aren't json, such as those from a proxy, only keep the raw body.
+func newAPIError(status int, body []byte) *APIError {
+	var payload struct {
+		Error json.RawMessage `json:"error"`
+		// Compatible servers such as mistral describe the error at the top
+		// level, and TGI gives a string error
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}
+	var described struct {
+		Type    string `json:"type"`
+		Code    any    `json:"code"`
+		Param   string `json:"param"`
+		Message string `json:"message"`
+	}
+
+	apiErr := &APIError{StatusCode: status, Body: string(body)}
+	if json.Unmarshal(body, &payload) != nil {
+		return apiErr
+	}
+	if json.Unmarshal(payload.Error, &described) != nil {
+		described.Type = payload.Type
+		described.Message = payload.Message
+		json.Unmarshal(payload.Error, &described.Message)
+	}
+
+	apiErr.Type = described.Type
+	apiErr.Param = described.Param
+	apiErr.Message = described.Message
+	// Codes are usually strings, but some older errors use numbers
+	if described.Code != nil {
+		apiErr.Code = fmt.Sprint(described.Code)
+	}
+
+	return apiErr
+}
+
+// decode streams a response body into out, refusing bodies over the size limit
+func (oa *OpenAI) decode(resp *http.Response, out any) error {
 	defer resp.Body.Close()
 
-	// Read the response body
-	respBody, err := io.ReadAll(resp.Body)
+	body, err := oa.body(resp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return err
 	}
 
+	// Decode the response body into the output
+	if err := json.NewDecoder(body).Decode(out); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+// body limits a response body to the client's maximum size, failing with a
+// APIError for anything but 200
+func (oa *OpenAI) body(resp *http.Response) (io.Reader, error) {
+	limit := oa.MaxResponseBytes
+	if limit <= 0 {
+		limit = httpclient.DefaultMaxResponseBytes
+	}
+	body := httpclient.LimitReader(resp.Body, limit)
+
 	// Check for non-200 status codes
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("non-200 status code: %d, body: %s", resp.StatusCode, string(respBody))
+		failed, _ := io.ReadAll(io.LimitReader(body, 64<<10))
+		apiErr := newAPIError(resp.StatusCode, failed)
+		apiErr.RetryAfter = keypool.RetryAfter(resp.Header)
+		return nil, apiErr
 	}
 
-	// Unmarshal the response body into the Response struct
-	var response Response
-	if err := json.Unmarshal(respBody, &response); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	return body, nil
+}
+
+// send makes a single attempt at a request using the given key. The caller
+// must close the response body.
+func (oa *OpenAI) send(ctx context.Context, method string, path string, contentType string, bodyBytes []byte, compressed bool, auth string) (*http.Response, error) {
+	var reqBody io.Reader
+	if bodyBytes != nil {
+		reqBody = bytes.NewReader(bodyBytes)
 	}
 
-	return &response, nil
+	// Create the HTTP request
+	target := oa.baseURL + path
+	if oa.Azure != nil {
+		target = oa.Azure.url(path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if bodyBytes != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if oa.Azure != nil {
+		req.Header.Set("api-key", auth)
+	} else if auth != "" {
+		// A compatible server of one's own may need no key
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+
+	if oa.Signer != nil {
+		if err := oa.Signer.Sign(req, bodyBytes); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+	}
+
+	// Send the HTTP request
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	return resp, nil
 }
 
+// NewOpenAIClient creates a client, using httpclient.Default when client is nil
 func NewOpenAIClient(client *http.Client, auth string) (*OpenAI, error) {
+	if client == nil {
+		client = httpclient.Default()
+	}
+
 	return &OpenAI{
-		client: client,
-		auth:   auth,
+		client:  client,
+		auth:    auth,
+		baseURL: "https://api.openai.com/v1",
 	}, nil
 }
 
+// NewCompatibleClient creates a client for an openai compatible server, such
+// as vLLM, LM Studio, llama.cpp, Groq or Together, reached at baseURL e.g.
+// http://localhost:8000/v1. Set ChatCompletions for servers without the
+// responses api.
+func NewCompatibleClient(client *http.Client, auth string, baseURL string) (*OpenAI, error) {
+	if baseURL == "" {
+		return nil, errors.New("empty base url")
+	}
+
+	oa, err := NewOpenAIClient(client, auth)
+	if err != nil {
+		return nil, err
+	}
+	oa.baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return oa, nil
+}
+
+// Runs the tool a function call names. Tool failures, and the model calling
+// a tool that doesn't exist, are described in the output so the model can
+// carry on, leaving no call without an output.
+func (oa *OpenAI) execute(ctx context.Context, call FunctionToolCall, tools []tool.Tool[any, any]) (string, error) {
+	for _, t := range tools {
+		if t.Name != call.Name {
+			continue
+		}
+
+		start := time.Now()
+		result, err := tool.Execute(ctx, t, any(call.Arguments))
+		if oa.OnToolCall != nil {
+			oa.OnToolCall(ctx, call.Name, call.Arguments, time.Since(start), err)
+		}
+		if err != nil {
+			// Tool failures might be expected, so we'll hand them back to
+			// the model rather than failing outright
+			slog.ErrorContext(ctx, "encountered err while executing tool", slog.Any("error", err))
+			return errorResponse(err.Error()), nil
+		}
+
+		str, err := json.Marshal(result)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode results into json - %w", err)
+		}
+
+		return string(str), nil
+	}
+
+	slog.WarnContext(ctx, "model called unknown tool", slog.String("tool", call.Name))
+	if oa.OnUnknownTool != nil {
+		oa.OnUnknownTool(ctx, call.Name)
+	}
+
+	return errorResponse("unknown tool " + call.Name), nil
+}
+
 func errorResponse(message string) string {
 	r, err := json.Marshal(struct {
 		Success bool   `json:"success"`
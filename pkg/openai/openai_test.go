@@ -1 +1,1132 @@
 package openai
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/embed"
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/keypool"
+	"github.com/calamity-m/clusterfuc/pkg/speech"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func testClient(t testing.TB, handler http.HandlerFunc) *OpenAI {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	oa, err := NewOpenAIClient(srv.Client(), "test-key")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	oa.baseURL = srv.URL
+
+	return oa
+}
+
+func TestStoredResponses(t *testing.T) {
+	t.Run("get response", func(t *testing.T) {
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != "/responses/resp_123" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			if r.Header.Get("Authorization") != "Bearer test-key" {
+				t.Errorf("expected bearer auth but got %q", r.Header.Get("Authorization"))
+			}
+			w.Write([]byte(`{"id":"resp_123","status":"completed"}`))
+		})
+
+		resp, err := oa.GetResponse(context.Background(), "resp_123")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if resp.ID != "resp_123" || resp.Status != "completed" {
+			t.Errorf("unexpected response %#v", resp)
+		}
+	})
+
+	t.Run("delete response", func(t *testing.T) {
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodDelete || r.URL.Path != "/responses/resp_123" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			w.Write([]byte(`{"id":"resp_123","object":"response","deleted":true}`))
+		})
+
+		if err := oa.DeleteResponse(context.Background(), "resp_123"); err != nil {
+			t.Errorf("did not expect err but got %v", err)
+		}
+	})
+
+	t.Run("list input items", func(t *testing.T) {
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/responses/resp_123/input_items" {
+				t.Errorf("unexpected path %s", r.URL.Path)
+			}
+			if r.URL.Query().Get("limit") != "2" || r.URL.Query().Get("order") != "asc" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"object":"list","data":[{"type":"message"}],"first_id":"a","last_id":"a","has_more":true}`))
+		})
+
+		list, err := oa.ListInputItems(context.Background(), "resp_123", &ListInputItemsParams{Limit: 2, Order: "asc"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(list.Data) != 1 || !list.HasMore {
+			t.Errorf("unexpected list %#v", list)
+		}
+	})
+
+	t.Run("non 200 fails", func(t *testing.T) {
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+
+		if _, err := oa.GetResponse(context.Background(), "missing"); err == nil {
+			t.Errorf("expected err but got nil")
+		}
+	})
+}
+
+func TestStrictProperties(t *testing.T) {
+	type Inner struct {
+		Value int `json:"value"`
+	}
+
+	type Arg struct {
+		Name  string   `json:"name"`
+		Note  string   `json:"note,omitempty"`
+		Inner Inner    `json:"inner"`
+		Tags  []string `json:"tags,omitempty"`
+	}
+
+	t.Run("normalises reflected tool", func(t *testing.T) {
+		created := tool.CreateTool("test", func(ctx context.Context, in Arg) (Arg, error) { return in, nil })
+
+		raw, err := json.Marshal(created.Definition.Properties)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		props, required, err := strictProperties(raw, created.Definition.Required)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !slices.Equal(required, []string{"name", "note", "inner", "tags"}) {
+			t.Errorf("expected every property to be required in order but got %v", required)
+		}
+
+		var decoded map[string]map[string]any
+		if err := json.Unmarshal(props, &decoded); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if decoded["name"]["type"] != "string" {
+			t.Errorf("expected required property to stay non nullable but got %v", decoded["name"]["type"])
+		}
+
+		if !reflect.DeepEqual(decoded["note"]["type"], []any{"string", "null"}) {
+			t.Errorf("expected optional property to become nullable but got %v", decoded["note"]["type"])
+		}
+
+		if decoded["inner"]["additionalProperties"] != false {
+			t.Errorf("expected nested object to disallow additional properties but got %v", decoded["inner"])
+		}
+
+		if !reflect.DeepEqual(decoded["inner"]["required"], []any{"value"}) {
+			t.Errorf("expected nested object to require all properties but got %v", decoded["inner"]["required"])
+		}
+	})
+
+	t.Run("maps are rejected", func(t *testing.T) {
+		_, _, err := strictProperties(json.RawMessage(`{"labels":{"type":"object","additionalProperties":{"type":"string"}}}`), nil)
+		if !errors.Is(err, ErrInvalidStrictSchema) {
+			t.Errorf("expected ErrInvalidStrictSchema but got %v", err)
+		}
+	})
+
+	t.Run("untyped schemas are rejected", func(t *testing.T) {
+		_, _, err := strictProperties(json.RawMessage(`{"anything":{}}`), nil)
+		if !errors.Is(err, ErrInvalidStrictSchema) {
+			t.Errorf("expected ErrInvalidStrictSchema but got %v", err)
+		}
+	})
+}
+
+func TestCompactToolOutputs(t *testing.T) {
+	output, _ := json.Marshal(FunctionToolCallOutput{
+		BaseItem: BaseItem{Type: "function_call_output"},
+		CallID:   "call-1",
+		Output:   `{"rows":"lots and lots of rows"}`,
+	})
+	message, _ := json.Marshal(Message{BaseItem: BaseItem{Type: "message"}, Role: "user"})
+
+	body := CreateResponse{Input: []json.RawMessage{message, output}}
+	err := body.CompactToolOutputs(func(output string) string {
+		return "compacted"
+	})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if string(body.Input[0]) != string(message) {
+		t.Errorf("expected message to be untouched but got %s", body.Input[0])
+	}
+
+	var compacted FunctionToolCallOutput
+	json.Unmarshal(body.Input[1], &compacted)
+	if compacted.Output != "compacted" || compacted.CallID != "call-1" {
+		t.Errorf("expected compacted output for call-1 but got %#v", compacted)
+	}
+}
+
+func TestToolChoice(t *testing.T) {
+	tests := []struct {
+		mode  string
+		names []string
+		want  string
+	}{
+		{mode: "auto", want: `"auto"`},
+		{mode: "required", names: []string{"log"}, want: `{"name":"log","type":"function"}`},
+		{mode: "auto", names: []string{"a", "b"}, want: `{"mode":"auto","tools":[{"name":"a","type":"function"},{"name":"b","type":"function"}],"type":"allowed_tools"}`},
+	}
+
+	for _, tt := range tests {
+		got, err := ToolChoice(tt.mode, tt.names...)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if string(got) != tt.want {
+			t.Errorf("expected %s but got %s", tt.want, got)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	order := []string{}
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var sent map[string]any
+		json.NewDecoder(r.Body).Decode(&sent)
+		if sent["gateway_tenant"] != "a" || sent["user"] != "mutated" {
+			t.Errorf("expected mutated body with extra field but got %v", sent)
+		}
+		w.Write([]byte(`{"id":"resp_123","status":"completed"}`))
+	})
+
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, body *CreateResponse) (*Response, error) {
+				order = append(order, name)
+				return next(ctx, body)
+			}
+		}
+	}
+
+	oa.Middleware = []Middleware{
+		trace("outer"),
+		trace("inner"),
+		func(next Handler) Handler {
+			return func(ctx context.Context, body *CreateResponse) (*Response, error) {
+				body.User = "mutated"
+				body.Extra = map[string]any{"gateway_tenant": "a"}
+				resp, err := next(ctx, body)
+				if err == nil {
+					resp.Status = "seen"
+				}
+				return resp, err
+			}
+		},
+	}
+
+	resp, err := oa.createResponse(context.Background(), CreateResponse{Model: "gpt-4o"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if resp.Status != "seen" {
+		t.Errorf("expected middleware to see the response but got %q", resp.Status)
+	}
+
+	if !slices.Equal(order, []string{"outer", "inner"}) {
+		t.Errorf("expected middleware to run in order but got %v", order)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer limited" {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id":"resp_123"}`))
+	})
+
+	keys, err := keypool.NewPool("limited", "fine")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	oa.Keys = keys
+
+	for range 2 {
+		if _, err := oa.GetResponse(context.Background(), "resp_123"); err != nil {
+			t.Errorf("did not expect err but got %v", err)
+		}
+	}
+}
+
+func BenchmarkGenerate(b *testing.B) {
+	for _, turns := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("%d turns", turns), func(b *testing.B) {
+			oa := testClient(b, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"id":"resp_123","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"a reply"}]}]}`))
+			})
+
+			var history CreateResponse
+			for i := range turns {
+				history.AppendUserInput(fmt.Sprintf("message number %d with a bit of padding to it", i))
+			}
+			raw, _ := json.Marshal(history)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for b.Loop() {
+				body, err := oa.Body("gpt-4o", "hello", "be nice", raw, nil)
+				if err != nil {
+					b.Fatalf("did not expect err but got %v", err)
+				}
+
+				if _, _, err := oa.Generate(context.Background(), body, nil); err != nil {
+					b.Fatalf("did not expect err but got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedRequests(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("expected gzipped request but got %q", r.Header.Get("Content-Encoding"))
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var sent CreateResponse
+		if err := json.NewDecoder(zr).Decode(&sent); err != nil || sent.Instructions == "" {
+			t.Errorf("expected decodable body but got %v", err)
+		}
+		w.Write([]byte(`{"id":"resp_123","status":"completed"}`))
+	})
+	oa.Compress = true
+
+	body := CreateResponse{Model: "gpt-4o", Instructions: strings.Repeat("be helpful. ", 200)}
+	if _, err := oa.createResponse(context.Background(), body); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"resp_123","status":"` + strings.Repeat("x", 1024) + `"}`))
+	})
+	oa.MaxResponseBytes = 512
+
+	if _, err := oa.GetResponse(context.Background(), "resp_123"); !errors.Is(err, httpclient.ErrResponseTooLarge) {
+		t.Errorf("expected ErrResponseTooLarge but got %v", err)
+	}
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	calls := 0
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"id":"resp_123","status":"completed"}`))
+	})
+	oa.MaxRequestBytes = 512
+
+	body := CreateResponse{Model: "gpt-4o", Instructions: strings.Repeat("be helpful. ", 200)}
+	if _, err := oa.createResponse(context.Background(), body); !errors.Is(err, httpclient.ErrRequestTooLarge) {
+		t.Errorf("expected ErrRequestTooLarge but got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("expected the request not to be sent but got %d calls", calls)
+	}
+}
+
+func TestReasoningItems(t *testing.T) {
+	calls := 0
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		var sent CreateResponse
+		json.NewDecoder(r.Body).Decode(&sent)
+
+		if !slices.Contains(sent.Include, IncludableReasoningEncryptedContent) {
+			t.Errorf("expected encrypted reasoning to be requested but got %v", sent.Include)
+		}
+
+		if calls == 1 {
+			w.Write([]byte(`{"id":"resp_1","status":"completed","output":[
+				{"type":"reasoning","id":"rs_1","summary":[{"type":"summary_text","text":"should look it up"}],"encrypted_content":"abc"},
+				{"type":"function_call","call_id":"call_1","name":"lookup","arguments":"{\"term\":\"it\"}"}
+			]}`))
+			return
+		}
+
+		var replayed BaseItem
+		json.Unmarshal(sent.Input[1], &replayed)
+		if replayed.Type != "reasoning" {
+			t.Errorf("expected reasoning to be replayed before the call but got %s", replayed.Type)
+		}
+
+		w.Write([]byte(`{"id":"resp_2","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`))
+	})
+
+	type Query struct {
+		Term string `json:"term"`
+	}
+	lookup := tool.CreateTool("lookup", func(ctx context.Context, in Query) (string, error) { return "found", nil })
+
+	body, err := oa.Body("o4-mini", "find it", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	_, res, err := oa.Generate(context.Background(), body, []tool.Tool[any, any]{lookup})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "done" || res.Thoughts != "should look it up" {
+		t.Errorf("unexpected result %#v", res)
+	}
+}
+
+func TestUnknownTool(t *testing.T) {
+	calls := 0
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls == 1 {
+			w.Write([]byte(`{"id":"resp_1","status":"completed","output":[
+				{"type":"function_call","call_id":"call_1","name":"missing","arguments":"{}"}
+			]}`))
+			return
+		}
+
+		var sent CreateResponse
+		json.NewDecoder(r.Body).Decode(&sent)
+
+		var out FunctionToolCallOutput
+		json.Unmarshal(sent.Input[len(sent.Input)-1], &out)
+		if out.CallID != "call_1" || !strings.Contains(out.Output, "unknown tool missing") {
+			t.Errorf("expected an unknown tool output for the call but got %#v", out)
+		}
+
+		w.Write([]byte(`{"id":"resp_2","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"done"}]}]}`))
+	})
+
+	var unknown string
+	oa.OnUnknownTool = func(ctx context.Context, name string) { unknown = name }
+
+	body, err := oa.Body("gpt-4.1", "find it", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	_, res, err := oa.Generate(context.Background(), body, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "done" {
+		t.Errorf("expected done but got %s", res.Text)
+	}
+
+	if unknown != "missing" {
+		t.Errorf("expected hook to see missing but got %q", unknown)
+	}
+}
+
+func TestEmbeddings(t *testing.T) {
+	var mux sync.Mutex
+	requests, limited := 0, 0
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/embeddings" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+
+		mux.Lock()
+		requests++
+		// Rate limit the first request, it should be retried
+		if requests == 1 {
+			limited++
+			mux.Unlock()
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		mux.Unlock()
+
+		var req EmbeddingRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var out EmbeddingResponse
+		// Reply out of order, the embedder should follow the indexes
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			out.Data = append(out.Data, Embedding{Index: i, Embedding: []float32{float32(len(req.Input[i]))}})
+		}
+		json.NewEncoder(w).Encode(out)
+	})
+
+	var embedder embed.Embedder = &Embedder{
+		Client:    oa,
+		Model:     "text-embedding-3-small",
+		BatchSize: 10,
+		Workers:   3,
+		Backoff:   time.Millisecond,
+	}
+
+	texts := make([]string, 95)
+	for i := range texts {
+		texts[i] = strings.Repeat("a", i)
+	}
+
+	vectors, err := embedder.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	for i, vector := range vectors {
+		if len(vector) != 1 || vector[0] != float32(i) {
+			t.Fatalf("expected vector %d to match its input but got %v", i, vector)
+		}
+	}
+
+	if requests != 11 || limited != 1 {
+		t.Errorf("expected 10 batches and a retry but got %d requests", requests)
+	}
+}
+
+func TestEmbeddingsGiveUp(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	embedder := NewEmbedder(oa, "text-embedding-3-small")
+	embedder.MaxAttempts = 2
+	embedder.Backoff = time.Millisecond
+
+	_, err := embedder.Embed(context.Background(), []string{"a"})
+
+	var status *APIError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected rate limit err but got %v", err)
+	}
+}
+
+func TestGenerateImages(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ImageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/images/generations" || req.Size != "1024x1024" || req.Quality != "high" {
+			t.Errorf("unexpected request to %s with %#v", r.URL.Path, req)
+		}
+
+		w.Write([]byte(`{"created":1,"data":[{"b64_json":"iVBORw=="}]}`))
+	})
+
+	res, err := oa.GenerateImages(context.Background(), ImageRequest{Model: "gpt-image-1", Prompt: "a cat", Size: "1024x1024", Quality: "high"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if len(res.Data) != 1 || string(res.Data[0].Data) != "\x89PNG" {
+		t.Errorf("expected decoded image bytes but got %#v", res.Data)
+	}
+}
+
+func TestVoiceLoop(t *testing.T) {
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/audio/transcriptions":
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+			defer file.Close()
+
+			if header.Filename != "audio.wav" || r.FormValue("model") != "gpt-4o-mini-transcribe" || r.FormValue("language") != "en" {
+				t.Errorf("unexpected transcription form %s %v", header.Filename, r.MultipartForm.Value)
+			}
+			w.Write([]byte(`{"text":"what time is it"}`))
+		case "/audio/speech":
+			var req SpeechRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.Input != "noon" || req.Voice != "coral" || req.ResponseFormat != "mp3" {
+				t.Errorf("unexpected speech request %#v", req)
+			}
+			w.Write([]byte("ID3"))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+
+	transcriber := NewTranscriber(oa)
+	transcriber.Language = "en"
+	speaker := NewSpeaker(oa)
+	speaker.Voice = "coral"
+
+	respond := func(ctx context.Context, text string) (string, error) {
+		if text != "what time is it" {
+			t.Errorf("expected transcript but got %q", text)
+		}
+		return "noon", nil
+	}
+
+	audio, err := speech.Converse(context.Background(), transcriber, respond, speaker, speech.Audio{Data: []byte("RIFF"), MimeType: "audio/wav"})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if string(audio.Data) != "ID3" || audio.MimeType != "audio/mpeg" {
+		t.Errorf("expected mp3 reply but got %#v", audio)
+	}
+
+	t.Run("unsupported audio", func(t *testing.T) {
+		if _, err := transcriber.Transcribe(context.Background(), speech.Audio{MimeType: "audio/midi"}); err == nil {
+			t.Errorf("expected err but got nil")
+		}
+	})
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		errType string
+		code    string
+		param   string
+		message string
+	}{
+		{
+			name:    "invalid request",
+			status:  http.StatusBadRequest,
+			body:    `{"error":{"message":"Unknown parameter: 'foo'.","type":"invalid_request_error","param":"foo","code":"unknown_parameter"}}`,
+			errType: ErrorTypeInvalidRequest,
+			code:    "unknown_parameter",
+			param:   "foo",
+			message: "Unknown parameter: 'foo'.",
+		},
+		{
+			name:    "insufficient quota",
+			status:  http.StatusTooManyRequests,
+			body:    `{"error":{"message":"You exceeded your current quota.","type":"insufficient_quota","param":null,"code":"insufficient_quota"}}`,
+			errType: ErrorTypeInsufficientQuota,
+			code:    ErrorCodeInsufficientQuota,
+			message: "You exceeded your current quota.",
+		},
+		{
+			name:    "described at the top level",
+			status:  http.StatusUnprocessableEntity,
+			body:    `{"object":"error","message":"Extra inputs are not permitted","type":"invalid_request_error","param":null,"code":null}`,
+			errType: ErrorTypeInvalidRequest,
+			message: "Extra inputs are not permitted",
+		},
+		{
+			name:    "string error",
+			status:  http.StatusServiceUnavailable,
+			body:    `{"error":"Model is overloaded","error_type":"overloaded"}`,
+			message: "Model is overloaded",
+		},
+		{
+			name:   "not json",
+			status: http.StatusBadGateway,
+			body:   "bad gateway",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := oa.GetResponse(context.Background(), "resp_1")
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected APIError but got %v", err)
+			}
+
+			if apiErr.StatusCode != tt.status || apiErr.Type != tt.errType || apiErr.Code != tt.code || apiErr.Param != tt.param || apiErr.Message != tt.message {
+				t.Errorf("unexpected error fields %#v", apiErr)
+			}
+
+			if apiErr.Body != tt.body {
+				t.Errorf("expected raw body %q but got %q", tt.body, apiErr.Body)
+			}
+		})
+	}
+}
+
+func TestRepairInput(t *testing.T) {
+	items := func(raw ...string) []json.RawMessage {
+		out := make([]json.RawMessage, len(raw))
+		for i, r := range raw {
+			out[i] = json.RawMessage(r)
+		}
+		return out
+	}
+	types := func(input []json.RawMessage) []string {
+		var out []string
+		for _, raw := range input {
+			var base BaseItem
+			json.Unmarshal(raw, &base)
+			out = append(out, base.Type)
+		}
+		return out
+	}
+
+	user := `{"type":"message","role":"user","content":[{"type":"input_text","text":"hi"}]}`
+	reply := `{"type":"message","role":"assistant","content":[{"type":"output_text","text":"hello"}]}`
+	refusal := `{"type":"message","role":"assistant","content":[{"type":"refusal","refusal":"no"}]}`
+	call := `{"type":"function_call","call_id":"call_1","name":"weather","arguments":"{}"}`
+	output := `{"type":"function_call_output","call_id":"call_1","output":"sunny"}`
+	orphan := `{"type":"function_call_output","call_id":"call_2","output":"rain"}`
+	reasoning := `{"type":"reasoning","id":"rs_1","summary":[]}`
+
+	t.Run("well formed input is untouched", func(t *testing.T) {
+		body := CreateResponse{Input: items(user, reasoning, call, output, reply)}
+		repairs, err := body.RepairInput()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(repairs) != 0 || len(body.Input) != 5 {
+			t.Errorf("expected no repairs but got %v", repairs)
+		}
+	})
+
+	t.Run("calls without output are answered", func(t *testing.T) {
+		body := CreateResponse{Input: items(user, call, user)}
+		repairs, err := body.RepairInput()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		got := types(body.Input)
+		if len(repairs) != 1 || !slices.Equal(got, []string{"message", "function_call", "function_call_output", "message"}) {
+			t.Fatalf("expected an output after the call but got %v", got)
+		}
+
+		var added FunctionToolCallOutput
+		json.Unmarshal(body.Input[2], &added)
+		if added.CallID != "call_1" || !strings.Contains(added.Output, "interrupted") {
+			t.Errorf("expected an interrupted output for call_1 but got %+v", added)
+		}
+	})
+
+	t.Run("orphans and repeats are dropped", func(t *testing.T) {
+		body := CreateResponse{Input: items(user, orphan, call, output, output, call, reply)}
+		repairs, err := body.RepairInput()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if got := types(body.Input); len(repairs) != 3 || !slices.Equal(got, []string{"message", "function_call", "function_call_output", "message"}) {
+			t.Errorf("expected orphan and repeats dropped but got %v from %v", got, repairs)
+		}
+	})
+
+	t.Run("nothing follows a refusal", func(t *testing.T) {
+		body := CreateResponse{Input: items(user, refusal, reply, user, reply)}
+		repairs, err := body.RepairInput()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(repairs) != 1 || len(body.Input) != 4 || string(body.Input[1]) != refusal {
+			t.Errorf("expected the reply after the refusal to be dropped but got %v", repairs)
+		}
+	})
+
+	t.Run("dangling reasoning is dropped", func(t *testing.T) {
+		body := CreateResponse{Input: items(user, reasoning, user, reasoning)}
+		repairs, err := body.RepairInput()
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if got := types(body.Input); len(repairs) != 2 || !slices.Equal(got, []string{"message", "message"}) {
+			t.Errorf("expected reasoning to be dropped but got %v", got)
+		}
+	})
+
+	t.Run("undecodable items fail", func(t *testing.T) {
+		body := CreateResponse{Input: items(user, `{"role":"user"}`)}
+		if _, err := body.RepairInput(); !errors.Is(err, ErrInvalidSequence) {
+			t.Errorf("expected ErrInvalidSequence but got %v", err)
+		}
+		if len(body.Input) != 2 {
+			t.Errorf("expected input to be left alone but got %d items", len(body.Input))
+		}
+	})
+}
+
+func TestAzure(t *testing.T) {
+	var requests []*http.Request
+	oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.Write([]byte(`{"id":"resp_1","status":"completed","object":"list","data":[]}`))
+	})
+	oa.Azure = &Azure{Endpoint: oa.baseURL + "/", Deployment: "prod gpt"}
+	oa.baseURL = "http://unused.invalid"
+
+	if _, err := oa.createResponse(context.Background(), CreateResponse{Model: "gpt-4o"}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if _, err := oa.ListInputItems(context.Background(), "resp_1", &ListInputItemsParams{Limit: 5}); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if got := requests[0].URL.String(); got != "/openai/deployments/prod%20gpt/responses?api-version="+DefaultAzureAPIVersion {
+		t.Errorf("expected a deployment url but got %s", got)
+	}
+	if requests[0].Header.Get("api-key") != "test-key" || requests[0].Header.Get("Authorization") != "" {
+		t.Errorf("expected api-key auth but got %v", requests[0].Header)
+	}
+
+	query := requests[1].URL.Query()
+	if query.Get("api-version") != DefaultAzureAPIVersion || query.Get("limit") != "5" {
+		t.Errorf("expected the path's query kept alongside the version but got %s", requests[1].URL)
+	}
+}
+
+func TestChatCompletions(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("expected a chat completions request but got %s", r.URL.Path)
+		}
+
+		var sent ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&sent)
+
+		if calls == 1 {
+			if sent.Messages[0].Role != "system" || sent.Messages[0].Content != "be brief" || sent.Messages[1].Content != "find it" {
+				t.Errorf("expected the instructions and input as messages but got %#v", sent.Messages)
+			}
+			if len(sent.Tools) != 1 || sent.Tools[0].Function.Name != "lookup" {
+				t.Errorf("expected the lookup tool but got %#v", sent.Tools)
+			}
+			if string(sent.ToolChoice) != `{"function":{"name":"lookup"},"type":"function"}` {
+				t.Errorf("expected a forced chat tool choice but got %s", sent.ToolChoice)
+			}
+
+			w.Write([]byte(`{"id":"chatcmpl_1","choices":[{"finish_reason":"tool_calls","message":{"role":"assistant","content":"","tool_calls":[
+				{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"term\":\"it\"}"}}
+			]}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+			return
+		}
+
+		if len(sent.Messages) != 4 || len(sent.Messages[2].ToolCalls) != 1 || sent.Messages[3].Role != "tool" || sent.Messages[3].ToolCallID != "call_1" || sent.Messages[3].Content != `"found"` {
+			t.Errorf("expected the call and its output replayed but got %#v", sent.Messages)
+		}
+
+		w.Write([]byte(`{"id":"chatcmpl_2","choices":[{"finish_reason":"length","message":{"role":"assistant","content":"done"}}],"usage":{"prompt_tokens":20,"completion_tokens":2,"total_tokens":22}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	oa, err := NewCompatibleClient(srv.Client(), "test-key", srv.URL+"/v1/")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	oa.ChatCompletions = true
+
+	type Query struct {
+		Term string `json:"term"`
+	}
+	lookup := tool.CreateTool("lookup", func(ctx context.Context, in Query) (string, error) { return "found", nil })
+
+	body, err := oa.Body("llama-3.1-8b", "find it", "be brief", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	body.ToolChoice, _ = ToolChoice("required", "lookup")
+
+	body, res, err := oa.Generate(context.Background(), body, []tool.Tool[any, any]{lookup})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "done" || !res.Truncated() || res.Usage.InputTokens != 30 {
+		t.Errorf("unexpected result %#v", res)
+	}
+	// user input, call, output and reply, all in the responses shape
+	if len(body.Input) != 4 {
+		t.Errorf("expected 4 history items but got %d", len(body.Input))
+	}
+}
+
+func TestChatRequest(t *testing.T) {
+	image := ImageContent("image/png", []byte("png"))
+	message, _ := InputMessage("user", MessageContent{Type: "input_text", Text: "what is this?"}, image)
+	seed, penalty := 7, 0.5
+	body := &CreateResponse{
+		Model:           "gpt-4o-mini",
+		Input:           []json.RawMessage{message},
+		Reasoning:       Reasoning{Effort: "low"},
+		ServiceTier:     ServiceTierFlex,
+		PromptCacheKey:  "key",
+		Stop:            []string{"END"},
+		Seed:            &seed,
+		PresencePenalty: &penalty,
+	}
+
+	request, err := chatRequest(body)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	sent, _ := json.Marshal(request)
+	for _, want := range []string{
+		`"content":[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,cG5n"}}]`,
+		`"reasoning_effort":"low"`,
+		`"service_tier":"flex"`,
+		`"prompt_cache_key":"key"`,
+		`"stop":["END"]`,
+		`"seed":7`,
+		`"presence_penalty":0.5`,
+	} {
+		if !strings.Contains(string(sent), want) {
+			t.Errorf("expected %s in %s", want, sent)
+		}
+	}
+	if strings.Contains(string(sent), "frequency_penalty") {
+		t.Errorf("expected an unset penalty left out but got %s", sent)
+	}
+}
+
+func TestOpenRouter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sent map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&sent)
+
+		if string(sent["models"]) != `["mistralai/mistral-small"]` {
+			t.Errorf("expected the fallback models but got %s", sent["models"])
+		}
+		if string(sent["provider"]) != `{"allow_fallbacks":false,"order":["Anthropic"]}` {
+			t.Errorf("expected the provider preferences but got %s", sent["provider"])
+		}
+
+		w.Write([]byte(`{"id":"gen_1","model":"mistralai/mistral-small","provider":"Mistral","choices":[{"finish_reason":"stop","message":{"role":"assistant","content":"hi"}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	oa, err := NewOpenRouterClient(srv.Client(), "test-key")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	oa.baseURL = srv.URL
+	allow := false
+	oa.Route = &Route{Fallbacks: []string{"mistralai/mistral-small"}, Order: []string{"Anthropic"}, AllowFallbacks: &allow}
+
+	body, err := oa.Body("anthropic/claude-sonnet-4", "hello", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	_, res, err := oa.Generate(context.Background(), body, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Model != "mistralai/mistral-small" || res.Provider != "Mistral" {
+		t.Errorf("expected the fallback to be reported but got %q from %q", res.Model, res.Provider)
+	}
+}
+
+func TestDeepSeek(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var sent ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&sent)
+
+		for _, message := range sent.Messages {
+			if message.ReasoningContent != "" {
+				t.Errorf("expected reasoning to be left out but got %#v", message)
+			}
+		}
+
+		w.Write([]byte(`{"id":"chat_1","model":"deepseek-reasoner","choices":[{"finish_reason":"stop","message":{"role":"assistant","reasoning_content":"they said hi, so say hi back","content":"hi"}}],
+			"usage":{"prompt_tokens":10,"completion_tokens":8,"total_tokens":18,"prompt_cache_hit_tokens":6,"completion_tokens_details":{"reasoning_tokens":7}}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	oa, err := NewDeepSeekClient(srv.Client(), "test-key")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if !oa.ChatCompletions {
+		t.Errorf("expected chat completions to be used")
+	}
+	oa.baseURL = srv.URL
+
+	body, err := oa.Body("deepseek-reasoner", "hello", "", nil, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	body, res, err := oa.Generate(context.Background(), body, nil)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if res.Text != "hi" || res.Thoughts != "they said hi, so say hi back" {
+		t.Errorf("expected the reasoning apart from the answer but got %q and %q", res.Text, res.Thoughts)
+	}
+	if res.Usage.InputTokensDetails.CachedTokens != 6 || res.Usage.OutputTokensDetails.ReasoningTokens != 7 {
+		t.Errorf("expected cache hits and reasoning tokens but got %+v", res.Usage)
+	}
+
+	body.AppendUserInput("and again")
+	if _, _, err := oa.Generate(context.Background(), body, nil); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 requests but got %d", calls)
+	}
+}
+
+func TestStream(t *testing.T) {
+	type Query struct {
+		Term string `json:"term"`
+	}
+	lookup := tool.CreateTool("lookup", func(ctx context.Context, in Query) (string, error) { return "found " + in.Term, nil })
+
+	t.Run("responses", func(t *testing.T) {
+		calls := 0
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			var sent map[string]any
+			json.NewDecoder(r.Body).Decode(&sent)
+			if sent["stream"] != true {
+				t.Errorf("expected a streamed request but got %v", sent["stream"])
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			if calls == 1 {
+				fmt.Fprint(w, "event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"id\":\"resp_1\",\"status\":\"completed\",\"output\":[{\"type\":\"function_call\",\"call_id\":\"call_1\",\"name\":\"lookup\",\"arguments\":\"{\\\"term\\\":\\\"it\\\"}\"}],\"usage\":{\"input_tokens\":10,\"output_tokens\":5,\"total_tokens\":15}}}\n\n")
+				return
+			}
+			fmt.Fprint(w, "data: {\"type\":\"response.output_text.delta\",\"delta\":\"hel\"}\n\n")
+			fmt.Fprint(w, "data: {\"type\":\"response.output_text.delta\",\"delta\":\"lo\"}\n\n")
+			fmt.Fprint(w, "data: {\"type\":\"response.completed\",\"response\":{\"id\":\"resp_2\",\"status\":\"completed\",\"output\":[{\"type\":\"message\",\"role\":\"assistant\",\"content\":[{\"type\":\"output_text\",\"text\":\"hello\"}]}],\"usage\":{\"input_tokens\":20,\"output_tokens\":2,\"total_tokens\":22}}}\n\n")
+		})
+
+		body, err := oa.Body("gpt-4o", "find it", "", nil, nil)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var streamed []string
+		body, res, err := oa.Stream(context.Background(), body, []tool.Tool[any, any]{lookup}, func(text string) {
+			streamed = append(streamed, text)
+		})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if strings.Join(streamed, "|") != "hel|lo" || res.Text != "hello" || res.Usage.TotalTokens != 37 {
+			t.Errorf("expected hello streamed in two pieces but got %q and %#v", streamed, res)
+		}
+		if body.Stream || body.OnText != nil {
+			t.Errorf("expected streaming left out of the body once done")
+		}
+	})
+
+	t.Run("chat completions", func(t *testing.T) {
+		calls := 0
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			var sent ChatCompletionRequest
+			json.NewDecoder(r.Body).Decode(&sent)
+			if !sent.Stream || sent.StreamOptions == nil || !sent.StreamOptions.IncludeUsage {
+				t.Errorf("expected a streamed request asking for usage but got %#v", sent)
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			if calls == 1 {
+				fmt.Fprint(w, "data: {\"id\":\"chatcmpl_1\",\"choices\":[{\"delta\":{\"role\":\"assistant\",\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"lookup\",\"arguments\":\"\"}}]}}]}\n\n")
+				fmt.Fprint(w, "data: {\"id\":\"chatcmpl_1\",\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"term\\\":\"}}]}}]}\n\n")
+				fmt.Fprint(w, "data: {\"id\":\"chatcmpl_1\",\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"it\\\"}\"}}]},\"finish_reason\":\"tool_calls\"}]}\n\n")
+				fmt.Fprint(w, "data: {\"id\":\"chatcmpl_1\",\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5,\"total_tokens\":15}}\n\ndata: [DONE]\n\n")
+				return
+			}
+
+			if last := sent.Messages[len(sent.Messages)-1]; last.Role != "tool" || last.Content != `"found it"` {
+				t.Errorf("expected the assembled call run but got %#v", last)
+			}
+			fmt.Fprint(w, "data: {\"id\":\"chatcmpl_2\",\"choices\":[{\"delta\":{\"content\":\"hel\"}}]}\n\n")
+			fmt.Fprint(w, "data: {\"id\":\"chatcmpl_2\",\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"length\"}]}\n\n")
+			fmt.Fprint(w, "data: {\"id\":\"chatcmpl_2\",\"choices\":[],\"usage\":{\"prompt_tokens\":20,\"completion_tokens\":2,\"total_tokens\":22}}\n\ndata: [DONE]\n\n")
+		})
+		oa.ChatCompletions = true
+
+		body, err := oa.Body("llama-3.1-8b", "find it", "", nil, nil)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		var streamed []string
+		_, res, err := oa.Stream(context.Background(), body, []tool.Tool[any, any]{lookup}, func(text string) {
+			streamed = append(streamed, text)
+		})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if strings.Join(streamed, "|") != "hel|lo" || res.Text != "hello" || !res.Truncated() || res.Usage.TotalTokens != 37 {
+			t.Errorf("expected hello streamed in two pieces but got %q and %#v", streamed, res)
+		}
+	})
+
+	t.Run("error events fail the generation", func(t *testing.T) {
+		oa := testClient(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "data: {\"type\":\"response.output_text.delta\",\"delta\":\"hel\"}\n\n")
+			fmt.Fprint(w, "data: {\"type\":\"error\",\"code\":\"server_error\",\"message\":\"overloaded\"}\n\n")
+		})
+
+		body, _ := oa.Body("gpt-4o", "hi", "", nil, nil)
+		_, _, err := oa.Stream(context.Background(), body, nil, func(string) {})
+		if err == nil || !strings.Contains(err.Error(), "overloaded") {
+			t.Errorf("expected the stream's error but got %v", err)
+		}
+	})
+}
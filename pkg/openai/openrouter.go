@@ -0,0 +1,60 @@
+package openai
+
+import (
+	"net/http"
+)
+
+// Where OpenRouter serves its openai compatible api
+const OpenRouterBaseURL = "https://openrouter.ai/api/v1"
+
+// How OpenRouter routes a request between models and the upstream providers
+// serving them. Which was used is reported as Result.Model and
+// Result.Provider.
+type Route struct {
+	// Models tried in order should the requested one be unavailable or
+	// refuse the request, e.g. anthropic/claude-sonnet-4
+	Fallbacks []string
+	// Upstream providers tried in order, e.g. Anthropic or Together
+	Order []string
+	// Whether providers outside of Order may be used once those in it
+	// fail. Nil leaves it to OpenRouter, which allows them.
+	AllowFallbacks *bool
+}
+
+// The top level request fields carrying the route
+func (r *Route) fields() map[string]any {
+	fields := map[string]any{}
+	if r == nil {
+		return fields
+	}
+
+	if len(r.Fallbacks) > 0 {
+		fields["models"] = r.Fallbacks
+	}
+
+	provider := map[string]any{}
+	if len(r.Order) > 0 {
+		provider["order"] = r.Order
+	}
+	if r.AllowFallbacks != nil {
+		provider["allow_fallbacks"] = *r.AllowFallbacks
+	}
+	if len(provider) > 0 {
+		fields["provider"] = provider
+	}
+
+	return fields
+}
+
+// NewOpenRouterClient creates a client for OpenRouter, which serves models
+// of many providers through chat completions. Models are named with their
+// provider, e.g. openai/gpt-4o-mini.
+func NewOpenRouterClient(client *http.Client, auth string) (*OpenAI, error) {
+	oa, err := NewCompatibleClient(client, auth, OpenRouterBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	oa.ChatCompletions = true
+
+	return oa, nil
+}
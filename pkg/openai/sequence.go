@@ -0,0 +1,141 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidSequence = errors.New("input items are out of order")
+
+// RepairInput checks the input items are in an order openai accepts, fixing
+// what it can so a malformed response doesn't poison every later turn:
+//
+//   - function calls without an output are given one saying the call was
+//     interrupted
+//   - outputs without a call before them, and repeated calls or outputs,
+//     are dropped
+//   - anything the model produced after a refusal, up to the next user
+//     message, is dropped
+//   - reasoning that isn't followed by the call or message it led to is
+//     dropped
+//
+// It returns a description of each repair made. Items that can't be decoded
+// fail with ErrInvalidSequence, leaving the input as it was.
+func (b *CreateResponse) RepairInput() ([]string, error) {
+	type item struct {
+		Type    string           `json:"type"`
+		Role    string           `json:"role"`
+		CallID  string           `json:"call_id"`
+		Content []MessageContent `json:"content"`
+	}
+
+	items := make([]item, len(b.Input))
+	answered := map[string]bool{}
+	for i, raw := range b.Input {
+		if err := json.Unmarshal(raw, &items[i]); err != nil {
+			return nil, fmt.Errorf("item %d can't be decoded - %w", i, errors.Join(ErrInvalidSequence, err))
+		}
+		if items[i].Type == "" {
+			return nil, fmt.Errorf("item %d has no type - %w", i, ErrInvalidSequence)
+		}
+		if items[i].Type == "function_call_output" {
+			answered[items[i].CallID] = true
+		}
+	}
+
+	var repairs []string
+	repaired := make([]json.RawMessage, 0, len(b.Input))
+	kinds := make([]item, 0, len(b.Input))
+	keep := func(raw json.RawMessage, it item) {
+		repaired = append(repaired, raw)
+		kinds = append(kinds, it)
+	}
+
+	called := map[string]bool{}
+	output := map[string]bool{}
+	refused := false
+
+	for i, it := range items {
+		raw := b.Input[i]
+
+		if refused && it.Role != "user" && it.Type != "function_call_output" {
+			repairs = append(repairs, fmt.Sprintf("dropped %s %d following a refusal", it.Type, i))
+			continue
+		}
+
+		switch it.Type {
+		case "message":
+			if it.Role == "user" {
+				refused = false
+			}
+			for _, content := range it.Content {
+				if content.Refusal != "" || content.Type == "refusal" {
+					refused = true
+				}
+			}
+			keep(raw, it)
+
+		case "function_call":
+			if called[it.CallID] {
+				repairs = append(repairs, fmt.Sprintf("dropped repeated function call %s", it.CallID))
+				continue
+			}
+			called[it.CallID] = true
+			keep(raw, it)
+
+			if !answered[it.CallID] {
+				missing, err := json.Marshal(FunctionToolCallOutput{
+					BaseItem: BaseItem{Type: "function_call_output"},
+					CallID:   it.CallID,
+					Output:   errorResponse("the call was interrupted before it returned"),
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed encoding missing function call output - %w", err)
+				}
+
+				output[it.CallID] = true
+				keep(missing, item{Type: "function_call_output", CallID: it.CallID})
+				repairs = append(repairs, fmt.Sprintf("added missing output for function call %s", it.CallID))
+			}
+
+		case "function_call_output":
+			if !called[it.CallID] {
+				repairs = append(repairs, fmt.Sprintf("dropped output for unknown function call %s", it.CallID))
+				continue
+			}
+			if output[it.CallID] {
+				repairs = append(repairs, fmt.Sprintf("dropped repeated output for function call %s", it.CallID))
+				continue
+			}
+			output[it.CallID] = true
+			keep(raw, it)
+
+		default:
+			keep(raw, it)
+		}
+	}
+
+	// Reasoning is only accepted alongside what it led to, so check it once
+	// everything else has been settled
+	input := make([]json.RawMessage, 0, len(repaired))
+	for i, it := range kinds {
+		if it.Type == "reasoning" {
+			next := i + 1
+			for next < len(kinds) && kinds[next].Type == "reasoning" {
+				next++
+			}
+
+			if next == len(kinds) || kinds[next].Role == "user" || (kinds[next].Type != "function_call" && kinds[next].Type != "message") {
+				repairs = append(repairs, fmt.Sprintf("dropped reasoning %d with nothing following it", i))
+				continue
+			}
+		}
+
+		input = append(input, repaired[i])
+	}
+
+	b.Input = input
+
+	return repairs, nil
+}
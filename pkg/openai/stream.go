@@ -0,0 +1,198 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Stream generates like Generate, calling onText with each piece of output
+// text as it arrives. Text of every request in the tool call loop is
+// streamed, and the result is the same as Generate's once the stream ends.
+// Responses Middleware serves without calling next aren't streamed.
+func (oa *OpenAI) Stream(ctx context.Context, body *CreateResponse, tools []tool.Tool[any, any], onText func(text string)) (*CreateResponse, Result, error) {
+	if body == nil {
+		return nil, Result{}, errors.New("nil body")
+	}
+
+	// Only this generation streams, so neither is left in history
+	body.Stream, body.OnText = true, onText
+	defer func() {
+		body.Stream, body.OnText = false, nil
+	}()
+
+	return oa.Generate(ctx, body, tools)
+}
+
+// An event of a streamed response
+type streamEvent struct {
+	// Such as response.output_text.delta or response.completed
+	Type string `json:"type"`
+	// Text added by an output_text delta
+	Delta string `json:"delta"`
+	// The whole response, sent once it is done
+	Response *Response `json:"response"`
+	// Set on error events
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Sends a create response request that streams, returning the response the
+// stream ends with
+func (oa *OpenAI) streamResponse(ctx context.Context, in json.RawMessage, onText func(string)) (*Response, error) {
+	var response *Response
+	err := oa.events(ctx, "/responses", in, func(data []byte) error {
+		var event streamEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("failed to decode stream event - %w", err)
+		}
+
+		switch event.Type {
+		case "response.output_text.delta":
+			if onText != nil && event.Delta != "" {
+				onText(event.Delta)
+			}
+		case "response.completed", "response.incomplete", "response.failed":
+			response = event.Response
+		case "error":
+			return fmt.Errorf("openai stream failed (%s): %s", event.Code, event.Message)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if response == nil {
+		return nil, errors.New("openai stream ended before the response did")
+	}
+
+	return response, nil
+}
+
+// A chunk of a streamed chat completion, which holds deltas in place of
+// messages
+type chatChunk struct {
+	ChatCompletion
+	Choices []struct {
+		Delta struct {
+			Content          string `json:"content"`
+			Refusal          string `json:"refusal"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				// Which call the delta adds to, as a call's arguments
+				// arrive over several chunks
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Type     string `json:"type"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+		Logprobs     struct {
+			Content []Logprob `json:"content"`
+		} `json:"logprobs"`
+	} `json:"choices"`
+}
+
+// Sends a chat completions request that streams, assembling its chunks
+// into the completion it would have been
+func (oa *OpenAI) streamCompletion(ctx context.Context, in json.RawMessage, onText func(string)) (ChatCompletion, error) {
+	completion := ChatCompletion{Choices: make([]ChatChoice, 1)}
+	choice := &completion.Choices[0]
+
+	err := oa.events(ctx, "/chat/completions", in, func(data []byte) error {
+		if string(data) == "[DONE]" {
+			return nil
+		}
+
+		var chunk chatChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("failed to decode chat completion chunk - %w", err)
+		}
+
+		if chunk.ID != "" {
+			completion.ID = chunk.ID
+			completion.Created = chunk.Created
+			completion.Model = chunk.Model
+		}
+		if chunk.ServiceTier != "" {
+			completion.ServiceTier = chunk.ServiceTier
+		}
+		if chunk.Provider != "" {
+			completion.Provider = chunk.Provider
+		}
+		// Usage comes in the final chunk, which has no choices
+		if chunk.Usage.TotalTokens > 0 {
+			completion.Usage = chunk.Usage
+		}
+
+		for _, delta := range chunk.Choices {
+			choice.Message.Role = "assistant"
+			choice.Message.Content += delta.Delta.Content
+			choice.Message.Refusal += delta.Delta.Refusal
+			choice.Message.ReasoningContent += delta.Delta.ReasoningContent
+			choice.Logprobs.Content = append(choice.Logprobs.Content, delta.Logprobs.Content...)
+			if delta.FinishReason != "" {
+				choice.FinishReason = delta.FinishReason
+			}
+			if onText != nil && delta.Delta.Content != "" {
+				onText(delta.Delta.Content)
+			}
+
+			for _, call := range delta.Delta.ToolCalls {
+				for len(choice.Message.ToolCalls) <= call.Index {
+					choice.Message.ToolCalls = append(choice.Message.ToolCalls, ChatToolCall{Type: "function"})
+				}
+				assembled := &choice.Message.ToolCalls[call.Index]
+				if call.ID != "" {
+					assembled.ID = call.ID
+				}
+				if call.Function.Name != "" {
+					assembled.Function.Name = call.Function.Name
+				}
+				assembled.Function.Arguments += call.Function.Arguments
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return ChatCompletion{}, err
+	}
+
+	if completion.ID == "" && choice.FinishReason == "" {
+		return ChatCompletion{}, errors.New("chat completion stream ended without a completion")
+	}
+
+	return completion, nil
+}
+
+// events sends a POST request that replies with server-sent events, calling
+// fn with the data of each
+func (oa *OpenAI) events(ctx context.Context, path string, in json.RawMessage, fn func(data []byte) error) error {
+	resp, err := oa.exchange(ctx, http.MethodPost, path, "application/json", in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := oa.body(resp)
+	if err != nil {
+		return err
+	}
+
+	return httpclient.Events(body, func(data []byte) error {
+		return fn(bytes.TrimSpace(data))
+	})
+}
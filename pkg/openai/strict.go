@@ -0,0 +1,298 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Limits openai places on schemas used in strict mode
+const (
+	strictMaxProperties = 5000
+	strictMaxDepth      = 10
+)
+
+var ErrInvalidStrictSchema = errors.New("schema not supported in strict mode")
+
+// strictProperties normalises a set of schema properties into the form strict
+// mode demands. Every object has additionalProperties disabled and all of its
+// properties marked as required, with properties that weren't required becoming
+// nullable so they remain optional to the model.
+func strictProperties(properties json.RawMessage, required []string) (json.RawMessage, []string, error) {
+	count := 0
+	return strictObject(properties, required, 1, &count)
+}
+
+func strictObject(properties json.RawMessage, required []string, depth int, count *int) (json.RawMessage, []string, error) {
+	if depth > strictMaxDepth {
+		return nil, nil, fmt.Errorf("nesting deeper than %d levels - %w", strictMaxDepth, ErrInvalidStrictSchema)
+	}
+
+	props := orderedObject{}
+	if len(properties) > 0 && !bytes.Equal(properties, []byte("null")) {
+		if err := json.Unmarshal(properties, &props); err != nil {
+			return nil, nil, fmt.Errorf("properties are not an object - %w", ErrInvalidStrictSchema)
+		}
+	}
+
+	*count += len(props.keys)
+	if *count > strictMaxProperties {
+		return nil, nil, fmt.Errorf("more than %d properties - %w", strictMaxProperties, ErrInvalidStrictSchema)
+	}
+
+	isRequired := make(map[string]bool, len(required))
+	for _, r := range required {
+		isRequired[r] = true
+	}
+
+	for _, key := range props.keys {
+		schema, err := strictSchema(props.values[key], depth, count)
+		if err != nil {
+			return nil, nil, fmt.Errorf("property %s - %w", key, err)
+		}
+
+		if !isRequired[key] {
+			schema, err = nullable(schema)
+			if err != nil {
+				return nil, nil, fmt.Errorf("property %s - %w", key, err)
+			}
+		}
+
+		props.values[key] = schema
+	}
+
+	normalised, err := json.Marshal(props)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return normalised, append([]string{}, props.keys...), nil
+}
+
+func strictSchema(raw json.RawMessage, depth int, count *int) (json.RawMessage, error) {
+	schema := orderedObject{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("schema is not an object - %w", ErrInvalidStrictSchema)
+	}
+
+	if !schema.has("type") && !schema.has("anyOf") && !schema.has("enum") && !schema.has("const") {
+		return nil, fmt.Errorf("schema must declare a type - %w", ErrInvalidStrictSchema)
+	}
+
+	var typ string
+	json.Unmarshal(schema.values["type"], &typ)
+
+	if typ == "object" || schema.has("properties") {
+		if additional, ok := schema.values["additionalProperties"]; ok && !bytes.Equal(additional, []byte("false")) {
+			return nil, fmt.Errorf("maps and additional properties are unsupported - %w", ErrInvalidStrictSchema)
+		}
+
+		var required []string
+		if r, ok := schema.values["required"]; ok {
+			if err := json.Unmarshal(r, &required); err != nil {
+				return nil, fmt.Errorf("required is not a list of strings - %w", ErrInvalidStrictSchema)
+			}
+		}
+
+		props, required, err := strictObject(schema.values["properties"], required, depth+1, count)
+		if err != nil {
+			return nil, err
+		}
+
+		requiredRaw, err := json.Marshal(required)
+		if err != nil {
+			return nil, err
+		}
+
+		schema.set("properties", props)
+		schema.set("required", requiredRaw)
+		schema.set("additionalProperties", json.RawMessage("false"))
+	}
+
+	if items, ok := schema.values["items"]; ok {
+		normalised, err := strictSchema(items, depth+1, count)
+		if err != nil {
+			return nil, err
+		}
+		schema.set("items", normalised)
+	}
+
+	if anyOf, ok := schema.values["anyOf"]; ok {
+		var variants []json.RawMessage
+		if err := json.Unmarshal(anyOf, &variants); err != nil {
+			return nil, fmt.Errorf("anyOf is not a list - %w", ErrInvalidStrictSchema)
+		}
+
+		for i, variant := range variants {
+			normalised, err := strictSchema(variant, depth, count)
+			if err != nil {
+				return nil, err
+			}
+			variants[i] = normalised
+		}
+
+		normalised, err := json.Marshal(variants)
+		if err != nil {
+			return nil, err
+		}
+		schema.set("anyOf", normalised)
+	}
+
+	return json.Marshal(schema)
+}
+
+// nullable allows null for a schema, which is how strict mode expresses
+// optional properties
+func nullable(raw json.RawMessage) (json.RawMessage, error) {
+	schema := orderedObject{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, err
+	}
+
+	if typ, ok := schema.values["type"]; ok {
+		var types []string
+		var single string
+		if err := json.Unmarshal(typ, &single); err == nil {
+			types = []string{single}
+		} else if err := json.Unmarshal(typ, &types); err != nil {
+			return nil, fmt.Errorf("type is not a string or list of strings - %w", ErrInvalidStrictSchema)
+		}
+
+		if !contains(types, "null") {
+			types = append(types, "null")
+		}
+
+		normalised, err := json.Marshal(types)
+		if err != nil {
+			return nil, err
+		}
+		schema.set("type", normalised)
+	} else if anyOf, ok := schema.values["anyOf"]; ok {
+		var variants []json.RawMessage
+		if err := json.Unmarshal(anyOf, &variants); err != nil {
+			return nil, fmt.Errorf("anyOf is not a list - %w", ErrInvalidStrictSchema)
+		}
+
+		variants = append(variants, json.RawMessage(`{"type":"null"}`))
+		normalised, err := json.Marshal(variants)
+		if err != nil {
+			return nil, err
+		}
+		schema.set("anyOf", normalised)
+	}
+
+	if enum, ok := schema.values["enum"]; ok {
+		var values []json.RawMessage
+		if err := json.Unmarshal(enum, &values); err != nil {
+			return nil, fmt.Errorf("enum is not a list - %w", ErrInvalidStrictSchema)
+		}
+
+		hasNull := false
+		for _, v := range values {
+			if bytes.Equal(v, []byte("null")) {
+				hasNull = true
+			}
+		}
+
+		if !hasNull {
+			values = append(values, json.RawMessage("null"))
+			normalised, err := json.Marshal(values)
+			if err != nil {
+				return nil, err
+			}
+			schema.set("enum", normalised)
+		}
+	}
+
+	return json.Marshal(schema)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A json object that remembers the order of its keys. Models generate
+// properties in the order they are declared, so it's worth keeping.
+type orderedObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+func (o *orderedObject) has(key string) bool {
+	_, ok := o.values[key]
+	return ok
+}
+
+func (o *orderedObject) set(key string, value json.RawMessage) {
+	if o.values == nil {
+		o.values = make(map[string]json.RawMessage)
+	}
+
+	if !o.has(key) {
+		o.keys = append(o.keys, key)
+	}
+
+	o.values[key] = value
+}
+
+func (o *orderedObject) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("expected json object")
+	}
+
+	o.keys = nil
+	o.values = make(map[string]json.RawMessage)
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+
+		o.set(tok.(string), value)
+	}
+
+	return nil
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(o.values[key])
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,210 @@
+package prompt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+)
+
+var ErrPromptNotFound = errors.New("prompt not found")
+
+// A single version of a named prompt
+type Prompt struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Text    string `json:"text"`
+}
+
+// Looks up prompts by name and version, letting them change without a
+// redeploy. Database backed stores only need to implement Get.
+type Store interface {
+	// Get returns the prompt with the given name and version, or the latest
+	// version when version is empty. Fails with ErrPromptNotFound when there
+	// is no such prompt.
+	Get(ctx context.Context, name string, version string) (Prompt, error)
+}
+
+// Reports whether version a is newer than b. Versions are compared a
+// dot separated segment at a time, numerically where both segments are
+// numbers, so 10 is newer than 9 and v1.10 newer than v1.9.
+func Newer(a string, b string) bool {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if aerr == nil && berr == nil {
+			return an > bn
+		}
+
+		return as[i] > bs[i]
+	}
+
+	return len(as) > len(bs)
+}
+
+// Keeps prompts in process, useful for tests or prompts loaded at startup
+type InMemoryStore struct {
+	mux     sync.RWMutex
+	prompts map[string]map[string]Prompt
+}
+
+// Put adds a prompt, replacing any with the same name and version
+func (s *InMemoryStore) Put(p Prompt) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.prompts[p.Name] == nil {
+		s.prompts[p.Name] = make(map[string]Prompt)
+	}
+
+	s.prompts[p.Name][p.Version] = p
+}
+
+func (s *InMemoryStore) Get(ctx context.Context, name string, version string) (Prompt, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	versions, ok := s.prompts[name]
+	if !ok {
+		return Prompt{}, fmt.Errorf("%s - %w", name, ErrPromptNotFound)
+	}
+
+	if version != "" {
+		p, ok := versions[version]
+		if !ok {
+			return Prompt{}, fmt.Errorf("%s version %s - %w", name, version, ErrPromptNotFound)
+		}
+
+		return p, nil
+	}
+
+	var latest Prompt
+	for v, p := range versions {
+		if latest.Version == "" || Newer(v, latest.Version) {
+			latest = p
+		}
+	}
+
+	return latest, nil
+}
+
+func NewInMemoryStore(prompts ...Prompt) *InMemoryStore {
+	s := &InMemoryStore{prompts: make(map[string]map[string]Prompt)}
+	for _, p := range prompts {
+		s.Put(p)
+	}
+
+	return s
+}
+
+// Reads prompts from a file system, such as an embed.FS, laid out as one
+// directory per prompt holding a file per version, e.g. greeter/v2.txt. The
+// version is the file name without its extension.
+type FSStore struct {
+	FS fs.FS
+}
+
+func (s *FSStore) Get(ctx context.Context, name string, version string) (Prompt, error) {
+	entries, err := fs.ReadDir(s.FS, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Prompt{}, fmt.Errorf("%s - %w", name, ErrPromptNotFound)
+	}
+	if err != nil {
+		return Prompt{}, fmt.Errorf("failed to list versions of %s - %w", name, err)
+	}
+
+	file := ""
+	found := ""
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		v := strings.TrimSuffix(entry.Name(), path.Ext(entry.Name()))
+		if v == version || (version == "" && (found == "" || Newer(v, found))) {
+			file, found = entry.Name(), v
+		}
+	}
+
+	if file == "" {
+		return Prompt{}, fmt.Errorf("%s version %s - %w", name, version, ErrPromptNotFound)
+	}
+
+	text, err := fs.ReadFile(s.FS, path.Join(name, file))
+	if err != nil {
+		return Prompt{}, fmt.Errorf("failed to read %s version %s - %w", name, found, err)
+	}
+
+	return Prompt{Name: name, Version: found, Text: string(text)}, nil
+}
+
+func NewFSStore(fsys fs.FS) *FSStore {
+	return &FSStore{FS: fsys}
+}
+
+// Fetches prompts from a http service, GETting {url}/{name}/{version} with
+// latest standing in for an empty version. The service replies with a Prompt
+// as json, or 404 when there is no such prompt.
+type HTTPStore struct {
+	Client *http.Client
+	URL    string
+}
+
+func (s *HTTPStore) Get(ctx context.Context, name string, version string) (Prompt, error) {
+	if version == "" {
+		version = "latest"
+	}
+
+	endpoint := strings.TrimSuffix(s.URL, "/") + "/" + url.PathEscape(name) + "/" + url.PathEscape(version)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return Prompt{}, fmt.Errorf("failed to create prompt request - %w", err)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return Prompt{}, fmt.Errorf("failed to fetch prompt - %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Prompt{}, fmt.Errorf("%s version %s - %w", name, version, ErrPromptNotFound)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return Prompt{}, fmt.Errorf("prompt store returned %d: %s", resp.StatusCode, body)
+	}
+
+	var p Prompt
+	if err := json.NewDecoder(httpclient.LimitReader(resp.Body, httpclient.DefaultMaxResponseBytes)).Decode(&p); err != nil {
+		return Prompt{}, fmt.Errorf("failed to decode prompt - %w", err)
+	}
+
+	return p, nil
+}
+
+func NewHTTPStore(client *http.Client, url string) *HTTPStore {
+	if client == nil {
+		client = httpclient.Default()
+	}
+
+	return &HTTPStore{Client: client, URL: url}
+}
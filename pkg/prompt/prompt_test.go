@@ -0,0 +1,112 @@
+package prompt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewer(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "1", true},
+		{"10", "9", true},
+		{"v1.10", "v1.9", true},
+		{"1.0.1", "1.0", true},
+		{"1", "2", false},
+		{"b", "a", true},
+	}
+
+	for _, c := range cases {
+		if got := Newer(c.a, c.b); got != c.want {
+			t.Errorf("expected Newer(%s, %s) to be %v but got %v", c.a, c.b, c.want, got)
+		}
+	}
+}
+
+func TestFSStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFSStore(fstest.MapFS{
+		"greeter/v9.txt":  {Data: []byte("hi")},
+		"greeter/v10.txt": {Data: []byte("hello")},
+	})
+
+	t.Run("latest version", func(t *testing.T) {
+		p, err := store.Get(ctx, "greeter", "")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if p.Version != "v10" || p.Text != "hello" {
+			t.Errorf("expected v10 but got %#v", p)
+		}
+	})
+
+	t.Run("pinned version", func(t *testing.T) {
+		p, err := store.Get(ctx, "greeter", "v9")
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if p.Text != "hi" {
+			t.Errorf("expected hi but got %s", p.Text)
+		}
+	})
+
+	t.Run("missing prompts", func(t *testing.T) {
+		if _, err := store.Get(ctx, "greeter", "v1"); !errors.Is(err, ErrPromptNotFound) {
+			t.Errorf("expected ErrPromptNotFound but got %v", err)
+		}
+
+		if _, err := store.Get(ctx, "missing", ""); !errors.Is(err, ErrPromptNotFound) {
+			t.Errorf("expected ErrPromptNotFound but got %v", err)
+		}
+	})
+}
+
+func TestHTTPStore(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prompts/greeter/latest" {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(Prompt{Name: "greeter", Version: "3", Text: "hello"})
+	}))
+	t.Cleanup(srv.Close)
+
+	store := NewHTTPStore(srv.Client(), srv.URL+"/prompts/")
+
+	p, err := store.Get(context.Background(), "greeter", "")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if p.Version != "3" || p.Text != "hello" {
+		t.Errorf("expected version 3 but got %#v", p)
+	}
+
+	if _, err := store.Get(context.Background(), "greeter", "1"); !errors.Is(err, ErrPromptNotFound) {
+		t.Errorf("expected ErrPromptNotFound but got %v", err)
+	}
+}
+
+func TestInMemoryStore(t *testing.T) {
+	store := NewInMemoryStore(Prompt{Name: "greeter", Version: "1", Text: "hi"})
+	store.Put(Prompt{Name: "greeter", Version: "2", Text: "hello"})
+
+	p, err := store.Get(context.Background(), "greeter", "")
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if p.Version != "2" {
+		t.Errorf("expected version 2 but got %s", p.Version)
+	}
+}
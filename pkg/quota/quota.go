@@ -0,0 +1,154 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("user quota exceeded")
+
+// Counts usage within fixed windows. Implementations backed by a shared store,
+// such as redis with INCRBY and EXPIRE, let quotas hold across replicas.
+type Store interface {
+	// Add increments the counter for key by n, starting a new window of the
+	// given length if the last one has ended. Returns the new total and when
+	// the window resets.
+	Add(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Time, error)
+}
+
+// Returned when a user has used up a quota, carrying when it resets
+type ExceededError struct {
+	User string
+	// Which limit was hit, either requests or tokens
+	Limit string
+	Reset time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota for %s exceeded until %s - %s", e.Limit, e.User, e.Reset.Format(time.RFC3339), ErrQuotaExceeded)
+}
+
+func (e *ExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+type Limits struct {
+	// Calls allowed per user per day, 0 for unlimited
+	RequestsPerDay int64
+	// Tokens allowed per user per day, 0 for unlimited. Usage is only known
+	// once a call finishes, so the call crossing the limit is let through and
+	// the ones after it rejected.
+	TokensPerDay int64
+}
+
+// Enforces daily limits per end user
+type UserQuota struct {
+	Limits Limits
+	Store  Store
+}
+
+// Allow counts a request for user, failing with an ExceededError once they
+// are over either limit
+func (q *UserQuota) Allow(ctx context.Context, user string) error {
+	if q.Limits.TokensPerDay > 0 {
+		tokens, reset, err := q.Store.Add(ctx, "tokens:"+user, 0, 24*time.Hour)
+		if err != nil {
+			return fmt.Errorf("failed to read token quota - %w", err)
+		}
+
+		if tokens >= q.Limits.TokensPerDay {
+			return &ExceededError{User: user, Limit: "tokens", Reset: reset}
+		}
+	}
+
+	if q.Limits.RequestsPerDay > 0 {
+		requests, reset, err := q.Store.Add(ctx, "requests:"+user, 1, 24*time.Hour)
+		if err != nil {
+			return fmt.Errorf("failed to count request quota - %w", err)
+		}
+
+		if requests > q.Limits.RequestsPerDay {
+			return &ExceededError{User: user, Limit: "requests", Reset: reset}
+		}
+	}
+
+	return nil
+}
+
+// Record counts the tokens a finished call used against user
+func (q *UserQuota) Record(ctx context.Context, user string, tokens int64) error {
+	if q.Limits.TokensPerDay <= 0 || tokens <= 0 {
+		return nil
+	}
+
+	if _, _, err := q.Store.Add(ctx, "tokens:"+user, tokens, 24*time.Hour); err != nil {
+		return fmt.Errorf("failed to record token quota - %w", err)
+	}
+
+	return nil
+}
+
+func NewUserQuota(limits Limits, store Store) *UserQuota {
+	if store == nil {
+		store = NewInMemoryStore()
+	}
+
+	return &UserQuota{
+		Limits: limits,
+		Store:  store,
+	}
+}
+
+type window struct {
+	total int64
+	reset time.Time
+}
+
+// How often InMemoryStore drops counters whose window has ended
+const sweepInterval = time.Minute
+
+// Keeps counters in process, so quotas only hold for a single replica.
+// Counters are dropped once their window ends, so users who stop calling
+// don't hold on to memory.
+type InMemoryStore struct {
+	mux      sync.Mutex
+	counters map[string]window
+	now      func() time.Time
+	// When ended windows are next dropped
+	sweep time.Time
+}
+
+func (s *InMemoryStore) Add(ctx context.Context, key string, n int64, length time.Duration) (int64, time.Time, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	if !now.Before(s.sweep) {
+		for k, w := range s.counters {
+			if !now.Before(w.reset) {
+				delete(s.counters, k)
+			}
+		}
+		s.sweep = now.Add(sweepInterval)
+	}
+
+	w, ok := s.counters[key]
+	if !ok || !now.Before(w.reset) {
+		w = window{reset: now.Add(length)}
+	}
+
+	w.total += n
+	s.counters[key] = w
+
+	return w.total, w.reset, nil
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		counters: make(map[string]window),
+		now:      time.Now,
+	}
+}
@@ -0,0 +1,89 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUserQuota(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("requests", func(t *testing.T) {
+		q := NewUserQuota(Limits{RequestsPerDay: 2}, nil)
+
+		for range 2 {
+			if err := q.Allow(ctx, "bob"); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+
+		err := q.Allow(ctx, "bob")
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("expected ErrQuotaExceeded but got %v", err)
+		}
+
+		var exceeded *ExceededError
+		if !errors.As(err, &exceeded) || exceeded.Limit != "requests" || time.Until(exceeded.Reset) <= 0 {
+			t.Errorf("unexpected exceeded error %#v", exceeded)
+		}
+
+		if err := q.Allow(ctx, "alice"); err != nil {
+			t.Errorf("expected other users to be unaffected but got %v", err)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		q := NewUserQuota(Limits{TokensPerDay: 100}, nil)
+
+		if err := q.Allow(ctx, "bob"); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		q.Record(ctx, "bob", 150)
+
+		if err := q.Allow(ctx, "bob"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("expected ErrQuotaExceeded but got %v", err)
+		}
+	})
+
+	t.Run("windows reset", func(t *testing.T) {
+		store := NewInMemoryStore()
+		now := time.Now()
+		store.now = func() time.Time { return now }
+		q := NewUserQuota(Limits{RequestsPerDay: 1}, store)
+
+		q.Allow(ctx, "bob")
+		if err := q.Allow(ctx, "bob"); err == nil {
+			t.Fatalf("expected err but got nil")
+		}
+
+		now = now.Add(25 * time.Hour)
+		if err := q.Allow(ctx, "bob"); err != nil {
+			t.Errorf("expected quota to reset but got %v", err)
+		}
+	})
+}
+
+func TestInMemoryStoreSweeps(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for _, user := range []string{"bob", "alice", "carol"} {
+		store.Add(ctx, "requests:"+user, 1, time.Hour)
+	}
+	now = now.Add(30 * time.Minute)
+	store.Add(ctx, "requests:dave", 1, time.Hour)
+
+	now = now.Add(45 * time.Minute)
+	store.Add(ctx, "requests:erin", 1, time.Hour)
+
+	if len(store.counters) != 2 {
+		t.Errorf("expected only dave and erin's counters to be kept but got %v", store.counters)
+	}
+	if _, ok := store.counters["requests:dave"]; !ok {
+		t.Errorf("expected dave's window to be kept while it runs")
+	}
+}
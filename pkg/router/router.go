@@ -0,0 +1,129 @@
+// Package router sends each call to the cheapest model able to serve it,
+// moving up to pricier models when a cheap one falls short.
+package router
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+)
+
+var ErrNoCapableModel = errors.New("no model satisfies the requirements")
+
+// Decides whether a call's result is poor enough to retry on a pricier model
+type EscalateFunc func(output agent.AgentOutput, err error) bool
+
+// InvalidStructuredOutput escalates calls whose output never matched their
+// schema
+func InvalidStructuredOutput(output agent.AgentOutput, err error) bool {
+	return errors.Is(err, agent.ErrInvalidStructuredOutput)
+}
+
+// LowConfidence escalates calls whose output is less confident than
+// threshold, see agent.GenerationOptions.Confidence. Outputs without a
+// confidence aren't escalated.
+func LowConfidence(threshold float64) EscalateFunc {
+	return func(output agent.AgentOutput, err error) bool {
+		return err == nil && output.Confidence != nil && *output.Confidence < threshold
+	}
+}
+
+// Routes calls between the models of a catalog. History is stored in the
+// format of a model's provider, so catalogs used with a Memoriser should
+// only hold models from one provider.
+type Router struct {
+	// Configuration shared by every call, its Model is replaced by the
+	// chosen one
+	Agent *agent.Agent[model.AIModel]
+	// Models to choose between, defaults to model.Catalog
+	Catalog []model.Info
+	// Optionally retries a call on the next cheapest capable model. The
+	// session is rolled back first, so the retry doesn't see the failed
+	// turn.
+	Escalate EscalateFunc
+	// Most times a call moves up, defaults to 1
+	MaxEscalations int
+}
+
+// Candidates returns the capable models, cheapest first
+func (r *Router) Candidates(needs model.Requirements) []model.Info {
+	catalog := r.Catalog
+	if catalog == nil {
+		catalog = model.Catalog
+	}
+
+	var capable []model.Info
+	for _, info := range catalog {
+		if info.Satisfies(needs) {
+			capable = append(capable, info)
+		}
+	}
+
+	// Compare a typical call, which reads far more than it writes
+	slices.SortStableFunc(capable, func(a, b model.Info) int {
+		return cmp.Compare(a.Cost(4, 1), b.Cost(4, 1))
+	})
+
+	return capable
+}
+
+// Call answers input with the cheapest model meeting needs, escalating while
+// Escalate is unhappy with the result
+func (r *Router) Call(ctx context.Context, input agent.AgentInput, needs model.Requirements) (agent.AgentOutput, error) {
+	candidates := r.Candidates(needs)
+	if len(candidates) == 0 {
+		return agent.AgentOutput{}, fmt.Errorf("%+v - %w", needs, ErrNoCapableModel)
+	}
+
+	escalations := r.MaxEscalations
+	if escalations <= 0 {
+		escalations = 1
+	}
+	candidates = candidates[:min(len(candidates), escalations+1)]
+
+	// Taken before the first attempt, so escalations can undo it
+	var snapshot []byte
+	if r.Escalate != nil && len(candidates) > 1 {
+		var err error
+		snapshot, err = r.Agent.Snapshot(ctx, input.Id)
+		if err != nil && !errors.Is(err, agent.ErrSessionNotFound) {
+			return agent.AgentOutput{}, err
+		}
+	}
+
+	for i := 0; ; i++ {
+		a := *r.Agent
+		a.Model = candidates[i].Model
+
+		output, err := a.Call(ctx, input)
+		if i == len(candidates)-1 || r.Escalate == nil || !r.Escalate(output, err) {
+			return output, err
+		}
+
+		slog.InfoContext(ctx, "escalating call", slog.String("from", candidates[i].Model.Model()), slog.String("to", candidates[i+1].Model.Model()))
+
+		if err := r.rollback(ctx, input.Id, snapshot); err != nil {
+			return output, err
+		}
+	}
+}
+
+// Puts a session back how it was before the first attempt
+func (r *Router) rollback(ctx context.Context, id string, snapshot []byte) error {
+	if snapshot != nil {
+		return r.Agent.Restore(ctx, id, snapshot)
+	}
+
+	if deleter, ok := r.Agent.Memoriser.(memoriser.Deleter); ok {
+		return deleter.Delete(id)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+var catalog = []model.Info{
+	{Model: model.OpenAiModel("big"), Tools: true, Vision: true, ContextWindow: 1_000_000, InputPrice: 2, OutputPrice: 8},
+	{Model: model.OpenAiModel("small"), Tools: true, ContextWindow: 100_000, InputPrice: 0.1, OutputPrice: 0.4},
+}
+
+func TestCandidates(t *testing.T) {
+	r := &Router{Catalog: catalog}
+
+	tests := []struct {
+		name   string
+		needs  model.Requirements
+		models []string
+	}{
+		{name: "cheapest first", needs: model.Requirements{Tools: true}, models: []string{"small", "big"}},
+		{name: "vision", needs: model.Requirements{Vision: true}, models: []string{"big"}},
+		{name: "context", needs: model.Requirements{MinContext: 200_000}, models: []string{"big"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, info := range r.Candidates(tt.needs) {
+				got = append(got, info.Model.Model())
+			}
+
+			if len(got) != len(tt.models) || got[0] != tt.models[0] {
+				t.Errorf("expected %v but got %v", tt.models, got)
+			}
+		})
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	var called []string
+	reply := func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			called = append(called, body.Model)
+
+			text := `"{\"answer\":\"42\"}"`
+			if body.Model == "small" {
+				text = `"no idea"`
+			}
+
+			var resp openai.Response
+			err := json.Unmarshal([]byte(`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":`+text+`}]}]}`), &resp)
+			return &resp, err
+		}
+	}
+
+	a, _ := agent.NewAgent(model.OpenAiModel("small"))
+	a.Memoriser = &memoriser.NoOpMemoriser{}
+	a.OpenAIMiddleware = []openai.Middleware{reply}
+
+	r := &Router{Agent: a, Catalog: catalog, Escalate: InvalidStructuredOutput}
+
+	schema := json.RawMessage(`{"type":"object","properties":{"answer":{"type":"string"}},"required":["answer"]}`)
+	output, err := r.Call(context.Background(), agent.AgentInput{Id: "id", UserInput: "meaning of life", Schema: schema}, model.Requirements{})
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	if output.Output != `{"answer":"42"}` || called[len(called)-1] != "big" || called[0] != "small" {
+		t.Errorf("expected escalation to big but got %q from %v", output.Output, called)
+	}
+
+	if a.Model.Model() != "small" {
+		t.Errorf("expected the shared agent to be left alone but got %s", a.Model.Model())
+	}
+
+	t.Run("nothing capable", func(t *testing.T) {
+		_, err := r.Call(context.Background(), agent.AgentInput{Id: "id", UserInput: "hi"}, model.Requirements{MinContext: 10_000_000})
+		if !errors.Is(err, ErrNoCapableModel) {
+			t.Errorf("expected ErrNoCapableModel but got %v", err)
+		}
+	})
+}
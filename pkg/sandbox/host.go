@@ -0,0 +1,190 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Most bytes a fetch will hand back to a tool
+const maxFetchBytes = 4 << 20
+
+type callKey struct{}
+
+// What the host keeps about a call in flight
+type callState struct {
+	module *Module
+	failed string
+}
+
+func (m *Module) granted(name string) bool {
+	switch name {
+	case "fail":
+		return true
+	case "log":
+		return m.Capabilities.Log
+	case "env":
+		return m.Capabilities.Env != nil
+	case "fetch":
+		return len(m.Capabilities.Hosts) > 0
+	}
+
+	return false
+}
+
+// Builds the host module, only defining functions for granted capabilities
+// so a tool asking for more can't even be loaded
+func (m *Module) host() wazero.HostModuleBuilder {
+	builder := m.runtime.NewHostModuleBuilder(hostModule)
+
+	i32 := api.ValueTypeI32
+	i64 := api.ValueTypeI64
+
+	define := func(name string, fn api.GoModuleFunc, results ...api.ValueType) {
+		if !m.granted(name) {
+			return
+		}
+
+		builder.NewFunctionBuilder().
+			WithGoModuleFunction(fn, []api.ValueType{i32, i32}, results).
+			Export(name)
+	}
+
+	define("fail", hostFail)
+	define("log", hostLog)
+	define("env", hostEnv, i64)
+	define("fetch", hostFetch, i64)
+
+	return builder
+}
+
+// The call a host function was made during, and the string it was passed
+func arguments(ctx context.Context, mod api.Module, stack []uint64) (*callState, string, bool) {
+	call, ok := ctx.Value(callKey{}).(*callState)
+	if !ok {
+		return nil, "", false
+	}
+
+	data, ok := mod.Memory().Read(api.DecodeU32(stack[0]), api.DecodeU32(stack[1]))
+	if !ok {
+		return nil, "", false
+	}
+
+	return call, string(data), true
+}
+
+// Hands data back to the tool, packed as ptr<<32 | len, or 0 for nothing
+func reply(ctx context.Context, mod api.Module, data []byte) uint64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	ptr, err := write(ctx, mod, data)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to reply to sandboxed tool", slog.Any("error", err))
+		return 0
+	}
+
+	return uint64(ptr)<<32 | uint64(len(data))
+}
+
+func hostFail(ctx context.Context, mod api.Module, stack []uint64) {
+	call, message, ok := arguments(ctx, mod, stack)
+	if !ok {
+		return
+	}
+
+	if message == "" {
+		message = "failed without a reason"
+	}
+	call.failed = message
+}
+
+func hostLog(ctx context.Context, mod api.Module, stack []uint64) {
+	call, message, ok := arguments(ctx, mod, stack)
+	if !ok {
+		return
+	}
+
+	slog.InfoContext(ctx, message, slog.String("tool", call.module.Name))
+}
+
+func hostEnv(ctx context.Context, mod api.Module, stack []uint64) {
+	call, key, ok := arguments(ctx, mod, stack)
+	if !ok {
+		stack[0] = 0
+		return
+	}
+
+	stack[0] = reply(ctx, mod, []byte(call.module.Capabilities.Env[key]))
+}
+
+func hostFetch(ctx context.Context, mod api.Module, stack []uint64) {
+	call, target, ok := arguments(ctx, mod, stack)
+	if !ok {
+		stack[0] = 0
+		return
+	}
+
+	body, err := call.module.fetch(ctx, target)
+	if err != nil {
+		slog.WarnContext(ctx, "sandboxed tool fetch failed", slog.String("tool", call.module.Name), slog.Any("error", err))
+		stack[0] = 0
+		return
+	}
+
+	stack[0] = reply(ctx, mod, body)
+}
+
+// Gets a url's body, as long as it's on a granted host
+func (m *Module) fetch(ctx context.Context, target string) ([]byte, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url - %w", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || !slices.Contains(m.Capabilities.Hosts, u.Hostname()) {
+		return nil, fmt.Errorf("%s is not a granted host - %w", u.Host, ErrCapabilityDenied)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{}
+	if m.Capabilities.Client != nil {
+		client = *m.Capabilities.Client
+	}
+
+	// Redirects could otherwise lead a tool off the hosts it was granted
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !slices.Contains(m.Capabilities.Hosts, req.URL.Hostname()) {
+			return fmt.Errorf("redirected to %s which is not a granted host - %w", req.URL.Host, ErrCapabilityDenied)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-200 status code %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+}
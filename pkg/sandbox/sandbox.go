@@ -0,0 +1,320 @@
+// Package sandbox runs tools compiled to WASM inside wazero, so untrusted or
+// third party tools can be called by an agent without trusting them with the
+// host. Every call runs in a fresh instance with limited fuel, memory and
+// time, and a tool can only reach the host through the capabilities it was
+// granted.
+//
+// Tools talk to the host over a small ABI. A module must export its memory
+// along with
+//
+//	alloc(size i32) i32
+//	call(ptr i32, len i32) i64
+//
+// where call is handed the tool's JSON arguments, written into memory the
+// module allocated, and returns where its JSON output is as ptr<<32 | len.
+// Modules may import these from the "clusterfuc" module
+//
+//	fail(ptr i32, len i32)          fails the call with a message, always granted
+//	log(ptr i32, len i32)           writes to the host's log, needs Log
+//	env(ptr i32, len i32) i64       reads a granted variable, needs Env
+//	fetch(ptr i32, len i32) i64     gets a url's body, needs Hosts
+//
+// with env and fetch returning 0 when there is nothing to return. WASI is
+// provided as well, with files limited to a read only FS if one is granted.
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var (
+	ErrFuelExhausted    = errors.New("tool ran out of fuel")
+	ErrCapabilityDenied = errors.New("tool needs a capability it was not granted")
+	ErrInvalidModule    = errors.New("module does not implement the tool abi")
+	ErrToolFailed       = errors.New("tool failed")
+)
+
+// Name of the module tools import host functions from
+const hostModule = "clusterfuc"
+
+// Bounds on a single call to a tool
+type Limits struct {
+	// Guest function calls a single call may make before it is stopped,
+	// 0 for no limit
+	Fuel uint64
+	// 64KiB pages of memory an instance may grow to, defaults to 512 (32MiB)
+	MemoryPages uint32
+	// How long a single call may run, 0 for no limit
+	Timeout time.Duration
+}
+
+// What a tool may reach on the host. Nothing is granted by default.
+type Capabilities struct {
+	// Lets the tool write to the host's log
+	Log bool
+	// Variables the tool may read, the host's own environment is never
+	// exposed
+	Env map[string]string
+	// Hosts the tool may fetch from over http(s)
+	Hosts []string
+	// Client fetches are made with, defaults to a plain http.Client
+	Client *http.Client
+	// Files the tool may read through WASI, mounted at /
+	FS fs.FS
+}
+
+// A tool compiled to WASM, instantiated fresh for every call so nothing
+// leaks between them
+type Module struct {
+	Name         string
+	Limits       Limits
+	Capabilities Capabilities
+	runtime      wazero.Runtime
+	compiled     wazero.CompiledModule
+	cache        wazero.CompilationCache
+}
+
+// Optional configuration applied to a module when it is loaded
+type Option func(*Module)
+
+// WithCache shares compiled code through cache, so loading the same tool
+// again, such as with different capabilities, skips compiling it
+func WithCache(cache wazero.CompilationCache) Option {
+	return func(m *Module) {
+		m.cache = cache
+	}
+}
+
+type meterKey struct{}
+
+// Fuel left for a call, which is cancelled once it runs dry
+type meter struct {
+	fuel   atomic.Int64
+	cancel context.CancelCauseFunc
+}
+
+// Counts every guest function call against the fuel of the call it is part
+// of
+var fuelListener = experimental.FunctionListenerFactoryFunc(func(api.FunctionDefinition) experimental.FunctionListener {
+	return experimental.FunctionListenerFunc(func(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+		m, ok := ctx.Value(meterKey{}).(*meter)
+		if !ok {
+			return
+		}
+
+		if m.fuel.Add(-1) < 0 {
+			m.cancel(ErrFuelExhausted)
+		}
+	})
+})
+
+// Load compiles a WASM tool, checking it implements the abi and only imports
+// what it has been granted
+func Load(ctx context.Context, name string, wasm []byte, limits Limits, caps Capabilities, opts ...Option) (*Module, error) {
+	m := &Module{
+		Name:         name,
+		Limits:       limits,
+		Capabilities: caps,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	pages := limits.MemoryPages
+	if pages == 0 {
+		pages = 512
+	}
+
+	// Closing on context done is what lets fuel and timeouts stop a tool
+	// stuck in a loop
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true)
+	if m.cache != nil {
+		config = config.WithCompilationCache(m.cache)
+	}
+
+	m.runtime = wazero.NewRuntimeWithConfig(ctx, config)
+
+	if err := m.load(ctx, wasm); err != nil {
+		m.runtime.Close(ctx)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Module) load(ctx context.Context, wasm []byte) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, m.runtime); err != nil {
+		return fmt.Errorf("failed to provide wasi - %w", err)
+	}
+
+	if _, err := m.host().Instantiate(ctx); err != nil {
+		return fmt.Errorf("failed to provide host functions - %w", err)
+	}
+
+	if m.Limits.Fuel > 0 {
+		ctx = experimental.WithFunctionListenerFactory(ctx, fuelListener)
+	}
+
+	compiled, err := m.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return fmt.Errorf("failed to compile %s - %w", m.Name, err)
+	}
+	m.compiled = compiled
+
+	for _, fn := range compiled.ImportedFunctions() {
+		module, name, _ := fn.Import()
+		if module == hostModule && !m.granted(name) {
+			return fmt.Errorf("%s imports %s - %w", m.Name, name, ErrCapabilityDenied)
+		}
+	}
+
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{"alloc", "call"} {
+		if _, ok := exports[name]; !ok {
+			return fmt.Errorf("%s does not export %s - %w", m.Name, name, ErrInvalidModule)
+		}
+	}
+
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return fmt.Errorf("%s does not export memory - %w", m.Name, ErrInvalidModule)
+	}
+
+	return nil
+}
+
+// Execute calls the tool with JSON arguments, returning its JSON output
+func (m *Module) Execute(ctx context.Context, input json.RawMessage) (json.RawMessage, error) {
+	if m.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Limits.Timeout)
+		defer cancel()
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Starting an instance isn't charged, as runtimes such as go's spend a
+	// good deal of calls setting themselves up
+	call := &callState{module: m}
+	ctx = context.WithValue(ctx, callKey{}, call)
+
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithFSConfig(m.fsConfig())
+
+	instance, err := m.runtime.InstantiateModule(ctx, m.compiled, config)
+	if err != nil {
+		return nil, m.failure(ctx, fmt.Errorf("failed to start %s - %w", m.Name, err))
+	}
+	defer instance.Close(context.WithoutCancel(ctx))
+
+	if m.Limits.Fuel > 0 {
+		fuel := &meter{cancel: cancel}
+		fuel.fuel.Store(int64(min(m.Limits.Fuel, 1<<62)))
+		ctx = context.WithValue(ctx, meterKey{}, fuel)
+	}
+
+	ptr, err := write(ctx, instance, input)
+	if err != nil {
+		return nil, m.failure(ctx, err)
+	}
+
+	results, err := instance.ExportedFunction("call").Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, m.failure(ctx, fmt.Errorf("%s trapped - %w", m.Name, err))
+	}
+
+	if call.failed != "" {
+		return nil, fmt.Errorf("%s: %s - %w", m.Name, call.failed, ErrToolFailed)
+	}
+
+	output, ok := read(instance, results[0])
+	if !ok {
+		return nil, fmt.Errorf("%s returned output outside of its memory - %w", m.Name, ErrInvalidModule)
+	}
+
+	if !json.Valid(output) {
+		return nil, fmt.Errorf("%s returned invalid json - %w", m.Name, ErrInvalidModule)
+	}
+
+	return json.RawMessage(output), nil
+}
+
+// Tool wraps the module as a tool agents can call
+func (m *Module) Tool(definition tool.JSONSchemaSubset, opts ...tool.Option) tool.Tool[any, any] {
+	return tool.Bind(m.Name, m.Execute, definition, opts...)
+}
+
+// Close frees the compiled module
+func (m *Module) Close(ctx context.Context) error {
+	return m.runtime.Close(ctx)
+}
+
+// Explains why a call stopped, preferring the limit that stopped it over the
+// error wazero surfaced
+func (m *Module) failure(ctx context.Context, err error) error {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, ErrFuelExhausted):
+		return fmt.Errorf("%s used more than %d fuel - %w", m.Name, m.Limits.Fuel, ErrFuelExhausted)
+	case errors.Is(cause, context.DeadlineExceeded):
+		return fmt.Errorf("%s ran longer than %s - %w", m.Name, m.Limits.Timeout, cause)
+	}
+
+	slog.ErrorContext(ctx, "sandboxed tool failed", slog.String("tool", m.Name), slog.Any("error", err))
+
+	return err
+}
+
+func (m *Module) fsConfig() wazero.FSConfig {
+	config := wazero.NewFSConfig()
+	if m.Capabilities.FS != nil {
+		config = config.WithFSMount(m.Capabilities.FS, "/")
+	}
+
+	return config
+}
+
+// Copies data into memory allocated by the instance
+func write(ctx context.Context, instance api.Module, data []byte) (uint32, error) {
+	results, err := instance.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate %d bytes - %w", len(data), err)
+	}
+
+	ptr := uint32(results[0])
+	if !instance.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("allocated memory is out of range - %w", ErrInvalidModule)
+	}
+
+	return ptr, nil
+}
+
+// Reads a ptr<<32 | len packed location out of an instance's memory
+func read(instance api.Module, packed uint64) ([]byte, bool) {
+	data, ok := instance.Memory().Read(uint32(packed>>32), uint32(packed))
+	if !ok {
+		return nil, false
+	}
+
+	// Memory is freed with the instance, so the output can't alias it
+	return append([]byte(nil), data...), true
+}
@@ -0,0 +1,151 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+	"github.com/tetratelabs/wazero"
+)
+
+// Builds the guest tool in testdata
+func guest(t *testing.T) []byte {
+	t.Helper()
+
+	out := filepath.Join(t.TempDir(), "guest.wasm")
+	cmd := exec.Command("go", "build", "-buildmode=c-shared", "-o", out, ".")
+	cmd.Dir = filepath.Join("testdata", "guest")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("failed to build guest: %v\n%s", err, output)
+	}
+
+	wasm, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	return wasm
+}
+
+func TestSandbox(t *testing.T) {
+	wasm := guest(t)
+	granted := Capabilities{Log: true, Env: map[string]string{"CITY": "Paris"}}
+
+	cache := wazero.NewCompilationCache()
+	defer cache.Close(t.Context())
+
+	load := func(t *testing.T, limits Limits, caps Capabilities) *Module {
+		t.Helper()
+
+		m, err := Load(t.Context(), "guest", wasm, limits, caps, WithCache(cache))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		t.Cleanup(func() { m.Close(t.Context()) })
+
+		return m
+	}
+
+	t.Run("executes tool", func(t *testing.T) {
+		m := load(t, Limits{Fuel: 1_000_000, Timeout: 5 * time.Second}, granted)
+
+		for range 2 {
+			out, err := m.Execute(t.Context(), json.RawMessage(`{"mode":"echo","text":"hello"}`))
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			if string(out) != `{"text":"hello"}` {
+				t.Errorf("expected echoed text but got %s", out)
+			}
+		}
+	})
+
+	t.Run("reads granted env only", func(t *testing.T) {
+		m := load(t, Limits{}, granted)
+
+		out, err := m.Execute(t.Context(), json.RawMessage(`{"mode":"env","text":"CITY"}`))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if string(out) != `{"text":"Paris"}` {
+			t.Errorf("expected granted variable but got %s", out)
+		}
+
+		t.Setenv("HOME_CITY", "Berlin")
+		out, err = m.Execute(t.Context(), json.RawMessage(`{"mode":"env","text":"HOME_CITY"}`))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if string(out) != `{"text":""}` {
+			t.Errorf("expected host environment to be hidden but got %s", out)
+		}
+	})
+
+	t.Run("denies ungranted capabilities", func(t *testing.T) {
+		_, err := Load(t.Context(), "guest", wasm, Limits{}, Capabilities{Log: true})
+		if !errors.Is(err, ErrCapabilityDenied) {
+			t.Errorf("expected ErrCapabilityDenied but got %v", err)
+		}
+	})
+
+	t.Run("tool fails", func(t *testing.T) {
+		m := load(t, Limits{}, granted)
+
+		_, err := m.Execute(t.Context(), json.RawMessage(`{"mode":"nope"}`))
+		if !errors.Is(err, ErrToolFailed) {
+			t.Errorf("expected ErrToolFailed but got %v", err)
+		}
+	})
+
+	t.Run("runs out of fuel", func(t *testing.T) {
+		m := load(t, Limits{Fuel: 10_000, Timeout: 5 * time.Second}, granted)
+
+		_, err := m.Execute(t.Context(), json.RawMessage(`{"mode":"spin"}`))
+		if !errors.Is(err, ErrFuelExhausted) {
+			t.Errorf("expected ErrFuelExhausted but got %v", err)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		m := load(t, Limits{Timeout: 50 * time.Millisecond}, granted)
+
+		_, err := m.Execute(t.Context(), json.RawMessage(`{"mode":"loop"}`))
+		if err == nil {
+			t.Fatalf("expected err but got none")
+		}
+	})
+
+	t.Run("limits memory", func(t *testing.T) {
+		m, err := Load(t.Context(), "guest", wasm, Limits{MemoryPages: 1}, granted)
+		if err == nil {
+			defer m.Close(t.Context())
+			_, err = m.Execute(t.Context(), json.RawMessage(`{"mode":"echo"}`))
+		}
+		if err == nil {
+			t.Errorf("expected err but got none")
+		}
+	})
+
+	t.Run("wraps as tool", func(t *testing.T) {
+		tl := load(t, Limits{}, granted).Tool(tool.JSONSchemaSubset{
+			Properties: map[string]any{"mode": map[string]any{"type": "string"}},
+			Required:   []string{"mode"},
+		})
+
+		out, err := tl.Executable.Execute(t.Context(), `{"mode":"echo","text":"hi"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if raw, ok := out.(json.RawMessage); !ok || string(raw) != `{"text":"hi"}` {
+			t.Errorf("expected echoed text but got %v", out)
+		}
+	})
+}
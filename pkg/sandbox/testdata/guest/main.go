@@ -0,0 +1,94 @@
+//go:build wasip1
+
+// A tool used to test the sandbox, built with
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared
+package main
+
+import (
+	"encoding/json"
+	"unsafe"
+)
+
+//go:wasmimport clusterfuc fail
+func hostFail(ptr unsafe.Pointer, size uint32)
+
+//go:wasmimport clusterfuc log
+func hostLog(ptr unsafe.Pointer, size uint32)
+
+//go:wasmimport clusterfuc env
+func hostEnv(ptr unsafe.Pointer, size uint32) uint64
+
+// Allocations handed to the host, kept alive until the instance is closed
+var pinned [][]byte
+
+//go:wasmexport alloc
+func alloc(size uint32) unsafe.Pointer {
+	buf := make([]byte, max(size, 1))
+	pinned = append(pinned, buf)
+	return unsafe.Pointer(&buf[0])
+}
+
+type input struct {
+	Mode string `json:"mode"`
+	Text string `json:"text"`
+}
+
+type output struct {
+	Text string `json:"text"`
+}
+
+//go:wasmexport call
+func call(ptr unsafe.Pointer, size uint32) uint64 {
+	var in input
+	if err := json.Unmarshal(unsafe.Slice((*byte)(ptr), size), &in); err != nil {
+		return fail(err.Error())
+	}
+
+	var out output
+	switch in.Mode {
+	case "echo":
+		out.Text = in.Text
+	case "log":
+		hostLog(pointer(in.Text), uint32(len(in.Text)))
+	case "env":
+		packed := hostEnv(pointer(in.Text), uint32(len(in.Text)))
+		if packed != 0 {
+			out.Text = string(unsafe.Slice((*byte)(unsafe.Pointer(uintptr(packed>>32))), uint32(packed)))
+		}
+	case "spin":
+		for {
+			spin()
+		}
+	case "loop":
+		for {
+		}
+	default:
+		return fail("unknown mode " + in.Mode)
+	}
+
+	data, _ := json.Marshal(out)
+	return reply(data)
+}
+
+//go:noinline
+func spin() {}
+
+func fail(message string) uint64 {
+	hostFail(pointer(message), uint32(len(message)))
+	return 0
+}
+
+func reply(data []byte) uint64 {
+	pinned = append(pinned, data)
+	return uint64(uintptr(unsafe.Pointer(&data[0])))<<32 | uint64(len(data))
+}
+
+func pointer(s string) unsafe.Pointer {
+	if s == "" {
+		return nil
+	}
+	return unsafe.Pointer(unsafe.StringData(s))
+}
+
+func main() {}
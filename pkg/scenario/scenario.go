@@ -0,0 +1,147 @@
+// Package scenario plays scripted conversations against an agent in tests,
+// checking the tools called and the output of every turn.
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+)
+
+// Checks the output of a turn, returning why it is wrong
+type Expectation func(output agent.AgentOutput) error
+
+// Contains expects the output to include text
+func Contains(text string) Expectation {
+	return func(output agent.AgentOutput) error {
+		if !strings.Contains(output.Output, text) {
+			return fmt.Errorf("expected output to contain %q but got %q", text, output.Output)
+		}
+
+		return nil
+	}
+}
+
+// Equals expects the output to be exactly text
+func Equals(text string) Expectation {
+	return func(output agent.AgentOutput) error {
+		if output.Output != text {
+			return fmt.Errorf("expected output %q but got %q", text, output.Output)
+		}
+
+		return nil
+	}
+}
+
+// Matches expects the output to match a regular expression
+func Matches(pattern string) Expectation {
+	re := regexp.MustCompile(pattern)
+
+	return func(output agent.AgentOutput) error {
+		if !re.MatchString(output.Output) {
+			return fmt.Errorf("expected output to match %s but got %q", pattern, output.Output)
+		}
+
+		return nil
+	}
+}
+
+// A single user turn and what should come of it
+type Step struct {
+	// What the user says
+	Input string
+	// Optionally adjusts the input before it is sent, e.g. to set a schema
+	Configure func(input *agent.AgentInput)
+	// Tools the model must call during the turn, in order. Nil skips the
+	// check, while an empty slice requires that no tools are called.
+	Tools []string
+	// Checks on the turn's output
+	Expect []Expectation
+	// Whether the call must fail
+	Fails bool
+}
+
+// A scripted conversation
+type Scenario struct {
+	Name string
+	// Session id the turns share, defaults to the name
+	Id    string
+	Steps []Step
+}
+
+// Run plays every step of a scenario in order as a subtest, stopping at the
+// first step that fails since later turns depend on it. The agent's
+// OnToolCall hook is wrapped for the duration, so the agent shouldn't serve
+// other calls while it runs.
+func Run[T model.AIModel](t *testing.T, a *agent.Agent[T], s Scenario) {
+	t.Helper()
+
+	id := s.Id
+	if id == "" {
+		id = s.Name
+	}
+
+	var mux sync.Mutex
+	var called []string
+
+	hooks := a.Hooks
+	a.Hooks.OnToolCall = func(ctx context.Context, input agent.AgentInput, call agent.ToolCall) {
+		mux.Lock()
+		called = append(called, call.Name)
+		mux.Unlock()
+
+		if hooks.OnToolCall != nil {
+			hooks.OnToolCall(ctx, input, call)
+		}
+	}
+	defer func() { a.Hooks = hooks }()
+
+	for i, step := range s.Steps {
+		passed := t.Run(fmt.Sprintf("%s turn %d", s.Name, i+1), func(t *testing.T) {
+			mux.Lock()
+			called = nil
+			mux.Unlock()
+
+			input := agent.AgentInput{Id: id, UserInput: step.Input}
+			if step.Configure != nil {
+				step.Configure(&input)
+			}
+
+			output, err := a.Call(t.Context(), input)
+			if step.Fails {
+				if err == nil {
+					t.Fatalf("expected err but got output %q", output.Output)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+
+			mux.Lock()
+			tools := slices.Clone(called)
+			mux.Unlock()
+
+			if step.Tools != nil && !slices.Equal(tools, step.Tools) {
+				t.Errorf("expected tool calls %v but got %v", step.Tools, tools)
+			}
+
+			for _, expect := range step.Expect {
+				if err := expect(output); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+
+		if !passed {
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package scenario
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func TestRun(t *testing.T) {
+	replies := []string{
+		`{"status":"completed","output":[{"type":"function_call","call_id":"call_1","name":"weather","arguments":"{\"city\":\"Perth\"}"}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"It is sunny in Perth"}]}]}`,
+		`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"You're welcome"}]}]}`,
+	}
+
+	a, _ := agent.NewAgent(model.OpenAiModel("gpt-4o-mini"))
+	a.Memoriser = memoriser.NewInMemoryMemoriser()
+	a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+		return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+			var resp openai.Response
+			err := json.Unmarshal([]byte(replies[0]), &resp)
+			replies = replies[1:]
+			return &resp, err
+		}
+	}}
+
+	type City struct {
+		City string `json:"city"`
+	}
+	var args json.RawMessage
+	a.Hooks.OnToolCall = func(ctx context.Context, input agent.AgentInput, call agent.ToolCall) {
+		args = call.Arguments
+	}
+	a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) { return "sunny", nil }))
+
+	Run(t, a, Scenario{
+		Name: "weather",
+		Steps: []Step{
+			{Input: "weather in Perth?", Tools: []string{"weather"}, Expect: []Expectation{Contains("sunny"), Matches(`Perth$`)}},
+			{Input: "thanks", Tools: []string{}, Expect: []Expectation{Equals("You're welcome")}},
+		},
+	})
+
+	if string(args) != `{"city":"Perth"}` {
+		t.Errorf("expected existing hook to still see the call but got %s", args)
+	}
+
+	if a.Hooks.OnToolCall == nil {
+		t.Errorf("expected hooks to be restored")
+	}
+}
@@ -0,0 +1,102 @@
+package serializer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrDecryptionFailed = errors.New("failed to decrypt history")
+
+// A serializer converts the json history of a conversation into the form
+// handed to a Memoriser, and back again. This allows history to be stored
+// as something other than raw provider json, e.g. msgpack, protobuf or an
+// encrypted envelope.
+//
+// Memorisers receive the serialized form as a json.RawMessage. Serializers
+// producing non-json bytes should only be paired with Memorisers that treat
+// history as opaque bytes, such as the InMemoryMemoriser.
+type Serializer interface {
+	Serialize(history json.RawMessage) ([]byte, error)
+	Deserialize(stored []byte) (json.RawMessage, error)
+}
+
+// Stores history as the raw json it already is
+type JSONSerializer struct {
+}
+
+func (JSONSerializer) Serialize(history json.RawMessage) ([]byte, error) {
+	return history, nil
+}
+
+func (JSONSerializer) Deserialize(stored []byte) (json.RawMessage, error) {
+	return stored, nil
+}
+
+// Encrypts history with AES-GCM, wrapping the result in a json envelope so
+// it remains valid json for any Memoriser
+type EncryptedSerializer struct {
+	aead cipher.AEAD
+}
+
+type envelope struct {
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (e *EncryptedSerializer) Serialize(history json.RawMessage) ([]byte, error) {
+	if len(history) == 0 {
+		return history, nil
+	}
+
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce - %w", err)
+	}
+
+	return json.Marshal(envelope{
+		Nonce:      nonce,
+		Ciphertext: e.aead.Seal(nil, nonce, history, nil),
+	})
+}
+
+func (e *EncryptedSerializer) Deserialize(stored []byte) (json.RawMessage, error) {
+	if len(stored) == 0 {
+		return nil, nil
+	}
+
+	var env envelope
+	if err := json.Unmarshal(stored, &env); err != nil {
+		return nil, fmt.Errorf("stored history is not an envelope - %w", ErrDecryptionFailed)
+	}
+
+	if len(env.Nonce) != e.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size - %w", ErrDecryptionFailed)
+	}
+
+	history, err := e.aead.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w - %w", ErrDecryptionFailed, err)
+	}
+
+	return history, nil
+}
+
+// Creates a serializer encrypting history with the given AES key, which must
+// be 16, 24 or 32 bytes long
+func NewEncryptedSerializer(key []byte) (*EncryptedSerializer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedSerializer{aead: aead}, nil
+}
@@ -0,0 +1,64 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedSerializer(t *testing.T) {
+	s, err := NewEncryptedSerializer(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	history := json.RawMessage(`{"contents":[{"role":"user"}]}`)
+
+	t.Run("round trip", func(t *testing.T) {
+		stored, err := s.Serialize(history)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if bytes.Contains(stored, []byte("contents")) {
+			t.Errorf("expected history to be encrypted but got %s", stored)
+		}
+
+		if !json.Valid(stored) {
+			t.Errorf("expected envelope to be valid json but got %s", stored)
+		}
+
+		decoded, err := s.Deserialize(stored)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if !bytes.Equal(decoded, history) {
+			t.Errorf("expected %s but got %s", history, decoded)
+		}
+	})
+
+	t.Run("wrong key fails", func(t *testing.T) {
+		stored, err := s.Serialize(history)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		other, err := NewEncryptedSerializer(bytes.Repeat([]byte{2}, 32))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if _, err := other.Deserialize(stored); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("expected ErrDecryptionFailed but got %v", err)
+		}
+	})
+
+	t.Run("empty history stays empty", func(t *testing.T) {
+		decoded, err := s.Deserialize(nil)
+		if err != nil || len(decoded) != 0 {
+			t.Errorf("expected empty history but got %s, %v", decoded, err)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type wrappedTransport struct {
+	http.RoundTripper
+}
+
+func TestHMACSigner(t *testing.T) {
+	s, err := NewHMACSigner("key-1", []byte("secret"))
+	if err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+	s.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	req, _ := http.NewRequest(http.MethodPost, "https://gateway.internal/v1/responses?x=1", nil)
+	body := []byte(`{"model":"gpt-4o"}`)
+
+	if err := s.Sign(req, body); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	fmt.Fprintf(mac, "POST\n/v1/responses?x=1\n1700000000\n%x", digest)
+	want := "keyId=key-1,timestamp=1700000000,signature=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := req.Header.Get("X-Signature"); got != want {
+		t.Errorf("expected %s but got %s", want, got)
+	}
+
+	t.Run("empty secret fails", func(t *testing.T) {
+		if _, err := NewHMACSigner("key-1", nil); !errors.Is(err, ErrEmptySecret) {
+			t.Errorf("expected ErrEmptySecret but got %v", err)
+		}
+	})
+}
+
+func TestWithClientCertificate(t *testing.T) {
+	t.Run("copies transport", func(t *testing.T) {
+		base := &http.Client{Timeout: time.Second}
+
+		client, err := WithClientCertificate(base, tls.Certificate{})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if base.Transport != nil {
+			t.Errorf("expected original client to be untouched")
+		}
+
+		transport := client.Transport.(*http.Transport)
+		if len(transport.TLSClientConfig.Certificates) != 1 || client.Timeout != time.Second {
+			t.Errorf("unexpected client %#v", client)
+		}
+	})
+
+	t.Run("custom transports fail", func(t *testing.T) {
+		_, err := WithClientCertificate(&http.Client{Transport: wrappedTransport{}}, tls.Certificate{})
+		if !errors.Is(err, ErrUnsupportedTransport) {
+			t.Errorf("expected ErrUnsupportedTransport but got %v", err)
+		}
+	})
+}
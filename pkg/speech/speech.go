@@ -0,0 +1,49 @@
+// Package speech defines what provider clients implement to turn text into
+// audio and back, so voice loops of transcribe, agent call and synthesize can
+// swap providers.
+package speech
+
+import (
+	"context"
+	"fmt"
+)
+
+// Encoded audio, such as mp3 or wav
+type Audio struct {
+	Data     []byte
+	MimeType string
+}
+
+// Turns text into spoken audio
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text string) (Audio, error)
+}
+
+// Turns spoken audio into text
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio Audio) (string, error)
+}
+
+// Answers a transcribed utterance, typically by calling an agent
+type Responder func(ctx context.Context, text string) (string, error)
+
+// Converse runs one turn of a voice loop, transcribing audio, answering the
+// transcript and speaking the answer
+func Converse(ctx context.Context, t Transcriber, respond Responder, s Synthesizer, audio Audio) (Audio, error) {
+	text, err := t.Transcribe(ctx, audio)
+	if err != nil {
+		return Audio{}, fmt.Errorf("failed to transcribe audio - %w", err)
+	}
+
+	reply, err := respond(ctx, text)
+	if err != nil {
+		return Audio{}, err
+	}
+
+	spoken, err := s.Synthesize(ctx, reply)
+	if err != nil {
+		return Audio{}, fmt.Errorf("failed to synthesize reply - %w", err)
+	}
+
+	return spoken, nil
+}
@@ -0,0 +1,67 @@
+package tool
+
+import (
+	"context"
+	"sync"
+)
+
+// A non-text result produced during a turn, such as a generated image or a
+// file written by a tool
+type Artifact struct {
+	Name     string
+	MimeType string
+	Data     []byte
+	// What produced the artifact, the tool's name or model
+	Source string
+}
+
+// Collects the artifacts emitted during a call
+type Artifacts struct {
+	mux   sync.Mutex
+	items []Artifact
+}
+
+func (a *Artifacts) Add(artifact Artifact) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.items = append(a.items, artifact)
+}
+
+// List returns the artifacts collected so far, in the order they were added
+func (a *Artifacts) List() []Artifact {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if len(a.items) == 0 {
+		return nil
+	}
+
+	return append([]Artifact(nil), a.items...)
+}
+
+type artifactsKey struct{}
+type nameKey struct{}
+
+// WithArtifacts returns a context that tools called with it emit artifacts
+// into
+func WithArtifacts(ctx context.Context, artifacts *Artifacts) context.Context {
+	return context.WithValue(ctx, artifactsKey{}, artifacts)
+}
+
+// Emit hands an artifact back to whoever called the tool, such as binary
+// output that doesn't belong in the json given to the model. The source
+// defaults to the calling tool's name. Without a collector in ctx the
+// artifact is dropped.
+func Emit(ctx context.Context, artifact Artifact) {
+	artifacts, ok := ctx.Value(artifactsKey{}).(*Artifacts)
+	if !ok {
+		return
+	}
+
+	if artifact.Source == "" {
+		artifact.Source, _ = ctx.Value(nameKey{}).(string)
+	}
+
+	artifacts.Add(artifact)
+}
@@ -0,0 +1,92 @@
+package tool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBudgetExceeded = errors.New("tool budget exceeded")
+
+// WithCost declares what a single call of a tool costs, such as the price of
+// the paid api behind it. The model is told, and calls are charged against
+// any Budget.
+func WithCost(cost float64) Option {
+	return func(t *Tool[any, any]) {
+		t.Cost = cost
+	}
+}
+
+// WithLatency declares about how long a tool takes, which the model is told
+func WithLatency(latency time.Duration) Option {
+	return func(t *Tool[any, any]) {
+		t.Latency = latency
+	}
+}
+
+// Describe returns the description the model sees, noting the tool's cost
+// and latency when they have been declared
+func (t Tool[T, S]) Describe() string {
+	notes := []string{t.Description}
+	if t.Cost > 0 {
+		notes = append(notes, fmt.Sprintf("Costs about %s per call, avoid calling it unless needed.", strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.4f", t.Cost), "0"), ".")))
+	}
+	if t.Latency > 0 {
+		notes = append(notes, fmt.Sprintf("Takes about %s.", t.Latency))
+	}
+
+	return strings.TrimSpace(strings.Join(notes, " "))
+}
+
+// Spending on tools over a call, with an optional limit
+type Budget struct {
+	// Most the calls may spend, 0 for no limit
+	Limit float64
+
+	mux   sync.Mutex
+	spent float64
+}
+
+// Spent returns what has been charged so far
+func (b *Budget) Spent() float64 {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.spent
+}
+
+func (b *Budget) charge(name string, cost float64) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.Limit > 0 && b.spent+cost > b.Limit {
+		return fmt.Errorf("%s costs %g with %g of %g left - %w", name, cost, b.Limit-b.spent, b.Limit, ErrBudgetExceeded)
+	}
+
+	b.spent += cost
+	return nil
+}
+
+type budgetKey struct{}
+
+// WithBudget returns a context that tools run through Execute are charged
+// against
+func WithBudget(ctx context.Context, budget *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// Execute runs a tool, first charging its cost to the budget in ctx. Tools
+// that would go over budget aren't run, failing with ErrBudgetExceeded.
+func Execute[T any, S any](ctx context.Context, t Tool[T, S], in T) (S, error) {
+	if budget, ok := ctx.Value(budgetKey{}).(*Budget); ok && t.Cost > 0 {
+		if err := budget.charge(t.Name, t.Cost); err != nil {
+			var zero S
+			return zero, err
+		}
+	}
+
+	return t.Executable.Execute(ctx, in)
+}
@@ -0,0 +1,53 @@
+package tool
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// How the tools offered to a model changed from one request to the next,
+// such as tools registered after a stored conversation began
+type Changes struct {
+	Added   []string
+	Removed []string
+	// Offered both times, but with a different definition
+	Changed []string
+}
+
+func (c Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+// Diff compares the provider definitions of tools offered before with those
+// offered after, matching them by name. Definitions are compared by their
+// json encoding.
+func Diff[D any](before []D, after []D, name func(D) string) Changes {
+	encoded := make(map[string][]byte, len(before))
+	for _, d := range before {
+		data, _ := json.Marshal(d)
+		encoded[name(d)] = data
+	}
+
+	var changes Changes
+	for _, d := range after {
+		n := name(d)
+		previous, ok := encoded[n]
+		if !ok {
+			changes.Added = append(changes.Added, n)
+			continue
+		}
+		delete(encoded, n)
+
+		if data, _ := json.Marshal(d); !bytes.Equal(data, previous) {
+			changes.Changed = append(changes.Changed, n)
+		}
+	}
+
+	for _, d := range before {
+		if _, ok := encoded[name(d)]; ok {
+			changes.Removed = append(changes.Removed, name(d))
+		}
+	}
+
+	return changes
+}
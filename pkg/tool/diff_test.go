@@ -0,0 +1,26 @@
+package tool
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	type def struct {
+		Name        string
+		Description string
+	}
+	name := func(d def) string { return d.Name }
+
+	before := []def{{"a", "first"}, {"b", "second"}, {"c", "third"}}
+	after := []def{{"a", "first"}, {"b", "changed"}, {"d", "fourth"}}
+
+	changes := Diff(before, after, name)
+	if !slices.Equal(changes.Added, []string{"d"}) || !slices.Equal(changes.Removed, []string{"c"}) || !slices.Equal(changes.Changed, []string{"b"}) {
+		t.Errorf("expected d added, c removed and b changed but got %+v", changes)
+	}
+
+	if !Diff(before, before, name).Empty() {
+		t.Errorf("expected no changes between the same tools")
+	}
+}
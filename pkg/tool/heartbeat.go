@@ -0,0 +1,63 @@
+package tool
+
+import (
+	"context"
+	"time"
+)
+
+// Called periodically while a tool runs, with how long it has been running
+type HeartbeatFunc func(ctx context.Context, name string, elapsed time.Duration)
+
+type heartbeat struct {
+	interval time.Duration
+	beat     HeartbeatFunc
+}
+
+type heartbeatKey struct{}
+
+// WithHeartbeat returns a context that tools called with it beat on every
+// interval while they run, letting streams relay keepalives so idle
+// connections aren't dropped during slow tools
+func WithHeartbeat(ctx context.Context, interval time.Duration, beat HeartbeatFunc) context.Context {
+	if interval <= 0 || beat == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, heartbeatKey{}, heartbeat{interval: interval, beat: beat})
+}
+
+// Beats for the named tool until the returned stop is called, doing nothing
+// without a heartbeat in ctx
+func startHeartbeat(ctx context.Context, name string) (stop func()) {
+	hb, ok := ctx.Value(heartbeatKey{}).(heartbeat)
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(hb.interval)
+		defer ticker.Stop()
+
+		start := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+				hb.beat(ctx, name, time.Since(start))
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Wait for the beater, so no beat arrives after the tool has returned
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,150 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/invopop/jsonschema"
+)
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	errorType   = reflect.TypeFor[error]()
+)
+
+// FromMethods turns the exported methods of a service into tools, so an
+// existing service layer can be handed to an agent in one go. When I is an
+// interface only its methods are used, otherwise every exported method of
+// impl is.
+//
+// Methods must look like func(ctx context.Context, in T) (S, error), the
+// same as functions given to CreateTool, and others are skipped. Tools are
+// named after their method in snake case, e.g. GetUser becomes get_user,
+// and described by descriptions keyed by method name.
+func FromMethods[I any](impl I, descriptions map[string]string, opts ...Option) ([]Tool[any, any], error) {
+	value := reflect.ValueOf(impl)
+	if !value.IsValid() {
+		return nil, errors.New("nil service")
+	}
+
+	methods := value.Type()
+	if iface := reflect.TypeFor[I](); iface.Kind() == reflect.Interface {
+		methods = iface
+	}
+
+	var tools []Tool[any, any]
+	for i := range methods.NumMethod() {
+		method := methods.Method(i)
+		if !method.IsExported() {
+			continue
+		}
+
+		fn := value.MethodByName(method.Name)
+		if !toolShaped(fn.Type()) {
+			continue
+		}
+
+		t := methodTool(snakeCase(method.Name), fn)
+		t.Description = descriptions[method.Name]
+		for _, opt := range opts {
+			opt(&t)
+		}
+
+		tools = append(tools, t)
+	}
+
+	if len(tools) == 0 {
+		return nil, fmt.Errorf("%s has no methods usable as tools", value.Type())
+	}
+
+	return tools, nil
+}
+
+// Whether a method is func(context.Context, T) (S, error)
+func toolShaped(fn reflect.Type) bool {
+	return fn.NumIn() == 2 && fn.In(0) == contextType &&
+		fn.NumOut() == 2 && fn.Out(1) == errorType
+}
+
+// The reflected equivalent of CreateTool
+func methodTool(name string, fn reflect.Value) Tool[any, any] {
+	reflector := jsonschema.Reflector{
+		AllowAdditionalProperties: false,
+		DoNotReference:            true,
+		ExpandedStruct:            true,
+	}
+
+	argType := fn.Type().In(1)
+	schema := reflector.ReflectFromType(argType)
+
+	return Tool[any, any]{
+		Name:   name,
+		Strict: true,
+		Executable: executableFunc[any, any](func(ctx context.Context, in any) (any, error) {
+			arg := reflect.New(argType)
+
+			switch raw := in.(type) {
+			case string:
+				if err := json.Unmarshal([]byte(raw), arg.Interface()); err != nil {
+					return nil, err
+				}
+			case json.RawMessage:
+				if err := json.Unmarshal(raw, arg.Interface()); err != nil {
+					return nil, err
+				}
+			default:
+				if in != nil && reflect.TypeOf(in) == argType {
+					arg.Elem().Set(reflect.ValueOf(in))
+					break
+				}
+
+				j, err := json.Marshal(in)
+				if err != nil {
+					return nil, err
+				}
+				if err := json.Unmarshal(j, arg.Interface()); err != nil {
+					return nil, err
+				}
+			}
+
+			stop := startHeartbeat(ctx, name)
+			defer stop()
+
+			out := fn.Call([]reflect.Value{reflect.ValueOf(context.WithValue(ctx, nameKey{}, name)), arg.Elem()})
+			if err, _ := out[1].Interface().(error); err != nil {
+				return nil, err
+			}
+
+			return out[0].Interface(), nil
+		}),
+		Definition: JSONSchemaSubset{
+			Properties: schema.Properties,
+			Required:   schema.Required,
+		},
+	}
+}
+
+// GetUserByID becomes get_user_by_id, and HTTPStatus http_status
+func snakeCase(name string) string {
+	runes := []rune(name)
+
+	var sb strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Break before the start of a word, but not within an acronym
+			// unless it is followed by a new word
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,99 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type UserQuery struct {
+	ID string `json:"id"`
+}
+
+type User struct {
+	Name string `json:"name"`
+}
+
+type Users interface {
+	GetUserByID(ctx context.Context, in UserQuery) (User, error)
+}
+
+type userService struct{}
+
+func (userService) GetUserByID(ctx context.Context, in UserQuery) (User, error) {
+	if in.ID == "" {
+		return User{}, errors.New("missing id")
+	}
+	return User{Name: "user " + in.ID}, nil
+}
+
+func (userService) DeleteUser(ctx context.Context, in UserQuery) (bool, error) {
+	return true, nil
+}
+
+// Not shaped like a tool, so skipped
+func (userService) Count() int {
+	return 1
+}
+
+func TestFromMethods(t *testing.T) {
+	t.Run("every exported method", func(t *testing.T) {
+		tools, err := FromMethods(userService{}, map[string]string{"GetUserByID": "Looks up a user"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(tools) != 2 || tools[0].Name != "delete_user" || tools[1].Name != "get_user_by_id" {
+			t.Fatalf("expected delete_user and get_user_by_id but got %#v", tools)
+		}
+
+		get := tools[1]
+		if get.Description != "Looks up a user" || len(get.Definition.Required) != 1 || get.Definition.Required[0] != "id" {
+			t.Errorf("unexpected definition %#v", get)
+		}
+
+		out, err := get.Executable.Execute(context.Background(), json.RawMessage(`{"id":"7"}`))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if out.(User).Name != "user 7" {
+			t.Errorf("expected user 7 but got %#v", out)
+		}
+
+		if _, err := get.Executable.Execute(context.Background(), `{}`); err == nil {
+			t.Errorf("expected the method's err but got nil")
+		}
+	})
+
+	t.Run("only the interface's methods", func(t *testing.T) {
+		tools, err := FromMethods[Users](userService{}, nil)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if len(tools) != 1 || tools[0].Name != "get_user_by_id" {
+			t.Errorf("expected only get_user_by_id but got %#v", tools)
+		}
+	})
+
+	t.Run("nothing usable", func(t *testing.T) {
+		if _, err := FromMethods(struct{}{}, nil); err == nil {
+			t.Errorf("expected err but got nil")
+		}
+	})
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"GetUser":     "get_user",
+		"GetUserByID": "get_user_by_id",
+		"HTTPStatus":  "http_status",
+		"GetV2User":   "get_v2_user",
+		"List":        "list",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("expected %s to become %s but got %s", name, want, got)
+		}
+	}
+}
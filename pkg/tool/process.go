@@ -0,0 +1,330 @@
+package tool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var ErrProcessTool = errors.New("process tool failed")
+
+// Most stderr kept to explain a failed call
+const maxStderrBytes = 4 << 10
+
+// How a ProcessTool runs its command
+type ProcessMode int
+
+const (
+	// Launches the command for every call, writing the arguments to its
+	// stdin and reading its output from stdout. Exiting non-zero fails the
+	// call, with stderr as the reason.
+	ProcessPerCall ProcessMode = iota
+	// Keeps one command running between calls, exchanging a line of JSON per
+	// call. Each line of arguments is answered with a line of
+	//
+	//	{"output": <any>, "error": "<reason the call failed>"}
+	//
+	// Anything the worker writes to stderr is logged.
+	ProcessWorker
+)
+
+// A tool run as a subprocess speaking JSON over stdio, such as a python
+// script, without needing an http layer in front of it
+type ProcessTool struct {
+	Name        string
+	Description string
+	Definition  JSONSchemaSubset
+	Command     string
+	Args        []string
+	// Environment of the process as KEY=value, inheriting the host's when
+	// nil
+	Env []string
+	// Working directory of the process, defaults to the host's
+	Dir  string
+	Mode ProcessMode
+	// Limit on a single call, 0 for none. A worker that times out is killed
+	// and restarted on the next call, as its state is unknown.
+	Timeout time.Duration
+	// Times in a row a worker may be restarted after crashing or timing out
+	// before calls fail, defaults to 3
+	MaxRestarts int
+	// Wait before restarting a worker, doubling with each restart in a row.
+	// Defaults to 100ms.
+	RestartDelay time.Duration
+
+	mux      sync.Mutex
+	worker   *worker
+	failures int
+}
+
+// Execute runs the process with JSON arguments, returning its JSON output
+func (p *ProcessTool) Execute(ctx context.Context, in json.RawMessage) (json.RawMessage, error) {
+	if len(in) == 0 {
+		in = json.RawMessage("{}")
+	}
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	if p.Mode == ProcessWorker {
+		return p.callWorker(ctx, in)
+	}
+
+	return p.run(ctx, in)
+}
+
+// Tool wraps the process so agents can call it
+func (p *ProcessTool) Tool(opts ...Option) Tool[any, any] {
+	opts = append([]Option{WithDescription(p.Description)}, opts...)
+
+	return Bind(p.Name, p.Execute, p.Definition, opts...)
+}
+
+// Close stops the worker, if one is running. Calls after closing start a
+// fresh worker with no failures counted against it.
+func (p *ProcessTool) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.failures = 0
+
+	if p.worker == nil {
+		return nil
+	}
+
+	err := p.worker.stop()
+	p.worker = nil
+
+	return err
+}
+
+func (p *ProcessTool) command(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	cmd.Env = p.Env
+	cmd.Dir = p.Dir
+
+	return cmd
+}
+
+// Runs a fresh process for a single call
+func (p *ProcessTool) run(ctx context.Context, in json.RawMessage) (json.RawMessage, error) {
+	var stdout bytes.Buffer
+	stderr := &limitedBuffer{limit: maxStderrBytes}
+
+	cmd := p.command(ctx)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s did not finish - %w", p.Name, ctx.Err())
+		}
+
+		return nil, fmt.Errorf("%s failed: %s (%v) - %w", p.Name, bytes.TrimSpace(stderr.Bytes()), err, ErrProcessTool)
+	}
+
+	return processOutput(p.Name, stdout.Bytes())
+}
+
+type workerReply struct {
+	Output json.RawMessage `json:"output"`
+	Error  string          `json:"error"`
+}
+
+// Sends a call to the worker, starting it first if needed. Calls are made
+// one at a time.
+func (p *ProcessTool) callWorker(ctx context.Context, in json.RawMessage) (json.RawMessage, error) {
+	var line bytes.Buffer
+	if err := json.Compact(&line, in); err != nil {
+		return nil, fmt.Errorf("invalid arguments - %w", err)
+	}
+	line.WriteByte('\n')
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.worker == nil {
+		if err := p.start(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := p.worker.exchange(ctx, line.Bytes())
+	if err != nil {
+		// Whatever state the worker is in can't be trusted anymore
+		p.worker.stop()
+		p.worker = nil
+		p.failures++
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s did not answer - %w", p.Name, ctx.Err())
+		}
+
+		return nil, fmt.Errorf("%s worker died - %w", p.Name, errors.Join(err, ErrProcessTool))
+	}
+	p.failures = 0
+
+	var reply workerReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("%s replied with invalid json - %w", p.Name, ErrProcessTool)
+	}
+
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%s failed: %s - %w", p.Name, reply.Error, ErrProcessTool)
+	}
+
+	return processOutput(p.Name, reply.Output)
+}
+
+// Starts the worker, waiting out the restart delay if it failed last time
+func (p *ProcessTool) start(ctx context.Context) error {
+	restarts := p.MaxRestarts
+	if restarts <= 0 {
+		restarts = 3
+	}
+
+	if p.failures > restarts {
+		return fmt.Errorf("%s worker failed %d times in a row - %w", p.Name, p.failures, ErrProcessTool)
+	}
+
+	if p.failures > 0 {
+		delay := p.RestartDelay
+		if delay <= 0 {
+			delay = 100 * time.Millisecond
+		}
+
+		slog.WarnContext(ctx, "restarting process tool worker", slog.String("tool", p.Name), slog.Int("failures", p.failures))
+
+		select {
+		case <-time.After(delay << (p.failures - 1)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The worker outlives the call starting it, so it can't be tied to ctx
+	cmd := p.command(context.Background())
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		p.failures++
+		return fmt.Errorf("failed to start %s - %w", p.Name, err)
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			slog.Warn("process tool worker stderr", slog.String("tool", p.Name), slog.String("line", scanner.Text()))
+		}
+	}()
+
+	p.worker = &worker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+
+	return nil
+}
+
+// A long lived process answering a line for every line sent to it
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func (w *worker) exchange(ctx context.Context, line []byte) ([]byte, error) {
+	type result struct {
+		line []byte
+		err  error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		if _, err := w.stdin.Write(line); err != nil {
+			results <- result{err: err}
+			return
+		}
+
+		reply, err := w.stdout.ReadBytes('\n')
+		results <- result{line: reply, err: err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.line, r.err
+	case <-ctx.Done():
+		// Killing the worker unblocks the exchange
+		w.cmd.Process.Kill()
+		<-results
+		return nil, ctx.Err()
+	}
+}
+
+// Closes stdin, letting the worker exit on its own, and kills it if it
+// doesn't
+func (w *worker) stop() error {
+	w.stdin.Close()
+
+	exited := make(chan error, 1)
+	go func() { exited <- w.cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(time.Second):
+		w.cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+// Checks a process's output is JSON, treating nothing as null
+func processOutput(name string, data []byte) (json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return json.RawMessage("null"), nil
+	}
+
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s returned invalid json - %w", name, ErrProcessTool)
+	}
+
+	return json.RawMessage(data), nil
+}
+
+// Keeps the first limit bytes written to it, discarding the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,196 @@
+package tool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Not a real test, run as the subprocess by the process tool tests
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("CLUSTERFUC_HELPER_PROCESS")
+	if mode == "" {
+		return
+	}
+	defer os.Exit(0)
+
+	type input struct {
+		Text  string `json:"text"`
+		Sleep bool   `json:"sleep"`
+		Crash bool   `json:"crash"`
+	}
+
+	switch mode {
+	case "per-call":
+		var in input
+		json.NewDecoder(os.Stdin).Decode(&in)
+		if in.Crash {
+			fmt.Fprint(os.Stderr, "crashed on purpose")
+			os.Exit(2)
+		}
+		if in.Sleep {
+			time.Sleep(time.Minute)
+		}
+		fmt.Printf(`{"echo":%q,"pid":%d}`, in.Text, os.Getpid())
+	case "worker":
+		lines := bufio.NewScanner(os.Stdin)
+		for lines.Scan() {
+			var in input
+			json.Unmarshal(lines.Bytes(), &in)
+			switch {
+			case in.Crash:
+				os.Exit(2)
+			case in.Sleep:
+				time.Sleep(time.Minute)
+			case in.Text == "":
+				fmt.Println(`{"error":"missing text"}`)
+			default:
+				fmt.Printf("{\"output\":{\"echo\":%q,\"pid\":%d}}\n", in.Text, os.Getpid())
+			}
+		}
+	}
+}
+
+func helper(mode ProcessMode) *ProcessTool {
+	env := "per-call"
+	if mode == ProcessWorker {
+		env = "worker"
+	}
+
+	return &ProcessTool{
+		Name:         "helper",
+		Command:      os.Args[0],
+		Args:         []string{"-test.run=^TestHelperProcess$"},
+		Env:          append(os.Environ(), "CLUSTERFUC_HELPER_PROCESS="+env),
+		Mode:         mode,
+		Timeout:      5 * time.Second,
+		RestartDelay: time.Millisecond,
+	}
+}
+
+type echo struct {
+	Echo string `json:"echo"`
+	Pid  int    `json:"pid"`
+}
+
+func call(t *testing.T, p *ProcessTool, in string) (echo, error) {
+	t.Helper()
+
+	raw, err := p.Execute(t.Context(), json.RawMessage(in))
+	if err != nil {
+		return echo{}, err
+	}
+
+	var out echo
+	if err := json.Unmarshal(raw, &out); err != nil {
+		t.Fatalf("did not expect err but got %v", err)
+	}
+
+	return out, nil
+}
+
+func TestProcessTool(t *testing.T) {
+	t.Run("launches per call", func(t *testing.T) {
+		p := helper(ProcessPerCall)
+
+		first, err := call(t, p, `{"text":"hello"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		second, err := call(t, p, `{"text":"again"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if first.Echo != "hello" || second.Echo != "again" {
+			t.Errorf("expected echoed text but got %q and %q", first.Echo, second.Echo)
+		}
+		if first.Pid == second.Pid {
+			t.Errorf("expected a process per call but both ran in %d", first.Pid)
+		}
+	})
+
+	t.Run("per call failure carries stderr", func(t *testing.T) {
+		_, err := call(t, helper(ProcessPerCall), `{"crash":true}`)
+		if !errors.Is(err, ErrProcessTool) {
+			t.Fatalf("expected ErrProcessTool but got %v", err)
+		}
+	})
+
+	t.Run("per call times out", func(t *testing.T) {
+		p := helper(ProcessPerCall)
+		p.Timeout = 100 * time.Millisecond
+
+		if _, err := call(t, p, `{"sleep":true}`); err == nil {
+			t.Errorf("expected err but got none")
+		}
+	})
+
+	t.Run("worker is reused", func(t *testing.T) {
+		p := helper(ProcessWorker)
+		defer p.Close()
+
+		first, err := call(t, p, `{"text":"hello"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		second, err := call(t, p, `{"text":"again"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if second.Echo != "again" || first.Pid != second.Pid {
+			t.Errorf("expected the same worker to answer but got %v and %v", first, second)
+		}
+
+		if _, err := call(t, p, `{}`); !errors.Is(err, ErrProcessTool) {
+			t.Errorf("expected ErrProcessTool but got %v", err)
+		}
+	})
+
+	t.Run("worker restarts after crash and timeout", func(t *testing.T) {
+		p := helper(ProcessWorker)
+		p.Timeout = 200 * time.Millisecond
+		defer p.Close()
+
+		first, err := call(t, p, `{"text":"hello"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if _, err := call(t, p, `{"crash":true}`); err == nil {
+			t.Fatalf("expected err but got none")
+		}
+		if _, err := call(t, p, `{"sleep":true}`); err == nil {
+			t.Fatalf("expected err but got none")
+		}
+
+		second, err := call(t, p, `{"text":"again"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if first.Pid == second.Pid {
+			t.Errorf("expected a restarted worker but got the same pid %d", first.Pid)
+		}
+	})
+
+	t.Run("worker gives up after too many restarts", func(t *testing.T) {
+		p := helper(ProcessWorker)
+		p.MaxRestarts = 1
+		defer p.Close()
+
+		for range 2 {
+			call(t, p, `{"crash":true}`)
+		}
+
+		_, err := call(t, p, `{"text":"hello"}`)
+		if !errors.Is(err, ErrProcessTool) {
+			t.Errorf("expected ErrProcessTool but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/signer"
+)
+
+var ErrRemoteTool = errors.New("remote tool failed")
+
+// A tool living in another service, possibly written in another language.
+// Calling it POSTs the arguments as JSON to Endpoint, relaying the JSON
+// response back to the model.
+type RemoteTool struct {
+	Name        string
+	Description string
+	Endpoint    string
+	Definition  JSONSchemaSubset
+	// Sent with every call, such as an api key
+	Headers map[string]string
+	// Optionally signs every call just before it is sent, e.g. with
+	// credentials.BearerSigner for short lived tokens
+	Signer signer.Signer
+	// Defaults to httpclient.Default
+	Client *http.Client
+	// Limit on a single attempt, 0 for none
+	Timeout time.Duration
+	// Attempts made at calls that time out, defaults to 1
+	Attempts int
+	// Responses larger than this fail with httpclient.ErrResponseTooLarge.
+	// Defaults to httpclient.DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+}
+
+// Execute posts JSON arguments to the endpoint, returning its JSON response
+func (r *RemoteTool) Execute(ctx context.Context, in json.RawMessage) (json.RawMessage, error) {
+	if len(in) == 0 {
+		in = json.RawMessage("{}")
+	}
+
+	client := r.Client
+	if client == nil {
+		client = httpclient.Default()
+	}
+
+	resp, err := httpclient.RoundTrip(ctx, r.Timeout, r.Attempts, func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Endpoint, bytes.NewReader(in))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		for key, value := range r.Headers {
+			req.Header.Set(key, value)
+		}
+
+		if r.Signer != nil {
+			if err := r.Signer.Sign(req, in); err != nil {
+				return nil, fmt.Errorf("failed to sign request - %w", err)
+			}
+		}
+
+		return client.Do(req)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s - %w", r.Name, err)
+	}
+	defer resp.Body.Close()
+
+	limit := r.MaxResponseBytes
+	if limit <= 0 {
+		limit = httpclient.DefaultMaxResponseBytes
+	}
+
+	body, err := io.ReadAll(httpclient.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response - %w", r.Name, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.ErrorContext(ctx, "non 2xx response from remote tool", slog.String("tool", r.Name), slog.Int("code", resp.StatusCode))
+		return nil, fmt.Errorf("%s returned status code %d: %s - %w", r.Name, resp.StatusCode, bytes.TrimSpace(body), ErrRemoteTool)
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return json.RawMessage("null"), nil
+	}
+
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("%s returned invalid json - %w", r.Name, ErrRemoteTool)
+	}
+
+	return json.RawMessage(body), nil
+}
+
+// Tool wraps the remote tool so agents can call it
+func (r *RemoteTool) Tool(opts ...Option) Tool[any, any] {
+	opts = append([]Option{WithDescription(r.Description)}, opts...)
+
+	return Bind(r.Name, r.Execute, r.Definition, opts...)
+}
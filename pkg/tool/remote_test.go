@@ -0,0 +1,101 @@
+package tool
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type signFunc func(req *http.Request, body []byte) error
+
+func (f signFunc) Sign(req *http.Request, body []byte) error {
+	return f(req, body)
+}
+
+func TestRemoteTool(t *testing.T) {
+	t.Run("posts arguments and relays response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("expected POST but got %s", r.Method)
+			}
+			if got := r.Header.Get("X-Api-Key"); got != "secret" {
+				t.Errorf("expected api key header but got %q", got)
+			}
+			if got := r.Header.Get("Authorization"); got != "Bearer token" {
+				t.Errorf("expected signed authorization but got %q", got)
+			}
+
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != `{"city":"Paris"}` {
+				t.Errorf("expected arguments but got %s", body)
+			}
+
+			w.Write([]byte(`{"temperature":21}`))
+		}))
+		defer server.Close()
+
+		remote := &RemoteTool{
+			Name:     "weather",
+			Endpoint: server.URL,
+			Headers:  map[string]string{"X-Api-Key": "secret"},
+			Signer: signFunc(func(req *http.Request, body []byte) error {
+				req.Header.Set("Authorization", "Bearer token")
+				return nil
+			}),
+		}
+
+		out, err := remote.Tool().Executable.Execute(t.Context(), `{"city":"Paris"}`)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if raw, ok := out.(json.RawMessage); !ok || string(raw) != `{"temperature":21}` {
+			t.Errorf("expected relayed response but got %v", out)
+		}
+	})
+
+	t.Run("fails on error status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "no such city", http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		remote := &RemoteTool{Name: "weather", Endpoint: server.URL}
+
+		_, err := remote.Execute(t.Context(), json.RawMessage(`{}`))
+		if !errors.Is(err, ErrRemoteTool) {
+			t.Errorf("expected ErrRemoteTool but got %v", err)
+		}
+	})
+
+	t.Run("retries timed out attempts", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				return
+			}
+			w.Write([]byte(`"ok"`))
+		}))
+		defer server.Close()
+
+		remote := &RemoteTool{Name: "slow", Endpoint: server.URL, Timeout: 50 * time.Millisecond, Attempts: 2}
+
+		out, err := remote.Execute(t.Context(), nil)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if string(out) != `"ok"` || calls.Load() != 2 {
+			t.Errorf("expected a second attempt to succeed but got %s after %d calls", out, calls.Load())
+		}
+	})
+}
@@ -3,6 +3,7 @@ package tool
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/invopop/jsonschema"
 )
@@ -38,6 +39,32 @@ type Tool[T any, S any] struct {
 	Output      JSONSchemaSubset
 	Name        string
 	Description string
+	// Whether providers that support it should enforce strict adherence
+	// to the definition when the model generates arguments. Tools made
+	// through CreateTool are strict unless opted out of.
+	Strict bool
+	// Estimated cost of a single call, see WithCost
+	Cost float64
+	// Estimated time a call takes, see WithLatency
+	Latency time.Duration
+}
+
+// Optional configuration applied to a tool when it is created
+type Option func(*Tool[any, any])
+
+// WithDescription describes what a tool does to the model
+func WithDescription(description string) Option {
+	return func(t *Tool[any, any]) {
+		t.Description = description
+	}
+}
+
+// WithoutStrict opts a tool out of strict argument generation, useful when
+// the definition uses something strict mode can't represent, such as maps.
+func WithoutStrict() Option {
+	return func(t *Tool[any, any]) {
+		t.Strict = false
+	}
 }
 
 // Creates a tool based on some provided function, where it's input/output types are abstracted,
@@ -45,7 +72,12 @@ type Tool[T any, S any] struct {
 //
 // The input T and output S must be marshable to/from JSON, as that is how the
 // abstraction is implemented.
-func CreateTool[T any, S any](name string, fn func(ctx context.Context, in T) (S, error)) Tool[any, any] {
+func CreateTool[T any, S any](name string, fn func(ctx context.Context, in T) (S, error), opts ...Option) Tool[any, any] {
+	return Bind(name, fn, Reflect[T](), opts...)
+}
+
+// Reflect infers the definition of T from its json and jsonschema tags
+func Reflect[T any]() JSONSchemaSubset {
 	// Might be worth removing dependency on this,
 	// famous last words but inferring a schema
 	// should be easy enough as we really just want
@@ -60,19 +92,39 @@ func CreateTool[T any, S any](name string, fn func(ctx context.Context, in T) (S
 	var val T
 	schema := reflector.Reflect(val)
 
-	return Tool[any, any]{
-		Name: name,
+	return JSONSchemaSubset{
+		Properties: schema.Properties,
+		Required:   schema.Required,
+	}
+}
+
+// Bind creates a tool like CreateTool, but with an already known definition
+// rather than one reflected from T. Code generated by clusterfuc-gen uses
+// this, having worked out definitions at build time.
+func Bind[T any, S any](name string, fn func(ctx context.Context, in T) (S, error), definition JSONSchemaSubset, opts ...Option) Tool[any, any] {
+	t := Tool[any, any]{
+		Name:   name,
+		Strict: true,
 		Executable: executableFunc[any, any](func(ctx context.Context, in any) (any, error) {
 			// If our input is a string encoded json blob, we'll have to handle it
 			// slightly differently
 			var arg T
 
-			if inStr, ok := in.(string); ok {
-				err := json.Unmarshal([]byte(inStr), &arg)
+			switch raw := in.(type) {
+			case string:
+				err := json.Unmarshal([]byte(raw), &arg)
+				if err != nil {
+					return nil, err
+				}
+			case json.RawMessage:
+				// Already encoded, no need to round trip it
+				err := json.Unmarshal(raw, &arg)
 				if err != nil {
 					return nil, err
 				}
-			} else {
+			case T:
+				arg = raw
+			default:
 				j, err := json.Marshal(in)
 				if err != nil {
 					return nil, err
@@ -84,18 +136,24 @@ func CreateTool[T any, S any](name string, fn func(ctx context.Context, in T) (S
 				}
 			}
 
-			o, err := fn(ctx, arg)
+			stop := startHeartbeat(ctx, name)
+			defer stop()
+
+			o, err := fn(context.WithValue(ctx, nameKey{}, name), arg)
 			if err != nil {
 				return nil, err
 			}
 
 			return o, nil
 		}),
-		Definition: JSONSchemaSubset{
-			Properties: schema.Properties,
-			Required:   schema.Required,
-		},
+		Definition: definition,
+	}
+
+	for _, opt := range opts {
+		opt(&t)
 	}
+
+	return t
 }
 
 func (t *Tool[T, S]) ValidDefinition() bool {
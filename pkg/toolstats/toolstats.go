@@ -0,0 +1,261 @@
+// Package toolstats tracks how agents use their tools, such as how often each
+// is called, how often it fails, how long it takes and which sessions call it,
+// so unused tools can be pruned and flaky ones found.
+package toolstats
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+)
+
+// Usage of a single tool
+type Stats struct {
+	Tool     string
+	Calls    int64
+	Failures int64
+	// Total time spent running the tool
+	Latency time.Duration
+	// Latency percentiles over the tool's most recent calls
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	// Calls made by each session, see Tracker.MaxSessions
+	Sessions   map[string]int64
+	LastCalled time.Time
+}
+
+func (s Stats) FailureRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+
+	return float64(s.Failures) / float64(s.Calls)
+}
+
+func (s Stats) AverageLatency() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+
+	return s.Latency / time.Duration(s.Calls)
+}
+
+type usage struct {
+	stats Stats
+	// Ring of the most recent latencies, for percentiles
+	recent []time.Duration
+	next   int
+}
+
+// Tracks tool calls across any number of agents
+type Tracker struct {
+	// Recent calls per tool that percentiles are worked out from, defaults
+	// to 1000
+	Window int
+	// Sessions tracked per tool, defaults to 1000. Calls from sessions past
+	// the limit still count, they just aren't attributed to the session.
+	MaxSessions int
+
+	mux   sync.Mutex
+	tools map[string]*usage
+	now   func() time.Time
+}
+
+// Track records every tool call a makes, keeping any tool call hook it
+// already had
+func Track[T model.AIModel](a *agent.Agent[T], t *Tracker) {
+	hook := a.Hooks.OnToolCall
+	a.Hooks.OnToolCall = func(ctx context.Context, input agent.AgentInput, call agent.ToolCall) {
+		t.OnToolCall(ctx, input, call)
+
+		if hook != nil {
+			hook(ctx, input, call)
+		}
+	}
+}
+
+// OnToolCall records a call, matching agent.Hooks.OnToolCall
+func (t *Tracker) OnToolCall(ctx context.Context, input agent.AgentInput, call agent.ToolCall) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if t.tools == nil {
+		t.tools = make(map[string]*usage)
+	}
+
+	u, ok := t.tools[call.Name]
+	if !ok {
+		u = &usage{stats: Stats{Tool: call.Name, Sessions: make(map[string]int64)}}
+		t.tools[call.Name] = u
+	}
+
+	u.stats.Calls++
+	if call.Err != nil {
+		u.stats.Failures++
+	}
+	u.stats.Latency += call.Duration
+	u.stats.LastCalled = t.clock()
+
+	window := t.Window
+	if window <= 0 {
+		window = 1000
+	}
+	if len(u.recent) < window {
+		u.recent = append(u.recent, call.Duration)
+	} else {
+		u.recent[u.next%len(u.recent)] = call.Duration
+		u.next++
+	}
+
+	maxSessions := t.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = 1000
+	}
+	if _, ok := u.stats.Sessions[input.Id]; ok || len(u.stats.Sessions) < maxSessions {
+		u.stats.Sessions[input.Id]++
+	}
+}
+
+// Stats returns the usage of every tool called so far, most called first
+func (t *Tracker) Stats() []Stats {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	stats := make([]Stats, 0, len(t.tools))
+	for _, u := range t.tools {
+		stats = append(stats, u.snapshot())
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Calls != stats[j].Calls {
+			return stats[i].Calls > stats[j].Calls
+		}
+		return stats[i].Tool < stats[j].Tool
+	})
+
+	return stats
+}
+
+// Tool returns the usage of a single tool, false if it hasn't been called
+func (t *Tracker) Tool(name string) (Stats, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	u, ok := t.tools[name]
+	if !ok {
+		return Stats{}, false
+	}
+
+	return u.snapshot(), true
+}
+
+// Unused returns which of the named tools have never been called, such as
+// the tools registered with an agent
+func (t *Tracker) Unused(names ...string) []string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var unused []string
+	for _, name := range names {
+		if _, ok := t.tools[name]; !ok {
+			unused = append(unused, name)
+		}
+	}
+
+	return unused
+}
+
+// Flaky returns the tools failing more often than rate, once they have been
+// called at least minCalls times, most failing first
+func (t *Tracker) Flaky(rate float64, minCalls int64) []Stats {
+	var flaky []Stats
+	for _, s := range t.Stats() {
+		if s.Calls >= minCalls && s.FailureRate() > rate {
+			flaky = append(flaky, s)
+		}
+	}
+
+	sort.SliceStable(flaky, func(i, j int) bool {
+		return flaky[i].FailureRate() > flaky[j].FailureRate()
+	})
+
+	return flaky
+}
+
+// Reset forgets every call recorded so far
+func (t *Tracker) Reset() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.tools = make(map[string]*usage)
+}
+
+// Publish exposes the stats through expvar under name, and so on
+// /debug/vars for anything serving it. Names can only be published once.
+func (t *Tracker) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		stats := t.Stats()
+
+		vars := make(map[string]any, len(stats))
+		for _, s := range stats {
+			vars[s.Tool] = map[string]any{
+				"calls":        s.Calls,
+				"failures":     s.Failures,
+				"failure_rate": s.FailureRate(),
+				"p50_ms":       s.P50.Milliseconds(),
+				"p90_ms":       s.P90.Milliseconds(),
+				"p99_ms":       s.P99.Milliseconds(),
+				"sessions":     len(s.Sessions),
+			}
+		}
+
+		return vars
+	}))
+}
+
+func (t *Tracker) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+
+	return time.Now()
+}
+
+// Copies the usage out, working out percentiles from the recent latencies
+func (u *usage) snapshot() Stats {
+	s := u.stats
+	s.Sessions = make(map[string]int64, len(u.stats.Sessions))
+	for id, calls := range u.stats.Sessions {
+		s.Sessions[id] = calls
+	}
+
+	sorted := slices.Clone(u.recent)
+	slices.Sort(sorted)
+	s.P50 = percentile(sorted, 0.5)
+	s.P90 = percentile(sorted, 0.9)
+	s.P99 = percentile(sorted, 0.99)
+
+	return s
+}
+
+// Nearest rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(float64(len(sorted))*p)) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{tools: make(map[string]*usage)}
+}
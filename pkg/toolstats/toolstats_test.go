@@ -0,0 +1,131 @@
+package toolstats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/memoriser"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func TestTracker(t *testing.T) {
+	t.Run("aggregates calls", func(t *testing.T) {
+		tracker := NewTracker()
+
+		for i := range 10 {
+			call := agent.ToolCall{Name: "search", Duration: time.Duration(i+1) * time.Millisecond}
+			if i%5 == 0 {
+				call.Err = errors.New("boom")
+			}
+			tracker.OnToolCall(t.Context(), agent.AgentInput{Id: []string{"a", "b"}[i%2]}, call)
+		}
+		tracker.OnToolCall(t.Context(), agent.AgentInput{Id: "a"}, agent.ToolCall{Name: "weather"})
+
+		stats := tracker.Stats()
+		if len(stats) != 2 || stats[0].Tool != "search" {
+			t.Fatalf("expected search to be most called but got %v", stats)
+		}
+
+		search := stats[0]
+		if search.Calls != 10 || search.Failures != 2 || search.FailureRate() != 0.2 {
+			t.Errorf("expected 10 calls with 2 failures but got %d and %d", search.Calls, search.Failures)
+		}
+		if search.P50 != 5*time.Millisecond || search.P90 != 9*time.Millisecond || search.P99 != 10*time.Millisecond {
+			t.Errorf("expected percentiles of 5ms, 9ms and 10ms but got %s, %s and %s", search.P50, search.P90, search.P99)
+		}
+		if search.Sessions["a"] != 5 || search.Sessions["b"] != 5 {
+			t.Errorf("expected calls split between sessions but got %v", search.Sessions)
+		}
+
+		if unused := tracker.Unused("search", "weather", "calendar"); !slices.Equal(unused, []string{"calendar"}) {
+			t.Errorf("expected calendar to be unused but got %v", unused)
+		}
+
+		if flaky := tracker.Flaky(0.1, 5); len(flaky) != 1 || flaky[0].Tool != "search" {
+			t.Errorf("expected search to be flaky but got %v", flaky)
+		}
+	})
+
+	t.Run("percentiles use recent calls", func(t *testing.T) {
+		tracker := &Tracker{Window: 3, MaxSessions: 1}
+
+		for i := range 6 {
+			tracker.OnToolCall(t.Context(), agent.AgentInput{Id: string(rune('a' + i))}, agent.ToolCall{Name: "slow", Duration: time.Duration(i) * time.Second})
+		}
+
+		stats, ok := tracker.Tool("slow")
+		if !ok {
+			t.Fatalf("expected stats for slow")
+		}
+
+		if stats.P50 != 4*time.Second || stats.Calls != 6 {
+			t.Errorf("expected median of the last 3 calls but got %s", stats.P50)
+		}
+		if len(stats.Sessions) != 1 {
+			t.Errorf("expected sessions to be capped but got %v", stats.Sessions)
+		}
+	})
+
+	t.Run("tracks agent", func(t *testing.T) {
+		replies := []string{
+			`{"status":"completed","output":[{"type":"function_call","call_id":"call_1","name":"weather","arguments":"{}"}]}`,
+			`{"status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"sunny"}]}]}`,
+		}
+
+		a, _ := agent.NewAgent(model.OpenAiModel("gpt-4o-mini"))
+		a.Memoriser = &memoriser.NoOpMemoriser{}
+		a.OpenAIMiddleware = []openai.Middleware{func(next openai.Handler) openai.Handler {
+			return func(ctx context.Context, body *openai.CreateResponse) (*openai.Response, error) {
+				var resp openai.Response
+				err := json.Unmarshal([]byte(replies[0]), &resp)
+				replies = replies[1:]
+				return &resp, err
+			}
+		}}
+		type City struct {
+			City string `json:"city"`
+		}
+		a.AddTool(tool.CreateTool("weather", func(ctx context.Context, in City) (string, error) {
+			time.Sleep(10 * time.Millisecond)
+			return "sunny", nil
+		}))
+
+		called := false
+		a.Hooks.OnToolCall = func(ctx context.Context, input agent.AgentInput, call agent.ToolCall) {
+			called = true
+		}
+
+		tracker := NewTracker()
+		Track(a, tracker)
+		tracker.Publish("toolstats_test")
+
+		if _, err := a.Call(t.Context(), agent.AgentInput{Id: "session", UserInput: "weather?"}); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		stats, ok := tracker.Tool("weather")
+		if !ok || stats.Calls != 1 || stats.P50 < 10*time.Millisecond || stats.Sessions["session"] != 1 {
+			t.Errorf("expected a timed call from session but got %+v", stats)
+		}
+
+		if !called {
+			t.Errorf("expected existing hook to still be called")
+		}
+
+		var vars map[string]map[string]any
+		if err := json.Unmarshal([]byte(expvar.Get("toolstats_test").String()), &vars); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if vars["weather"]["calls"] != float64(1) {
+			t.Errorf("expected published calls but got %v", vars)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+package clusterfuc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+	"gopkg.in/yaml.v3"
+)
+
+// An agent flavour defined in yaml or json rather than go, so new agents can
+// be made without writing code. For example:
+//
+//	name: support
+//	provider: openai
+//	model: gpt-4o-mini
+//	system_prompt: You help customers with their orders.
+//	tools: [lookup_order, refund_order]
+//	generation:
+//	  max_output_tokens: 800
+type Preset struct {
+	// Defaults to the file name when loaded from a file
+	Name string `json:"name"`
+	// One of openai, openrouter, deepseek, gemini, ollama, mistral, cohere or
+	// huggingface
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	// Ignored when PromptName is set
+	SystemPrompt string `json:"system_prompt"`
+	// Prompt fetched from AgentConfig.Prompts instead of SystemPrompt
+	PromptName    string `json:"prompt_name"`
+	PromptVersion string `json:"prompt_version"`
+	// See agent.Agent.DeveloperMessages
+	DeveloperMessages []string `json:"developer_messages"`
+	// Names of the tools the agent is given, out of those passed to
+	// NewPresetAgent
+	Tools        []string         `json:"tools"`
+	Generation   PresetGeneration `json:"generation"`
+	MaxTurnTools int              `json:"max_turn_tools"`
+	Scratchpad   bool             `json:"scratchpad"`
+	// Where ollama, an openai compatible server, or a huggingface endpoint
+	// is reached
+	OllamaHost          string `json:"ollama_host"`
+	OpenAIBaseURL       string `json:"openai_base_url"`
+	HuggingFaceEndpoint string `json:"huggingface_endpoint"`
+	ChatCompletions     bool   `json:"chat_completions"`
+}
+
+// The agent.GenerationOptions a preset can set
+type PresetGeneration struct {
+	ThinkingBudget   *int     `json:"thinking_budget"`
+	IncludeThoughts  bool     `json:"include_thoughts"`
+	PresencePenalty  *float64 `json:"presence_penalty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty"`
+	Seed             *int     `json:"seed"`
+	MaxOutputTokens  int      `json:"max_output_tokens"`
+	Continuations    int      `json:"continuations"`
+	// One of logprobs or self_assessment
+	Confidence  string `json:"confidence"`
+	ServiceTier string `json:"service_tier"`
+}
+
+// ParsePreset decodes a preset from yaml or json. Unknown fields fail, so a
+// typo doesn't silently leave a setting at its default.
+func ParsePreset(data []byte) (*Preset, error) {
+	var preset Preset
+	if err := decodeConfig(data, &preset); err != nil {
+		return nil, fmt.Errorf("failed to decode preset - %w", errors.Join(err, ErrInvalidPreset))
+	}
+
+	if err := preset.validate(); err != nil {
+		return nil, err
+	}
+
+	return &preset, nil
+}
+
+func (p *Preset) validate() error {
+	if _, err := p.model(); err != nil {
+		return err
+	}
+
+	switch agent.ConfidenceMode(p.Generation.Confidence) {
+	case "", agent.ConfidenceLogprobs, agent.ConfidenceSelfAssessment:
+	default:
+		return fmt.Errorf("preset %s has unknown confidence %q - %w", p.Name, p.Generation.Confidence, ErrInvalidPreset)
+	}
+
+	return nil
+}
+
+// Decodes yaml or json into v, failing on unknown fields. Yaml is a
+// superset of json, so both are decoded as yaml and then handed to
+// encoding/json, keeping to the one set of field names.
+func decodeConfig(data []byte, v any) error {
+	var raw any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// LoadPreset reads a preset from a yaml or json file
+func LoadPreset(path string) (*Preset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	preset, err := ParsePreset(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if preset.Name == "" {
+		preset.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	return preset, nil
+}
+
+// LoadPresets reads every .yaml, .yml and .json file in dir, keyed by
+// preset name. A tool_groups file is skipped, see DirSource.
+func LoadPresets(dir string) (map[string]*Preset, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	presets := map[string]*Preset{}
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if entry.IsDir() || toolGroupsFile(entry.Name()) {
+			continue
+		}
+
+		preset, err := LoadPreset(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := presets[preset.Name]; ok {
+			return nil, fmt.Errorf("preset %s defined twice - %w", preset.Name, ErrInvalidPreset)
+		}
+		presets[preset.Name] = preset
+	}
+
+	return presets, nil
+}
+
+func (p *Preset) model() (model.AIModel, error) {
+	if p.Model == "" {
+		return nil, fmt.Errorf("preset %s has no model - %w", p.Name, ErrInvalidPreset)
+	}
+
+	switch p.Provider {
+	case "openai":
+		return model.OpenAiModel(p.Model), nil
+	case "openrouter":
+		return model.OpenRouterModel(p.Model), nil
+	case "deepseek":
+		return model.DeepSeekModel(p.Model), nil
+	case "gemini":
+		return model.GeminiAiModel(p.Model), nil
+	case "ollama":
+		return model.OllamaModel(p.Model), nil
+	case "mistral":
+		return model.MistralModel(p.Model), nil
+	case "cohere":
+		return model.CohereModel(p.Model), nil
+	case "huggingface":
+		return model.HuggingFaceModel(p.Model), nil
+	}
+
+	return nil, fmt.Errorf("preset %s has unknown provider %q - %w", p.Name, p.Provider, ErrInvalidPreset)
+}
+
+// Config lays the preset over cfg, which supplies everything a preset
+// can't, such as the http client and credentials. Cfg is left unchanged and
+// may be nil.
+func (p *Preset) Config(cfg *AgentConfig) (*AgentConfig, error) {
+	m, err := p.model()
+	if err != nil {
+		return nil, err
+	}
+
+	var out AgentConfig
+	if cfg != nil {
+		out = *cfg
+	}
+
+	out.Model = m
+	out.SystemPrompt = p.SystemPrompt
+	out.DeveloperMessages = p.DeveloperMessages
+	if p.PromptName != "" {
+		out.PromptName = p.PromptName
+		out.PromptVersion = p.PromptVersion
+	}
+	out.Generation = agent.GenerationOptions{
+		ThinkingBudget:   p.Generation.ThinkingBudget,
+		IncludeThoughts:  p.Generation.IncludeThoughts,
+		PresencePenalty:  p.Generation.PresencePenalty,
+		FrequencyPenalty: p.Generation.FrequencyPenalty,
+		Seed:             p.Generation.Seed,
+		MaxOutputTokens:  p.Generation.MaxOutputTokens,
+		// Image output hands back artifacts code has to deal with, so it
+		// stays with cfg
+		ImageOutput:   out.Generation.ImageOutput,
+		Continuations: p.Generation.Continuations,
+		Confidence:    agent.ConfidenceMode(p.Generation.Confidence),
+		ServiceTier:   p.Generation.ServiceTier,
+	}
+	if p.MaxTurnTools > 0 {
+		out.MaxTurnTools = p.MaxTurnTools
+	}
+	out.Scratchpad = out.Scratchpad || p.Scratchpad
+	if p.OllamaHost != "" {
+		out.OllamaHost = p.OllamaHost
+	}
+	if p.OpenAIBaseURL != "" {
+		out.OpenAIBaseURL = p.OpenAIBaseURL
+	}
+	if p.HuggingFaceEndpoint != "" {
+		out.HuggingFaceEndpoint = p.HuggingFaceEndpoint
+	}
+	out.ChatCompletions = out.ChatCompletions || p.ChatCompletions
+
+	return &out, nil
+}
+
+// NewPresetAgent creates an agent from a preset laid over cfg, see
+// Preset.Config. Tools are the ones the preset may name, and only those it
+// names are registered.
+func NewPresetAgent(p *Preset, cfg *AgentConfig, tools ...tool.Tool[any, any]) (*agent.Agent[model.AIModel], error) {
+	config, err := p.Config(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := NewAgent(config)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make(map[string]tool.Tool[any, any], len(tools))
+	for _, t := range tools {
+		available[t.Name] = t
+	}
+
+	for _, name := range p.Tools {
+		t, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("preset %s names unknown tool %s - %w", p.Name, name, ErrInvalidPreset)
+		}
+		if err := a.AddTool(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
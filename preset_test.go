@@ -0,0 +1,88 @@
+package clusterfuc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func TestPresets(t *testing.T) {
+	type Order struct {
+		ID string `json:"id"`
+	}
+	lookup := tool.CreateTool("lookup_order", func(ctx context.Context, in Order) (string, error) { return "shipped", nil })
+	refund := tool.CreateTool("refund_order", func(ctx context.Context, in Order) (string, error) { return "refunded", nil })
+
+	t.Run("yaml and json presets load from a directory", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "support.yaml"), []byte(`
+provider: mistral
+model: mistral-small-latest
+system_prompt: You help customers with their orders.
+tools: [lookup_order]
+generation:
+  max_output_tokens: 800
+  confidence: self_assessment
+`), 0o644)
+		os.WriteFile(filepath.Join(dir, "triage.json"), []byte(`{"name":"triage","provider":"gemini","model":"gemini-2.5-flash","generation":{"thinking_budget":0}}`), 0o644)
+		os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a preset"), 0o644)
+
+		presets, err := LoadPresets(dir)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if len(presets) != 2 {
+			t.Fatalf("expected 2 presets but got %v", presets)
+		}
+
+		a, err := NewPresetAgent(presets["support"], &AgentConfig{Auth: "key"}, lookup, refund)
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if a.Model != model.MistralModel("mistral-small-latest") || a.Auth != "key" || a.SystemPrompt != "You help customers with their orders." {
+			t.Errorf("expected the preset laid over the config but got %+v", a)
+		}
+		if a.Generation.MaxOutputTokens != 800 || a.Generation.Confidence != "self_assessment" {
+			t.Errorf("expected the preset generation options but got %+v", a.Generation)
+		}
+		if err := a.AddTool(lookup); !errors.Is(err, ErrDuplicateTool) {
+			t.Errorf("expected the named tool registered but got %v", err)
+		}
+		if err := a.AddTool(refund); err != nil {
+			t.Errorf("expected the unnamed tool left out but got %v", err)
+		}
+
+		if budget := presets["triage"].Generation.ThinkingBudget; budget == nil || *budget != 0 {
+			t.Errorf("expected a thinking budget of 0 but got %v", budget)
+		}
+	})
+
+	t.Run("invalid presets fail", func(t *testing.T) {
+		for name, data := range map[string]string{
+			"unknown field":    "provider: openai\nmodel: gpt-4o\nsytem_prompt: typo",
+			"unknown provider": "provider: anthropic\nmodel: claude",
+			"missing model":    "provider: openai",
+			"bad confidence":   "provider: openai\nmodel: gpt-4o\ngeneration:\n  confidence: vibes",
+		} {
+			if _, err := ParsePreset([]byte(data)); !errors.Is(err, ErrInvalidPreset) {
+				t.Errorf("%s: expected ErrInvalidPreset but got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("unknown tools fail", func(t *testing.T) {
+		preset, err := ParsePreset([]byte("provider: openai\nmodel: gpt-4o\ntools: [cancel_order]"))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		if _, err := NewPresetAgent(preset, nil, lookup); !errors.Is(err, ErrInvalidPreset) {
+			t.Errorf("expected ErrInvalidPreset but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+package clusterfuc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Prefixes the tools agents hand conversations off with
+const handoffPrefix = "transfer_to_"
+
+// Several presets wired together into one assistant, declared in yaml or
+// json so the whole topology can be reviewed as config. For example:
+//
+//	entry: triage
+//	agents:
+//	  triage:
+//	    provider: openai
+//	    model: gpt-4o-mini
+//	    system_prompt: Work out what the customer needs.
+//	    handoffs: [billing]
+//	  billing:
+//	    provider: openai
+//	    model: gpt-4o
+//	    description: Answers billing questions
+//	    agents: [ledger]
+//	    handoffs: [triage]
+//	  ledger:
+//	    provider: mistral
+//	    model: mistral-small-latest
+//	    description: Looks up account balances
+//	    tools: [lookup_balance]
+type TopologyConfig struct {
+	// Defaults to the file name when loaded from a file
+	Name string `json:"name"`
+	// Agent conversations start with
+	Entry  string                    `json:"entry"`
+	Agents map[string]*TopologyAgent `json:"agents"`
+	// Most handoffs a single call follows, defaults to 3
+	MaxHandoffs int `json:"max_handoffs"`
+}
+
+// A preset taking part in a topology, with the agents it may call on
+type TopologyAgent struct {
+	Preset
+	// Told to agents calling on or handing off to this one
+	Description string `json:"description"`
+	// Agents this one may call as tools, getting their answer back. Must
+	// not loop back round to this agent.
+	Agents []string `json:"agents"`
+	// Agents this one may hand the conversation to. The agent handed to
+	// answers the input, and keeps answering the conversation until it
+	// hands off in turn.
+	Handoffs []string `json:"handoffs"`
+}
+
+// ParseTopology decodes a topology from yaml or json, checking every agent
+// it names is declared
+func ParseTopology(data []byte) (*TopologyConfig, error) {
+	var cfg TopologyConfig
+	if err := decodeConfig(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode topology - %w", errors.Join(err, ErrInvalidPreset))
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// LoadTopology reads a topology from a yaml or json file
+func LoadTopology(path string) (*TopologyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseTopology(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	return cfg, nil
+}
+
+func (c *TopologyConfig) validate() error {
+	if _, ok := c.Agents[c.Entry]; !ok {
+		return fmt.Errorf("topology entry %q is not a declared agent - %w", c.Entry, ErrInvalidPreset)
+	}
+
+	for name, a := range c.Agents {
+		if a.Name == "" {
+			a.Name = name
+		}
+		if err := a.validate(); err != nil {
+			return err
+		}
+
+		for _, other := range slices.Concat(a.Agents, a.Handoffs) {
+			if _, ok := c.Agents[other]; !ok || other == name {
+				return fmt.Errorf("agent %s names %q, which isn't another declared agent - %w", name, other, ErrInvalidPreset)
+			}
+		}
+	}
+
+	// Agents called as tools wait on each other, so a loop would never
+	// return
+	visiting := map[string]bool{}
+	done := map[string]bool{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("agent %s calls back on itself through its agents - %w", name, ErrInvalidPreset)
+		}
+
+		visiting[name] = true
+		for _, other := range c.Agents[name].Agents {
+			if err := visit(other); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+
+		return nil
+	}
+	for name := range c.Agents {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A running topology, routing each conversation to the agent it was last
+// handed to
+type Topology struct {
+	Entry       string
+	Agents      map[string]*agent.Agent[model.AIModel]
+	MaxHandoffs int
+
+	mux sync.Mutex
+	// Agent each conversation was last handed to, by input id
+	active map[string]string
+}
+
+// The outcome of a call through a topology
+type TopologyOutput struct {
+	agent.AgentOutput
+	// Agent that gave the output
+	Agent string
+	// Agents the call was handed through, in order, starting with the one
+	// it began at
+	Path []string
+}
+
+// Carries the handoff asked for during an agent's turn
+type handoffKey struct{}
+
+type handoff struct {
+	to     string
+	reason string
+}
+
+type handoffInput struct {
+	Reason string `json:"reason" jsonschema:"description=Why the conversation is being handed over, passed on to the next agent"`
+}
+
+// NewTopology builds every agent of a topology from its preset laid over
+// cfg, see NewPresetAgent, and wires them together. Tools are those the
+// presets may name.
+func NewTopology(c *TopologyConfig, cfg *AgentConfig, tools ...tool.Tool[any, any]) (*Topology, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	t := &Topology{
+		Entry:       c.Entry,
+		Agents:      make(map[string]*agent.Agent[model.AIModel], len(c.Agents)),
+		MaxHandoffs: c.MaxHandoffs,
+		active:      map[string]string{},
+	}
+	if t.MaxHandoffs <= 0 {
+		t.MaxHandoffs = 3
+	}
+
+	for name, a := range c.Agents {
+		built, err := NewPresetAgent(&a.Preset, cfg, tools...)
+		if err != nil {
+			return nil, err
+		}
+		t.Agents[name] = built
+	}
+
+	for name, a := range c.Agents {
+		for _, other := range a.Agents {
+			callee := t.Agents[other]
+			call := func(ctx context.Context, in agent.AgentInput) (agent.AgentOutput, error) {
+				// Only the agent answering the conversation can hand it off
+				return callee.Call(context.WithValue(ctx, handoffKey{}, (*handoff)(nil)), in)
+			}
+			if err := t.Agents[name].AddTool(tool.CreateTool(other, call, tool.WithDescription(c.Agents[other].Description))); err != nil {
+				return nil, fmt.Errorf("agent %s: %w", name, err)
+			}
+		}
+
+		for _, other := range a.Handoffs {
+			description := "Hand the conversation over to " + other
+			if d := c.Agents[other].Description; d != "" {
+				description += ", which " + strings.ToLower(d[:1]) + d[1:]
+			}
+
+			transfer := tool.CreateTool(handoffPrefix+other, func(ctx context.Context, in handoffInput) (string, error) {
+				if pending, ok := ctx.Value(handoffKey{}).(*handoff); ok && pending != nil {
+					pending.to = other
+					pending.reason = in.Reason
+				}
+				return "handed over to " + other + ", who will answer the user next", nil
+			}, tool.WithDescription(description))
+
+			if err := t.Agents[name].AddTool(transfer); err != nil {
+				return nil, fmt.Errorf("agent %s: %w", name, err)
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// Call answers input with the agent the conversation was last handed to,
+// starting at Entry. Handoffs made during the call are followed straight
+// away, with the agent handed to answering the same input. Every agent
+// keeps its own session, under the input's id suffixed with the agent's
+// name.
+func (t *Topology) Call(ctx context.Context, input agent.AgentInput) (TopologyOutput, error) {
+	t.mux.Lock()
+	current, ok := t.active[input.Id]
+	t.mux.Unlock()
+	if !ok {
+		current = t.Entry
+	}
+
+	var output TopologyOutput
+	var usage agent.Usage
+	// Handoffs received by the current agent, as instructions
+	var handedOver []string
+
+	for {
+		a, ok := t.Agents[current]
+		if !ok {
+			return output, fmt.Errorf("no agent named %s - %w", current, ErrUnknownPreset)
+		}
+		output.Path = append(output.Path, current)
+
+		pending := &handoff{}
+		turn := input
+		turn.Id = input.Id + ":" + current
+		turn.Instructions = slices.Concat(input.Instructions, handedOver)
+
+		out, err := a.Call(context.WithValue(ctx, handoffKey{}, pending), turn)
+		usage = usage.Add(out.Usage)
+		output.AgentOutput = out
+		output.Agent = current
+		output.Usage = usage
+		if err != nil {
+			return output, fmt.Errorf("%s failed to answer - %w", current, err)
+		}
+
+		if pending.to == "" {
+			break
+		}
+		if len(output.Path) > t.MaxHandoffs {
+			return output, fmt.Errorf("call was handed off more than %d times", t.MaxHandoffs)
+		}
+
+		handedOver = []string{fmt.Sprintf("The conversation was handed to you by %s: %s", current, pending.reason)}
+		current = pending.to
+	}
+
+	t.mux.Lock()
+	t.active[input.Id] = current
+	t.mux.Unlock()
+
+	return output, nil
+}
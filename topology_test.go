@@ -0,0 +1,136 @@
+package clusterfuc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/openai"
+)
+
+func TestTopology(t *testing.T) {
+	t.Run("agents call each other and hand off", func(t *testing.T) {
+		var handedOver bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var sent openai.ChatCompletionRequest
+			json.NewDecoder(r.Body).Decode(&sent)
+
+			var system []string
+			for _, message := range sent.Messages {
+				if message.Role == "system" {
+					system = append(system, message.Content)
+				}
+			}
+			answered := sent.Messages[len(sent.Messages)-1].Role == "tool"
+
+			reply := func(text string) {
+				w.Write([]byte(`{"id":"1","choices":[{"finish_reason":"stop","message":{"role":"assistant","content":` + jsonString(text) + `}}]}`))
+			}
+			call := func(name string, args string) {
+				w.Write([]byte(`{"id":"1","choices":[{"finish_reason":"tool_calls","message":{"role":"assistant","tool_calls":[
+					{"id":"call_1","type":"function","function":{"name":"` + name + `","arguments":` + jsonString(args) + `}}
+				]}}]}`))
+			}
+
+			switch {
+			case strings.HasPrefix(system[0], "triage"):
+				if answered {
+					reply("over to billing")
+					return
+				}
+				call("transfer_to_billing", `{"reason":"wants a refund"}`)
+			case strings.HasPrefix(system[0], "billing"):
+				if answered {
+					reply("your refund of 10 is on its way")
+					return
+				}
+				handedOver = handedOver || strings.Contains(strings.Join(system, "\n"), "handed to you by triage: wants a refund")
+				call("ledger", `{"id":"acct","user_input":"balance?"}`)
+			case strings.HasPrefix(system[0], "ledger"):
+				reply("balance 10")
+			default:
+				t.Errorf("unexpected system prompt %v", system)
+			}
+		}))
+		t.Cleanup(srv.Close)
+
+		topology, err := ParseTopology([]byte(`
+entry: triage
+agents:
+  triage:
+    provider: openai
+    model: gpt-4o-mini
+    system_prompt: triage the customer
+    handoffs: [billing]
+  billing:
+    provider: openai
+    model: gpt-4o
+    system_prompt: billing questions
+    description: Answers billing questions
+    agents: [ledger]
+    handoffs: [triage]
+  ledger:
+    provider: openai
+    model: gpt-4o-mini
+    system_prompt: ledger lookups
+    description: Looks up account balances
+`))
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		running, err := NewTopology(topology, &AgentConfig{Client: srv.Client(), OpenAIBaseURL: srv.URL, ChatCompletions: true})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		out, err := running.Call(t.Context(), agent.AgentInput{Id: "conv", UserInput: "refund please"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if out.Output != "your refund of 10 is on its way" || out.Agent != "billing" {
+			t.Errorf("expected billing to answer but got %q from %s", out.Output, out.Agent)
+		}
+		if !slices.Equal(out.Path, []string{"triage", "billing"}) {
+			t.Errorf("expected the call handed from triage to billing but got %v", out.Path)
+		}
+		if !handedOver {
+			t.Errorf("expected billing told why it was handed the conversation")
+		}
+
+		// The conversation stays with billing
+		out, err = running.Call(t.Context(), agent.AgentInput{Id: "conv", UserInput: "thanks"})
+		if err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if !slices.Equal(out.Path, []string{"billing"}) {
+			t.Errorf("expected billing to keep the conversation but got %v", out.Path)
+		}
+	})
+
+	t.Run("invalid topologies fail", func(t *testing.T) {
+		agents := "  a:\n    provider: openai\n    model: gpt-4o\n    agents: [b]\n  b:\n    provider: openai\n    model: gpt-4o\n"
+		for name, data := range map[string]string{
+			"missing entry":   "entry: c\nagents:\n" + agents,
+			"unknown agent":   "entry: a\nagents:\n" + agents + "    handoffs: [c]\n",
+			"agents loop":     "entry: a\nagents:\n" + agents + "    agents: [a]\n",
+			"invalid preset":  "entry: a\nagents:\n  a:\n    provider: anthropic\n    model: claude\n",
+			"unknown field":   "entry: a\nagents:\n" + agents + "    handof: [a]\n",
+			"handoff to self": "entry: a\nagents:\n" + agents + "    handoffs: [b]\n",
+		} {
+			if _, err := ParseTopology([]byte(data)); !errors.Is(err, ErrInvalidPreset) {
+				t.Errorf("%s: expected ErrInvalidPreset but got %v", name, err)
+			}
+		}
+	})
+}
+
+func jsonString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
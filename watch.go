@@ -0,0 +1,268 @@
+package clusterfuc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/httpclient"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+// Presets along with the tool groups they may name
+type PresetBundle struct {
+	Presets map[string]*Preset `json:"presets"`
+	// Named sets of tools, which a preset gets all of by listing the
+	// group's name in its Tools
+	ToolGroups map[string][]string `json:"tool_groups"`
+}
+
+// Where a PresetWatcher loads presets from, checked again on every reload
+type PresetSource interface {
+	Load(ctx context.Context) (PresetBundle, error)
+}
+
+// Presets in a directory, see LoadPresets, with tool groups in a
+// tool_groups.yaml, .yml or .json file mapping group names to tool names. A
+// kubernetes ConfigMap mounted as a volume is such a directory, and is
+// updated in place when the map changes.
+type DirSource string
+
+func toolGroupsFile(name string) bool {
+	return strings.TrimSuffix(name, filepath.Ext(name)) == "tool_groups"
+}
+
+func (d DirSource) Load(ctx context.Context) (PresetBundle, error) {
+	presets, err := LoadPresets(string(d))
+	if err != nil {
+		return PresetBundle{}, err
+	}
+	bundle := PresetBundle{Presets: presets}
+
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		data, err := os.ReadFile(filepath.Join(string(d), "tool_groups"+ext))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return PresetBundle{}, err
+		}
+
+		if err := decodeConfig(data, &bundle.ToolGroups); err != nil {
+			return PresetBundle{}, fmt.Errorf("failed to decode tool groups - %w", errors.Join(err, ErrInvalidPreset))
+		}
+		break
+	}
+
+	return bundle, nil
+}
+
+// Presets served over http as a single yaml or json PresetBundle, e.g.
+//
+//	presets:
+//	  support:
+//	    provider: openai
+//	    model: gpt-4o-mini
+//	    tools: [orders]
+//	tool_groups:
+//	  orders: [lookup_order, refund_order]
+type HTTPSource struct {
+	URL string
+	// Defaults to httpclient.Default
+	Client *http.Client
+	// Sent with every request, such as for authorization
+	Header http.Header
+}
+
+func (s *HTTPSource) Load(ctx context.Context) (PresetBundle, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return PresetBundle{}, fmt.Errorf("failed to create HTTP request - %w", err)
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+
+	client := s.Client
+	if client == nil {
+		client = httpclient.Default()
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return PresetBundle{}, fmt.Errorf("HTTP request failed - %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(httpclient.LimitReader(resp.Body, httpclient.DefaultMaxResponseBytes))
+	if err != nil {
+		return PresetBundle{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return PresetBundle{}, fmt.Errorf("unexpected status %d loading presets from %s", resp.StatusCode, s.URL)
+	}
+
+	var raw struct {
+		Presets    map[string]json.RawMessage `json:"presets"`
+		ToolGroups map[string][]string        `json:"tool_groups"`
+	}
+	if err := decodeConfig(data, &raw); err != nil {
+		return PresetBundle{}, fmt.Errorf("failed to decode presets - %w", errors.Join(err, ErrInvalidPreset))
+	}
+
+	bundle := PresetBundle{Presets: make(map[string]*Preset, len(raw.Presets)), ToolGroups: raw.ToolGroups}
+	for name, data := range raw.Presets {
+		preset, err := ParsePreset(data)
+		if err != nil {
+			return PresetBundle{}, fmt.Errorf("%s: %w", name, err)
+		}
+		if preset.Name == "" {
+			preset.Name = name
+		}
+		bundle.Presets[name] = preset
+	}
+
+	return bundle, nil
+}
+
+// Keeps agents built from presets up to date with their source, so they
+// can be changed without restarting the process. Each reload swaps in a
+// whole new set of agents at once. Calls already holding an agent finish
+// with it, while new calls get the new one.
+type PresetWatcher struct {
+	Source PresetSource
+	// Config every preset is laid over, see Preset.Config
+	Config *AgentConfig
+	// Tools presets may name
+	Tools []tool.Tool[any, any]
+	// Optionally adjusts each agent once built, such as giving it a
+	// Memoriser. An error fails the reload.
+	Configure func(name string, a *agent.Agent[model.AIModel]) error
+	// Optionally called after every reload, with the error that left the
+	// previous agents in place
+	OnReload func(err error)
+
+	// Serializes reloads
+	mux     sync.Mutex
+	current atomic.Pointer[presetAgents]
+}
+
+type presetAgents struct {
+	// Of the bundle the agents were built from, so unchanged bundles
+	// aren't rebuilt
+	fingerprint [sha256.Size]byte
+	agents      map[string]*agent.Agent[model.AIModel]
+}
+
+func NewPresetWatcher(source PresetSource, cfg *AgentConfig, tools ...tool.Tool[any, any]) *PresetWatcher {
+	return &PresetWatcher{Source: source, Config: cfg, Tools: tools}
+}
+
+// Agent returns the current agent of a preset. Hold on to it for the
+// length of a call, so the call sees a single config throughout.
+func (w *PresetWatcher) Agent(name string) (*agent.Agent[model.AIModel], bool) {
+	current := w.current.Load()
+	if current == nil {
+		return nil, false
+	}
+
+	a, ok := current.agents[name]
+	return a, ok
+}
+
+// Call calls the current agent of a preset
+func (w *PresetWatcher) Call(ctx context.Context, name string, input agent.AgentInput) (agent.AgentOutput, error) {
+	a, ok := w.Agent(name)
+	if !ok {
+		return agent.AgentOutput{}, fmt.Errorf("no preset named %s - %w", name, ErrUnknownPreset)
+	}
+
+	return a.Call(ctx, input)
+}
+
+// Reload loads the source and swaps in agents built from it. Nothing is
+// swapped unless every preset builds, leaving the previous agents serving
+// calls.
+func (w *PresetWatcher) Reload(ctx context.Context) (err error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.OnReload != nil {
+		defer func() { w.OnReload(err) }()
+	}
+
+	bundle, err := w.Source.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint presets - %w", err)
+	}
+	fingerprint := sha256.Sum256(encoded)
+	if current := w.current.Load(); current != nil && current.fingerprint == fingerprint {
+		return nil
+	}
+
+	agents := make(map[string]*agent.Agent[model.AIModel], len(bundle.Presets))
+	for name, preset := range bundle.Presets {
+		expanded := *preset
+		expanded.Tools = nil
+		for _, t := range preset.Tools {
+			if group, ok := bundle.ToolGroups[t]; ok {
+				expanded.Tools = append(expanded.Tools, group...)
+			} else {
+				expanded.Tools = append(expanded.Tools, t)
+			}
+		}
+
+		a, err := NewPresetAgent(&expanded, w.Config, w.Tools...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if w.Configure != nil {
+			if err := w.Configure(name, a); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		agents[name] = a
+	}
+
+	w.current.Store(&presetAgents{fingerprint: fingerprint, agents: agents})
+	slog.InfoContext(ctx, "reloaded presets", slog.Int("presets", len(agents)))
+
+	return nil
+}
+
+// Watch reloads every interval until ctx is done, starting with a reload
+// straight away. Failed reloads are logged and retried at the next interval.
+func (w *PresetWatcher) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Reload(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to reload presets", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
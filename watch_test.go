@@ -0,0 +1,107 @@
+package clusterfuc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/calamity-m/clusterfuc/pkg/agent"
+	"github.com/calamity-m/clusterfuc/pkg/model"
+	"github.com/calamity-m/clusterfuc/pkg/tool"
+)
+
+func TestPresetWatcher(t *testing.T) {
+	type Order struct {
+		ID string `json:"id"`
+	}
+	lookup := tool.CreateTool("lookup_order", func(ctx context.Context, in Order) (string, error) { return "shipped", nil })
+	refund := tool.CreateTool("refund_order", func(ctx context.Context, in Order) (string, error) { return "refunded", nil })
+
+	t.Run("reloads swap agents while held agents keep their config", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name string, data string) {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+				t.Fatalf("did not expect err but got %v", err)
+			}
+		}
+		write("support.yaml", "provider: openai\nmodel: gpt-4o-mini\ntools: [orders]")
+		write("tool_groups.yaml", "orders: [lookup_order, refund_order]")
+
+		var reloads []error
+		w := NewPresetWatcher(DirSource(dir), nil, lookup, refund)
+		w.OnReload = func(err error) { reloads = append(reloads, err) }
+
+		if err := w.Reload(t.Context()); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		held, ok := w.Agent("support")
+		if !ok {
+			t.Fatalf("expected the support preset to be loaded")
+		}
+		if err := held.AddTool(refund); !errors.Is(err, ErrDuplicateTool) {
+			t.Errorf("expected the group's tools registered but got %v", err)
+		}
+
+		// Unchanged presets keep their agents
+		if err := w.Reload(t.Context()); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+		if again, _ := w.Agent("support"); again != held {
+			t.Errorf("expected an unchanged preset to keep its agent")
+		}
+
+		write("support.yaml", "provider: openai\nmodel: gpt-4o\ntools: [lookup_order]")
+		if err := w.Reload(t.Context()); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		reloaded, _ := w.Agent("support")
+		if reloaded.Model != model.OpenAiModel("gpt-4o") {
+			t.Errorf("expected the new model but got %v", reloaded.Model)
+		}
+		if held.Model != model.OpenAiModel("gpt-4o-mini") {
+			t.Errorf("expected the held agent to keep its config but got %v", held.Model)
+		}
+
+		write("support.yaml", "provider: openai\nmodel: gpt-4o\ntools: [cancel_order]")
+		if err := w.Reload(t.Context()); !errors.Is(err, ErrInvalidPreset) {
+			t.Errorf("expected ErrInvalidPreset but got %v", err)
+		}
+		if current, _ := w.Agent("support"); current != reloaded {
+			t.Errorf("expected a failed reload to leave the previous agent serving")
+		}
+
+		if len(reloads) != 4 || reloads[3] == nil {
+			t.Errorf("expected every reload reported but got %v", reloads)
+		}
+	})
+
+	t.Run("http source", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"presets":{"triage":{"provider":"gemini","model":"gemini-2.5-flash","system_prompt":"sort it"}}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		w := NewPresetWatcher(&HTTPSource{URL: srv.URL, Header: http.Header{"Authorization": {"Bearer token"}}}, nil)
+		if err := w.Reload(t.Context()); err != nil {
+			t.Fatalf("did not expect err but got %v", err)
+		}
+
+		a, ok := w.Agent("triage")
+		if !ok || a.SystemPrompt != "sort it" {
+			t.Errorf("expected the triage preset but got %+v", a)
+		}
+
+		if _, err := w.Call(t.Context(), "missing", agent.AgentInput{Id: "id", UserInput: "hi"}); !errors.Is(err, ErrUnknownPreset) {
+			t.Errorf("expected ErrUnknownPreset but got %v", err)
+		}
+	})
+}